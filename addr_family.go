@@ -0,0 +1,125 @@
+package dht
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru/simplelru"
+	"github.com/libp2p/go-libp2p-core/peer"
+	pstore "github.com/libp2p/go-libp2p-core/peerstore"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// addrFamilyWithheldEntries is the number of lookup candidates whose addresses
+// of the other family are remembered until they are dialed.
+const addrFamilyWithheldEntries = 4096
+
+// addrFamilyPreference applies an address family policy, see
+// AddressFamilyPreference. A nil preference treats all addresses alike.
+type addrFamilyPreference struct {
+	policy        AddrFamilyPolicy
+	fallbackDelay time.Duration
+
+	mu sync.Mutex
+	// the addresses of the other family withheld from the peerstore, by
+	// lookup candidate
+	withheld *lru.LRU
+}
+
+func newAddrFamilyPreference(policy AddrFamilyPolicy, fallbackDelay time.Duration) *addrFamilyPreference {
+	if policy == NoAddrFamilyPreference {
+		return nil
+	}
+	// can only fail on a non-positive size
+	withheld, _ := lru.NewLRU(addrFamilyWithheldEntries, nil)
+	return &addrFamilyPreference{policy: policy, fallbackDelay: fallbackDelay, withheld: withheld}
+}
+
+// preferred reports whether a is of the preferred family, or of none.
+func (af *addrFamilyPreference) preferred(a ma.Multiaddr) bool {
+	c, _ := ma.SplitFirst(a)
+	if c == nil {
+		return true
+	}
+	switch c.Protocol().Code {
+	case ma.P_IP4, ma.P_DNS4:
+		return af.policy == PreferIPv4
+	case ma.P_IP6, ma.P_DNS6:
+		return af.policy == PreferIPv6
+	}
+	return true
+}
+
+// split separates the addresses of the preferred family from the others. All
+// the addresses are preferred if none is.
+func (af *addrFamilyPreference) split(addrs []ma.Multiaddr) (preferred, others []ma.Multiaddr) {
+	for _, a := range addrs {
+		if af.preferred(a) {
+			preferred = append(preferred, a)
+		} else {
+			others = append(others, a)
+		}
+	}
+	if len(preferred) == 0 {
+		return others, nil
+	}
+	return preferred, others
+}
+
+// addCandidateAddrs adds the addresses of a lookup candidate to the peerstore,
+// withholding the ones of the other family until it is dialed.
+func (dht *IpfsDHT) addCandidateAddrs(p peer.ID, addrs []ma.Multiaddr) {
+	af := dht.addrFamily
+	if af == nil {
+		dht.maybeAddAddrs(p, addrs, pstore.TempAddrTTL)
+		return
+	}
+
+	preferred, others := af.split(addrs)
+	dht.maybeAddAddrs(p, preferred, pstore.TempAddrTTL)
+	if len(others) > 0 {
+		af.mu.Lock()
+		af.withheld.Add(p, others)
+		af.mu.Unlock()
+	}
+}
+
+// connect dials p. If addresses of the other family were withheld, they are
+// dialed too once dialing the preferred ones fails or takes longer than the
+// fallback delay.
+func (dht *IpfsDHT) connect(ctx context.Context, p peer.ID) error {
+	af := dht.addrFamily
+	if af == nil {
+		return dht.host.Connect(ctx, peer.AddrInfo{ID: p})
+	}
+	af.mu.Lock()
+	v, ok := af.withheld.Get(p)
+	af.withheld.Remove(p)
+	af.mu.Unlock()
+	if !ok {
+		return dht.host.Connect(ctx, peer.AddrInfo{ID: p})
+	}
+
+	first := make(chan error, 1)
+	go func() {
+		first <- dht.host.Connect(ctx, peer.AddrInfo{ID: p})
+	}()
+	var fallback <-chan time.Time
+	if af.fallbackDelay > 0 {
+		timer := time.NewTimer(af.fallbackDelay)
+		defer timer.Stop()
+		fallback = timer.C
+	}
+	select {
+	case err := <-first:
+		if err == nil || ctx.Err() != nil {
+			return err
+		}
+	case <-fallback:
+		// the swarm merges both dials, the first connection wins
+	}
+
+	dht.maybeAddAddrs(p, v.([]ma.Multiaddr), pstore.TempAddrTTL)
+	return dht.host.Connect(ctx, peer.AddrInfo{ID: p})
+}
@@ -0,0 +1,86 @@
+package dht
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru/simplelru"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"go.opencensus.io/stats"
+
+	"github.com/libp2p/go-libp2p-kad-dht/metrics"
+	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
+)
+
+// defaultCloserPeersCacheSize is the number of keys whose closer peers are
+// cached when no size is configured.
+const defaultCloserPeersCacheSize = 1024
+
+// closerPeersCache remembers the closer peers we answered recently requested
+// keys with, so that storms of requests for a popular key don't each walk the
+// routing table and the peerstore. A nil cache caches nothing.
+type closerPeersCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries *lru.LRU
+}
+
+type closerPeersEntry struct {
+	peers   []pb.Message_Peer
+	expires time.Time
+}
+
+func newCloserPeersCache(ttl time.Duration, size int) *closerPeersCache {
+	if ttl == 0 {
+		return nil
+	}
+	if size == 0 {
+		size = defaultCloserPeersCacheSize
+	}
+	// can only fail on a non-positive size
+	entries, _ := lru.NewLRU(size, nil)
+	return &closerPeersCache{ttl: ttl, entries: entries}
+}
+
+// get returns the closer peers for key, computed by compute, for a request
+// from the given peer. Cached answers are computed for no peer in particular,
+// and the requester is left out of them on the way out, as compute does.
+func (c *closerPeersCache) get(ctx context.Context, key string, from peer.ID, compute func(from peer.ID) []pb.Message_Peer) []pb.Message_Peer {
+	if c == nil {
+		return compute(from)
+	}
+
+	now := time.Now()
+	c.mu.Lock()
+	v, ok := c.entries.Get(key)
+	c.mu.Unlock()
+	if ok {
+		if e := v.(closerPeersEntry); now.Before(e.expires) {
+			stats.Record(ctx, metrics.CloserPeersCacheHits.M(1))
+			return withoutPeer(e.peers, from)
+		}
+	}
+
+	stats.Record(ctx, metrics.CloserPeersCacheMisses.M(1))
+	peers := compute("")
+	c.mu.Lock()
+	c.entries.Add(key, closerPeersEntry{peers: peers, expires: now.Add(c.ttl)})
+	c.mu.Unlock()
+	return withoutPeer(peers, from)
+}
+
+// withoutPeer returns a copy of peers without p, which callers may modify.
+func withoutPeer(peers []pb.Message_Peer, p peer.ID) []pb.Message_Peer {
+	if peers == nil {
+		return nil
+	}
+	out := make([]pb.Message_Peer, 0, len(peers))
+	for _, pbp := range peers {
+		if peer.ID(pbp.Id) != p {
+			out = append(out, pbp)
+		}
+	}
+	return out
+}
@@ -0,0 +1,116 @@
+package dht
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	kb "github.com/libp2p/go-libp2p-kbucket"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/tag"
+
+	"github.com/libp2p/go-libp2p-kad-dht/metrics"
+)
+
+// CplCoverage describes how well the routing table covers the peers sharing a
+// common prefix of Cpl bits with us, see KeyspaceCoverage.
+type CplCoverage struct {
+	Cpl int
+	// Peers is the number of peers of the routing table at Cpl.
+	Peers int
+	// Expected is the number of peers expected at Cpl, at most the bucket
+	// size, given the estimated size of the network, see NetworkSize. It is
+	// the bucket size if the size of the network isn't known yet.
+	Expected float64
+	// Sparse is set if the routing table holds at most half of the expected
+	// peers at Cpl, which refreshing the routing table should fill in.
+	Sparse bool
+	// Overfull is set if the routing table holds far more peers at Cpl than
+	// the network is expected to have, which is the symptom of an eclipse
+	// attack: peers crafting their IDs to get close to us.
+	Overfull bool
+}
+
+// KeyspaceCoverage reports, by common prefix length with us, how well the
+// routing table covers the keyspace, from 0 to the deepest of the last common
+// prefix length holding peers and of the last one expected to.
+func (dht *IpfsDHT) KeyspaceCoverage() []CplCoverage {
+	var peers []int
+	for _, p := range dht.routingTable.ListPeers() {
+		cpl := kb.CommonPrefixLen(dht.selfKey, kb.ConvertPeerID(p))
+		for len(peers) <= cpl {
+			peers = append(peers, 0)
+		}
+		peers[cpl]++
+	}
+
+	n, err := dht.NetworkSize()
+	known := err == nil
+	var coverage []CplCoverage
+	for cpl := 0; ; cpl++ {
+		expected := float64(dht.bucketSize)
+		if known {
+			// half of the other peers of the network share no bit with us,
+			// a quarter one, ...
+			expected = math.Min(expected, float64(n-1)/math.Exp2(float64(cpl+1)))
+		}
+		if cpl >= len(peers) && (!known || expected < 1) {
+			return coverage
+		}
+
+		c := CplCoverage{Cpl: cpl, Expected: expected}
+		if cpl < len(peers) {
+			c.Peers = peers[cpl]
+		}
+		c.Sparse = float64(c.Peers) <= expected/2
+		// allowing for the deviation of the number of peers there
+		c.Overfull = known && float64(c.Peers) > expected+3*math.Sqrt(expected)+1
+		coverage = append(coverage, c)
+	}
+}
+
+// recordKeyspaceCoverage records the number of peers of the routing table by
+// common prefix length, zero up to the deepest one last recorded.
+func (dht *IpfsDHT) recordKeyspaceCoverage(lastCpls int) int {
+	coverage := dht.KeyspaceCoverage()
+	for cpl := 0; cpl < len(coverage) || cpl < lastCpls; cpl++ {
+		peers := 0
+		if cpl < len(coverage) {
+			peers = coverage[cpl].Peers
+		}
+		_ = stats.RecordWithTags(dht.ctx, []tag.Mutator{tag.Upsert(metrics.KeyCpl, strconv.Itoa(cpl))},
+			metrics.RoutingTableCplPeers.M(int64(peers)),
+		)
+	}
+	return len(coverage)
+}
+
+// coverageBarWidth is the width of the bar of a full bucket in the histogram
+// served at /coverage.
+const coverageBarWidth = 40
+
+func (dht *IpfsDHT) serveDebugCoverage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "%4s %6s %8s\n", "cpl", "peers", "expected")
+	for _, c := range dht.KeyspaceCoverage() {
+		bar := strings.Repeat("#", c.Peers*coverageBarWidth/dht.bucketSize)
+		var note string
+		switch {
+		case c.Overfull:
+			note = " overfull"
+		case c.Sparse:
+			note = " sparse"
+		}
+		fmt.Fprintf(&b, "%4d %6d %8.1f %s%s\n", c.Cpl, c.Peers, c.Expected, bar, note)
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if _, err := w.Write([]byte(b.String())); err != nil {
+		logger.Debugw("failed to write keyspace coverage", "error", err)
+	}
+}
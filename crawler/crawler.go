@@ -15,6 +15,7 @@ import (
 
 	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
 	kbucket "github.com/libp2p/go-libp2p-kbucket"
+	ma "github.com/multiformats/go-multiaddr"
 )
 
 var logger = logging.Logger("dht-crawler")
@@ -121,8 +122,95 @@ type HandleQueryFail func(p peer.ID, err error)
 
 const dialAddressExtendDur time.Duration = time.Minute * 30
 
+// CrawledPeer describes a peer the crawler queried, see Crawl.
+type CrawledPeer struct {
+	ID peer.ID
+	// Addrs are the addresses of the peer known to the crawler.
+	Addrs []ma.Multiaddr
+	// AgentVersion is the agent version the peer identified itself with, if
+	// the crawler connected to it and it did.
+	AgentVersion string
+	// Connected is set if the crawler connected to the peer.
+	Connected bool
+	// RTPeers are the peers of the routing table of the peer, if it answered,
+	// and Err the error connecting to or querying it otherwise.
+	RTPeers []*peer.AddrInfo
+	Err     error
+}
+
+// Progress describes the progress of a crawl, see Crawl.
+type Progress struct {
+	// Seen is the number of peers the crawl found, including the starting
+	// peers, Queried the number of those it queried, and Pending the number
+	// of those it didn't yet or is waiting on.
+	Seen, Queried, Pending int
+	// Succeeded and Failed are the numbers of peers that answered and that
+	// the crawler failed to connect to or to query.
+	Succeeded, Failed int
+}
+
+// Crawl crawls dht peers from an initial seed of startingPeers, like Run, calling
+// handlePeer, if not nil, with each peer queried, e.g. to record the network
+// for measurements. The progress of the crawl is reported on the returned
+// channel after every peer, the updates the receiver didn't keep up with being
+// replaced by the last one. The channel is closed once the crawl ends, with
+// the final progress left in it.
+func (c *Crawler) Crawl(ctx context.Context, startingPeers []*peer.AddrInfo, handlePeer func(*CrawledPeer)) <-chan Progress {
+	progress := make(chan Progress, 1)
+	go func() {
+		defer close(progress)
+		c.crawl(ctx, startingPeers, func(res *queryResult) {
+			if handlePeer != nil {
+				handlePeer(c.crawledPeer(res))
+			}
+		}, func(p Progress) {
+			// replace the update not received yet, if any
+			select {
+			case <-progress:
+			default:
+			}
+			progress <- p
+		})
+	}()
+	return progress
+}
+
+func (c *Crawler) crawledPeer(res *queryResult) *CrawledPeer {
+	cp := &CrawledPeer{
+		ID:        res.peer,
+		Addrs:     c.host.Peerstore().Addrs(res.peer),
+		Connected: res.connected,
+		Err:       res.err,
+	}
+	if av, err := c.host.Peerstore().Get(res.peer, "AgentVersion"); err == nil {
+		cp.AgentVersion, _ = av.(string)
+	}
+	for _, ai := range res.data {
+		cp.RTPeers = append(cp.RTPeers, ai)
+	}
+	return cp
+}
+
 // Run crawls dht peers from an initial seed of `startingPeers`
 func (c *Crawler) Run(ctx context.Context, startingPeers []*peer.AddrInfo, handleSuccess HandleQueryResult, handleFail HandleQueryFail) {
+	c.crawl(ctx, startingPeers, func(res *queryResult) {
+		if len(res.data) > 0 {
+			if handleSuccess != nil {
+				rtPeers := make([]*peer.AddrInfo, 0, len(res.data))
+				for _, ai := range res.data {
+					rtPeers = append(rtPeers, ai)
+				}
+				handleSuccess(res.peer, rtPeers)
+			}
+		} else if handleFail != nil {
+			handleFail(res.peer, res.err)
+		}
+	}, nil)
+}
+
+// crawl crawls from startingPeers, calling handle with the result of every peer
+// queried, and progress, if not nil, after it.
+func (c *Crawler) crawl(ctx context.Context, startingPeers []*peer.AddrInfo, handle func(*queryResult), progress func(Progress)) {
 	jobs := make(chan peer.ID, 1)
 	results := make(chan *queryResult, 1)
 
@@ -167,6 +255,7 @@ func (c *Crawler) Run(ctx context.Context, startingPeers []*peer.AddrInfo, handl
 
 	numQueried := 0
 	outstanding := 0
+	numSucceeded, numFailed := 0, 0
 
 	for len(toDial) > 0 || outstanding > 0 {
 		var jobCh chan peer.ID
@@ -180,22 +269,30 @@ func (c *Crawler) Run(ctx context.Context, startingPeers []*peer.AddrInfo, handl
 		case res := <-results:
 			if len(res.data) > 0 {
 				logger.Debugf("peer %v had %d peers", res.peer, len(res.data))
-				rtPeers := make([]*peer.AddrInfo, 0, len(res.data))
 				for p, ai := range res.data {
 					c.host.Peerstore().AddAddrs(p, ai.Addrs, dialAddressExtendDur)
 					if _, ok := peersSeen[p]; !ok {
 						peersSeen[p] = struct{}{}
 						toDial = append(toDial, ai)
 					}
-					rtPeers = append(rtPeers, ai)
 				}
-				if handleSuccess != nil {
-					handleSuccess(res.peer, rtPeers)
-				}
-			} else if handleFail != nil {
-				handleFail(res.peer, res.err)
 			}
+			if res.err == nil {
+				numSucceeded++
+			} else {
+				numFailed++
+			}
+			handle(res)
 			outstanding--
+			if progress != nil {
+				progress(Progress{
+					Seen:      len(peersSeen),
+					Queried:   numQueried,
+					Pending:   len(toDial) + outstanding,
+					Succeeded: numSucceeded,
+					Failed:    numFailed,
+				})
+			}
 		case jobCh <- nextPeerID:
 			outstanding++
 			numQueried++
@@ -206,16 +303,17 @@ func (c *Crawler) Run(ctx context.Context, startingPeers []*peer.AddrInfo, handl
 }
 
 type queryResult struct {
-	peer peer.ID
-	data map[peer.ID]*peer.AddrInfo
-	err  error
+	peer      peer.ID
+	data      map[peer.ID]*peer.AddrInfo
+	err       error
+	connected bool
 }
 
 func (c *Crawler) queryPeer(ctx context.Context, nextPeer peer.ID) *queryResult {
 	tmpRT, err := kbucket.NewRoutingTable(20, kbucket.ConvertPeerID(nextPeer), time.Hour, c.host.Peerstore(), time.Hour, nil)
 	if err != nil {
 		logger.Errorf("error creating rt for peer %v : %v", nextPeer, err)
-		return &queryResult{nextPeer, nil, err}
+		return &queryResult{nextPeer, nil, err, false}
 	}
 
 	connCtx, cancel := context.WithTimeout(ctx, c.connectTimeout)
@@ -223,7 +321,7 @@ func (c *Crawler) queryPeer(ctx context.Context, nextPeer peer.ID) *queryResult
 	err = c.host.Connect(connCtx, peer.AddrInfo{ID: nextPeer})
 	if err != nil {
 		logger.Debugf("could not connect to peer %v: %v", nextPeer, err)
-		return &queryResult{nextPeer, nil, err}
+		return &queryResult{nextPeer, nil, err, false}
 	}
 
 	localPeers := make(map[peer.ID]*peer.AddrInfo)
@@ -247,8 +345,8 @@ func (c *Crawler) queryPeer(ctx context.Context, nextPeer peer.ID) *queryResult
 	}
 
 	if retErr != nil {
-		return &queryResult{nextPeer, nil, retErr}
+		return &queryResult{nextPeer, nil, retErr, true}
 	}
 
-	return &queryResult{nextPeer, localPeers, retErr}
+	return &queryResult{nextPeer, localPeers, retErr, true}
 }
@@ -0,0 +1,72 @@
+package crawler
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	coretest "github.com/libp2p/go-libp2p-core/test"
+	swarmt "github.com/libp2p/go-libp2p-swarm/testing"
+	bhost "github.com/libp2p/go-libp2p/p2p/host/basic"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/require"
+
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+)
+
+func TestCrawl(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dhts := make([]*dht.IpfsDHT, 4)
+	for i := range dhts {
+		h, err := bhost.NewHost(ctx, swarmt.GenSwarm(t, ctx, swarmt.OptDisableReuseport), new(bhost.HostOpts))
+		require.NoError(t, err)
+		defer h.Close()
+		d, err := dht.New(ctx, h, dht.Mode(dht.ModeServer), dht.DisableAutoRefresh())
+		require.NoError(t, err)
+		defer d.Close()
+		dhts[i] = d
+	}
+	for i := 1; i < len(dhts); i++ {
+		a, b := dhts[i-1].Host(), dhts[i].Host()
+		require.NoError(t, a.Connect(ctx, peer.AddrInfo{ID: b.ID(), Addrs: b.Addrs()}))
+		require.Eventually(t, func() bool {
+			return dhts[i-1].RoutingTable().Find(b.ID()) != "" && dhts[i].RoutingTable().Find(a.ID()) != ""
+		}, 5*time.Second, 10*time.Millisecond)
+	}
+
+	h, err := bhost.NewHost(ctx, swarmt.GenSwarm(t, ctx, swarmt.OptDisableReuseport), new(bhost.HostOpts))
+	require.NoError(t, err)
+	defer h.Close()
+	c, err := New(h, WithParallelism(2), WithConnectTimeout(time.Second))
+	require.NoError(t, err)
+
+	unreachable := &peer.AddrInfo{
+		ID:    coretest.RandPeerIDFatal(t),
+		Addrs: []ma.Multiaddr{ma.StringCast("/ip4/127.0.0.1/tcp/1")},
+	}
+	seed := &peer.AddrInfo{ID: dhts[0].Host().ID(), Addrs: dhts[0].Host().Addrs()}
+	crawled := make(map[peer.ID]*CrawledPeer)
+	progress := c.Crawl(ctx, []*peer.AddrInfo{seed, unreachable}, func(cp *CrawledPeer) {
+		crawled[cp.ID] = cp
+	})
+	var last Progress
+	for p := range progress {
+		last = p
+	}
+
+	require.Equal(t, Progress{Seen: 5, Queried: 5, Succeeded: 4, Failed: 1}, last)
+	require.Len(t, crawled, 5)
+	for _, d := range dhts {
+		cp := crawled[d.Host().ID()]
+		require.NotNil(t, cp)
+		require.True(t, cp.Connected)
+		require.NoError(t, cp.Err)
+		require.NotEmpty(t, cp.RTPeers)
+		require.NotEmpty(t, cp.Addrs)
+	}
+	require.False(t, crawled[unreachable.ID].Connected)
+	require.Error(t, crawled[unreachable.ID].Err)
+}
@@ -0,0 +1,201 @@
+package dht
+
+import (
+	"encoding/json"
+	gonet "net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/jbenet/goprocess"
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	kb "github.com/libp2p/go-libp2p-kbucket"
+)
+
+const (
+	// debugEventBufferSize is the number of events buffered per subscriber of
+	// the debug server, beyond which events are dropped rather than slowing
+	// the lookups down.
+	debugEventBufferSize = 256
+	// debugWriteTimeout bounds the time spent writing an event to a
+	// subscriber.
+	debugWriteTimeout = 10 * time.Second
+)
+
+// DebugEvent is streamed to the subscribers of the debug server, see
+// DebugHandler. Exactly one of its fields is set.
+type DebugEvent struct {
+	Lookup  *LookupEvent   `json:",omitempty"`
+	Summary *LookupSummary `json:",omitempty"`
+}
+
+// debugEvents fans the lookup events out to the subscribers of the debug
+// server.
+type debugEvents struct {
+	mu   sync.Mutex
+	subs map[chan *DebugEvent]struct{}
+}
+
+func newDebugEvents() *debugEvents {
+	return &debugEvents{subs: make(map[chan *DebugEvent]struct{})}
+}
+
+func (d *debugEvents) subscribe() chan *DebugEvent {
+	ch := make(chan *DebugEvent, debugEventBufferSize)
+	d.mu.Lock()
+	d.subs[ch] = struct{}{}
+	d.mu.Unlock()
+	return ch
+}
+
+func (d *debugEvents) unsubscribe(ch chan *DebugEvent) {
+	d.mu.Lock()
+	delete(d.subs, ch)
+	d.mu.Unlock()
+}
+
+func (d *debugEvents) subscribed() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.subs) > 0
+}
+
+// publish hands ev to the subscribers, dropping it for those not keeping up.
+func (d *debugEvents) publish(ev *DebugEvent) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for ch := range d.subs {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+// debugRoutingTable is the routing table snapshot served by the debug server.
+type debugRoutingTable struct {
+	Self  peer.ID
+	Size  int
+	Peers []debugRoutingTablePeer
+}
+
+type debugRoutingTablePeer struct {
+	ID                            peer.ID
+	Cpl                           int
+	AddedAt                       time.Time
+	LastUsefulAt                  time.Time
+	LastSuccessfulOutboundQueryAt time.Time
+}
+
+// DebugHandler returns a handler letting operators watch the DHT without
+// instrumenting their application. It serves:
+//   - /routing-table, a JSON snapshot of the routing table,
+//   - /events, a WebSocket streaming the LookupEvents of all our lookups, and
+//     their LookupSummary once completed, as JSON DebugEvents. The events
+//     are dropped for the clients not keeping up.
+//   - /introspection, the protobuf encoded pb.Introspection returned by
+//     Introspect.
+//   - /coverage, a text histogram of the KeyspaceCoverage of the routing
+//     table.
+//
+// It is meant to be mounted on a private HTTP server, see DebugServer.
+func (dht *IpfsDHT) DebugHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/routing-table", dht.serveDebugRoutingTable)
+	mux.HandleFunc("/events", dht.serveDebugEvents)
+	mux.HandleFunc("/introspection", dht.serveIntrospection)
+	mux.HandleFunc("/coverage", dht.serveDebugCoverage)
+	return mux
+}
+
+func (dht *IpfsDHT) serveDebugRoutingTable(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	infos := dht.routingTable.GetPeerInfos()
+	snapshot := debugRoutingTable{
+		Self:  dht.self,
+		Size:  len(infos),
+		Peers: make([]debugRoutingTablePeer, 0, len(infos)),
+	}
+	for _, pi := range infos {
+		snapshot.Peers = append(snapshot.Peers, debugRoutingTablePeer{
+			ID:                            pi.Id,
+			Cpl:                           kb.CommonPrefixLen(dht.selfKey, kb.ConvertPeerID(pi.Id)),
+			AddedAt:                       pi.AddedAt,
+			LastUsefulAt:                  pi.LastUsefulAt,
+			LastSuccessfulOutboundQueryAt: pi.LastSuccessfulOutboundQueryAt,
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(snapshot); err != nil {
+		logger.Debugw("failed to write routing table snapshot", "error", err)
+	}
+}
+
+var debugUpgrader websocket.Upgrader
+
+func (dht *IpfsDHT) serveDebugEvents(w http.ResponseWriter, r *http.Request) {
+	// streams the events from the handshake on
+	ch := dht.debugEvents.subscribe()
+	defer dht.debugEvents.unsubscribe(ch)
+
+	conn, err := debugUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// the upgrader answered with an error
+		return
+	}
+	defer conn.Close()
+
+	// nothing is expected from the client, reading notices it going away
+	gone := make(chan struct{})
+	go func() {
+		defer close(gone)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case ev := <-ch:
+			if err := conn.SetWriteDeadline(time.Now().Add(debugWriteTimeout)); err != nil {
+				return
+			}
+			if err := conn.WriteJSON(ev); err != nil {
+				return
+			}
+		case <-gone:
+			return
+		case <-dht.ctx.Done():
+			return
+		}
+	}
+}
+
+// startDebugServer serves DebugHandler on the TCP address listenAddr until
+// the DHT is closed.
+func (dht *IpfsDHT) startDebugServer(listenAddr string) error {
+	l, err := gonet.Listen("tcp", listenAddr)
+	if err != nil {
+		return err
+	}
+	logger.Infow("debug server listening", "addr", l.Addr())
+
+	srv := &http.Server{Handler: dht.DebugHandler()}
+	go func() {
+		if err := srv.Serve(l); err != http.ErrServerClosed {
+			logger.Warnw("debug server failed", "error", err)
+		}
+	}()
+	dht.proc.Go(func(proc goprocess.Process) {
+		<-proc.Closing()
+		srv.Close()
+	})
+	return nil
+}
@@ -0,0 +1,198 @@
+package dht
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/routing"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// maxDelegatedResponseSize bounds the responses read from the delegated routing
+// endpoint.
+const maxDelegatedResponseSize = 4 << 20
+
+// delegatedRouting queries a delegated routing HTTP API for what the DHT
+// doesn't find, see DelegatedRoutingFallback.
+type delegatedRouting struct {
+	endpoint string
+	delay    time.Duration
+	client   *http.Client
+}
+
+// newDelegatedRouting returns the client of the API at endpoint, nil if none.
+func newDelegatedRouting(endpoint string, delay time.Duration) *delegatedRouting {
+	if endpoint == "" {
+		return nil
+	}
+	return &delegatedRouting{
+		endpoint: strings.TrimSuffix(endpoint, "/"),
+		delay:    delay,
+		client:   &http.Client{},
+	}
+}
+
+// delegatedRecord is a record of the responses of the API, of the "peer" schema
+// if it describes a peer.
+type delegatedRecord struct {
+	Schema    string
+	ID        string
+	Addrs     []string
+	Protocols []string
+}
+
+// addrInfo returns the peer the record describes, false if it doesn't describe
+// a valid one. Invalid addresses are left out.
+func (r *delegatedRecord) addrInfo() (peer.AddrInfo, bool) {
+	if r.Schema != "peer" {
+		return peer.AddrInfo{}, false
+	}
+	id, err := peer.Decode(r.ID)
+	if err != nil {
+		return peer.AddrInfo{}, false
+	}
+	ai := peer.AddrInfo{ID: id}
+	for _, s := range r.Addrs {
+		if a, err := ma.NewMultiaddr(s); err == nil {
+			ai.Addrs = append(ai.Addrs, a)
+		}
+	}
+	return ai, true
+}
+
+// get gets the records of the API at path, nil if there are none.
+func (d *delegatedRouting) get(ctx context.Context, path string, records interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, d.endpoint+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil
+	default:
+		return fmt.Errorf("delegated routing endpoint answered %s", resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, maxDelegatedResponseSize)).Decode(records)
+}
+
+// findProviders returns the providers of c known to the API.
+func (d *delegatedRouting) findProviders(ctx context.Context, c cid.Cid) ([]ProviderInfo, error) {
+	var resp struct {
+		Providers []delegatedRecord
+	}
+	if err := d.get(ctx, "/routing/v1/providers/"+c.String(), &resp); err != nil {
+		return nil, err
+	}
+	var provs []ProviderInfo
+	for _, r := range resp.Providers {
+		if ai, ok := r.addrInfo(); ok {
+			provs = append(provs, ProviderInfo{AddrInfo: ai, TransferProtocols: r.Protocols, Delegated: d.endpoint})
+		}
+	}
+	return provs, nil
+}
+
+// findPeer returns the addresses of p known to the API, routing.ErrNotFound if
+// none.
+func (d *delegatedRouting) findPeer(ctx context.Context, p peer.ID) (peer.AddrInfo, error) {
+	var resp struct {
+		Peers []delegatedRecord
+	}
+	if err := d.get(ctx, "/routing/v1/peers/"+peer.ToCid(p).String(), &resp); err != nil {
+		return peer.AddrInfo{}, err
+	}
+	for _, r := range resp.Peers {
+		if ai, ok := r.addrInfo(); ok && ai.ID == p && len(ai.Addrs) > 0 {
+			return ai, nil
+		}
+	}
+	return peer.AddrInfo{}, routing.ErrNotFound
+}
+
+// withDelegatedProviders merges the providers of c found by the DHT, sent on
+// infos, with the ones found through the delegated routing endpoint, up to
+// count of them, all if 0. The endpoint is queried once the DHT found fewer
+// than count providers, none if 0, or after the delay if sooner. cancel stops
+// the DHT once done.
+func (d *delegatedRouting) withDelegatedProviders(ctx context.Context, cancel context.CancelFunc, c cid.Cid, count int, infos <-chan ProviderInfo) <-chan ProviderInfo {
+	chSize := count
+	if count == 0 {
+		chSize = 1
+	}
+	out := make(chan ProviderInfo, chSize)
+	go func() {
+		defer close(out)
+		defer cancel()
+
+		found := make(map[peer.ID]struct{})
+		var delegated chan []ProviderInfo
+		queried := false
+		query := func() {
+			if queried {
+				return
+			}
+			queried = true
+			delegated = make(chan []ProviderInfo, 1)
+			go func() {
+				provs, err := d.findProviders(ctx, c)
+				if err != nil {
+					logger.Debugw("failed to find providers through the delegated routing endpoint", "cid", c, "error", err)
+				}
+				delegated <- provs
+			}()
+		}
+		timer := time.NewTimer(d.delay)
+		defer timer.Stop()
+
+		for infos != nil || delegated != nil {
+			var provs []ProviderInfo
+			select {
+			case info, ok := <-infos:
+				if !ok {
+					infos = nil
+					if len(found) < count || len(found) == 0 {
+						query()
+					}
+					continue
+				}
+				provs = []ProviderInfo{info}
+			case <-timer.C:
+				query()
+				continue
+			case provs = <-delegated:
+				delegated = nil
+			}
+
+			for _, info := range provs {
+				if _, ok := found[info.ID]; ok {
+					continue
+				}
+				select {
+				case out <- info:
+					found[info.ID] = struct{}{}
+				case <-ctx.Done():
+					return
+				}
+				if count > 0 && len(found) >= count {
+					return
+				}
+			}
+		}
+	}()
+	return out
+}
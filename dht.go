@@ -5,9 +5,13 @@ import (
 	"fmt"
 	"math"
 	"math/rand"
+	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/libp2p/go-libp2p-core/connmgr"
+	"github.com/libp2p/go-libp2p-core/crypto"
 	"github.com/libp2p/go-libp2p-core/host"
 	"github.com/libp2p/go-libp2p-core/network"
 	"github.com/libp2p/go-libp2p-core/peer"
@@ -34,6 +38,7 @@ import (
 	goprocessctx "github.com/jbenet/goprocess/context"
 	"github.com/multiformats/go-base32"
 	ma "github.com/multiformats/go-multiaddr"
+	"go.opencensus.io/stats"
 	"go.opencensus.io/tag"
 	"go.uber.org/zap"
 )
@@ -60,7 +65,9 @@ const (
 )
 
 const (
-	kad1 protocol.ID = "/kad/1.0.0"
+	// kadDatagram hands out the sessions of the datagram transport, see
+	// DatagramQueries.
+	kadDatagram protocol.ID = "/kad/datagram/1.0.0"
 )
 
 const (
@@ -86,19 +93,83 @@ type IpfsDHT struct {
 	routingTable *kb.RoutingTable // Array of routing tables for differently distanced nodes
 	// providerStore stores & manages the provider records for this Dht peer.
 	providerStore providers.ProviderStore
+	// doubleHashProviders is set when provider records are stored and
+	// looked up under double-hashed keys.
+	doubleHashProviders bool
+	// bound the lookups and RPCs run concurrently by provides, nil if
+	// unbounded.
+	provideLookups *provideStage
+	provideRPCs    *provideStage
+
+	// reprovider, if set, periodically reprovides the configured key tiers.
+	reprovider *reprovider
+
+	// transferProtocols are advertised in our provider records.
+	transferProtocols []string
+
+	// offlineQueue, if set, holds the provides and puts issued while the
+	// routing table is empty.
+	offlineQueue *offlineQueue
+	// providerLimiter rate limits inbound provider records.
+	providerLimiter *providerRateLimiter
+
+	// requestLimiter rate limits inbound requests per peer, and peerBackoff
+	// tracks the peers that rate limited ours.
+	requestLimiter *requestRateLimiter
+	peerBackoff    peerBackoff
+	// requestQueue bounds the inbound requests handled at once, by priority.
+	requestQueue *requestQueue
+
+	// drainer tracks the work Close lets complete for up to
+	// shutdownGracePeriod, if positive.
+	drainer             drainer
+	shutdownGracePeriod time.Duration
 
 	// manages Routing Table refresh
 	rtRefreshManager *rtrefresh.RtRefreshManager
 
 	birth time.Time // When this peer started up
 
-	Validator record.Validator
+	// recordValidator validates the value records, see Validator. Guarded by
+	// validatorLk.
+	recordValidator record.Validator
+	validatorLk     sync.RWMutex
+	// set when running the default protocol, whose validators must not change
+	fixedValidators bool
+
+	// conflictResolver, if set, is used instead of the validator's Select to
+	// choose between divergent values for the same key.
+	conflictResolver ConflictResolverFunc
+
+	// keyMappers transform the keys of records by namespace.
+	keyMappers map[string]KeyMapperFunc
+
+	// middlewares wrap the handling of inbound requests, outermost first.
+	middlewares []RequestMiddleware
+
+	// lookupCacheTTL, if positive, enables caching values along lookup paths.
+	lookupCacheTTL    time.Duration
+	lookupCachePolicy CachePolicyFunc
 
 	ctx  context.Context
 	proc goprocess.Process
 
 	protoMessenger *pb.ProtocolMessenger
 	msgSender      pb.MessageSender
+	// datagrams, if set, sends and answers lookup requests over UDP.
+	datagrams *net.DatagramTransport
+	// httpSender, if set, sends requests over HTTP to the peers we can't dial.
+	httpSender *net.HTTPSender
+
+	// delegatedRouting, if set, finds what the DHT doesn't, see
+	// DelegatedRoutingFallback.
+	delegatedRouting *delegatedRouting
+	// httpSeeds start lookups while our routing table is empty.
+	httpSeeds []peer.ID
+	// capabilities are announced to the peers we exchange messages with.
+	capabilities pb.Capabilities
+	// responseKey, if set, signs our FIND_NODE and GET_PROVIDERS responses.
+	responseKey crypto.PrivKey
 
 	plk sync.Mutex
 
@@ -112,17 +183,90 @@ type IpfsDHT struct {
 	// DHT protocols we can respond to.
 	serverProtocols []protocol.ID
 
+	// metricsName labels our metrics, see MetricsName.
+	metricsName string
+
 	auto   ModeOpt
 	mode   mode
 	modeLk sync.Mutex
+	// reachability is the last one reported by the host, used by the
+	// automatic modes.
+	reachability network.Reachability
 
-	bucketSize int
-	alpha      int // The concurrency parameter per path
-	beta       int // The number of peers closest to a target that must have responded for a query path to terminate
+	bucketSize        int
+	replicationFactor int // The number of peers records are stored on
+	alpha             int // The concurrency parameter per path
+	beta              int // The number of peers closest to a target that must have responded for a query path to terminate
 
 	queryPeerFilter        QueryFilterFunc
 	routingTablePeerFilter RouteTableFilterFunc
 	rtPeerDiversityFilter  peerdiversity.PeerIPGroupFilter
+	// gater, if set, is consulted before dialing lookup candidates and
+	// handling inbound requests.
+	gater connmgr.ConnectionGater
+	// responseAddrFilter, if set, filters the peer addresses we send.
+	responseAddrFilter AddressFilterFunc
+	// closerPeersCache, if set, caches the closer peers we answer with.
+	closerPeersCache *closerPeersCache
+	// addrFamily, if set, orders the addresses we send and dial by family.
+	addrFamily *addrFamilyPreference
+	// idempotentRequests answers the retransmissions of mutating requests.
+	idempotentRequests *idempotentRequests
+
+	// privateNetwork is set when running the private network profile.
+	privateNetwork bool
+
+	// strictValidation rejects malformed requests before handling them.
+	strictValidation bool
+
+	// streamProviders streams large GET_PROVIDERS responses to the peers
+	// reading them.
+	streamProviders bool
+
+	// observedAddrFeedback tells requesters the address we observe them at.
+	observedAddrFeedback bool
+
+	// lookupLogs logs one structured record per completed lookup.
+	lookupLogs bool
+
+	// lookupSampling is the fraction of the lookups traced and logged.
+	lookupSampling float64
+
+	// latencyWeight weighs the latency of the peers against their distance to
+	// the key when picking the peers lookups query next.
+	latencyWeight float64
+
+	// experimentFraction is the fraction of the lookups shadowed by a lookup
+	// picking the peers to query with experimentWeight as latency weight.
+	experimentFraction float64
+	experimentWeight   float64
+
+	// debugEvents streams the lookup events to the debug server.
+	debugEvents *debugEvents
+
+	// introspection tracks the ongoing lookups and the last operations, see
+	// Introspect.
+	introspection *introspection
+
+	// peerStats keeps the outcome of the requests sent to the remote peers,
+	// see PeerStats.
+	peerStats *peerStats
+
+	// netSize estimates the size of the network, see NetworkSize.
+	netSize *netSizeEstimator
+
+	// peersets counts the peersets of the running lookups.
+	peersets *peersetStats
+
+	// anomalies, if set, detects the anomalies of the lookups, see
+	// LatencyAnomalyHandler.
+	anomalies *latencyAnomalies
+
+	// slos tracks the outcomes of the last operations, see OperationSLOs.
+	slos *operationSLOs
+
+	// lifecycle emits the lifecycle events on the event bus of the host.
+	lifecycle *lifecycleEvents
 
 	autoRefresh bool
 
@@ -131,7 +275,26 @@ type IpfsDHT struct {
 	// connecting to the network).
 	bootstrapPeers func() []peer.AddrInfo
 
-	maxRecordAge time.Duration
+	maxRecordAge  time.Duration
+	maxRecordSize int
+
+	// oversizedMessages counts the inbound messages rejected for exceeding
+	// maxInboundMessageSize. Accessed atomically.
+	oversizedMessages int64
+
+	// namespaceMaxAges override maxRecordAge by record namespace.
+	namespaceMaxAges map[string]time.Duration
+
+	// compress record values of at least recordCompressionThreshold bytes
+	// if recordCompression is set
+	recordCompression          bool
+	recordCompressionThreshold int
+
+	// values published by this node that are periodically re-put if
+	// republishInterval is non-zero, with the time of their last put.
+	republishInterval time.Duration
+	publishedLk       sync.Mutex
+	published         map[string]time.Time
 
 	// Allows disabling dht subsystems. These should _only_ be set on
 	// "forked" DHTs (e.g., DHTs with custom protocols and/or private
@@ -139,6 +302,13 @@ type IpfsDHT struct {
 	enableProviders, enableValues bool
 
 	disableFixLowPeers bool
+
+	// fastBootstrap is set by FastBootstrap.
+	fastBootstrap bool
+	// ready is closed once the routing table holds readyPeers peers, and
+	// populated once it holds one, see Ready.
+	readyPeers       int
+	ready, populated chan struct{}
 	fixLowPeersChan    chan struct{}
 
 	addPeerToRTChan   chan addPeerRTReq
@@ -172,6 +342,15 @@ func New(ctx context.Context, h host.Host, options ...Option) (*IpfsDHT, error)
 	if err := cfg.ApplyFallbacks(h); err != nil {
 		return nil, err
 	}
+	if cfg.PrivateNetwork {
+		applyPrivateNetworkProfile(&cfg)
+	}
+	if cfg.MinimalClient.Enabled {
+		applyMinimalClientProfile(&cfg)
+	}
+	if cfg.RecordCipher != nil {
+		cfg.Datastore = EncryptedDatastore(cfg.Datastore, cfg.RecordCipher)
+	}
 
 	if err := cfg.Validate(); err != nil {
 		return nil, err
@@ -185,19 +364,179 @@ func New(ctx context.Context, h host.Host, options ...Option) (*IpfsDHT, error)
 	dht.autoRefresh = cfg.RoutingTable.AutoRefresh
 
 	dht.maxRecordAge = cfg.MaxRecordAge
+	dht.namespaceMaxAges = cfg.NamespaceMaxAges
+	dht.maxRecordSize = cfg.MaxRecordSize
+	dht.republishInterval = cfg.RepublishInterval
+	dht.provideLookups = newProvideStage("lookup", cfg.ProvideConcurrency.Lookups)
+	dht.provideRPCs = newProvideStage("rpc", cfg.ProvideConcurrency.RPCs)
+	if len(cfg.ReproviderTiers) > 0 {
+		dht.reprovider = newReprovider(cfg.ReproviderTiers)
+	}
 	dht.enableProviders = cfg.EnableProviders
 	dht.enableValues = cfg.EnableValues
+	dht.doubleHashProviders = cfg.DoubleHashProviders
 	dht.disableFixLowPeers = cfg.DisableFixLowPeers
-
-	dht.Validator = cfg.Validator
-	dht.msgSender = net.NewMessageSenderImpl(h, dht.protocols)
-	dht.protoMessenger, err = pb.NewProtocolMessenger(dht.msgSender)
+	dht.fastBootstrap = cfg.FastBootstrap.Enabled
+	dht.readyPeers = cfg.FastBootstrap.MinPeers
+	if dht.readyPeers == 0 {
+		dht.readyPeers = 1
+	}
+	dht.ready = make(chan struct{})
+	dht.populated = make(chan struct{})
+
+	dht.recordValidator = cfg.Validator
+	dht.fixedValidators = cfg.ProtocolPrefix == DefaultPrefix
+	dht.conflictResolver = cfg.ConflictResolver
+	dht.keyMappers = cfg.KeyMappers
+	dht.middlewares = cfg.RequestMiddlewares
+	if cfg.OfflineQueueSize > 0 {
+		dht.offlineQueue = &offlineQueue{
+			size:      cfg.OfflineQueueSize,
+			peerAdded: make(chan struct{}, 1),
+		}
+	}
+	if cfg.LookupCache.Enabled {
+		dht.lookupCacheTTL = cfg.LookupCache.TTL
+		dht.lookupCachePolicy = cfg.LookupCache.Policy
+	}
+	var msOpts []net.Option
+	if cfg.RequestPipelining > 0 {
+		msOpts = append(msOpts, net.Pipelining(cfg.RequestPipelining))
+	}
+	if len(cfg.RequestTimeouts) > 0 {
+		msOpts = append(msOpts, net.Timeouts(cfg.RequestTimeouts))
+	}
+	if cfg.StreamPool.MaxSize > 0 || cfg.StreamPool.IdleTimeout > 0 {
+		msOpts = append(msOpts, net.StreamPool(cfg.StreamPool.MaxSize, cfg.StreamPool.IdleTimeout))
+	}
+	if cfg.PeerLatencyBuckets > 0 {
+		msOpts = append(msOpts, net.PeerLatencyBuckets(cfg.PeerLatencyBuckets))
+	}
+	msOpts = append(msOpts, net.OnRequest(dht.peerStats.record))
+	senderProtocols := dht.protocols
+	if cfg.MessageCompression {
+		// preferred when the peer supports them
+		senderProtocols = nil
+		for _, p := range dht.protocols {
+			senderProtocols = append(senderProtocols, net.CompressedProtocol(p))
+		}
+		senderProtocols = append(senderProtocols, dht.protocols...)
+	}
+	dht.msgSender = net.NewMessageSenderImpl(h, senderProtocols, msOpts...)
+	if cfg.DatagramQueries.Enabled {
+		dht.datagrams, err = net.NewDatagramTransport(h, cfg.DatagramQueries.ListenAddr,
+			cfg.ProtocolPrefix+kadDatagram, dht.msgSender, dht.handleRequest)
+		if err != nil {
+			return nil, fmt.Errorf("listening for datagrams: %w", err)
+		}
+		dht.msgSender = dht.datagrams
+		dht.proc.Go(func(proc goprocess.Process) {
+			<-proc.Closing()
+			dht.datagrams.Close()
+		})
+	}
+	if cfg.DebugListenAddr != "" {
+		if err := dht.startDebugServer(cfg.DebugListenAddr); err != nil {
+			return nil, fmt.Errorf("starting debug server: %w", err)
+		}
+	}
+	if cfg.HTTPFallback.Enabled {
+		sk := dht.peerstore.PrivKey(h.ID())
+		if sk == nil {
+			return nil, fmt.Errorf("sending requests over http requires the host's private key")
+		}
+		dht.httpSender = net.NewHTTPSender(h, sk, dht.protocols[0], &http.Client{}, dht.msgSender)
+		dht.msgSender = dht.httpSender
+		for _, ai := range cfg.HTTPFallback.Seeds {
+			dht.peerstore.AddAddrs(ai.ID, ai.Addrs, peerstore.PermanentAddrTTL)
+			dht.httpSeeds = append(dht.httpSeeds, ai.ID)
+		}
+	}
+	dht.msgSender = &livenessSender{MessageSender: dht.msgSender, alive: dht.peerAlive}
+	var pmOpts []pb.ProtocolMessengerOption
+	if cfg.RecordCompression.Enabled {
+		dht.recordCompression = true
+		dht.recordCompressionThreshold = cfg.RecordCompression.Threshold
+		pmOpts = append(pmOpts, pb.WithRecordCompression(dht.recordCompressionThreshold, dht.peerstore))
+	}
+	if cfg.SignProviderRecords {
+		sk := dht.peerstore.PrivKey(h.ID())
+		if sk == nil {
+			return nil, fmt.Errorf("signing provider records requires the host's private key")
+		}
+		pmOpts = append(pmOpts, pb.WithSignedProviderRecords(sk))
+	}
+	if len(cfg.TransferProtocols) > 0 {
+		dht.transferProtocols = cfg.TransferProtocols
+		pmOpts = append(pmOpts, pb.WithTransferProtocols(dht.transferProtocols))
+	}
+	if cfg.ProviderRecordTTL > 0 {
+		pmOpts = append(pmOpts, pb.WithProviderRecordTTL(cfg.ProviderRecordTTL))
+	}
+	if filter := cfg.QueryAddressFilter; filter != nil {
+		pmOpts = append(pmOpts, pb.WithAddressFilter(func(a ma.Multiaddr) bool {
+			return filter(dht, a)
+		}))
+	}
+	if cfg.ResponseSignatures.Sign {
+		dht.responseKey = dht.peerstore.PrivKey(h.ID())
+		if dht.responseKey == nil {
+			return nil, fmt.Errorf("signing responses requires the host's private key")
+		}
+	}
+	if cfg.ResponseSignatures.Verify {
+		pmOpts = append(pmOpts, pb.WithResponseVerification(dht.peerstore))
+	}
+	dht.capabilities = pb.CapSignedProviderRecords | pb.CapBatchedQueries | pb.CapPaginatedProviders
+	if cfg.MessageCompression {
+		dht.capabilities |= pb.CapMessageCompression
+	}
+	if cfg.RecordCompression.Enabled {
+		dht.capabilities |= pb.CapRecordCompression
+	}
+	if cfg.DoubleHashProviders {
+		dht.capabilities |= pb.CapDoubleHashedProviders
+	}
+	if dht.responseKey != nil {
+		dht.capabilities |= pb.CapSignedResponses
+	}
+	if cfg.StreamProviders {
+		dht.capabilities |= pb.CapStreamedProviders
+	}
+	if cfg.DeadlineHints {
+		pmOpts = append(pmOpts, pb.WithDeadlineHints())
+	}
+	if cfg.ObservedAddrs.Handler != nil {
+		dht.capabilities |= pb.CapObservedAddrs
+		pmOpts = append(pmOpts, pb.WithObservedAddrHandler(cfg.ObservedAddrs.Handler))
+	}
+	if cfg.MutationRetries.Retries > 0 {
+		pmOpts = append(pmOpts, pb.WithMutationRetries(cfg.MutationRetries.Retries, cfg.MutationRetries.Backoff))
+	}
+	// ask for as many closer peers as we keep per bucket, or store records on,
+	// whatever the bucket size of the responders
+	closerPeersCount := cfg.BucketSize
+	if cfg.ReplicationFactor > closerPeersCount {
+		closerPeersCount = cfg.ReplicationFactor
+	}
+	if closerPeersCount > pb.MaxCloserPeers {
+		closerPeersCount = pb.MaxCloserPeers
+	}
+	pmOpts = append(pmOpts, pb.WithCloserPeersCount(closerPeersCount))
+	pmOpts = append(pmOpts, pb.WithCapabilities(dht.capabilities, dht.peerstore))
+	dht.protoMessenger, err = pb.NewProtocolMessenger(dht.msgSender, pmOpts...)
 	if err != nil {
 		return nil, err
 	}
 
 	dht.testAddressUpdateProcessing = cfg.TestAddressUpdateProcessing
 
+	dht.lifecycle, err = newLifecycleEvents(h.EventBus())
+	if err != nil {
+		return nil, err
+	}
+	dht.proc.Go(dht.lifecycleLoop)
+
 	dht.auto = cfg.Mode
 	switch cfg.Mode {
 	case ModeAuto, ModeClient:
@@ -231,6 +570,13 @@ func New(ctx context.Context, h host.Host, options ...Option) (*IpfsDHT, error)
 
 	dht.proc.Go(dht.rtPeerLoop)
 
+	if dht.offlineQueue != nil {
+		if err := dht.loadOfflineQueue(); err != nil {
+			return nil, fmt.Errorf("loading offline queue: %w", err)
+		}
+		dht.proc.Go(dht.offlineQueueLoop)
+	}
+
 	// Fill routing table with currently connected peers that are DHT servers
 	dht.plk.Lock()
 	for _, p := range dht.host.Network().Peers() {
@@ -240,6 +586,15 @@ func New(ctx context.Context, h host.Host, options ...Option) (*IpfsDHT, error)
 
 	dht.proc.Go(dht.populatePeers)
 
+	if dht.enableValues && dht.republishInterval > 0 {
+		dht.published = make(map[string]time.Time)
+		dht.proc.Go(dht.republishLoop)
+	}
+
+	if dht.enableProviders && dht.reprovider != nil {
+		dht.proc.Go(dht.reprovideLoop)
+	}
+
 	return dht, nil
 }
 
@@ -268,14 +623,16 @@ func NewDHTClient(ctx context.Context, h host.Host, dstore ds.Batching) *IpfsDHT
 func makeDHT(ctx context.Context, h host.Host, cfg dhtcfg.Config) (*IpfsDHT, error) {
 	var protocols, serverProtocols []protocol.ID
 
-	v1proto := cfg.ProtocolPrefix + kad1
-
-	if cfg.V1ProtocolOverride != "" {
-		v1proto = cfg.V1ProtocolOverride
-	}
-
+	v1proto := cfg.V1Protocol()
 	protocols = []protocol.ID{v1proto}
 	serverProtocols = []protocol.ID{v1proto}
+	if cfg.MessageCompression {
+		serverProtocols = append(serverProtocols, net.CompressedProtocol(v1proto))
+	}
+
+	if cfg.MetricsName == "" {
+		cfg.MetricsName = string(v1proto)
+	}
 
 	dht := &IpfsDHT{
 		datastore:              cfg.Datastore,
@@ -288,18 +645,26 @@ func makeDHT(ctx context.Context, h host.Host, cfg dhtcfg.Config) (*IpfsDHT, err
 		protocolsStrs:          protocol.ConvertToStrings(protocols),
 		serverProtocols:        serverProtocols,
 		bucketSize:             cfg.BucketSize,
+		replicationFactor:      cfg.ReplicationFactor,
 		alpha:                  cfg.Concurrency,
 		beta:                   cfg.Resiliency,
 		queryPeerFilter:        cfg.QueryPeerFilter,
+		gater:                  cfg.ConnectionGater,
+		responseAddrFilter:     cfg.ResponseAddressFilter,
 		routingTablePeerFilter: cfg.RoutingTable.PeerFilter,
 		rtPeerDiversityFilter:  cfg.RoutingTable.DiversityFilter,
 
+		metricsName:     cfg.MetricsName,
 		fixLowPeersChan: make(chan struct{}, 1),
 
 		addPeerToRTChan:   make(chan addPeerRTReq),
 		refreshFinishedCh: make(chan struct{}),
 	}
 
+	if dht.replicationFactor == 0 {
+		dht.replicationFactor = cfg.BucketSize
+	}
+
 	var maxLastSuccessfulOutboundThreshold time.Duration
 
 	// The threshold is calculated based on the expected amount of time that should pass before we
@@ -349,6 +714,33 @@ func makeDHT(ctx context.Context, h host.Host, cfg dhtcfg.Config) (*IpfsDHT, err
 		}
 	}
 
+	rl := cfg.ProviderRateLimit
+	dht.providerLimiter = newProviderRateLimiter(rl.PeerRate, rl.PeerBurst, rl.KeyRate, rl.KeyBurst)
+	rrl := cfg.RequestRateLimit
+	dht.requestLimiter = newRequestRateLimiter(rrl.Rate, rrl.Burst, rrl.SubnetRate, rrl.SubnetBurst, rrl.Allowlist)
+	dht.requestQueue = newRequestQueue(dht.ctx, cfg.InboundQoS.Workers, cfg.InboundQoS.MaxQueued)
+	dht.shutdownGracePeriod = cfg.ShutdownGracePeriod
+	dht.closerPeersCache = newCloserPeersCache(cfg.CloserPeersCache.TTL, cfg.CloserPeersCache.Size)
+	dht.addrFamily = newAddrFamilyPreference(cfg.AddrFamily.Policy, cfg.AddrFamily.FallbackDelay)
+	dht.idempotentRequests = newIdempotentRequests()
+	dht.privateNetwork = cfg.PrivateNetwork
+	dht.strictValidation = cfg.StrictValidation
+	dht.streamProviders = cfg.StreamProviders
+	dht.observedAddrFeedback = cfg.ObservedAddrs.Feedback
+	dht.lookupLogs = cfg.LookupLogs
+	dht.lookupSampling = cfg.LookupSampling
+	dht.debugEvents = newDebugEvents()
+	dht.introspection = newIntrospection()
+	dht.peerStats = newPeerStats()
+	dht.netSize = newNetSizeEstimator()
+	dht.peersets = new(peersetStats)
+	dht.slos = newOperationSLOs()
+	dht.delegatedRouting = newDelegatedRouting(cfg.DelegatedRouting.Endpoint, cfg.DelegatedRouting.Delay)
+	dht.anomalies = newLatencyAnomalies(cfg.LatencyAnomaly.Threshold, cfg.LatencyAnomaly.Handler)
+	dht.latencyWeight = cfg.LatencyWeight
+	dht.experimentFraction = cfg.LookupExperiment.Fraction
+	dht.experimentWeight = cfg.LookupExperiment.Weight
+
 	dht.rtFreezeTimeout = rtFreezeTimeout
 
 	return dht, nil
@@ -365,10 +757,19 @@ func makeRtRefreshManager(dht *IpfsDHT, cfg dhtcfg.Config, maxLastSuccessfulOutb
 		return err
 	}
 
+	maxCplFnc := func() (uint, bool) {
+		n, err := dht.NetworkSize()
+		if err != nil {
+			return 0, false
+		}
+		return refreshMaxCpl(n, dht.bucketSize), true
+	}
+
 	r, err := rtrefresh.NewRtRefreshManager(
 		dht.host, dht.routingTable, cfg.RoutingTable.AutoRefresh,
 		keyGenFnc,
 		queryFnc,
+		maxCplFnc,
 		cfg.RoutingTable.RefreshQueryTimeout,
 		cfg.RoutingTable.RefreshInterval,
 		maxLastSuccessfulOutboundThreshold,
@@ -399,6 +800,8 @@ func makeRoutingTable(dht *IpfsDHT, cfg dhtcfg.Config, maxLastSuccessfulOutbound
 
 	cmgr := dht.host.ConnManager()
 
+	// the callbacks run under the lock of the routing table, which Size takes
+	var rtSize int64
 	rt.PeerAdded = func(p peer.ID) {
 		commonPrefixLen := kb.CommonPrefixLen(dht.selfKey, kb.ConvertPeerID(p))
 		if commonPrefixLen < protectedBuckets {
@@ -406,10 +809,16 @@ func makeRoutingTable(dht *IpfsDHT, cfg dhtcfg.Config, maxLastSuccessfulOutbound
 		} else {
 			cmgr.TagPeer(p, kbucketTag, baseConnMgrScore)
 		}
+
+		dht.signalOfflineQueue()
+		dht.signalRoutingTableChanged()
+		stats.Record(dht.ctx, metrics.RoutingTableSize.M(atomic.AddInt64(&rtSize, 1)))
 	}
 	rt.PeerRemoved = func(p peer.ID) {
 		cmgr.Unprotect(p, kbucketTag)
 		cmgr.UntagPeer(p, kbucketTag)
+		stats.Record(dht.ctx, metrics.RoutingTableSize.M(atomic.AddInt64(&rtSize, -1)))
+		dht.signalRoutingTableChanged()
 
 		// try to fix the RT
 		dht.fixRTIfNeeded()
@@ -430,11 +839,17 @@ func (dht *IpfsDHT) GetRoutingTableDiversityStats() []peerdiversity.CplDiversity
 
 // Mode allows introspection of the operation mode of the DHT
 func (dht *IpfsDHT) Mode() ModeOpt {
+	dht.modeLk.Lock()
+	defer dht.modeLk.Unlock()
 	return dht.auto
 }
 
 func (dht *IpfsDHT) populatePeers(_ goprocess.Process) {
-	if !dht.disableFixLowPeers {
+	if dht.fastBootstrap {
+		dht.proc.Go(func(goprocess.Process) {
+			dht.bootstrapFast(dht.ctx)
+		})
+	} else if !dht.disableFixLowPeers {
 		dht.fixLowPeers(dht.ctx)
 	}
 
@@ -614,6 +1029,10 @@ func (dht *IpfsDHT) rtPeerLoop(proc goprocess.Process) {
 			isBootsrapping = false
 			if old {
 				dht.rtRefreshManager.RefreshNoWait()
+				dht.publishLifecycleEvent(EvtBootstrapped{
+					Protocol:         dht.protocols[0],
+					RoutingTableSize: dht.routingTable.Size(),
+				})
 			}
 
 		case <-proc.Closing():
@@ -714,20 +1133,80 @@ func (dht *IpfsDHT) betterPeersToQuery(pmes *pb.Message, from peer.ID, count int
 
 func (dht *IpfsDHT) setMode(m mode) error {
 	dht.modeLk.Lock()
-	defer dht.modeLk.Unlock()
+	changed, err := dht.switchMode(m)
+	dht.modeLk.Unlock()
+	if changed {
+		dht.modeChanged(m)
+	}
+	return err
+}
 
+// switchMode switches to mode m and returns whether the mode changed. It must
+// be called with modeLk held, and modeChanged once it is released if the mode
+// changed.
+func (dht *IpfsDHT) switchMode(m mode) (bool, error) {
 	if m == dht.mode {
-		return nil
+		return false, nil
 	}
 
 	switch m {
 	case modeServer:
-		return dht.moveToServerMode()
+		if err := dht.moveToServerMode(); err != nil {
+			return false, err
+		}
+		// let the peers we know learn about us as a server
+		if dht.autoRefresh {
+			dht.rtRefreshManager.RefreshNoWait()
+		}
+		return true, nil
 	case modeClient:
-		return dht.moveToClientMode()
+		if err := dht.moveToClientMode(); err != nil {
+			return false, err
+		}
+		return true, nil
 	default:
-		return fmt.Errorf("unrecognized dht mode: %d", m)
+		return false, fmt.Errorf("unrecognized dht mode: %d", m)
+	}
+}
+
+// modeChanged publishes the switch to mode m.
+func (dht *IpfsDHT) modeChanged(m mode) {
+	evt := EvtModeChanged{Protocol: dht.protocols[0], Mode: ModeClient}
+	if m == modeServer {
+		evt.Mode = ModeServer
 	}
+	dht.publishLifecycleEvent(evt)
+}
+
+// SetMode switches the mode the DHT operates in while it runs, e.g. when the
+// node learns it is reachable by means other than AutoNAT. Switching to
+// ModeServer starts answering queries and advertises the DHT protocols to the
+// connected peers, which then add us to their routing tables, and switching to
+// ModeClient stops answering them and rescinds the advertisement. ModeAuto and
+// ModeAutoServer switch to the mode matching the last known reachability and
+// follow its changes from then on.
+func (dht *IpfsDHT) SetMode(m ModeOpt) error {
+	dht.modeLk.Lock()
+
+	var target mode
+	switch m {
+	case ModeClient:
+		target = modeClient
+	case ModeServer:
+		target = modeServer
+	case ModeAuto, ModeAutoServer:
+		target = reachabilityMode(m, dht.reachability)
+	default:
+		dht.modeLk.Unlock()
+		return fmt.Errorf("invalid dht mode %d", m)
+	}
+	dht.auto = m
+	changed, err := dht.switchMode(target)
+	dht.modeLk.Unlock()
+	if changed {
+		dht.modeChanged(target)
+	}
+	return err
 }
 
 // moveToServerMode advertises (via libp2p identify updates) that we are able to respond to DHT queries and sets the appropriate stream handlers.
@@ -738,6 +1217,9 @@ func (dht *IpfsDHT) moveToServerMode() error {
 	for _, p := range dht.serverProtocols {
 		dht.host.SetStreamHandler(p, dht.handleNewStream)
 	}
+	if dht.datagrams != nil {
+		dht.host.SetStreamHandler(dht.datagrams.Protocol(), dht.datagrams.HandleSessionStream)
+	}
 	return nil
 }
 
@@ -751,6 +1233,10 @@ func (dht *IpfsDHT) moveToClientMode() error {
 	for _, p := range dht.serverProtocols {
 		dht.host.RemoveStreamHandler(p)
 	}
+	if dht.datagrams != nil {
+		dht.host.RemoveStreamHandler(dht.datagrams.Protocol())
+		dht.datagrams.RevokeSessions()
+	}
 
 	pset := make(map[protocol.ID]bool)
 	for _, p := range dht.serverProtocols {
@@ -790,8 +1276,12 @@ func (dht *IpfsDHT) RoutingTable() *kb.RoutingTable {
 	return dht.routingTable
 }
 
-// Close calls Process Close.
+// Close calls Process Close. With a ShutdownGracePeriod, it first lets the
+// in-flight requests and operations complete for up to the grace period.
 func (dht *IpfsDHT) Close() error {
+	if dht.shutdownGracePeriod > 0 {
+		dht.shutdown()
+	}
 	return dht.proc.Close()
 }
 
@@ -809,6 +1299,12 @@ func (dht *IpfsDHT) PeerKey() []byte {
 	return kb.ConvertPeerID(dht.self)
 }
 
+// PeerCapabilities returns the optional features p supports, as learned when
+// first exchanging messages with it, and false if they are not known yet.
+func (dht *IpfsDHT) PeerCapabilities(p peer.ID) (pb.Capabilities, bool) {
+	return pb.PeerCapabilities(dht.peerstore, p)
+}
+
 // Host returns the libp2p host this DHT is operating with.
 func (dht *IpfsDHT) Host() host.Host {
 	return dht.host
@@ -819,14 +1315,15 @@ func (dht *IpfsDHT) Ping(ctx context.Context, p peer.ID) error {
 	return dht.protoMessenger.Ping(ctx, p)
 }
 
-// newContextWithLocalTags returns a new context.Context with the InstanceID and
-// PeerID keys populated. It will also take any extra tags that need adding to
-// the context as tag.Mutators.
+// newContextWithLocalTags returns a new context.Context with the InstanceID,
+// PeerID and DHT keys populated. It will also take any extra tags that need
+// adding to the context as tag.Mutators.
 func (dht *IpfsDHT) newContextWithLocalTags(ctx context.Context, extraTags ...tag.Mutator) context.Context {
 	extraTags = append(
 		extraTags,
 		tag.Upsert(metrics.KeyPeerID, dht.self.Pretty()),
 		tag.Upsert(metrics.KeyInstanceID, fmt.Sprintf("%p", dht)),
+		tag.Upsert(metrics.KeyDHT, dht.metricsName),
 	)
 	ctx, _ = tag.New(
 		ctx,
@@ -835,6 +1332,13 @@ func (dht *IpfsDHT) newContextWithLocalTags(ctx context.Context, extraTags ...ta
 	return ctx
 }
 
+// operationContext returns ctx tagged with the local tags and op as the
+// operation, unless ctx is already tagged with an operation, e.g. the lookup of
+// a Provide.
+func (dht *IpfsDHT) operationContext(ctx context.Context, op string) context.Context {
+	return dht.newContextWithLocalTags(ctx, tag.Insert(metrics.KeyOperation, op))
+}
+
 func (dht *IpfsDHT) maybeAddAddrs(p peer.ID, addrs []ma.Multiaddr, ttl time.Duration) {
 	// Don't add addresses for self or our connected peers. We have better ones.
 	if p == dht.self || dht.host.Network().Connectedness(p) == network.Connected {
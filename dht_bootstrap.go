@@ -79,3 +79,68 @@ func (dht *IpfsDHT) RefreshRoutingTable() <-chan error {
 func (dht *IpfsDHT) ForceRefresh() <-chan error {
 	return dht.rtRefreshManager.Refresh(true)
 }
+
+// fastBootstrapTimeout is how long a fast bootstrap waits for a peer to join
+// the routing table before giving up on looking ourselves up.
+const fastBootstrapTimeout = time.Minute
+
+// Ready returns a channel closed once the routing table holds enough peers for
+// the queries to work: the minimum set by FastBootstrap, one otherwise. It stays
+// closed even if the routing table loses peers later.
+func (dht *IpfsDHT) Ready() <-chan struct{} {
+	return dht.ready
+}
+
+// checkReady closes the channels of Ready and of populated once the routing
+// table, of the given size, holds enough peers, from lifecycleLoop.
+func (dht *IpfsDHT) checkReady(size int) {
+	if size < 1 {
+		return
+	}
+	select {
+	case <-dht.populated:
+	default:
+		close(dht.populated)
+	}
+	if size < dht.readyPeers {
+		return
+	}
+	select {
+	case <-dht.ready:
+	default:
+		close(dht.ready)
+	}
+}
+
+// bootstrapFast dials all the bootstrap peers at once, and looks us up as soon
+// as one of them joins the routing table, see FastBootstrap.
+func (dht *IpfsDHT) bootstrapFast(ctx context.Context) {
+	// the peers we are connected to already
+	for _, p := range dht.host.Network().Peers() {
+		dht.peerFound(ctx, p, false)
+	}
+	if dht.bootstrapPeers != nil {
+		for _, ai := range dht.bootstrapPeers() {
+			go func(ai peer.AddrInfo) {
+				if err := dht.Host().Connect(ctx, ai); err != nil {
+					logger.Warnw("failed to bootstrap", "peer", ai.ID, "error", err)
+				}
+			}(ai)
+		}
+	}
+
+	// the bootstrap peers join the routing table once identified
+	timer := time.NewTimer(fastBootstrapTimeout)
+	defer timer.Stop()
+	select {
+	case <-dht.populated:
+	case <-timer.C:
+		logger.Warnw("no peer joined the routing table to bootstrap from", "timeout", fastBootstrapTimeout)
+		return
+	case <-ctx.Done():
+		return
+	}
+	if _, err := dht.GetClosestPeers(ctx, string(dht.self)); err != nil {
+		logger.Debugw("failed to look ourselves up", "error", err)
+	}
+}
@@ -199,3 +199,60 @@ func TestBootstrappersReplacable(t *testing.T) {
 	require.Contains(t, d.routingTable.ListPeers(), d3.self)
 	require.Contains(t, d.routingTable.ListPeers(), d4.self)
 }
+
+func TestFastBootstrap(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	servers := setupDHTS(t, ctx, 5)
+	defer func() {
+		for _, d := range servers {
+			d.Close()
+			d.host.Close()
+		}
+	}()
+	for i := 1; i < len(servers); i++ {
+		connect(t, ctx, servers[i-1], servers[i])
+	}
+
+	// ready once the self lookup filled the routing table past the bootstrap
+	// peer
+	bootstrapper := peer.AddrInfo{ID: servers[0].self, Addrs: servers[0].host.Addrs()}
+	d := setupDHT(ctx, t, false, BootstrapPeers(bootstrapper), FastBootstrap(3))
+	defer d.Close()
+	defer d.host.Close()
+	select {
+	case <-d.Ready():
+	case <-time.After(5 * time.Second):
+		t.Fatal("not ready")
+	}
+	require.GreaterOrEqual(t, d.routingTable.Size(), 3)
+
+	// ready with a peer otherwise
+	d2 := setupDHT(ctx, t, false)
+	defer d2.Close()
+	defer d2.host.Close()
+	select {
+	case <-d2.Ready():
+		t.Fatal("ready without peers")
+	case <-time.After(50 * time.Millisecond):
+	}
+	connect(t, ctx, d2, servers[0])
+	select {
+	case <-d2.Ready():
+	case <-time.After(5 * time.Second):
+		t.Fatal("not ready")
+	}
+
+	// ready once a minimal client's routing table is full, even if that's
+	// fewer peers than asked for
+	client := setupDHT(ctx, t, false, MinimalClientProfile(1), FastBootstrap(3))
+	defer client.Close()
+	defer client.host.Close()
+	connectNoSync(t, ctx, client, servers[0])
+	select {
+	case <-client.Ready():
+	case <-time.After(5 * time.Second):
+		t.Fatal("not ready")
+	}
+}
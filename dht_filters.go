@@ -26,11 +26,24 @@ type QueryFilterFunc = dhtcfg.QueryFilterFunc
 // the local route table.
 type RouteTableFilterFunc = dhtcfg.RouteTableFilterFunc
 
+// AddressFilterFunc is a filter applied to the peer addresses exchanged in
+// responses, see ResponseAddressFilter and QueryAddressFilter.
+type AddressFilterFunc = dhtcfg.AddressFilterFunc
+
 var publicCIDR6 = "2000::/3"
 var public6 *net.IPNet
 
+// privateNetworkCIDRs are the ranges that count as public in a private
+// network, see PrivateNetworkProfile.
+var privateNetworkCIDRs = []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7"}
+var privateNetworkRanges []*net.IPNet
+
 func init() {
 	_, public6, _ = net.ParseCIDR(publicCIDR6)
+	for _, cidr := range privateNetworkCIDRs {
+		_, ipnet, _ := net.ParseCIDR(cidr)
+		privateNetworkRanges = append(privateNetworkRanges, ipnet)
+	}
 }
 
 // isPublicAddr follows the logic of manet.IsPublicAddr, except it uses
@@ -47,6 +60,23 @@ func isPublicAddr(a ma.Multiaddr) bool {
 	return public6.Contains(ip)
 }
 
+type inPrivateNetwork interface {
+	inPrivateNetwork() bool
+}
+
+// isPublicAddrFor is isPublicAddr, except that it accepts the private network
+// ranges when the dht runs the private network profile.
+func isPublicAddrFor(dht interface{}, a ma.Multiaddr) bool {
+	if isPublicAddr(a) {
+		return true
+	}
+	if d, ok := dht.(inPrivateNetwork); !ok || !d.inPrivateNetwork() {
+		return false
+	}
+	ip, err := manet.ToIP(a)
+	return err == nil && inAddrRange(ip, privateNetworkRanges)
+}
+
 // isPrivateAddr follows the logic of manet.IsPrivateAddr, except that
 // it uses a stricter definition of "public" for ipv6
 func isPrivateAddr(a ma.Multiaddr) bool {
@@ -62,14 +92,14 @@ func isPrivateAddr(a ma.Multiaddr) bool {
 }
 
 // PublicQueryFilter returns true if the peer is suspected of being publicly accessible
-func PublicQueryFilter(_ interface{}, ai peer.AddrInfo) bool {
+func PublicQueryFilter(dht interface{}, ai peer.AddrInfo) bool {
 	if len(ai.Addrs) == 0 {
 		return false
 	}
 
 	var hasPublicAddr bool
 	for _, a := range ai.Addrs {
-		if !isRelayAddr(a) && isPublicAddr(a) {
+		if !isRelayAddr(a) && isPublicAddrFor(dht, a) {
 			hasPublicAddr = true
 		}
 	}
@@ -96,7 +126,7 @@ func PublicRoutingTableFilter(dht interface{}, p peer.ID) bool {
 	id := conns[0].RemotePeer()
 	known := d.Host().Peerstore().PeerInfo(id)
 	for _, a := range known.Addrs {
-		if !isRelayAddr(a) && isPublicAddr(a) {
+		if !isRelayAddr(a) && isPublicAddrFor(dht, a) {
 			return true
 		}
 	}
@@ -106,6 +136,25 @@ func PublicRoutingTableFilter(dht interface{}, p peer.ID) bool {
 
 var _ RouteTableFilterFunc = PublicRoutingTableFilter
 
+// PublicAddressFilter rejects the IP addresses in private and unroutable
+// ranges, which are useless to the peers of a public DHT. Addresses that aren't
+// IP addresses, e.g. DNS ones, are kept.
+func PublicAddressFilter(dht interface{}, a ma.Multiaddr) bool {
+	if _, err := manet.ToIP(a); err != nil {
+		return true
+	}
+	return isPublicAddrFor(dht, a)
+}
+
+var _ AddressFilterFunc = PublicAddressFilter
+
+// NoRelayAddressFilter rejects relayed addresses.
+func NoRelayAddressFilter(_ interface{}, a ma.Multiaddr) bool {
+	return !isRelayAddr(a)
+}
+
+var _ AddressFilterFunc = NoRelayAddressFilter
+
 // PrivateQueryFilter doens't currently restrict which peers we are willing to query from the local DHT.
 func PrivateQueryFilter(_ interface{}, ai peer.AddrInfo) bool {
 	return len(ai.Addrs) > 0
@@ -1,16 +1,25 @@
 package dht
 
 import (
+	"context"
+	"fmt"
 	"io"
+	gonet "net"
+	"net/http"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
 
 	"github.com/libp2p/go-libp2p-kad-dht/internal/net"
 	"github.com/libp2p/go-libp2p-kad-dht/metrics"
 	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
 
 	"github.com/libp2p/go-msgio"
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
 	"go.opencensus.io/stats"
 	"go.opencensus.io/tag"
 	"go.uber.org/zap"
@@ -18,6 +27,14 @@ import (
 
 var dhtStreamIdleTimeout = 1 * time.Minute
 
+// maxPipelinedRequests is the maximum number of requests handled at once for
+// a stream pipelining requests.
+const maxPipelinedRequests = 16
+
+// inboundMessageOverhead is the room left on top of the maximum record size
+// for the rest of an inbound message (key, provider addresses, etc.).
+const inboundMessageOverhead = 64 << 10
+
 // ErrReadTimeout is an error that occurs when no message is read within the timeout period.
 var ErrReadTimeout = net.ErrReadTimeout
 
@@ -32,16 +49,67 @@ func (dht *IpfsDHT) handleNewStream(s network.Stream) {
 	}
 }
 
+// maxInboundMessageSize returns the size of the largest inbound message we are
+// willing to read. Requests only ever carry a single record, so with a maximum
+// record size set, larger messages are rejected before being unmarshaled.
+func (dht *IpfsDHT) maxInboundMessageSize() int {
+	if dht.maxRecordSize > 0 && dht.maxRecordSize+inboundMessageOverhead < network.MessageSizeMax {
+		return dht.maxRecordSize + inboundMessageOverhead
+	}
+	return network.MessageSizeMax
+}
+
+// decompressRequest restores the compressed record of a request, if any, and
+// remembers which compressions the requester accepts.
+func (dht *IpfsDHT) decompressRequest(p peer.ID, req *pb.Message) error {
+	if dht.recordCompression {
+		pb.RememberAcceptedCompressions(dht.peerstore, p, req)
+	}
+
+	maxSize := network.MessageSizeMax
+	if dht.maxRecordSize > 0 {
+		maxSize = dht.maxRecordSize
+	}
+	return pb.DecompressRecord(req, maxSize)
+}
+
+// compressResponse advertises the compressions we accept and compresses the
+// response record with one the requester accepts.
+func (dht *IpfsDHT) compressResponse(req, resp *pb.Message) error {
+	if !dht.recordCompression {
+		return nil
+	}
+	switch req.GetType() {
+	case pb.Message_GET_VALUE, pb.Message_PUT_VALUE:
+	default:
+		return nil
+	}
+
+	resp.AcceptedCompressions = pb.SupportedCompressions
+	return pb.CompressRecord(resp, req.GetAcceptedCompressions(), dht.recordCompressionThreshold)
+}
+
 // Returns true on orderly completion of writes (so we can Close the stream).
 func (dht *IpfsDHT) handleNewMessage(s network.Stream) bool {
-	ctx := dht.ctx
-	r := msgio.NewVarintReaderSize(s, network.MessageSizeMax)
+	ctx := withRemoteAddr(dht.ctx, s.Conn().RemoteMultiaddr())
+	r := msgio.NewVarintReaderSize(s, dht.maxInboundMessageSize())
 
 	mPeer := s.Conn().RemotePeer()
 
 	timer := time.AfterFunc(dhtStreamIdleTimeout, func() { _ = s.Reset() })
 	defer timer.Stop()
 
+	var (
+		wlk       sync.Mutex
+		pipelined = make(chan struct{}, maxPipelinedRequests)
+		inflight  sync.WaitGroup
+	)
+	write := func(resp *pb.Message) error {
+		wlk.Lock()
+		defer wlk.Unlock()
+		return net.WriteStreamMsg(s, resp)
+	}
+
 	for {
 		if dht.getMode() != modeServer {
 			logger.Errorf("ignoring incoming dht message while not in server mode")
@@ -54,6 +122,8 @@ func (dht *IpfsDHT) handleNewMessage(s network.Stream) bool {
 		if err != nil {
 			r.ReleaseMsg(msgbytes)
 			if err == io.EOF {
+				// answer the pipelined requests before closing
+				inflight.Wait()
 				return true
 			}
 			// This string test is necessary because there isn't a single stream reset error
@@ -62,7 +132,15 @@ func (dht *IpfsDHT) handleNewMessage(s network.Stream) bool {
 				c.Write(zap.String("from", mPeer.String()),
 					zap.Error(err))
 			}
-			if msgLen > 0 {
+			if err == msgio.ErrMsgTooLarge {
+				atomic.AddInt64(&dht.oversizedMessages, 1)
+				logger.Debugw("rejected oversized message", "from", mPeer, "max", dht.maxInboundMessageSize())
+				_ = stats.RecordWithTags(ctx,
+					[]tag.Mutator{tag.Upsert(metrics.KeyMessageType, "UNKNOWN")},
+					metrics.ReceivedMessages.M(1),
+					metrics.ReceivedMessageErrors.M(1),
+				)
+			} else if msgLen > 0 {
 				_ = stats.RecordWithTags(ctx,
 					[]tag.Mutator{tag.Upsert(metrics.KeyMessageType, "UNKNOWN")},
 					metrics.ReceivedMessages.M(1),
@@ -72,8 +150,11 @@ func (dht *IpfsDHT) handleNewMessage(s network.Stream) bool {
 			}
 			return false
 		}
-		err = req.Unmarshal(msgbytes)
+		err = net.UnmarshalStreamMsg(s, msgbytes, &req, dht.maxInboundMessageSize())
 		r.ReleaseMsg(msgbytes)
+		if err == nil {
+			err = dht.decompressRequest(mPeer, &req)
+		}
 		if err != nil {
 			if c := baseLogger.Check(zap.DebugLevel, "error unmarshaling message"); c != nil {
 				c.Write(zap.String("from", mPeer.String()),
@@ -90,59 +171,179 @@ func (dht *IpfsDHT) handleNewMessage(s network.Stream) bool {
 
 		timer.Reset(dhtStreamIdleTimeout)
 
-		startTime := time.Now()
-		ctx, _ := tag.New(ctx,
-			tag.Upsert(metrics.KeyMessageType, req.GetType().String()),
-		)
-
-		stats.Record(ctx,
-			metrics.ReceivedMessages.M(1),
-			metrics.ReceivedBytes.M(int64(msgLen)),
-		)
-
-		handler := dht.handlerForMsgType(req.GetType())
-		if handler == nil {
-			stats.Record(ctx, metrics.ReceivedMessageErrors.M(1))
-			if c := baseLogger.Check(zap.DebugLevel, "can't handle received message"); c != nil {
-				c.Write(zap.String("from", mPeer.String()),
-					zap.Int32("type", int32(req.GetType())))
+		if req.GetRequestId() == 0 {
+			if !dht.handleRequest(ctx, mPeer, &req, msgLen, write) {
+				return false
 			}
+			continue
+		}
+
+		// pipelined requests are handled concurrently, and answered as
+		// soon as they are handled.
+		select {
+		case pipelined <- struct{}{}:
+		case <-dht.ctx.Done():
 			return false
 		}
+		inflight.Add(1)
+		go func(req *pb.Message) {
+			defer func() {
+				<-pipelined
+				inflight.Done()
+			}()
+			if !dht.handleRequest(ctx, mPeer, req, msgLen, write) {
+				_ = s.Reset()
+			}
+		}(&req)
+	}
+}
 
-		// a peer has queried us, let's add it to RT
-		dht.peerFound(dht.ctx, mPeer, true)
+// handleRequest handles a request and writes the response, if any. It returns
+// false if the stream must be reset.
+func (dht *IpfsDHT) handleRequest(ctx context.Context, mPeer peer.ID, req *pb.Message, msgLen int, write func(*pb.Message) error) bool {
+	startTime := time.Now()
+	ctx, _ = tag.New(ctx,
+		tag.Upsert(metrics.KeyMessageType, req.GetType().String()),
+	)
 
-		if c := baseLogger.Check(zap.DebugLevel, "handling message"); c != nil {
-			c.Write(zap.String("from", mPeer.String()),
-				zap.Int32("type", int32(req.GetType())),
-				zap.Binary("key", req.GetKey()))
-		}
-		resp, err := handler(ctx, mPeer, &req)
-		if err != nil {
-			stats.Record(ctx, metrics.ReceivedMessageErrors.M(1))
-			if c := baseLogger.Check(zap.DebugLevel, "error handling message"); c != nil {
+	stats.Record(ctx,
+		metrics.ReceivedMessages.M(1),
+		metrics.ReceivedBytes.M(int64(msgLen)),
+	)
+
+	ctx, done, err := dht.drainer.enter(ctx)
+	if err != nil {
+		// closing
+		return false
+	}
+	defer done()
+
+	if !dht.requestAllowed(ctx, mPeer) {
+		stats.Record(ctx, metrics.BlockedRequests.M(1))
+		return false
+	}
+
+	if dht.strictValidation {
+		if err := pb.ValidateRequest(req); err != nil {
+			_ = stats.RecordWithTags(ctx,
+				[]tag.Mutator{tag.Upsert(metrics.KeyRejectReason, err.(*pb.ValidationError).Reason)},
+				metrics.RejectedRequests.M(1),
+				metrics.ReceivedMessageErrors.M(1),
+			)
+			if c := baseLogger.Check(zap.DebugLevel, "rejected invalid message"); c != nil {
 				c.Write(zap.String("from", mPeer.String()),
-					zap.Int32("type", int32(req.GetType())),
-					zap.Binary("key", req.GetKey()),
 					zap.Error(err))
 			}
 			return false
 		}
+	}
 
-		if c := baseLogger.Check(zap.DebugLevel, "handled message"); c != nil {
+	if retryAfter, limit := dht.requestLimiter.allow(mPeer, dht.remoteIP(ctx, mPeer)); retryAfter > 0 {
+		_ = stats.RecordWithTags(ctx,
+			[]tag.Mutator{tag.Upsert(metrics.KeyRateLimit, limit)},
+			metrics.ThrottledRequests.M(1),
+		)
+		resp := throttleResponse(req, retryAfter)
+		if resp == nil {
+			return true
+		}
+		resp.RequestId = req.GetRequestId()
+		return write(resp) == nil
+	}
+
+	release, queued, err := dht.requestQueue.acquire(ctx, req.GetType())
+	if !queued {
+		resp := throttleResponse(req, queueFullRetryAfter)
+		if resp == nil {
+			return true
+		}
+		resp.RequestId = req.GetRequestId()
+		return write(resp) == nil
+	}
+	if err != nil {
+		return false
+	}
+	defer release()
+
+	handler := dht.requestHandler(req.GetType())
+	if handler == nil {
+		stats.Record(ctx, metrics.ReceivedMessageErrors.M(1))
+		if c := baseLogger.Check(zap.DebugLevel, "can't handle received message"); c != nil {
+			c.Write(zap.String("from", mPeer.String()),
+				zap.Int32("type", int32(req.GetType())))
+		}
+		return false
+	}
+
+	// a peer has queried us, let's add it to RT
+	dht.peerFound(dht.ctx, mPeer, true)
+	if caps := req.GetCapabilities(); caps != 0 {
+		pb.RememberCapabilities(dht.peerstore, mPeer, pb.Capabilities(caps))
+	}
+
+	if c := baseLogger.Check(zap.DebugLevel, "handling message"); c != nil {
+		c.Write(zap.String("from", mPeer.String()),
+			zap.Int32("type", int32(req.GetType())),
+			zap.Binary("key", req.GetKey()))
+	}
+	handlerStart := time.Now()
+	resp, err := dht.idempotentRequests.handle(ctx, mPeer, req, func() (*pb.Message, error) {
+		return dht.handleWithDeadline(ctx, handler, mPeer, req, startTime)
+	})
+	stats.Record(ctx, metrics.InboundHandlerLatency.M(float64(time.Since(handlerStart))/float64(time.Millisecond)))
+	if err != nil {
+		stats.Record(ctx, metrics.ReceivedMessageErrors.M(1))
+		if c := baseLogger.Check(zap.DebugLevel, "error handling message"); c != nil {
 			c.Write(zap.String("from", mPeer.String()),
 				zap.Int32("type", int32(req.GetType())),
 				zap.Binary("key", req.GetKey()),
-				zap.Duration("time", time.Since(startTime)))
+				zap.Error(err))
 		}
+		return false
+	}
 
-		if resp == nil {
-			continue
+	if c := baseLogger.Check(zap.DebugLevel, "handled message"); c != nil {
+		c.Write(zap.String("from", mPeer.String()),
+			zap.Int32("type", int32(req.GetType())),
+			zap.Binary("key", req.GetKey()),
+			zap.Duration("time", time.Since(startTime)))
+	}
+
+	if resp == nil {
+		return true
+	}
+
+	if dht.responseAddrFilter != nil {
+		pb.FilterMessageAddrs(resp, func(a ma.Multiaddr) bool {
+			return dht.responseAddrFilter(dht, a)
+		})
+	}
+	if dht.addrFamily != nil {
+		pb.PreferMessageAddrs(resp, dht.addrFamily.preferred)
+	}
+	dht.setObservedAddr(ctx, mPeer, resp)
+	if err := dht.compressResponse(req, resp); err != nil {
+		logger.Debugw("failed to compress response record", "error", err)
+	}
+
+	frames := []*pb.Message{resp}
+	if req.GetType() == pb.Message_GET_PROVIDERS && dht.streamsProviders(ctx, mPeer) {
+		frames = providerFrames(resp)
+	}
+	sent := 0
+	for _, resp := range frames {
+		if dht.responseKey != nil && pb.IsSignedResponseType(req.GetType()) {
+			if err := pb.SignResponse(dht.responseKey, resp); err != nil {
+				logger.Errorw("failed to sign response", "error", err)
+			}
+		}
+		if req.GetCapabilities() != 0 {
+			resp.Capabilities = uint64(dht.capabilities)
 		}
 
 		// send out response msg
-		err = net.WriteMsg(s, resp)
+		resp.RequestId = req.GetRequestId()
+		err = write(resp)
 		if err != nil {
 			stats.Record(ctx, metrics.ReceivedMessageErrors.M(1))
 			if c := baseLogger.Check(zap.DebugLevel, "error writing response"); c != nil {
@@ -153,17 +354,66 @@ func (dht *IpfsDHT) handleNewMessage(s network.Stream) bool {
 			}
 			return false
 		}
+		sent += resp.Size()
+	}
 
-		elapsedTime := time.Since(startTime)
+	stats.Record(ctx, metrics.SentResponseBytes.M(int64(sent)))
+	elapsedTime := time.Since(startTime)
 
-		if c := baseLogger.Check(zap.DebugLevel, "responded to message"); c != nil {
-			c.Write(zap.String("from", mPeer.String()),
-				zap.Int32("type", int32(req.GetType())),
-				zap.Binary("key", req.GetKey()),
-				zap.Duration("time", elapsedTime))
+	if c := baseLogger.Check(zap.DebugLevel, "responded to message"); c != nil {
+		c.Write(zap.String("from", mPeer.String()),
+			zap.Int32("type", int32(req.GetType())),
+			zap.Binary("key", req.GetKey()),
+			zap.Duration("time", elapsedTime))
+	}
+
+	latencyMillis := float64(elapsedTime) / float64(time.Millisecond)
+	stats.Record(ctx, metrics.InboundRequestLatency.M(latencyMillis))
+	return true
+}
+
+// handleWithDeadline runs handler under the deadline hinted by the requester,
+// if any, counted from when we got the request.
+func (dht *IpfsDHT) handleWithDeadline(ctx context.Context, handler dhtHandler, p peer.ID, req *pb.Message, received time.Time) (*pb.Message, error) {
+	if ms := req.GetDeadlineMs(); ms > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, received.Add(time.Duration(ms)*time.Millisecond))
+		defer cancel()
+	}
+	return handler(ctx, p, req)
+}
+
+// remoteIP returns the IP address a request from p came from, or nil if unknown.
+func (dht *IpfsDHT) remoteIP(ctx context.Context, p peer.ID) gonet.IP {
+	if dht.requestLimiter == nil {
+		return nil
+	}
+	if ip, ok := net.RemoteIP(ctx); ok {
+		return ip
+	}
+	for _, c := range dht.host.Network().ConnsToPeer(p) {
+		if ip, err := manet.ToIP(c.RemoteMultiaddr()); err == nil {
+			return ip
 		}
+	}
+	return nil
+}
+
+// HTTPHandler returns a handler answering the requests posted over HTTP by the
+// peers that can't dial us, see HTTPFallback. It is meant to be mounted at the
+// root of an HTTP server whose address is advertised, e.g. as
+// /dns4/example.com/tcp/443/https, and only answers while in server mode.
+func (dht *IpfsDHT) HTTPHandler() (http.Handler, error) {
+	sk := dht.peerstore.PrivKey(dht.self)
+	if sk == nil {
+		return nil, fmt.Errorf("serving requests over http requires the host's private key")
+	}
+	return net.NewHTTPHandler(dht.ctx, dht.self, sk, dht.serverProtocols, dht.handleHTTPRequest), nil
+}
 
-		latencyMillis := float64(elapsedTime) / float64(time.Millisecond)
-		stats.Record(ctx, metrics.InboundRequestLatency.M(latencyMillis))
+func (dht *IpfsDHT) handleHTTPRequest(ctx context.Context, p peer.ID, req *pb.Message, msgLen int, write func(*pb.Message) error) bool {
+	if dht.getMode() != modeServer {
+		return false
 	}
+	return dht.handleRequest(ctx, p, req, msgLen, write)
 }
@@ -2,12 +2,16 @@ package dht
 
 import (
 	"fmt"
+	"net"
 	"testing"
 	"time"
 
+	"github.com/libp2p/go-libp2p-core/connmgr"
 	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/pnet"
 	"github.com/libp2p/go-libp2p-core/protocol"
 	dhtcfg "github.com/libp2p/go-libp2p-kad-dht/internal/config"
+	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
 	"github.com/libp2p/go-libp2p-kad-dht/providers"
 
 	"github.com/libp2p/go-libp2p-kbucket/peerdiversity"
@@ -31,6 +35,19 @@ const (
 	ModeAutoServer
 )
 
+// AddrFamilyPolicy describes which address family to prefer, see
+// AddressFamilyPreference.
+type AddrFamilyPolicy = dhtcfg.AddrFamilyPolicy
+
+const (
+	// NoAddrFamilyPreference treats IPv4 and IPv6 addresses alike
+	NoAddrFamilyPreference AddrFamilyPolicy = iota
+	// PreferIPv4 prefers IPv4 addresses, e.g. for hosts with flaky IPv6 connectivity
+	PreferIPv4
+	// PreferIPv6 prefers IPv6 addresses, e.g. for IPv6-only hosts behind NAT64
+	PreferIPv6
+)
+
 // DefaultPrefix is the application specific prefix attached to all DHT protocols by default.
 const DefaultPrefix protocol.ID = "/ipfs"
 
@@ -85,6 +102,21 @@ func Datastore(ds ds.Batching) Option {
 	}
 }
 
+// RecordEncryption encrypts the value and provider records, and the rest of
+// the DHT's state, with cipher before persisting them to the datastore, and
+// decrypts them as they are read back, for deployments required to encrypt
+// the third-party records they cache at rest. The datastore keys, which carry
+// the record keys, aren't encrypted. Custom provider stores, see ProviderStore,
+// are left alone, but can be built on an EncryptedDatastore.
+//
+// Defaults to nil, which stores the records as is.
+func RecordEncryption(cipher RecordCipher) Option {
+	return func(c *dhtcfg.Config) error {
+		c.RecordCipher = cipher
+		return nil
+	}
+}
+
 // Mode configures which mode the DHT operates in (Client, Server, Auto).
 //
 // Defaults to ModeAuto.
@@ -131,6 +163,36 @@ func NamespacedValidator(ns string, v record.Validator) Option {
 	}
 }
 
+// ValueConflictResolver configures a function that is invoked whenever divergent
+// values are found for the same key, both across peers during a lookup and
+// when a new value would replace a locally stored one. The resolver returns the
+// index of the value to keep.
+//
+// Defaults to the Select method of the configured Validator.
+func ValueConflictResolver(r ConflictResolverFunc) Option {
+	return func(c *dhtcfg.Config) error {
+		c.ConflictResolver = r
+		return nil
+	}
+}
+
+// NamespaceKeyMapper transforms the keys of records under the `ns` namespace
+// with m before they are stored or looked up, e.g. with SaltedKeyMapper. The
+// mapped keys stay in the namespace and are validated by its validator.
+//
+// This lets applications keep their records apart from those of other
+// applications sharing the namespace. Every node reading or writing the records
+// must use the same mapping.
+func NamespaceKeyMapper(ns string, m KeyMapperFunc) Option {
+	return func(c *dhtcfg.Config) error {
+		if c.KeyMappers == nil {
+			c.KeyMappers = make(map[string]KeyMapperFunc)
+		}
+		c.KeyMappers[ns] = m
+		return nil
+	}
+}
+
 // ProtocolPrefix sets an application specific prefix to be attached to all DHT protocols. For example,
 // /myapp/kad/1.0.0 instead of /ipfs/kad/1.0.0. Prefix should be of the form /myapp.
 //
@@ -163,6 +225,137 @@ func V1ProtocolOverride(proto protocol.ID) Option {
 	}
 }
 
+// NetworkConfig describes the DHT network to run on: the protocol its peers
+// speak, the record namespaces they accept, and the peers to join it through.
+// Forks and private networks can describe theirs in one place to run an
+// isolated DHT, see Network.
+type NetworkConfig struct {
+	// ProtocolPrefix is prepended to the DHT protocols, e.g. /myapp for
+	// /myapp/kad/1.0.0.
+	ProtocolPrefix protocol.ID
+	// Protocol, if set, is the DHT protocol, regardless of the
+	// ProtocolPrefix, see V1ProtocolOverride.
+	Protocol protocol.ID
+	// Validators validate the records of each namespace, e.g. "pk" and
+	// "ipns". If nil, the default /pk and /ipns validators are used.
+	Validators map[string]record.Validator
+	// BootstrapPeers are the peers the network is joined through.
+	BootstrapPeers []peer.AddrInfo
+}
+
+// DefaultNetwork returns the description of the public IPFS DHT, a starting
+// point for the description of other networks.
+func DefaultNetwork() NetworkConfig {
+	return NetworkConfig{
+		ProtocolPrefix: DefaultPrefix,
+		BootstrapPeers: GetDefaultBootstrapPeerAddrInfos(),
+	}
+}
+
+// Network configures the DHT to run on the network described by n, in place of
+// the ProtocolPrefix, V1ProtocolOverride, Validator and BootstrapPeers options.
+// Options applied after it still take precedence.
+//
+// Defaults to DefaultNetwork, without bootstrap peers.
+func Network(n NetworkConfig) Option {
+	return func(c *dhtcfg.Config) error {
+		if n.ProtocolPrefix == "" && n.Protocol == "" {
+			return fmt.Errorf("network must have a protocol prefix or protocol")
+		}
+		c.ProtocolPrefix = n.ProtocolPrefix
+		c.V1ProtocolOverride = n.Protocol
+		if n.Validators != nil {
+			nsval := make(record.NamespacedValidator, len(n.Validators))
+			for ns, v := range n.Validators {
+				nsval[ns] = v
+			}
+			c.Validator = nsval
+			c.ValidatorChanged = true
+		}
+		bootstrappers := n.BootstrapPeers
+		c.BootstrapPeers = func() []peer.AddrInfo {
+			return bootstrappers
+		}
+		return nil
+	}
+}
+
+// PrivateNetworkProfile configures the DHT for a host running in a private
+// network, one whose connections are protected with a pre-shared key. The
+// public DefaultBootstrapPeers are left out of the bootstrap peers, and
+// PublicQueryFilter, PublicRoutingTableFilter and PublicAddressFilter accept
+// the RFC 1918 ranges and their IPv6 counterpart, fc00::/7, which are all a
+// private network may have. The protocol prefix is kept, see
+// PrivateNetworkProtocols.
+//
+// The host doesn't tell whether it runs with a pre-shared key, see
+// PrivateNetworkFromEnv.
+//
+// Defaults to false.
+func PrivateNetworkProfile(enabled bool) Option {
+	return func(c *dhtcfg.Config) error {
+		c.PrivateNetwork = enabled
+		return nil
+	}
+}
+
+// PrivateNetworkFromEnv enables the private network profile, see
+// PrivateNetworkProfile, if pnet.ForcePrivateNetwork is set, i.e. if hosts
+// refuse to run without a pre-shared key because LIBP2P_FORCE_PNET is set.
+func PrivateNetworkFromEnv() Option {
+	return PrivateNetworkProfile(pnet.ForcePrivateNetwork)
+}
+
+// PrivateNetworkProtocols replaces the /ipfs protocol prefix with
+// PrivateNetworkPrefix when the private network profile is enabled, so that
+// the DHT doesn't pose as the public one. Other prefixes are left alone. All
+// the peers of the network must agree on it, as peers using different prefixes
+// don't talk to each other.
+//
+// Defaults to false.
+func PrivateNetworkProtocols() Option {
+	return func(c *dhtcfg.Config) error {
+		c.PrivateNetworkProtocols = true
+		return nil
+	}
+}
+
+// FastBootstrap shortens the cold start of ephemeral nodes: the bootstrap peers
+// are all dialed at once, rather than one after the other until two answer,
+// and we look ourselves up as soon as one of them joins the routing table,
+// whether or not the routing table is refreshed automatically, to fill it
+// with our closest peers. The DHT is ready once the routing table holds
+// minPeers peers, one if 0, see Ready.
+//
+// Defaults to disabled, the DHT being ready once the routing table holds a
+// peer.
+func FastBootstrap(minPeers int) Option {
+	return func(c *dhtcfg.Config) error {
+		c.FastBootstrap.Enabled = true
+		c.FastBootstrap.MinPeers = minPeers
+		return nil
+	}
+}
+
+// MinimalClientProfile configures the DHT for short-lived processes, e.g. CLI
+// tools and serverless functions, where bootstrapping a full routing table
+// would be wasted. The DHT runs in ModeClient, so it doesn't handle requests,
+// its routing table isn't refreshed, see DisableAutoRefresh, and keeps at most
+// maxPeers peers, the bucket size if 0. The routing table is populated lazily,
+// from the bootstrap peers once the DHT starts and from the peers the lookups
+// query.
+//
+// The options setting the mode or enabling the refreshes are overridden, the
+// routing table filter still applies, and the DHT is ready once the routing
+// table holds maxPeers peers if FastBootstrap asks for more.
+func MinimalClientProfile(maxPeers int) Option {
+	return func(c *dhtcfg.Config) error {
+		c.MinimalClient.Enabled = true
+		c.MinimalClient.MaxPeers = maxPeers
+		return nil
+	}
+}
+
 // BucketSize configures the bucket size (k in the Kademlia paper) of the routing table.
 //
 // The default value is 20.
@@ -173,6 +366,19 @@ func BucketSize(bucketSize int) Option {
 	}
 }
 
+// ReplicationFactor configures the number of closest peers that values and
+// provider records are stored on by PutValue, PutMany and Provide,
+// independently of the bucket size. Setting it above the bucket size trades
+// more traffic for higher durability without changing routing behavior.
+//
+// Defaults to the bucket size.
+func ReplicationFactor(n int) Option {
+	return func(c *dhtcfg.Config) error {
+		c.ReplicationFactor = n
+		return nil
+	}
+}
+
 // Concurrency configures the number of concurrent requests (alpha in the Kademlia paper) for a given query path.
 //
 // The default value is 10.
@@ -207,6 +413,309 @@ func MaxRecordAge(maxAge time.Duration) Option {
 	}
 }
 
+// NamespaceMaxRecordAge overrides MaxRecordAge for the records under the `ns`
+// namespace, so that applications sharing the DHT get the freshness they need.
+// Records older than maxAge are neither served nor kept, and values cached for
+// longer than maxAge expire after it.
+//
+// Values of the namespace must be republished more frequently than maxAge.
+func NamespaceMaxRecordAge(ns string, maxAge time.Duration) Option {
+	return func(c *dhtcfg.Config) error {
+		if c.NamespaceMaxAges == nil {
+			c.NamespaceMaxAges = make(map[string]time.Duration)
+		}
+		c.NamespaceMaxAges[ns] = maxAge
+		return nil
+	}
+}
+
+// MaxRecordSize sets the maximum size, in bytes, of the values of the records
+// this node puts, accepts from other peers and returns from lookups. Putting a
+// larger value fails with ErrRecordTooLarge, larger inbound records are rejected
+// and inbound messages that could only carry larger records are dropped before
+// being unmarshaled.
+//
+// Defaults to 0, which does not limit records beyond the maximum message size.
+func MaxRecordSize(size int) Option {
+	return func(c *dhtcfg.Config) error {
+		c.MaxRecordSize = size
+		return nil
+	}
+}
+
+// RecordCompression enables compressing record values of at least threshold
+// bytes in PUT_VALUE and GET_VALUE messages exchanged with peers that support
+// it. Support is advertised in every value request and response, so compression
+// is only used once a peer has told us it accepts it. zstd is preferred over
+// snappy.
+//
+// Defaults to disabled. Compressed records are always accepted.
+func RecordCompression(threshold int) Option {
+	return func(c *dhtcfg.Config) error {
+		c.RecordCompression.Enabled = true
+		c.RecordCompression.Threshold = threshold
+		return nil
+	}
+}
+
+// MessageCompression offers the compressed variants of the DHT protocols, e.g.
+// /ipfs/kad/1.0.0+zstd, whose messages are compressed with zstd. Streams to
+// peers offering them too are opened with the compressed variant, cutting the
+// bandwidth of large closer peer lists and provider responses. Other peers are
+// still spoken to with the plain protocols.
+//
+// Defaults to disabled.
+func MessageCompression() Option {
+	return func(c *dhtcfg.Config) error {
+		c.MessageCompression = true
+		return nil
+	}
+}
+
+// LookupCaching enables caching the values found by GetValue and SearchValue
+// along the lookup path, as in classic Kademlia. When a lookup stops early
+// because enough peers returned the value, the value is cached for ttl at the
+// closest peer that was queried but didn't return it, spreading the load of
+// popular keys. Only values accepted by policy are cached, a nil policy accepts
+// all values. Peers that already store a value for the key keep their own.
+//
+// The provider records found by FindProviders are likewise cached at the
+// closest peer queried that returned no provider, if policy accepts the key.
+// Only the records signed by their provider can be cached, see
+// SignProviderRecords, since the peer can't otherwise check them.
+//
+// Defaults to disabled.
+func LookupCaching(ttl time.Duration, policy CachePolicyFunc) Option {
+	return func(c *dhtcfg.Config) error {
+		c.LookupCache.Enabled = true
+		c.LookupCache.TTL = ttl
+		c.LookupCache.Policy = policy
+		return nil
+	}
+}
+
+// OfflineQueue makes Provide, ProvideMany and PutValue queue their records
+// instead of failing while the routing table is empty, e.g. on intermittently
+// connected devices.
+// Up to size operations are persisted in the datastore and sent out
+// automatically once peers join the routing table, including after a restart.
+// The record is stored locally right away, and the call returns without a
+// result. When the queue is full ErrOfflineQueueFull is returned.
+//
+// Defaults to 0, which disables the queue.
+func OfflineQueue(size int) Option {
+	return func(c *dhtcfg.Config) error {
+		c.OfflineQueueSize = size
+		return nil
+	}
+}
+
+// RequestPipelining sends up to maxInFlight concurrent requests to a peer over a
+// single stream, instead of one request at a time, cutting the stream setup
+// overhead of bulk operations such as ProvideMany. Requests are only pipelined
+// to peers that answered a first request with its id, others are still sent
+// one request at a time.
+//
+// Defaults to 0, which disables pipelining.
+func RequestPipelining(maxInFlight int) Option {
+	return func(c *dhtcfg.Config) error {
+		c.RequestPipelining = maxInFlight
+		return nil
+	}
+}
+
+// RequestTimeout bounds the time spent sending a request of type t to a peer,
+// from opening a stream to reading the response, e.g. so that provider fetches
+// can take longer than routing queries. Repeated uses set the timeouts of other
+// types, PUT_VALUE and ADD_PROVIDER included.
+//
+// Defaults to waiting 10 seconds for the response of any request.
+func RequestTimeout(t pb.Message_MessageType, timeout time.Duration) Option {
+	return func(c *dhtcfg.Config) error {
+		if c.RequestTimeouts == nil {
+			c.RequestTimeouts = make(map[pb.Message_MessageType]time.Duration)
+		}
+		c.RequestTimeouts[t] = timeout
+		return nil
+	}
+}
+
+// DatagramQueries is an experimental option sending the FIND_NODE and
+// GET_PROVIDERS requests of lookups over UDP datagrams to the peers that
+// support it, sparing the round trips of setting up a stream. Datagrams are
+// received on the UDP address listenAddr, e.g. ":4002", or ":0" for any port,
+// which must be reachable by peers at the IP address they connect to us from.
+//
+// Datagrams are authenticated with keys exchanged over a libp2p stream when
+// first querying a peer. Requests whose response is lost, or doesn't fit in a
+// datagram, fall back to a stream after a timeout derived from the latency to
+// the peer, as do the requests to peers not supporting datagrams.
+//
+// Defaults to disabled.
+func DatagramQueries(listenAddr string) Option {
+	return func(c *dhtcfg.Config) error {
+		c.DatagramQueries.Enabled = true
+		c.DatagramQueries.ListenAddr = listenAddr
+		return nil
+	}
+}
+
+// HTTPFallback lets nodes behind middleboxes blocking libp2p connections
+// participate as clients, by sending their requests over HTTP to the peers
+// advertising an HTTP endpoint, e.g. /dns4/example.com/tcp/443/https, when they
+// can't be dialed. Requests and responses are signed with the keys of the
+// requester and responder, whose clocks must be within a minute of each other.
+//
+// seeds are queried first while the routing table is empty, which it stays
+// when no peer can be dialed. Peers serve HTTP requests by mounting the
+// handler returned by HTTPHandler.
+//
+// Defaults to disabled.
+func HTTPFallback(seeds ...peer.AddrInfo) Option {
+	return func(c *dhtcfg.Config) error {
+		c.HTTPFallback.Enabled = true
+		c.HTTPFallback.Seeds = append(c.HTTPFallback.Seeds, seeds...)
+		return nil
+	}
+}
+
+// DelegatedRoutingFallback queries the delegated routing HTTP API served at
+// endpoint, e.g. https://example.com, as specified by the IPFS Routing V1 HTTP
+// API, when the DHT fails or is too slow: FindProviders queries it once its
+// lookup found fewer providers than asked for, or after delay if sooner, and
+// FindPeer once its lookup failed. Their results are merged with the ones of
+// the DHT, the providers found through the endpoint being attributed to it,
+// see ProviderInfo.Delegated. A zero delay queries the endpoint along with
+// the DHT.
+//
+// Defaults to disabled.
+func DelegatedRoutingFallback(endpoint string, delay time.Duration) Option {
+	return func(c *dhtcfg.Config) error {
+		c.DelegatedRouting.Endpoint = endpoint
+		c.DelegatedRouting.Delay = delay
+		return nil
+	}
+}
+
+// StreamPool bounds the streams kept open to the peers we send requests to.
+// At most maxSize peers have a stream open at once, the least recently used
+// one being closed to make room for another, and streams left unused for
+// idleTimeout are closed. Streams in use are never closed, so the pool may
+// briefly exceed its size under load. The reuse rate can be monitored with
+// the outbound stream metrics.
+//
+// Defaults to 0 for both, which keeps the streams open for as long as the peer
+// stays connected.
+func StreamPool(maxSize int, idleTimeout time.Duration) Option {
+	return func(c *dhtcfg.Config) error {
+		c.StreamPool.MaxSize = maxSize
+		c.StreamPool.IdleTimeout = idleTimeout
+		return nil
+	}
+}
+
+// ProviderPeerRateLimit limits the rate at which provider records announced by
+// a single peer are accepted to rate records per second, with bursts of up to
+// burst records. Records over the limit are dropped.
+//
+// Defaults to 0, which disables the limit.
+func ProviderPeerRateLimit(rate float64, burst int) Option {
+	return func(c *dhtcfg.Config) error {
+		c.ProviderRateLimit.PeerRate = rate
+		c.ProviderRateLimit.PeerBurst = burst
+		return nil
+	}
+}
+
+// ProviderKeyRateLimit limits the rate at which provider records for a single
+// key are accepted, across all peers, to rate records per second, with bursts of
+// up to burst records. Records over the limit are dropped.
+//
+// Defaults to 0, which disables the limit.
+func ProviderKeyRateLimit(rate float64, burst int) Option {
+	return func(c *dhtcfg.Config) error {
+		c.ProviderRateLimit.KeyRate = rate
+		c.ProviderRateLimit.KeyBurst = burst
+		return nil
+	}
+}
+
+// InboundRequestRateLimit limits the rate at which requests from a single peer
+// are handled to rate requests per second, with bursts of up to burst requests.
+// Requests over the limit are answered with how long the peer should wait
+// before sending more, and peers getting such an answer from us back off
+// accordingly. Provider announcements over the limit are dropped.
+//
+// Defaults to 0, which disables the limit.
+func InboundRequestRateLimit(rate float64, burst int) Option {
+	return func(c *dhtcfg.Config) error {
+		c.RequestRateLimit.Rate = rate
+		c.RequestRateLimit.Burst = burst
+		return nil
+	}
+}
+
+// InboundSubnetRateLimit limits the rate at which requests from a single subnet
+// are handled, across all its peers, to rate requests per second, with bursts
+// of up to burst requests, since Sybil peers can trivially rotate their peer
+// IDs but not their addresses. Subnets are /24 networks for IPv4 addresses, and
+// autonomous systems for IPv6 addresses, or /48 networks when unknown. Requests
+// over the limit are handled as for InboundRequestRateLimit, and counted per
+// limit in the throttled requests metric.
+//
+// Defaults to 0, which disables the limit.
+func InboundSubnetRateLimit(rate float64, burst int) Option {
+	return func(c *dhtcfg.Config) error {
+		c.RequestRateLimit.SubnetRate = rate
+		c.RequestRateLimit.SubnetBurst = burst
+		return nil
+	}
+}
+
+// InboundRateLimitAllowlist exempts the requests coming from the given networks,
+// e.g. our own infrastructure, from InboundRequestRateLimit and
+// InboundSubnetRateLimit. Repeated uses add to the list.
+//
+// Defaults to no network.
+func InboundRateLimitAllowlist(nets ...*net.IPNet) Option {
+	return func(c *dhtcfg.Config) error {
+		c.RequestRateLimit.Allowlist = append(c.RequestRateLimit.Allowlist, nets...)
+		return nil
+	}
+}
+
+// ValueRepublishInterval configures the DHT to remember the values published
+// through PutValue and to re-put them to the closest peers every interval, so
+// that they are not dropped once they reach the MaxRecordAge of remote peers.
+// Values are forgotten once they disappear from the local datastore or no longer
+// pass validation.
+//
+// The interval must be shorter than MaxRecordAge. Defaults to 0, which
+// disables republishing.
+func ValueRepublishInterval(interval time.Duration) Option {
+	return func(c *dhtcfg.Config) error {
+		c.RepublishInterval = interval
+		return nil
+	}
+}
+
+// ReproviderTiers makes the DHT reprovide the keys of each tier every tier
+// interval, with ProvideMany. The tiers are given in decreasing priority, e.g.
+// pinned roots, then MFS, then all blocks: when several tiers are due, a tier
+// is only reprovided once the ones before it are done, and keys already
+// reprovided by a tier are skipped by the following ones. The first round
+// starts a minute after the DHT is created. Per tier statistics are available
+// through ReproviderStats.
+//
+// Tier names must be unique and intervals shorter than the provider record
+// validity. Defaults to no tiers, which disables reproviding.
+func ReproviderTiers(tiers ...ReproviderTier) Option {
+	return func(c *dhtcfg.Config) error {
+		c.ReproviderTiers = append(c.ReproviderTiers, tiers...)
+		return nil
+	}
+}
+
 // DisableAutoRefresh completely disables 'auto-refresh' on the DHT routing
 // table. This means that we will neither refresh the routing table periodically
 // nor when the routing table size goes below the minimum threshold.
@@ -230,6 +739,389 @@ func DisableProviders() Option {
 	}
 }
 
+// DoubleHashProviderKeys makes Provide, ProvideMany, Unprovide and
+// FindProviders use the double hash of the content's multihash (see
+// DoubleHashProviderKey) as the provider record key, instead of the multihash
+// itself. The peers serving and routing the records then never see which
+// content is being announced or sought.
+//
+// Records stored under double-hashed keys can only be found by nodes that use
+// this option too. Defaults to disabled.
+func DoubleHashProviderKeys() Option {
+	return func(c *dhtcfg.Config) error {
+		c.DoubleHashProviders = true
+		return nil
+	}
+}
+
+// SignProviderRecords makes the provider records we put carry their
+// announcement time signed with the host's private key. Peers storing the
+// records reject older signed announcements than the one they have, and peers
+// fetching them drop records whose signature doesn't check out or whose signed
+// time is older than the provider record validity, so stale records can't be
+// replayed. Defaults to disabled.
+func SignProviderRecords() Option {
+	return func(c *dhtcfg.Config) error {
+		c.SignProviderRecords = true
+		return nil
+	}
+}
+
+// HandlerMiddleware wraps the handling of inbound requests in the given
+// middlewares, the first one being the outermost, e.g. to validate, authorize,
+// serve and record requests in turn. Middlewares may answer requests
+// themselves, or reject them by returning an error, which resets the stream,
+// and are also handed the requests of types we don't handle, letting
+// deployments add access control, audit logging or experimental handlers
+// without forking the handlers. Requests over the InboundRequestRateLimit are
+// refused before reaching them. Repeated uses add to the chain.
+//
+// Defaults to no middleware.
+func HandlerMiddleware(mws ...RequestMiddleware) Option {
+	return func(c *dhtcfg.Config) error {
+		c.RequestMiddlewares = append(c.RequestMiddlewares, mws...)
+		return nil
+	}
+}
+
+// SignResponses signs the closer peers and providers of our FIND_NODE and
+// GET_PROVIDERS responses with the host's private key, so that the peers
+// verifying them, see VerifyResponseSignatures, can attribute manipulated
+// routing information to us. Peers are told we sign our responses when first
+// exchanging messages with us. Defaults to disabled.
+func SignResponses() Option {
+	return func(c *dhtcfg.Config) error {
+		c.ResponseSignatures.Sign = true
+		return nil
+	}
+}
+
+// VerifyResponseSignatures checks the signatures of the FIND_NODE and
+// GET_PROVIDERS responses we get. Responses with an invalid signature, or
+// without one from peers that announced signing theirs, are rejected, and
+// their sender is dropped from the routing table like an unresponsive peer.
+// Unsigned responses from other peers are accepted. Defaults to disabled.
+func VerifyResponseSignatures() Option {
+	return func(c *dhtcfg.Config) error {
+		c.ResponseSignatures.Verify = true
+		return nil
+	}
+}
+
+// StrictValidation rejects the malformed requests before they are handled:
+// requests with oversized fields, undecodable peer IDs or multiaddrs, or fields
+// that make no sense in their type of request, e.g. a record in a FIND_NODE
+// request, see pb.ValidateRequest. Their stream is reset, and they are counted
+// per rejection reason. Defaults to disabled, leaving each handler to check the
+// fields it uses.
+func StrictValidation() Option {
+	return func(c *dhtcfg.Config) error {
+		c.StrictValidation = true
+		return nil
+	}
+}
+
+// StreamProviders sends large GET_PROVIDERS responses in several frames over
+// the request's stream, and reads the ones streamed to us, so that providers
+// are used as they arrive rather than once the whole list went through. Only
+// the peers announcing they read streamed responses get them, the others get
+// paginated ones. Defaults to disabled.
+func StreamProviders() Option {
+	return func(c *dhtcfg.Config) error {
+		c.StreamProviders = true
+		return nil
+	}
+}
+
+// DeadlineHints tells the peers we send requests to how long we are willing to
+// wait for their responses, when the context of the request has a deadline, so
+// that they skip the work that wouldn't complete in time and answer with what
+// they have. We honor the hints of the requests we get regardless. Defaults to
+// disabled.
+func DeadlineHints() Option {
+	return func(c *dhtcfg.Config) error {
+		c.DeadlineHints = true
+		return nil
+	}
+}
+
+// ObservedAddrFeedback tells the peers sending us requests over streams the
+// address we observe them at in our responses, if they ask for it, see
+// ObservedAddrHandler. Defaults to disabled.
+func ObservedAddrFeedback() Option {
+	return func(c *dhtcfg.Config) error {
+		c.ObservedAddrs.Feedback = true
+		return nil
+	}
+}
+
+// ObservedAddrHandler asks the peers we send requests to for the address they
+// observe us at, and hands them to h as they answer. Unlike the addresses
+// learned through identify, these come from the DHT servers we query anyway,
+// and can feed NAT and reachability detection. Only the peers enabling
+// ObservedAddrFeedback answer with them. The handler is called from the
+// goroutines sending the requests and must not block.
+//
+// Defaults to nil.
+func ObservedAddrHandler(h pb.ObservedAddrHandler) Option {
+	return func(c *dhtcfg.Config) error {
+		c.ObservedAddrs.Handler = h
+		return nil
+	}
+}
+
+// LookupLogs logs one structured record per completed lookup to the
+// "dht/lookups" logger, at the info level, for ingestion into log pipelines.
+// The records carry the lookup id, the prefix of the Kademlia ID of the key,
+// the duration, the number of hops, the number of peers contacted, timed out
+// and unreachable, the number of peers found and why the lookup terminated.
+// Use the JSON log format to get one JSON object per lookup.
+//
+// Defaults to disabled.
+func LookupLogs() Option {
+	return func(c *dhtcfg.Config) error {
+		c.LookupLogs = true
+		return nil
+	}
+}
+
+// LookupSampling traces, and logs if LookupLogs is set, only the given fraction
+// of the lookups, picked at random, from 0 to 1. This bounds the overhead of
+// tracing and logging the lookups of busy nodes while keeping a representative
+// sample of them. The metrics account for all the lookups regardless.
+//
+// Defaults to 1, which traces every lookup.
+func LookupSampling(fraction float64) Option {
+	return func(c *dhtcfg.Config) error {
+		c.LookupSampling = fraction
+		return nil
+	}
+}
+
+// LookupLatencyWeight blends the latency of the peers, as estimated by the
+// peerstore, with their distance to the key when picking the peers lookups
+// query next: weight 0 picks the closest peers first, as Kademlia does, and 1
+// the fastest peers first, peers of unknown latency last. In between, peers
+// are ranked by both, and picked by the weighed sum of their ranks. Lookups
+// still terminate once the beta closest peers have been queried, whatever the
+// weight.
+//
+// Defaults to 0.
+func LookupLatencyWeight(weight float64) Option {
+	return func(c *dhtcfg.Config) error {
+		c.LatencyWeight = weight
+		return nil
+	}
+}
+
+// LookupExperiment compares two ways of picking the peers lookups query next
+// on live traffic. For the given fraction of the lookups, sampled at random,
+// a shadow lookup of the same key is started from the same seed peers, picking
+// the peers to query with weight as latency weight, see LookupLatencyWeight.
+// Shadow lookups only send FIND_NODE requests, and their events aren't
+// published.
+//
+// Once both are done, the pair is logged to the "dht/lookups" logger, at the
+// info level, for offline analysis: the divergence between the peers they
+// contacted, 0 if the same and 1 if disjoint, and the weight, duration, hops,
+// number of peers contacted and termination reason of each.
+//
+// Shadow lookups add to the load of the network. Defaults to disabled.
+func LookupExperiment(fraction, weight float64) Option {
+	return func(c *dhtcfg.Config) error {
+		c.LookupExperiment.Fraction = fraction
+		c.LookupExperiment.Weight = weight
+		return nil
+	}
+}
+
+// LatencyAnomalyHandler calls h when the latency or the timeout rate of the
+// lookups rises sharply above its rolling baseline, to alert or to mitigate,
+// e.g. by switching modes or refreshing the routing table, and again once it
+// is back to its baseline. The rates of the last lookups are compared to their
+// baseline over the last hundreds of lookups, and deviate once they exceed it
+// by threshold standard deviations, 4 if 0. Only the lookups that weren't
+// canceled count. The handler is called from the goroutines of the lookups and
+// must not block.
+//
+// Defaults to nil.
+func LatencyAnomalyHandler(threshold float64, h LatencyAnomalyFunc) Option {
+	return func(c *dhtcfg.Config) error {
+		c.LatencyAnomaly.Handler = h
+		c.LatencyAnomaly.Threshold = threshold
+		return nil
+	}
+}
+
+// PeerLatencyMetrics records the latency of the requests sent to each remote
+// peer as the metrics.PeerRequestLatency histogram, to tell the consistently
+// slow peers apart. To bound the cardinality of the metric however many peers
+// we talk to, the peers are hashed to one of buckets buckets, labeled by
+// metrics.KeyPeerBucket, see metrics.PeerBucket.
+//
+// Defaults to 0, which doesn't record the latencies per peer.
+func PeerLatencyMetrics(buckets int) Option {
+	return func(c *dhtcfg.Config) error {
+		c.PeerLatencyBuckets = buckets
+		return nil
+	}
+}
+
+// MetricsName labels the metrics of the DHT with name, as metrics.KeyDHT, to
+// tell them apart from the metrics of the other DHTs of the process, e.g. "wan"
+// and "lan" for the dual DHT.
+//
+// Defaults to the DHT protocol, e.g. "/ipfs/kad/1.0.0".
+func MetricsName(name string) Option {
+	return func(c *dhtcfg.Config) error {
+		c.MetricsName = name
+		return nil
+	}
+}
+
+// DebugServer serves DebugHandler on the TCP address listenAddr, e.g.
+// "127.0.0.1:5002", until the DHT is closed. The debug server isn't
+// authenticated, and shouldn't be reachable by untrusted parties.
+//
+// Defaults to disabled.
+func DebugServer(listenAddr string) Option {
+	return func(c *dhtcfg.Config) error {
+		c.DebugListenAddr = listenAddr
+		return nil
+	}
+}
+
+// ProvideConcurrency bounds the work done concurrently by Provide and
+// ProvideMany: at most lookups closest peer lookups and rpcs ADD_PROVIDER
+// requests are in flight at any time, across all calls. Calls beyond these
+// limits wait for a free slot, or until their context is done, so applications
+// providing large numbers of keys at once don't spawn unbounded lookups and
+// dials. The queue depth and wait times are exported as metrics and through
+// ProvideQueueStats.
+//
+// Defaults to 0 for both, which means unbounded.
+func ProvideConcurrency(lookups, rpcs int) Option {
+	return func(c *dhtcfg.Config) error {
+		c.ProvideConcurrency.Lookups = lookups
+		c.ProvideConcurrency.RPCs = rpcs
+		return nil
+	}
+}
+
+// InboundRequestQoS bounds the inbound requests handled at once to workers.
+// Requests beyond it wait for a free worker, which under load goes to
+// FIND_NODE and PING requests first, then GET_PROVIDERS and GET_VALUE, and
+// last ADD_PROVIDER, PUT_VALUE and the other requests, so that heavy provider
+// traffic doesn't starve routing. When maxQueued requests of a class are
+// waiting already, further ones are refused and their sender is asked to retry
+// later. The queue depths, wait times and refused requests are exported as
+// metrics per class.
+//
+// Defaults to 0 for workers, which means unbounded, and 0 for maxQueued, which
+// lets requests queue up without limit.
+func InboundRequestQoS(workers, maxQueued int) Option {
+	return func(c *dhtcfg.Config) error {
+		c.InboundQoS.Workers = workers
+		c.InboundQoS.MaxQueued = maxQueued
+		return nil
+	}
+}
+
+// AddressFamilyPreference applies an address family policy to the addresses
+// we send and to the lookup candidates we dial. The peers in our responses list
+// their addresses of the preferred family first. Lookup candidates announced
+// with addresses of both families are dialed at the preferred ones first, and
+// at the others once that dial fails or, if fallbackDelay is positive, once it
+// hasn't succeeded within fallbackDelay, racing both families like happy
+// eyeballs do. Addresses of no particular family, e.g. /dnsaddr ones, count as
+// preferred.
+//
+// Defaults to NoAddrFamilyPreference.
+func AddressFamilyPreference(policy AddrFamilyPolicy, fallbackDelay time.Duration) Option {
+	return func(c *dhtcfg.Config) error {
+		c.AddrFamily.Policy = policy
+		c.AddrFamily.FallbackDelay = fallbackDelay
+		return nil
+	}
+}
+
+// CloserPeersCache caches the closer peers we answer FIND_NODE, GET_VALUE and
+// GET_PROVIDERS requests with for ttl, for up to size keys, so that storms of
+// requests for a popular key don't each walk the routing table and build the
+// same answer. Answers may thus miss the peers that joined the routing table
+// in the last ttl, which should be kept to a few seconds. The cache hits and
+// misses are exported as metrics.
+//
+// Defaults to 0 for ttl, which disables the cache. A size of 0 caches 1024 keys.
+func CloserPeersCache(ttl time.Duration, size int) Option {
+	return func(c *dhtcfg.Config) error {
+		c.CloserPeersCache.TTL = ttl
+		c.CloserPeersCache.Size = size
+		return nil
+	}
+}
+
+// MutationRetries retries the PUT_VALUE and ADD_PROVIDER requests that fail,
+// e.g. time out, up to retries times, waiting backoff before the first retry
+// and twice as long before each following one. Requests refused by throttled
+// peers aren't retried. All the attempts carry the same idempotency token, so
+// that peers don't store a value or count a provider twice when only their
+// response got lost.
+//
+// Defaults to 0 retries.
+func MutationRetries(retries int, backoff time.Duration) Option {
+	return func(c *dhtcfg.Config) error {
+		c.MutationRetries.Retries = retries
+		c.MutationRetries.Backoff = backoff
+		return nil
+	}
+}
+
+// ShutdownGracePeriod makes Close drain the DHT rather than tear it down
+// abruptly: it stops accepting inbound streams, fails the operations started
+// from then on with ErrClosing, sends out the offline queue if there are peers
+// to send it to, and waits for up to grace for the inbound requests and the
+// lookups, provides and puts in flight to complete.
+//
+// Defaults to 0, which closes the DHT right away.
+func ShutdownGracePeriod(grace time.Duration) Option {
+	return func(c *dhtcfg.Config) error {
+		c.ShutdownGracePeriod = grace
+		return nil
+	}
+}
+
+// ProviderRecordTTL asks the peers storing our provider records to keep them for
+// ttl instead of the default 24 hours, so that short-lived providers such as
+// ephemeral gateways don't stay advertised long after they are gone. Peers cap
+// the TTL at the default validity, and older peers ignore it. Keys must be
+// reprovided more often than ttl to stay advertised.
+//
+// Defaults to 0, which leaves the validity to the peers storing the records.
+func ProviderRecordTTL(ttl time.Duration) Option {
+	return func(c *dhtcfg.Config) error {
+		c.ProviderRecordTTL = ttl
+		return nil
+	}
+}
+
+// ProviderTransferProtocols advertises the retrieval protocols we serve the
+// content we provide with, e.g. TransferBitswap or TransferHTTP, in our
+// provider records. Peers finding us with FindProviderInfosAsync can then tell
+// whether they can fetch from us. At most 8 protocols of up to 64 bytes each
+// can be advertised.
+//
+// Defaults to advertising none.
+func ProviderTransferProtocols(protos ...string) Option {
+	return func(c *dhtcfg.Config) error {
+		if err := checkTransferProtocols(protos); err != nil {
+			return err
+		}
+		c.TransferProtocols = protos
+		return nil
+	}
+}
+
 // DisableValues disables storing and retrieving value records (including
 // public keys).
 //
@@ -252,6 +1144,46 @@ func QueryFilter(filter QueryFilterFunc) Option {
 	}
 }
 
+// ResponseAddressFilter sets a function that approves which peer addresses we
+// send in the closer peers and providers of our responses, e.g.
+// PublicAddressFilter to keep private ranges off the public DHT, or
+// NoRelayAddressFilter. Peers left without an address are still sent.
+//
+// Defaults to nil, which sends all the addresses we know.
+func ResponseAddressFilter(filter AddressFilterFunc) Option {
+	return func(c *dhtcfg.Config) error {
+		c.ResponseAddressFilter = filter
+		return nil
+	}
+}
+
+// QueryAddressFilter is the counterpart of ResponseAddressFilter for the
+// responses we get: the peer addresses it rejects are dropped before anything
+// else sees them, including the query filter and the peerstore.
+//
+// Defaults to nil, which keeps all the addresses we get.
+func QueryAddressFilter(filter AddressFilterFunc) Option {
+	return func(c *dhtcfg.Config) error {
+		c.QueryAddressFilter = filter
+		return nil
+	}
+}
+
+// ConnectionGater makes the DHT consult gater, usually the one the host was
+// built with, on the query path. Lookup candidates the gater doesn't allow
+// dialing are skipped rather than dialed, and the requests of peers it doesn't
+// accept are refused, including those coming in over datagrams and HTTP, which
+// bypass the host. Both are counted by the blocked dials and blocked requests
+// metrics, and the skipped candidates are left in the PeerBlocked state.
+//
+// Defaults to nil, which leaves gating to the host.
+func ConnectionGater(gater connmgr.ConnectionGater) Option {
+	return func(c *dhtcfg.Config) error {
+		c.ConnectionGater = gater
+		return nil
+	}
+}
+
 // RoutingTableFilter sets a function that approves which peers may be added to the routing table. The host should
 // already have at least one connection to the peer under consideration.
 func RoutingTableFilter(filter RouteTableFilterFunc) Option {
@@ -4,21 +4,35 @@ import (
 	"bytes"
 	"context"
 	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io/ioutil"
+	"math/big"
 	"math/rand"
+	gonet "net"
+	"net/http"
+	"net/http/httptest"
 	"runtime"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/libp2p/go-libp2p-core/control"
 	"github.com/libp2p/go-libp2p-core/event"
 	"github.com/libp2p/go-libp2p-core/network"
 	"github.com/libp2p/go-libp2p-core/peer"
 	"github.com/libp2p/go-libp2p-core/peerstore"
+	"github.com/libp2p/go-libp2p-core/protocol"
 	"github.com/libp2p/go-libp2p-core/routing"
+	coretest "github.com/libp2p/go-libp2p-core/test"
 	ma "github.com/multiformats/go-multiaddr"
 	"github.com/multiformats/go-multihash"
 	"github.com/multiformats/go-multistream"
@@ -26,16 +40,29 @@ import (
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
+	"github.com/libp2p/go-libp2p-kad-dht/internal/net"
 	test "github.com/libp2p/go-libp2p-kad-dht/internal/testing"
+	"github.com/libp2p/go-libp2p-kad-dht/metrics"
 	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
+	"github.com/libp2p/go-libp2p-kad-dht/providers"
+	"github.com/libp2p/go-libp2p-kad-dht/qpeerset"
 
 	"github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+	dssync "github.com/ipfs/go-datastore/sync"
 	detectrace "github.com/ipfs/go-detect-race"
 	u "github.com/ipfs/go-ipfs-util"
+	"github.com/ipfs/go-ipns"
 	kb "github.com/libp2p/go-libp2p-kbucket"
 	record "github.com/libp2p/go-libp2p-record"
+	swarm "github.com/libp2p/go-libp2p-swarm"
 	swarmt "github.com/libp2p/go-libp2p-swarm/testing"
 	bhost "github.com/libp2p/go-libp2p/p2p/host/basic"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
 )
 
 var testCaseCids []cid.Cid
@@ -344,8 +371,8 @@ func TestValueSetInvalid(t *testing.T) {
 	defer dhtA.host.Close()
 	defer dhtB.host.Close()
 
-	dhtA.Validator.(record.NamespacedValidator)["v"] = test.TestValidator{}
-	dhtB.Validator.(record.NamespacedValidator)["v"] = blankValidator{}
+	dhtA.recordValidator.(record.NamespacedValidator)["v"] = test.TestValidator{}
+	dhtB.recordValidator.(record.NamespacedValidator)["v"] = blankValidator{}
 
 	connect(t, ctx, dhtA, dhtB)
 
@@ -385,6 +412,46 @@ func TestValueSetInvalid(t *testing.T) {
 	testSetGet("valid", true, "newer", nil)
 }
 
+func TestRuntimeValidators(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dhtA := setupDHT(ctx, t, false)
+	dhtB := setupDHT(ctx, t, false)
+
+	defer dhtA.Close()
+	defer dhtB.Close()
+	defer dhtA.host.Close()
+	defer dhtB.host.Close()
+
+	connect(t, ctx, dhtA, dhtB)
+
+	require.Error(t, dhtA.PutValue(ctx, "/w/hello", []byte("world")))
+
+	require.NoError(t, dhtA.AddValidator("w", blankValidator{}))
+	require.NoError(t, dhtB.AddValidator("w", blankValidator{}))
+	require.NoError(t, dhtA.PutValue(ctx, "/w/hello", []byte("world")))
+
+	ctxT, cancelT := context.WithTimeout(ctx, 5*time.Second)
+	defer cancelT()
+	val, err := dhtB.GetValue(ctxT, "/w/hello")
+	require.NoError(t, err)
+	require.Equal(t, "world", string(val))
+
+	require.NoError(t, dhtA.RemoveValidator("w"))
+	require.Error(t, dhtA.PutValue(ctx, "/w/hello", []byte("again")))
+	// other namespaces are untouched
+	require.NoError(t, dhtA.PutValue(ctx, "/v/hello", []byte("world")))
+
+	h, err := bhost.NewHost(ctx, swarmt.GenSwarm(t, ctx, swarmt.OptDisableReuseport), new(bhost.HostOpts))
+	require.NoError(t, err)
+	defer h.Close()
+	ipfsDHT, err := New(ctx, h, Mode(ModeClient))
+	require.NoError(t, err)
+	defer ipfsDHT.Close()
+	require.Error(t, ipfsDHT.AddValidator("w", blankValidator{}))
+}
+
 func TestContextShutDown(t *testing.T) {
 	t.Skip("This test is flaky, see https://github.com/libp2p/go-libp2p-kad-dht/issues/724.")
 	ctx, cancel := context.WithCancel(context.Background())
@@ -426,8 +493,8 @@ func TestSearchValue(t *testing.T) {
 
 	connect(t, ctx, dhtA, dhtB)
 
-	dhtA.Validator.(record.NamespacedValidator)["v"] = test.TestValidator{}
-	dhtB.Validator.(record.NamespacedValidator)["v"] = test.TestValidator{}
+	dhtA.recordValidator.(record.NamespacedValidator)["v"] = test.TestValidator{}
+	dhtB.recordValidator.(record.NamespacedValidator)["v"] = test.TestValidator{}
 
 	ctxT, cancel := context.WithTimeout(ctx, time.Second)
 	defer cancel()
@@ -468,6 +535,95 @@ func TestSearchValue(t *testing.T) {
 	}
 }
 
+func TestGetValueCrossValidate(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dhts := setupDHTS(t, ctx, 4)
+	defer func() {
+		for _, d := range dhts {
+			d.Close()
+			defer d.host.Close()
+		}
+	}()
+	for _, d := range dhts {
+		d.recordValidator.(record.NamespacedValidator)["v"] = test.TestValidator{}
+	}
+	connect(t, ctx, dhts[0], dhts[1])
+	connect(t, ctx, dhts[0], dhts[2])
+	connect(t, ctx, dhts[0], dhts[3])
+
+	ctxT, cancelT := context.WithTimeout(ctx, 5*time.Second)
+	defer cancelT()
+
+	for i, val := range []string{"valid", "newer"} {
+		rec := record.MakePutRecord("/v/hello", []byte(val))
+		rec.TimeReceived = u.FormatRFC3339(time.Now())
+		require.NoError(t, dhts[i+1].putLocal(ctxT, "/v/hello", rec))
+	}
+
+	var report ValueReport
+	val, err := dhts[0].GetValue(ctxT, "/v/hello", CrossValidate(&report))
+	require.NoError(t, err)
+	require.Equal(t, []byte("newer"), val)
+
+	require.True(t, report.Divergent())
+	require.Len(t, report.Values, 2)
+	require.Equal(t, []byte("newer"), report.Values[0].Val)
+	require.Equal(t, []peer.ID{dhts[2].self}, report.Values[0].Peers)
+	require.Equal(t, []byte("valid"), report.Values[1].Val)
+	require.Equal(t, []peer.ID{dhts[1].self}, report.Values[1].Peers)
+	require.Equal(t, []peer.ID{dhts[3].self}, report.Missing)
+}
+
+func TestSearchValueProgressive(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dhtA := setupDHT(ctx, t, false)
+	dhtB := setupDHT(ctx, t, false)
+
+	defer dhtA.Close()
+	defer dhtB.Close()
+	defer dhtA.host.Close()
+	defer dhtB.host.Close()
+
+	dhtA.recordValidator.(record.NamespacedValidator)["v"] = test.TestValidator{}
+	dhtB.recordValidator.(record.NamespacedValidator)["v"] = test.TestValidator{}
+
+	connect(t, ctx, dhtA, dhtB)
+
+	ctxT, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	require.NoError(t, dhtA.PutValue(ctxT, "/v/hello", []byte("valid")))
+	rec := record.MakePutRecord("/v/hello", []byte("newer"))
+	rec.TimeReceived = u.FormatRFC3339(time.Now())
+	require.NoError(t, dhtB.putLocal(ctxT, "/v/hello", rec))
+
+	updates, err := dhtA.SearchValueProgressive(ctxT, "/v/hello")
+	require.NoError(t, err)
+
+	var got []ValueUpdate
+	for upd := range updates {
+		got = append(got, upd)
+	}
+	require.NoError(t, ctxT.Err())
+	require.Len(t, got, 3)
+	require.Equal(t, ValueUpdate{Value: []byte("valid")}, got[0])
+	require.Equal(t, ValueUpdate{Value: []byte("newer")}, got[1])
+	require.Equal(t, ValueUpdate{Value: []byte("newer"), Settled: true}, got[2])
+
+	// a search that finds nothing still settles
+	updates, err = dhtA.SearchValueProgressive(ctxT, "/v/missing")
+	require.NoError(t, err)
+	got = nil
+	for upd := range updates {
+		got = append(got, upd)
+	}
+	require.Equal(t, []ValueUpdate{{Settled: true}}, got)
+}
+
 func TestValueGetInvalid(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -480,8 +636,8 @@ func TestValueGetInvalid(t *testing.T) {
 	defer dhtA.host.Close()
 	defer dhtB.host.Close()
 
-	dhtA.Validator.(record.NamespacedValidator)["v"] = blankValidator{}
-	dhtB.Validator.(record.NamespacedValidator)["v"] = test.TestValidator{}
+	dhtA.recordValidator.(record.NamespacedValidator)["v"] = blankValidator{}
+	dhtB.recordValidator.(record.NamespacedValidator)["v"] = test.TestValidator{}
 
 	connect(t, ctx, dhtA, dhtB)
 
@@ -565,8 +721,77 @@ func TestProvides(t *testing.T) {
 	}
 }
 
-func TestLocalProvides(t *testing.T) {
-	// t.Skip("skipping test to debug another")
+func TestProvideMany(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	provider := setupDHT(ctx, t, false, ReplicationFactor(2))
+	defer provider.Close()
+	defer provider.host.Close()
+
+	// count the batched FIND_NODE requests
+	countBatched := func(n *int64) Option {
+		return HandlerMiddleware(func(next RequestHandler) RequestHandler {
+			return func(ctx context.Context, p peer.ID, req *pb.Message) (*pb.Message, error) {
+				if req.GetType() == pb.Message_FIND_NODE && len(req.GetKeys()) > 0 {
+					atomic.AddInt64(n, 1)
+				}
+				return next(ctx, p, req)
+			}
+		})
+	}
+	var batched, legacyBatched int64
+	dhts := setupDHTS(t, ctx, 7, countBatched(&batched))
+	dhts = append(dhts, setupDHT(ctx, t, false, countBatched(&legacyBatched)))
+	defer func() {
+		for i := 0; i < 8; i++ {
+			dhts[i].Close()
+			defer dhts[i].host.Close()
+		}
+	}()
+
+	byID := make(map[peer.ID]*IpfsDHT)
+	var ids []peer.ID
+	for i := range dhts {
+		byID[dhts[i].self] = dhts[i]
+		ids = append(ids, dhts[i].self)
+		connect(t, ctx, provider, dhts[i])
+		for j := i + 1; j < len(dhts); j++ {
+			connect(t, ctx, dhts[i], dhts[j])
+		}
+	}
+	// the last peer doesn't support batched requests
+	pb.RememberCapabilities(provider.peerstore, dhts[7].self, 0)
+
+	var keys []multihash.Multihash
+	for i := 0; i < 50; i++ {
+		keys = append(keys, u.Hash([]byte(fmt.Sprintf("sweep-%d", i))))
+	}
+	require.NoError(t, provider.ProvideMany(ctx, keys))
+
+	// the closest peers of the next keys are asked in batches, but not from
+	// the peers that don't support it
+	require.NotZero(t, atomic.LoadInt64(&batched))
+	region := &sweepRegion{target: kb.ConvertKey(string(keys[0])), peers: []peer.ID{dhts[0].self, dhts[7].self}, radius: new(big.Int)}
+	provider.widenRegion(ctx, region, [][]byte{keys[1], keys[2]})
+	require.ElementsMatch(t, ids, region.peers)
+	require.Zero(t, atomic.LoadInt64(&legacyBatched))
+
+	// every key must have reached its actual closest peers, whether or not
+	// its lookup was reused.
+	for _, k := range keys {
+		closest := kb.SortClosestPeers(ids, kb.ConvertKey(string(k)))[:2]
+		for _, p := range closest {
+			d := byID[p]
+			require.Eventually(t, func() bool {
+				provs, err := d.providerStore.GetProviders(ctx, k)
+				return err == nil && len(provs) == 1 && provs[0].ID == provider.self
+			}, 5*time.Second, 10*time.Millisecond)
+		}
+	}
+}
+
+func TestUnprovide(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
@@ -582,875 +807,1202 @@ func TestLocalProvides(t *testing.T) {
 	connect(t, ctx, dhts[1], dhts[2])
 	connect(t, ctx, dhts[1], dhts[3])
 
-	for _, k := range testCaseCids {
-		logger.Debugf("announcing provider for %s", k)
-		if err := dhts[3].Provide(ctx, k, false); err != nil {
-			t.Fatal(err)
-		}
-	}
+	k := testCaseCids[0]
+	require.NoError(t, dhts[3].Provide(ctx, k, true))
 
-	time.Sleep(time.Millisecond * 10)
+	providers := func(d *IpfsDHT) int {
+		provs, err := d.providerStore.GetProviders(ctx, k.Hash())
+		require.NoError(t, err)
+		return len(provs)
+	}
+	for _, d := range dhts {
+		require.Eventually(t, func() bool { return providers(d) == 1 }, 5*time.Second, 10*time.Millisecond)
+	}
 
-	for _, c := range testCaseCids {
-		for i := 0; i < 3; i++ {
-			provs, _ := dhts[i].ProviderStore().GetProviders(ctx, c.Hash())
-			if len(provs) > 0 {
-				t.Fatal("shouldnt know this")
-			}
-		}
+	require.NoError(t, dhts[3].Unprovide(ctx, k, true))
+	for _, d := range dhts {
+		require.Eventually(t, func() bool { return providers(d) == 0 }, 5*time.Second, 10*time.Millisecond)
 	}
 }
 
-// if minPeers or avgPeers is 0, dont test for it.
-func waitForWellFormedTables(t *testing.T, dhts []*IpfsDHT, minPeers, avgPeers int, timeout time.Duration) {
-	// test "well-formed-ness" (>= minPeers peers in every routing table)
-	t.Helper()
+func TestDoubleHashProviderKeys(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-	checkTables := func() bool {
-		totalPeers := 0
-		for _, dht := range dhts {
-			rtlen := dht.routingTable.Size()
-			totalPeers += rtlen
-			if minPeers > 0 && rtlen < minPeers {
-				//t.Logf("routing table for %s only has %d peers (should have >%d)", dht.self, rtlen, minPeers)
-				return false
-			}
-		}
-		actualAvgPeers := totalPeers / len(dhts)
-		t.Logf("avg rt size: %d", actualAvgPeers)
-		if avgPeers > 0 && actualAvgPeers < avgPeers {
-			t.Logf("avg rt size: %d < %d", actualAvgPeers, avgPeers)
-			return false
-		}
-		return true
+	dhtA := setupDHT(ctx, t, false, DoubleHashProviderKeys())
+	dhtB := setupDHT(ctx, t, false, DoubleHashProviderKeys())
+	dhtC := setupDHT(ctx, t, false)
+	for _, d := range []*IpfsDHT{dhtA, dhtB, dhtC} {
+		defer d.Close()
+		defer d.host.Close()
 	}
 
-	timeoutA := time.After(timeout)
-	for {
-		select {
-		case <-timeoutA:
-			t.Errorf("failed to reach well-formed routing tables after %s", timeout)
-			return
-		case <-time.After(5 * time.Millisecond):
-			if checkTables() {
-				// succeeded
-				return
-			}
-		}
-	}
-}
+	connect(t, ctx, dhtA, dhtC)
+	connect(t, ctx, dhtB, dhtC)
 
-func printRoutingTables(dhts []*IpfsDHT) {
-	// the routing tables should be full now. let's inspect them.
-	fmt.Printf("checking routing table of %d\n", len(dhts))
-	for _, dht := range dhts {
-		fmt.Printf("checking routing table of %s\n", dht.self)
-		dht.routingTable.Print()
-		fmt.Println("")
-	}
-}
+	k := testCaseCids[0]
+	require.NoError(t, dhtA.Provide(ctx, k, true))
 
-func TestRefresh(t *testing.T) {
-	if testing.Short() {
-		t.SkipNow()
-	}
+	// the intermediate node only ever sees the double hash
+	require.Eventually(t, func() bool {
+		provs, err := dhtC.providerStore.GetProviders(ctx, DoubleHashProviderKey(k.Hash()))
+		return err == nil && len(provs) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	provs, err := dhtC.providerStore.GetProviders(ctx, k.Hash())
+	require.NoError(t, err)
+	require.Empty(t, provs)
 
+	ctxT, cancelT := context.WithTimeout(ctx, 5*time.Second)
+	defer cancelT()
+	provs, err = dhtB.FindProviders(ctxT, k)
+	require.NoError(t, err)
+	require.Len(t, provs, 1)
+	require.Equal(t, dhtA.self, provs[0].ID)
+}
+
+func TestSignedProviderRecords(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	nDHTs := 30
-	dhts := setupDHTS(t, ctx, nDHTs)
-	defer func() {
-		for i := 0; i < nDHTs; i++ {
-			dhts[i].Close()
-			defer dhts[i].host.Close()
-		}
-	}()
+	signer := setupDHT(ctx, t, false, SignProviderRecords())
+	server := setupDHT(ctx, t, false)
+	client := setupDHT(ctx, t, false)
+	for _, d := range []*IpfsDHT{signer, server, client} {
+		defer d.Close()
+		defer d.host.Close()
+	}
+	connect(t, ctx, signer, server)
+	connect(t, ctx, client, server)
 
-	t.Logf("connecting %d dhts in a ring", nDHTs)
-	for i := 0; i < nDHTs; i++ {
-		connect(t, ctx, dhts[i], dhts[(i+1)%len(dhts)])
+	k := testCaseCids[0]
+	require.NoError(t, signer.Provide(ctx, k, true))
+
+	var recs []*pb.ProviderRecord
+	require.Eventually(t, func() bool {
+		var err error
+		recs, _, err = client.protoMessenger.GetProviderRecords(ctx, server.self, k.Hash())
+		return err == nil && len(recs) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, signer.self, recs[0].ID)
+	require.NotEmpty(t, recs[0].Signature)
+	require.Less(t, recs[0].Age, time.Minute)
+	require.NoError(t, client.checkProviderTimestamp(signer.self, k.Hash(), recs[0].SignedAt, recs[0].Signature))
+
+	// a tampered timestamp doesn't verify
+	require.Error(t, client.checkProviderTimestamp(signer.self, k.Hash(), recs[0].SignedAt.Add(time.Second), recs[0].Signature))
+
+	addSigned := func(at time.Time) {
+		sig, err := pb.SignProviderTimestamp(signer.peerstore.PrivKey(signer.self), k.Hash(), at)
+		require.NoError(t, err)
+		pmes := pb.NewMessage(pb.Message_ADD_PROVIDER, k.Hash(), 0)
+		pmes.ProviderPeers = pb.RawPeerInfosToPBPeers([]peer.AddrInfo{{ID: signer.self, Addrs: signer.host.Addrs()}})
+		pmes.ProviderPeers[0].SignedAt = at.UnixNano()
+		pmes.ProviderPeers[0].Signature = sig
+		_, err = server.handleAddProvider(ctx, signer.self, pmes)
+		require.NoError(t, err)
+	}
+	received := func() time.Time {
+		recs, err := server.providerStore.(providers.ProviderRecordStore).GetProviderRecords(ctx, k.Hash())
+		require.NoError(t, err)
+		require.Len(t, recs, 1)
+		return recs[0].Received
 	}
 
-	<-time.After(100 * time.Millisecond)
-	// bootstrap a few times until we get good tables.
-	t.Logf("bootstrapping them so they find each other %d", nDHTs)
+	// replaying an older signed announcement doesn't refresh the record
+	before := received()
+	addSigned(recs[0].SignedAt.Add(-time.Minute))
+	require.Equal(t, before, received())
+
+	// nor does replaying the very same one
+	addSigned(recs[0].SignedAt)
+	require.Equal(t, before, received())
+
+	// neither does an announcement signed too long ago
+	addSigned(time.Now().Add(-2 * providers.ProvideValidity))
+	require.Equal(t, before, received())
+
+	// a newer one does
+	addSigned(time.Now())
+	require.True(t, received().After(before))
+
 	ctxT, cancelT := context.WithTimeout(ctx, 5*time.Second)
 	defer cancelT()
+	provs, err := client.FindProviders(ctxT, k)
+	require.NoError(t, err)
+	require.Len(t, provs, 1)
+	require.Equal(t, signer.self, provs[0].ID)
+}
 
-	for ctxT.Err() == nil {
-		bootstrap(t, ctxT, dhts)
+func TestProviderTransferProtocols(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-		// wait a bit.
-		select {
-		case <-time.After(50 * time.Millisecond):
-			continue // being explicit
-		case <-ctxT.Done():
-			return
-		}
+	provider := setupDHT(ctx, t, false, ProviderTransferProtocols(TransferBitswap, TransferHTTP))
+	server := setupDHT(ctx, t, false)
+	client := setupDHT(ctx, t, false)
+	for _, d := range []*IpfsDHT{provider, server, client} {
+		defer d.Close()
+		defer d.host.Close()
 	}
+	connect(t, ctx, provider, server)
+	connect(t, ctx, client, server)
 
-	waitForWellFormedTables(t, dhts, 7, 10, 10*time.Second)
-
-	cancelT()
+	k := testCaseCids[0]
+	require.NoError(t, provider.Provide(ctx, k, true))
 
-	if u.Debug {
-		// the routing tables should be full now. let's inspect them.
-		printRoutingTables(dhts)
+	expected := []string{TransferBitswap, TransferHTTP}
+	require.Eventually(t, func() bool {
+		recs, err := server.providerStore.(providers.ProviderRecordStore).GetProviderRecords(ctx, k.Hash())
+		return err == nil && len(recs) == 1 && len(recs[0].TransferProtocols) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+
+	for _, d := range []*IpfsDHT{provider, client} {
+		ctxT, cancelT := context.WithTimeout(ctx, 5*time.Second)
+		var infos []ProviderInfo
+		for info := range d.FindProviderInfosAsync(ctxT, k, 1) {
+			infos = append(infos, info)
+		}
+		cancelT()
+		require.Len(t, infos, 1)
+		require.Equal(t, provider.self, infos[0].ID)
+		require.Equal(t, expected, infos[0].TransferProtocols)
 	}
+
+	_, err := New(ctx, client.host, ProviderTransferProtocols(""))
+	require.Error(t, err)
 }
 
-func TestRefreshBelowMinRTThreshold(t *testing.T) {
+func TestReproviderTiers(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	host, err := bhost.NewHost(ctx, swarmt.GenSwarm(t, ctx, swarmt.OptDisableReuseport), new(bhost.HostOpts))
-	require.NoError(t, err)
+	keysOf := func(cids ...cid.Cid) KeyChanFunc {
+		return func(ctx context.Context) (<-chan cid.Cid, error) {
+			ch := make(chan cid.Cid, len(cids))
+			for _, c := range cids {
+				ch <- c
+			}
+			close(ch)
+			return ch, nil
+		}
+	}
+	tiers := []ReproviderTier{
+		{Name: "pinned", Keys: keysOf(testCaseCids[0]), Interval: time.Hour},
+		{Name: "blocks", Keys: keysOf(testCaseCids[0], testCaseCids[1], testCaseCids[2]), Interval: 2 * time.Hour},
+	}
 
-	// enable auto bootstrap on A
-	dhtA, err := New(
-		ctx,
-		host,
-		testPrefix,
-		Mode(ModeServer),
-		NamespacedValidator("v", blankValidator{}),
-	)
-	if err != nil {
-		t.Fatal(err)
+	provider := setupDHT(ctx, t, false, ReproviderTiers(tiers...))
+	other := setupDHT(ctx, t, false)
+	for _, d := range []*IpfsDHT{provider, other} {
+		defer d.Close()
+		defer d.host.Close()
 	}
+	connect(t, ctx, provider, other)
 
-	dhtB := setupDHT(ctx, t, false)
-	dhtC := setupDHT(ctx, t, false)
+	require.NoError(t, provider.Reprovide(ctx))
+	for _, c := range testCaseCids[:3] {
+		require.Eventually(t, func() bool {
+			provs, err := other.providerStore.GetProviders(ctx, c.Hash())
+			return err == nil && len(provs) == 1
+		}, 5*time.Second, 10*time.Millisecond)
+	}
+
+	stats := provider.ReproviderStats()
+	require.Len(t, stats, 2)
+	require.Equal(t, "pinned", stats[0].Name)
+	require.Equal(t, 1, stats[0].Rounds)
+	require.Equal(t, 1, stats[0].LastKeys)
+	require.NoError(t, stats[0].LastError)
+	require.Equal(t, stats[0].LastStart.Add(time.Hour), stats[0].NextRound)
+	// the key shared with the pinned tier isn't reprovided twice
+	require.Equal(t, 2, stats[1].LastKeys)
+	require.False(t, stats[1].LastStart.Before(stats[0].LastStart.Add(stats[0].LastDuration)))
+
+	// retracted keys are skipped until they are provided again
+	require.NoError(t, provider.Unprovide(ctx, testCaseCids[1], true))
+	require.Eventually(t, func() bool {
+		provs, err := other.providerStore.GetProviders(ctx, testCaseCids[1].Hash())
+		return err == nil && len(provs) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+	require.NoError(t, provider.Reprovide(ctx))
+	require.Equal(t, 1, provider.ReproviderStats()[1].LastKeys)
+	provs, err := other.providerStore.GetProviders(ctx, testCaseCids[1].Hash())
+	require.NoError(t, err)
+	require.Empty(t, provs)
 
-	defer func() {
-		dhtA.Close()
-		dhtA.host.Close()
+	require.NoError(t, provider.Provide(ctx, testCaseCids[1], false))
+	require.NoError(t, provider.Reprovide(ctx))
+	require.Equal(t, 2, provider.ReproviderStats()[1].LastKeys)
+	require.Eventually(t, func() bool {
+		provs, err := other.providerStore.GetProviders(ctx, testCaseCids[1].Hash())
+		return err == nil && len(provs) == 1
+	}, 5*time.Second, 10*time.Millisecond)
 
-		dhtB.Close()
-		dhtB.host.Close()
+	_, err = New(ctx, other.host, ReproviderTiers(ReproviderTier{Name: "pinned", Keys: keysOf(), Interval: 0}))
+	require.Error(t, err)
+}
 
-		dhtC.Close()
-		dhtC.host.Close()
-	}()
-
-	connect(t, ctx, dhtA, dhtB)
-	connect(t, ctx, dhtB, dhtC)
-
-	// we ONLY init bootstrap on A
-	dhtA.RefreshRoutingTable()
-	// and wait for one round to complete i.e. A should be connected to both B & C
-	waitForWellFormedTables(t, []*IpfsDHT{dhtA}, 2, 2, 20*time.Second)
+func TestProvideConcurrency(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-	// now we create two new peers
-	dhtD := setupDHT(ctx, t, false)
-	dhtE := setupDHT(ctx, t, false)
+	provider := setupDHT(ctx, t, false, ProvideConcurrency(1, 1))
+	others := setupDHTS(t, ctx, 3)
+	for _, d := range append(others, provider) {
+		defer d.Close()
+		defer d.host.Close()
+	}
+	for _, d := range others {
+		connect(t, ctx, provider, d)
+	}
 
-	// connect them to each other
-	connect(t, ctx, dhtD, dhtE)
-	defer func() {
-		dhtD.Close()
-		dhtD.host.Close()
+	// hold the only lookup slot so provides queue up behind it
+	release, err := provider.provideLookups.acquire(ctx)
+	require.NoError(t, err)
 
-		dhtE.Close()
-		dhtE.host.Close()
-	}()
+	var wg sync.WaitGroup
+	for _, c := range testCaseCids[:5] {
+		wg.Add(1)
+		go func(c cid.Cid) {
+			defer wg.Done()
+			assert.NoError(t, provider.Provide(ctx, c, true))
+		}(c)
+	}
+	require.Eventually(t, func() bool {
+		return provider.ProvideQueueStats().Lookups.Queued == 5
+	}, 5*time.Second, 10*time.Millisecond)
+	stats := provider.ProvideQueueStats()
+	require.Equal(t, ProvideStageStats{Queued: 5, InFlight: 1, Limit: 1}, stats.Lookups)
 
-	// and then, on connecting the peer D to A, the min RT threshold gets triggered on A which leads to a bootstrap.
-	// since the default bootstrap scan interval is 30 mins - 1 hour, we can be sure that if bootstrap happens,
-	// it is because of the min RT threshold getting triggered (since default min value is 4 & we only have 2 peers in the RT when D gets connected)
-	connect(t, ctx, dhtA, dhtD)
+	// a provide giving up while queued reports its context error
+	ctxT, cancelT := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancelT()
+	require.ErrorIs(t, provider.Provide(ctxT, testCaseCids[5], true), context.DeadlineExceeded)
 
-	// and because of the above bootstrap, A also discovers E !
-	waitForWellFormedTables(t, []*IpfsDHT{dhtA}, 4, 4, 20*time.Second)
-	assert.Equal(t, dhtE.self, dhtA.routingTable.Find(dhtE.self), "A's routing table should have peer E!")
-}
+	release()
+	wg.Wait()
+	require.Equal(t, ProvideQueueStats{
+		Lookups: ProvideStageStats{Limit: 1},
+		RPCs:    ProvideStageStats{Limit: 1},
+	}, provider.ProvideQueueStats())
+
+	for _, c := range testCaseCids[:5] {
+		for _, d := range others {
+			require.Eventually(t, func() bool {
+				provs, err := d.providerStore.GetProviders(ctx, c.Hash())
+				return err == nil && len(provs) == 1
+			}, 5*time.Second, 10*time.Millisecond)
+		}
+	}
 
-func TestQueryWithEmptyRTShouldNotPanic(t *testing.T) {
-	ctx := context.Background()
-	d := setupDHT(ctx, t, false)
+	// peers that could not be sent the records for lack of a free rpc slot
+	// are reported as such
+	release, err = provider.provideRPCs.acquire(ctx)
+	require.NoError(t, err)
+	defer release()
 
-	// TODO This swallows the error for now, should we change it ?
-	// FindProviders
-	ps, _ := d.FindProviders(ctx, testCaseCids[0])
-	require.Empty(t, ps)
+	ctxT, cancelT = context.WithTimeout(ctx, time.Second)
+	defer cancelT()
+	res, err := provider.ProvideWithResult(ctxT, testCaseCids[6], true)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.Empty(t, res.Succeeded)
+	require.Len(t, res.Failed, len(others))
+	for _, err := range res.Failed {
+		require.ErrorIs(t, err, ErrNoProvideSlot)
+	}
 
-	// GetClosestPeers
-	pc, err := d.GetClosestPeers(ctx, "key")
-	require.Nil(t, pc)
-	require.Equal(t, kb.ErrLookupFailure, err)
+	ctxT, cancelT = context.WithTimeout(ctx, time.Second)
+	defer cancelT()
+	res, err = provider.ProvideManyWithResult(ctxT, []multihash.Multihash{testCaseCids[7].Hash()})
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.Empty(t, res.Succeeded)
+	require.Len(t, res.Failed, len(others))
+	for _, err := range res.Failed {
+		require.ErrorIs(t, err, ErrNoProvideSlot)
+	}
+}
 
-	// GetValue
-	best, err := d.GetValue(ctx, "key")
-	require.Empty(t, best)
-	require.Error(t, err)
+func TestRequestPipelining(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-	// SearchValue
-	bchan, err := d.SearchValue(ctx, "key")
-	require.Empty(t, bchan)
-	require.NoError(t, err)
+	client := setupDHT(ctx, t, false, RequestPipelining(4))
+	server := setupDHT(ctx, t, false)
+	for _, d := range []*IpfsDHT{client, server} {
+		defer d.Close()
+		defer d.host.Close()
+	}
+	connect(t, ctx, client, server)
 
-	// Provide
-	err = d.Provide(ctx, testCaseCids[0], true)
-	require.Equal(t, kb.ErrLookupFailure, err)
-}
+	key := "/v/hello"
+	rec := record.MakePutRecord(key, []byte("world"))
+	rec.TimeReceived = u.FormatRFC3339(time.Now())
+	require.NoError(t, server.putLocal(ctx, key, rec))
 
-func TestPeriodicRefresh(t *testing.T) {
-	if testing.Short() {
-		t.SkipNow()
+	var wg sync.WaitGroup
+	errs := make(chan error, 32)
+	for i := 0; i < 32; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			got, _, err := client.protoMessenger.GetValue(ctx, server.self, key)
+			if err == nil && !bytes.Equal(got.GetValue(), []byte("world")) {
+				err = fmt.Errorf("unexpected value %q", got.GetValue())
+			}
+			errs <- err
+		}()
 	}
-	if runtime.GOOS == "windows" {
-		t.Skip("skipping due to #760")
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
 	}
-	if detectrace.WithRace() {
-		t.Skip("skipping due to race detector max goroutines")
+
+	// all the requests went over a single stream
+	outbound := 0
+	for _, c := range client.host.Network().ConnsToPeer(server.self) {
+		for _, s := range c.GetStreams() {
+			if s.Stat().Direction == network.DirOutbound && s.Protocol() == client.protocols[0] {
+				outbound++
+			}
+		}
 	}
+	require.Equal(t, 1, outbound)
+}
 
+func TestInboundRequestThrottling(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	nDHTs := 30
-	dhts := setupDHTS(t, ctx, nDHTs)
-	defer func() {
-		for i := 0; i < nDHTs; i++ {
-			dhts[i].Close()
-			defer dhts[i].host.Close()
-		}
-	}()
-
-	t.Logf("dhts are not connected. %d", nDHTs)
-	for _, dht := range dhts {
-		rtlen := dht.routingTable.Size()
-		if rtlen > 0 {
-			t.Errorf("routing table for %s should have 0 peers. has %d", dht.self, rtlen)
-		}
+	client := setupDHT(ctx, t, false)
+	server := setupDHT(ctx, t, false, InboundRequestRateLimit(0.01, 1))
+	for _, d := range []*IpfsDHT{client, server} {
+		defer d.Close()
+		defer d.host.Close()
 	}
+	connect(t, ctx, client, server)
 
-	for i := 0; i < nDHTs; i++ {
-		connect(t, ctx, dhts[i], dhts[(i+1)%len(dhts)])
-	}
+	_, err := client.protoMessenger.GetClosestPeers(ctx, server.self, client.self)
+	require.NoError(t, err)
 
-	t.Logf("DHTs are now connected to 1-2 others. %d", nDHTs)
-	for _, dht := range dhts {
-		rtlen := dht.routingTable.Size()
-		if rtlen > 2 {
-			t.Errorf("routing table for %s should have at most 2 peers. has %d", dht.self, rtlen)
-		}
-	}
+	_, err = client.protoMessenger.GetClosestPeers(ctx, server.self, client.self)
+	var throttled *pb.ThrottledError
+	require.True(t, errors.As(err, &throttled), "expected a throttled error, got %v", err)
+	require.True(t, throttled.RetryAfter > 0)
 
-	if u.Debug {
-		printRoutingTables(dhts)
-	}
+	// the lookup backs off the throttling peer instead of dropping it
+	_, err = client.GetClosestPeers(ctx, "foo")
+	require.NoError(t, err)
+	require.True(t, client.peerBackoff.backingOff(server.self))
+	require.Equal(t, 1, client.routingTable.Size())
+}
 
-	t.Logf("bootstrapping them so they find each other. %d", nDHTs)
-	var wg sync.WaitGroup
-	for _, dht := range dhts {
-		wg.Add(1)
-		go func(d *IpfsDHT) {
-			<-d.RefreshRoutingTable()
-			wg.Done()
-		}(dht)
-	}
+func TestPeerBackoffPruned(t *testing.T) {
+	var b peerBackoff
+	require.True(t, b.empty())
 
-	wg.Wait()
-	// this is async, and we dont know when it's finished with one cycle, so keep checking
-	// until the routing tables look better, or some long timeout for the failure case.
-	waitForWellFormedTables(t, dhts, 7, 10, 20*time.Second)
+	// expired entries are dropped
+	b.add("expired", -time.Second)
+	require.True(t, b.empty())
 
-	if u.Debug {
-		printRoutingTables(dhts)
+	// and the peers remembered are bounded
+	for i := 0; i <= requestRateLimitEntries; i++ {
+		b.add(peer.ID(fmt.Sprint(i)), time.Minute)
 	}
+	require.Equal(t, requestRateLimitEntries, b.until.Len())
+	require.False(t, b.backingOff("0"))
+	require.True(t, b.backingOff(peer.ID(fmt.Sprint(requestRateLimitEntries))))
 }
 
-func TestProvidesMany(t *testing.T) {
-	if runtime.GOOS == "windows" {
-		t.Skip("skipping due to #760")
-	}
-	if detectrace.WithRace() {
-		t.Skip("skipping due to race detector max goroutines")
-	}
+func TestLivenessPiggyback(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	nDHTs := 40
-	dhts := setupDHTS(t, ctx, nDHTs)
-	defer func() {
-		for i := 0; i < nDHTs; i++ {
-			dhts[i].Close()
-			defer dhts[i].host.Close()
-		}
-	}()
-
-	t.Logf("connecting %d dhts in a ring", nDHTs)
-	for i := 0; i < nDHTs; i++ {
-		connect(t, ctx, dhts[i], dhts[(i+1)%len(dhts)])
+	client := setupDHT(ctx, t, false)
+	server := setupDHT(ctx, t, false)
+	for _, d := range []*IpfsDHT{client, server} {
+		defer d.Close()
+		defer d.host.Close()
 	}
+	connect(t, ctx, client, server)
 
-	<-time.After(100 * time.Millisecond)
-	t.Logf("bootstrapping them so they find each other. %d", nDHTs)
-	ctxT, cancel := context.WithTimeout(ctx, 20*time.Second)
-	defer cancel()
-	bootstrap(t, ctxT, dhts)
-
-	if u.Debug {
-		// the routing tables should be full now. let's inspect them.
-		t.Logf("checking routing table of %d", nDHTs)
-		for _, dht := range dhts {
-			fmt.Printf("checking routing table of %s\n", dht.self)
-			dht.routingTable.Print()
-			fmt.Println("")
+	lastHeard := func() time.Time {
+		for _, pi := range client.routingTable.GetPeerInfos() {
+			if pi.Id == server.self {
+				return pi.LastSuccessfulOutboundQueryAt
+			}
 		}
+		return time.Time{}
 	}
+	stale := time.Now().Add(-time.Hour)
+	require.True(t, client.routingTable.UpdateLastSuccessfulOutboundQueryAt(server.self, stale))
 
-	providers := make(map[cid.Cid]peer.ID)
+	// any answered request shows the peer is alive, not only lookups
+	_, _, err := client.protoMessenger.GetProviders(ctx, server.self, testCaseCids[0].Hash())
+	require.NoError(t, err)
+	require.True(t, lastHeard().After(stale.Add(time.Minute)))
+}
 
-	d := 0
-	for _, c := range testCaseCids {
-		d = (d + 1) % len(dhts)
-		dht := dhts[d]
-		providers[c] = dht.self
+func TestRequestRateLimiterLimits(t *testing.T) {
+	rl := newRequestRateLimiter(0.01, 1, 0.01, 2, nil)
+	ip := gonet.ParseIP("10.0.0.1")
+
+	wait, _ := rl.allow("a", ip)
+	require.Zero(t, wait)
+	// a request refused by the peer limit takes no token from the subnet
+	wait, limit := rl.allow("a", ip)
+	require.NotZero(t, wait)
+	require.Equal(t, "peer", limit)
+	wait, _ = rl.allow("b", ip)
+	require.Zero(t, wait)
+
+	// IPv6 addresses are limited by autonomous system
+	require.Equal(t, "AS15169", subnetOf(gonet.ParseIP("2001:4860:4860::8888")))
+	require.Equal(t, subnetOf(gonet.ParseIP("2001:4860:4860::8888")), subnetOf(gonet.ParseIP("2001:4860:4802::1")))
+	// or by /48 when it isn't known
+	require.Equal(t, subnetOf(gonet.ParseIP("2001:db8:1:2::1")), subnetOf(gonet.ParseIP("2001:db8:1:3::1")))
+	require.NotEqual(t, subnetOf(gonet.ParseIP("2001:db8:1::1")), subnetOf(gonet.ParseIP("2001:db8:2::1")))
+}
 
-		t.Logf("announcing provider for %s", c)
-		if err := dht.Provide(ctx, c, true); err != nil {
-			t.Fatal(err)
+func TestInboundSubnetRateLimit(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, loopback, err := gonet.ParseCIDR("127.0.0.0/8")
+	require.NoError(t, err)
+
+	limited := setupDHT(ctx, t, false, InboundSubnetRateLimit(0.01, 1))
+	allowed := setupDHT(ctx, t, false, InboundSubnetRateLimit(0.01, 1), InboundRateLimitAllowlist(loopback))
+	clients := []*IpfsDHT{setupDHT(ctx, t, false), setupDHT(ctx, t, false)}
+	for _, d := range append([]*IpfsDHT{limited, allowed}, clients...) {
+		defer d.Close()
+		defer d.host.Close()
+	}
+
+	// the peers share the loopback subnet
+	for _, server := range []*IpfsDHT{limited, allowed} {
+		for _, client := range clients {
+			connect(t, ctx, client, server)
 		}
 	}
 
-	// what is this timeout for? was 60ms before.
-	time.Sleep(time.Millisecond * 6)
+	_, err = clients[0].protoMessenger.GetClosestPeers(ctx, limited.self, clients[0].self)
+	require.NoError(t, err)
+	_, err = clients[1].protoMessenger.GetClosestPeers(ctx, limited.self, clients[1].self)
+	var throttled *pb.ThrottledError
+	require.True(t, errors.As(err, &throttled), "expected a throttled error, got %v", err)
 
-	errchan := make(chan error)
+	for _, client := range clients {
+		_, err = client.protoMessenger.GetClosestPeers(ctx, allowed.self, client.self)
+		require.NoError(t, err)
+	}
+}
 
-	ctxT, cancel = context.WithTimeout(ctx, 5*time.Second)
+func TestMessageTypeAccounting(t *testing.T) {
+	views := []*view.View{metrics.ReceivedResponseBytesView, metrics.SentResponseBytesView, metrics.InboundHandlerLatencyView}
+	require.NoError(t, view.Register(views...))
+	defer view.Unregister(views...)
+
+	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	var wg sync.WaitGroup
-	getProvider := func(dht *IpfsDHT, k cid.Cid) {
-		defer wg.Done()
+	client := setupDHT(ctx, t, false)
+	server := setupDHT(ctx, t, false)
+	for _, d := range []*IpfsDHT{client, server} {
+		defer d.Close()
+		defer d.host.Close()
+	}
+	connect(t, ctx, client, server)
 
-		expected := providers[k]
+	_, err := client.protoMessenger.GetClosestPeers(ctx, server.self, client.self)
+	require.NoError(t, err)
 
-		provchan := dht.FindProvidersAsync(ctxT, k, 1)
-		select {
-		case prov := <-provchan:
-			actual := prov.ID
-			if actual == "" {
-				errchan <- fmt.Errorf("Got back nil provider (%s at %s)", k, dht.self)
-			} else if actual != expected {
-				errchan <- fmt.Errorf("Got back wrong provider (%s != %s) (%s at %s)",
-					expected, actual, k, dht.self)
+	recorded := func(v *view.View) bool {
+		rows, err := view.RetrieveData(v.Name)
+		if err != nil {
+			return false
+		}
+		for _, row := range rows {
+			for _, tg := range row.Tags {
+				if tg.Key == metrics.KeyMessageType && tg.Value == pb.Message_FIND_NODE.String() {
+					return row.Data.(*view.DistributionData).Count > 0
+				}
 			}
-		case <-ctxT.Done():
-			errchan <- fmt.Errorf("Did not get a provider back (%s at %s)", k, dht.self)
 		}
+		return false
+	}
+	for _, v := range views {
+		require.Eventually(t, func() bool { return recorded(v) }, 5*time.Second, 10*time.Millisecond, v.Name)
 	}
+}
 
-	for _, c := range testCaseCids {
-		// everyone should be able to find it...
-		for _, dht := range dhts {
-			logger.Debugf("getting providers for %s at %s", c, dht.self)
-			wg.Add(1)
-			go getProvider(dht, c)
-		}
+func TestLookupHopsMetrics(t *testing.T) {
+	require.NoError(t, view.Register(metrics.LookupHopsView))
+	defer view.Unregister(metrics.LookupHopsView)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	client := setupDHT(ctx, t, false)
+	near := setupDHT(ctx, t, false)
+	far := setupDHT(ctx, t, false)
+	for _, d := range []*IpfsDHT{client, near, far} {
+		defer d.Close()
+		defer d.host.Close()
 	}
+	connect(t, ctx, client, near)
+	connect(t, ctx, near, far)
 
-	// we need this because of printing errors
-	go func() {
-		wg.Wait()
-		close(errchan)
-	}()
+	_, err := client.GetClosestPeers(ctx, "foo")
+	require.NoError(t, err)
 
-	for err := range errchan {
-		t.Error(err)
+	rows, err := view.RetrieveData(metrics.LookupHopsView.Name)
+	require.NoError(t, err)
+	var hops *view.DistributionData
+	for _, row := range rows {
+		for _, tg := range row.Tags {
+			if tg.Key == metrics.KeyOperation && tg.Value == opGetClosestPeers {
+				hops = row.Data.(*view.DistributionData)
+			}
+		}
 	}
+	require.NotNil(t, hops)
+	// far is reached through near
+	require.EqualValues(t, 2, hops.Max)
 }
 
-func TestProvidesAsync(t *testing.T) {
-	// t.Skip("skipping test to debug another")
-	if testing.Short() {
-		t.SkipNow()
-	}
+func TestLookupPeerTimeoutMetrics(t *testing.T) {
+	views := []*view.View{metrics.LookupPeerQueriesView, metrics.LookupPeerTimeoutsView}
+	require.NoError(t, view.Register(views...))
+	defer view.Unregister(views...)
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	dhts := setupDHTS(t, ctx, 4)
-	defer func() {
-		for i := 0; i < 4; i++ {
-			dhts[i].Close()
-			defer dhts[i].host.Close()
+	d := setupDHT(ctx, t, false)
+	near := setupDHT(ctx, t, false)
+	for _, d := range []*IpfsDHT{d, near} {
+		defer d.Close()
+		defer d.host.Close()
+	}
+	connect(t, ctx, d, near)
+
+	_, err := d.runLookupWithFollowup(ctx, opGetValue, "foo",
+		func(ctx context.Context, p peer.ID) ([]*peer.AddrInfo, error) {
+			return nil, context.DeadlineExceeded
+		},
+		func() bool { return false },
+	)
+	require.NoError(t, err)
+
+	cpl := strconv.Itoa(kb.CommonPrefixLen(d.selfKey, kb.ConvertPeerID(near.self)))
+	count := func(v *view.View) int64 {
+		rows, err := view.RetrieveData(v.Name)
+		require.NoError(t, err)
+		for _, row := range rows {
+			for _, tg := range row.Tags {
+				if tg.Key == metrics.KeyCpl && tg.Value == cpl {
+					return row.Data.(*view.CountData).Value
+				}
+			}
 		}
-	}()
+		return 0
+	}
+	require.EqualValues(t, 1, count(metrics.LookupPeerTimeoutsView))
+	require.GreaterOrEqual(t, count(metrics.LookupPeerQueriesView), int64(1))
+}
 
-	connect(t, ctx, dhts[0], dhts[1])
-	connect(t, ctx, dhts[1], dhts[2])
-	connect(t, ctx, dhts[1], dhts[3])
+func TestMetricsLabels(t *testing.T) {
+	require.NoError(t, view.Register(metrics.LookupLatencyView))
+	defer view.Unregister(metrics.LookupLatencyView)
 
-	err := dhts[3].Provide(ctx, testCaseCids[0], true)
-	if err != nil {
-		t.Fatal(err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	named := setupDHT(ctx, t, false, MetricsName("custom"))
+	unnamed := setupDHT(ctx, t, false)
+	for _, d := range []*IpfsDHT{named, unnamed} {
+		defer d.Close()
+		defer d.host.Close()
 	}
+	connect(t, ctx, named, unnamed)
 
-	time.Sleep(time.Millisecond * 60)
+	require.NoError(t, named.Provide(ctx, testCaseCids[0], true))
+	_, err := unnamed.GetClosestPeers(ctx, "foo")
+	require.NoError(t, err)
 
-	ctxT, cancel := context.WithTimeout(ctx, time.Millisecond*300)
-	defer cancel()
-	provs := dhts[0].FindProvidersAsync(ctxT, testCaseCids[0], 5)
-	select {
-	case p, ok := <-provs:
-		if !ok {
-			t.Fatal("Provider channel was closed...")
-		}
-		if p.ID == "" {
-			t.Fatal("Got back nil provider!")
-		}
-		if p.ID != dhts[3].self {
-			t.Fatalf("got a provider, but not the right one. %s", p)
+	recorded := func(name, op string) bool {
+		rows, err := view.RetrieveData(metrics.LookupLatencyView.Name)
+		require.NoError(t, err)
+		for _, row := range rows {
+			tags := make(map[tag.Key]string)
+			for _, tg := range row.Tags {
+				tags[tg.Key] = tg.Value
+			}
+			if tags[metrics.KeyDHT] == name && tags[metrics.KeyOperation] == op {
+				return true
+			}
 		}
-	case <-ctxT.Done():
-		t.Fatal("Didnt get back providers")
+		return false
 	}
+	// the lookup of a Provide is labeled as such
+	require.True(t, recorded("custom", opProvide))
+	require.False(t, recorded("custom", opGetClosestPeers))
+	require.True(t, recorded(string(unnamed.protocols[0]), opGetClosestPeers))
 }
 
-func TestLayeredGet(t *testing.T) {
+func TestInboundRequestQoS(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	dhts := setupDHTS(t, ctx, 4)
-	defer func() {
-		for i := 0; i < 4; i++ {
-			dhts[i].Close()
-			defer dhts[i].host.Close()
+	q := newRequestQueue(ctx, 1, 1)
+	release, queued, err := q.acquire(ctx, pb.Message_ADD_PROVIDER)
+	require.NoError(t, err)
+	require.True(t, queued)
+
+	handled := make(chan requestClass, 3)
+	waiting := func(c requestClass) func() bool {
+		return func() bool {
+			q.mu.Lock()
+			defer q.mu.Unlock()
+			return len(q.waiting[c]) == 1
 		}
-	}()
-
-	connect(t, ctx, dhts[0], dhts[1])
-	connect(t, ctx, dhts[1], dhts[2])
-	connect(t, ctx, dhts[2], dhts[3])
-
-	err := dhts[3].PutValue(ctx, "/v/hello", []byte("world"))
-	if err != nil {
-		t.Fatal(err)
 	}
-
-	time.Sleep(time.Millisecond * 6)
-
-	ctxT, cancel := context.WithTimeout(ctx, time.Second)
-	defer cancel()
-	val, err := dhts[0].GetValue(ctxT, "/v/hello")
-	if err != nil {
-		t.Fatal(err)
+	for _, typ := range []pb.Message_MessageType{pb.Message_ADD_PROVIDER, pb.Message_GET_PROVIDERS, pb.Message_FIND_NODE} {
+		go func(typ pb.Message_MessageType) {
+			release, _, err := q.acquire(ctx, typ)
+			if err != nil {
+				return
+			}
+			handled <- classOf(typ)
+			release()
+		}(typ)
+		require.Eventually(t, waiting(classOf(typ)), 5*time.Second, time.Millisecond)
 	}
 
-	if string(val) != "world" {
-		t.Error("got wrong value")
-	}
-}
+	// the store class is full
+	_, queued, _ = q.acquire(ctx, pb.Message_PUT_VALUE)
+	require.False(t, queued)
 
-func TestUnfindablePeer(t *testing.T) {
-	if testing.Short() {
-		t.SkipNow()
+	release()
+	for _, c := range []requestClass{classRouting, classLookup, classStore} {
+		require.Equal(t, c, <-handled)
 	}
+	require.Eventually(t, func() bool {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		return q.running == 0
+	}, 5*time.Second, time.Millisecond)
+}
 
+func TestDatagramQueries(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	dhts := setupDHTS(t, ctx, 4)
-	defer func() {
-		for i := 0; i < 4; i++ {
-			dhts[i].Close()
-			dhts[i].Host().Close()
+	client := setupDHT(ctx, t, false, DatagramQueries("127.0.0.1:0"))
+	server := setupDHT(ctx, t, false, DatagramQueries("127.0.0.1:0"))
+	for _, d := range []*IpfsDHT{client, server} {
+		defer d.Close()
+		defer d.host.Close()
+	}
+	connect(t, ctx, client, server)
+	require.Eventually(t, func() bool {
+		protos, err := client.peerstore.SupportsProtocols(server.self, string(server.datagrams.Protocol()))
+		return err == nil && len(protos) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	key := testCaseCids[0].Hash()
+	require.NoError(t, server.providerStore.AddProvider(ctx, key, peer.AddrInfo{ID: client.self}))
+
+	// stop answering requests over streams
+	server.host.RemoveStreamHandler(server.protocols[0])
+	for _, c := range server.host.Network().ConnsToPeer(client.self) {
+		for _, s := range c.GetStreams() {
+			if s.Protocol() == server.protocols[0] {
+				_ = s.Reset()
+			}
 		}
-	}()
-
-	connect(t, ctx, dhts[0], dhts[1])
-	connect(t, ctx, dhts[1], dhts[2])
-	connect(t, ctx, dhts[2], dhts[3])
+	}
 
-	// Give DHT 1 a bad addr for DHT 2.
-	dhts[1].host.Peerstore().ClearAddrs(dhts[2].PeerID())
-	dhts[1].host.Peerstore().AddAddr(dhts[2].PeerID(), dhts[0].Host().Addrs()[0], time.Minute)
+	provs, _, err := client.protoMessenger.GetProviders(ctx, server.self, key)
+	require.NoError(t, err)
+	require.Len(t, provs, 1)
+	require.Equal(t, client.self, provs[0].ID)
 
-	ctxT, cancel := context.WithTimeout(ctx, time.Second)
-	defer cancel()
-	_, err := dhts[0].FindPeer(ctxT, dhts[3].PeerID())
-	if err == nil {
-		t.Error("should have failed to find peer")
-	}
-	if ctxT.Err() != nil {
-		t.Error("FindPeer should have failed before context expired")
-	}
+	// other requests still go over streams
+	require.Error(t, client.protoMessenger.Ping(ctx, server.self))
 }
 
-func TestFindPeer(t *testing.T) {
-	// t.Skip("skipping test to debug another")
-	if testing.Short() {
-		t.SkipNow()
-	}
-
+func TestHTTPFallback(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	dhts := setupDHTS(t, ctx, 4)
-	defer func() {
-		for i := 0; i < 4; i++ {
-			dhts[i].Close()
-			dhts[i].host.Close()
-		}
-	}()
+	server := setupDHT(ctx, t, false)
+	defer server.Close()
+	defer server.host.Close()
+	handler, err := server.HTTPHandler()
+	require.NoError(t, err)
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
 
-	connect(t, ctx, dhts[0], dhts[1])
-	connect(t, ctx, dhts[1], dhts[2])
-	connect(t, ctx, dhts[1], dhts[3])
+	_, port, err := gonet.SplitHostPort(ts.Listener.Addr().String())
+	require.NoError(t, err)
+	addr, err := ma.NewMultiaddr("/ip4/127.0.0.1/tcp/" + port + "/http")
+	require.NoError(t, err)
 
-	ctxT, cancel := context.WithTimeout(ctx, time.Second)
-	defer cancel()
-	p, err := dhts[0].FindPeer(ctxT, dhts[2].PeerID())
-	if err != nil {
-		t.Fatal(err)
-	}
+	client := setupDHT(ctx, t, true, HTTPFallback(peer.AddrInfo{ID: server.self, Addrs: []ma.Multiaddr{addr}}))
+	defer client.Close()
+	defer client.host.Close()
 
-	if p.ID == "" {
-		t.Fatal("Failed to find peer.")
-	}
+	c := testCaseCids[0]
+	require.NoError(t, server.providerStore.AddProvider(ctx, c.Hash(), peer.AddrInfo{ID: server.self}))
 
-	if p.ID != dhts[2].PeerID() {
-		t.Fatal("Didnt find expected peer.")
-	}
+	provs, err := client.FindProviders(ctx, c)
+	require.NoError(t, err)
+	require.Len(t, provs, 1)
+	require.Equal(t, server.self, provs[0].ID)
+	require.NotEqual(t, network.Connected, client.host.Network().Connectedness(server.self))
+
+	// requests from peers other than the signer are refused
+	req := httptest.NewRequest(http.MethodPost, string(server.protocols[0]), strings.NewReader(""))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
 }
 
-func TestFindPeerWithQueryFilter(t *testing.T) {
-	// t.Skip("skipping test to debug another")
-	if testing.Short() {
-		t.SkipNow()
-	}
-	if runtime.GOOS == "windows" {
-		t.Skip("skipping due to #760")
-	}
-
+func TestMessageCompression(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	filteredPeer, err := bhost.NewHost(ctx, swarmt.GenSwarm(t, ctx, swarmt.OptDisableReuseport), new(bhost.HostOpts))
-	require.NoError(t, err)
-	dhts := setupDHTS(t, ctx, 4, QueryFilter(func(_ interface{}, ai peer.AddrInfo) bool {
-		return ai.ID != filteredPeer.ID()
-	}))
-	defer func() {
-		for i := 0; i < 4; i++ {
-			dhts[i].Close()
-			dhts[i].host.Close()
+	client := setupDHT(ctx, t, false, MessageCompression())
+	compressed := setupDHT(ctx, t, false, MessageCompression())
+	plain := setupDHT(ctx, t, false)
+	for _, d := range []*IpfsDHT{client, compressed, plain} {
+		defer d.Close()
+		defer d.host.Close()
+	}
+	connect(t, ctx, client, compressed)
+	connect(t, ctx, client, plain)
+
+	key := "/v/hello"
+	rec := record.MakePutRecord(key, bytes.Repeat([]byte("world"), 100))
+	rec.TimeReceived = u.FormatRFC3339(time.Now())
+
+	streamProtocol := func(server *IpfsDHT) protocol.ID {
+		for _, c := range client.host.Network().ConnsToPeer(server.self) {
+			for _, s := range c.GetStreams() {
+				if s.Stat().Direction == network.DirOutbound && strings.HasPrefix(string(s.Protocol()), string(client.protocols[0])) {
+					return s.Protocol()
+				}
+			}
 		}
-	}()
-
-	connect(t, ctx, dhts[0], dhts[1])
-	connect(t, ctx, dhts[1], dhts[2])
-	connect(t, ctx, dhts[1], dhts[3])
-
-	err = filteredPeer.Connect(ctx, peer.AddrInfo{
-		ID:    dhts[2].host.ID(),
-		Addrs: dhts[2].host.Addrs(),
-	})
-	require.NoError(t, err)
+		return ""
+	}
 
-	require.Eventually(t, func() bool {
-		return len(dhts[2].host.Network().ConnsToPeer(filteredPeer.ID())) > 0
-	}, 5*time.Millisecond, time.Millisecond, "failed to connect to peer")
+	for _, server := range []*IpfsDHT{compressed, plain} {
+		require.NoError(t, server.putLocal(ctx, key, rec))
+		got, _, err := client.protoMessenger.GetValue(ctx, server.self, key)
+		require.NoError(t, err)
+		require.Equal(t, rec.GetValue(), got.GetValue())
+	}
+	require.Equal(t, client.protocols[0]+"+zstd", streamProtocol(compressed))
+	require.Equal(t, client.protocols[0], streamProtocol(plain))
+}
 
-	ctxT, cancel := context.WithTimeout(ctx, time.Second)
+func TestOfflineQueue(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	p, err := dhts[0].FindPeer(ctxT, filteredPeer.ID())
-	require.NoError(t, err)
+	offline := setupDHT(ctx, t, false, OfflineQueue(2))
+	other := setupDHT(ctx, t, false)
+	for _, d := range []*IpfsDHT{offline, other} {
+		defer d.Close()
+		defer d.host.Close()
+	}
 
-	require.NotEmpty(t, p.ID, "Failed to find peer.")
-	require.Equal(t, filteredPeer.ID(), p.ID, "Didnt find expected peer.")
-}
+	// with no peers both operations are queued rather than failing
+	require.NoError(t, offline.PutValue(ctx, "/v/hello", []byte("world")))
+	require.NoError(t, offline.Provide(ctx, testCaseCids[0], true))
+	require.ErrorIs(t, offline.Provide(ctx, testCaseCids[1], true), ErrOfflineQueueFull)
 
-func TestConnectCollision(t *testing.T) {
-	if testing.Short() {
-		t.SkipNow()
-	}
+	// re-queueing the same record takes no extra room
+	require.NoError(t, offline.Provide(ctx, testCaseCids[0], true))
 
-	runTimes := 10
+	connect(t, ctx, offline, other)
 
-	for rtime := 0; rtime < runTimes; rtime++ {
-		logger.Info("Running Time: ", rtime)
+	require.Eventually(t, func() bool {
+		rec, err := other.getLocal(ctx, "/v/hello")
+		if err != nil || rec == nil {
+			return false
+		}
+		provs, err := other.providerStore.GetProviders(ctx, testCaseCids[0].Hash())
+		return err == nil && len(provs) == 1
+	}, 5*time.Second, 10*time.Millisecond)
 
-		ctx, cancel := context.WithCancel(context.Background())
+	require.Eventually(t, func() bool {
+		offline.offlineQueue.mu.Lock()
+		defer offline.offlineQueue.mu.Unlock()
+		return offline.offlineQueue.count == 0
+	}, 5*time.Second, 10*time.Millisecond)
+}
 
-		dhtA := setupDHT(ctx, t, false)
-		dhtB := setupDHT(ctx, t, false)
+func TestOfflineQueueProvideMany(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-		addrA := dhtA.peerstore.Addrs(dhtA.self)[0]
-		addrB := dhtB.peerstore.Addrs(dhtB.self)[0]
+	offline := setupDHT(ctx, t, false, OfflineQueue(4))
+	other := setupDHT(ctx, t, false)
+	for _, d := range []*IpfsDHT{offline, other} {
+		defer d.Close()
+		defer d.host.Close()
+	}
 
-		peerA := dhtA.self
-		peerB := dhtB.self
+	keys := []multihash.Multihash{testCaseCids[0].Hash(), testCaseCids[1].Hash()}
+	require.NoError(t, offline.ProvideMany(ctx, keys))
+	offline.offlineQueue.mu.Lock()
+	count := offline.offlineQueue.count
+	offline.offlineQueue.mu.Unlock()
+	require.Equal(t, 2, count)
 
-		errs := make(chan error)
-		go func() {
-			dhtA.peerstore.AddAddr(peerB, addrB, peerstore.TempAddrTTL)
-			pi := peer.AddrInfo{ID: peerB}
-			err := dhtA.host.Connect(ctx, pi)
-			errs <- err
-		}()
-		go func() {
-			dhtB.peerstore.AddAddr(peerA, addrA, peerstore.TempAddrTTL)
-			pi := peer.AddrInfo{ID: peerA}
-			err := dhtB.host.Connect(ctx, pi)
-			errs <- err
-		}()
+	connect(t, ctx, offline, other)
 
-		timeout := time.After(5 * time.Second)
-		select {
-		case e := <-errs:
-			if e != nil {
-				t.Fatal(e)
-			}
-		case <-timeout:
-			t.Fatal("Timeout received!")
-		}
-		select {
-		case e := <-errs:
-			if e != nil {
-				t.Fatal(e)
+	require.Eventually(t, func() bool {
+		for _, k := range keys {
+			provs, err := other.providerStore.GetProviders(ctx, k)
+			if err != nil || len(provs) != 1 {
+				return false
 			}
-		case <-timeout:
-			t.Fatal("Timeout received!")
 		}
-
-		dhtA.Close()
-		dhtB.Close()
-		dhtA.host.Close()
-		dhtB.host.Close()
-		cancel()
-	}
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
 }
 
-func TestBadProtoMessages(t *testing.T) {
+func TestOfflineQueueBackoff(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	d := setupDHT(ctx, t, false)
-
-	nilrec := new(pb.Message)
-	if _, err := d.handlePutValue(ctx, "testpeer", nilrec); err == nil {
-		t.Fatal("should have errored on nil record")
+	offline := setupDHT(ctx, t, false, OfflineQueue(2))
+	noValues := setupDHT(ctx, t, false, DisableValues())
+	for _, d := range []*IpfsDHT{offline, noValues} {
+		defer d.Close()
+		defer d.host.Close()
 	}
+
+	require.NoError(t, offline.PutValue(ctx, "/v/hello", []byte("world")))
+	connect(t, ctx, offline, noValues)
+
+	// the put nobody accepted stays queued, and isn't retried right away
+	dsk := offlinePutsKey.Child(convertToDsKey([]byte("/v/hello")))
+	require.Eventually(t, func() bool {
+		return offline.backingOff(offlinePutsKey, []byte("/v/hello"))
+	}, 5*time.Second, 10*time.Millisecond)
+	offline.offlineQueue.mu.Lock()
+	count := offline.offlineQueue.count
+	// each failed attempt doubles the wait
+	offline.offlineQueue.backoffs[dsk] = offlineBackoff{attempts: 1}
+	offline.offlineQueue.mu.Unlock()
+	require.Equal(t, 1, count)
+
+	offline.backOff(offlinePutsKey, []byte("/v/hello"))
+	offline.offlineQueue.mu.Lock()
+	b := offline.offlineQueue.backoffs[dsk]
+	offline.offlineQueue.mu.Unlock()
+	require.Equal(t, 2, b.attempts)
+	require.WithinDuration(t, time.Now().Add(2*offlineQueueRetryInterval), b.next, 10*time.Second)
 }
 
-func TestAtomicPut(t *testing.T) {
+func TestProvideDeadlinePartitioning(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	d := setupDHT(ctx, t, false)
-	d.Validator = testAtomicPutValidator{}
+	provider := setupDHT(ctx, t, false, Concurrency(1))
+	fast := setupDHT(ctx, t, false)
+	for _, d := range []*IpfsDHT{provider, fast} {
+		defer d.Close()
+		defer d.host.Close()
+	}
+	connect(t, ctx, provider, fast)
 
-	// fnc to put a record
-	key := "testkey"
-	putRecord := func(value []byte) error {
-		rec := record.MakePutRecord(key, value)
-		pmes := pb.NewMessage(pb.Message_PUT_VALUE, rec.Key, 0)
-		pmes.Record = rec
-		_, err := d.handlePutValue(ctx, "testpeer", pmes)
-		return err
-	}
-
-	// put a valid record
-	if err := putRecord([]byte("valid")); err != nil {
-		t.Fatal("should not have errored on a valid record")
-	}
-
-	// simultaneous puts for old & new values
-	values := [][]byte{[]byte("newer1"), []byte("newer7"), []byte("newer3"), []byte("newer5")}
-	var wg sync.WaitGroup
-	for _, v := range values {
-		wg.Add(1)
-		go func(v []byte) {
-			defer wg.Done()
-			_ = putRecord(v) // we expect some of these to fail
-		}(v)
-	}
-	wg.Wait()
+	// a peer that accepts connections but never completes the handshake
+	l, err := gonet.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+	slow := coretest.RandPeerIDFatal(t)
+	provider.peerstore.AddAddr(slow, ma.StringCast(fmt.Sprintf("/ip4/127.0.0.1/tcp/%d", l.Addr().(*gonet.TCPAddr).Port)), time.Hour)
 
-	// get should return the newest value
-	pmes := pb.NewMessage(pb.Message_GET_VALUE, []byte(key), 0)
-	msg, err := d.handleGetValue(ctx, "testkey", pmes)
-	if err != nil {
-		t.Fatalf("should not have errored on final get, but got %+v", err)
-	}
-	if string(msg.GetRecord().Value) != "newer7" {
-		t.Fatalf("Expected 'newer7' got '%s'", string(msg.GetRecord().Value))
-	}
+	ctxT, cancelT := context.WithTimeout(ctx, 2*time.Second)
+	defer cancelT()
+	start := time.Now()
+	res := provider.putProviderToPeers(ctxT, testCaseCids[0].Hash(), []peer.ID{slow, fast.self})
+
+	// the slow peer only gets half of the time, leaving enough for the fast one
+	require.Equal(t, []peer.ID{fast.self}, res.Succeeded)
+	require.Equal(t, map[peer.ID]error{slow: ErrPeerTooSlow}, res.Failed)
+	require.Less(t, int64(time.Since(start)), int64(1900*time.Millisecond))
+
+	// without a deadline, the slow peer doesn't hold the fast one back
+	ctxC, cancelC := context.WithCancel(ctx)
+	done := make(chan *PutResult)
+	go func() { done <- provider.putProviderToPeers(ctxC, testCaseCids[1].Hash(), []peer.ID{slow, fast.self}) }()
+	require.Eventually(t, func() bool {
+		provs, err := fast.providerStore.GetProviders(ctx, testCaseCids[1].Hash())
+		return err == nil && len(provs) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	cancelC()
+	res = <-done
+	require.Equal(t, []peer.ID{fast.self}, res.Succeeded)
+	require.Contains(t, res.Failed, slow)
 }
 
-func TestClientModeConnect(t *testing.T) {
+func TestLocalProvides(t *testing.T) {
+	// t.Skip("skipping test to debug another")
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	a := setupDHT(ctx, t, false)
-	b := setupDHT(ctx, t, true)
-
-	connectNoSync(t, ctx, a, b)
+	dhts := setupDHTS(t, ctx, 4)
+	defer func() {
+		for i := 0; i < 4; i++ {
+			dhts[i].Close()
+			defer dhts[i].host.Close()
+		}
+	}()
 
-	c := testCaseCids[0]
-	p := peer.ID("TestPeer")
-	a.ProviderStore().AddProvider(ctx, c.Hash(), peer.AddrInfo{ID: p})
-	time.Sleep(time.Millisecond * 5) // just in case...
+	connect(t, ctx, dhts[0], dhts[1])
+	connect(t, ctx, dhts[1], dhts[2])
+	connect(t, ctx, dhts[1], dhts[3])
 
-	provs, err := b.FindProviders(ctx, c)
-	if err != nil {
-		t.Fatal(err)
+	for _, k := range testCaseCids {
+		logger.Debugf("announcing provider for %s", k)
+		if err := dhts[3].Provide(ctx, k, false); err != nil {
+			t.Fatal(err)
+		}
 	}
 
-	if len(provs) == 0 {
-		t.Fatal("Expected to get a provider back")
-	}
+	time.Sleep(time.Millisecond * 10)
 
-	if provs[0].ID != p {
-		t.Fatal("expected it to be our test peer")
-	}
-	if a.routingTable.Find(b.self) != "" {
-		t.Fatal("DHT clients should not be added to routing tables")
-	}
-	if b.routingTable.Find(a.self) == "" {
-		t.Fatal("DHT server should have been added to the dht client's routing table")
+	for _, c := range testCaseCids {
+		for i := 0; i < 3; i++ {
+			provs, _ := dhts[i].ProviderStore().GetProviders(ctx, c.Hash())
+			if len(provs) > 0 {
+				t.Fatal("shouldnt know this")
+			}
+		}
 	}
 }
 
-func TestClientModeFindPeer(t *testing.T) {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-
-	a := setupDHT(ctx, t, false)
-	b := setupDHT(ctx, t, true)
-	c := setupDHT(ctx, t, true)
-
-	connectNoSync(t, ctx, b, a)
-	connectNoSync(t, ctx, c, a)
-
-	// Can't use `connect` because b and c are only clients.
-	wait(t, ctx, b, a)
-	wait(t, ctx, c, a)
+// if minPeers or avgPeers is 0, dont test for it.
+func waitForWellFormedTables(t *testing.T, dhts []*IpfsDHT, minPeers, avgPeers int, timeout time.Duration) {
+	// test "well-formed-ness" (>= minPeers peers in every routing table)
+	t.Helper()
 
-	pi, err := c.FindPeer(ctx, b.self)
-	if err != nil {
-		t.Fatal(err)
-	}
-	if len(pi.Addrs) == 0 {
-		t.Fatal("should have found addresses for node b")
+	checkTables := func() bool {
+		totalPeers := 0
+		for _, dht := range dhts {
+			rtlen := dht.routingTable.Size()
+			totalPeers += rtlen
+			if minPeers > 0 && rtlen < minPeers {
+				//t.Logf("routing table for %s only has %d peers (should have >%d)", dht.self, rtlen, minPeers)
+				return false
+			}
+		}
+		actualAvgPeers := totalPeers / len(dhts)
+		t.Logf("avg rt size: %d", actualAvgPeers)
+		if avgPeers > 0 && actualAvgPeers < avgPeers {
+			t.Logf("avg rt size: %d < %d", actualAvgPeers, avgPeers)
+			return false
+		}
+		return true
 	}
 
-	err = c.host.Connect(ctx, pi)
-	if err != nil {
-		t.Fatal(err)
+	timeoutA := time.After(timeout)
+	for {
+		select {
+		case <-timeoutA:
+			t.Errorf("failed to reach well-formed routing tables after %s", timeout)
+			return
+		case <-time.After(5 * time.Millisecond):
+			if checkTables() {
+				// succeeded
+				return
+			}
+		}
 	}
 }
 
-func minInt(a, b int) int {
-	if a < b {
-		return a
+func printRoutingTables(dhts []*IpfsDHT) {
+	// the routing tables should be full now. let's inspect them.
+	fmt.Printf("checking routing table of %d\n", len(dhts))
+	for _, dht := range dhts {
+		fmt.Printf("checking routing table of %s\n", dht.self)
+		dht.routingTable.Print()
+		fmt.Println("")
 	}
-	return b
-}
-
-func TestFindPeerQueryMinimal(t *testing.T) {
-	testFindPeerQuery(t, 2, 22, 1)
 }
 
-func TestFindPeerQuery(t *testing.T) {
-	if detectrace.WithRace() {
-		t.Skip("skipping due to race detector max goroutines")
-	}
-
+func TestRefresh(t *testing.T) {
 	if testing.Short() {
-		t.Skip("skipping test in short mode")
-	}
-	testFindPeerQuery(t, 5, 40, 3)
-}
-
-// NOTE: You must have ATLEAST (minRTRefreshThreshold+1) test peers before using this.
-func testFindPeerQuery(t *testing.T,
-	bootstrappers, // Number of nodes connected to the querying node
-	leafs, // Number of nodes that might be connected to from the bootstrappers
-	bootstrapConns int, // Number of bootstrappers each leaf should connect to.
-) {
-	if runtime.GOOS == "windows" {
-		t.Skip("skipping due to #760")
+		t.SkipNow()
 	}
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	dhts := setupDHTS(t, ctx, 1+bootstrappers+leafs, BucketSize(4))
+	nDHTs := 30
+	dhts := setupDHTS(t, ctx, nDHTs)
 	defer func() {
-		for _, d := range dhts {
-			d.Close()
-			d.host.Close()
+		for i := 0; i < nDHTs; i++ {
+			dhts[i].Close()
+			defer dhts[i].host.Close()
 		}
 	}()
 
-	t.Log("connecting")
-
-	mrand := rand.New(rand.NewSource(42))
-	guy := dhts[0]
-	others := dhts[1:]
-	for i := 0; i < leafs; i++ {
-		for _, v := range mrand.Perm(bootstrappers)[:bootstrapConns] {
-			connectNoSync(t, ctx, others[v], others[bootstrappers+i])
-		}
-	}
-
-	for i := 0; i < bootstrappers; i++ {
-		connectNoSync(t, ctx, guy, others[i])
+	t.Logf("connecting %d dhts in a ring", nDHTs)
+	for i := 0; i < nDHTs; i++ {
+		connect(t, ctx, dhts[i], dhts[(i+1)%len(dhts)])
 	}
 
-	t.Log("waiting for routing tables")
-
-	// give some time for things to settle down
-	waitForWellFormedTables(t, dhts, bootstrapConns, bootstrapConns, 5*time.Second)
+	<-time.After(100 * time.Millisecond)
+	// bootstrap a few times until we get good tables.
+	t.Logf("bootstrapping them so they find each other %d", nDHTs)
+	ctxT, cancelT := context.WithTimeout(ctx, 5*time.Second)
+	defer cancelT()
 
-	t.Log("refreshing")
+	for ctxT.Err() == nil {
+		bootstrap(t, ctxT, dhts)
 
-	var wg sync.WaitGroup
-	for _, dht := range dhts {
-		wg.Add(1)
-		go func(d *IpfsDHT) {
-			<-d.RefreshRoutingTable()
-			wg.Done()
-		}(dht)
+		// wait a bit.
+		select {
+		case <-time.After(50 * time.Millisecond):
+			continue // being explicit
+		case <-ctxT.Done():
+			return
+		}
 	}
 
-	wg.Wait()
-
-	t.Log("waiting for routing tables again")
+	waitForWellFormedTables(t, dhts, 7, 10, 10*time.Second)
 
-	// Wait for refresh to work. At least one bucket should be full.
-	waitForWellFormedTables(t, dhts, 4, 0, 5*time.Second)
+	cancelT()
 
-	var peers []peer.ID
-	for _, d := range others {
-		peers = append(peers, d.PeerID())
+	if u.Debug {
+		// the routing tables should be full now. let's inspect them.
+		printRoutingTables(dhts)
 	}
+}
 
-	t.Log("querying")
-
-	val := "foobar"
-	rtval := kb.ConvertKey(val)
+func TestRefreshBelowMinRTThreshold(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-	outpeers, err := guy.GetClosestPeers(ctx, val)
+	host, err := bhost.NewHost(ctx, swarmt.GenSwarm(t, ctx, swarmt.OptDisableReuseport), new(bhost.HostOpts))
 	require.NoError(t, err)
 
-	sort.Sort(peer.IDSlice(outpeers))
+	// enable auto bootstrap on A
+	dhtA, err := New(
+		ctx,
+		host,
+		testPrefix,
+		Mode(ModeServer),
+		NamespacedValidator("v", blankValidator{}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	exp := kb.SortClosestPeers(peers, rtval)[:minInt(guy.bucketSize, len(peers))]
-	t.Logf("got %d peers", len(outpeers))
-	got := kb.SortClosestPeers(outpeers, rtval)
+	dhtB := setupDHT(ctx, t, false)
+	dhtC := setupDHT(ctx, t, false)
 
-	assert.EqualValues(t, exp, got)
+	defer func() {
+		dhtA.Close()
+		dhtA.host.Close()
+
+		dhtB.Close()
+		dhtB.host.Close()
+
+		dhtC.Close()
+		dhtC.host.Close()
+	}()
+
+	connect(t, ctx, dhtA, dhtB)
+	connect(t, ctx, dhtB, dhtC)
+
+	// we ONLY init bootstrap on A
+	dhtA.RefreshRoutingTable()
+	// and wait for one round to complete i.e. A should be connected to both B & C
+	waitForWellFormedTables(t, []*IpfsDHT{dhtA}, 2, 2, 20*time.Second)
+
+	// now we create two new peers
+	dhtD := setupDHT(ctx, t, false)
+	dhtE := setupDHT(ctx, t, false)
+
+	// connect them to each other
+	connect(t, ctx, dhtD, dhtE)
+	defer func() {
+		dhtD.Close()
+		dhtD.host.Close()
+
+		dhtE.Close()
+		dhtE.host.Close()
+	}()
+
+	// and then, on connecting the peer D to A, the min RT threshold gets triggered on A which leads to a bootstrap.
+	// since the default bootstrap scan interval is 30 mins - 1 hour, we can be sure that if bootstrap happens,
+	// it is because of the min RT threshold getting triggered (since default min value is 4 & we only have 2 peers in the RT when D gets connected)
+	connect(t, ctx, dhtA, dhtD)
+
+	// and because of the above bootstrap, A also discovers E !
+	waitForWellFormedTables(t, []*IpfsDHT{dhtA}, 4, 4, 20*time.Second)
+	assert.Equal(t, dhtE.self, dhtA.routingTable.Find(dhtE.self), "A's routing table should have peer E!")
 }
 
-func TestFindClosestPeers(t *testing.T) {
+func TestQueryWithEmptyRTShouldNotPanic(t *testing.T) {
+	ctx := context.Background()
+	d := setupDHT(ctx, t, false)
+
+	// TODO This swallows the error for now, should we change it ?
+	// FindProviders
+	ps, _ := d.FindProviders(ctx, testCaseCids[0])
+	require.Empty(t, ps)
+
+	// GetClosestPeers
+	pc, err := d.GetClosestPeers(ctx, "key")
+	require.Nil(t, pc)
+	require.Equal(t, kb.ErrLookupFailure, err)
+
+	// GetValue
+	best, err := d.GetValue(ctx, "key")
+	require.Empty(t, best)
+	require.Error(t, err)
+
+	// SearchValue
+	bchan, err := d.SearchValue(ctx, "key")
+	require.Empty(t, bchan)
+	require.NoError(t, err)
+
+	// Provide
+	err = d.Provide(ctx, testCaseCids[0], true)
+	require.Equal(t, kb.ErrLookupFailure, err)
+}
+
+func TestPeriodicRefresh(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+	if runtime.GOOS == "windows" {
+		t.Skip("skipping due to #760")
+	}
+	if detectrace.WithRace() {
+		t.Skip("skipping due to race detector max goroutines")
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
@@ -1463,640 +2015,3260 @@ func TestFindClosestPeers(t *testing.T) {
 		}
 	}()
 
-	t.Logf("connecting %d dhts in a ring", nDHTs)
+	t.Logf("dhts are not connected. %d", nDHTs)
+	for _, dht := range dhts {
+		rtlen := dht.routingTable.Size()
+		if rtlen > 0 {
+			t.Errorf("routing table for %s should have 0 peers. has %d", dht.self, rtlen)
+		}
+	}
+
 	for i := 0; i < nDHTs; i++ {
 		connect(t, ctx, dhts[i], dhts[(i+1)%len(dhts)])
 	}
 
-	querier := dhts[1]
-	peers, err := querier.GetClosestPeers(ctx, "foo")
-	if err != nil {
-		t.Fatal(err)
+	t.Logf("DHTs are now connected to 1-2 others. %d", nDHTs)
+	for _, dht := range dhts {
+		rtlen := dht.routingTable.Size()
+		if rtlen > 2 {
+			t.Errorf("routing table for %s should have at most 2 peers. has %d", dht.self, rtlen)
+		}
 	}
 
-	if len(peers) < querier.beta {
-		t.Fatalf("got wrong number of peers (got %d, expected at least %d)", len(peers), querier.beta)
+	if u.Debug {
+		printRoutingTables(dhts)
 	}
-}
 
-func TestFixLowPeers(t *testing.T) {
-	ctx := context.Background()
+	t.Logf("bootstrapping them so they find each other. %d", nDHTs)
+	var wg sync.WaitGroup
+	for _, dht := range dhts {
+		wg.Add(1)
+		go func(d *IpfsDHT) {
+			<-d.RefreshRoutingTable()
+			wg.Done()
+		}(dht)
+	}
 
-	dhts := setupDHTS(t, ctx, minRTRefreshThreshold+5)
+	wg.Wait()
+	// this is async, and we dont know when it's finished with one cycle, so keep checking
+	// until the routing tables look better, or some long timeout for the failure case.
+	waitForWellFormedTables(t, dhts, 7, 10, 20*time.Second)
 
-	defer func() {
-		for _, d := range dhts {
-			d.Close()
-			d.Host().Close()
-		}
-	}()
+	if u.Debug {
+		printRoutingTables(dhts)
+	}
+}
 
-	mainD := dhts[0]
+func TestProvidersPagination(t *testing.T) {
+	defer func(old int) { providersPageBytes = old }(providersPageBytes)
+	// a single provider per page
+	providersPageBytes = 1
 
-	// connect it to everyone else
-	for _, d := range dhts[1:] {
-		mainD.peerstore.AddAddrs(d.self, d.peerstore.Addrs(d.self), peerstore.TempAddrTTL)
-		require.NoError(t, mainD.Host().Connect(ctx, peer.AddrInfo{ID: d.self}))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	client := setupDHT(ctx, t, false)
+	server := setupDHT(ctx, t, false)
+	for _, d := range []*IpfsDHT{client, server} {
+		defer d.Close()
+		defer d.host.Close()
 	}
+	connect(t, ctx, client, server)
 
-	waitForWellFormedTables(t, []*IpfsDHT{mainD}, minRTRefreshThreshold, minRTRefreshThreshold+4, 5*time.Second)
+	key := testCaseCids[0].Hash()
+	var provs []peer.ID
+	for i := 0; i < 5; i++ {
+		p := coretest.RandPeerIDFatal(t)
+		addr := ma.StringCast(fmt.Sprintf("/ip4/1.2.3.4/tcp/%d", 4000+i))
+		require.NoError(t, server.providerStore.AddProvider(ctx, key, peer.AddrInfo{ID: p, Addrs: []ma.Multiaddr{addr}}))
+		provs = append(provs, p)
+	}
 
-	// run a refresh on all of them
-	for _, d := range dhts {
-		err := <-d.RefreshRoutingTable()
+	page, _, token, err := client.protoMessenger.GetProviderRecordsPage(ctx, server.self, key, nil)
+	require.NoError(t, err)
+	require.Len(t, page, 1)
+	require.NotEmpty(t, token)
+
+	seen := []peer.ID{page[0].ID}
+	for len(token) > 0 {
+		page, _, token, err = client.protoMessenger.GetProviderRecordsPage(ctx, server.self, key, token)
 		require.NoError(t, err)
+		require.Len(t, page, 1)
+		seen = append(seen, page[0].ID)
 	}
+	require.ElementsMatch(t, provs, seen)
 
-	// now remove peers from RT so threshold gets hit
-	for _, d := range dhts[3:] {
-		mainD.routingTable.RemovePeer(d.self)
-	}
+	all, _, err := client.protoMessenger.GetProviders(ctx, server.self, key)
+	require.NoError(t, err)
+	require.Len(t, all, len(provs))
 
-	// but we will still get enough peers in the RT because of fix low Peers
-	waitForWellFormedTables(t, []*IpfsDHT{mainD}, minRTRefreshThreshold, minRTRefreshThreshold, 5*time.Second)
+	// lookups fetch the pages they need
+	var found []peer.ID
+	for pi := range client.FindProvidersAsync(ctx, testCaseCids[0], 0) {
+		found = append(found, pi.ID)
+	}
+	require.ElementsMatch(t, provs, found)
 }
 
-func TestProvideDisabled(t *testing.T) {
-	k := testCaseCids[0]
-	kHash := k.Hash()
-	for i := 0; i < 3; i++ {
-		enabledA := (i & 0x1) > 0
-		enabledB := (i & 0x2) > 0
-		t.Run(fmt.Sprintf("a=%v/b=%v", enabledA, enabledB), func(t *testing.T) {
+func TestStreamedProviders(t *testing.T) {
+	defer func(old int) { providersFrameBytes = old }(providersFrameBytes)
+	// a single provider per frame
+	providersFrameBytes = 1
+
+	for name, opts := range map[string][]Option{
+		"single":    {StreamProviders(), SignResponses(), VerifyResponseSignatures()},
+		"pipelined": {StreamProviders(), SignResponses(), VerifyResponseSignatures(), RequestPipelining(4)},
+	} {
+		t.Run(name, func(t *testing.T) {
 			ctx, cancel := context.WithCancel(context.Background())
 			defer cancel()
 
-			var (
-				optsA, optsB []Option
-			)
-			optsA = append(optsA, ProtocolPrefix("/provMaybeDisabled"))
-			optsB = append(optsB, ProtocolPrefix("/provMaybeDisabled"))
-
-			if !enabledA {
-				optsA = append(optsA, DisableProviders())
+			client := setupDHT(ctx, t, false, opts...)
+			server := setupDHT(ctx, t, false, opts...)
+			other := setupDHT(ctx, t, false)
+			for _, d := range []*IpfsDHT{client, server, other} {
+				defer d.Close()
+				defer d.host.Close()
 			}
-			if !enabledB {
-				optsB = append(optsB, DisableProviders())
+			connect(t, ctx, client, server)
+			connect(t, ctx, server, other)
+
+			key := testCaseCids[0].Hash()
+			var provs []peer.ID
+			for i := 0; i < 5; i++ {
+				p := coretest.RandPeerIDFatal(t)
+				addr := ma.StringCast(fmt.Sprintf("/ip4/1.2.3.4/tcp/%d", 4000+i))
+				require.NoError(t, server.providerStore.AddProvider(ctx, key, peer.AddrInfo{ID: p, Addrs: []ma.Multiaddr{addr}}))
+				provs = append(provs, p)
 			}
 
-			dhtA := setupDHT(ctx, t, false, optsA...)
-			dhtB := setupDHT(ctx, t, false, optsB...)
-
-			defer dhtA.Close()
-			defer dhtB.Close()
-			defer dhtA.host.Close()
-			defer dhtB.host.Close()
-
-			connect(t, ctx, dhtA, dhtB)
-
-			err := dhtB.Provide(ctx, k, true)
-			if enabledB {
-				if err != nil {
-					t.Fatal("put should have succeeded on node B", err)
-				}
-			} else {
-				if err != routing.ErrNotSupported {
-					t.Fatal("should not have put the value to node B", err)
-				}
-				_, err = dhtB.FindProviders(ctx, k)
-				if err != routing.ErrNotSupported {
-					t.Fatal("get should have failed on node B")
-				}
-				provs, _ := dhtB.ProviderStore().GetProviders(ctx, kHash)
-				if len(provs) != 0 {
-					t.Fatal("node B should not have found local providers")
-				}
-			}
+			// learn each other's capabilities
+			require.NoError(t, client.Ping(ctx, server.self))
 
-			provs, err := dhtA.FindProviders(ctx, k)
-			if enabledA {
-				if len(provs) != 0 {
-					t.Fatal("node A should not have found providers")
+			// the providers come in a frame each, the closer peers with the first
+			var frames int
+			var seen []peer.ID
+			err := client.protoMessenger.StreamProviderRecords(ctx, server.self, key, func(recs []*pb.ProviderRecord, closer []*peer.AddrInfo) error {
+				if frames == 0 {
+					require.NotEmpty(t, closer)
 				}
-			} else {
-				if err != routing.ErrNotSupported {
-					t.Fatal("node A should not have found providers")
+				frames++
+				for _, rec := range recs {
+					seen = append(seen, rec.ID)
 				}
+				return nil
+			})
+			require.NoError(t, err)
+			require.Equal(t, len(provs), frames)
+			require.ElementsMatch(t, provs, seen)
+
+			// requests stopped early don't break the following ones
+			stop := errors.New("stop")
+			err = client.protoMessenger.StreamProviderRecords(ctx, server.self, key, func([]*pb.ProviderRecord, []*peer.AddrInfo) error {
+				return stop
+			})
+			require.Equal(t, stop, err)
+
+			all, _, err := client.protoMessenger.GetProviders(ctx, server.self, key)
+			require.NoError(t, err)
+			require.Len(t, all, len(provs))
+
+			var found []peer.ID
+			for pi := range client.FindProvidersAsync(ctx, testCaseCids[0], 0) {
+				found = append(found, pi.ID)
 			}
-			provAddrs, _ := dhtA.ProviderStore().GetProviders(ctx, kHash)
-			if len(provAddrs) != 0 {
-				t.Fatal("node A should not have found local providers")
-			}
+			require.ElementsMatch(t, provs, found)
 		})
 	}
 }
 
-func TestHandleRemotePeerProtocolChanges(t *testing.T) {
+func TestProvidesMany(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("skipping due to #760")
+	}
+	if detectrace.WithRace() {
+		t.Skip("skipping due to race detector max goroutines")
+	}
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	os := []Option{
-		testPrefix,
-		Mode(ModeServer),
-		NamespacedValidator("v", blankValidator{}),
-		DisableAutoRefresh(),
+	nDHTs := 40
+	dhts := setupDHTS(t, ctx, nDHTs)
+	defer func() {
+		for i := 0; i < nDHTs; i++ {
+			dhts[i].Close()
+			defer dhts[i].host.Close()
+		}
+	}()
+
+	t.Logf("connecting %d dhts in a ring", nDHTs)
+	for i := 0; i < nDHTs; i++ {
+		connect(t, ctx, dhts[i], dhts[(i+1)%len(dhts)])
 	}
 
-	// start host 1 that speaks dht v1
-	hA, err := bhost.NewHost(ctx, swarmt.GenSwarm(t, ctx, swarmt.OptDisableReuseport), new(bhost.HostOpts))
+	<-time.After(100 * time.Millisecond)
+	t.Logf("bootstrapping them so they find each other. %d", nDHTs)
+	ctxT, cancel := context.WithTimeout(ctx, 20*time.Second)
+	defer cancel()
+	bootstrap(t, ctxT, dhts)
+
+	if u.Debug {
+		// the routing tables should be full now. let's inspect them.
+		t.Logf("checking routing table of %d", nDHTs)
+		for _, dht := range dhts {
+			fmt.Printf("checking routing table of %s\n", dht.self)
+			dht.routingTable.Print()
+			fmt.Println("")
+		}
+	}
+
+	providers := make(map[cid.Cid]peer.ID)
+
+	d := 0
+	for _, c := range testCaseCids {
+		d = (d + 1) % len(dhts)
+		dht := dhts[d]
+		providers[c] = dht.self
+
+		t.Logf("announcing provider for %s", c)
+		if err := dht.Provide(ctx, c, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// what is this timeout for? was 60ms before.
+	time.Sleep(time.Millisecond * 6)
+
+	errchan := make(chan error)
+
+	ctxT, cancel = context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	getProvider := func(dht *IpfsDHT, k cid.Cid) {
+		defer wg.Done()
+
+		expected := providers[k]
+
+		provchan := dht.FindProvidersAsync(ctxT, k, 1)
+		select {
+		case prov := <-provchan:
+			actual := prov.ID
+			if actual == "" {
+				errchan <- fmt.Errorf("Got back nil provider (%s at %s)", k, dht.self)
+			} else if actual != expected {
+				errchan <- fmt.Errorf("Got back wrong provider (%s != %s) (%s at %s)",
+					expected, actual, k, dht.self)
+			}
+		case <-ctxT.Done():
+			errchan <- fmt.Errorf("Did not get a provider back (%s at %s)", k, dht.self)
+		}
+	}
+
+	for _, c := range testCaseCids {
+		// everyone should be able to find it...
+		for _, dht := range dhts {
+			logger.Debugf("getting providers for %s at %s", c, dht.self)
+			wg.Add(1)
+			go getProvider(dht, c)
+		}
+	}
+
+	// we need this because of printing errors
+	go func() {
+		wg.Wait()
+		close(errchan)
+	}()
+
+	for err := range errchan {
+		t.Error(err)
+	}
+}
+
+func TestProvidesAsync(t *testing.T) {
+	// t.Skip("skipping test to debug another")
+	if testing.Short() {
+		t.SkipNow()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dhts := setupDHTS(t, ctx, 4)
+	defer func() {
+		for i := 0; i < 4; i++ {
+			dhts[i].Close()
+			defer dhts[i].host.Close()
+		}
+	}()
+
+	connect(t, ctx, dhts[0], dhts[1])
+	connect(t, ctx, dhts[1], dhts[2])
+	connect(t, ctx, dhts[1], dhts[3])
+
+	err := dhts[3].Provide(ctx, testCaseCids[0], true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(time.Millisecond * 60)
+
+	ctxT, cancel := context.WithTimeout(ctx, time.Millisecond*300)
+	defer cancel()
+	provs := dhts[0].FindProvidersAsync(ctxT, testCaseCids[0], 5)
+	select {
+	case p, ok := <-provs:
+		if !ok {
+			t.Fatal("Provider channel was closed...")
+		}
+		if p.ID == "" {
+			t.Fatal("Got back nil provider!")
+		}
+		if p.ID != dhts[3].self {
+			t.Fatalf("got a provider, but not the right one. %s", p)
+		}
+	case <-ctxT.Done():
+		t.Fatal("Didnt get back providers")
+	}
+}
+
+func TestLayeredGet(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dhts := setupDHTS(t, ctx, 4)
+	defer func() {
+		for i := 0; i < 4; i++ {
+			dhts[i].Close()
+			defer dhts[i].host.Close()
+		}
+	}()
+
+	connect(t, ctx, dhts[0], dhts[1])
+	connect(t, ctx, dhts[1], dhts[2])
+	connect(t, ctx, dhts[2], dhts[3])
+
+	err := dhts[3].PutValue(ctx, "/v/hello", []byte("world"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(time.Millisecond * 6)
+
+	ctxT, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	val, err := dhts[0].GetValue(ctxT, "/v/hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(val) != "world" {
+		t.Error("got wrong value")
+	}
+}
+
+func TestGetValuePerCallQuorum(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dhts := setupDHTS(t, ctx, 4)
+	defer func() {
+		for i := 0; i < 4; i++ {
+			dhts[i].Close()
+			defer dhts[i].host.Close()
+		}
+	}()
+
+	for i := 1; i < 4; i++ {
+		connect(t, ctx, dhts[0], dhts[i])
+	}
+
+	require.NoError(t, dhts[1].PutValue(ctx, "/v/hello", []byte("world")))
+
+	for _, q := range []int{1, 3} {
+		ctxT, cancel := context.WithTimeout(ctx, 5*time.Second)
+		val, err := dhts[0].GetValue(ctxT, "/v/hello", Quorum(q))
+		cancel()
+		require.NoError(t, err)
+		require.Equal(t, "world", string(val))
+	}
+
+	_, err := dhts[0].GetValue(ctx, "/v/hello", Quorum(-1))
+	require.Error(t, err)
+}
+
+func TestPutValueWithResult(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dhts := setupDHTS(t, ctx, 3)
+	defer func() {
+		for i := 0; i < 3; i++ {
+			dhts[i].Close()
+			defer dhts[i].host.Close()
+		}
+	}()
+
+	connect(t, ctx, dhts[0], dhts[1])
+	connect(t, ctx, dhts[0], dhts[2])
+
+	// dhts[2] rejects the value
+	dhts[2].recordValidator.(record.NamespacedValidator)["v"] = test.TestValidator{}
+
+	res, err := dhts[0].PutValueWithResult(ctx, "/v/hello", []byte("expired"))
+	require.NoError(t, err)
+	require.Equal(t, []peer.ID{dhts[1].self}, res.Succeeded)
+	require.Len(t, res.Failed, 1)
+	require.Contains(t, res.Failed, dhts[2].self)
+
+	// the value is reported lost if no peer stored it
+	dhts[1].recordValidator.(record.NamespacedValidator)["v"] = test.TestValidator{}
+	res, err = dhts[0].PutValueWithResult(ctx, "/v/hello", []byte("expired"))
+	var perr *PutError
+	require.ErrorAs(t, err, &perr)
+	require.Empty(t, res.Succeeded)
+	require.Len(t, res.Failed, 2)
+	require.Equal(t, res.Failed, perr.Failed)
+}
+
+func TestReplicationFactor(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	putter := setupDHT(ctx, t, false, BucketSize(2), ReplicationFactor(4))
+	defer putter.Close()
+	defer putter.host.Close()
+
+	dhts := setupDHTS(t, ctx, 4)
+	defer func() {
+		for i := 0; i < 4; i++ {
+			dhts[i].Close()
+			defer dhts[i].host.Close()
+		}
+	}()
+
+	for i := range dhts {
+		connect(t, ctx, putter, dhts[i])
+		for j := i + 1; j < len(dhts); j++ {
+			connect(t, ctx, dhts[i], dhts[j])
+		}
+	}
+
+	res, err := putter.PutValueWithResult(ctx, "/v/hello", []byte("world"))
+	require.NoError(t, err)
+	require.Len(t, res.Succeeded, 4)
+
+	_, err = New(ctx, putter.host, testPrefix, ReplicationFactor(-1))
+	require.Error(t, err)
+}
+
+func TestNamespaceKeyMapper(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mapper := SaltedKeyMapper([]byte("my app"))
+	dhtA := setupDHT(ctx, t, false, NamespaceKeyMapper("v", mapper))
+	dhtB := setupDHT(ctx, t, false, NamespaceKeyMapper("v", mapper))
+	dhtC := setupDHT(ctx, t, false)
+	for _, d := range []*IpfsDHT{dhtA, dhtB, dhtC} {
+		defer d.Close()
+		defer d.host.Close()
+	}
+
+	connect(t, ctx, dhtA, dhtB)
+	connect(t, ctx, dhtB, dhtC)
+	connect(t, ctx, dhtA, dhtC)
+
+	require.NoError(t, dhtA.PutValue(ctx, "/v/hello", []byte("world")))
+
+	ctxT, cancelT := context.WithTimeout(ctx, 5*time.Second)
+	defer cancelT()
+
+	val, err := dhtB.GetValue(ctxT, "/v/hello")
+	require.NoError(t, err)
+	require.Equal(t, []byte("world"), val)
+
+	// the record is stored under the mapped key only
+	mapped := "/v/" + mapper("hello")
+	val, err = dhtC.GetValue(ctxT, mapped)
+	require.NoError(t, err)
+	require.Equal(t, []byte("world"), val)
+
+	_, err = dhtC.GetValue(ctxT, "/v/hello", Quorum(1))
+	require.Equal(t, routing.ErrNotFound, err)
+}
+
+func TestLookupCaching(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	getter := setupDHT(ctx, t, false, LookupCaching(time.Minute, nil))
+	dhts := setupDHTS(t, ctx, 2)
+	for _, d := range append(dhts, getter) {
+		defer d.Close()
+		defer d.host.Close()
+	}
+	hasVal, lacksVal := dhts[0], dhts[1]
+	connect(t, ctx, getter, hasVal)
+	connect(t, ctx, getter, lacksVal)
+
+	key := "/v/hello"
+	rec := record.MakePutRecord(key, []byte("stored"))
+	rec.TimeReceived = u.FormatRFC3339(time.Now())
+	require.NoError(t, hasVal.putLocal(ctx, key, rec))
+
+	lookupRes := make(chan *lookupWithFollowupResult, 1)
+	lookupRes <- &lookupWithFollowupResult{
+		peers: []peer.ID{hasVal.self, lacksVal.self},
+		state: []qpeerset.PeerState{qpeerset.PeerQueried, qpeerset.PeerQueried},
+	}
+	getter.cacheValue(key, []byte("cached"), map[peer.ID]struct{}{hasVal.self: {}}, lookupRes)
+
+	// the value is cached at the closest peer that didn't have it, and
+	// expires after the ttl rather than the max record age.
+	cached, err := lacksVal.getRecordFromDatastore(ctx, mkDsKey(key))
+	require.NoError(t, err)
+	require.Equal(t, []byte("cached"), cached.GetValue())
+	received, err := u.ParseRFC3339(cached.GetTimeReceived())
+	require.NoError(t, err)
+	require.WithinDuration(t, time.Now().Add(time.Minute-lacksVal.maxRecordAge), received, 10*time.Second)
+
+	// stored records are never replaced by cached ones
+	require.NoError(t, getter.protoMessenger.CacheValue(ctx, hasVal.self, record.MakePutRecord(key, []byte("cached")), time.Minute))
+	stored, err := hasVal.getRecordFromDatastore(ctx, mkDsKey(key))
+	require.NoError(t, err)
+	require.Equal(t, []byte("stored"), stored.GetValue())
+}
+
+func TestProviderLookupCaching(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	finder := setupDHT(ctx, t, false, LookupCaching(time.Minute, nil))
+	provider := setupDHT(ctx, t, true, SignProviderRecords())
+	dhts := setupDHTS(t, ctx, 2)
+	for _, d := range append(dhts, finder, provider) {
+		defer d.Close()
+		defer d.host.Close()
+	}
+	hasProv, lacksProv := dhts[0], dhts[1]
+	connect(t, ctx, finder, hasProv)
+	connect(t, ctx, finder, lacksProv)
+	for _, d := range []*IpfsDHT{finder, hasProv, lacksProv} {
+		connectNoSync(t, ctx, provider, d)
+	}
+
+	key := testCaseCids[0].Hash()
+	require.NoError(t, provider.protoMessenger.PutProvider(ctx, hasProv.self, key, provider.host))
+	require.Eventually(t, func() bool {
+		return hasProv.hasProviderRecord(ctx, hasProv.providerStore.(providers.ProviderRecordStore), key, provider.self)
+	}, 5*time.Second, 10*time.Millisecond)
+
+	provs, err := finder.FindProviders(ctx, testCaseCids[0])
+	require.NoError(t, err)
+	require.Len(t, provs, 1)
+
+	// the signed record is cached at the peer queried that lacked it, and
+	// expires after the ttl rather than the provide validity
+	rs := lacksProv.providerStore.(providers.ProviderRecordStore)
+	require.Eventually(t, func() bool {
+		return lacksProv.hasProviderRecord(ctx, rs, key, provider.self)
+	}, 5*time.Second, 10*time.Millisecond)
+	recs, err := rs.GetProviderRecords(ctx, key)
+	require.NoError(t, err)
+	require.Len(t, recs, 1)
+	require.NotEmpty(t, recs[0].Signature)
+	require.WithinDuration(t, time.Now().Add(time.Minute-providers.ProvideValidity), recs[0].Received, 10*time.Second)
+
+	// unsigned records of other providers are never accepted
+	pmes := pb.NewMessage(pb.Message_ADD_PROVIDER, testCaseCids[1].Hash(), 0)
+	pmes.CacheTtl = 60
+	pmes.ProviderPeers = pb.RawPeerInfosToPBPeers([]peer.AddrInfo{{ID: provider.self, Addrs: provider.host.Addrs()}})
+	_, err = lacksProv.handleAddProvider(ctx, finder.self, pmes)
+	require.NoError(t, err)
+	require.False(t, lacksProv.hasProviderRecord(ctx, rs, testCaseCids[1].Hash(), provider.self))
+}
+
+func TestPutMany(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dhts := setupDHTS(t, ctx, 4)
+	defer func() {
+		for i := 0; i < 4; i++ {
+			dhts[i].Close()
+			defer dhts[i].host.Close()
+		}
+	}()
+
+	for i := 1; i < 4; i++ {
+		connect(t, ctx, dhts[0], dhts[i])
+	}
+
+	values := make(map[string][]byte)
+	for i := 0; i < 50; i++ {
+		values[fmt.Sprintf("/v/key%d", i)] = []byte(fmt.Sprintf("value%d", i))
+	}
+	require.NoError(t, dhts[0].PutMany(ctx, values))
+
+	for _, d := range dhts[1:] {
+		for k, v := range values {
+			rec, err := d.getLocal(ctx, k)
+			require.NoError(t, err)
+			require.NotNil(t, rec, "%s missing %s", d.self, k)
+			require.Equal(t, v, rec.GetValue())
+		}
+	}
+
+	// an invalid value fails the whole batch before anything is stored
+	err := dhts[0].PutMany(ctx, map[string][]byte{
+		"/v/good":    []byte("value"),
+		"/nope/root": []byte("value"),
+	})
+	require.Error(t, err)
+	rec, err := dhts[0].getLocal(ctx, "/v/good")
+	require.NoError(t, err)
+	require.Nil(t, rec)
+
+	// and so does a value older than the one stored
+	require.NoError(t, dhts[0].AddValidator("w", test.TestValidator{}))
+	_, err = dhts[0].putValueLocal(ctx, "/w/stale", []byte("newer"))
+	require.NoError(t, err)
+	err = dhts[0].PutMany(ctx, map[string][]byte{
+		"/w/fresh": []byte("valid"),
+		"/w/stale": []byte("valid"),
+	})
+	require.Error(t, err)
+	rec, err = dhts[0].getLocal(ctx, "/w/fresh")
+	require.NoError(t, err)
+	require.Nil(t, rec)
+}
+
+func TestGetValuesProvenance(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dhts := setupDHTS(t, ctx, 3)
+	defer func() {
+		for i := 0; i < 3; i++ {
+			dhts[i].Close()
+			defer dhts[i].host.Close()
+		}
+	}()
+
+	connect(t, ctx, dhts[0], dhts[1])
+	connect(t, ctx, dhts[0], dhts[2])
+
+	require.NoError(t, dhts[1].PutValue(ctx, "/v/hello", []byte("world")))
+
+	ctxT, cancelT := context.WithTimeout(ctx, 5*time.Second)
+	defer cancelT()
+	vals, err := dhts[0].GetValues(ctxT, "/v/hello", 0)
+	require.NoError(t, err)
+
+	seen := make(map[peer.ID]struct{})
+	for _, v := range vals {
+		require.Equal(t, "world", string(v.Val))
+		require.Equal(t, u.XOR(kb.ConvertKey("/v/hello"), kb.ConvertPeerID(v.From)), v.Distance)
+		if v.From == dhts[0].self {
+			require.Zero(t, v.RTT)
+		} else {
+			require.NotZero(t, v.RTT)
+		}
+		seen[v.From] = struct{}{}
+	}
+	require.Contains(t, seen, dhts[1].self)
+
+	vals, err = dhts[0].GetValues(ctxT, "/v/hello", 1)
+	require.NoError(t, err)
+	require.Len(t, vals, 1)
+
+	_, err = dhts[0].GetValues(ctxT, "/v/missing", 0)
+	require.Equal(t, routing.ErrNotFound, err)
+}
+
+func TestUnfindablePeer(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dhts := setupDHTS(t, ctx, 4)
+	defer func() {
+		for i := 0; i < 4; i++ {
+			dhts[i].Close()
+			dhts[i].Host().Close()
+		}
+	}()
+
+	connect(t, ctx, dhts[0], dhts[1])
+	connect(t, ctx, dhts[1], dhts[2])
+	connect(t, ctx, dhts[2], dhts[3])
+
+	// Give DHT 1 a bad addr for DHT 2.
+	dhts[1].host.Peerstore().ClearAddrs(dhts[2].PeerID())
+	dhts[1].host.Peerstore().AddAddr(dhts[2].PeerID(), dhts[0].Host().Addrs()[0], time.Minute)
+
+	ctxT, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	_, err := dhts[0].FindPeer(ctxT, dhts[3].PeerID())
+	if err == nil {
+		t.Error("should have failed to find peer")
+	}
+	if ctxT.Err() != nil {
+		t.Error("FindPeer should have failed before context expired")
+	}
+}
+
+func TestFindPeer(t *testing.T) {
+	// t.Skip("skipping test to debug another")
+	if testing.Short() {
+		t.SkipNow()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dhts := setupDHTS(t, ctx, 4)
+	defer func() {
+		for i := 0; i < 4; i++ {
+			dhts[i].Close()
+			dhts[i].host.Close()
+		}
+	}()
+
+	connect(t, ctx, dhts[0], dhts[1])
+	connect(t, ctx, dhts[1], dhts[2])
+	connect(t, ctx, dhts[1], dhts[3])
+
+	ctxT, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	p, err := dhts[0].FindPeer(ctxT, dhts[2].PeerID())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if p.ID == "" {
+		t.Fatal("Failed to find peer.")
+	}
+
+	if p.ID != dhts[2].PeerID() {
+		t.Fatal("Didnt find expected peer.")
+	}
+}
+
+func TestFindNodeBatch(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dhts := setupDHTS(t, ctx, 4)
+	defer func() {
+		for i := 0; i < 4; i++ {
+			dhts[i].Close()
+			dhts[i].host.Close()
+		}
+	}()
+
+	connect(t, ctx, dhts[0], dhts[1])
+	connect(t, ctx, dhts[1], dhts[2])
+	connect(t, ctx, dhts[1], dhts[3])
+
+	keys := [][]byte{[]byte(dhts[2].self), []byte(dhts[3].self), []byte("some key")}
+	batched, err := dhts[0].protoMessenger.GetClosestPeersBatch(ctx, dhts[1].self, keys)
+	require.NoError(t, err)
+	require.Len(t, batched, len(keys))
+
+	ids := func(infos []*peer.AddrInfo) []peer.ID {
+		out := make([]peer.ID, len(infos))
+		for i, ai := range infos {
+			out[i] = ai.ID
+		}
+		return out
+	}
+	for _, key := range keys {
+		single, err := dhts[0].protoMessenger.GetClosestPeers(ctx, dhts[1].self, peer.ID(key))
+		require.NoError(t, err)
+		require.ElementsMatch(t, ids(single), ids(batched[string(key)]))
+	}
+	require.Contains(t, ids(batched[string(keys[0])]), dhts[2].self)
+}
+
+func TestCapabilityExchange(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	client := setupDHT(ctx, t, false, MessageCompression())
+	server := setupDHT(ctx, t, false, DoubleHashProviderKeys())
+	for _, d := range []*IpfsDHT{client, server} {
+		defer d.Close()
+		defer d.host.Close()
+	}
+	connectNoSync(t, ctx, client, server)
+	require.NoError(t, client.Ping(ctx, server.self))
+
+	caps, ok := client.PeerCapabilities(server.self)
+	require.True(t, ok)
+	require.True(t, caps.Has(pb.CapBatchedQueries|pb.CapDoubleHashedProviders))
+	require.False(t, caps.Has(pb.CapMessageCompression))
+
+	caps, ok = server.PeerCapabilities(client.self)
+	require.True(t, ok)
+	require.True(t, caps.Has(pb.CapBatchedQueries|pb.CapMessageCompression))
+	require.False(t, caps.Has(pb.CapDoubleHashedProviders))
+
+	// peers known not to answer batched requests are asked one key at a time
+	pb.RememberCapabilities(client.peerstore, server.self, caps&^pb.CapBatchedQueries)
+	keys := [][]byte{[]byte(client.self), []byte("some key")}
+	batched, err := client.protoMessenger.GetClosestPeersBatch(ctx, server.self, keys)
+	require.NoError(t, err)
+	require.Len(t, batched, len(keys))
+}
+
+func TestResponseSignatures(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	client := setupDHT(ctx, t, false, VerifyResponseSignatures())
+	signer := setupDHT(ctx, t, false, SignResponses())
+	plain := setupDHT(ctx, t, false)
+	for _, d := range []*IpfsDHT{client, signer, plain} {
+		defer d.Close()
+		defer d.host.Close()
+	}
+	connect(t, ctx, client, signer)
+	connect(t, ctx, client, plain)
+	connect(t, ctx, signer, plain)
+
+	_, err := client.protoMessenger.GetClosestPeers(ctx, signer.self, client.self)
+	require.NoError(t, err)
+	caps, ok := client.PeerCapabilities(signer.self)
+	require.True(t, ok)
+	require.True(t, caps.Has(pb.CapSignedResponses))
+
+	// the signature covers the closer peers
+	resp, err := client.msgSender.SendRequest(ctx, signer.self, pb.NewMessage(pb.Message_FIND_NODE, []byte(client.self), 0))
+	require.NoError(t, err)
+	require.NotEmpty(t, resp.GetCloserPeers())
+	pk := signer.peerstore.PubKey(signer.self)
+	require.NoError(t, pb.VerifyResponse(pk, resp))
+	resp.CloserPeers = resp.CloserPeers[1:]
+	require.ErrorIs(t, pb.VerifyResponse(pk, resp), pb.ErrInvalidResponseSignature)
+
+	// unsigned responses are only accepted from peers not announcing signing
+	_, err = client.protoMessenger.GetClosestPeers(ctx, plain.self, client.self)
+	require.NoError(t, err)
+	pb.RememberCapabilities(client.peerstore, plain.self, pb.CapSignedResponses)
+	_, err = client.protoMessenger.GetClosestPeers(ctx, plain.self, client.self)
+	require.ErrorIs(t, err, pb.ErrInvalidResponseSignature)
+}
+
+func TestFindPeerWithQueryFilter(t *testing.T) {
+	// t.Skip("skipping test to debug another")
+	if testing.Short() {
+		t.SkipNow()
+	}
+	if runtime.GOOS == "windows" {
+		t.Skip("skipping due to #760")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	filteredPeer, err := bhost.NewHost(ctx, swarmt.GenSwarm(t, ctx, swarmt.OptDisableReuseport), new(bhost.HostOpts))
+	require.NoError(t, err)
+	dhts := setupDHTS(t, ctx, 4, QueryFilter(func(_ interface{}, ai peer.AddrInfo) bool {
+		return ai.ID != filteredPeer.ID()
+	}))
+	defer func() {
+		for i := 0; i < 4; i++ {
+			dhts[i].Close()
+			dhts[i].host.Close()
+		}
+	}()
+
+	connect(t, ctx, dhts[0], dhts[1])
+	connect(t, ctx, dhts[1], dhts[2])
+	connect(t, ctx, dhts[1], dhts[3])
+
+	err = filteredPeer.Connect(ctx, peer.AddrInfo{
+		ID:    dhts[2].host.ID(),
+		Addrs: dhts[2].host.Addrs(),
+	})
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		return len(dhts[2].host.Network().ConnsToPeer(filteredPeer.ID())) > 0
+	}, 5*time.Millisecond, time.Millisecond, "failed to connect to peer")
+
+	ctxT, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+
+	p, err := dhts[0].FindPeer(ctxT, filteredPeer.ID())
+	require.NoError(t, err)
+
+	require.NotEmpty(t, p.ID, "Failed to find peer.")
+	require.Equal(t, filteredPeer.ID(), p.ID, "Didnt find expected peer.")
+}
+
+func TestConnectCollision(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+
+	runTimes := 10
+
+	for rtime := 0; rtime < runTimes; rtime++ {
+		logger.Info("Running Time: ", rtime)
+
+		ctx, cancel := context.WithCancel(context.Background())
+
+		dhtA := setupDHT(ctx, t, false)
+		dhtB := setupDHT(ctx, t, false)
+
+		addrA := dhtA.peerstore.Addrs(dhtA.self)[0]
+		addrB := dhtB.peerstore.Addrs(dhtB.self)[0]
+
+		peerA := dhtA.self
+		peerB := dhtB.self
+
+		errs := make(chan error)
+		go func() {
+			dhtA.peerstore.AddAddr(peerB, addrB, peerstore.TempAddrTTL)
+			pi := peer.AddrInfo{ID: peerB}
+			err := dhtA.host.Connect(ctx, pi)
+			errs <- err
+		}()
+		go func() {
+			dhtB.peerstore.AddAddr(peerA, addrA, peerstore.TempAddrTTL)
+			pi := peer.AddrInfo{ID: peerA}
+			err := dhtB.host.Connect(ctx, pi)
+			errs <- err
+		}()
+
+		timeout := time.After(5 * time.Second)
+		select {
+		case e := <-errs:
+			if e != nil {
+				t.Fatal(e)
+			}
+		case <-timeout:
+			t.Fatal("Timeout received!")
+		}
+		select {
+		case e := <-errs:
+			if e != nil {
+				t.Fatal(e)
+			}
+		case <-timeout:
+			t.Fatal("Timeout received!")
+		}
+
+		dhtA.Close()
+		dhtB.Close()
+		dhtA.host.Close()
+		dhtB.host.Close()
+		cancel()
+	}
+}
+
+func TestValueRepublish(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dhtA := setupDHT(ctx, t, false, ValueRepublishInterval(100*time.Millisecond))
+	dhtB := setupDHT(ctx, t, false)
+
+	defer dhtA.Close()
+	defer dhtB.Close()
+	defer dhtA.host.Close()
+	defer dhtB.host.Close()
+
+	connect(t, ctx, dhtA, dhtB)
+
+	require.NoError(t, dhtA.PutValue(ctx, "/v/hello", []byte("world")))
+	rec, err := dhtB.getLocal(ctx, "/v/hello")
+	require.NoError(t, err)
+	require.NotNil(t, rec)
+
+	// B forgets the value, A should put it back
+	require.NoError(t, dhtB.datastore.Delete(ctx, mkDsKey("/v/hello")))
+	require.Eventually(t, func() bool {
+		rec, err := dhtB.getLocal(ctx, "/v/hello")
+		return err == nil && rec != nil && string(rec.GetValue()) == "world"
+	}, 5*time.Second, 50*time.Millisecond)
+
+	// once A loses the value it stops republishing it
+	require.NoError(t, dhtA.datastore.Delete(ctx, mkDsKey("/v/hello")))
+	require.Eventually(t, func() bool {
+		dhtA.publishedLk.Lock()
+		defer dhtA.publishedLk.Unlock()
+		return len(dhtA.published) == 0
+	}, 5*time.Second, 50*time.Millisecond)
+}
+
+func TestValueRepublishIntervalValidation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h, err := bhost.NewHost(ctx, swarmt.GenSwarm(t, ctx, swarmt.OptDisableReuseport), new(bhost.HostOpts))
+	require.NoError(t, err)
+	defer h.Close()
+
+	_, err = New(ctx, h, testPrefix, MaxRecordAge(time.Hour), ValueRepublishInterval(2*time.Hour))
+	require.Error(t, err)
+}
+
+func TestNamespaceMaxRecordAge(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	strict := setupDHT(ctx, t, false, NamespaceMaxRecordAge("v", time.Hour))
+	lenient := setupDHT(ctx, t, false)
+	for _, d := range []*IpfsDHT{strict, lenient} {
+		defer d.Close()
+		defer d.host.Close()
+	}
+
+	key := "/v/hello"
+	rec := record.MakePutRecord(key, []byte("world"))
+	rec.TimeReceived = u.FormatRFC3339(time.Now().Add(-2 * time.Hour))
+	for _, d := range []*IpfsDHT{strict, lenient} {
+		require.NoError(t, d.putLocal(ctx, key, rec))
+	}
+
+	// the record is too old for the namespace, and pruned
+	got, err := strict.checkLocalDatastore(ctx, []byte(key))
+	require.NoError(t, err)
+	require.Nil(t, got)
+	has, err := strict.datastore.Has(ctx, mkDsKey(key))
+	require.NoError(t, err)
+	require.False(t, has)
+
+	got, err = lenient.checkLocalDatastore(ctx, []byte(key))
+	require.NoError(t, err)
+	require.Equal(t, []byte("world"), got.GetValue())
+
+	// values must be republished more often than their namespace expires
+	_, err = New(ctx, strict.host, testPrefix, ValueRepublishInterval(2*time.Hour), NamespaceMaxRecordAge("v", time.Hour))
+	require.Error(t, err)
+}
+
+func TestMaxRecordSize(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dhtA := setupDHT(ctx, t, false, MaxRecordSize(16))
+	dhtB := setupDHT(ctx, t, false, MaxRecordSize(16))
+
+	defer dhtA.Close()
+	defer dhtB.Close()
+	defer dhtA.host.Close()
+	defer dhtB.host.Close()
+
+	connect(t, ctx, dhtA, dhtB)
+
+	require.NoError(t, dhtA.PutValue(ctx, "/v/small", []byte("small")))
+	err := dhtA.PutValue(ctx, "/v/large", bytes.Repeat([]byte("a"), 17))
+	require.True(t, errors.Is(err, ErrRecordTooLarge), err)
+	require.True(t, errors.Is(dhtA.PutMany(ctx, map[string][]byte{"/v/large": bytes.Repeat([]byte("a"), 17)}), ErrRecordTooLarge))
+
+	// oversized records sent to us are rejected by the handler
+	rec := record.MakePutRecord("/v/large", bytes.Repeat([]byte("a"), 17))
+	_, err = dhtB.handlePutValue(ctx, dhtA.self, &pb.Message{Type: pb.Message_PUT_VALUE, Key: rec.Key, Record: rec})
+	require.True(t, errors.Is(err, ErrRecordTooLarge), err)
+
+	// messages too large to carry an acceptable record are dropped unread
+	s, err := dhtA.host.NewStream(ctx, dhtB.self, dhtB.protocols...)
+	require.NoError(t, err)
+	defer s.Close()
+	rec = record.MakePutRecord("/v/huge", bytes.Repeat([]byte("a"), inboundMessageOverhead+17))
+	// the handler may reset the stream while we are still writing, so either
+	// the write or the following read fails.
+	if err = net.WriteMsg(s, &pb.Message{Type: pb.Message_PUT_VALUE, Key: rec.Key, Record: rec}); err == nil {
+		_, err = s.Read(make([]byte, 1))
+	}
+	require.Error(t, err)
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt64(&dhtB.oversizedMessages) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	rec, err = dhtB.getLocal(ctx, "/v/huge")
+	require.NoError(t, err)
+	require.Nil(t, rec)
+}
+
+func TestRecordCompression(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dhtA := setupDHT(ctx, t, false, RecordCompression(64))
+	dhtB := setupDHT(ctx, t, false, RecordCompression(64))
+	dhtC := setupDHT(ctx, t, false)
+
+	for _, d := range []*IpfsDHT{dhtA, dhtB, dhtC} {
+		defer d.Close()
+		defer d.host.Close()
+	}
+
+	connect(t, ctx, dhtA, dhtB)
+	connect(t, ctx, dhtA, dhtC)
+
+	value := bytes.Repeat([]byte("compressible "), 100)
+
+	ctxT, cancelT := context.WithTimeout(ctx, 5*time.Second)
+	defer cancelT()
+
+	// looking up a value teaches A which compressions B accepts, the put uses them
+	require.NoError(t, dhtA.PutValue(ctx, "/v/first", value))
+	_, err := dhtA.GetValue(ctxT, "/v/first")
+	require.NoError(t, err)
+	require.Equal(t, pb.SupportedCompressions, pb.AcceptedCompressions(dhtA.peerstore, dhtB.self))
+	require.Empty(t, pb.AcceptedCompressions(dhtA.peerstore, dhtC.self))
+	require.NoError(t, dhtA.PutValue(ctx, "/v/second", value))
+
+	for _, d := range []*IpfsDHT{dhtB, dhtC} {
+		rec, err := d.getLocal(ctx, "/v/second")
+		require.NoError(t, err)
+		require.NotNil(t, rec)
+		require.Equal(t, value, rec.GetValue())
+	}
+
+	for _, d := range []*IpfsDHT{dhtB, dhtC} {
+		val, err := d.GetValue(ctxT, "/v/second")
+		require.NoError(t, err)
+		require.Equal(t, value, val)
+	}
+}
+
+func TestBadProtoMessages(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d := setupDHT(ctx, t, false)
+
+	nilrec := new(pb.Message)
+	if _, err := d.handlePutValue(ctx, "testpeer", nilrec); err == nil {
+		t.Fatal("should have errored on nil record")
+	}
+}
+
+func TestAtomicPut(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d := setupDHT(ctx, t, false)
+	d.recordValidator = testAtomicPutValidator{}
+
+	// fnc to put a record
+	key := "testkey"
+	putRecord := func(value []byte) error {
+		rec := record.MakePutRecord(key, value)
+		pmes := pb.NewMessage(pb.Message_PUT_VALUE, rec.Key, 0)
+		pmes.Record = rec
+		_, err := d.handlePutValue(ctx, "testpeer", pmes)
+		return err
+	}
+
+	// put a valid record
+	if err := putRecord([]byte("valid")); err != nil {
+		t.Fatal("should not have errored on a valid record")
+	}
+
+	// simultaneous puts for old & new values
+	values := [][]byte{[]byte("newer1"), []byte("newer7"), []byte("newer3"), []byte("newer5")}
+	var wg sync.WaitGroup
+	for _, v := range values {
+		wg.Add(1)
+		go func(v []byte) {
+			defer wg.Done()
+			_ = putRecord(v) // we expect some of these to fail
+		}(v)
+	}
+	wg.Wait()
+
+	// get should return the newest value
+	pmes := pb.NewMessage(pb.Message_GET_VALUE, []byte(key), 0)
+	msg, err := d.handleGetValue(ctx, "testkey", pmes)
+	if err != nil {
+		t.Fatalf("should not have errored on final get, but got %+v", err)
+	}
+	if string(msg.GetRecord().Value) != "newer7" {
+		t.Fatalf("Expected 'newer7' got '%s'", string(msg.GetRecord().Value))
+	}
+}
+
+func TestClientModeConnect(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	a := setupDHT(ctx, t, false)
+	b := setupDHT(ctx, t, true)
+
+	connectNoSync(t, ctx, a, b)
+
+	c := testCaseCids[0]
+	p := peer.ID("TestPeer")
+	a.ProviderStore().AddProvider(ctx, c.Hash(), peer.AddrInfo{ID: p})
+	time.Sleep(time.Millisecond * 5) // just in case...
+
+	provs, err := b.FindProviders(ctx, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(provs) == 0 {
+		t.Fatal("Expected to get a provider back")
+	}
+
+	if provs[0].ID != p {
+		t.Fatal("expected it to be our test peer")
+	}
+	if a.routingTable.Find(b.self) != "" {
+		t.Fatal("DHT clients should not be added to routing tables")
+	}
+	if b.routingTable.Find(a.self) == "" {
+		t.Fatal("DHT server should have been added to the dht client's routing table")
+	}
+}
+
+func TestClientModeFindPeer(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	a := setupDHT(ctx, t, false)
+	b := setupDHT(ctx, t, true)
+	c := setupDHT(ctx, t, true)
+
+	connectNoSync(t, ctx, b, a)
+	connectNoSync(t, ctx, c, a)
+
+	// Can't use `connect` because b and c are only clients.
+	wait(t, ctx, b, a)
+	wait(t, ctx, c, a)
+
+	pi, err := c.FindPeer(ctx, b.self)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pi.Addrs) == 0 {
+		t.Fatal("should have found addresses for node b")
+	}
+
+	err = c.host.Connect(ctx, pi)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func TestFindPeerQueryMinimal(t *testing.T) {
+	testFindPeerQuery(t, 2, 22, 1)
+}
+
+func TestFindPeerQuery(t *testing.T) {
+	if detectrace.WithRace() {
+		t.Skip("skipping due to race detector max goroutines")
+	}
+
+	if testing.Short() {
+		t.Skip("skipping test in short mode")
+	}
+	testFindPeerQuery(t, 5, 40, 3)
+}
+
+// NOTE: You must have ATLEAST (minRTRefreshThreshold+1) test peers before using this.
+func testFindPeerQuery(t *testing.T,
+	bootstrappers, // Number of nodes connected to the querying node
+	leafs, // Number of nodes that might be connected to from the bootstrappers
+	bootstrapConns int, // Number of bootstrappers each leaf should connect to.
+) {
+	if runtime.GOOS == "windows" {
+		t.Skip("skipping due to #760")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dhts := setupDHTS(t, ctx, 1+bootstrappers+leafs, BucketSize(4))
+	defer func() {
+		for _, d := range dhts {
+			d.Close()
+			d.host.Close()
+		}
+	}()
+
+	t.Log("connecting")
+
+	mrand := rand.New(rand.NewSource(42))
+	guy := dhts[0]
+	others := dhts[1:]
+	for i := 0; i < leafs; i++ {
+		for _, v := range mrand.Perm(bootstrappers)[:bootstrapConns] {
+			connectNoSync(t, ctx, others[v], others[bootstrappers+i])
+		}
+	}
+
+	for i := 0; i < bootstrappers; i++ {
+		connectNoSync(t, ctx, guy, others[i])
+	}
+
+	t.Log("waiting for routing tables")
+
+	// give some time for things to settle down
+	waitForWellFormedTables(t, dhts, bootstrapConns, bootstrapConns, 5*time.Second)
+
+	t.Log("refreshing")
+
+	var wg sync.WaitGroup
+	for _, dht := range dhts {
+		wg.Add(1)
+		go func(d *IpfsDHT) {
+			<-d.RefreshRoutingTable()
+			wg.Done()
+		}(dht)
+	}
+
+	wg.Wait()
+
+	t.Log("waiting for routing tables again")
+
+	// Wait for refresh to work. At least one bucket should be full.
+	waitForWellFormedTables(t, dhts, 4, 0, 5*time.Second)
+
+	var peers []peer.ID
+	for _, d := range others {
+		peers = append(peers, d.PeerID())
+	}
+
+	t.Log("querying")
+
+	val := "foobar"
+	rtval := kb.ConvertKey(val)
+
+	outpeers, err := guy.GetClosestPeers(ctx, val)
+	require.NoError(t, err)
+
+	sort.Sort(peer.IDSlice(outpeers))
+
+	exp := kb.SortClosestPeers(peers, rtval)[:minInt(guy.bucketSize, len(peers))]
+	t.Logf("got %d peers", len(outpeers))
+	got := kb.SortClosestPeers(outpeers, rtval)
+
+	assert.EqualValues(t, exp, got)
+}
+
+func TestFindClosestPeers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	nDHTs := 30
+	dhts := setupDHTS(t, ctx, nDHTs)
+	defer func() {
+		for i := 0; i < nDHTs; i++ {
+			dhts[i].Close()
+			defer dhts[i].host.Close()
+		}
+	}()
+
+	t.Logf("connecting %d dhts in a ring", nDHTs)
+	for i := 0; i < nDHTs; i++ {
+		connect(t, ctx, dhts[i], dhts[(i+1)%len(dhts)])
+	}
+
+	querier := dhts[1]
+	peers, err := querier.GetClosestPeers(ctx, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(peers) < querier.beta {
+		t.Fatalf("got wrong number of peers (got %d, expected at least %d)", len(peers), querier.beta)
+	}
+}
+
+func TestFixLowPeers(t *testing.T) {
+	ctx := context.Background()
+
+	dhts := setupDHTS(t, ctx, minRTRefreshThreshold+5)
+
+	defer func() {
+		for _, d := range dhts {
+			d.Close()
+			d.Host().Close()
+		}
+	}()
+
+	mainD := dhts[0]
+
+	// connect it to everyone else
+	for _, d := range dhts[1:] {
+		mainD.peerstore.AddAddrs(d.self, d.peerstore.Addrs(d.self), peerstore.TempAddrTTL)
+		require.NoError(t, mainD.Host().Connect(ctx, peer.AddrInfo{ID: d.self}))
+	}
+
+	waitForWellFormedTables(t, []*IpfsDHT{mainD}, minRTRefreshThreshold, minRTRefreshThreshold+4, 5*time.Second)
+
+	// run a refresh on all of them
+	for _, d := range dhts {
+		err := <-d.RefreshRoutingTable()
+		require.NoError(t, err)
+	}
+
+	// now remove peers from RT so threshold gets hit
+	for _, d := range dhts[3:] {
+		mainD.routingTable.RemovePeer(d.self)
+	}
+
+	// but we will still get enough peers in the RT because of fix low Peers
+	waitForWellFormedTables(t, []*IpfsDHT{mainD}, minRTRefreshThreshold, minRTRefreshThreshold, 5*time.Second)
+}
+
+func TestProvideDisabled(t *testing.T) {
+	k := testCaseCids[0]
+	kHash := k.Hash()
+	for i := 0; i < 3; i++ {
+		enabledA := (i & 0x1) > 0
+		enabledB := (i & 0x2) > 0
+		t.Run(fmt.Sprintf("a=%v/b=%v", enabledA, enabledB), func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			var (
+				optsA, optsB []Option
+			)
+			optsA = append(optsA, ProtocolPrefix("/provMaybeDisabled"))
+			optsB = append(optsB, ProtocolPrefix("/provMaybeDisabled"))
+
+			if !enabledA {
+				optsA = append(optsA, DisableProviders())
+			}
+			if !enabledB {
+				optsB = append(optsB, DisableProviders())
+			}
+
+			dhtA := setupDHT(ctx, t, false, optsA...)
+			dhtB := setupDHT(ctx, t, false, optsB...)
+
+			defer dhtA.Close()
+			defer dhtB.Close()
+			defer dhtA.host.Close()
+			defer dhtB.host.Close()
+
+			connect(t, ctx, dhtA, dhtB)
+
+			err := dhtB.Provide(ctx, k, true)
+			if enabledB {
+				if err != nil {
+					t.Fatal("put should have succeeded on node B", err)
+				}
+			} else {
+				if err != routing.ErrNotSupported {
+					t.Fatal("should not have put the value to node B", err)
+				}
+				_, err = dhtB.FindProviders(ctx, k)
+				if err != routing.ErrNotSupported {
+					t.Fatal("get should have failed on node B")
+				}
+				provs, _ := dhtB.ProviderStore().GetProviders(ctx, kHash)
+				if len(provs) != 0 {
+					t.Fatal("node B should not have found local providers")
+				}
+			}
+
+			provs, err := dhtA.FindProviders(ctx, k)
+			if enabledA {
+				if len(provs) != 0 {
+					t.Fatal("node A should not have found providers")
+				}
+			} else {
+				if err != routing.ErrNotSupported {
+					t.Fatal("node A should not have found providers")
+				}
+			}
+			provAddrs, _ := dhtA.ProviderStore().GetProviders(ctx, kHash)
+			if len(provAddrs) != 0 {
+				t.Fatal("node A should not have found local providers")
+			}
+		})
+	}
+}
+
+func TestHandleRemotePeerProtocolChanges(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	os := []Option{
+		testPrefix,
+		Mode(ModeServer),
+		NamespacedValidator("v", blankValidator{}),
+		DisableAutoRefresh(),
+	}
+
+	// start host 1 that speaks dht v1
+	hA, err := bhost.NewHost(ctx, swarmt.GenSwarm(t, ctx, swarmt.OptDisableReuseport), new(bhost.HostOpts))
+	require.NoError(t, err)
+	dhtA, err := New(ctx, hA, os...)
+	require.NoError(t, err)
+	defer dhtA.Close()
+
+	// start host 2 that also speaks dht v1
+	hB, err := bhost.NewHost(ctx, swarmt.GenSwarm(t, ctx, swarmt.OptDisableReuseport), new(bhost.HostOpts))
+	require.NoError(t, err)
+	dhtB, err := New(ctx, hB, os...)
+	require.NoError(t, err)
+	defer dhtB.Close()
+
+	connect(t, ctx, dhtA, dhtB)
+
+	// now assert both have each other in their RT
+	waitForWellFormedTables(t, []*IpfsDHT{dhtA, dhtB}, 1, 1, 10*time.Second)
+
+	// dhtB becomes a client
+	require.NoError(t, dhtB.setMode(modeClient))
+
+	// which means that dhtA should evict it from it's RT
+	waitForWellFormedTables(t, []*IpfsDHT{dhtA}, 0, 0, 10*time.Second)
+
+	// dhtB becomes a server
+	require.NoError(t, dhtB.setMode(modeServer))
+
+	// which means dhtA should have it in the RT again because of fixLowPeers
+	waitForWellFormedTables(t, []*IpfsDHT{dhtA}, 1, 1, 10*time.Second)
+}
+
+func TestGetSetPluggedProtocol(t *testing.T) {
+	t.Run("PutValue/GetValue - same protocol", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		os := []Option{
+			ProtocolPrefix("/esh"),
+			Mode(ModeServer),
+			NamespacedValidator("v", blankValidator{}),
+			DisableAutoRefresh(),
+		}
+
+		hA, err := bhost.NewHost(ctx, swarmt.GenSwarm(t, ctx, swarmt.OptDisableReuseport), new(bhost.HostOpts))
+		require.NoError(t, err)
+		dhtA, err := New(ctx, hA, os...)
+		require.NoError(t, err)
+
+		hB, err := bhost.NewHost(ctx, swarmt.GenSwarm(t, ctx, swarmt.OptDisableReuseport), new(bhost.HostOpts))
+		require.NoError(t, err)
+		dhtB, err := New(ctx, hB, os...)
+		require.NoError(t, err)
+
+		connect(t, ctx, dhtA, dhtB)
+
+		ctxT, cancel := context.WithTimeout(ctx, time.Second)
+		defer cancel()
+		err = dhtA.PutValue(ctxT, "/v/cat", []byte("meow"))
+		require.NoError(t, err)
+
+		value, err := dhtB.GetValue(ctxT, "/v/cat")
+		require.NoError(t, err)
+
+		require.Equal(t, "meow", string(value))
+	})
+
+	t.Run("DHT routing table for peer A won't contain B if A and B don't use same protocol", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		hA, err := bhost.NewHost(ctx, swarmt.GenSwarm(t, ctx, swarmt.OptDisableReuseport), new(bhost.HostOpts))
+		require.NoError(t, err)
+		dhtA, err := New(ctx, hA, []Option{
+			ProtocolPrefix("/esh"),
+			Mode(ModeServer),
+			NamespacedValidator("v", blankValidator{}),
+			DisableAutoRefresh(),
+		}...)
+		require.NoError(t, err)
+
+		hB, err := bhost.NewHost(ctx, swarmt.GenSwarm(t, ctx, swarmt.OptDisableReuseport), new(bhost.HostOpts))
+		require.NoError(t, err)
+		dhtB, err := New(ctx, hB, []Option{
+			ProtocolPrefix("/lsr"),
+			Mode(ModeServer),
+			NamespacedValidator("v", blankValidator{}),
+			DisableAutoRefresh(),
+		}...)
+		require.NoError(t, err)
+
+		connectNoSync(t, ctx, dhtA, dhtB)
+
+		// We don't expect connection notifications for A to reach B (or vice-versa), given
+		// that they've been configured with different protocols - but we'll give them a
+		// chance, anyhow.
+		time.Sleep(time.Second * 2)
+
+		err = dhtA.PutValue(ctx, "/v/cat", []byte("meow"))
+		if err == nil || !strings.Contains(err.Error(), "failed to find any peer in table") {
+			t.Fatalf("put should not have been able to find any peers in routing table, err:'%v'", err)
+		}
+
+		v, err := dhtB.GetValue(ctx, "/v/cat")
+		if v != nil || err != routing.ErrNotFound {
+			t.Fatalf("get should have failed from not being able to find the value, err: '%v'", err)
+		}
+	})
+}
+
+func TestPing(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds := setupDHTS(t, ctx, 2)
+	ds[0].Host().Peerstore().AddAddrs(ds[1].PeerID(), ds[1].Host().Addrs(), peerstore.AddressTTL)
+	assert.NoError(t, ds[0].Ping(context.Background(), ds[1].PeerID()))
+}
+
+func TestClientModeAtInit(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	pinger := setupDHT(ctx, t, false)
+	client := setupDHT(ctx, t, true)
+	pinger.Host().Peerstore().AddAddrs(client.PeerID(), client.Host().Addrs(), peerstore.AddressTTL)
+	err := pinger.Ping(context.Background(), client.PeerID())
+	assert.True(t, errors.Is(err, multistream.ErrNotSupported))
+}
+
+func TestModeChange(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	clientOnly := setupDHT(ctx, t, true)
+	clientToServer := setupDHT(ctx, t, true)
+	clientOnly.Host().Peerstore().AddAddrs(clientToServer.PeerID(), clientToServer.Host().Addrs(), peerstore.AddressTTL)
+	err := clientOnly.Ping(ctx, clientToServer.PeerID())
+	assert.True(t, errors.Is(err, multistream.ErrNotSupported))
+	err = clientToServer.setMode(modeServer)
+	assert.Nil(t, err)
+	err = clientOnly.Ping(ctx, clientToServer.PeerID())
+	assert.Nil(t, err)
+	err = clientToServer.setMode(modeClient)
+	assert.Nil(t, err)
+	err = clientOnly.Ping(ctx, clientToServer.PeerID())
+	assert.NotNil(t, err)
+}
+
+func TestDynamicModeSwitching(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	prober := setupDHT(ctx, t, true)               // our test harness
+	node := setupDHT(ctx, t, true, Mode(ModeAuto)) // the node under test
+	prober.Host().Peerstore().AddAddrs(node.PeerID(), node.Host().Addrs(), peerstore.AddressTTL)
+	if _, err := prober.Host().Network().DialPeer(ctx, node.PeerID()); err != nil {
+		t.Fatal(err)
+	}
+
+	emitter, err := node.host.EventBus().Emitter(new(event.EvtLocalReachabilityChanged))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertDHTClient := func() {
+		err = prober.Ping(ctx, node.PeerID())
+		assert.True(t, errors.Is(err, multistream.ErrNotSupported))
+		if l := len(prober.RoutingTable().ListPeers()); l != 0 {
+			t.Errorf("expected routing table length to be 0; instead is %d", l)
+		}
+	}
+
+	assertDHTServer := func() {
+		err = prober.Ping(ctx, node.PeerID())
+		assert.Nil(t, err)
+		// the node should be in the RT for the prober
+		// because the prober will call fixLowPeers when the node updates it's protocols
+		if l := len(prober.RoutingTable().ListPeers()); l != 1 {
+			t.Errorf("expected routing table length to be 1; instead is %d", l)
+		}
+	}
+
+	err = emitter.Emit(event.EvtLocalReachabilityChanged{Reachability: network.ReachabilityPrivate})
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(500 * time.Millisecond)
+
+	assertDHTClient()
+
+	err = emitter.Emit(event.EvtLocalReachabilityChanged{Reachability: network.ReachabilityPublic})
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(500 * time.Millisecond)
+
+	assertDHTServer()
+
+	err = emitter.Emit(event.EvtLocalReachabilityChanged{Reachability: network.ReachabilityUnknown})
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(500 * time.Millisecond)
+
+	assertDHTClient()
+}
+
+func TestSetMode(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	prober := setupDHT(ctx, t, false)
+	node := setupDHT(ctx, t, true, Mode(ModeClient))
+	for _, d := range []*IpfsDHT{prober, node} {
+		defer d.Close()
+		defer d.host.Close()
+	}
+	connectNoSync(t, ctx, node, prober)
+
+	emitter, err := node.host.EventBus().Emitter(new(event.EvtLocalReachabilityChanged))
+	require.NoError(t, err)
+
+	inRT := func() bool {
+		return prober.RoutingTable().Find(node.self) != ""
+	}
+
+	require.NoError(t, node.SetMode(ModeServer))
+	require.Equal(t, ModeServer, node.Mode())
+	require.Eventually(t, inRT, 5*time.Second, 10*time.Millisecond)
+
+	require.NoError(t, node.SetMode(ModeClient))
+	require.Equal(t, ModeClient, node.Mode())
+	require.Eventually(t, func() bool { return !inRT() }, 5*time.Second, 10*time.Millisecond)
+
+	// manual modes ignore reachability changes
+	require.NoError(t, emitter.Emit(event.EvtLocalReachabilityChanged{Reachability: network.ReachabilityPublic}))
+	time.Sleep(100 * time.Millisecond)
+	require.Equal(t, modeClient, node.getMode())
+
+	// automatic modes follow the last known reachability
+	require.NoError(t, node.SetMode(ModeAuto))
+	require.Equal(t, modeServer, node.getMode())
+	require.NoError(t, emitter.Emit(event.EvtLocalReachabilityChanged{Reachability: network.ReachabilityPrivate}))
+	require.Eventually(t, func() bool { return node.getMode() == modeClient }, 5*time.Second, 10*time.Millisecond)
+
+	require.Error(t, node.SetMode(ModeOpt(42)))
+}
+
+func TestInvalidKeys(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	nDHTs := 2
+	dhts := setupDHTS(t, ctx, nDHTs)
+	defer func() {
+		for i := 0; i < nDHTs; i++ {
+			dhts[i].Close()
+			defer dhts[i].host.Close()
+		}
+	}()
+
+	t.Logf("connecting %d dhts in a ring", nDHTs)
+	for i := 0; i < nDHTs; i++ {
+		connect(t, ctx, dhts[i], dhts[(i+1)%len(dhts)])
+	}
+
+	querier := dhts[0]
+	_, err := querier.GetClosestPeers(ctx, "")
+	if err == nil {
+		t.Fatal("get closest peers should have failed")
+	}
+
+	_, err = querier.FindProviders(ctx, cid.Cid{})
+	switch err {
+	case routing.ErrNotFound, routing.ErrNotSupported, kb.ErrLookupFailure:
+		t.Fatal("failed with the wrong error: ", err)
+	case nil:
+		t.Fatal("find providers should have failed")
+	}
+
+	_, err = querier.FindPeer(ctx, peer.ID(""))
+	if err != peer.ErrEmptyPeerID {
+		t.Fatal("expected to fail due to the empty peer ID")
+	}
+
+	_, err = querier.GetValue(ctx, "")
+	if err == nil {
+		t.Fatal("expected to have failed")
+	}
+
+	err = querier.PutValue(ctx, "", []byte("foobar"))
+	if err == nil {
+		t.Fatal("expected to have failed")
+	}
+}
+
+func TestV1ProtocolOverride(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d1 := setupDHT(ctx, t, false, V1ProtocolOverride("/myproto"))
+	d2 := setupDHT(ctx, t, false, V1ProtocolOverride("/myproto"))
+	d3 := setupDHT(ctx, t, false, V1ProtocolOverride("/myproto2"))
+	d4 := setupDHT(ctx, t, false)
+
+	dhts := []*IpfsDHT{d1, d2, d3, d4}
+
+	for i, dout := range dhts {
+		for _, din := range dhts[i+1:] {
+			connectNoSync(t, ctx, dout, din)
+		}
+	}
+
+	wait(t, ctx, d1, d2)
+	wait(t, ctx, d2, d1)
+
+	time.Sleep(time.Second)
+
+	if d1.RoutingTable().Size() != 1 || d2.routingTable.Size() != 1 {
+		t.Fatal("should have one peer in the routing table")
+	}
+
+	if d3.RoutingTable().Size() > 0 || d4.RoutingTable().Size() > 0 {
+		t.Fatal("should have an empty routing table")
+	}
+}
+
+func TestNetworkConfig(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	network := NetworkConfig{
+		ProtocolPrefix: "/forked",
+		Validators:     map[string]record.Validator{"v": blankValidator{}},
+	}
+	d1 := setupDHT(ctx, t, false, Network(network))
+	network.BootstrapPeers = []peer.AddrInfo{{ID: d1.self, Addrs: d1.host.Addrs()}}
+	d2 := setupDHT(ctx, t, false, Network(network))
+	d3 := setupDHT(ctx, t, false)
+	for _, d := range []*IpfsDHT{d1, d2, d3} {
+		defer d.Close()
+		defer d.host.Close()
+	}
+
+	require.Equal(t, []protocol.ID{"/forked/kad/1.0.0"}, d2.protocols)
+	require.Len(t, d2.Validator(), 1)
+	require.Equal(t, network.BootstrapPeers, d2.bootstrapPeers())
+
+	connectNoSync(t, ctx, d2, d3)
+	require.NoError(t, d2.host.Connect(ctx, network.BootstrapPeers[0]))
+	wait(t, ctx, d2, d1)
+	require.NoError(t, d2.PutValue(ctx, "/v/hello", []byte("world")))
+	val, err := d1.GetValue(ctx, "/v/hello", Quorum(1))
+	require.NoError(t, err)
+	require.Equal(t, []byte("world"), val)
+
+	time.Sleep(100 * time.Millisecond)
+	require.Equal(t, 1, d2.RoutingTable().Size())
+	require.Equal(t, 0, d3.RoutingTable().Size())
+}
+
+func TestRoutingFilter(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	nDHTs := 2
+	dhts := setupDHTS(t, ctx, nDHTs)
+	defer func() {
+		for i := 0; i < nDHTs; i++ {
+			dhts[i].Close()
+			defer dhts[i].host.Close()
+		}
+	}()
+	dhts[0].routingTablePeerFilter = PublicRoutingTableFilter
+
+	connectNoSync(t, ctx, dhts[0], dhts[1])
+	wait(t, ctx, dhts[1], dhts[0])
+
+	select {
+	case <-ctx.Done():
+		t.Fatal(ctx.Err())
+	case <-time.After(time.Millisecond * 200):
+	}
+}
+
+func TestBootStrapWhenRTIsEmpty(t *testing.T) {
+	if detectrace.WithRace() {
+		t.Skip("skipping timing dependent test when race detector is running")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// create three boostrap peers each of which is connected to 1 other peer.
+	nBootStraps := 3
+	bootstrappers := setupDHTS(t, ctx, nBootStraps)
+	defer func() {
+		for i := 0; i < nBootStraps; i++ {
+			bootstrappers[i].Close()
+			defer bootstrappers[i].host.Close()
+		}
+	}()
+
+	bootstrapcons := setupDHTS(t, ctx, nBootStraps)
+	defer func() {
+		for i := 0; i < nBootStraps; i++ {
+			bootstrapcons[i].Close()
+			defer bootstrapcons[i].host.Close()
+		}
+	}()
+	for i := 0; i < nBootStraps; i++ {
+		connect(t, ctx, bootstrappers[i], bootstrapcons[i])
+	}
+
+	// convert the bootstrap addresses to a p2p address
+	bootstrapAddrs := make([]peer.AddrInfo, nBootStraps)
+	for i := 0; i < nBootStraps; i++ {
+		b := peer.AddrInfo{ID: bootstrappers[i].self,
+			Addrs: bootstrappers[i].host.Addrs()}
+		bootstrapAddrs[i] = b
+	}
+
+	{
+
+		//----------------
+		// We will initialize a DHT with 1 bootstrapper, connect it to another DHT,
+		// then remove the latter from the Routing Table
+		// This should add the bootstrap peer and the peer that the bootstrap peer is conencted to
+		// to it's Routing Table.
+		// AutoRefresh needs to be enabled for this.
+
+		h1, err := bhost.NewHost(ctx, swarmt.GenSwarm(t, ctx, swarmt.OptDisableReuseport), new(bhost.HostOpts))
+		require.NoError(t, err)
+		dht1, err := New(
+			ctx,
+			h1,
+			testPrefix,
+			NamespacedValidator("v", blankValidator{}),
+			Mode(ModeServer),
+			BootstrapPeers(bootstrapAddrs[0]),
+		)
+		require.NoError(t, err)
+		dht2 := setupDHT(ctx, t, false)
+		defer func() {
+			dht1.host.Close()
+			dht2.host.Close()
+			dht1.Close()
+			dht2.Close()
+		}()
+		connect(t, ctx, dht1, dht2)
+		require.NoError(t, dht2.Close())
+		require.NoError(t, dht2.host.Close())
+		require.NoError(t, dht1.host.Network().ClosePeer(dht2.self))
+		dht1.routingTable.RemovePeer(dht2.self)
+		require.NotContains(t, dht2.self, dht1.routingTable.ListPeers())
+		require.Eventually(t, func() bool {
+			return dht1.routingTable.Size() == 2 && dht1.routingTable.Find(bootstrappers[0].self) != "" &&
+				dht1.routingTable.Find(bootstrapcons[0].self) != ""
+		}, 5*time.Second, 500*time.Millisecond)
+
+	}
+
+	{
+
+		//----------------
+		// We will initialize a DHT with 2 bootstrappers, connect it to another DHT,
+		// then remove the DHT handler from the other DHT which should make the first DHT's
+		// routing table empty.
+		// This should add the bootstrap peers and the peer thats the bootstrap peers are connected to
+		// to it's Routing Table.
+		// AutoRefresh needs to be enabled for this.
+		h1, err := bhost.NewHost(ctx, swarmt.GenSwarm(t, ctx, swarmt.OptDisableReuseport), new(bhost.HostOpts))
+		require.NoError(t, err)
+		dht1, err := New(
+			ctx,
+			h1,
+			testPrefix,
+			NamespacedValidator("v", blankValidator{}),
+			Mode(ModeServer),
+			BootstrapPeers(bootstrapAddrs[1], bootstrapAddrs[2]),
+		)
+		require.NoError(t, err)
+
+		dht2 := setupDHT(ctx, t, false)
+		connect(t, ctx, dht1, dht2)
+		defer func() {
+			dht1.host.Close()
+			dht2.host.Close()
+			dht1.Close()
+			dht2.Close()
+		}()
+		connect(t, ctx, dht1, dht2)
+		require.NoError(t, dht2.setMode(modeClient))
+
+		require.Eventually(t, func() bool {
+			rt := dht1.routingTable
+
+			return rt.Size() == 4 && rt.Find(bootstrappers[1].self) != "" &&
+				rt.Find(bootstrappers[2].self) != "" && rt.Find(bootstrapcons[1].self) != "" && rt.Find(bootstrapcons[2].self) != ""
+		}, 5*time.Second, 500*time.Millisecond)
+	}
+}
+
+func TestBootstrapPeersFunc(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var lock sync.Mutex
+
+	bootstrapFuncA := func() []peer.AddrInfo {
+		return []peer.AddrInfo{}
+	}
+	dhtA := setupDHT(ctx, t, false, BootstrapPeersFunc(bootstrapFuncA))
+
+	bootstrapPeersB := []peer.AddrInfo{}
+	bootstrapFuncB := func() []peer.AddrInfo {
+		lock.Lock()
+		defer lock.Unlock()
+		return bootstrapPeersB
+	}
+
+	dhtB := setupDHT(ctx, t, false, BootstrapPeersFunc(bootstrapFuncB))
+	require.Equal(t, 0, len(dhtB.host.Network().Peers()))
+
+	addrA := peer.AddrInfo{
+		ID:    dhtA.self,
+		Addrs: dhtA.host.Addrs(),
+	}
+
+	lock.Lock()
+	bootstrapPeersB = []peer.AddrInfo{addrA}
+	lock.Unlock()
+
+	dhtB.fixLowPeers(ctx)
+	require.NotEqual(t, 0, len(dhtB.host.Network().Peers()))
+}
+
+func TestPreconnectedNodes(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	opts := []Option{
+		testPrefix,
+		DisableAutoRefresh(),
+		Mode(ModeServer),
+	}
+
+	// Create hosts
+	h1, err := bhost.NewHost(ctx, swarmt.GenSwarm(t, ctx, swarmt.OptDisableReuseport), new(bhost.HostOpts))
 	require.NoError(t, err)
-	dhtA, err := New(ctx, hA, os...)
+	h2, err := bhost.NewHost(ctx, swarmt.GenSwarm(t, ctx, swarmt.OptDisableReuseport), new(bhost.HostOpts))
 	require.NoError(t, err)
-	defer dhtA.Close()
 
-	// start host 2 that also speaks dht v1
-	hB, err := bhost.NewHost(ctx, swarmt.GenSwarm(t, ctx, swarmt.OptDisableReuseport), new(bhost.HostOpts))
-	require.NoError(t, err)
-	dhtB, err := New(ctx, hB, os...)
+	// Setup first DHT
+	d1, err := New(ctx, h1, opts...)
 	require.NoError(t, err)
-	defer dhtB.Close()
 
-	connect(t, ctx, dhtA, dhtB)
+	// Connect the first host to the second
+	err = h1.Connect(ctx, peer.AddrInfo{ID: h2.ID(), Addrs: h2.Addrs()})
+	require.NoError(t, err)
 
-	// now assert both have each other in their RT
-	waitForWellFormedTables(t, []*IpfsDHT{dhtA, dhtB}, 1, 1, 10*time.Second)
+	// Wait until we know identify has completed by checking for supported protocols
+	// TODO: Is this needed? Could we do h2.Connect(h1) and that would wait for identify to complete.
+	require.Eventually(t, func() bool {
+		h1Protos, err := h2.Peerstore().SupportsProtocols(h1.ID(), d1.protocolsStrs...)
+		require.NoError(t, err)
 
-	// dhtB becomes a client
-	require.NoError(t, dhtB.setMode(modeClient))
+		return len(h1Protos) > 0
+	}, 10*time.Second, time.Millisecond)
 
-	// which means that dhtA should evict it from it's RT
-	waitForWellFormedTables(t, []*IpfsDHT{dhtA}, 0, 0, 10*time.Second)
+	// Setup the second DHT
+	d2, err := New(ctx, h2, opts...)
+	require.NoError(t, err)
 
-	// dhtB becomes a server
-	require.NoError(t, dhtB.setMode(modeServer))
+	// See if it works
+	peers, err := d2.GetClosestPeers(ctx, "testkey")
+	require.NoError(t, err)
 
-	// which means dhtA should have it in the RT again because of fixLowPeers
-	waitForWellFormedTables(t, []*IpfsDHT{dhtA}, 1, 1, 10*time.Second)
+	require.Equal(t, len(peers), 1, "why is there more than one peer?")
+	require.Equal(t, h1.ID(), peers[0], "could not find peer")
 }
 
-func TestGetSetPluggedProtocol(t *testing.T) {
-	t.Run("PutValue/GetValue - same protocol", func(t *testing.T) {
-		ctx, cancel := context.WithCancel(context.Background())
-		defer cancel()
+func TestShutdownGracePeriod(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-		os := []Option{
-			ProtocolPrefix("/esh"),
-			Mode(ModeServer),
-			NamespacedValidator("v", blankValidator{}),
-			DisableAutoRefresh(),
+	entered, unblock := make(chan struct{}), make(chan struct{})
+	block := func(next RequestHandler) RequestHandler {
+		return func(ctx context.Context, p peer.ID, req *pb.Message) (*pb.Message, error) {
+			if req.GetType() == pb.Message_GET_PROVIDERS {
+				close(entered)
+				<-unblock
+			}
+			return next(ctx, p, req)
 		}
+	}
 
-		hA, err := bhost.NewHost(ctx, swarmt.GenSwarm(t, ctx, swarmt.OptDisableReuseport), new(bhost.HostOpts))
-		require.NoError(t, err)
-		dhtA, err := New(ctx, hA, os...)
-		require.NoError(t, err)
+	client := setupDHT(ctx, t, false)
+	server := setupDHT(ctx, t, false, ShutdownGracePeriod(time.Minute), HandlerMiddleware(block))
+	defer client.Close()
+	for _, d := range []*IpfsDHT{client, server} {
+		defer d.host.Close()
+	}
+	connect(t, ctx, client, server)
+
+	answered := make(chan error, 1)
+	go func() {
+		_, _, err := client.protoMessenger.GetProviders(ctx, server.self, testCaseCids[0].Hash())
+		answered <- err
+	}()
+	<-entered
+
+	closed := make(chan struct{})
+	go func() {
+		server.Close()
+		close(closed)
+	}()
+	require.Eventually(t, func() bool {
+		_, err := server.GetClosestPeers(ctx, "key")
+		return err == ErrClosing
+	}, 5*time.Second, 10*time.Millisecond)
+	select {
+	case <-closed:
+		t.Fatal("expected Close to wait for the request in flight")
+	default:
+	}
+
+	close(unblock)
+	require.NoError(t, <-answered)
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected Close to return once the request was answered")
+	}
+}
+
+func TestDrainerNested(t *testing.T) {
+	var d1, d2 drainer
+	ctx, done, err := d1.enter(context.Background())
+	require.NoError(t, err)
+	defer done()
+
+	d1.draining, d2.draining = true, true
+	// operations of d1 keep running their nested operations on d1...
+	_, nested, err := d1.enter(ctx)
+	require.NoError(t, err)
+	nested()
+	// ...but not on another draining DHT
+	_, _, err = d2.enter(ctx)
+	require.ErrorIs(t, err, ErrClosing)
+}
+
+// blockingGater blocks the given peers, in both directions.
+type blockingGater map[peer.ID]bool
+
+func (g blockingGater) InterceptPeerDial(p peer.ID) bool { return !g[p] }
+func (g blockingGater) InterceptAddrDial(p peer.ID, _ ma.Multiaddr) bool {
+	return !g[p]
+}
+func (g blockingGater) InterceptAccept(network.ConnMultiaddrs) bool { return true }
+func (g blockingGater) InterceptSecured(_ network.Direction, p peer.ID, _ network.ConnMultiaddrs) bool {
+	return !g[p]
+}
+func (g blockingGater) InterceptUpgraded(network.Conn) (bool, control.DisconnectReason) {
+	return true, 0
+}
+
+func TestConnectionGater(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	a := setupDHT(ctx, t, false)
+	b := setupDHT(ctx, t, false)
+	c := setupDHT(ctx, t, false)
+	blocker := setupDHT(ctx, t, false, ConnectionGater(blockingGater{a.self: true, c.self: true}))
+	for _, d := range []*IpfsDHT{a, b, c, blocker} {
+		defer d.Close()
+		defer d.host.Close()
+	}
+	connect(t, ctx, blocker, b)
+	connect(t, ctx, b, c)
+	connect(t, ctx, a, blocker)
+
+	// b refers us to c, which we mustn't dial
+	_, err := blocker.GetClosestPeers(ctx, string(c.self))
+	require.NoError(t, err)
+	require.NotEqual(t, network.Connected, blocker.host.Network().Connectedness(c.self))
+
+	// nor answer a
+	_, err = a.protoMessenger.GetClosestPeers(ctx, blocker.self, b.self)
+	require.Error(t, err)
+}
+
+func TestSkipDialBackoff(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	a := setupDHT(ctx, t, false)
+	b := setupDHT(ctx, t, false)
+	c := setupDHT(ctx, t, false)
+	for _, d := range []*IpfsDHT{a, b, c} {
+		defer d.Close()
+		defer d.host.Close()
+	}
+	connect(t, ctx, a, b)
+	connect(t, ctx, b, c)
 
-		hB, err := bhost.NewHost(ctx, swarmt.GenSwarm(t, ctx, swarmt.OptDisableReuseport), new(bhost.HostOpts))
-		require.NoError(t, err)
-		dhtB, err := New(ctx, hB, os...)
-		require.NoError(t, err)
+	// a recently failed to dial c
+	backoff := a.host.Network().(*swarm.Swarm).Backoff()
+	for _, addr := range c.host.Addrs() {
+		backoff.AddBackoff(c.self, addr)
+	}
 
-		connect(t, ctx, dhtA, dhtB)
+	qctx, events := routing.RegisterForQueryEvents(ctx)
+	dialed := make(chan peer.ID, 16)
+	go func() {
+		for e := range events {
+			if e.Type == routing.DialingPeer {
+				dialed <- e.ID
+			}
+		}
+		close(dialed)
+	}()
 
-		ctxT, cancel := context.WithTimeout(ctx, time.Second)
-		defer cancel()
-		err = dhtA.PutValue(ctxT, "/v/cat", []byte("meow"))
-		require.NoError(t, err)
+	// b refers a to c, which a skips rather than dialing it again
+	_, err := a.GetClosestPeers(qctx, string(c.self))
+	require.NoError(t, err)
+	require.True(t, a.inDialBackoff(c.self))
+	cancel()
+	for p := range dialed {
+		require.NotEqual(t, c.self, p)
+	}
+}
 
-		value, err := dhtB.GetValue(ctxT, "/v/cat")
-		require.NoError(t, err)
+func TestAddressFilters(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-		require.Equal(t, "meow", string(value))
-	})
+	server := setupDHT(ctx, t, false, ResponseAddressFilter(NoRelayAddressFilter))
+	other := setupDHT(ctx, t, false)
+	client := setupDHT(ctx, t, false)
+	publicClient := setupDHT(ctx, t, false, QueryAddressFilter(PublicAddressFilter))
+	for _, d := range []*IpfsDHT{server, other, client, publicClient} {
+		defer d.Close()
+		defer d.host.Close()
+	}
+	connect(t, ctx, server, other)
+	connect(t, ctx, client, server)
+	connect(t, ctx, publicClient, server)
 
-	t.Run("DHT routing table for peer A won't contain B if A and B don't use same protocol", func(t *testing.T) {
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-		defer cancel()
+	relayed := ma.StringCast("/ip4/1.2.3.4/tcp/4001/p2p/" + client.self.Pretty() + "/p2p-circuit")
+	server.peerstore.AddAddr(other.self, relayed, peerstore.PermanentAddrTTL)
 
-		hA, err := bhost.NewHost(ctx, swarmt.GenSwarm(t, ctx, swarmt.OptDisableReuseport), new(bhost.HostOpts))
-		require.NoError(t, err)
-		dhtA, err := New(ctx, hA, []Option{
-			ProtocolPrefix("/esh"),
-			Mode(ModeServer),
-			NamespacedValidator("v", blankValidator{}),
-			DisableAutoRefresh(),
-		}...)
+	addrsOf := func(d *IpfsDHT) []ma.Multiaddr {
+		peers, err := d.protoMessenger.GetClosestPeers(ctx, server.self, other.self)
 		require.NoError(t, err)
+		for _, p := range peers {
+			if p.ID == other.self {
+				return p.Addrs
+			}
+		}
+		t.Fatal("expected the server to return the other peer")
+		return nil
+	}
 
-		hB, err := bhost.NewHost(ctx, swarmt.GenSwarm(t, ctx, swarmt.OptDisableReuseport), new(bhost.HostOpts))
-		require.NoError(t, err)
-		dhtB, err := New(ctx, hB, []Option{
-			ProtocolPrefix("/lsr"),
-			Mode(ModeServer),
-			NamespacedValidator("v", blankValidator{}),
-			DisableAutoRefresh(),
-		}...)
-		require.NoError(t, err)
+	// the server doesn't send relayed addresses
+	addrs := addrsOf(client)
+	require.NotEmpty(t, addrs)
+	for _, a := range addrs {
+		require.False(t, a.Equal(relayed))
+	}
 
-		connectNoSync(t, ctx, dhtA, dhtB)
+	// and the public client drops the loopback ones
+	require.Empty(t, addrsOf(publicClient))
+}
 
-		// We don't expect connection notifications for A to reach B (or vice-versa), given
-		// that they've been configured with different protocols - but we'll give them a
-		// chance, anyhow.
-		time.Sleep(time.Second * 2)
+func TestAddressFamilyPreference(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-		err = dhtA.PutValue(ctx, "/v/cat", []byte("meow"))
-		if err == nil || !strings.Contains(err.Error(), "failed to find any peer in table") {
-			t.Fatalf("put should not have been able to find any peers in routing table, err:'%v'", err)
-		}
+	server := setupDHT(ctx, t, false, AddressFamilyPreference(PreferIPv6, 0))
+	other := setupDHT(ctx, t, false)
+	client := setupDHT(ctx, t, false, AddressFamilyPreference(PreferIPv6, 0))
+	for _, d := range []*IpfsDHT{server, other, client} {
+		defer d.Close()
+		defer d.host.Close()
+	}
+	connect(t, ctx, server, other)
+	connect(t, ctx, client, server)
 
-		v, err := dhtB.GetValue(ctx, "/v/cat")
-		if v != nil || err != routing.ErrNotFound {
-			t.Fatalf("get should have failed from not being able to find the value, err: '%v'", err)
+	v6 := ma.StringCast("/ip6/2001:db8::1/tcp/4001")
+	server.peerstore.AddAddr(other.self, v6, peerstore.PermanentAddrTTL)
+
+	peers, err := client.protoMessenger.GetClosestPeers(ctx, server.self, other.self)
+	require.NoError(t, err)
+	var addrs []ma.Multiaddr
+	for _, p := range peers {
+		if p.ID == other.self {
+			addrs = p.Addrs
 		}
-	})
+	}
+	// the server sends the IPv6 address first
+	require.Greater(t, len(addrs), 1)
+	require.True(t, addrs[0].Equal(v6))
+
+	// and the client withholds the IPv4 addresses of its lookup candidates
+	// until it dials them
+	p := coretest.RandPeerIDFatal(t)
+	v4 := ma.StringCast("/ip4/192.0.2.1/tcp/4001")
+	client.addCandidateAddrs(p, []ma.Multiaddr{v4, v6})
+	require.Equal(t, []ma.Multiaddr{v6}, client.peerstore.Addrs(p))
+
+	// a candidate with IPv4 addresses only gets them all
+	q := coretest.RandPeerIDFatal(t)
+	client.addCandidateAddrs(q, []ma.Multiaddr{v4})
+	require.Equal(t, []ma.Multiaddr{v4}, client.peerstore.Addrs(q))
 }
 
-func TestPing(t *testing.T) {
+func TestPrivateNetworkProfile(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
-	ds := setupDHTS(t, ctx, 2)
-	ds[0].Host().Peerstore().AddAddrs(ds[1].PeerID(), ds[1].Host().Addrs(), peerstore.AddressTTL)
-	assert.NoError(t, ds[0].Ping(context.Background(), ds[1].PeerID()))
+
+	privatePeer := peer.AddrInfo{ID: coretest.RandPeerIDFatal(t), Addrs: []ma.Multiaddr{ma.StringCast("/ip4/192.168.1.2/tcp/4001")}}
+	n := DefaultNetwork()
+	n.BootstrapPeers = append(n.BootstrapPeers, privatePeer)
+	n.Validators = map[string]record.Validator{"pk": record.PublicKeyValidator{}, "ipns": ipns.Validator{}}
+
+	d := setupDHT(ctx, t, false, Network(n), PrivateNetworkProfile(true))
+	defer d.Close()
+	defer d.host.Close()
+
+	// the protocols are only moved on request
+	require.Equal(t, []protocol.ID{"/ipfs/kad/1.0.0"}, d.protocols)
+	require.Equal(t, []peer.AddrInfo{privatePeer}, d.bootstrapPeers())
+
+	// the RFC 1918 ranges count as public, the loopback ones still don't
+	require.True(t, PublicQueryFilter(d, privatePeer))
+	require.False(t, PublicQueryFilter(nil, privatePeer))
+	require.True(t, PublicAddressFilter(d, ma.StringCast("/ip6/fd00::1/tcp/4001")))
+	require.False(t, PublicAddressFilter(d, ma.StringCast("/ip4/127.0.0.1/tcp/4001")))
+
+	moved := setupDHT(ctx, t, false, Network(n), PrivateNetworkProfile(true), PrivateNetworkProtocols())
+	defer moved.Close()
+	defer moved.host.Close()
+	require.Equal(t, []protocol.ID{"/pnet/kad/1.0.0"}, moved.protocols)
+
+	// the profile is only enabled on request
+	public := setupDHT(ctx, t, false, Network(n), PrivateNetworkProtocols())
+	defer public.Close()
+	defer public.host.Close()
+	require.Equal(t, []protocol.ID{"/ipfs/kad/1.0.0"}, public.protocols)
+	require.False(t, PublicQueryFilter(public, privatePeer))
+
+	// protocols of other applications are left alone
+	other := setupDHT(ctx, t, false, PrivateNetworkProfile(true), PrivateNetworkProtocols())
+	defer other.Close()
+	defer other.host.Close()
+	require.Equal(t, []protocol.ID{"/test/kad/1.0.0"}, other.protocols)
 }
 
-func TestClientModeAtInit(t *testing.T) {
+func TestStrictValidation(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
-	pinger := setupDHT(ctx, t, false)
-	client := setupDHT(ctx, t, true)
-	pinger.Host().Peerstore().AddAddrs(client.PeerID(), client.Host().Addrs(), peerstore.AddressTTL)
-	err := pinger.Ping(context.Background(), client.PeerID())
-	assert.True(t, errors.Is(err, multistream.ErrNotSupported))
+
+	dhtA := setupDHT(ctx, t, false, StrictValidation())
+	dhtB := setupDHT(ctx, t, false, StrictValidation())
+	for _, d := range []*IpfsDHT{dhtA, dhtB} {
+		defer d.Close()
+		defer d.host.Close()
+	}
+	connect(t, ctx, dhtA, dhtB)
+
+	ctxT, cancelT := context.WithTimeout(ctx, 5*time.Second)
+	defer cancelT()
+
+	// well formed requests get through
+	require.NoError(t, dhtA.PutValue(ctxT, "/v/hello", []byte("world")))
+	val, err := dhtB.GetValue(ctxT, "/v/hello")
+	require.NoError(t, err)
+	require.Equal(t, []byte("world"), val)
+	c := testCaseCids[0]
+	require.NoError(t, dhtA.Provide(ctxT, c, true))
+	provs, err := dhtB.FindProviders(ctxT, c)
+	require.NoError(t, err)
+	require.Len(t, provs, 1)
+	_, err = dhtA.protoMessenger.GetClosestPeers(ctxT, dhtB.self, dhtA.self)
+	require.NoError(t, err)
+
+	// malformed ones reset the stream
+	for _, req := range []*pb.Message{
+		{Type: pb.Message_FIND_NODE, Key: []byte("key"), Record: record.MakePutRecord("key", []byte("value"))},
+		{Type: pb.Message_ADD_PROVIDER, Key: c.Hash(), ProviderPeers: []pb.Message_Peer{{Addrs: [][]byte{[]byte("not a multiaddr")}}}},
+		{Type: pb.Message_GET_VALUE, Key: bytes.Repeat([]byte("k"), pb.MaxRequestKeySize+1)},
+	} {
+		s, err := dhtA.host.NewStream(ctx, dhtB.self, dhtB.protocols...)
+		require.NoError(t, err)
+		require.NoError(t, net.WriteMsg(s, req))
+		_, err = s.Read(make([]byte, 1))
+		require.Error(t, err)
+		_ = s.Close()
+	}
 }
 
-func TestModeChange(t *testing.T) {
+func TestObservedAddrFeedback(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	clientOnly := setupDHT(ctx, t, true)
-	clientToServer := setupDHT(ctx, t, true)
-	clientOnly.Host().Peerstore().AddAddrs(clientToServer.PeerID(), clientToServer.Host().Addrs(), peerstore.AddressTTL)
-	err := clientOnly.Ping(ctx, clientToServer.PeerID())
-	assert.True(t, errors.Is(err, multistream.ErrNotSupported))
-	err = clientToServer.setMode(modeServer)
-	assert.Nil(t, err)
-	err = clientOnly.Ping(ctx, clientToServer.PeerID())
-	assert.Nil(t, err)
-	err = clientToServer.setMode(modeClient)
-	assert.Nil(t, err)
-	err = clientOnly.Ping(ctx, clientToServer.PeerID())
-	assert.NotNil(t, err)
+	observed := make(chan ma.Multiaddr, 10)
+	server := setupDHT(ctx, t, false, ObservedAddrFeedback())
+	client := setupDHT(ctx, t, false, ObservedAddrHandler(func(observer peer.ID, a ma.Multiaddr) {
+		require.Equal(t, server.self, observer)
+		observed <- a
+	}))
+	other := setupDHT(ctx, t, false)
+	for _, d := range []*IpfsDHT{server, client, other} {
+		defer d.Close()
+		defer d.host.Close()
+	}
+	connect(t, ctx, client, server)
+	connect(t, ctx, other, server)
+
+	// the server tells the client the address of its connection
+	_, err := client.protoMessenger.GetClosestPeers(ctx, server.self, other.self)
+	require.NoError(t, err)
+	conns := server.host.Network().ConnsToPeer(client.self)
+	require.NotEmpty(t, conns)
+	require.Len(t, observed, 1)
+	require.True(t, conns[0].RemoteMultiaddr().Equal(<-observed))
+
+	// but not the peers not asking for it
+	resp, err := other.msgSender.SendRequest(ctx, server.self, pb.NewMessage(pb.Message_FIND_NODE, []byte(client.self), 0))
+	require.NoError(t, err)
+	require.Empty(t, resp.GetObservedAddr())
 }
 
-func TestDynamicModeSwitching(t *testing.T) {
+func TestProviderRecordExtensions(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	prober := setupDHT(ctx, t, true)               // our test harness
-	node := setupDHT(ctx, t, true, Mode(ModeAuto)) // the node under test
-	prober.Host().Peerstore().AddAddrs(node.PeerID(), node.Host().Addrs(), peerstore.AddressTTL)
-	if _, err := prober.Host().Network().DialPeer(ctx, node.PeerID()); err != nil {
-		t.Fatal(err)
-	}
+	const field = pb.MinExtensionField + 2
+	require.NoError(t, pb.RegisterExtension(field, t.Name()))
 
-	emitter, err := node.host.EventBus().Emitter(new(event.EvtLocalReachabilityChanged))
-	if err != nil {
-		t.Fatal(err)
+	server := setupDHT(ctx, t, false)
+	provider := setupDHT(ctx, t, false)
+	client := setupDHT(ctx, t, false)
+	for _, d := range []*IpfsDHT{server, provider, client} {
+		defer d.Close()
+		defer d.host.Close()
 	}
+	connect(t, ctx, provider, server)
+	connect(t, ctx, client, server)
 
-	assertDHTClient := func() {
-		err = prober.Ping(ctx, node.PeerID())
-		assert.True(t, errors.Is(err, multistream.ErrNotSupported))
-		if l := len(prober.RoutingTable().ListPeers()); l != 0 {
-			t.Errorf("expected routing table length to be 0; instead is %d", l)
-		}
-	}
+	// the server keeps the fields of the records it doesn't know of
+	key := testCaseCids[0].Hash()
+	pmes := pb.NewMessage(pb.Message_ADD_PROVIDER, key, 0)
+	pmes.ProviderPeers = pb.RawPeerInfosToPBPeers([]peer.AddrInfo{{ID: provider.self, Addrs: provider.host.Addrs()}})
+	require.NoError(t, pmes.ProviderPeers[0].SetExtension(field, []byte("experimental")))
+	require.NoError(t, provider.msgSender.SendMessage(ctx, server.self, pmes))
 
-	assertDHTServer := func() {
-		err = prober.Ping(ctx, node.PeerID())
-		assert.Nil(t, err)
-		// the node should be in the RT for the prober
-		// because the prober will call fixLowPeers when the node updates it's protocols
-		if l := len(prober.RoutingTable().ListPeers()); l != 1 {
-			t.Errorf("expected routing table length to be 1; instead is %d", l)
-		}
+	var recs []*pb.ProviderRecord
+	require.Eventually(t, func() bool {
+		var err error
+		recs, _, err = client.protoMessenger.GetProviderRecords(ctx, server.self, key)
+		return err == nil && len(recs) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	v, ok := pb.ReadExtension(recs[0].Extensions, field)
+	require.True(t, ok)
+	require.Equal(t, []byte("experimental"), v)
+}
+
+// xorCipher is a RecordCipher for tests, in no way secure.
+type xorCipher struct{}
+
+func (xorCipher) Seal(_ ds.Key, plaintext []byte) ([]byte, error) {
+	sealed := []byte("sealed:")
+	for _, b := range plaintext {
+		sealed = append(sealed, b^0x5a)
 	}
+	return sealed, nil
+}
 
-	err = emitter.Emit(event.EvtLocalReachabilityChanged{Reachability: network.ReachabilityPrivate})
-	if err != nil {
-		t.Fatal(err)
+func (xorCipher) Open(_ ds.Key, ciphertext []byte) ([]byte, error) {
+	if !bytes.HasPrefix(ciphertext, []byte("sealed:")) {
+		return nil, errors.New("not sealed")
 	}
-	time.Sleep(500 * time.Millisecond)
+	plaintext := make([]byte, 0, len(ciphertext)-len("sealed:"))
+	for _, b := range ciphertext[len("sealed:"):] {
+		plaintext = append(plaintext, b^0x5a)
+	}
+	return plaintext, nil
+}
 
-	assertDHTClient()
+func TestRecordEncryption(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-	err = emitter.Emit(event.EvtLocalReachabilityChanged{Reachability: network.ReachabilityPublic})
-	if err != nil {
-		t.Fatal(err)
-	}
-	time.Sleep(500 * time.Millisecond)
+	dstore := dssync.MutexWrap(ds.NewMapDatastore())
+	d := setupDHT(ctx, t, false, Datastore(dstore), RecordEncryption(xorCipher{}))
+	defer d.Close()
+	defer d.host.Close()
 
-	assertDHTServer()
+	rec := record.MakePutRecord("/v/hello", []byte("plaintext value"))
+	require.NoError(t, d.putLocal(ctx, "/v/hello", rec))
+	key := testCaseCids[0].Hash()
+	prov := peer.AddrInfo{ID: coretest.RandPeerIDFatal(t), Addrs: []ma.Multiaddr{ma.StringCast("/ip4/1.2.3.4/tcp/4001")}}
+	require.NoError(t, d.providerStore.AddProvider(ctx, key, prov))
 
-	err = emitter.Emit(event.EvtLocalReachabilityChanged{Reachability: network.ReachabilityUnknown})
-	if err != nil {
-		t.Fatal(err)
+	// the records read back decrypted
+	got, err := d.getLocal(ctx, "/v/hello")
+	require.NoError(t, err)
+	require.Equal(t, rec.Value, got.Value)
+	provs, err := d.providerStore.GetProviders(ctx, key)
+	require.NoError(t, err)
+	require.Len(t, provs, 1)
+	require.Equal(t, prov.ID, provs[0].ID)
+
+	// and are stored encrypted
+	res, err := dstore.Query(ctx, dsq.Query{})
+	require.NoError(t, err)
+	entries, err := res.Rest()
+	require.NoError(t, err)
+	require.NotEmpty(t, entries)
+	for _, e := range entries {
+		require.True(t, bytes.HasPrefix(e.Value, []byte("sealed:")), "%s isn't encrypted", e.Key)
+		require.False(t, bytes.Contains(e.Value, rec.Value), "%s isn't encrypted", e.Key)
 	}
-	time.Sleep(500 * time.Millisecond)
 
-	assertDHTClient()
+	// including through queries
+	stored, err := d.datastore.Get(ctx, mkDsKey("/v/hello"))
+	require.NoError(t, err)
+	res, err = d.datastore.Query(ctx, dsq.Query{Filters: []dsq.Filter{dsq.FilterValueCompare{Op: dsq.Equal, Value: stored}}})
+	require.NoError(t, err)
+	entries, err = res.Rest()
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.Equal(t, mkDsKey("/v/hello").String(), entries[0].Key)
 }
 
-func TestInvalidKeys(t *testing.T) {
+func TestLookupLogs(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	nDHTs := 2
-	dhts := setupDHTS(t, ctx, nDHTs)
-	defer func() {
-		for i := 0; i < nDHTs; i++ {
-			dhts[i].Close()
-			defer dhts[i].host.Close()
-		}
-	}()
+	core, logs := observer.New(zap.InfoLevel)
+	sugared := lookupLogger.SugaredLogger
+	lookupLogger.SugaredLogger = *zap.New(core).Sugar()
+	defer func() { lookupLogger.SugaredLogger = sugared }()
 
-	t.Logf("connecting %d dhts in a ring", nDHTs)
-	for i := 0; i < nDHTs; i++ {
-		connect(t, ctx, dhts[i], dhts[(i+1)%len(dhts)])
+	client := setupDHT(ctx, t, false, LookupLogs())
+	near := setupDHT(ctx, t, false)
+	far := setupDHT(ctx, t, false)
+	for _, d := range []*IpfsDHT{client, near, far} {
+		defer d.Close()
+		defer d.host.Close()
 	}
+	connect(t, ctx, client, near)
+	connect(t, ctx, near, far)
 
-	querier := dhts[0]
-	_, err := querier.GetClosestPeers(ctx, "")
-	if err == nil {
-		t.Fatal("get closest peers should have failed")
-	}
+	peers, err := client.GetClosestPeers(ctx, "foo")
+	require.NoError(t, err)
+	require.Len(t, peers, 2)
+
+	entries := logs.FilterMessage("lookup").All()
+	require.Len(t, entries, 1)
+	fields := entries[0].ContextMap()
+	require.Equal(t, hex.EncodeToString(kb.ConvertKey("foo")[:keyPrefixSize]), fields["key"])
+	require.EqualValues(t, 2, fields["hops"])
+	require.EqualValues(t, 2, fields["contacted"])
+	require.EqualValues(t, 0, fields["timeouts"])
+	require.EqualValues(t, 0, fields["unreachable"])
+	require.EqualValues(t, 2, fields["results"])
+	// too few peers to fill the beta closest
+	require.Equal(t, LookupStarvation.String(), fields["reason"])
+	require.Contains(t, fields, "duration_ms")
+
+	// the lookups of the peers not asking for it aren't logged
+	_, err = near.GetClosestPeers(ctx, "foo")
+	require.NoError(t, err)
+	require.Len(t, logs.FilterMessage("lookup").All(), 1)
+}
 
-	_, err = querier.FindProviders(ctx, cid.Cid{})
-	switch err {
-	case routing.ErrNotFound, routing.ErrNotSupported, kb.ErrLookupFailure:
-		t.Fatal("failed with the wrong error: ", err)
-	case nil:
-		t.Fatal("find providers should have failed")
-	}
+func TestDebugHandler(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-	_, err = querier.FindPeer(ctx, peer.ID(""))
-	if err != peer.ErrEmptyPeerID {
-		t.Fatal("expected to fail due to the empty peer ID")
+	d := setupDHT(ctx, t, false)
+	near := setupDHT(ctx, t, false)
+	far := setupDHT(ctx, t, false)
+	for _, d := range []*IpfsDHT{d, near, far} {
+		defer d.Close()
+		defer d.host.Close()
 	}
+	connect(t, ctx, d, near)
+	connect(t, ctx, near, far)
 
-	_, err = querier.GetValue(ctx, "")
-	if err == nil {
-		t.Fatal("expected to have failed")
-	}
+	srv := httptest.NewServer(d.DebugHandler())
+	defer srv.Close()
 
-	err = querier.PutValue(ctx, "", []byte("foobar"))
-	if err == nil {
-		t.Fatal("expected to have failed")
+	resp, err := http.Get(srv.URL + "/routing-table")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	var rt debugRoutingTable
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&rt))
+	require.Equal(t, d.self, rt.Self)
+	require.Equal(t, 1, rt.Size)
+	require.Equal(t, near.self, rt.Peers[0].ID)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/events", nil)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = d.GetClosestPeers(ctx, "foo")
+	require.NoError(t, err)
+
+	// the lookup events come first, then the summary
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	var lookups int
+	for {
+		var ev DebugEvent
+		require.NoError(t, conn.ReadJSON(&ev))
+		if ev.Summary == nil {
+			require.NotNil(t, ev.Lookup)
+			lookups++
+			continue
+		}
+		require.NotZero(t, lookups)
+		require.Equal(t, 2, ev.Summary.Contacted)
+		require.Equal(t, 2, ev.Summary.Results)
+		break
 	}
 }
 
-func TestV1ProtocolOverride(t *testing.T) {
+func TestIntrospect(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	d1 := setupDHT(ctx, t, false, V1ProtocolOverride("/myproto"))
-	d2 := setupDHT(ctx, t, false, V1ProtocolOverride("/myproto"))
-	d3 := setupDHT(ctx, t, false, V1ProtocolOverride("/myproto2"))
-	d4 := setupDHT(ctx, t, false)
-
-	dhts := []*IpfsDHT{d1, d2, d3, d4}
-
-	for i, dout := range dhts {
-		for _, din := range dhts[i+1:] {
-			connectNoSync(t, ctx, dout, din)
+	d := setupDHT(ctx, t, false)
+	near := setupDHT(ctx, t, false)
+	for _, d := range []*IpfsDHT{d, near} {
+		defer d.Close()
+		defer d.host.Close()
+	}
+	connect(t, ctx, d, near)
+
+	key := hex.EncodeToString(kb.ConvertKey("foo")[:keyPrefixSize])
+	findLookup := func() *pb.Introspection_Lookup {
+		for _, l := range d.Introspect().Lookups {
+			if l.Operation == opGetValue && l.Key == key {
+				return l
+			}
 		}
+		return nil
 	}
 
-	wait(t, ctx, d1, d2)
-	wait(t, ctx, d2, d1)
+	// the lookup waits on near until released
+	release := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		_, err := d.runLookupWithFollowup(ctx, opGetValue, "foo",
+			func(ctx context.Context, p peer.ID) ([]*peer.AddrInfo, error) {
+				<-release
+				return nil, nil
+			},
+			func() bool { return false },
+		)
+		done <- err
+	}()
 
-	time.Sleep(time.Second)
+	require.Eventually(t, func() bool {
+		l := findLookup()
+		return l != nil && l.Waiting == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	close(release)
+	require.NoError(t, <-done)
+	require.Nil(t, findLookup())
+
+	srv := httptest.NewServer(d.DebugHandler())
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "/introspection")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	var snapshot pb.Introspection
+	require.NoError(t, snapshot.Unmarshal(b))
+
+	require.Equal(t, []byte(d.self), snapshot.Self)
+	require.Len(t, snapshot.RoutingTable, 1)
+	require.Equal(t, []byte(near.self), snapshot.RoutingTable[0].Id)
+	require.NotZero(t, snapshot.RoutingTable[0].AddedAt)
+	var ops []string
+	for _, o := range snapshot.RecentOperations {
+		require.NotZero(t, o.Duration)
+		ops = append(ops, o.Operation)
+	}
+	require.Contains(t, ops, opGetValue)
+}
 
-	if d1.RoutingTable().Size() != 1 || d2.routingTable.Size() != 1 {
-		t.Fatal("should have one peer in the routing table")
-	}
+func TestPeerStats(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-	if d3.RoutingTable().Size() > 0 || d4.RoutingTable().Size() > 0 {
-		t.Fatal("should have an empty routing table")
-	}
+	d := setupDHT(ctx, t, false)
+	near := setupDHT(ctx, t, false)
+	defer d.Close()
+	defer d.host.Close()
+	connect(t, ctx, d, near)
+
+	require.Zero(t, d.PeerStats(near.self).Requests)
+
+	_, err := d.protoMessenger.GetClosestPeers(ctx, near.self, d.self)
+	require.NoError(t, err)
+	stats := d.PeerStats(near.self)
+	require.Equal(t, 1, stats.Requests)
+	require.Equal(t, 1.0, stats.SuccessRate)
+	require.NotZero(t, stats.RTT)
+	require.NotZero(t, stats.TimeToFirstByte)
+	require.NoError(t, stats.LastError)
+
+	// the requests we give up on aren't held against the peer
+	canceled, cancelRequest := context.WithCancel(ctx)
+	cancelRequest()
+	_, err = d.protoMessenger.GetClosestPeers(canceled, near.self, d.self)
+	require.Error(t, err)
+	require.Equal(t, 1, d.PeerStats(near.self).Requests)
+
+	near.Close()
+	near.host.Close()
+	_, err = d.protoMessenger.GetClosestPeers(ctx, near.self, d.self)
+	require.Error(t, err)
+	stats = d.PeerStats(near.self)
+	require.Equal(t, 2, stats.Requests)
+	require.InDelta(t, 1-peerStatsAlpha, stats.SuccessRate, 1e-9)
+	require.Error(t, stats.LastError)
+	require.False(t, stats.LastErrorAt.IsZero())
 }
 
-func TestRoutingFilter(t *testing.T) {
+func TestLifecycleEvents(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	nDHTs := 2
-	dhts := setupDHTS(t, ctx, nDHTs)
+	dhts := setupDHTS(t, ctx, minRTRefreshThreshold+2)
 	defer func() {
-		for i := 0; i < nDHTs; i++ {
-			dhts[i].Close()
-			defer dhts[i].host.Close()
+		for _, d := range dhts {
+			d.Close()
+			d.host.Close()
 		}
 	}()
-	dhts[0].routingTablePeerFilter = PublicRoutingTableFilter
-
-	connectNoSync(t, ctx, dhts[0], dhts[1])
-	wait(t, ctx, dhts[1], dhts[0])
+	d := dhts[0]
 
-	select {
-	case <-ctx.Done():
-		t.Fatal(ctx.Err())
-	case <-time.After(time.Millisecond * 200):
+	sub, err := d.host.EventBus().Subscribe([]interface{}{
+		new(EvtBootstrapped),
+		new(EvtRoutingTableHealthChanged),
+		new(EvtModeChanged),
+		new(EvtLookupFailed),
+	})
+	require.NoError(t, err)
+	defer sub.Close()
+	next := func() interface{} {
+		t.Helper()
+		select {
+		case ev := <-sub.Out():
+			return ev
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for a lifecycle event")
+			return nil
+		}
 	}
+
+	// nobody to ask
+	_, err = d.GetClosestPeers(ctx, "foo")
+	require.Error(t, err)
+	require.Equal(t, EvtLookupFailed{
+		Protocol:  d.protocols[0],
+		Operation: opGetClosestPeers,
+		Key:       lookupKeyPrefix("foo"),
+		Err:       kb.ErrLookupFailure,
+	}, next())
+
+	require.NoError(t, d.SetMode(ModeClient))
+	require.Equal(t, EvtModeChanged{Protocol: d.protocols[0], Mode: ModeClient}, next())
+	require.NoError(t, d.SetMode(ModeServer))
+	require.Equal(t, EvtModeChanged{Protocol: d.protocols[0], Mode: ModeServer}, next())
+
+	connect(t, ctx, d, dhts[1])
+	require.NoError(t, <-d.RefreshRoutingTable())
+	ev := next()
+	require.IsType(t, EvtBootstrapped{}, ev)
+	require.Equal(t, d.protocols[0], ev.(EvtBootstrapped).Protocol)
+
+	for _, peer := range dhts[2:] {
+		connect(t, ctx, d, peer)
+	}
+	require.Equal(t, EvtRoutingTableHealthChanged{
+		Protocol:         d.protocols[0],
+		Healthy:          true,
+		RoutingTableSize: minRTRefreshThreshold + 1,
+	}, next())
 }
 
-func TestBootStrapWhenRTIsEmpty(t *testing.T) {
-	if detectrace.WithRace() {
-		t.Skip("skipping timing dependent test when race detector is running")
-	}
+func TestLifecycleEventsDropped(t *testing.T) {
+	d := &IpfsDHT{lifecycle: &lifecycleEvents{events: make(chan interface{}, 1)}}
+
+	// publishing never blocks, even with nobody emitting the events
+	d.publishLifecycleEvent(EvtModeChanged{Mode: ModeClient})
+	d.publishLifecycleEvent(EvtModeChanged{Mode: ModeServer})
+	require.EqualValues(t, 1, atomic.LoadInt64(&d.lifecycle.dropped))
+	require.Equal(t, EvtModeChanged{Mode: ModeClient}, <-d.lifecycle.events)
+}
+
+func TestLookupExperiment(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	// create three boostrap peers each of which is connected to 1 other peer.
-	nBootStraps := 3
-	bootstrappers := setupDHTS(t, ctx, nBootStraps)
-	defer func() {
-		for i := 0; i < nBootStraps; i++ {
-			bootstrappers[i].Close()
-			defer bootstrappers[i].host.Close()
+	core, logs := observer.New(zap.InfoLevel)
+	sugared := lookupLogger.SugaredLogger
+	lookupLogger.SugaredLogger = *zap.New(core).Sugar()
+	defer func() { lookupLogger.SugaredLogger = sugared }()
+
+	client := setupDHT(ctx, t, false, LookupLatencyWeight(0.5), LookupExperiment(1, 1))
+	near := setupDHT(ctx, t, false)
+	far := setupDHT(ctx, t, false)
+	for _, d := range []*IpfsDHT{client, near, far} {
+		defer d.Close()
+		defer d.host.Close()
+	}
+	connect(t, ctx, client, near)
+	connect(t, ctx, near, far)
+
+	_, err := client.GetClosestPeers(ctx, "foo")
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		return logs.FilterMessage("lookup experiment").Len() == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	fields := logs.FilterMessage("lookup experiment").All()[0].ContextMap()
+	// both contact the only two peers there are
+	require.EqualValues(t, 0, fields["divergence"])
+	require.EqualValues(t, 0.5, fields["primary_weight"])
+	require.EqualValues(t, 1, fields["shadow_weight"])
+	require.EqualValues(t, 2, fields["primary_contacted"])
+	require.EqualValues(t, 2, fields["shadow_contacted"])
+	require.EqualValues(t, 2, fields["shadow_hops"])
+
+	require.Equal(t, 0.5, divergence([]peer.ID{"a", "b", "c"}, []peer.ID{"b", "c", "d"}))
+	require.Equal(t, 1.0, divergence([]peer.ID{"a"}, nil))
+}
+
+func TestNetworkSize(t *testing.T) {
+	// the estimate of a uniformly distributed network
+	network := make([]peer.ID, 2000)
+	for i := range network {
+		network[i] = coretest.RandPeerIDFatal(t)
+	}
+	e := newNetSizeEstimator()
+	for i := 0; i < netSizeSamples; i++ {
+		target := strconv.Itoa(i)
+		if i < netSizeMinSamples {
+			_, err := e.estimate()
+			require.Equal(t, ErrNotEnoughData, err)
 		}
-	}()
+		e.track(target, kb.SortClosestPeers(network, kb.ConvertKey(target))[:20])
+	}
+	n, err := e.estimate()
+	require.NoError(t, err)
+	require.InEpsilon(t, len(network), n, 0.2)
 
-	bootstrapcons := setupDHTS(t, ctx, nBootStraps)
+	// the refreshes are bounded by the size of the network
+	require.EqualValues(t, 1, refreshMaxCpl(15, 20))
+	require.EqualValues(t, 7, refreshMaxCpl(2000, 20))
+
+	// the DHT estimates the size of its network from its lookups
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	dhts := setupDHTS(t, ctx, 10)
 	defer func() {
-		for i := 0; i < nBootStraps; i++ {
-			bootstrapcons[i].Close()
-			defer bootstrapcons[i].host.Close()
+		for _, d := range dhts {
+			d.Close()
+			d.host.Close()
 		}
 	}()
-	for i := 0; i < nBootStraps; i++ {
-		connect(t, ctx, bootstrappers[i], bootstrapcons[i])
+	for i := 1; i < len(dhts); i++ {
+		connect(t, ctx, dhts[i-1], dhts[i])
 	}
-
-	// convert the bootstrap addresses to a p2p address
-	bootstrapAddrs := make([]peer.AddrInfo, nBootStraps)
-	for i := 0; i < nBootStraps; i++ {
-		b := peer.AddrInfo{ID: bootstrappers[i].self,
-			Addrs: bootstrappers[i].host.Addrs()}
-		bootstrapAddrs[i] = b
+	for i := 0; i < netSizeMinSamples; i++ {
+		_, err := dhts[0].GetClosestPeers(ctx, strconv.Itoa(i))
+		require.NoError(t, err)
 	}
+	n, err = dhts[0].NetworkSize()
+	require.NoError(t, err)
+	require.Greater(t, n, 1)
+}
 
-	{
-
-		//----------------
-		// We will initialize a DHT with 1 bootstrapper, connect it to another DHT,
-		// then remove the latter from the Routing Table
-		// This should add the bootstrap peer and the peer that the bootstrap peer is conencted to
-		// to it's Routing Table.
-		// AutoRefresh needs to be enabled for this.
+func TestQueryPeersetMetrics(t *testing.T) {
+	views := []*view.View{metrics.LiveQueryPeersetsView, metrics.LiveQueryPeersetEntriesView, metrics.LookupPeersetEntriesView}
+	require.NoError(t, view.Register(views...))
+	defer view.Unregister(views...)
 
-		h1, err := bhost.NewHost(ctx, swarmt.GenSwarm(t, ctx, swarmt.OptDisableReuseport), new(bhost.HostOpts))
-		require.NoError(t, err)
-		dht1, err := New(
-			ctx,
-			h1,
-			testPrefix,
-			NamespacedValidator("v", blankValidator{}),
-			Mode(ModeServer),
-			BootstrapPeers(bootstrapAddrs[0]),
-		)
-		require.NoError(t, err)
-		dht2 := setupDHT(ctx, t, false)
-		defer func() {
-			dht1.host.Close()
-			dht2.host.Close()
-			dht1.Close()
-			dht2.Close()
-		}()
-		connect(t, ctx, dht1, dht2)
-		require.NoError(t, dht2.Close())
-		require.NoError(t, dht2.host.Close())
-		require.NoError(t, dht1.host.Network().ClosePeer(dht2.self))
-		dht1.routingTable.RemovePeer(dht2.self)
-		require.NotContains(t, dht2.self, dht1.routingTable.ListPeers())
-		require.Eventually(t, func() bool {
-			return dht1.routingTable.Size() == 2 && dht1.routingTable.Find(bootstrappers[0].self) != "" &&
-				dht1.routingTable.Find(bootstrapcons[0].self) != ""
-		}, 5*time.Second, 500*time.Millisecond)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
+	client := setupDHT(ctx, t, false)
+	near := setupDHT(ctx, t, false)
+	far := setupDHT(ctx, t, false)
+	for _, d := range []*IpfsDHT{client, near, far} {
+		defer d.Close()
+		defer d.host.Close()
 	}
+	connect(t, ctx, client, near)
+	connect(t, ctx, near, far)
 
-	{
+	_, err := client.GetClosestPeers(ctx, "foo")
+	require.NoError(t, err)
 
-		//----------------
-		// We will initialize a DHT with 2 bootstrappers, connect it to another DHT,
-		// then remove the DHT handler from the other DHT which should make the first DHT's
-		// routing table empty.
-		// This should add the bootstrap peers and the peer thats the bootstrap peers are connected to
-		// to it's Routing Table.
-		// AutoRefresh needs to be enabled for this.
-		h1, err := bhost.NewHost(ctx, swarmt.GenSwarm(t, ctx, swarmt.OptDisableReuseport), new(bhost.HostOpts))
-		require.NoError(t, err)
-		dht1, err := New(
-			ctx,
-			h1,
-			testPrefix,
-			NamespacedValidator("v", blankValidator{}),
-			Mode(ModeServer),
-			BootstrapPeers(bootstrapAddrs[1], bootstrapAddrs[2]),
-		)
+	// the rows of the client, of the lookup if by operation
+	row := func(v *view.View, op string) view.AggregationData {
+		rows, err := view.RetrieveData(v.Name)
 		require.NoError(t, err)
+		for _, row := range rows {
+			var self, match bool
+			for _, tg := range row.Tags {
+				switch tg.Key {
+				case metrics.KeyPeerID:
+					self = tg.Value == client.self.Pretty()
+				case metrics.KeyOperation:
+					match = tg.Value == op
+				}
+			}
+			if self && (op == "" || match) {
+				return row.Data
+			}
+		}
+		return nil
+	}
+	entries := row(metrics.LookupPeersetEntriesView, opGetClosestPeers).(*view.DistributionData)
+	require.EqualValues(t, 1, entries.Count)
+	// near and far
+	require.EqualValues(t, 2, entries.Max)
 
-		dht2 := setupDHT(ctx, t, false)
-		connect(t, ctx, dht1, dht2)
-		defer func() {
-			dht1.host.Close()
-			dht2.host.Close()
-			dht1.Close()
-			dht2.Close()
-		}()
-		connect(t, ctx, dht1, dht2)
-		require.NoError(t, dht2.setMode(modeClient))
+	// nothing is left live once the lookups, e.g. the refreshes, are done
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt64(&client.peersets.peersets) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Zero(t, atomic.LoadInt64(&client.peersets.entries))
+	require.NotNil(t, row(metrics.LiveQueryPeersetsView, ""))
+	require.NotNil(t, row(metrics.LiveQueryPeersetEntriesView, ""))
+}
 
-		require.Eventually(t, func() bool {
-			rt := dht1.routingTable
+func TestKeyspaceCoverage(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-			return rt.Size() == 4 && rt.Find(bootstrappers[1].self) != "" &&
-				rt.Find(bootstrappers[2].self) != "" && rt.Find(bootstrapcons[1].self) != "" && rt.Find(bootstrapcons[2].self) != ""
-		}, 5*time.Second, 500*time.Millisecond)
+	d := setupDHT(ctx, t, false)
+	defer d.Close()
+	defer d.host.Close()
+
+	add := func(cpl int, n int) {
+		for i := 0; i < n; i++ {
+			p := coretest.RandPeerIDFatal(t)
+			for kb.CommonPrefixLen(d.selfKey, kb.ConvertPeerID(p)) != cpl {
+				p = coretest.RandPeerIDFatal(t)
+			}
+			added, err := d.routingTable.TryAddPeer(p, true, false)
+			require.NoError(t, err)
+			require.True(t, added)
+		}
 	}
+	add(0, 2)
+	add(12, 10)
+
+	// each bucket is expected to be full until the size of the network is known
+	coverage := d.KeyspaceCoverage()
+	require.Len(t, coverage, 13)
+	for _, c := range coverage {
+		require.EqualValues(t, d.bucketSize, c.Expected)
+		require.True(t, c.Sparse)
+		require.False(t, c.Overfull)
+	}
+	require.Equal(t, 2, coverage[0].Peers)
+	require.Equal(t, 10, coverage[12].Peers)
+
+	// in a network of 1000 peers, we only expect the peers of the first
+	// buckets
+	d.netSize.mu.Lock()
+	for i := 0; i < netSizeMinSamples; i++ {
+		d.netSize.samples = append(d.netSize.samples, netSizeSample{num: 1000, den: 1})
+	}
+	d.netSize.mu.Unlock()
+	coverage = d.KeyspaceCoverage()
+	require.Len(t, coverage, 13)
+	require.EqualValues(t, d.bucketSize, coverage[0].Expected)
+	require.True(t, coverage[0].Sparse)
+	require.InDelta(t, 999.0/64, coverage[5].Expected, 1e-9)
+	require.Less(t, coverage[12].Expected, 1.0)
+	require.True(t, coverage[12].Overfull)
+	require.False(t, coverage[5].Overfull)
+
+	srv := httptest.NewServer(d.DebugHandler())
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "/coverage")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(body)), "\n")
+	require.Len(t, lines, 14)
+	require.True(t, strings.HasSuffix(lines[1], "## sparse"), lines[1])
+	require.True(t, strings.HasSuffix(lines[13], " overfull"), lines[13])
 }
 
-func TestBootstrapPeersFunc(t *testing.T) {
+func TestLookupProgress(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
-	var lock sync.Mutex
 
-	bootstrapFuncA := func() []peer.AddrInfo {
-		return []peer.AddrInfo{}
+	client := setupDHT(ctx, t, false)
+	near := setupDHT(ctx, t, false)
+	far := setupDHT(ctx, t, false)
+	for _, d := range []*IpfsDHT{client, near, far} {
+		defer d.Close()
+		defer d.host.Close()
 	}
-	dhtA := setupDHT(ctx, t, false, BootstrapPeersFunc(bootstrapFuncA))
+	connect(t, ctx, client, near)
+	connect(t, ctx, near, far)
 
-	bootstrapPeersB := []peer.AddrInfo{}
-	bootstrapFuncB := func() []peer.AddrInfo {
-		lock.Lock()
-		defer lock.Unlock()
-		return bootstrapPeersB
+	progressCtx, stop := context.WithCancel(ctx)
+	progressCtx, progress := RegisterForLookupProgress(progressCtx)
+	_, err := client.FindPeer(progressCtx, far.self)
+	require.NoError(t, err)
+
+	// the last update is the final state of the lookup
+	var last LookupProgress
+	select {
+	case last = <-progress:
+	default:
+		t.Fatal("no lookup progress")
+	}
+	require.NotEqual(t, uuid.UUID{}, last.ID)
+	require.Equal(t, lookupKeyPrefix(string(far.self)), last.Key)
+	require.GreaterOrEqual(t, last.Queried, 1)
+	require.Contains(t, []peer.ID{near.self, far.self}, last.Closest)
+	require.Equal(t, kb.CommonPrefixLen(kb.ConvertPeerID(far.self), kb.ConvertPeerID(last.Closest)), last.ClosestCpl)
+	require.Zero(t, last.Failed)
+
+	stop()
+	_, ok := <-progress
+	require.False(t, ok)
+}
+
+func TestLatencyAnomalies(t *testing.T) {
+	var anomalies []LatencyAnomaly
+	d := newLatencyAnomalies(0, func(a LatencyAnomaly) {
+		anomalies = append(anomalies, a)
+	})
+	rng := rand.New(rand.NewSource(1))
+	lookup := func(latency time.Duration, timeouts int) {
+		jitter := time.Duration(rng.Int63n(int64(latency / 5)))
+		d.track(latency-latency/10+jitter, timeouts, 20)
 	}
 
-	dhtB := setupDHT(ctx, t, false, BootstrapPeersFunc(bootstrapFuncB))
-	require.Equal(t, 0, len(dhtB.host.Network().Peers()))
+	// the baseline, with the occasional timeout
+	for i := 0; i < 300; i++ {
+		lookup(100*time.Millisecond, rng.Intn(2))
+	}
+	require.Empty(t, anomalies)
 
-	addrA := peer.AddrInfo{
-		ID:    dhtA.self,
-		Addrs: dhtA.host.Addrs(),
+	// the lookups slow down
+	for i := 0; i < 20; i++ {
+		lookup(500*time.Millisecond, rng.Intn(2))
 	}
+	require.Len(t, anomalies, 1)
+	require.Equal(t, LookupLatencyAnomaly, anomalies[0].Kind)
+	require.False(t, anomalies[0].Ended)
+	require.Greater(t, anomalies[0].Value, anomalies[0].Baseline)
+	require.Greater(t, anomalies[0].Deviation, float64(defaultAnomalyThreshold))
 
-	lock.Lock()
-	bootstrapPeersB = []peer.AddrInfo{addrA}
-	lock.Unlock()
+	// and recover
+	for i := 0; i < 50; i++ {
+		lookup(100*time.Millisecond, rng.Intn(2))
+	}
+	require.Len(t, anomalies, 2)
+	require.Equal(t, LookupLatencyAnomaly, anomalies[1].Kind)
+	require.True(t, anomalies[1].Ended)
 
-	dhtB.fixLowPeers(ctx)
-	require.NotEqual(t, 0, len(dhtB.host.Network().Peers()))
+	// the peers time out
+	for i := 0; i < 10; i++ {
+		lookup(100*time.Millisecond, 10)
+	}
+	require.Len(t, anomalies, 3)
+	require.Equal(t, LookupTimeoutAnomaly, anomalies[2].Kind)
+	require.False(t, anomalies[2].Ended)
+
+	require.Nil(t, newLatencyAnomalies(0, nil))
 }
 
-func TestPreconnectedNodes(t *testing.T) {
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+func TestOperationSLOs(t *testing.T) {
+	views := []*view.View{metrics.OperationsView, metrics.OperationLatencyView}
+	require.NoError(t, view.Register(views...))
+	defer view.Unregister(views...)
 
-	opts := []Option{
-		testPrefix,
-		DisableAutoRefresh(),
-		Mode(ModeServer),
+	// the percentiles of the last operations
+	s := newOperationSLOs()
+	for i := 1; i <= sloWindow+100; i++ {
+		s.track(opGetValue, operationOutcome{duration: time.Duration(i%100+1) * time.Millisecond, succeeded: i%10 != 0})
 	}
+	slo := s.slo(opGetValue)
+	require.Equal(t, sloWindow, slo.Completed)
+	require.InDelta(t, 0.9, slo.SuccessRate, 0.01)
+	require.InDelta(t, 50*time.Millisecond, slo.P50, float64(2*time.Millisecond))
+	require.InDelta(t, 90*time.Millisecond, slo.P90, float64(2*time.Millisecond))
+	require.InDelta(t, 99*time.Millisecond, slo.P99, float64(2*time.Millisecond))
+	require.Equal(t, OperationSLO{Operation: opPutValue, SuccessRate: 1}, s.slo(opPutValue))
 
-	// Create hosts
-	h1, err := bhost.NewHost(ctx, swarmt.GenSwarm(t, ctx, swarmt.OptDisableReuseport), new(bhost.HostOpts))
-	require.NoError(t, err)
-	h2, err := bhost.NewHost(ctx, swarmt.GenSwarm(t, ctx, swarmt.OptDisableReuseport), new(bhost.HostOpts))
-	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	dhts := setupDHTS(t, ctx, 2)
+	defer func() {
+		for _, d := range dhts {
+			d.Close()
+			d.host.Close()
+		}
+	}()
+	connect(t, ctx, dhts[0], dhts[1])
 
-	// Setup first DHT
-	d1, err := New(ctx, h1, opts...)
+	_, err := dhts[0].FindPeer(ctx, dhts[1].self)
 	require.NoError(t, err)
+	_, err = dhts[0].FindPeer(ctx, coretest.RandPeerIDFatal(t))
+	require.Equal(t, routing.ErrNotFound, err)
+	canceled, cancelOp := context.WithCancel(ctx)
+	cancelOp()
+	_, err = dhts[0].FindPeer(canceled, coretest.RandPeerIDFatal(t))
+	require.Error(t, err)
 
-	// Connect the first host to the second
-	err = h1.Connect(ctx, peer.AddrInfo{ID: h2.ID(), Addrs: h2.Addrs()})
+	slos := dhts[0].OperationSLOs()
+	require.Len(t, slos, len(sloOperations))
+	slo = slos[1]
+	require.Equal(t, opFindPeer, slo.Operation)
+	require.Equal(t, 2, slo.Completed)
+	require.Equal(t, 1, slo.Succeeded)
+	require.Equal(t, 0.5, slo.SuccessRate)
+	require.LessOrEqual(t, slo.P50, slo.P99)
+
+	rows, err := view.RetrieveData(metrics.OperationsView.Name)
 	require.NoError(t, err)
+	outcomes := make(map[string]int64)
+	for _, row := range rows {
+		var op, outcome, instance string
+		for _, tg := range row.Tags {
+			switch tg.Key {
+			case metrics.KeyOperation:
+				op = tg.Value
+			case metrics.KeyOutcome:
+				outcome = tg.Value
+			case metrics.KeyInstanceID:
+				instance = tg.Value
+			}
+		}
+		if op == opFindPeer && instance == fmt.Sprintf("%p", dhts[0]) {
+			outcomes[outcome] += row.Data.(*view.CountData).Value
+		}
+	}
+	require.Equal(t, map[string]int64{outcomeSuccess: 1, outcomeFailure: 1, outcomeCanceled: 1}, outcomes)
+}
 
-	// Wait until we know identify has completed by checking for supported protocols
-	// TODO: Is this needed? Could we do h2.Connect(h1) and that would wait for identify to complete.
-	require.Eventually(t, func() bool {
-		h1Protos, err := h2.Peerstore().SupportsProtocols(h1.ID(), d1.protocolsStrs...)
-		require.NoError(t, err)
+func TestMinimalClientProfile(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-		return len(h1Protos) > 0
-	}, 10*time.Second, time.Millisecond)
+	servers := setupDHTS(t, ctx, 5)
+	defer func() {
+		for _, d := range servers {
+			d.Close()
+			d.host.Close()
+		}
+	}()
+	// every server knows the others, so that a lookup hears of all of them
+	// before terminating
+	for i := range servers {
+		for j := i + 1; j < len(servers); j++ {
+			connect(t, ctx, servers[i], servers[j])
+		}
+	}
 
-	// Setup the second DHT
-	d2, err := New(ctx, h2, opts...)
+	client := setupDHT(ctx, t, false, MinimalClientProfile(2))
+	defer client.Close()
+	defer client.host.Close()
+	require.Equal(t, ModeClient, client.Mode())
+	require.False(t, client.autoRefresh)
+
+	for _, s := range servers {
+		connectNoSync(t, ctx, client, s)
+	}
+	require.Eventually(t, func() bool { return client.routingTable.Size() == 2 }, 5*time.Second, 10*time.Millisecond)
+
+	// the lookups still find the peers the routing table misses
+	peers, err := client.GetClosestPeers(ctx, "foo")
 	require.NoError(t, err)
+	require.Len(t, peers, len(servers))
+	require.Equal(t, 2, client.routingTable.Size())
 
-	// See if it works
-	peers, err := d2.GetClosestPeers(ctx, "testkey")
+	// the peers of the routing table stay
+	for _, p := range client.routingTable.ListPeers() {
+		require.True(t, client.routingTablePeerFilter(client, p))
+	}
+}
+
+func TestDelegatedRoutingFallback(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c := cid.NewCidV1(cid.Raw, u.Hash([]byte("delegated")))
+	local := cid.NewCidV1(cid.Raw, u.Hash([]byte("local")))
+	prov, found := coretest.RandPeerIDFatal(t), coretest.RandPeerIDFatal(t)
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		require.Equal(t, "application/json", r.Header.Get("Accept"))
+		switch r.URL.Path {
+		case "/routing/v1/providers/" + c.String():
+			fmt.Fprintf(w, `{"Providers":[{"Schema":"peer","ID":%q,"Addrs":["/ip4/1.2.3.4/tcp/4001","invalid"],"Protocols":["transport-bitswap"]},{"Schema":"unknown"}]}`, prov)
+		case "/routing/v1/peers/" + peer.ToCid(found).String():
+			fmt.Fprintf(w, `{"Peers":[{"Schema":"peer","ID":%q,"Addrs":["/ip4/1.2.3.4/tcp/4002"]}]}`, found)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	// no peers, so that the lookups fail
+	d := setupDHT(ctx, t, false, DelegatedRoutingFallback(srv.URL, time.Hour))
+	defer d.Close()
+	defer d.host.Close()
+
+	var provs []ProviderInfo
+	for p := range d.FindProviderInfosAsync(ctx, c, 1) {
+		provs = append(provs, p)
+	}
+	require.Len(t, provs, 1)
+	require.Equal(t, prov, provs[0].ID)
+	require.Equal(t, []ma.Multiaddr{ma.StringCast("/ip4/1.2.3.4/tcp/4001")}, provs[0].Addrs)
+	require.Equal(t, []string{"transport-bitswap"}, provs[0].TransferProtocols)
+	require.Equal(t, srv.URL, provs[0].Delegated)
+	require.EqualValues(t, 1, atomic.LoadInt32(&requests))
+
+	// the endpoint isn't queried for the providers the DHT finds
+	require.NoError(t, d.ProviderStore().AddProvider(ctx, local.Hash(), peer.AddrInfo{ID: d.self}))
+	provs = nil
+	for p := range d.FindProviderInfosAsync(ctx, local, 1) {
+		provs = append(provs, p)
+	}
+	require.Len(t, provs, 1)
+	require.Equal(t, d.self, provs[0].ID)
+	require.Empty(t, provs[0].Delegated)
+	require.EqualValues(t, 1, atomic.LoadInt32(&requests))
+
+	ai, err := d.FindPeer(ctx, found)
 	require.NoError(t, err)
+	require.Equal(t, []ma.Multiaddr{ma.StringCast("/ip4/1.2.3.4/tcp/4002")}, ai.Addrs)
+	_, err = d.FindPeer(ctx, coretest.RandPeerIDFatal(t))
+	require.Error(t, err)
+	require.EqualValues(t, 3, atomic.LoadInt32(&requests))
 
-	require.Equal(t, len(peers), 1, "why is there more than one peer?")
-	require.Equal(t, h1.ID(), peers[0], "could not find peer")
+	// invalid endpoints are rejected
+	_, err = New(ctx, d.host, DelegatedRoutingFallback("example.com", 0))
+	require.Error(t, err)
 }
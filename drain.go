@@ -0,0 +1,100 @@
+package dht
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrClosing is returned by the operations started while the DHT drains its
+// in-flight work on Close, see ShutdownGracePeriod.
+var ErrClosing = errors.New("dht is closing")
+
+type drainCtxKey struct{}
+
+// drainer tracks the in-flight inbound requests and outbound operations, so
+// that Close can let them complete.
+type drainer struct {
+	mu       sync.Mutex
+	draining bool
+	inflight sync.WaitGroup
+}
+
+// enter tracks an operation running with ctx until the returned function is
+// called. It fails with ErrClosing once draining, unless ctx belongs to an
+// operation tracked already by d: a provide that is being drained gets to run
+// its lookup. Operations tracked by another DHT, e.g. the other half of a dual
+// DHT, are tracked anew.
+func (d *drainer) enter(ctx context.Context) (context.Context, func(), error) {
+	if ctx.Value(drainCtxKey{}) == d {
+		return ctx, func() {}, nil
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.draining {
+		return ctx, nil, ErrClosing
+	}
+	d.inflight.Add(1)
+	return context.WithValue(ctx, drainCtxKey{}, d), d.inflight.Done, nil
+}
+
+// drain stops accepting new operations, runs flush, and waits for it and the
+// operations in flight to complete. It gives up after grace, and reports
+// whether everything completed.
+func (d *drainer) drain(ctx context.Context, grace time.Duration, flush func(ctx context.Context)) bool {
+	d.mu.Lock()
+	d.draining = true
+	d.inflight.Add(1)
+	d.mu.Unlock()
+
+	go func() {
+		defer d.inflight.Done()
+		flush(context.WithValue(ctx, drainCtxKey{}, d))
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		d.inflight.Wait()
+		close(done)
+	}()
+
+	timer := time.NewTimer(grace)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// shutdown lets the in-flight work complete before Close tears the DHT down.
+// Inbound streams are no longer accepted, the operations started from now on
+// fail with ErrClosing, and the offline queue is sent out if we have peers to
+// send it to.
+func (dht *IpfsDHT) shutdown() {
+	dht.modeLk.Lock()
+	if dht.mode == modeServer {
+		for _, p := range dht.serverProtocols {
+			dht.host.RemoveStreamHandler(p)
+		}
+		if dht.datagrams != nil {
+			dht.host.RemoveStreamHandler(dht.datagrams.Protocol())
+		}
+	}
+	dht.modeLk.Unlock()
+
+	flush := func(ctx context.Context) {
+		if dht.offlineQueue != nil && dht.routingTable.Size() > 0 {
+			dht.flushOfflineQueue(ctx)
+		}
+	}
+	start := time.Now()
+	if dht.drainer.drain(dht.ctx, dht.shutdownGracePeriod, flush) {
+		logger.Debugw("drained in-flight work", "duration", time.Since(start))
+	} else {
+		logger.Infow("gave up draining in-flight work", "grace", dht.shutdownGracePeriod)
+	}
+}
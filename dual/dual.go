@@ -28,6 +28,8 @@ import (
 type DHT struct {
 	WAN *dht.IpfsDHT
 	LAN *dht.IpfsDHT
+
+	provideOnLAN bool
 }
 
 // LanExtension is used to differentiate local protocol requests from those on the WAN DHT.
@@ -50,6 +52,8 @@ var (
 
 type config struct {
 	wan, lan []dht.Option
+
+	provideOnLAN bool
 }
 
 func (cfg *config) apply(opts ...Option) error {
@@ -89,6 +93,18 @@ func DHTOption(opts ...dht.Option) Option {
 	}
 }
 
+// ProvideOnLAN announces the provider records on the LAN DHT too, when it has
+// peers, even if the WAN DHT is active, so that the peers of the local network
+// find our content even when they or we are offline from the public network.
+// By default, the records are only announced on the LAN DHT while the WAN DHT
+// has no peers.
+func ProvideOnLAN() Option {
+	return func(c *config) error {
+		c.provideOnLAN = true
+		return nil
+	}
+}
+
 // New creates a new DualDHT instance. Options provided are forwarded on to the two concrete
 // IpfsDHT internal constructions, modulo additional options used by the Dual DHT to enforce
 // the LAN-vs-WAN distinction.
@@ -98,8 +114,11 @@ func New(ctx context.Context, h host.Host, options ...Option) (*DHT, error) {
 	var cfg config
 	err := cfg.apply(
 		WanDHTOption(
+			dht.MetricsName("wan"),
 			dht.QueryFilter(dht.PublicQueryFilter),
 			dht.RoutingTableFilter(dht.PublicRoutingTableFilter),
+			dht.ResponseAddressFilter(dht.PublicAddressFilter),
+			dht.QueryAddressFilter(dht.PublicAddressFilter),
 			dht.RoutingTablePeerDiversityFilter(dht.NewRTPeerDiversityFilter(h, maxPrefixCountPerCpl, maxPrefixCount)),
 		),
 	)
@@ -108,6 +127,7 @@ func New(ctx context.Context, h host.Host, options ...Option) (*DHT, error) {
 	}
 	err = cfg.apply(
 		LanDHTOption(
+			dht.MetricsName("lan"),
 			dht.ProtocolExtension(LanExtension),
 			dht.QueryFilter(dht.PrivateQueryFilter),
 			dht.RoutingTableFilter(dht.PrivateRoutingTableFilter),
@@ -136,7 +156,7 @@ func New(ctx context.Context, h host.Host, options ...Option) (*DHT, error) {
 		return nil, err
 	}
 
-	impl := DHT{wan, lan}
+	impl := DHT{WAN: wan, LAN: lan, provideOnLAN: cfg.provideOnLAN}
 	return &impl, nil
 }
 
@@ -150,12 +170,35 @@ func (dht *DHT) WANActive() bool {
 	return dht.WAN.RoutingTable().Size() > 0
 }
 
+// LANActive returns true when the LAN DHT is active (has peers).
+func (dht *DHT) LANActive() bool {
+	return dht.LAN.RoutingTable().Size() > 0
+}
+
 // Provide adds the given cid to the content routing system.
 func (dht *DHT) Provide(ctx context.Context, key cid.Cid, announce bool) error {
-	if dht.WANActive() {
+	if !dht.WANActive() {
+		return dht.LAN.Provide(ctx, key, announce)
+	}
+	if !dht.provideOnLAN || !dht.LANActive() {
 		return dht.WAN.Provide(ctx, key, announce)
 	}
-	return dht.LAN.Provide(ctx, key, announce)
+
+	var lanErr error
+	var lanWaiter sync.WaitGroup
+	lanWaiter.Add(1)
+	go func() {
+		defer lanWaiter.Done()
+		lanErr = dht.LAN.Provide(ctx, key, announce)
+	}()
+	wanErr := dht.WAN.Provide(ctx, key, announce)
+	lanWaiter.Wait()
+
+	// provided if either succeeded
+	if wanErr == nil || lanErr == nil {
+		return nil
+	}
+	return combineErrors(wanErr, lanErr)
 }
 
 // GetRoutingTableDiversityStats fetches the Routing Table Diversity Stats.
@@ -343,12 +386,12 @@ func (d *DHT) GetValue(ctx context.Context, key string, opts ...routing.Option)
 
 // SearchValue searches for better values from this value
 func (dht *DHT) SearchValue(ctx context.Context, key string, opts ...routing.Option) (<-chan []byte, error) {
-	p := helper.Parallel{Routers: []routing.Routing{dht.WAN, dht.LAN}, Validator: dht.WAN.Validator}
+	p := helper.Parallel{Routers: []routing.Routing{dht.WAN, dht.LAN}, Validator: dht.WAN.Validator()}
 	return p.SearchValue(ctx, key, opts...)
 }
 
 // GetPublicKey returns the public key for the given peer.
 func (dht *DHT) GetPublicKey(ctx context.Context, pid peer.ID) (ci.PubKey, error) {
-	p := helper.Parallel{Routers: []routing.Routing{dht.WAN, dht.LAN}, Validator: dht.WAN.Validator}
+	p := helper.Parallel{Routers: []routing.Routing{dht.WAN, dht.LAN}, Validator: dht.WAN.Validator()}
 	return p.GetPublicKey(ctx, pid)
 }
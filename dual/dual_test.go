@@ -12,7 +12,6 @@ import (
 	peerstore "github.com/libp2p/go-libp2p-core/peerstore"
 	dht "github.com/libp2p/go-libp2p-kad-dht"
 	test "github.com/libp2p/go-libp2p-kad-dht/internal/testing"
-	record "github.com/libp2p/go-libp2p-record"
 	swarmt "github.com/libp2p/go-libp2p-swarm/testing"
 	bhost "github.com/libp2p/go-libp2p/p2p/host/basic"
 	"github.com/multiformats/go-multiaddr"
@@ -82,7 +81,7 @@ func setupDHTWithFilters(ctx context.Context, t *testing.T, options ...dht.Optio
 	lan, err := dht.New(ctx, h, lanOpts...)
 	require.NoError(t, err)
 
-	impl := DHT{wan, lan}
+	impl := DHT{WAN: wan, LAN: lan}
 	return &impl, []*customRtHelper{wanRef, lanRef}
 }
 
@@ -236,6 +235,38 @@ func TestFindProviderAsync(t *testing.T) {
 	}
 }
 
+func TestProvideOnLAN(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	d, wan, lan := setupTier(ctx, t)
+	defer d.Close()
+	defer wan.Close()
+	defer lan.Close()
+
+	time.Sleep(5 * time.Millisecond)
+
+	providedBy := func(server *dht.IpfsDHT, c cid.Cid, p peer.ID) func() bool {
+		return func() bool {
+			provs, err := server.ProviderStore().GetProviders(ctx, c.Hash())
+			return err == nil && len(provs) == 1 && provs[0].ID == p
+		}
+	}
+
+	// only announced on the WAN by default
+	require.NoError(t, d.Provide(ctx, wancid, true))
+	require.Eventually(t, providedBy(wan, wancid, d.WAN.PeerID()), 5*time.Second, 10*time.Millisecond)
+	provs, err := lan.ProviderStore().GetProviders(ctx, wancid.Hash())
+	require.NoError(t, err)
+	require.Empty(t, provs)
+
+	// and on both once enabled
+	d.provideOnLAN = true
+	require.NoError(t, d.Provide(ctx, lancid, true))
+	require.Eventually(t, providedBy(wan, lancid, d.WAN.PeerID()), 5*time.Second, 10*time.Millisecond)
+	require.Eventually(t, providedBy(lan, lancid, d.LAN.PeerID()), 5*time.Second, 10*time.Millisecond)
+}
+
 func TestValueGetSet(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
 	defer cancel()
@@ -274,8 +305,8 @@ func TestSearchValue(t *testing.T) {
 	defer wan.Close()
 	defer lan.Close()
 
-	d.WAN.Validator.(record.NamespacedValidator)["v"] = test.TestValidator{}
-	d.LAN.Validator.(record.NamespacedValidator)["v"] = test.TestValidator{}
+	require.NoError(t, d.WAN.AddValidator("v", test.TestValidator{}))
+	require.NoError(t, d.LAN.AddValidator("v", test.TestValidator{}))
 
 	_ = wan.PutValue(ctx, "/v/hello", []byte("valid"))
 
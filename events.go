@@ -3,6 +3,7 @@ package dht
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"sync"
 
 	"github.com/google/uuid"
@@ -148,6 +149,21 @@ func (r LookupTerminationReason) MarshalJSON() ([]byte, error) {
 	return json.Marshal(r.String())
 }
 
+// UnmarshalJSON parses the JSON encoding of a lookup termination reason.
+func (r *LookupTerminationReason) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	for _, reason := range []LookupTerminationReason{LookupStopped, LookupCancelled, LookupStarvation, LookupCompleted} {
+		if reason.String() == s {
+			*r = reason
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown lookup termination reason %q", s)
+}
+
 func (r LookupTerminationReason) String() string {
 	switch r {
 	case LookupStopped:
@@ -2,7 +2,9 @@ package dht
 
 import (
 	"context"
+	"fmt"
 	"math/rand"
+	"sync"
 	"testing"
 	"time"
 
@@ -459,3 +461,70 @@ func TestMultipleQueries(t *testing.T) {
 		t.Fatal("Expected to recieve an error.")
 	}
 }
+
+func TestProviderPagesBounded(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mn, err := mocknet.FullMeshConnected(ctx, 2)
+	require.NoError(t, err)
+	hosts := mn.Hosts()
+	d, err := New(ctx, hosts[0], testPrefix, DisableAutoRefresh(), Mode(ModeServer))
+	require.NoError(t, err)
+	defer d.Close()
+
+	// answer every page with the token handed out by nextToken
+	var (
+		tokenLk   sync.Mutex
+		nextToken func() []byte
+	)
+	for _, proto := range d.serverProtocols {
+		hosts[1].SetStreamHandler(proto, func(s network.Stream) {
+			defer s.Close()
+
+			pbr := protoio.NewDelimitedReader(s, network.MessageSizeMax)
+			pbw := protoio.NewDelimitedWriter(s)
+			for {
+				pmes := new(pb.Message)
+				if err := pbr.ReadMsg(pmes); err != nil {
+					return
+				}
+				tokenLk.Lock()
+				token := nextToken()
+				tokenLk.Unlock()
+				resp := &pb.Message{
+					Type:               pmes.Type,
+					Key:                pmes.Key,
+					RequestId:          pmes.RequestId,
+					ProvidersPageToken: token,
+				}
+				if err := pbw.WriteMsg(resp); err != nil {
+					return
+				}
+			}
+		})
+	}
+	key := testCaseCids[0].Hash()
+
+	var pages int
+	tokenLk.Lock()
+	nextToken = func() []byte {
+		pages++
+		return []byte("same")
+	}
+	tokenLk.Unlock()
+	_, _, err = d.protoMessenger.GetProviderRecords(ctx, hosts[1].ID(), key)
+	require.Error(t, err)
+	require.Equal(t, 2, pages)
+
+	tokenLk.Lock()
+	pages = 0
+	nextToken = func() []byte {
+		pages++
+		return []byte(fmt.Sprint(pages))
+	}
+	tokenLk.Unlock()
+	_, _, err = d.protoMessenger.GetProviderRecords(ctx, hosts[1].ID(), key)
+	require.Error(t, err)
+	require.Equal(t, pb.MaxProviderRecordPages, pages)
+}
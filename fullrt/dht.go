@@ -101,7 +101,12 @@ type FullRT struct {
 //
 // Not all of the standard DHT options are supported in this DHT.
 func NewFullRT(h host.Host, protocolPrefix protocol.ID, options ...Option) (*FullRT, error) {
-	var fullrtcfg config
+	fullrtcfg := config{
+		crawlInterval:       time.Hour,
+		waitFrac:            0.3,
+		bulkSendParallelism: 20,
+		timeoutPerOp:        5 * time.Second,
+	}
 	if err := fullrtcfg.apply(options...); err != nil {
 		return nil, err
 	}
@@ -125,14 +130,18 @@ func NewFullRT(h host.Host, protocolPrefix protocol.ID, options ...Option) (*Ful
 	if err := dhtcfg.Validate(); err != nil {
 		return nil, err
 	}
+	if dhtcfg.RecordCipher != nil {
+		dhtcfg.Datastore = kaddht.EncryptedDatastore(dhtcfg.Datastore, dhtcfg.RecordCipher)
+	}
 
-	ms := net.NewMessageSenderImpl(h, []protocol.ID{dhtcfg.ProtocolPrefix + "/kad/1.0.0"})
+	protocols := []protocol.ID{dhtcfg.V1Protocol()}
+	ms := net.NewMessageSenderImpl(h, protocols)
 	protoMessenger, err := dht_pb.NewProtocolMessenger(ms)
 	if err != nil {
 		return nil, err
 	}
 
-	c, err := crawler.New(h, crawler.WithParallelism(200))
+	c, err := crawler.New(h, crawler.WithParallelism(200), crawler.WithProtocols(protocols))
 	if err != nil {
 		return nil, err
 	}
@@ -175,12 +184,12 @@ func NewFullRT(h host.Host, protocolPrefix protocol.ID, options ...Option) (*Ful
 
 		triggerRefresh: make(chan struct{}),
 
-		waitFrac:     0.3,
-		timeoutPerOp: 5 * time.Second,
+		waitFrac:     fullrtcfg.waitFrac,
+		timeoutPerOp: fullrtcfg.timeoutPerOp,
 
-		crawlerInterval: time.Minute * 60,
+		crawlerInterval: fullrtcfg.crawlInterval,
 
-		bulkSendParallelism: 20,
+		bulkSendParallelism: fullrtcfg.bulkSendParallelism,
 	}
 
 	rt.wg.Add(1)
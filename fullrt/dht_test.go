@@ -3,6 +3,7 @@ package fullrt
 import (
 	"strconv"
 	"testing"
+	"time"
 
 	"github.com/libp2p/go-libp2p-core/peer"
 )
@@ -84,3 +85,19 @@ func TestDivideByChunkSize(t *testing.T) {
 		}
 	})
 }
+
+func TestOptions(t *testing.T) {
+	var cfg config
+	if err := cfg.apply(WithCrawlInterval(time.Minute), WithSuccessWaitFraction(0.5), WithBulkSendParallelism(5), WithTimeoutPerOperation(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.crawlInterval != time.Minute || cfg.waitFrac != 0.5 || cfg.bulkSendParallelism != 5 || cfg.timeoutPerOp != time.Second {
+		t.Fatalf("options not applied: %+v", cfg)
+	}
+
+	for _, o := range []Option{WithCrawlInterval(0), WithSuccessWaitFraction(0), WithSuccessWaitFraction(1.5), WithBulkSendParallelism(0), WithTimeoutPerOperation(-time.Second)} {
+		if err := cfg.apply(o); err == nil {
+			t.Fatal("expected an invalid option to fail")
+		}
+	}
+}
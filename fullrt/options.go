@@ -2,11 +2,18 @@ package fullrt
 
 import (
 	"fmt"
+	"time"
+
 	kaddht "github.com/libp2p/go-libp2p-kad-dht"
 )
 
 type config struct {
 	dhtOpts []kaddht.Option
+
+	crawlInterval       time.Duration
+	waitFrac            float64
+	bulkSendParallelism int
+	timeoutPerOp        time.Duration
 }
 
 func (cfg *config) apply(opts ...Option) error {
@@ -26,3 +33,55 @@ func DHTOption(opts ...kaddht.Option) Option {
 		return nil
 	}
 }
+
+// WithCrawlInterval sets the time between the crawls of the network refreshing
+// the routing table.
+// Defaults to 1 hour.
+func WithCrawlInterval(interval time.Duration) Option {
+	return func(c *config) error {
+		if interval <= 0 {
+			return fmt.Errorf("crawl interval must be positive, got %s", interval)
+		}
+		c.crawlInterval = interval
+		return nil
+	}
+}
+
+// WithSuccessWaitFraction sets the fraction of the closest peers to wait for
+// before considering a put or a provide successful, from 0, excluded, to 1.
+// Defaults to 0.3.
+func WithSuccessWaitFraction(f float64) Option {
+	return func(c *config) error {
+		if f <= 0 || f > 1 {
+			return fmt.Errorf("success wait fraction must be larger than 0 and at most 1, got %v", f)
+		}
+		c.waitFrac = f
+		return nil
+	}
+}
+
+// WithBulkSendParallelism sets the number of peers ProvideMany and PutMany send
+// their records to at once.
+// Defaults to 20.
+func WithBulkSendParallelism(n int) Option {
+	return func(c *config) error {
+		if n < 1 {
+			return fmt.Errorf("bulk send parallelism must be at least 1, got %d", n)
+		}
+		c.bulkSendParallelism = n
+		return nil
+	}
+}
+
+// WithTimeoutPerOperation sets the timeout of each request sent to a peer, e.g.
+// to put a record or to query it.
+// Defaults to 5 seconds.
+func WithTimeoutPerOperation(timeout time.Duration) Option {
+	return func(c *config) error {
+		if timeout <= 0 {
+			return fmt.Errorf("timeout per operation must be positive, got %s", timeout)
+		}
+		c.timeoutPerOp = timeout
+		return nil
+	}
+}
@@ -0,0 +1,90 @@
+package dht
+
+import (
+	"context"
+	gonet "net"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+	"go.opencensus.io/stats"
+
+	"github.com/libp2p/go-libp2p-kad-dht/internal/net"
+	"github.com/libp2p/go-libp2p-kad-dht/metrics"
+	"github.com/libp2p/go-libp2p-kad-dht/qpeerset"
+)
+
+// dialAllowed reports whether the gater allows dialing p, either as a peer or
+// at one of its known addresses. Peers we are connected to already are always
+// allowed.
+func (dht *IpfsDHT) dialAllowed(p peer.ID) bool {
+	if dht.gater == nil || dht.host.Network().Connectedness(p) == network.Connected {
+		return true
+	}
+	if !dht.gater.InterceptPeerDial(p) {
+		return false
+	}
+	addrs := dht.peerstore.Addrs(p)
+	if len(addrs) == 0 {
+		// left to the dialer
+		return true
+	}
+	for _, a := range addrs {
+		if dht.gater.InterceptAddrDial(p, a) {
+			return true
+		}
+	}
+	return false
+}
+
+// skipBlockedPeers marks the heard peers the gater doesn't allow dialing as
+// blocked, so that they aren't queried.
+func (q *query) skipBlockedPeers() {
+	if q.dht.gater == nil {
+		return
+	}
+	for _, p := range q.queryPeers.GetClosestInStates(qpeerset.PeerHeard) {
+		if !q.dht.dialAllowed(p) {
+			q.queryPeers.SetState(p, qpeerset.PeerBlocked)
+			stats.Record(q.dht.ctx, metrics.BlockedDials.M(1))
+		}
+	}
+}
+
+// requestAllowed reports whether the gater accepts the requests of p. The
+// requests coming in over libp2p connections are checked against them, and
+// the ones coming in over datagrams or HTTP against their remote IP.
+func (dht *IpfsDHT) requestAllowed(ctx context.Context, p peer.ID) bool {
+	if dht.gater == nil {
+		return true
+	}
+	if ip, ok := net.RemoteIP(ctx); ok {
+		return dht.gater.InterceptSecured(network.DirInbound, p, newRequestAddrs(ip))
+	}
+	for _, c := range dht.host.Network().ConnsToPeer(p) {
+		if c.Stat().Direction == network.DirInbound && !dht.gater.InterceptSecured(network.DirInbound, p, c) {
+			return false
+		}
+	}
+	return true
+}
+
+// requestAddrs describes the endpoints of a request that didn't come in over
+// a libp2p connection, of which only the remote IP is known.
+type requestAddrs struct {
+	local, remote ma.Multiaddr
+}
+
+func newRequestAddrs(ip gonet.IP) requestAddrs {
+	unspecified := gonet.IPv6unspecified
+	if ip.To4() != nil {
+		unspecified = gonet.IPv4zero
+	}
+	local, _ := manet.FromIP(unspecified)
+	remote, _ := manet.FromIP(ip)
+	return requestAddrs{local: local, remote: remote}
+}
+
+func (a requestAddrs) LocalMultiaddr() ma.Multiaddr  { return a.local }
+func (a requestAddrs) RemoteMultiaddr() ma.Multiaddr { return a.remote }
@@ -15,6 +15,8 @@ import (
 	u "github.com/ipfs/go-ipfs-util"
 	"github.com/libp2p/go-libp2p-kad-dht/internal"
 	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
+	"github.com/libp2p/go-libp2p-kad-dht/providers"
+	record "github.com/libp2p/go-libp2p-record"
 	recpb "github.com/libp2p/go-libp2p-record/pb"
 	"github.com/multiformats/go-base32"
 )
@@ -45,6 +47,8 @@ func (dht *IpfsDHT) handlerForMsgType(t pb.Message_MessageType) dhtHandler {
 			return dht.handleAddProvider
 		case pb.Message_GET_PROVIDERS:
 			return dht.handleGetProviders
+		case pb.Message_REMOVE_PROVIDER:
+			return dht.handleRemoveProvider
 		}
 	}
 
@@ -68,25 +72,47 @@ func (dht *IpfsDHT) handleGetValue(ctx context.Context, p peer.ID, pmes *pb.Mess
 	resp.Record = rec
 
 	// Find closest peer on given cluster to desired key and reply with that info
-	closer := dht.betterPeersToQuery(pmes, p, dht.bucketSize)
-	if len(closer) > 0 {
+	resp.CloserPeers = dht.closerPeers(ctx, pmes, p)
+
+	return resp, nil
+}
+
+// closerPeersCount returns the number of closer peers to answer a request
+// with: the number the requester asked for, up to pb.MaxCloserPeers, or our
+// bucket size.
+func (dht *IpfsDHT) closerPeersCount(pmes *pb.Message) int {
+	n := int(pmes.GetCloserPeersCount())
+	switch {
+	case n == 0:
+		return dht.bucketSize
+	case n > pb.MaxCloserPeers:
+		return pb.MaxCloserPeers
+	}
+	return n
+}
+
+// closerPeers returns the peers closest to the key of a GET_VALUE or
+// GET_PROVIDERS request.
+func (dht *IpfsDHT) closerPeers(ctx context.Context, pmes *pb.Message, from peer.ID) []pb.Message_Peer {
+	count := dht.closerPeersCount(pmes)
+	return dht.closerPeersCache.get(ctx, fmt.Sprintf("closer/%d/%s", count, pmes.GetKey()), from, func(from peer.ID) []pb.Message_Peer {
+		closer := dht.betterPeersToQuery(pmes, from, count)
+		if len(closer) == 0 {
+			return nil
+		}
 		// TODO: pstore.PeerInfos should move to core (=> peerstore.AddrInfos).
 		closerinfos := pstore.PeerInfos(dht.peerstore, closer)
 		for _, pi := range closerinfos {
-			logger.Debugf("handleGetValue returning closer peer: '%s'", pi.ID)
 			if len(pi.Addrs) < 1 {
 				logger.Warnw("no addresses on peer being sent",
 					"local", dht.self,
-					"to", p,
+					"to", from,
 					"sending", pi.ID,
 				)
 			}
 		}
-
-		resp.CloserPeers = pb.PeerInfosToPBPeers(dht.host.Network(), closerinfos)
-	}
-
-	return resp, nil
+		return pb.PeerInfosToPBPeers(dht.host.Network(), closerinfos)
+	})
 }
 
 func (dht *IpfsDHT) checkLocalDatastore(ctx context.Context, k []byte) (*recpb.Record, error) {
@@ -121,7 +147,7 @@ func (dht *IpfsDHT) checkLocalDatastore(ctx context.Context, k []byte) (*recpb.R
 		recordIsBad = true
 	}
 
-	if time.Since(recvtime) > dht.maxRecordAge {
+	if time.Since(recvtime) > dht.recordMaxAge(k) {
 		logger.Debug("old record found, tossing.")
 		recordIsBad = true
 	}
@@ -142,6 +168,22 @@ func (dht *IpfsDHT) checkLocalDatastore(ctx context.Context, k []byte) (*recpb.R
 	return rec, nil
 }
 
+// recordMaxAge returns how long the record stored under key is kept, see
+// NamespaceMaxRecordAge.
+func (dht *IpfsDHT) recordMaxAge(key []byte) time.Duration {
+	if len(dht.namespaceMaxAges) == 0 {
+		return dht.maxRecordAge
+	}
+	ns, _, err := record.SplitKey(string(key))
+	if err != nil {
+		return dht.maxRecordAge
+	}
+	if maxAge, ok := dht.namespaceMaxAges[ns]; ok {
+		return maxAge
+	}
+	return dht.maxRecordAge
+}
+
 // Cleans the record (to avoid storing arbitrary data).
 func cleanRecord(rec *recpb.Record) {
 	rec.TimeReceived = ""
@@ -165,8 +207,13 @@ func (dht *IpfsDHT) handlePutValue(ctx context.Context, p peer.ID, pmes *pb.Mess
 
 	cleanRecord(rec)
 
+	if err := dht.checkRecordSize(string(rec.GetKey()), rec.GetValue()); err != nil {
+		logger.Infow("oversized dht record in PUT", "from", p, "key", internal.LoggableRecordKeyBytes(rec.GetKey()), "size", len(rec.GetValue()))
+		return nil, err
+	}
+
 	// Make sure the record is valid (not expired, valid signature etc)
-	if err = dht.Validator.Validate(string(rec.GetKey()), rec.GetValue()); err != nil {
+	if err = dht.Validator().Validate(string(rec.GetKey()), rec.GetValue()); err != nil {
 		logger.Infow("bad dht record in PUT", "from", p, "key", internal.LoggableRecordKeyBytes(rec.GetKey()), "error", err)
 		return nil, err
 	}
@@ -192,9 +239,15 @@ func (dht *IpfsDHT) handlePutValue(ctx context.Context, p peer.ID, pmes *pb.Mess
 		return nil, err
 	}
 
+	cacheTTL := time.Duration(pmes.GetCacheTtl()) * time.Second
+	if existing != nil && cacheTTL > 0 {
+		// never let a cached copy replace a record stored for good
+		return pmes, nil
+	}
+
 	if existing != nil {
 		recs := [][]byte{rec.GetValue(), existing.GetValue()}
-		i, err := dht.Validator.Select(string(rec.GetKey()), recs)
+		i, err := dht.selectValue(string(rec.GetKey()), recs)
 		if err != nil {
 			logger.Warnw("dht record passed validation but failed select", "from", p, "key", internal.LoggableRecordKeyBytes(rec.GetKey()), "error", err)
 			return nil, err
@@ -206,7 +259,12 @@ func (dht *IpfsDHT) handlePutValue(ctx context.Context, p peer.ID, pmes *pb.Mess
 	}
 
 	// record the time we receive every record
-	rec.TimeReceived = u.FormatRFC3339(time.Now())
+	received := time.Now()
+	if maxAge := dht.recordMaxAge(rec.GetKey()); cacheTTL > 0 && cacheTTL < maxAge {
+		// backdate cached records so that they expire after their ttl
+		received = received.Add(cacheTTL - maxAge)
+	}
+	rec.TimeReceived = u.FormatRFC3339(received)
 
 	data, err := proto.Marshal(rec)
 	if err != nil {
@@ -236,7 +294,7 @@ func (dht *IpfsDHT) getRecordFromDatastore(ctx context.Context, dskey ds.Key) (*
 		return nil, nil
 	}
 
-	err = dht.Validator.Validate(string(rec.GetKey()), rec.GetValue())
+	err = dht.Validator().Validate(string(rec.GetKey()), rec.GetValue())
 	if err != nil {
 		// Invalid record in datastore, probably expired but don't return an error,
 		// we'll just overwrite it
@@ -254,18 +312,47 @@ func (dht *IpfsDHT) handlePing(_ context.Context, p peer.ID, pmes *pb.Message) (
 
 func (dht *IpfsDHT) handleFindPeer(ctx context.Context, from peer.ID, pmes *pb.Message) (_ *pb.Message, _err error) {
 	resp := pb.NewMessage(pmes.GetType(), nil, pmes.GetClusterLevel())
-	var closest []peer.ID
 
 	if len(pmes.GetKey()) == 0 {
 		return nil, fmt.Errorf("handleFindPeer with empty key")
 	}
+	count := dht.closerPeersCount(pmes)
+	resp.CloserPeers = dht.findNodeCloserPeers(ctx, pmes.GetKey(), from, count)
+
+	// answer the additional keys of batched requests
+	keys := pmes.GetKeys()
+	if len(keys) > pb.MaxBatchedKeys {
+		keys = keys[:pb.MaxBatchedKeys]
+	}
+	for _, key := range keys {
+		if len(key) == 0 {
+			continue
+		}
+		resp.CloserPeersByKey = append(resp.CloserPeersByKey, pb.Message_KeyPeers{
+			Key:         key,
+			CloserPeers: dht.findNodeCloserPeers(ctx, key, from, count),
+		})
+	}
+	return resp, nil
+}
+
+// findNodeCloserPeers returns the count peers with known addresses closest to
+// the key of a FIND_NODE request.
+func (dht *IpfsDHT) findNodeCloserPeers(ctx context.Context, key []byte, from peer.ID, count int) []pb.Message_Peer {
+	return dht.closerPeersCache.get(ctx, fmt.Sprintf("find/%d/%s", count, key), from, func(from peer.ID) []pb.Message_Peer {
+		return dht.computeFindNodeCloserPeers(key, from, count)
+	})
+}
+
+func (dht *IpfsDHT) computeFindNodeCloserPeers(key []byte, from peer.ID, count int) []pb.Message_Peer {
+	var closest []peer.ID
 
 	// if looking for self... special case where we send it on CloserPeers.
-	targetPid := peer.ID(pmes.GetKey())
+	targetPid := peer.ID(key)
 	if targetPid == dht.self {
 		closest = []peer.ID{dht.self}
 	} else {
-		closest = dht.betterPeersToQuery(pmes, from, dht.bucketSize)
+		closest = dht.betterPeersToQuery(pb.NewMessage(pb.Message_FIND_NODE, key, 0), from, count)
 
 		// Never tell a peer about itself.
 		if targetPid != from {
@@ -289,7 +376,7 @@ func (dht *IpfsDHT) handleFindPeer(ctx context.Context, from peer.ID, pmes *pb.M
 	}
 
 	if closest == nil {
-		return resp, nil
+		return nil
 	}
 
 	// TODO: pstore.PeerInfos should move to core (=> peerstore.AddrInfos).
@@ -302,8 +389,7 @@ func (dht *IpfsDHT) handleFindPeer(ctx context.Context, from peer.ID, pmes *pb.M
 		}
 	}
 
-	resp.CloserPeers = pb.PeerInfosToPBPeers(dht.host.Network(), withAddresses)
-	return resp, nil
+	return pb.PeerInfosToPBPeers(dht.host.Network(), withAddresses)
 }
 
 func (dht *IpfsDHT) handleGetProviders(ctx context.Context, p peer.ID, pmes *pb.Message) (_ *pb.Message, _err error) {
@@ -316,20 +402,37 @@ func (dht *IpfsDHT) handleGetProviders(ctx context.Context, p peer.ID, pmes *pb.
 
 	resp := pb.NewMessage(pmes.GetType(), pmes.GetKey(), pmes.GetClusterLevel())
 
-	// setup providers
-	providers, err := dht.providerStore.GetProviders(ctx, key)
+	// setup providers, if the requester still waits for them
+	err := ctx.Err()
+	if rs, ok := dht.providerStore.(providers.ProviderRecordStore); ok && err == nil {
+		var recs []providers.ProviderRecord
+		if recs, err = rs.GetProviderRecords(ctx, key); err == nil {
+			resp.ProviderPeers = dht.providerRecordsToPBPeers(recs)
+		}
+	} else if err == nil {
+		var provs []peer.AddrInfo
+		if provs, err = dht.providerStore.GetProviders(ctx, key); err == nil {
+			resp.ProviderPeers = pb.PeerInfosToPBPeers(dht.host.Network(), provs)
+		}
+	}
 	if err != nil {
-		return nil, err
+		if !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return nil, err
+		}
+		// past the deadline hinted by the requester, answer with the
+		// closer peers alone
+		logger.Debugw("skipped providers past the request deadline", "from", p, "key", internal.LoggableProviderRecordBytes(key))
+	}
+	if caps, ok := pb.PeerCapabilities(dht.peerstore, p); ok && caps.Has(pb.CapPaginatedProviders) && !dht.streamsProviders(ctx, p) {
+		resp.ProviderPeers, resp.ProvidersPageToken = providersPage(resp.ProviderPeers, pmes.GetProvidersPageToken())
+	}
+	if len(pmes.GetProvidersPageToken()) > 0 {
+		// the closer peers came with the first page
+		return resp, nil
 	}
-	resp.ProviderPeers = pb.PeerInfosToPBPeers(dht.host.Network(), providers)
 
 	// Also send closer peers.
-	closer := dht.betterPeersToQuery(pmes, p, dht.bucketSize)
-	if closer != nil {
-		// TODO: pstore.PeerInfos should move to core (=> peerstore.AddrInfos).
-		infos := pstore.PeerInfos(dht.peerstore, closer)
-		resp.CloserPeers = pb.PeerInfosToPBPeers(dht.host.Network(), infos)
-	}
+	resp.CloserPeers = dht.closerPeers(ctx, pmes, p)
 
 	return resp, nil
 }
@@ -344,12 +447,17 @@ func (dht *IpfsDHT) handleAddProvider(ctx context.Context, p peer.ID, pmes *pb.M
 
 	logger.Debugf("adding provider", "from", p, "key", internal.LoggableProviderRecordBytes(key))
 
+	// records of other providers are only accepted as cached copies of
+	// records their provider signed, found by a lookup
+	cacheTTL := time.Duration(pmes.GetCacheTtl()) * time.Second
+
 	// add provider should use the address given in the message
-	pinfos := pb.PBPeersToPeerInfos(pmes.GetProviderPeers())
-	for _, pi := range pinfos {
-		if pi.ID != p {
+	pbps := pmes.GetProviderPeers()
+	pinfos := pb.PBPeersToPeerInfos(pbps)
+	for i, pi := range pinfos {
+		cached := pi.ID != p
+		if cached && (cacheTTL <= 0 || len(pbps[i].Signature) == 0) {
 			// we should ignore this provider record! not from originator.
-			// (we should sign them and check signature later...)
 			logger.Debugw("received provider from wrong peer", "from", p, "peer", pi.ID)
 			continue
 		}
@@ -359,7 +467,82 @@ func (dht *IpfsDHT) handleAddProvider(ctx context.Context, p peer.ID, pmes *pb.M
 			continue
 		}
 
-		dht.providerStore.AddProvider(ctx, key, peer.AddrInfo{ID: p})
+		if !dht.providerLimiter.allow(ctx, p, key) {
+			logger.Debugw("dropping rate limited provider record", "from", p, "key", internal.LoggableProviderRecordBytes(key))
+			continue
+		}
+
+		rs, ok := dht.providerStore.(providers.ProviderRecordStore)
+		if !ok {
+			if !cached {
+				dht.providerStore.AddProvider(ctx, key, *pi)
+			}
+			continue
+		}
+		if cached && dht.hasProviderRecord(ctx, rs, key, pi.ID) {
+			// never let a cached copy replace a record stored for good
+			continue
+		}
+
+		rec := providers.ProviderRecord{
+			AddrInfo: *pi,
+			TTL:      time.Duration(pbps[i].GetProviderTtl()) * time.Second,
+		}
+		if cached {
+			rec.TTL = cacheTTL
+		}
+		if protos := pbps[i].TransferProtocols; len(protos) > 0 {
+			if err := checkTransferProtocols(protos); err != nil {
+				logger.Debugw("dropping provider record", "from", p, "key", internal.LoggableProviderRecordBytes(key), "error", err)
+				continue
+			}
+			rec.TransferProtocols = protos
+		}
+		if ext := pbps[i].XXX_unrecognized; len(ext) <= pb.MaxProviderExtensionsSize {
+			// keep the fields we don't know of for the peers that do
+			rec.Extensions = ext
+		}
+		if len(pbps[i].Signature) > 0 {
+			signedAt := time.Unix(0, pbps[i].SignedAt)
+			if err := dht.checkProviderTimestamp(pi.ID, key, signedAt, pbps[i].Signature); err != nil {
+				logger.Debugw("dropping signed provider record", "from", p, "key", internal.LoggableProviderRecordBytes(key), "error", err)
+				continue
+			}
+			rec.SignedAt = signedAt
+			rec.Signature = pbps[i].Signature
+		}
+		rs.AddProviderRecord(ctx, key, rec)
+	}
+
+	return nil, nil
+}
+
+func (dht *IpfsDHT) handleRemoveProvider(ctx context.Context, p peer.ID, pmes *pb.Message) (_ *pb.Message, _err error) {
+	key := pmes.GetKey()
+	if len(key) > 80 {
+		return nil, fmt.Errorf("handleRemoveProvider key size too large")
+	} else if len(key) == 0 {
+		return nil, fmt.Errorf("handleRemoveProvider key is empty")
+	}
+
+	remover, ok := dht.providerStore.(providers.ProviderRemover)
+	if !ok {
+		logger.Debugw("provider store does not support removing providers", "from", p)
+		return nil, nil
+	}
+
+	logger.Debugw("removing provider", "from", p, "key", internal.LoggableProviderRecordBytes(key))
+
+	for _, pi := range pb.PBPeersToPeerInfos(pmes.GetProviderPeers()) {
+		if pi.ID != p {
+			// peers can only retract their own records.
+			logger.Debugw("received provider retraction from wrong peer", "from", p, "peer", pi.ID)
+			continue
+		}
+
+		if err := remover.RemoveProvider(ctx, key, p); err != nil {
+			return nil, err
+		}
 	}
 
 	return nil, nil
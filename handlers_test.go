@@ -88,6 +88,118 @@ func TestBadMessage(t *testing.T) {
 	}
 }
 
+func TestAddProviderRateLimit(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d := setupDHT(ctx, t, false, ProviderPeerRateLimit(0.001, 2), ProviderKeyRateLimit(0.001, 1))
+	defer d.Close()
+
+	addr := ma.StringCast("/ip4/1.2.3.4/tcp/4001")
+	addProvider := func(p peer.ID, key []byte) {
+		t.Helper()
+		msg := pb.NewMessage(pb.Message_ADD_PROVIDER, key, 0)
+		msg.ProviderPeers = pb.RawPeerInfosToPBPeers([]peer.AddrInfo{{ID: p, Addrs: []ma.Multiaddr{addr}}})
+		if _, err := d.handleAddProvider(ctx, p, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	providers := func(key []byte) int {
+		t.Helper()
+		provs, err := d.providerStore.GetProviders(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(provs)
+	}
+
+	p1, p2 := peer.ID("peer one"), peer.ID("peer two")
+
+	// the first peer can only announce two records
+	for i := 0; i < 3; i++ {
+		addProvider(p1, []byte(fmt.Sprintf("key-%d", i)))
+	}
+	if providers([]byte("key-0")) != 1 || providers([]byte("key-1")) != 1 {
+		t.Fatal("expected the first records to be accepted")
+	}
+	if providers([]byte("key-2")) != 0 {
+		t.Fatal("expected the record over the peer limit to be dropped")
+	}
+
+	// a single record per key is accepted
+	addProvider(p2, []byte("key-0"))
+	if providers([]byte("key-0")) != 1 {
+		t.Fatal("expected the record over the key limit to be dropped")
+	}
+
+	// which didn't cost the second peer any of its records
+	addProvider(p2, []byte("key-3"))
+	addProvider(p2, []byte("key-4"))
+	if providers([]byte("key-3")) != 1 || providers([]byte("key-4")) != 1 {
+		t.Fatal("expected the record refused for its key not to count against its peer")
+	}
+}
+
+func TestHandlerMiddleware(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var audit []pb.Message_MessageType
+	record := func(next RequestHandler) RequestHandler {
+		return func(ctx context.Context, p peer.ID, req *pb.Message) (*pb.Message, error) {
+			audit = append(audit, req.GetType())
+			return next(ctx, p, req)
+		}
+	}
+	blocked := peer.ID("blocked peer")
+	authorize := func(next RequestHandler) RequestHandler {
+		return func(ctx context.Context, p peer.ID, req *pb.Message) (*pb.Message, error) {
+			if p == blocked {
+				return nil, fmt.Errorf("peer %s not allowed", p)
+			}
+			return next(ctx, p, req)
+		}
+	}
+	serveValues := func(next RequestHandler) RequestHandler {
+		return func(ctx context.Context, p peer.ID, req *pb.Message) (*pb.Message, error) {
+			if req.GetType() != pb.Message_GET_VALUE {
+				return next(ctx, p, req)
+			}
+			resp := pb.NewMessage(req.GetType(), req.GetKey(), 0)
+			resp.Record = &recpb.Record{Key: req.GetKey(), Value: []byte("experimental")}
+			return resp, nil
+		}
+	}
+
+	d := setupDHT(ctx, t, false, DisableValues(), HandlerMiddleware(record, authorize), HandlerMiddleware(serveValues))
+	defer d.Close()
+
+	ping := pb.NewMessage(pb.Message_PING, nil, 0)
+	if _, err := d.requestHandler(pb.Message_PING)(ctx, blocked, ping); err == nil {
+		t.Fatal("expected the request of the blocked peer to be refused")
+	}
+	if _, err := d.requestHandler(pb.Message_PING)(ctx, "allowed peer", ping); err != nil {
+		t.Fatal(err)
+	}
+
+	// values are disabled, but served by the middleware
+	resp, err := d.requestHandler(pb.Message_GET_VALUE)(ctx, "allowed peer", pb.NewMessage(pb.Message_GET_VALUE, []byte("/v/key"), 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(resp.GetRecord().GetValue(), []byte("experimental")) {
+		t.Fatalf("unexpected value %q", resp.GetRecord().GetValue())
+	}
+	if _, err := d.requestHandler(pb.Message_PUT_VALUE)(ctx, "allowed peer", pb.NewMessage(pb.Message_PUT_VALUE, []byte("/v/key"), 0)); err == nil {
+		t.Fatal("expected requests handled by no one to fail")
+	}
+
+	expected := []pb.Message_MessageType{pb.Message_PING, pb.Message_PING, pb.Message_GET_VALUE, pb.Message_PUT_VALUE}
+	if fmt.Sprint(audit) != fmt.Sprint(expected) {
+		t.Fatalf("expected requests %v to be recorded, got %v", expected, audit)
+	}
+}
+
 func BenchmarkHandleFindPeer(b *testing.B) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -138,3 +250,265 @@ func BenchmarkHandleFindPeer(b *testing.B) {
 	}
 
 }
+
+func TestCloserPeersCache(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d := setupDHT(ctx, t, false, CloserPeersCache(time.Minute, 0))
+	defer d.Close()
+	defer d.host.Close()
+
+	rng := rand.New(rand.NewSource(154))
+	addPeer := func() peer.ID {
+		_, pubk, _ := crypto.GenerateEd25519Key(rng)
+		id, err := peer.IDFromPublicKey(pubk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := d.routingTable.TryAddPeer(id, true, false); err != nil {
+			t.Fatal(err)
+		}
+		d.host.Peerstore().AddAddr(id, ma.StringCast("/ip4/1.2.3.4/tcp/4001"), time.Hour)
+		return id
+	}
+	var peers []peer.ID
+	for i := 0; i < 5; i++ {
+		peers = append(peers, addPeer())
+	}
+
+	closer := func(from peer.ID) map[peer.ID]bool {
+		resp, err := d.handleFindPeer(ctx, from, pb.NewMessage(pb.Message_FIND_NODE, []byte("key"), 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids := make(map[peer.ID]bool)
+		for _, p := range resp.CloserPeers {
+			ids[peer.ID(p.Id)] = true
+		}
+		return ids
+	}
+
+	if ids := closer(peers[0]); len(ids) != 4 || ids[peers[0]] {
+		t.Fatalf("expected the 4 other peers, got %v", ids)
+	}
+
+	// answered from the cache, still without the requester
+	late := addPeer()
+	if ids := closer(peers[1]); len(ids) != 4 || ids[peers[1]] || !ids[peers[0]] || ids[late] {
+		t.Fatalf("expected the 4 other peers known at first, got %v", ids)
+	}
+}
+
+func TestDeadlineHints(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hints := make(chan uint32, 1)
+	record := func(next RequestHandler) RequestHandler {
+		return func(ctx context.Context, p peer.ID, req *pb.Message) (*pb.Message, error) {
+			if _, ok := ctx.Deadline(); ok && req.GetType() == pb.Message_FIND_NODE {
+				select {
+				case hints <- req.GetDeadlineMs():
+				default:
+				}
+			}
+			return next(ctx, p, req)
+		}
+	}
+	server := setupDHT(ctx, t, false, HandlerMiddleware(record))
+	client := setupDHT(ctx, t, false, DeadlineHints())
+	other := setupDHT(ctx, t, false)
+	for _, d := range []*IpfsDHT{server, client, other} {
+		defer d.Close()
+		defer d.host.Close()
+	}
+	connect(t, ctx, client, server)
+	connect(t, ctx, server, other)
+
+	// the server runs the handler under the hinted deadline
+	ctxT, cancelT := context.WithTimeout(ctx, 5*time.Second)
+	defer cancelT()
+	if _, err := client.protoMessenger.GetClosestPeers(ctxT, server.self, other.self); err != nil {
+		t.Fatal(err)
+	}
+	if hint := <-hints; hint == 0 || hint > 5000 {
+		t.Fatalf("unexpected deadline hint of %dms", hint)
+	}
+
+	// and skips the providers past it
+	key := []byte("provided key")
+	if err := server.providerStore.AddProvider(ctx, key, peer.AddrInfo{ID: other.self, Addrs: other.host.Addrs()}); err != nil {
+		t.Fatal(err)
+	}
+	req := pb.NewMessage(pb.Message_GET_PROVIDERS, key, 0)
+	req.DeadlineMs = 1
+	resp, err := server.handleWithDeadline(ctx, server.handleGetProviders, client.self, req, time.Now().Add(-time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.GetProviderPeers()) != 0 || len(resp.GetCloserPeers()) == 0 {
+		t.Fatalf("expected closer peers only, got %d providers and %d closer peers", len(resp.GetProviderPeers()), len(resp.GetCloserPeers()))
+	}
+
+	req.DeadlineMs = 0
+	if resp, err = server.handleWithDeadline(ctx, server.handleGetProviders, client.self, req, time.Now().Add(-time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.GetProviderPeers()) != 1 {
+		t.Fatalf("expected a provider, got %d", len(resp.GetProviderPeers()))
+	}
+}
+
+func TestCloserPeersCount(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	server := setupDHT(ctx, t, false, BucketSize(30))
+	client := setupDHT(ctx, t, false, BucketSize(10))
+	for _, d := range []*IpfsDHT{server, client} {
+		defer d.Close()
+		defer d.host.Close()
+	}
+	connect(t, ctx, client, server)
+	// keep the requester out of the answers
+	server.routingTable.RemovePeer(client.self)
+
+	rng := rand.New(rand.NewSource(160))
+	for i := 0; i < 60; i++ {
+		_, pubk, _ := crypto.GenerateEd25519Key(rng)
+		id, err := peer.IDFromPublicKey(pubk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// full buckets reject some of them
+		_, _ = server.routingTable.TryAddPeer(id, true, false)
+		server.host.Peerstore().AddAddr(id, ma.StringCast("/ip4/1.2.3.4/tcp/4001"), time.Hour)
+	}
+	if server.routingTable.Size() < 40 {
+		t.Fatalf("expected at least 40 peers in the routing table, got %d", server.routingTable.Size())
+	}
+
+	count := func(n uint32) int {
+		req := pb.NewMessage(pb.Message_FIND_NODE, []byte("key"), 0)
+		req.CloserPeersCount = n
+		resp, err := server.handleFindPeer(ctx, client.self, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(resp.CloserPeers)
+	}
+	// the server answers with as many peers as asked for, or its bucket size
+	if n := count(0); n != 30 {
+		t.Fatalf("expected 30 closer peers, got %d", n)
+	}
+	if n := count(35); n != 35 {
+		t.Fatalf("expected 35 closer peers, got %d", n)
+	}
+
+	// the client asks for its bucket size
+	peers, err := client.protoMessenger.GetClosestPeers(ctx, server.self, peer.ID("key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 10 {
+		t.Fatalf("expected 10 closer peers, got %d", len(peers))
+	}
+
+	// and keeps the closest of the peers it gets from servers answering with
+	// more
+	req := pb.NewMessage(pb.Message_FIND_NODE, []byte("key"), 0)
+	resp, err := server.handleFindPeer(ctx, client.self, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	closest := pb.ClosestPeers(resp.CloserPeers, []byte("key"), 10)
+	for i, p := range peers {
+		if peer.ID(closest[i].Id) != p.ID {
+			t.Fatalf("expected the closest peers %v, got %v", closest, peers)
+		}
+	}
+}
+
+// lossySender drops the responses to the next lost requests it sends.
+type lossySender struct {
+	pb.MessageSender
+	lost   int
+	tokens [][]byte
+}
+
+func (ls *lossySender) SendRequest(ctx context.Context, p peer.ID, pmes *pb.Message) (*pb.Message, error) {
+	ls.tokens = append(ls.tokens, pmes.GetIdempotencyToken())
+	resp, err := ls.MessageSender.SendRequest(ctx, p, pmes)
+	if err == nil && ls.lost > 0 {
+		ls.lost--
+		return nil, fmt.Errorf("response lost")
+	}
+	return resp, err
+}
+
+func TestMutationRetries(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	handled := make(chan struct{}, 10)
+	count := func(next RequestHandler) RequestHandler {
+		return func(ctx context.Context, p peer.ID, req *pb.Message) (*pb.Message, error) {
+			if req.GetType() == pb.Message_PUT_VALUE {
+				handled <- struct{}{}
+			}
+			return next(ctx, p, req)
+		}
+	}
+	server := setupDHT(ctx, t, false, HandlerMiddleware(count))
+	client := setupDHT(ctx, t, false)
+	for _, d := range []*IpfsDHT{server, client} {
+		defer d.Close()
+		defer d.host.Close()
+	}
+	connect(t, ctx, client, server)
+
+	sender := &lossySender{MessageSender: client.msgSender, lost: 2}
+	pm, err := pb.NewProtocolMessenger(sender, pb.WithMutationRetries(2, time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := &recpb.Record{Key: []byte("/v/hello"), Value: []byte("world")}
+	if err := pm.PutValue(ctx, server.self, rec); err != nil {
+		t.Fatal(err)
+	}
+
+	// all the attempts carry the same token, and the server stored the value once
+	if len(sender.tokens) != 3 || len(sender.tokens[0]) == 0 {
+		t.Fatalf("expected 3 attempts with a token, got %d", len(sender.tokens))
+	}
+	for _, token := range sender.tokens[1:] {
+		if !bytes.Equal(token, sender.tokens[0]) {
+			t.Fatal("expected the retries to carry the token of the first attempt")
+		}
+	}
+	if n := len(handled); n != 1 {
+		t.Fatalf("expected the value to be put once, got %d", n)
+	}
+
+	// the token only deduplicates the requests of its sender
+	other := setupDHT(ctx, t, false)
+	defer other.Close()
+	defer other.host.Close()
+	connect(t, ctx, other, server)
+	req := pb.NewMessage(pb.Message_PUT_VALUE, rec.Key, 0)
+	req.Record = rec
+	req.IdempotencyToken = sender.tokens[0]
+	if _, err := other.msgSender.SendRequest(ctx, server.self, req); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(handled); n != 2 {
+		t.Fatalf("expected the value to be put twice, got %d", n)
+	}
+
+	// and further attempts are given up on
+	sender.lost = 3
+	if err := pm.PutValue(ctx, server.self, rec); err == nil {
+		t.Fatal("expected the put to fail after 2 retries")
+	}
+}
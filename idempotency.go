@@ -0,0 +1,97 @@
+package dht
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	lru "github.com/hashicorp/golang-lru/simplelru"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"go.opencensus.io/stats"
+
+	"github.com/libp2p/go-libp2p-kad-dht/metrics"
+	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
+)
+
+const (
+	// idempotentRequestsSize is the number of mutating requests whose
+	// idempotency tokens are remembered.
+	idempotentRequestsSize = 4096
+	// idempotentRequestsTTL is how long they are remembered, which must
+	// outlast the retries of their senders.
+	idempotentRequestsTTL = 2 * time.Minute
+)
+
+// idempotentRequests remembers the mutating requests carrying an idempotency
+// token we handled, and answers their retransmissions with the response we
+// sent without handling them again.
+type idempotentRequests struct {
+	mu      sync.Mutex
+	entries *lru.LRU
+}
+
+type idempotentEntry struct {
+	// closed once handled, resp and err are set then
+	done    chan struct{}
+	resp    *pb.Message
+	err     error
+	expires time.Time
+}
+
+func newIdempotentRequests() *idempotentRequests {
+	// can only fail on a non-positive size
+	entries, _ := lru.NewLRU(idempotentRequestsSize, nil)
+	return &idempotentRequests{entries: entries}
+}
+
+// handle handles req from p with handler, unless it is the retransmission of
+// a request handled already, or being handled, in which case it is answered
+// with the same response. Tokens are scoped to their sender. Failed requests
+// are forgotten, so that their retransmissions are handled again.
+func (ir *idempotentRequests) handle(ctx context.Context, p peer.ID, req *pb.Message, handler func() (*pb.Message, error)) (*pb.Message, error) {
+	token := req.GetIdempotencyToken()
+	if len(token) == 0 || !pb.IsMutatingRequest(req.GetType()) {
+		return handler()
+	}
+	key := string(p) + "/" + string(token)
+
+	now := time.Now()
+	ir.mu.Lock()
+	if v, ok := ir.entries.Get(key); ok {
+		if e := v.(*idempotentEntry); now.Before(e.expires) {
+			ir.mu.Unlock()
+			stats.Record(ctx, metrics.DuplicateRequests.M(1))
+			select {
+			case <-e.done:
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+			if e.err != nil || e.resp == nil {
+				return nil, e.err
+			}
+			// the response is modified on its way out
+			return proto.Clone(e.resp).(*pb.Message), nil
+		}
+	}
+	e := &idempotentEntry{done: make(chan struct{}), expires: now.Add(idempotentRequestsTTL)}
+	ir.entries.Add(key, e)
+	ir.mu.Unlock()
+
+	resp, err := handler()
+	if err != nil {
+		ir.mu.Lock()
+		if v, ok := ir.entries.Peek(key); ok && v == e {
+			ir.entries.Remove(key)
+		}
+		ir.mu.Unlock()
+		e.err = err
+		close(e.done)
+		return nil, err
+	}
+	if resp != nil {
+		e.resp = proto.Clone(resp).(*pb.Message)
+	}
+	close(e.done)
+	return resp, nil
+}
@@ -1,18 +1,25 @@
 package config
 
 import (
+	"context"
 	"fmt"
+	"net"
+	"net/url"
 	"time"
 
+	"github.com/ipfs/go-cid"
 	ds "github.com/ipfs/go-datastore"
 	dssync "github.com/ipfs/go-datastore/sync"
 	"github.com/ipfs/go-ipns"
+	"github.com/libp2p/go-libp2p-core/connmgr"
 	"github.com/libp2p/go-libp2p-core/host"
 	"github.com/libp2p/go-libp2p-core/peer"
 	"github.com/libp2p/go-libp2p-core/protocol"
+	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
 	"github.com/libp2p/go-libp2p-kad-dht/providers"
 	"github.com/libp2p/go-libp2p-kbucket/peerdiversity"
 	record "github.com/libp2p/go-libp2p-record"
+	ma "github.com/multiformats/go-multiaddr"
 )
 
 // DefaultPrefix is the application specific prefix attached to all DHT protocols by default.
@@ -23,6 +30,9 @@ const defaultBucketSize = 20
 // ModeOpt describes what mode the dht should operate in
 type ModeOpt int
 
+// AddrFamilyPolicy describes which address family to prefer
+type AddrFamilyPolicy int
+
 // QueryFilterFunc is a filter applied when considering peers to dial when querying
 type QueryFilterFunc func(dht interface{}, ai peer.AddrInfo) bool
 
@@ -30,22 +40,281 @@ type QueryFilterFunc func(dht interface{}, ai peer.AddrInfo) bool
 // the local route table.
 type RouteTableFilterFunc func(dht interface{}, p peer.ID) bool
 
+// AddressFilterFunc is a filter applied to the peer addresses exchanged in
+// responses.
+type AddressFilterFunc func(dht interface{}, a ma.Multiaddr) bool
+
+// ConflictResolverFunc picks the value to keep among divergent values found for
+// the same key. It returns the index of the chosen value.
+type ConflictResolverFunc func(key string, vals [][]byte) (int, error)
+
+// CachePolicyFunc decides whether a value, or the providers of a key, found by a
+// lookup should be cached. It is passed a nil value for providers.
+type CachePolicyFunc func(key string, value []byte) bool
+
+// KeyMapperFunc maps the key of a record, without its namespace, to the key it
+// is stored and routed under within the same namespace.
+type KeyMapperFunc func(key string) string
+
+// KeyChanFunc streams the keys to reprovide. The channel is closed once all the
+// keys were sent.
+type KeyChanFunc func(ctx context.Context) (<-chan cid.Cid, error)
+
+// RecordCipher encrypts the records persisted to the datastore, and decrypts
+// them as they are read back.
+type RecordCipher interface {
+	// Seal encrypts the value stored under key.
+	Seal(key ds.Key, plaintext []byte) ([]byte, error)
+	// Open decrypts the value read from under key.
+	Open(key ds.Key, ciphertext []byte) ([]byte, error)
+}
+
+// RequestHandler handles an inbound request from a peer, and returns the
+// response to send back, if any.
+type RequestHandler func(ctx context.Context, p peer.ID, req *pb.Message) (*pb.Message, error)
+
+// RequestMiddleware wraps the handling of inbound requests.
+type RequestMiddleware func(next RequestHandler) RequestHandler
+
+// LatencyAnomalyKind tells which rate of the lookups deviates from its
+// baseline.
+type LatencyAnomalyKind int
+
+// LatencyAnomaly describes a deviation of the lookups from their baseline.
+type LatencyAnomaly struct {
+	Kind LatencyAnomalyKind
+	// Value is the recent value of the rate, and Baseline its long run value.
+	Value    float64
+	Baseline float64
+	// Deviation is how far Value is from Baseline, in standard deviations.
+	Deviation float64
+	// Ended is set once the rate is back to its baseline.
+	Ended bool
+}
+
+// LatencyAnomalyFunc is called with the anomalies of the lookups as they start
+// and end.
+type LatencyAnomalyFunc func(a LatencyAnomaly)
+
+// ReproviderTier is a set of keys reprovided on its own schedule.
+type ReproviderTier struct {
+	Name     string
+	Keys     KeyChanFunc
+	Interval time.Duration
+}
+
 // Config is a structure containing all the options that can be used when constructing a DHT.
 type Config struct {
-	Datastore          ds.Batching
-	Validator          record.Validator
-	ValidatorChanged   bool // if true implies that the validator has been changed and that Defaults should not be used
-	Mode               ModeOpt
-	ProtocolPrefix     protocol.ID
-	V1ProtocolOverride protocol.ID
-	BucketSize         int
-	Concurrency        int
-	Resiliency         int
-	MaxRecordAge       time.Duration
-	EnableProviders    bool
-	EnableValues       bool
-	ProviderStore      providers.ProviderStore
-	QueryPeerFilter    QueryFilterFunc
+	Datastore           ds.Batching
+	RecordCipher        RecordCipher
+	Validator           record.Validator
+	ValidatorChanged    bool // if true implies that the validator has been changed and that Defaults should not be used
+	Mode                ModeOpt
+	ProtocolPrefix      protocol.ID
+	V1ProtocolOverride  protocol.ID
+	BucketSize          int
+	ReplicationFactor   int
+	Concurrency         int
+	Resiliency          int
+	MaxRecordAge        time.Duration
+	NamespaceMaxAges    map[string]time.Duration
+	RepublishInterval   time.Duration
+	MaxRecordSize       int
+	OfflineQueueSize    int
+	RequestPipelining   int
+	MessageCompression  bool
+	EnableProviders     bool
+	EnableValues        bool
+	DoubleHashProviders bool
+	SignProviderRecords bool
+	StrictValidation    bool
+	StreamProviders     bool
+	DeadlineHints       bool
+	TransferProtocols   []string
+	ProviderRecordTTL   time.Duration
+	ProviderStore       providers.ProviderStore
+	QueryPeerFilter     QueryFilterFunc
+	ConnectionGater     connmgr.ConnectionGater
+	ConflictResolver    ConflictResolverFunc
+	KeyMappers          map[string]KeyMapperFunc
+	ReproviderTiers     []ReproviderTier
+	RequestMiddlewares  []RequestMiddleware
+	RequestTimeouts     map[pb.Message_MessageType]time.Duration
+
+	// PrivateNetwork enables the private network profile, for hosts whose
+	// connections are protected with a pre-shared key, and
+	// PrivateNetworkProtocols also moves the DHT protocols under the private
+	// network prefix.
+	PrivateNetwork          bool
+	PrivateNetworkProtocols bool
+
+	// FastBootstrap dials the bootstrap peers at once and looks ourselves up
+	// as soon as the routing table has a peer, and MinPeers is the size of the
+	// routing table the DHT is ready at.
+	FastBootstrap struct {
+		Enabled  bool
+		MinPeers int
+	}
+
+	// MinimalClient enables the minimal client profile, keeping at most
+	// MaxPeers peers in the routing table.
+	MinimalClient struct {
+		Enabled  bool
+		MaxPeers int
+	}
+
+	// ResponseAddressFilter and QueryAddressFilter, if set, filter the peer
+	// addresses in the responses we send and get.
+	ResponseAddressFilter AddressFilterFunc
+	QueryAddressFilter    AddressFilterFunc
+
+	RecordCompression struct {
+		Enabled   bool
+		Threshold int
+	}
+
+	ProvideConcurrency struct {
+		Lookups int
+		RPCs    int
+	}
+
+	LookupCache struct {
+		Enabled bool
+		TTL     time.Duration
+		Policy  CachePolicyFunc
+	}
+
+	// ProviderRateLimit limits the rate, in records per second, at which
+	// provider records are accepted from a single peer and for a single key.
+	ProviderRateLimit struct {
+		PeerRate  float64
+		PeerBurst int
+		KeyRate   float64
+		KeyBurst  int
+	}
+
+	// RequestRateLimit limits the rate, in requests per second, at which
+	// inbound requests from a single peer, and from a single subnet, are
+	// handled. Requests from the Allowlist networks aren't limited.
+	RequestRateLimit struct {
+		Rate        float64
+		Burst       int
+		SubnetRate  float64
+		SubnetBurst int
+		Allowlist   []*net.IPNet
+	}
+
+	// InboundQoS bounds the inbound requests handled at once to Workers,
+	// handling the waiting ones by priority, with at most MaxQueued waiting
+	// per class.
+	InboundQoS struct {
+		Workers   int
+		MaxQueued int
+	}
+
+	// AddrFamily orders the addresses we send by family preference, and dials
+	// the lookup candidates at the addresses of the other family after
+	// FallbackDelay or a failed dial.
+	AddrFamily struct {
+		Policy        AddrFamilyPolicy
+		FallbackDelay time.Duration
+	}
+
+	// CloserPeersCache caches the closer peers we answer requests with for
+	// TTL, for up to Size keys.
+	CloserPeersCache struct {
+		TTL  time.Duration
+		Size int
+	}
+
+	// ObservedAddrs tells requesters the address we observe them at, if
+	// Feedback is set, and hands Handler the addresses peers observe us at.
+	ObservedAddrs struct {
+		Feedback bool
+		Handler  pb.ObservedAddrHandler
+	}
+
+	// MutationRetries retries the PUT_VALUE and ADD_PROVIDER requests we send
+	// up to Retries times, with an exponential backoff starting at Backoff.
+	MutationRetries struct {
+		Retries int
+		Backoff time.Duration
+	}
+
+	// ShutdownGracePeriod, if positive, is how long Close waits for the
+	// in-flight work to complete.
+	ShutdownGracePeriod time.Duration
+
+	// LookupLogs logs one structured record per completed lookup.
+	LookupLogs bool
+
+	// LookupSampling is the fraction of the lookups traced, and logged if
+	// LookupLogs is set.
+	LookupSampling float64
+
+	// DebugListenAddr, if set, is the TCP address of the debug server.
+	DebugListenAddr string
+
+	// LatencyWeight weighs the latency of the peers against their distance
+	// to the key when picking the peers lookups query next, from 0 to 1.
+	LatencyWeight float64
+
+	// LookupExperiment runs a shadow lookup, picking the peers to query with
+	// Weight as the latency weight, for the Fraction of the lookups sampled.
+	LookupExperiment struct {
+		Fraction float64
+		Weight   float64
+	}
+
+	// LatencyAnomaly calls Handler once the latency or the timeout rate of
+	// the lookups exceeds its baseline by Threshold standard deviations.
+	LatencyAnomaly struct {
+		Handler   LatencyAnomalyFunc
+		Threshold float64
+	}
+
+	// MetricsName labels the metrics of the DHT, the V1Protocol if empty.
+	MetricsName string
+
+	// PeerLatencyBuckets, if positive, records the latency of the requests
+	// sent to each remote peer, hashed to one of that many buckets.
+	PeerLatencyBuckets int
+
+	// ResponseSignatures signs our FIND_NODE and GET_PROVIDERS responses and
+	// verifies the ones we get.
+	ResponseSignatures struct {
+		Sign   bool
+		Verify bool
+	}
+
+	// DatagramQueries sends lookup requests over UDP datagrams to the peers
+	// supporting it, listening on ListenAddr.
+	DatagramQueries struct {
+		Enabled    bool
+		ListenAddr string
+	}
+
+	// HTTPFallback sends requests over HTTP to the peers we can't dial that
+	// advertise an HTTP endpoint, starting lookups from Seeds when our routing
+	// table is empty.
+	HTTPFallback struct {
+		Enabled bool
+		Seeds   []peer.AddrInfo
+	}
+
+	// DelegatedRouting queries the delegated routing HTTP API at Endpoint
+	// for the providers and the peers the DHT doesn't find, or for the
+	// providers it doesn't find within Delay.
+	DelegatedRouting struct {
+		Endpoint string
+		Delay    time.Duration
+	}
+
+	// StreamPool bounds the streams kept open to peers between requests.
+	StreamPool struct {
+		MaxSize     int
+		IdleTimeout time.Duration
+	}
 
 	RoutingTable struct {
 		RefreshQueryTimeout time.Duration
@@ -96,6 +365,17 @@ func (c *Config) ApplyFallbacks(h host.Host) error {
 	return nil
 }
 
+// kad1 is the DHT protocol, prefixed by the ProtocolPrefix.
+const kad1 protocol.ID = "/kad/1.0.0"
+
+// V1Protocol returns the DHT protocol ID, e.g. /ipfs/kad/1.0.0.
+func (c *Config) V1Protocol() protocol.ID {
+	if c.V1ProtocolOverride != "" {
+		return c.V1ProtocolOverride
+	}
+	return c.ProtocolPrefix + kad1
+}
+
 // Option DHT option type.
 type Option func(*Config) error
 
@@ -120,10 +400,147 @@ var Defaults = func(o *Config) error {
 	o.Concurrency = 10
 	o.Resiliency = 3
 
+	o.LookupSampling = 1
+
 	return nil
 }
 
 func (c *Config) Validate() error {
+	if c.RecordCompression.Threshold < 0 {
+		return fmt.Errorf("record compression threshold must not be negative, got %d", c.RecordCompression.Threshold)
+	}
+
+	if rl := c.ProviderRateLimit; rl.PeerRate < 0 || rl.KeyRate < 0 ||
+		(rl.PeerRate > 0 && rl.PeerBurst < 1) || (rl.KeyRate > 0 && rl.KeyBurst < 1) {
+		return fmt.Errorf("provider rate limits must not be negative and allow bursts of at least one record")
+	}
+
+	if rl := c.RequestRateLimit; rl.Rate < 0 || rl.SubnetRate < 0 ||
+		(rl.Rate > 0 && rl.Burst < 1) || (rl.SubnetRate > 0 && rl.SubnetBurst < 1) {
+		return fmt.Errorf("request rate limits must not be negative and allow bursts of at least one request")
+	}
+
+	if c.LookupCache.Enabled && c.LookupCache.TTL < time.Second {
+		return fmt.Errorf("lookup cache ttl must be at least a second, got %s", c.LookupCache.TTL)
+	}
+
+	tierNames := make(map[string]struct{}, len(c.ReproviderTiers))
+	for _, tier := range c.ReproviderTiers {
+		if tier.Name == "" || tier.Keys == nil {
+			return fmt.Errorf("reprovider tiers need a name and a key source")
+		}
+		if _, ok := tierNames[tier.Name]; ok {
+			return fmt.Errorf("duplicate reprovider tier %s", tier.Name)
+		}
+		tierNames[tier.Name] = struct{}{}
+		if tier.Interval <= 0 || tier.Interval >= providers.ProvideValidity {
+			return fmt.Errorf("reprovide interval %s of tier %s must be positive and shorter than the provider record validity %s",
+				tier.Interval, tier.Name, providers.ProvideValidity)
+		}
+	}
+
+	if ttl := c.ProviderRecordTTL; ttl != 0 && (ttl < time.Second || ttl > providers.ProvideValidity) {
+		return fmt.Errorf("provider record ttl must be between a second and the provider record validity %s, got %s",
+			providers.ProvideValidity, ttl)
+	}
+
+	if c.ProvideConcurrency.Lookups < 0 || c.ProvideConcurrency.RPCs < 0 {
+		return fmt.Errorf("provide concurrency limits must not be negative")
+	}
+
+	if c.LatencyWeight < 0 || c.LatencyWeight > 1 {
+		return fmt.Errorf("latency weight must be between 0 and 1, got %v", c.LatencyWeight)
+	}
+
+	if c.LookupSampling < 0 || c.LookupSampling > 1 {
+		return fmt.Errorf("lookup sampling must be between 0 and 1, got %v", c.LookupSampling)
+	}
+
+	if e := c.LookupExperiment; e.Fraction < 0 || e.Fraction > 1 || e.Weight < 0 || e.Weight > 1 {
+		return fmt.Errorf("lookup experiment fraction and weight must be between 0 and 1, got %v and %v", e.Fraction, e.Weight)
+	}
+
+	if d := c.DelegatedRouting; d.Endpoint != "" {
+		if u, err := url.Parse(d.Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid delegated routing endpoint %q", d.Endpoint)
+		}
+		if d.Delay < 0 {
+			return fmt.Errorf("delegated routing delay must not be negative, got %s", d.Delay)
+		}
+	}
+
+	if c.FastBootstrap.MinPeers < 0 {
+		return fmt.Errorf("fast bootstrap minimum routing table size must not be negative, got %d", c.FastBootstrap.MinPeers)
+	}
+
+	if c.MinimalClient.MaxPeers < 0 {
+		return fmt.Errorf("minimal client routing table size must not be negative, got %d", c.MinimalClient.MaxPeers)
+	}
+
+	if c.LatencyAnomaly.Threshold < 0 {
+		return fmt.Errorf("latency anomaly threshold must not be negative, got %v", c.LatencyAnomaly.Threshold)
+	}
+
+	if c.PeerLatencyBuckets < 0 {
+		return fmt.Errorf("peer latency buckets must not be negative, got %d", c.PeerLatencyBuckets)
+	}
+
+	if c.RequestPipelining < 0 {
+		return fmt.Errorf("request pipelining limit must not be negative, got %d", c.RequestPipelining)
+	}
+
+	for t, timeout := range c.RequestTimeouts {
+		if timeout <= 0 {
+			return fmt.Errorf("timeout of %s requests must be positive, got %s", t, timeout)
+		}
+	}
+
+	if c.InboundQoS.Workers < 0 || c.InboundQoS.MaxQueued < 0 {
+		return fmt.Errorf("inbound request workers and queue size must not be negative")
+	}
+
+	if c.AddrFamily.Policy < 0 || c.AddrFamily.Policy > 2 || c.AddrFamily.FallbackDelay < 0 {
+		return fmt.Errorf("invalid address family policy %d or fallback delay %s", c.AddrFamily.Policy, c.AddrFamily.FallbackDelay)
+	}
+
+	if c.CloserPeersCache.TTL < 0 || c.CloserPeersCache.Size < 0 {
+		return fmt.Errorf("closer peers cache ttl and size must not be negative")
+	}
+
+	if c.MutationRetries.Retries < 0 || c.MutationRetries.Backoff < 0 {
+		return fmt.Errorf("mutation retries and backoff must not be negative")
+	}
+
+	if c.ShutdownGracePeriod < 0 {
+		return fmt.Errorf("shutdown grace period must not be negative, got %s", c.ShutdownGracePeriod)
+	}
+
+	if c.StreamPool.MaxSize < 0 || c.StreamPool.IdleTimeout < 0 {
+		return fmt.Errorf("stream pool size and idle timeout must not be negative")
+	}
+
+	if c.OfflineQueueSize < 0 {
+		return fmt.Errorf("offline queue size must not be negative, got %d", c.OfflineQueueSize)
+	}
+
+	if c.ReplicationFactor < 0 {
+		return fmt.Errorf("replication factor must not be negative, got %d", c.ReplicationFactor)
+	}
+
+	if c.MaxRecordSize < 0 {
+		return fmt.Errorf("max record size must not be negative, got %d", c.MaxRecordSize)
+	}
+
+	if c.RepublishInterval < 0 || (c.RepublishInterval > 0 && c.RepublishInterval >= c.MaxRecordAge) {
+		return fmt.Errorf("value republish interval %s must be positive and shorter than the max record age %s", c.RepublishInterval, c.MaxRecordAge)
+	}
+
+	for ns, maxAge := range c.NamespaceMaxAges {
+		if maxAge <= 0 || (c.RepublishInterval > 0 && c.RepublishInterval >= maxAge) {
+			return fmt.Errorf("max record age %s of namespace %q must be positive and longer than the value republish interval", maxAge, ns)
+		}
+	}
+
 	if c.ProtocolPrefix != DefaultPrefix {
 		return nil
 	}
@@ -0,0 +1,5 @@
+package config
+
+// CrossValidateOptionKey is the routing option key under which the report
+// filled by a cross-validating GetValue is passed.
+type CrossValidateOptionKey struct{}
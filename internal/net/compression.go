@@ -0,0 +1,78 @@
+package net
+
+import (
+	"encoding/binary"
+	"strings"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
+
+	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
+)
+
+// compressedSuffix marks the protocol variants whose messages are compressed
+// with zstd, e.g. /ipfs/kad/1.0.0+zstd. Messages are still length delimited,
+// the length being the one of the compressed message.
+const compressedSuffix = "+zstd"
+
+// CompressedProtocol returns the compressed variant of a DHT protocol.
+func CompressedProtocol(p protocol.ID) protocol.ID {
+	return p + compressedSuffix
+}
+
+// IsCompressedProtocol returns whether p is a compressed protocol variant.
+func IsCompressedProtocol(p protocol.ID) bool {
+	return strings.HasSuffix(string(p), compressedSuffix)
+}
+
+// protocolsFor returns the protocols to open streams to p with, leaving out the
+// compressed variants if p is known not to speak them.
+func (m *messageSenderImpl) protocolsFor(p peer.ID) []protocol.ID {
+	caps, ok := pb.PeerCapabilities(m.host.Peerstore(), p)
+	if !ok || caps.Has(pb.CapMessageCompression) {
+		return m.protocols
+	}
+	protos := make([]protocol.ID, 0, len(m.protocols))
+	for _, proto := range m.protocols {
+		if !IsCompressedProtocol(proto) {
+			protos = append(protos, proto)
+		}
+	}
+	return protos
+}
+
+// WriteStreamMsg writes a message to s, compressing it if s speaks a
+// compressed protocol variant.
+func WriteStreamMsg(s network.Stream, mes *pb.Message) error {
+	if !IsCompressedProtocol(s.Protocol()) {
+		return WriteMsg(s, mes)
+	}
+
+	b, err := mes.Marshal()
+	if err != nil {
+		return err
+	}
+	b, err = pb.CompressMessage(b)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, binary.MaxVarintLen64+len(b))
+	n := binary.PutUvarint(buf, uint64(len(b)))
+	n += copy(buf[n:], b)
+	_, err = s.Write(buf[:n])
+	return err
+}
+
+// UnmarshalStreamMsg unmarshals a message read from s, decompressing it if s
+// speaks a compressed protocol variant. Decompressed messages larger than
+// maxSize bytes are rejected.
+func UnmarshalStreamMsg(s network.Stream, b []byte, mes *pb.Message, maxSize int) error {
+	if IsCompressedProtocol(s.Protocol()) {
+		var err error
+		if b, err = pb.DecompressMessage(b, maxSize); err != nil {
+			return err
+		}
+	}
+	return mes.Unmarshal(b)
+}
@@ -0,0 +1,589 @@
+package net
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	stdnet "net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
+	manet "github.com/multiformats/go-multiaddr/net"
+
+	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
+)
+
+// Datagrams are authenticated with a session key handed out over a stream of
+// the session protocol, which is secured by the libp2p connection. They read
+//
+//	kind (1 byte) | session id (16 bytes) | message | HMAC-SHA256 (32 bytes)
+//
+// with the HMAC covering everything before it. Servers only answer datagrams
+// coming from the IP address the session was handed out to, so they can't be
+// used to reflect traffic to spoofed addresses, and drop the requests whose id
+// they saw already in the session, so they can't be replayed.
+const (
+	dgRequest byte = iota
+	dgResponse
+	// dgTooLarge tells the client to send the request over a stream, the
+	// response doesn't fit in a datagram. The message only has the request id.
+	dgTooLarge
+)
+
+const (
+	sessionIDSize  = 16
+	sessionKeySize = 32
+	macSize        = sha256.Size
+
+	// sessionGrantSize is the size of a session handed out over a stream: the
+	// UDP port of the server, the session id and the session key.
+	sessionGrantSize = 2 + sessionIDSize + sessionKeySize
+
+	datagramHeaderSize = 1 + sessionIDSize
+)
+
+var (
+	// maxDatagramSize is the largest datagram sent. Responses over the path
+	// MTU rely on IP fragmentation, and are re-requested over a stream if
+	// lost.
+	maxDatagramSize = 8192
+
+	// datagramSessionTTL is how long a session stays valid.
+	datagramSessionTTL = 10 * time.Minute
+
+	// minDatagramTimeout and maxDatagramTimeout bound how long a response is
+	// waited for before falling back to a stream, three times the measured
+	// latency to the peer, or defaultDatagramTimeout if unknown.
+	minDatagramTimeout     = 50 * time.Millisecond
+	maxDatagramTimeout     = time.Second
+	defaultDatagramTimeout = 500 * time.Millisecond
+
+	// maxDatagramRequests bounds the number of datagram requests handled
+	// concurrently, the ones over it are dropped.
+	maxDatagramRequests = 64
+
+	// datagramReplayWindow is the number of request ids remembered per
+	// session to drop replayed requests.
+	datagramReplayWindow = 256
+)
+
+// InboundHandler handles a request received outside of a libp2p stream, e.g.
+// over a datagram, and writes its response, if any, with write. It returns
+// false if the request failed.
+type InboundHandler func(ctx context.Context, p peer.ID, req *pb.Message, msgLen int, write func(*pb.Message) error) bool
+
+type remoteIPKey struct{}
+
+// withRemoteIP records the IP address a request handed to an InboundHandler
+// came from.
+func withRemoteIP(ctx context.Context, ip stdnet.IP) context.Context {
+	return context.WithValue(ctx, remoteIPKey{}, ip)
+}
+
+// RemoteIP returns the IP address a request handed to an InboundHandler came
+// from, if known.
+func RemoteIP(ctx context.Context) (stdnet.IP, bool) {
+	ip, ok := ctx.Value(remoteIPKey{}).(stdnet.IP)
+	return ip, ok
+}
+
+type sessionID [sessionIDSize]byte
+
+// serverSession is a session handed out to a peer.
+type serverSession struct {
+	p       peer.ID
+	ip      stdnet.IP
+	key     []byte
+	expires time.Time
+
+	// seen holds the ids of the last datagramReplayWindow requests, in the
+	// order received in recent, and floor is the highest id forgotten since.
+	seen   map[uint64]struct{}
+	recent []uint64
+	floor  uint64
+}
+
+// fresh records the request id and reports whether it wasn't seen before. The
+// ids are unique per client, so a request seen again is a replay. Requests
+// older than the ids remembered are dropped too, as they can't be told apart
+// from replays.
+func (s *serverSession) fresh(id uint64) bool {
+	if id <= s.floor {
+		return false
+	}
+	if _, ok := s.seen[id]; ok {
+		return false
+	}
+	if s.seen == nil {
+		s.seen = make(map[uint64]struct{}, datagramReplayWindow)
+	}
+	if len(s.recent) == datagramReplayWindow {
+		old := s.recent[0]
+		s.recent = s.recent[1:]
+		delete(s.seen, old)
+		if old > s.floor {
+			s.floor = old
+		}
+	}
+	s.seen[id] = struct{}{}
+	s.recent = append(s.recent, id)
+	return true
+}
+
+// clientSession is a session handed out by a peer. It is ready once ready is
+// closed, if err is nil.
+type clientSession struct {
+	ready   chan struct{}
+	err     error
+	addr    *stdnet.UDPAddr
+	id      sessionID
+	key     []byte
+	expires time.Time
+}
+
+type pendingDatagram struct {
+	p    peer.ID
+	resp chan *pb.Message
+}
+
+// DatagramTransport sends FIND_NODE and GET_PROVIDERS requests over UDP
+// datagrams to the peers supporting it, sparing the stream setup round trips.
+// Other requests, and requests whose response is lost or too large, are sent
+// over streams. It also answers the datagram requests of other peers.
+type DatagramTransport struct {
+	host    host.Host
+	proto   protocol.ID
+	conn    stdnet.PacketConn
+	port    int
+	streams pb.MessageSender
+	handler InboundHandler
+	ctx     context.Context
+	cancel  context.CancelFunc
+
+	requestID uint64 // atomic
+	handling  chan struct{}
+
+	mu       sync.Mutex
+	issued   map[sessionID]*serverSession
+	byPeer   map[peer.ID]sessionID
+	sessions map[peer.ID]*clientSession
+	bySID    map[sessionID]peer.ID
+	pending  map[uint64]pendingDatagram
+}
+
+var _ pb.MessageSender = (*DatagramTransport)(nil)
+
+// NewDatagramTransport listens for datagrams on the UDP address listenAddr,
+// e.g. ":0" for any port. Requests not sent over datagrams are sent with
+// streams, and the received ones are handed to handler. Sessions are handed out
+// to peers over streams of the proto protocol, see HandleSessionStream.
+func NewDatagramTransport(h host.Host, listenAddr string, proto protocol.ID, streams pb.MessageSender, handler InboundHandler) (*DatagramTransport, error) {
+	conn, err := stdnet.ListenPacket("udp", listenAddr)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t := &DatagramTransport{
+		host:     h,
+		proto:    proto,
+		conn:     conn,
+		port:     conn.LocalAddr().(*stdnet.UDPAddr).Port,
+		streams:  streams,
+		handler:  handler,
+		ctx:      ctx,
+		cancel:   cancel,
+		handling: make(chan struct{}, maxDatagramRequests),
+		issued:   make(map[sessionID]*serverSession),
+		byPeer:   make(map[peer.ID]sessionID),
+		sessions: make(map[peer.ID]*clientSession),
+		bySID:    make(map[sessionID]peer.ID),
+		pending:  make(map[uint64]pendingDatagram),
+	}
+	go t.readLoop()
+	return t, nil
+}
+
+// Close stops listening for datagrams.
+func (t *DatagramTransport) Close() error {
+	t.cancel()
+	return t.conn.Close()
+}
+
+// Protocol returns the session protocol.
+func (t *DatagramTransport) Protocol() protocol.ID {
+	return t.proto
+}
+
+// RevokeSessions invalidates the sessions handed out, e.g. as we stop answering
+// requests.
+func (t *DatagramTransport) RevokeSessions() {
+	t.mu.Lock()
+	t.issued = make(map[sessionID]*serverSession)
+	t.byPeer = make(map[peer.ID]sessionID)
+	t.mu.Unlock()
+}
+
+// SendRequest sends FIND_NODE and GET_PROVIDERS requests over a datagram if the
+// peer supports it, and all the other requests over a stream.
+func (t *DatagramTransport) SendRequest(ctx context.Context, p peer.ID, pmes *pb.Message) (*pb.Message, error) {
+	switch pmes.GetType() {
+	case pb.Message_FIND_NODE, pb.Message_GET_PROVIDERS:
+		if resp := t.request(ctx, p, pmes); resp != nil {
+			return resp, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+	}
+	return t.streams.SendRequest(ctx, p, pmes)
+}
+
+// SendMessage sends a message over a stream.
+func (t *DatagramTransport) SendMessage(ctx context.Context, p peer.ID, pmes *pb.Message) error {
+	return t.streams.SendMessage(ctx, p, pmes)
+}
+
+// OnDisconnect forgets the sessions with the peer.
+func (t *DatagramTransport) OnDisconnect(ctx context.Context, p peer.ID) {
+	t.mu.Lock()
+	if sid, ok := t.byPeer[p]; ok {
+		delete(t.issued, sid)
+		delete(t.byPeer, p)
+	}
+	if s, ok := t.sessions[p]; ok {
+		delete(t.sessions, p)
+		delete(t.bySID, s.id)
+	}
+	t.mu.Unlock()
+
+	if d, ok := t.streams.(interface {
+		OnDisconnect(context.Context, peer.ID)
+	}); ok {
+		d.OnDisconnect(ctx, p)
+	}
+}
+
+// request sends a request over a datagram, and returns its response or nil if
+// it must be sent over a stream.
+func (t *DatagramTransport) request(ctx context.Context, p peer.ID, pmes *pb.Message) *pb.Message {
+	s := t.session(ctx, p)
+	if s == nil {
+		return nil
+	}
+
+	req := *pmes
+	req.RequestId = atomic.AddUint64(&t.requestID, 1)
+	b, err := req.Marshal()
+	if err != nil || datagramHeaderSize+len(b)+macSize > maxDatagramSize {
+		return nil
+	}
+
+	resp := make(chan *pb.Message, 1)
+	t.mu.Lock()
+	t.pending[req.RequestId] = pendingDatagram{p: p, resp: resp}
+	t.mu.Unlock()
+	defer func() {
+		t.mu.Lock()
+		delete(t.pending, req.RequestId)
+		t.mu.Unlock()
+	}()
+
+	if _, err := t.conn.WriteTo(seal(dgRequest, s.id, s.key, b), s.addr); err != nil {
+		logger.Debugw("failed to send datagram", "error", err, "to", p)
+		return nil
+	}
+
+	timer := time.NewTimer(t.timeout(p))
+	defer timer.Stop()
+	select {
+	case mes := <-resp:
+		return mes
+	case <-timer.C:
+		logger.Debugw("datagram response timed out", "to", p)
+		return nil
+	case <-ctx.Done():
+		return nil
+	}
+}
+
+// timeout returns how long to wait for a response from p.
+func (t *DatagramTransport) timeout(p peer.ID) time.Duration {
+	lat := t.host.Peerstore().LatencyEWMA(p)
+	if lat == 0 {
+		return defaultDatagramTimeout
+	}
+	d := 3 * lat
+	if d < minDatagramTimeout {
+		return minDatagramTimeout
+	}
+	if d > maxDatagramTimeout {
+		return maxDatagramTimeout
+	}
+	return d
+}
+
+// session returns a session with p, getting one if needed, or nil if p doesn't
+// support datagrams.
+func (t *DatagramTransport) session(ctx context.Context, p peer.ID) *clientSession {
+	t.mu.Lock()
+	s, ok := t.sessions[p]
+	if ok {
+		select {
+		case <-s.ready:
+			if s.err == nil && time.Now().After(s.expires) {
+				// expired, get a new one
+				delete(t.sessions, p)
+				delete(t.bySID, s.id)
+				ok = false
+			}
+		default:
+		}
+	}
+	if !ok {
+		if supported, err := t.host.Peerstore().SupportsProtocols(p, string(t.proto)); err != nil || len(supported) == 0 {
+			t.mu.Unlock()
+			return nil
+		}
+		s = &clientSession{ready: make(chan struct{})}
+		t.sessions[p] = s
+		t.mu.Unlock()
+
+		// the session outlives the request getting it
+		err := t.openSession(t.ctx, p, s)
+		t.mu.Lock()
+		s.err = err
+		if err == nil {
+			t.bySID[s.id] = p
+		} else {
+			logger.Debugw("failed to get datagram session", "error", err, "peer", p)
+		}
+		close(s.ready)
+	}
+	t.mu.Unlock()
+
+	select {
+	case <-s.ready:
+	case <-ctx.Done():
+		return nil
+	}
+	if s.err != nil {
+		// not retried until the peer reconnects
+		return nil
+	}
+	return s
+}
+
+// openSession gets a session from p over a stream.
+func (t *DatagramTransport) openSession(ctx context.Context, p peer.ID, s *clientSession) error {
+	ctx, cancel := context.WithTimeout(ctx, dhtReadMessageTimeout)
+	defer cancel()
+
+	str, err := t.host.NewStream(ctx, p, t.proto)
+	if err != nil {
+		return err
+	}
+	defer str.Close()
+	_ = str.SetReadDeadline(time.Now().Add(dhtReadMessageTimeout))
+
+	ip, err := manet.ToIP(str.Conn().RemoteMultiaddr())
+	if err != nil {
+		_ = str.Reset()
+		return err
+	}
+	grant := make([]byte, sessionGrantSize)
+	if _, err := io.ReadFull(str, grant); err != nil {
+		_ = str.Reset()
+		return err
+	}
+
+	s.addr = &stdnet.UDPAddr{IP: ip, Port: int(binary.BigEndian.Uint16(grant))}
+	copy(s.id[:], grant[2:])
+	s.key = grant[2+sessionIDSize:]
+	s.expires = time.Now().Add(datagramSessionTTL - time.Minute)
+	return nil
+}
+
+// HandleSessionStream hands out a session to the peer of the stream, replacing
+// its previous one.
+func (t *DatagramTransport) HandleSessionStream(s network.Stream) {
+	ip, err := manet.ToIP(s.Conn().RemoteMultiaddr())
+	if err != nil {
+		// e.g. relayed, we couldn't reach the peer over UDP
+		_ = s.Reset()
+		return
+	}
+
+	grant := make([]byte, sessionGrantSize)
+	binary.BigEndian.PutUint16(grant, uint16(t.port))
+	if _, err := rand.Read(grant[2:]); err != nil {
+		_ = s.Reset()
+		return
+	}
+	var sid sessionID
+	copy(sid[:], grant[2:])
+	p := s.Conn().RemotePeer()
+
+	t.mu.Lock()
+	if old, ok := t.byPeer[p]; ok {
+		delete(t.issued, old)
+	}
+	t.issued[sid] = &serverSession{
+		p:       p,
+		ip:      ip,
+		key:     grant[2+sessionIDSize:],
+		expires: time.Now().Add(datagramSessionTTL),
+	}
+	t.byPeer[p] = sid
+	t.mu.Unlock()
+
+	if _, err := s.Write(grant); err != nil {
+		_ = s.Reset()
+		return
+	}
+	_ = s.Close()
+}
+
+// readLoop handles the datagrams received until the transport is closed.
+func (t *DatagramTransport) readLoop() {
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, from, err := t.conn.ReadFrom(buf)
+		if err != nil {
+			if t.ctx.Err() == nil {
+				logger.Errorw("failed to read datagram", "error", err)
+			}
+			return
+		}
+		if n < datagramHeaderSize+macSize {
+			continue
+		}
+		dg := make([]byte, n)
+		copy(dg, buf[:n])
+
+		switch dg[0] {
+		case dgRequest:
+			t.handleRequest(dg, from)
+		case dgResponse, dgTooLarge:
+			t.handleResponse(dg)
+		}
+	}
+}
+
+func (t *DatagramTransport) handleRequest(dg []byte, from stdnet.Addr) {
+	var sid sessionID
+	copy(sid[:], dg[1:])
+
+	t.mu.Lock()
+	s, ok := t.issued[sid]
+	t.mu.Unlock()
+	if !ok || time.Now().After(s.expires) || !open(dg, s.key) {
+		return
+	}
+	if addr, ok := from.(*stdnet.UDPAddr); !ok || !addr.IP.Equal(s.ip) {
+		return
+	}
+
+	req := new(pb.Message)
+	if err := req.Unmarshal(dg[datagramHeaderSize : len(dg)-macSize]); err != nil {
+		return
+	}
+	switch req.GetType() {
+	case pb.Message_FIND_NODE, pb.Message_GET_PROVIDERS:
+	default:
+		return
+	}
+
+	t.mu.Lock()
+	fresh := req.GetRequestId() != 0 && s.fresh(req.GetRequestId())
+	t.mu.Unlock()
+	if !fresh {
+		logger.Debugw("dropping replayed datagram request", "from", s.p, "id", req.GetRequestId())
+		return
+	}
+
+	select {
+	case t.handling <- struct{}{}:
+	default:
+		logger.Debugw("dropping datagram request, too many in flight", "from", s.p)
+		return
+	}
+	go func() {
+		defer func() { <-t.handling }()
+		t.handler(withRemoteIP(t.ctx, s.ip), s.p, req, len(dg), func(resp *pb.Message) error {
+			b, err := resp.Marshal()
+			if err != nil {
+				return err
+			}
+			kind := dgResponse
+			if datagramHeaderSize+len(b)+macSize > maxDatagramSize {
+				kind = dgTooLarge
+				b, err = (&pb.Message{RequestId: req.GetRequestId()}).Marshal()
+				if err != nil {
+					return err
+				}
+			}
+			_, err = t.conn.WriteTo(seal(kind, sid, s.key, b), from)
+			return err
+		})
+	}()
+}
+
+func (t *DatagramTransport) handleResponse(dg []byte) {
+	var sid sessionID
+	copy(sid[:], dg[1:])
+
+	t.mu.Lock()
+	p, ok := t.bySID[sid]
+	var s *clientSession
+	if ok {
+		s = t.sessions[p]
+	}
+	t.mu.Unlock()
+	if s == nil || !open(dg, s.key) {
+		return
+	}
+
+	mes := new(pb.Message)
+	if err := mes.Unmarshal(dg[datagramHeaderSize : len(dg)-macSize]); err != nil {
+		return
+	}
+
+	t.mu.Lock()
+	pd, ok := t.pending[mes.GetRequestId()]
+	delete(t.pending, mes.GetRequestId())
+	t.mu.Unlock()
+	if !ok || pd.p != p {
+		return
+	}
+	if dg[0] == dgTooLarge {
+		close(pd.resp)
+		return
+	}
+	pd.resp <- mes
+}
+
+// seal builds a datagram carrying the message b.
+func seal(kind byte, sid sessionID, key []byte, b []byte) []byte {
+	dg := make([]byte, 0, datagramHeaderSize+len(b)+macSize)
+	dg = append(dg, kind)
+	dg = append(dg, sid[:]...)
+	dg = append(dg, b...)
+	mac := hmac.New(sha256.New, key)
+	mac.Write(dg)
+	return mac.Sum(dg)
+}
+
+// open checks the HMAC of a datagram.
+func open(dg []byte, key []byte) bool {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(dg[:len(dg)-macSize])
+	return hmac.Equal(mac.Sum(nil), dg[len(dg)-macSize:])
+}
@@ -0,0 +1,29 @@
+package net
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDatagramReplayWindow(t *testing.T) {
+	s := new(serverSession)
+
+	require.True(t, s.fresh(2))
+	require.False(t, s.fresh(2))
+	// requests may arrive out of order
+	require.True(t, s.fresh(1))
+	require.False(t, s.fresh(1))
+
+	next := uint64(3 + datagramReplayWindow)
+	for id := uint64(3); id < next; id++ {
+		require.True(t, s.fresh(id))
+	}
+	require.Len(t, s.seen, datagramReplayWindow)
+
+	// the forgotten ids can't be replayed either
+	require.False(t, s.fresh(1))
+	require.False(t, s.fresh(2))
+	require.False(t, s.fresh(next-1))
+	require.True(t, s.fresh(next))
+}
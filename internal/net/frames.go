@@ -0,0 +1,44 @@
+package net
+
+import (
+	"context"
+
+	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
+)
+
+// frameCollector gathers the frames of a response streamed in several frames.
+// All but the last frame are handed to the frame handler of the request's
+// context, or, without one, merged into the last frame.
+type frameCollector struct {
+	handler pb.FrameHandler
+	merged  *pb.Message
+}
+
+func newFrameCollector(ctx context.Context) *frameCollector {
+	return &frameCollector{handler: pb.GetFrameHandler(ctx)}
+}
+
+// add takes a frame followed by more frames.
+func (c *frameCollector) add(frame *pb.Message) error {
+	if c.handler != nil {
+		return c.handler(frame)
+	}
+	if c.merged == nil {
+		c.merged = frame
+		return nil
+	}
+	c.merged.CloserPeers = append(c.merged.CloserPeers, frame.CloserPeers...)
+	c.merged.ProviderPeers = append(c.merged.ProviderPeers, frame.ProviderPeers...)
+	return nil
+}
+
+// last takes the last frame, and returns the response.
+func (c *frameCollector) last(frame *pb.Message) *pb.Message {
+	if c.merged != nil {
+		frame.CloserPeers = append(c.merged.CloserPeers, frame.CloserPeers...)
+		frame.ProviderPeers = append(c.merged.ProviderPeers, frame.ProviderPeers...)
+		// serialized fields merge by concatenation
+		frame.XXX_unrecognized = append(c.merged.XXX_unrecognized, frame.XXX_unrecognized...)
+	}
+	return frame
+}
@@ -0,0 +1,414 @@
+package net
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	stdnet "net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
+	ma "github.com/multiformats/go-multiaddr"
+
+	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
+)
+
+// DHT messages are POSTed to <endpoint><protocol>, e.g.
+// https://example.com:443/ipfs/kad/1.0.0, as a single protobuf message, and
+// the response, if any, is returned the same way. Both are signed by their
+// sender, who is identified by the headers below, so that the requester and
+// responder are authenticated as over a libp2p stream. Requests are signed
+// along with the responder and the time, and are only accepted once, within
+// maxHTTPClockSkew of it. Responses are signed along with the request
+// signature.
+const (
+	httpPeerHeader      = "X-Kad-Peer"
+	httpPublicKeyHeader = "X-Kad-Public-Key"
+	httpTimeHeader      = "X-Kad-Time"
+	httpSignatureHeader = "X-Kad-Signature"
+
+	httpContentType = "application/vnd.libp2p.kad-dht+protobuf"
+
+	httpRequestPrefix  = "libp2p-kad-dht-http-request:"
+	httpResponsePrefix = "libp2p-kad-dht-http-response:"
+)
+
+// maxHTTPClockSkew is how far apart the clocks of the requester and responder
+// may be.
+var maxHTTPClockSkew = time.Minute
+
+// HTTPEndpoint returns the HTTP endpoint of a peer address ending with /http or
+// /https, e.g. https://example.com:443 for /dns4/example.com/tcp/443/https.
+func HTTPEndpoint(addr ma.Multiaddr) (string, bool) {
+	var scheme, hostname, port string
+	ma.ForEach(addr, func(c ma.Component) bool {
+		switch c.Protocol().Code {
+		case ma.P_IP4, ma.P_DNS, ma.P_DNS4, ma.P_DNS6:
+			hostname = c.Value()
+		case ma.P_IP6:
+			hostname = "[" + c.Value() + "]"
+		case ma.P_TCP:
+			port = c.Value()
+		case ma.P_HTTP:
+			scheme = "http"
+		case ma.P_HTTPS:
+			scheme = "https"
+		}
+		return true
+	})
+	if scheme == "" || hostname == "" || port == "" {
+		return "", false
+	}
+	return scheme + "://" + hostname + ":" + port, true
+}
+
+// HTTPSender sends requests over HTTP to the peers we aren't connected to and
+// that have an HTTP endpoint among their addresses, and over streams to the
+// other peers.
+type HTTPSender struct {
+	host    host.Host
+	sk      crypto.PrivKey
+	proto   protocol.ID
+	client  *http.Client
+	streams pb.MessageSender
+}
+
+var _ pb.MessageSender = (*HTTPSender)(nil)
+
+// NewHTTPSender returns a sender posting requests of the proto protocol with
+// client, signed with the host's key sk. Requests that can't be sent over
+// HTTP are sent with streams.
+func NewHTTPSender(h host.Host, sk crypto.PrivKey, proto protocol.ID, client *http.Client, streams pb.MessageSender) *HTTPSender {
+	return &HTTPSender{host: h, sk: sk, proto: proto, client: client, streams: streams}
+}
+
+// Endpoint returns the HTTP endpoint of p, if any is known.
+func (hs *HTTPSender) Endpoint(p peer.ID) (string, bool) {
+	for _, addr := range hs.host.Peerstore().Addrs(p) {
+		if endpoint, ok := HTTPEndpoint(addr); ok {
+			return endpoint, true
+		}
+	}
+	return "", false
+}
+
+// useHTTP returns the endpoint to send requests to p to, if they should go
+// over HTTP.
+func (hs *HTTPSender) useHTTP(p peer.ID) (string, bool) {
+	if hs.host.Network().Connectedness(p) == network.Connected {
+		return "", false
+	}
+	return hs.Endpoint(p)
+}
+
+func (hs *HTTPSender) SendRequest(ctx context.Context, p peer.ID, pmes *pb.Message) (*pb.Message, error) {
+	endpoint, ok := hs.useHTTP(p)
+	if !ok {
+		return hs.streams.SendRequest(ctx, p, pmes)
+	}
+	resp, err := hs.post(ctx, p, endpoint, pmes)
+	if err != nil {
+		return nil, err
+	}
+	if resp == nil {
+		return nil, fmt.Errorf("no response from %s", p)
+	}
+	return resp, nil
+}
+
+func (hs *HTTPSender) SendMessage(ctx context.Context, p peer.ID, pmes *pb.Message) error {
+	endpoint, ok := hs.useHTTP(p)
+	if !ok {
+		return hs.streams.SendMessage(ctx, p, pmes)
+	}
+	_, err := hs.post(ctx, p, endpoint, pmes)
+	return err
+}
+
+// OnDisconnect forwards disconnections to the stream sender.
+func (hs *HTTPSender) OnDisconnect(ctx context.Context, p peer.ID) {
+	if d, ok := hs.streams.(interface {
+		OnDisconnect(context.Context, peer.ID)
+	}); ok {
+		d.OnDisconnect(ctx, p)
+	}
+}
+
+// post sends a message to p and returns its response, nil if there is none.
+func (hs *HTTPSender) post(ctx context.Context, p peer.ID, endpoint string, pmes *pb.Message) (*pb.Message, error) {
+	body, err := pmes.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	now := strconv.FormatInt(time.Now().UnixNano(), 10)
+	sig, err := hs.sk.Sign(httpRequestPayload(p, now, body))
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint+string(hs.proto), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", httpContentType)
+	req.Header.Set(httpTimeHeader, now)
+	if err := setHTTPIdentity(req.Header, hs.host.ID(), hs.sk, sig); err != nil {
+		return nil, err
+	}
+
+	resp, err := hs.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusNoContent:
+		return nil, nil
+	case http.StatusOK:
+	default:
+		return nil, fmt.Errorf("http request to %s failed: %s", p, resp.Status)
+	}
+
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, network.MessageSizeMax+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > network.MessageSizeMax {
+		return nil, fmt.Errorf("http response from %s too large", p)
+	}
+	responder, pk, rsig, err := httpIdentity(resp.Header)
+	if err != nil {
+		return nil, err
+	}
+	if responder != p {
+		return nil, fmt.Errorf("http response from %s signed by %s", p, responder)
+	}
+	if ok, err := pk.Verify(httpResponsePayload(sig, b), rsig); err != nil || !ok {
+		return nil, fmt.Errorf("invalid http response signature from %s", p)
+	}
+
+	mes := new(pb.Message)
+	if err := mes.Unmarshal(b); err != nil {
+		return nil, err
+	}
+	return mes, nil
+}
+
+// HTTPHandler serves the requests posted to the DHT protocols over HTTP.
+type HTTPHandler struct {
+	self    peer.ID
+	sk      crypto.PrivKey
+	protos  map[string]struct{}
+	handler InboundHandler
+	ctx     context.Context
+
+	// seen holds the requests accepted while they could still be replayed,
+	// by sender and time, in the order received in recent.
+	mu     sync.Mutex
+	seen   map[string]struct{}
+	recent []seenRequest
+}
+
+type seenRequest struct {
+	nonce   string
+	expires time.Time
+}
+
+var _ http.Handler = (*HTTPHandler)(nil)
+
+// NewHTTPHandler returns an HTTP handler serving the requests posted to protos
+// with handler, and signing the responses with the host's key sk.
+func NewHTTPHandler(ctx context.Context, self peer.ID, sk crypto.PrivKey, protos []protocol.ID, handler InboundHandler) *HTTPHandler {
+	h := &HTTPHandler{
+		self:    self,
+		sk:      sk,
+		protos:  make(map[string]struct{}, len(protos)),
+		handler: handler,
+		ctx:     ctx,
+		seen:    make(map[string]struct{}),
+	}
+	for _, p := range protos {
+		h.protos[string(p)] = struct{}{}
+	}
+	return h
+}
+
+func (h *HTTPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if _, ok := h.protos[r.URL.Path]; !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, network.MessageSizeMax))
+	if err != nil {
+		http.Error(w, "request too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	p, reqSig, err := h.authenticate(r.Header, body)
+	if err != nil {
+		logger.Debugw("refusing http request", "error", err)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	req := new(pb.Message)
+	if err := req.Unmarshal(body); err != nil {
+		http.Error(w, "malformed message", http.StatusBadRequest)
+		return
+	}
+
+	// stop handling the request if the client goes away, or we shut down
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	if host, _, err := stdnet.SplitHostPort(r.RemoteAddr); err == nil {
+		if ip := stdnet.ParseIP(host); ip != nil {
+			ctx = withRemoteIP(ctx, ip)
+		}
+	}
+	go func() {
+		select {
+		case <-h.ctx.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	var resp []byte
+	ok := h.handler(ctx, p, req, len(body), func(mes *pb.Message) error {
+		resp, err = mes.Marshal()
+		return err
+	})
+	if !ok {
+		http.Error(w, "request failed", http.StatusInternalServerError)
+		return
+	}
+	if resp == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	sig, err := h.sk.Sign(httpResponsePayload(reqSig, resp))
+	if err != nil {
+		http.Error(w, "failed to sign response", http.StatusInternalServerError)
+		return
+	}
+	if err := setHTTPIdentity(w.Header(), h.self, h.sk, sig); err != nil {
+		http.Error(w, "failed to sign response", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", httpContentType)
+	_, _ = w.Write(resp)
+}
+
+// authenticate checks the signature of a request, and that it isn't a replay,
+// and returns its sender and the signature.
+func (h *HTTPHandler) authenticate(header http.Header, body []byte) (peer.ID, []byte, error) {
+	p, pk, sig, err := httpIdentity(header)
+	if err != nil {
+		return "", nil, err
+	}
+	now := header.Get(httpTimeHeader)
+	t, err := strconv.ParseInt(now, 10, 64)
+	if err != nil {
+		return "", nil, errors.New("invalid request time")
+	}
+	if skew := time.Since(time.Unix(0, t)); skew > maxHTTPClockSkew || skew < -maxHTTPClockSkew {
+		return "", nil, errors.New("request time too far from ours")
+	}
+	if ok, err := pk.Verify(httpRequestPayload(h.self, now, body), sig); err != nil || !ok {
+		return "", nil, errors.New("invalid request signature")
+	}
+	if !h.fresh(p, now) {
+		return "", nil, errors.New("replayed request")
+	}
+	return p, sig, nil
+}
+
+// fresh records a request by its sender and time, and reports whether it wasn't
+// seen before. Requests are remembered for twice maxHTTPClockSkew after they
+// are received, by when their time is too far from ours to be accepted again.
+func (h *HTTPHandler) fresh(p peer.ID, now string) bool {
+	nonce := string(p) + now
+	received := time.Now()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for len(h.recent) > 0 && received.After(h.recent[0].expires) {
+		delete(h.seen, h.recent[0].nonce)
+		h.recent = h.recent[1:]
+	}
+	if _, ok := h.seen[nonce]; ok {
+		return false
+	}
+	h.seen[nonce] = struct{}{}
+	h.recent = append(h.recent, seenRequest{nonce: nonce, expires: received.Add(2 * maxHTTPClockSkew)})
+	return true
+}
+
+func httpRequestPayload(responder peer.ID, now string, body []byte) []byte {
+	buf := make([]byte, 0, len(httpRequestPrefix)+len(responder)+len(now)+1+len(body))
+	buf = append(buf, httpRequestPrefix...)
+	buf = append(buf, responder...)
+	buf = append(buf, now...)
+	buf = append(buf, '\n')
+	return append(buf, body...)
+}
+
+func httpResponsePayload(reqSig []byte, body []byte) []byte {
+	buf := make([]byte, 0, len(httpResponsePrefix)+len(reqSig)+len(body))
+	buf = append(buf, httpResponsePrefix...)
+	buf = append(buf, reqSig...)
+	return append(buf, body...)
+}
+
+// setHTTPIdentity sets the headers identifying the signer of a message.
+func setHTTPIdentity(header http.Header, self peer.ID, sk crypto.PrivKey, sig []byte) error {
+	pkb, err := crypto.MarshalPublicKey(sk.GetPublic())
+	if err != nil {
+		return err
+	}
+	header.Set(httpPeerHeader, self.Pretty())
+	header.Set(httpPublicKeyHeader, base64.StdEncoding.EncodeToString(pkb))
+	header.Set(httpSignatureHeader, base64.StdEncoding.EncodeToString(sig))
+	return nil
+}
+
+// httpIdentity returns the signer of a message, its public key and the
+// signature.
+func httpIdentity(header http.Header) (peer.ID, crypto.PubKey, []byte, error) {
+	p, err := peer.Decode(header.Get(httpPeerHeader))
+	if err != nil {
+		return "", nil, nil, errors.New("invalid peer id")
+	}
+	pkb, err := base64.StdEncoding.DecodeString(header.Get(httpPublicKeyHeader))
+	if err != nil {
+		return "", nil, nil, errors.New("invalid public key")
+	}
+	pk, err := crypto.UnmarshalPublicKey(pkb)
+	if err != nil {
+		return "", nil, nil, errors.New("invalid public key")
+	}
+	if !p.MatchesPublicKey(pk) {
+		return "", nil, nil, errors.New("public key doesn't match the peer id")
+	}
+	sig, err := base64.StdEncoding.DecodeString(header.Get(httpSignatureHeader))
+	if err != nil {
+		return "", nil, nil, errors.New("invalid signature")
+	}
+	return p, pk, sig, nil
+}
@@ -0,0 +1,52 @@
+package net
+
+import (
+	"context"
+	"crypto/rand"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHTTPReplayedRequest(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	newKey := func() (peer.ID, crypto.PrivKey) {
+		sk, _, err := crypto.GenerateEd25519Key(rand.Reader)
+		require.NoError(t, err)
+		p, err := peer.IDFromPrivateKey(sk)
+		require.NoError(t, err)
+		return p, sk
+	}
+	self, selfKey := newKey()
+	sender, senderKey := newKey()
+	h := NewHTTPHandler(ctx, self, selfKey, nil, nil)
+
+	body := []byte("request")
+	signed := func(at time.Time) http.Header {
+		now := strconv.FormatInt(at.UnixNano(), 10)
+		sig, err := senderKey.Sign(httpRequestPayload(self, now, body))
+		require.NoError(t, err)
+		header := make(http.Header)
+		header.Set(httpTimeHeader, now)
+		require.NoError(t, setHTTPIdentity(header, sender, senderKey, sig))
+		return header
+	}
+
+	header := signed(time.Now())
+	p, _, err := h.authenticate(header, body)
+	require.NoError(t, err)
+	require.Equal(t, sender, p)
+	_, _, err = h.authenticate(header, body)
+	require.EqualError(t, err, "replayed request")
+
+	// a request sent later is another one
+	_, _, err = h.authenticate(signed(time.Now().Add(time.Millisecond)), body)
+	require.NoError(t, err)
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/libp2p/go-libp2p-core/host"
@@ -39,14 +40,76 @@ type messageSenderImpl struct {
 	smlk      sync.Mutex
 	strmap    map[peer.ID]*peerMessageSender
 	protocols []protocol.ID
+
+	// maximum number of requests in flight over a pipelined stream, 0 if
+	// requests aren't pipelined.
+	pipelining int
+	requestID  uint64 // atomic
+
+	// maximum number of peers with an open stream, 0 if unbounded, and
+	// duration after which unused streams are closed, 0 if never.
+	maxPoolSize int
+	idleTimeout time.Duration
+
+	// number of buckets the remote peers are hashed to when recording the
+	// latency of the requests sent to them, 0 if not recorded.
+	peerLatencyBuckets int
+
+	// timeouts of the requests and messages of each type, the ones of other
+	// types time out reading a response after dhtReadMessageTimeout.
+	timeouts map[pb.Message_MessageType]time.Duration
+
+	// called with the outcome of every request sent, if set.
+	onRequest func(p peer.ID, firstByte, total time.Duration, err error)
+}
+
+// Option is a message sender option.
+type Option func(*messageSenderImpl)
+
+// Pipelining multiplexes up to maxInFlight concurrent requests to a peer over
+// a single stream, for the peers that support it. Other peers are sent one
+// request at a time.
+func Pipelining(maxInFlight int) Option {
+	return func(m *messageSenderImpl) {
+		m.pipelining = maxInFlight
+	}
+}
+
+// Timeouts bounds the time spent sending a request or message of each type,
+// from opening a stream to reading the response.
+func Timeouts(timeouts map[pb.Message_MessageType]time.Duration) Option {
+	return func(m *messageSenderImpl) {
+		m.timeouts = timeouts
+	}
+}
+
+// PeerLatencyBuckets records the latency of the requests sent to each remote
+// peer, hashed to one of buckets buckets, see metrics.PeerBucket.
+func PeerLatencyBuckets(buckets int) Option {
+	return func(m *messageSenderImpl) {
+		m.peerLatencyBuckets = buckets
+	}
 }
 
-func NewMessageSenderImpl(h host.Host, protos []protocol.ID) pb.MessageSender {
-	return &messageSenderImpl{
+// OnRequest calls fn with the outcome of every request sent, nil if it got a
+// response, along with the time it took for the first byte of the response to
+// arrive and for the whole response to, both zero if it got none.
+func OnRequest(fn func(p peer.ID, firstByte, total time.Duration, err error)) Option {
+	return func(m *messageSenderImpl) {
+		m.onRequest = fn
+	}
+}
+
+func NewMessageSenderImpl(h host.Host, protos []protocol.ID, opts ...Option) pb.MessageSender {
+	m := &messageSenderImpl{
 		host:      h,
 		strmap:    make(map[peer.ID]*peerMessageSender),
 		protocols: protos,
 	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	return m
 }
 
 func (m *messageSenderImpl) OnDisconnect(ctx context.Context, p peer.ID) {
@@ -72,6 +135,8 @@ func (m *messageSenderImpl) OnDisconnect(ctx context.Context, p peer.ID) {
 // measure the RTT for latency measurements.
 func (m *messageSenderImpl) SendRequest(ctx context.Context, p peer.ID, pmes *pb.Message) (*pb.Message, error) {
 	ctx, _ = tag.New(ctx, metrics.UpsertMessageType(pmes))
+	ctx, cancel := m.withTimeout(ctx, pmes.GetType())
+	defer cancel()
 
 	ms, err := m.messageSenderForPeer(ctx, p)
 	if err != nil {
@@ -80,33 +145,62 @@ func (m *messageSenderImpl) SendRequest(ctx context.Context, p peer.ID, pmes *pb
 			metrics.SentRequestErrors.M(1),
 		)
 		logger.Debugw("request failed to open message sender", "error", err, "to", p)
+		m.requestDone(p, 0, 0, err)
 		return nil, err
 	}
+	defer ms.release()
 
 	start := time.Now()
 
-	rpmes, err := ms.SendRequest(ctx, pmes)
+	rpmes, firstByte, err := ms.SendRequest(ctx, pmes)
+	if err == nil && rpmes.GetRetryAfterMs() > 0 {
+		err = &pb.ThrottledError{RetryAfter: time.Duration(rpmes.GetRetryAfterMs()) * time.Millisecond}
+	}
 	if err != nil {
 		stats.Record(ctx,
 			metrics.SentRequests.M(1),
 			metrics.SentRequestErrors.M(1),
 		)
 		logger.Debugw("request failed", "error", err, "to", p)
+		m.requestDone(p, 0, 0, err)
 		return nil, err
 	}
 
+	latency := time.Since(start)
+	// the time to the first byte is the latency of the network and of the
+	// peer, the rest the time to transfer the response.
+	ttfb := latency
+	if !firstByte.IsZero() && firstByte.Before(start.Add(latency)) {
+		ttfb = firstByte.Sub(start)
+	}
 	stats.Record(ctx,
 		metrics.SentRequests.M(1),
 		metrics.SentBytes.M(int64(pmes.Size())),
-		metrics.OutboundRequestLatency.M(float64(time.Since(start))/float64(time.Millisecond)),
+		metrics.ReceivedResponseBytes.M(int64(rpmes.Size())),
+		metrics.OutboundRequestLatency.M(float64(latency)/float64(time.Millisecond)),
+		metrics.OutboundRequestFirstByteLatency.M(float64(ttfb)/float64(time.Millisecond)),
 	)
-	m.host.Peerstore().RecordLatency(p, time.Since(start))
+	if m.peerLatencyBuckets > 0 {
+		_ = stats.RecordWithTags(ctx, []tag.Mutator{tag.Upsert(metrics.KeyPeerBucket, metrics.PeerBucket(p, m.peerLatencyBuckets))},
+			metrics.PeerRequestLatency.M(float64(latency)/float64(time.Millisecond)),
+		)
+	}
+	m.host.Peerstore().RecordLatency(p, latency)
+	m.requestDone(p, ttfb, latency, nil)
 	return rpmes, nil
 }
 
+func (m *messageSenderImpl) requestDone(p peer.ID, firstByte, total time.Duration, err error) {
+	if m.onRequest != nil {
+		m.onRequest(p, firstByte, total, err)
+	}
+}
+
 // SendMessage sends out a message
 func (m *messageSenderImpl) SendMessage(ctx context.Context, p peer.ID, pmes *pb.Message) error {
 	ctx, _ = tag.New(ctx, metrics.UpsertMessageType(pmes))
+	ctx, cancel := m.withTimeout(ctx, pmes.GetType())
+	defer cancel()
 
 	ms, err := m.messageSenderForPeer(ctx, p)
 	if err != nil {
@@ -117,6 +211,7 @@ func (m *messageSenderImpl) SendMessage(ctx context.Context, p peer.ID, pmes *pb
 		logger.Debugw("message failed to open message sender", "error", err, "to", p)
 		return err
 	}
+	defer ms.release()
 
 	if err := ms.SendMessage(ctx, pmes); err != nil {
 		stats.Record(ctx,
@@ -134,16 +229,38 @@ func (m *messageSenderImpl) SendMessage(ctx context.Context, p peer.ID, pmes *pb
 	return nil
 }
 
+// withTimeout bounds ctx by the timeout of the messages of type t, if any.
+func (m *messageSenderImpl) withTimeout(ctx context.Context, t pb.Message_MessageType) (context.Context, context.CancelFunc) {
+	if timeout, ok := m.timeouts[t]; ok {
+		return context.WithTimeout(ctx, timeout)
+	}
+	return ctx, func() {}
+}
+
+// readTimeout returns how long to wait for the response to a request of type
+// t.
+func (m *messageSenderImpl) readTimeout(t pb.Message_MessageType) time.Duration {
+	if timeout, ok := m.timeouts[t]; ok {
+		return timeout
+	}
+	return dhtReadMessageTimeout
+}
+
+// messageSenderForPeer returns the sender for p, acquired for a request.
 func (m *messageSenderImpl) messageSenderForPeer(ctx context.Context, p peer.ID) (*peerMessageSender, error) {
 	m.smlk.Lock()
 	ms, ok := m.strmap[p]
 	if ok {
+		ms.acquire()
 		m.smlk.Unlock()
 		return ms, nil
 	}
+	m.makeRoom(ctx)
 	ms = &peerMessageSender{p: p, m: m, lk: internal.NewCtxMutex()}
+	ms.acquire()
 	m.strmap[p] = ms
 	m.smlk.Unlock()
+	m.watchIdle(ms)
 
 	if err := ms.prepOrInvalidate(ctx); err != nil {
 		m.smlk.Lock()
@@ -153,6 +270,7 @@ func (m *messageSenderImpl) messageSenderForPeer(ctx context.Context, p peer.ID)
 			// Changed. Use the new one, old one is invalid and
 			// not in the map so we can just throw it away.
 			if ms != msCur {
+				msCur.acquire()
 				return msCur, nil
 			}
 			// Not changed, remove the now invalid stream from the
@@ -170,12 +288,26 @@ func (m *messageSenderImpl) messageSenderForPeer(ctx context.Context, p peer.ID)
 type peerMessageSender struct {
 	s  network.Stream
 	r  msgio.ReadCloser
+	fb *firstByteReader
 	lk internal.CtxMutex
 	p  peer.ID
 	m  *messageSenderImpl
 
 	invalid   bool
 	singleMes int
+
+	// set while the stream opened along with the sender wasn't used yet
+	fresh bool
+
+	// number of requests using the sender, guarded by the smlk of m, and
+	// unix time in nanoseconds of its last use.
+	active   int
+	lastUsed int64 // atomic
+
+	// set once the peer echoed the id of a request, its requests are then
+	// pipelined over pipe.
+	canPipeline bool
+	pipe        *requestPipeline
 }
 
 // invalidate is called before this peerMessageSender is removed from the strmap.
@@ -187,6 +319,10 @@ func (ms *peerMessageSender) invalidate() {
 		_ = ms.s.Reset()
 		ms.s = nil
 	}
+	if ms.pipe != nil {
+		ms.pipe.fail(fmt.Errorf("message sender has been invalidated"))
+		ms.pipe = nil
+	}
 }
 
 func (ms *peerMessageSender) prepOrInvalidate(ctx context.Context) error {
@@ -199,9 +335,19 @@ func (ms *peerMessageSender) prepOrInvalidate(ctx context.Context) error {
 		ms.invalidate()
 		return err
 	}
+	ms.fresh = true
 	return nil
 }
 
+// countReuse records whether a request reuses the open stream, if any. The
+// stream opened along with the sender counts as new for its first request.
+func (ms *peerMessageSender) countReuse(ctx context.Context) {
+	if ms.s != nil && !ms.fresh {
+		stats.Record(ctx, metrics.OutboundStreamsReused.M(1))
+	}
+	ms.fresh = false
+}
+
 func (ms *peerMessageSender) prep(ctx context.Context) error {
 	if ms.invalid {
 		return fmt.Errorf("message sender has been invalidated")
@@ -213,17 +359,38 @@ func (ms *peerMessageSender) prep(ctx context.Context) error {
 	// We only want to speak to peers using our primary protocols. We do not want to query any peer that only speaks
 	// one of the secondary "server" protocols that we happen to support (e.g. older nodes that we can respond to for
 	// backwards compatibility reasons).
-	nstr, err := ms.m.host.NewStream(ctx, ms.p, ms.m.protocols...)
+	nstr, err := ms.m.host.NewStream(ctx, ms.p, ms.m.protocolsFor(ms.p)...)
 	if err != nil {
 		return err
 	}
 
-	ms.r = msgio.NewVarintReaderSize(nstr, network.MessageSizeMax)
+	ms.fb = &firstByteReader{Reader: nstr}
+	ms.r = msgio.NewVarintReaderSize(ms.fb, network.MessageSizeMax)
 	ms.s = nstr
+	stats.Record(ctx, metrics.OutboundStreamsOpened.M(1))
 
 	return nil
 }
 
+// pipeline returns the pipelined stream to the peer, opening a new one if the
+// last one failed. The stream used for unpipelined requests, if any, becomes
+// the pipelined one.
+func (ms *peerMessageSender) pipeline(ctx context.Context) (*requestPipeline, error) {
+	if ms.pipe != nil && !ms.pipe.isFailed() {
+		stats.Record(ctx, metrics.OutboundStreamsReused.M(1))
+		return ms.pipe, nil
+	}
+	ms.countReuse(ctx)
+	if err := ms.prep(ctx); err != nil {
+		return nil, err
+	}
+	ms.pipe = newRequestPipeline(ms.s, ms.r, ms.fb, ms.m.pipelining)
+	ms.s = nil
+	ms.r = nil
+	ms.fb = nil
+	return ms.pipe, nil
+}
+
 // streamReuseTries is the number of times we will try to reuse a stream to a
 // given peer before giving up and reverting to the old one-message-per-stream
 // behaviour.
@@ -235,6 +402,15 @@ func (ms *peerMessageSender) SendMessage(ctx context.Context, pmes *pb.Message)
 	}
 	defer ms.lk.Unlock()
 
+	if ms.canPipeline {
+		pipe, err := ms.pipeline(ctx)
+		if err != nil {
+			return err
+		}
+		return pipe.send(pmes)
+	}
+
+	ms.countReuse(ctx)
 	retry := false
 	for {
 		if err := ms.prep(ctx); err != nil {
@@ -266,25 +442,44 @@ func (ms *peerMessageSender) SendMessage(ctx context.Context, pmes *pb.Message)
 	}
 }
 
-func (ms *peerMessageSender) SendRequest(ctx context.Context, pmes *pb.Message) (*pb.Message, error) {
+// SendRequest sends pmes and returns the response, along with the time its
+// first byte arrived.
+func (ms *peerMessageSender) SendRequest(ctx context.Context, pmes *pb.Message) (*pb.Message, time.Time, error) {
+	if ms.m.pipelining > 0 {
+		// the message may be sent to other peers concurrently
+		req := *pmes
+		req.RequestId = atomic.AddUint64(&ms.m.requestID, 1)
+		pmes = &req
+	}
+
 	if err := ms.lk.Lock(ctx); err != nil {
-		return nil, err
+		return nil, time.Time{}, err
+	}
+	if ms.canPipeline {
+		pipe, err := ms.pipeline(ctx)
+		ms.lk.Unlock()
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		return pipe.request(ctx, pmes, ms.m.readTimeout(pmes.GetType()))
 	}
 	defer ms.lk.Unlock()
 
+	ms.countReuse(ctx)
 	retry := false
 	for {
 		if err := ms.prep(ctx); err != nil {
-			return nil, err
+			return nil, time.Time{}, err
 		}
 
+		ms.fb.expect()
 		if err := ms.writeMsg(pmes); err != nil {
 			_ = ms.s.Reset()
 			ms.s = nil
 
 			if retry {
 				logger.Debugw("error writing message", "error", err)
-				return nil, err
+				return nil, time.Time{}, err
 			}
 			logger.Debugw("error writing message", "error", err, "retrying", true)
 			retry = true
@@ -292,20 +487,36 @@ func (ms *peerMessageSender) SendRequest(ctx context.Context, pmes *pb.Message)
 		}
 
 		mes := new(pb.Message)
-		if err := ms.ctxReadMsg(ctx, mes); err != nil {
+		if err := ms.ctxReadMsg(ctx, mes, ms.m.readTimeout(pmes.GetType())); err != nil {
 			_ = ms.s.Reset()
 			ms.s = nil
 
 			if retry {
 				logger.Debugw("error reading message", "error", err)
-				return nil, err
+				return nil, time.Time{}, err
 			}
 			logger.Debugw("error reading message", "error", err, "retrying", true)
 			retry = true
 			continue
 		}
+		if mes.GetMoreFrames() {
+			var err error
+			if mes, err = ms.readFrames(ctx, mes, ms.m.readTimeout(pmes.GetType())); err != nil {
+				_ = ms.s.Reset()
+				ms.s = nil
+				logger.Debugw("error reading response frames", "error", err)
+				return nil, time.Time{}, err
+			}
+		}
+
+		if pmes.GetRequestId() != 0 && mes.GetRequestId() == pmes.GetRequestId() {
+			// the peer supports pipelining, keep the stream for it
+			ms.canPipeline = true
+			return mes, ms.fb.firstByte(), nil
+		}
 
 		var err error
+		firstByte := ms.fb.firstByte()
 		if ms.singleMes > streamReuseTries {
 			err = ms.s.Close()
 			ms.s = nil
@@ -313,17 +524,33 @@ func (ms *peerMessageSender) SendRequest(ctx context.Context, pmes *pb.Message)
 			ms.singleMes++
 		}
 
-		return mes, err
+		return mes, firstByte, err
+	}
+}
+
+// readFrames reads the frames following the first one of a streamed response,
+// waiting up to timeout for each, and returns the response.
+func (ms *peerMessageSender) readFrames(ctx context.Context, mes *pb.Message, timeout time.Duration) (*pb.Message, error) {
+	frames := newFrameCollector(ctx)
+	for mes.GetMoreFrames() {
+		if err := frames.add(mes); err != nil {
+			return nil, err
+		}
+		mes = new(pb.Message)
+		if err := ms.ctxReadMsg(ctx, mes, timeout); err != nil {
+			return nil, err
+		}
 	}
+	return frames.last(mes), nil
 }
 
 func (ms *peerMessageSender) writeMsg(pmes *pb.Message) error {
-	return WriteMsg(ms.s, pmes)
+	return WriteStreamMsg(ms.s, pmes)
 }
 
-func (ms *peerMessageSender) ctxReadMsg(ctx context.Context, mes *pb.Message) error {
+func (ms *peerMessageSender) ctxReadMsg(ctx context.Context, mes *pb.Message, timeout time.Duration) error {
 	errc := make(chan error, 1)
-	go func(r msgio.ReadCloser) {
+	go func(s network.Stream, r msgio.ReadCloser) {
 		defer close(errc)
 		bytes, err := r.ReadMsg()
 		defer r.ReleaseMsg(bytes)
@@ -331,10 +558,10 @@ func (ms *peerMessageSender) ctxReadMsg(ctx context.Context, mes *pb.Message) er
 			errc <- err
 			return
 		}
-		errc <- mes.Unmarshal(bytes)
-	}(ms.r)
+		errc <- UnmarshalStreamMsg(s, bytes, mes, network.MessageSizeMax)
+	}(ms.s, ms.r)
 
-	t := time.NewTimer(dhtReadMessageTimeout)
+	t := time.NewTimer(timeout)
 	defer t.Stop()
 
 	select {
@@ -347,6 +574,38 @@ func (ms *peerMessageSender) ctxReadMsg(ctx context.Context, mes *pb.Message) er
 	}
 }
 
+// firstByteReader records when the first byte of a message arrives, once
+// expected.
+type firstByteReader struct {
+	io.Reader
+	expecting int32 // atomic
+	at        int64 // atomic, unix time in nanoseconds
+}
+
+func (r *firstByteReader) Read(b []byte) (int, error) {
+	n, err := r.Reader.Read(b)
+	if n > 0 && atomic.CompareAndSwapInt32(&r.expecting, 1, 0) {
+		atomic.StoreInt64(&r.at, time.Now().UnixNano())
+	}
+	return n, err
+}
+
+// expect is called before the next message can arrive.
+func (r *firstByteReader) expect() {
+	atomic.StoreInt64(&r.at, 0)
+	atomic.StoreInt32(&r.expecting, 1)
+}
+
+// firstByte returns when the first byte of the expected message arrived, zero
+// if it didn't yet.
+func (r *firstByteReader) firstByte() time.Time {
+	at := atomic.LoadInt64(&r.at)
+	if at == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, at)
+}
+
 // The Protobuf writer performs multiple small writes when writing a message.
 // We need to buffer those writes, to make sure that we're not sending a new
 // packet for every single write.
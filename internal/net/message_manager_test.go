@@ -1,16 +1,26 @@
 package net
 
 import (
+	"bytes"
 	"context"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/libp2p/go-libp2p-core/network"
 	"github.com/libp2p/go-libp2p-core/peer"
 	"github.com/libp2p/go-libp2p-core/protocol"
+	"github.com/libp2p/go-msgio"
 
 	swarmt "github.com/libp2p/go-libp2p-swarm/testing"
 	bhost "github.com/libp2p/go-libp2p/p2p/host/basic"
 
 	"github.com/stretchr/testify/require"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+
+	"github.com/libp2p/go-libp2p-kad-dht/metrics"
+	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
 )
 
 func TestInvalidMessageSenderTracking(t *testing.T) {
@@ -35,3 +45,276 @@ func TestInvalidMessageSenderTracking(t *testing.T) {
 		t.Fatal("should have no message senders in map")
 	}
 }
+
+func TestPipelinedRequests(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	proto := protocol.ID("/test/kad/1.0.0")
+	client, err := bhost.NewHost(ctx, swarmt.GenSwarm(t, ctx, swarmt.OptDisableReuseport), new(bhost.HostOpts))
+	require.NoError(t, err)
+	defer client.Close()
+	server, err := bhost.NewHost(ctx, swarmt.GenSwarm(t, ctx, swarmt.OptDisableReuseport), new(bhost.HostOpts))
+	require.NoError(t, err)
+	defer server.Close()
+
+	// the server answers the first request right away, and then pairs of
+	// requests in reverse order, which only works if both are in flight.
+	server.SetStreamHandler(proto, func(s network.Stream) {
+		defer s.Close()
+		r := msgio.NewVarintReaderSize(s, network.MessageSizeMax)
+		read := func() *pb.Message {
+			b, err := r.ReadMsg()
+			if err != nil {
+				return nil
+			}
+			defer r.ReleaseMsg(b)
+			mes := new(pb.Message)
+			if mes.Unmarshal(b) != nil {
+				return nil
+			}
+			return mes
+		}
+		if mes := read(); mes == nil || WriteMsg(s, mes) != nil {
+			return
+		}
+		for {
+			first, second := read(), read()
+			if first == nil || second == nil {
+				return
+			}
+			if WriteMsg(s, second) != nil || WriteMsg(s, first) != nil {
+				return
+			}
+		}
+	})
+	require.NoError(t, client.Connect(ctx, peer.AddrInfo{ID: server.ID(), Addrs: server.Addrs()}))
+
+	ms := NewMessageSenderImpl(client, []protocol.ID{proto}, Pipelining(2))
+	resp, err := ms.SendRequest(ctx, server.ID(), pb.NewMessage(pb.Message_PING, []byte("first"), 0))
+	require.NoError(t, err)
+	require.Equal(t, []byte("first"), resp.GetKey())
+
+	var wg sync.WaitGroup
+	for _, key := range []string{"second", "third"} {
+		wg.Add(1)
+		go func(key string) {
+			defer wg.Done()
+			resp, err := ms.SendRequest(ctx, server.ID(), pb.NewMessage(pb.Message_PING, []byte(key), 0))
+			require.NoError(t, err)
+			require.Equal(t, []byte(key), resp.GetKey())
+		}(key)
+	}
+	wg.Wait()
+}
+
+func TestStreamPool(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	proto := protocol.ID("/test/kad/1.0.0")
+	client, err := bhost.NewHost(ctx, swarmt.GenSwarm(t, ctx, swarmt.OptDisableReuseport), new(bhost.HostOpts))
+	require.NoError(t, err)
+	defer client.Close()
+
+	var servers []peer.ID
+	for i := 0; i < 3; i++ {
+		server, err := bhost.NewHost(ctx, swarmt.GenSwarm(t, ctx, swarmt.OptDisableReuseport), new(bhost.HostOpts))
+		require.NoError(t, err)
+		defer server.Close()
+		server.SetStreamHandler(proto, func(s network.Stream) {
+			defer s.Close()
+			r := msgio.NewVarintReaderSize(s, network.MessageSizeMax)
+			for {
+				b, err := r.ReadMsg()
+				if err != nil {
+					return
+				}
+				mes := new(pb.Message)
+				err = mes.Unmarshal(b)
+				r.ReleaseMsg(b)
+				if err != nil || WriteMsg(s, mes) != nil {
+					return
+				}
+			}
+		})
+		require.NoError(t, client.Connect(ctx, peer.AddrInfo{ID: server.ID(), Addrs: server.Addrs()}))
+		servers = append(servers, server.ID())
+	}
+
+	openStreams := func() int {
+		n := 0
+		for _, c := range client.Network().Conns() {
+			for _, s := range c.GetStreams() {
+				if s.Protocol() == proto {
+					n++
+				}
+			}
+		}
+		return n
+	}
+	pooled := func(m *messageSenderImpl) int {
+		m.smlk.Lock()
+		defer m.smlk.Unlock()
+		return len(m.strmap)
+	}
+
+	ms := NewMessageSenderImpl(client, []protocol.ID{proto}, StreamPool(2, 200*time.Millisecond)).(*messageSenderImpl)
+	for _, p := range servers {
+		_, err := ms.SendRequest(ctx, p, pb.NewMessage(pb.Message_PING, nil, 0))
+		require.NoError(t, err)
+	}
+
+	// the least recently used stream made room for the last peer
+	require.Equal(t, 2, pooled(ms))
+	ms.smlk.Lock()
+	_, ok := ms.strmap[servers[0]]
+	ms.smlk.Unlock()
+	require.False(t, ok)
+	require.Eventually(t, func() bool { return openStreams() == 2 }, time.Second, 10*time.Millisecond)
+
+	// and the other ones are closed once idle
+	require.Eventually(t, func() bool { return pooled(ms) == 0 && openStreams() == 0 }, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestRequestTimeouts(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	proto := protocol.ID("/test/kad/1.0.0")
+	client, err := bhost.NewHost(ctx, swarmt.GenSwarm(t, ctx, swarmt.OptDisableReuseport), new(bhost.HostOpts))
+	require.NoError(t, err)
+	defer client.Close()
+	server, err := bhost.NewHost(ctx, swarmt.GenSwarm(t, ctx, swarmt.OptDisableReuseport), new(bhost.HostOpts))
+	require.NoError(t, err)
+	defer server.Close()
+
+	// the server takes a while to answer
+	server.SetStreamHandler(proto, func(s network.Stream) {
+		defer s.Close()
+		r := msgio.NewVarintReaderSize(s, network.MessageSizeMax)
+		for {
+			b, err := r.ReadMsg()
+			if err != nil {
+				return
+			}
+			mes := new(pb.Message)
+			err = mes.Unmarshal(b)
+			r.ReleaseMsg(b)
+			time.Sleep(200 * time.Millisecond)
+			if err != nil || WriteMsg(s, mes) != nil {
+				return
+			}
+		}
+	})
+	require.NoError(t, client.Connect(ctx, peer.AddrInfo{ID: server.ID(), Addrs: server.Addrs()}))
+
+	msgSender := NewMessageSenderImpl(client, []protocol.ID{proto}, Timeouts(map[pb.Message_MessageType]time.Duration{
+		pb.Message_FIND_NODE:     50 * time.Millisecond,
+		pb.Message_GET_PROVIDERS: 5 * time.Second,
+	}))
+
+	start := time.Now()
+	_, err = msgSender.SendRequest(ctx, server.ID(), pb.NewMessage(pb.Message_FIND_NODE, []byte("key"), 0))
+	require.Error(t, err)
+	require.Less(t, int64(time.Since(start)), int64(200*time.Millisecond))
+
+	resp, err := msgSender.SendRequest(ctx, server.ID(), pb.NewMessage(pb.Message_GET_PROVIDERS, []byte("key"), 0))
+	require.NoError(t, err)
+	require.Equal(t, pb.Message_GET_PROVIDERS, resp.GetType())
+}
+
+func TestPeerLatencyBuckets(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	require.NoError(t, view.Register(metrics.PeerRequestLatencyView))
+	defer view.Unregister(metrics.PeerRequestLatencyView)
+
+	proto := protocol.ID("/test/kad/1.0.0")
+	client, err := bhost.NewHost(ctx, swarmt.GenSwarm(t, ctx, swarmt.OptDisableReuseport), new(bhost.HostOpts))
+	require.NoError(t, err)
+	defer client.Close()
+	server, err := bhost.NewHost(ctx, swarmt.GenSwarm(t, ctx, swarmt.OptDisableReuseport), new(bhost.HostOpts))
+	require.NoError(t, err)
+	defer server.Close()
+
+	server.SetStreamHandler(proto, func(s network.Stream) {
+		defer s.Close()
+		r := msgio.NewVarintReaderSize(s, network.MessageSizeMax)
+		for {
+			b, err := r.ReadMsg()
+			if err != nil {
+				return
+			}
+			mes := new(pb.Message)
+			err = mes.Unmarshal(b)
+			r.ReleaseMsg(b)
+			if err != nil || WriteMsg(s, mes) != nil {
+				return
+			}
+		}
+	})
+	require.NoError(t, client.Connect(ctx, peer.AddrInfo{ID: server.ID(), Addrs: server.Addrs()}))
+
+	const buckets = 4
+	msgSender := NewMessageSenderImpl(client, []protocol.ID{proto}, PeerLatencyBuckets(buckets))
+	for i := 0; i < 3; i++ {
+		_, err = msgSender.SendRequest(ctx, server.ID(), pb.NewMessage(pb.Message_FIND_NODE, []byte("key"), 0))
+		require.NoError(t, err)
+	}
+
+	rows, err := view.RetrieveData(metrics.PeerRequestLatencyView.Name)
+	require.NoError(t, err)
+	require.Len(t, rows, 1)
+	require.Contains(t, rows[0].Tags, tag.Tag{Key: metrics.KeyPeerBucket, Value: metrics.PeerBucket(server.ID(), buckets)})
+	require.EqualValues(t, 3, rows[0].Data.(*view.DistributionData).Count)
+}
+
+func TestRequestFirstByte(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	proto := protocol.ID("/test/kad/1.0.0")
+	client, err := bhost.NewHost(ctx, swarmt.GenSwarm(t, ctx, swarmt.OptDisableReuseport), new(bhost.HostOpts))
+	require.NoError(t, err)
+	defer client.Close()
+	server, err := bhost.NewHost(ctx, swarmt.GenSwarm(t, ctx, swarmt.OptDisableReuseport), new(bhost.HostOpts))
+	require.NoError(t, err)
+	defer server.Close()
+
+	// the server starts answering right away, but takes its time to finish
+	const transfer = 100 * time.Millisecond
+	server.SetStreamHandler(proto, func(s network.Stream) {
+		defer s.Close()
+		r := msgio.NewVarintReaderSize(s, network.MessageSizeMax)
+		b, err := r.ReadMsg()
+		if err != nil {
+			return
+		}
+		mes := new(pb.Message)
+		if mes.Unmarshal(b) != nil {
+			return
+		}
+		var buf bytes.Buffer
+		if WriteMsg(&buf, mes) != nil {
+			return
+		}
+		if _, err := s.Write(buf.Next(1)); err != nil {
+			return
+		}
+		time.Sleep(transfer)
+		_, _ = s.Write(buf.Bytes())
+	})
+	require.NoError(t, client.Connect(ctx, peer.AddrInfo{ID: server.ID(), Addrs: server.Addrs()}))
+
+	var firstByte, total time.Duration
+	ms := NewMessageSenderImpl(client, []protocol.ID{proto}, OnRequest(func(_ peer.ID, fb, tot time.Duration, err error) {
+		require.NoError(t, err)
+		firstByte, total = fb, tot
+	}))
+	_, err = ms.SendRequest(ctx, server.ID(), pb.NewMessage(pb.Message_PING, []byte("foo"), 0))
+	require.NoError(t, err)
+	require.NotZero(t, firstByte)
+	require.GreaterOrEqual(t, int64(total-firstByte), int64(transfer))
+}
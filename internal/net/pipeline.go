@@ -0,0 +1,197 @@
+package net
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-msgio"
+
+	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
+)
+
+// requestPipeline multiplexes the requests sent to a peer over a single stream.
+// Requests carry an id, which the peer echoes in the responses, possibly out of
+// order.
+type requestPipeline struct {
+	s     network.Stream
+	wlk   sync.Mutex
+	slots chan struct{}
+
+	mu      sync.Mutex
+	pending map[uint64]*pendingRequest
+	err     error
+	failed  chan struct{}
+}
+
+// pendingRequest receives the response to a request, in several frames if
+// streamed.
+type pendingRequest struct {
+	frames    chan *pb.Message
+	abandoned chan struct{}
+
+	// when the first byte of the response arrived, set by readLoop before
+	// handing the first frame over
+	firstByte time.Time
+}
+
+func newRequestPipeline(s network.Stream, r msgio.ReadCloser, fb *firstByteReader, maxInFlight int) *requestPipeline {
+	p := &requestPipeline{
+		s:       s,
+		slots:   make(chan struct{}, maxInFlight),
+		pending: make(map[uint64]*pendingRequest),
+		failed:  make(chan struct{}),
+	}
+	go p.readLoop(r, fb)
+	return p
+}
+
+// readLoop hands the responses to the pending requests until the stream fails.
+// The responses queued behind others are seen arriving once read.
+func (p *requestPipeline) readLoop(r msgio.ReadCloser, fb *firstByteReader) {
+	for {
+		fb.expect()
+		bytes, err := r.ReadMsg()
+		if err != nil {
+			r.ReleaseMsg(bytes)
+			p.fail(err)
+			return
+		}
+		mes := new(pb.Message)
+		err = UnmarshalStreamMsg(p.s, bytes, mes, network.MessageSizeMax)
+		r.ReleaseMsg(bytes)
+		if err != nil {
+			p.fail(err)
+			return
+		}
+
+		p.mu.Lock()
+		req, ok := p.pending[mes.GetRequestId()]
+		if !mes.GetMoreFrames() {
+			delete(p.pending, mes.GetRequestId())
+		}
+		p.mu.Unlock()
+		if !ok {
+			// the request was abandoned
+			logger.Debugw("dropping response to unknown request", "id", mes.GetRequestId())
+			continue
+		}
+		if req.firstByte.IsZero() {
+			req.firstByte = fb.firstByte()
+		}
+		select {
+		case req.frames <- mes:
+		case <-req.abandoned:
+		}
+	}
+}
+
+// fail resets the stream and fails all the pending requests with err.
+func (p *requestPipeline) fail(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err != nil {
+		return
+	}
+	p.err = err
+	close(p.failed)
+	_ = p.s.Reset()
+}
+
+func (p *requestPipeline) isFailed() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err != nil
+}
+
+func (p *requestPipeline) failure() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err
+}
+
+func (p *requestPipeline) forget(id uint64) {
+	p.mu.Lock()
+	if req, ok := p.pending[id]; ok {
+		delete(p.pending, id)
+		close(req.abandoned)
+	}
+	p.mu.Unlock()
+}
+
+// send writes a message expecting no response.
+func (p *requestPipeline) send(pmes *pb.Message) error {
+	p.wlk.Lock()
+	err := WriteStreamMsg(p.s, pmes)
+	p.wlk.Unlock()
+	if err != nil {
+		p.fail(err)
+	}
+	return err
+}
+
+// request sends a request once fewer than the maximum number of requests are
+// in flight, and waits up to timeout for its response, returned along with the
+// time its first byte arrived.
+func (p *requestPipeline) request(ctx context.Context, pmes *pb.Message, timeout time.Duration) (*pb.Message, time.Time, error) {
+	select {
+	case p.slots <- struct{}{}:
+	case <-p.failed:
+		return nil, time.Time{}, p.failure()
+	case <-ctx.Done():
+		return nil, time.Time{}, ctx.Err()
+	}
+	defer func() { <-p.slots }()
+
+	id := pmes.GetRequestId()
+	req := &pendingRequest{frames: make(chan *pb.Message, 1), abandoned: make(chan struct{})}
+	p.mu.Lock()
+	if p.err != nil {
+		p.mu.Unlock()
+		return nil, time.Time{}, p.err
+	}
+	p.pending[id] = req
+	p.mu.Unlock()
+
+	if err := p.send(pmes); err != nil {
+		return nil, time.Time{}, err
+	}
+
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+
+	frames := newFrameCollector(ctx)
+	for {
+		select {
+		case mes := <-req.frames:
+			if !mes.GetMoreFrames() {
+				return frames.last(mes), req.firstByte, nil
+			}
+			if err := frames.add(mes); err != nil {
+				p.forget(id)
+				return nil, time.Time{}, err
+			}
+			// wait up to timeout for each frame
+			if !t.Stop() {
+				<-t.C
+			}
+			t.Reset(timeout)
+		case <-p.failed:
+			select {
+			case mes := <-req.frames:
+				if !mes.GetMoreFrames() {
+					return frames.last(mes), req.firstByte, nil
+				}
+			default:
+			}
+			return nil, time.Time{}, p.failure()
+		case <-ctx.Done():
+			p.forget(id)
+			return nil, time.Time{}, ctx.Err()
+		case <-t.C:
+			p.forget(id)
+			return nil, time.Time{}, ErrReadTimeout
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package net
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"go.opencensus.io/stats"
+
+	"github.com/libp2p/go-libp2p-kad-dht/metrics"
+)
+
+// StreamPool bounds the streams kept open to peers between requests: at most
+// maxSize peers have a stream open, the least recently used one being closed
+// to make room for a new peer, and streams unused for idleTimeout are closed.
+// Zero values disable the respective limit.
+func StreamPool(maxSize int, idleTimeout time.Duration) Option {
+	return func(m *messageSenderImpl) {
+		m.maxPoolSize = maxSize
+		m.idleTimeout = idleTimeout
+	}
+}
+
+// acquire marks the sender as in use, which keeps it in the pool. It must be
+// called with smlk held.
+func (ms *peerMessageSender) acquire() {
+	ms.active++
+	ms.touch()
+}
+
+// release marks the sender as no longer in use by one request.
+func (ms *peerMessageSender) release() {
+	ms.m.smlk.Lock()
+	ms.active--
+	ms.touch()
+	ms.m.smlk.Unlock()
+}
+
+func (ms *peerMessageSender) touch() {
+	atomic.StoreInt64(&ms.lastUsed, time.Now().UnixNano())
+}
+
+func (ms *peerMessageSender) idleFor(now time.Time) time.Duration {
+	return now.Sub(time.Unix(0, atomic.LoadInt64(&ms.lastUsed)))
+}
+
+// makeRoom closes the least recently used sender not in use, if the pool is
+// full. It must be called with smlk held.
+func (m *messageSenderImpl) makeRoom(ctx context.Context) {
+	if m.maxPoolSize <= 0 || len(m.strmap) < m.maxPoolSize {
+		return
+	}
+
+	now := time.Now()
+	var lru *peerMessageSender
+	for _, ms := range m.strmap {
+		if ms.active > 0 {
+			continue
+		}
+		if lru == nil || ms.idleFor(now) > lru.idleFor(now) {
+			lru = ms
+		}
+	}
+	if lru == nil {
+		// all in use, the pool goes over its size until some are released
+		return
+	}
+	m.remove(lru)
+	stats.Record(ctx, metrics.OutboundStreamsEvicted.M(1))
+}
+
+// watchIdle closes the sender once it has been unused for the idle timeout.
+func (m *messageSenderImpl) watchIdle(ms *peerMessageSender) {
+	if m.idleTimeout <= 0 {
+		return
+	}
+
+	var check func()
+	check = func() {
+		m.smlk.Lock()
+		defer m.smlk.Unlock()
+		if m.strmap[ms.p] != ms {
+			// already removed
+			return
+		}
+		if ms.active > 0 {
+			time.AfterFunc(m.idleTimeout, check)
+			return
+		}
+		if idle := ms.idleFor(time.Now()); idle < m.idleTimeout {
+			time.AfterFunc(m.idleTimeout-idle, check)
+			return
+		}
+		m.remove(ms)
+		stats.Record(context.Background(), metrics.OutboundStreamsEvicted.M(1))
+	}
+	time.AfterFunc(m.idleTimeout, check)
+}
+
+// remove drops the sender from the pool and closes its stream. It must be
+// called with smlk held.
+func (m *messageSenderImpl) remove(ms *peerMessageSender) {
+	delete(m.strmap, ms.p)
+
+	// Do this asynchronously as ms.lk can block for a while.
+	go func() {
+		if err := ms.lk.Lock(context.Background()); err != nil {
+			return
+		}
+		defer ms.lk.Unlock()
+		ms.invalidate()
+	}()
+}
@@ -0,0 +1,152 @@
+package dht
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
+	"github.com/libp2p/go-libp2p-kad-dht/qpeerset"
+	kb "github.com/libp2p/go-libp2p-kbucket"
+)
+
+// The DHT operations, as reported by Introspect and labeling the metrics, see
+// metrics.KeyOperation.
+const (
+	opPutValue        = "PutValue"
+	opGetValue        = "GetValue"
+	opProvide         = "Provide"
+	opFindProviders   = "FindProviders"
+	opFindPeer        = "FindPeer"
+	opGetClosestPeers = "GetClosestPeers"
+)
+
+// recentOperationsSize is the number of completed operations Introspect
+// reports.
+const recentOperationsSize = 64
+
+// introspection tracks the ongoing lookups and the last completed operations.
+type introspection struct {
+	mu      sync.Mutex
+	lookups map[*pb.Introspection_Lookup]struct{}
+	// ring of the last completed operations, next being the oldest once full
+	recent []pb.Introspection_Operation
+	next   int
+}
+
+func newIntrospection() *introspection {
+	return &introspection{lookups: make(map[*pb.Introspection_Lookup]struct{})}
+}
+
+// startLookup starts tracking the lookup q, returning its progress for
+// updateLookup and endLookup.
+func (in *introspection) startLookup(q *query, op string) *pb.Introspection_Lookup {
+	l := &pb.Introspection_Lookup{
+		Id:        q.id[:],
+		Operation: op,
+		Key:       lookupKeyPrefix(q.key),
+		StartedAt: time.Now().UnixNano(),
+	}
+	in.mu.Lock()
+	in.lookups[l] = struct{}{}
+	in.mu.Unlock()
+	return l
+}
+
+// updateLookup records the progress of the lookup q, from the goroutine running
+// it.
+func (in *introspection) updateLookup(l *pb.Introspection_Lookup, q *query) {
+	heard := q.queryPeers.NumHeard()
+	waiting := q.queryPeers.NumWaiting()
+	queried := len(q.queryPeers.GetClosestInStates(qpeerset.PeerQueried))
+	unreachable := len(q.queryPeers.GetClosestInStates(qpeerset.PeerUnreachable))
+
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	l.Heard = uint32(heard)
+	l.Waiting = uint32(waiting)
+	l.Queried = uint32(queried)
+	l.Unreachable = uint32(unreachable)
+}
+
+func (in *introspection) endLookup(l *pb.Introspection_Lookup) {
+	in.mu.Lock()
+	delete(in.lookups, l)
+	in.mu.Unlock()
+}
+
+// recordOperation records the completion of the operation op started at start.
+func (in *introspection) recordOperation(op string, start time.Time) {
+	o := pb.Introspection_Operation{
+		Operation: op,
+		StartedAt: start.UnixNano(),
+		Duration:  int64(time.Since(start)),
+	}
+
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	if len(in.recent) < recentOperationsSize {
+		in.recent = append(in.recent, o)
+		return
+	}
+	in.recent[in.next] = o
+	in.next = (in.next + 1) % recentOperationsSize
+}
+
+// Introspect returns a snapshot of the routing table, of the ongoing lookups
+// and of the last completed operations, for external dashboards. The debug
+// server serves it at /introspection, see DebugHandler.
+func (dht *IpfsDHT) Introspect() *pb.Introspection {
+	infos := dht.routingTable.GetPeerInfos()
+	snapshot := &pb.Introspection{
+		Self:         []byte(dht.self),
+		Time:         time.Now().UnixNano(),
+		RoutingTable: make([]*pb.Introspection_Peer, 0, len(infos)),
+	}
+	for _, pi := range infos {
+		snapshot.RoutingTable = append(snapshot.RoutingTable, &pb.Introspection_Peer{
+			Id:                            []byte(pi.Id),
+			Cpl:                           uint32(kb.CommonPrefixLen(dht.selfKey, kb.ConvertPeerID(pi.Id))),
+			AddedAt:                       unixNano(pi.AddedAt),
+			LastUsefulAt:                  unixNano(pi.LastUsefulAt),
+			LastSuccessfulOutboundQueryAt: unixNano(pi.LastSuccessfulOutboundQueryAt),
+		})
+	}
+
+	in := dht.introspection
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	for l := range in.lookups {
+		c := *l
+		snapshot.Lookups = append(snapshot.Lookups, &c)
+	}
+	for i := range in.recent {
+		o := in.recent[(in.next+i)%len(in.recent)]
+		snapshot.RecentOperations = append(snapshot.RecentOperations, &o)
+	}
+	return snapshot
+}
+
+func (dht *IpfsDHT) serveIntrospection(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	b, err := dht.Introspect().Marshal()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	if _, err := w.Write(b); err != nil {
+		logger.Debugw("failed to write introspection snapshot", "error", err)
+	}
+}
+
+// unixNano returns t as a unix time in nanoseconds, zero if t is zero.
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
@@ -0,0 +1,41 @@
+package dht
+
+import (
+	"crypto/sha256"
+
+	dhtcfg "github.com/libp2p/go-libp2p-kad-dht/internal/config"
+	record "github.com/libp2p/go-libp2p-record"
+	"github.com/multiformats/go-base32"
+)
+
+// KeyMapperFunc maps the key of a record, without its namespace, to the key it
+// is stored and routed under within the same namespace.
+type KeyMapperFunc = dhtcfg.KeyMapperFunc
+
+// SaltedKeyMapper returns a KeyMapperFunc replacing keys with the hash of the
+// salt followed by the key, giving each salt its own record space.
+func SaltedKeyMapper(salt []byte) KeyMapperFunc {
+	return func(key string) string {
+		h := sha256.New()
+		h.Write(salt)
+		h.Write([]byte(key))
+		return base32.RawStdEncoding.EncodeToString(h.Sum(nil))
+	}
+}
+
+// routingKey returns the key a record is stored and routed under, applying the
+// key mapper registered for the key's namespace, if any.
+func (dht *IpfsDHT) routingKey(key string) string {
+	if len(dht.keyMappers) == 0 {
+		return key
+	}
+	ns, rest, err := record.SplitKey(key)
+	if err != nil {
+		return key
+	}
+	m, ok := dht.keyMappers[ns]
+	if !ok {
+		return key
+	}
+	return "/" + ns + "/" + m(rest)
+}
@@ -0,0 +1,145 @@
+package dht
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	dhtcfg "github.com/libp2p/go-libp2p-kad-dht/internal/config"
+)
+
+// LatencyAnomalyKind tells which rate of the lookups deviates from its
+// baseline, see LatencyAnomalyHandler.
+type LatencyAnomalyKind = dhtcfg.LatencyAnomalyKind
+
+const (
+	// LookupLatencyAnomaly is the anomaly of the latency of the lookups, in
+	// milliseconds.
+	LookupLatencyAnomaly LatencyAnomalyKind = iota
+	// LookupTimeoutAnomaly is the anomaly of the fraction of the peers
+	// contacted by the lookups that timed out.
+	LookupTimeoutAnomaly
+)
+
+// LatencyAnomaly describes a deviation of the lookups from their baseline, see
+// LatencyAnomalyHandler.
+type LatencyAnomaly = dhtcfg.LatencyAnomaly
+
+// LatencyAnomalyFunc is called with the anomalies of the lookups as they start
+// and end, see LatencyAnomalyHandler.
+type LatencyAnomalyFunc = dhtcfg.LatencyAnomalyFunc
+
+const (
+	// defaultAnomalyThreshold is the deviation of the recent rates from their
+	// baseline, in standard deviations, starting an anomaly.
+	defaultAnomalyThreshold = 4
+	// anomalyBaselineWeight and anomalyRecentWeight are the weights of a
+	// lookup in the baseline and in the recent rates, moving averages over
+	// the last hundreds and the last few lookups.
+	anomalyBaselineWeight = 1.0 / 256
+	anomalyRecentWeight   = 1.0 / 8
+	// anomalyWarmup is the number of lookups the baseline is established
+	// from before any anomaly is reported.
+	anomalyWarmup = 64
+)
+
+// anomalyRecentScale scales the standard deviation of the rate of a lookup to
+// the one of the recent rate, its moving average.
+var anomalyRecentScale = math.Sqrt(anomalyRecentWeight / (2 - anomalyRecentWeight))
+
+// latencyAnomalies detects the anomalies of the lookups, comparing their
+// recent latency and timeout rate to their baseline.
+type latencyAnomalies struct {
+	handler   LatencyAnomalyFunc
+	threshold float64
+
+	mu       sync.Mutex
+	latency  anomalyRate
+	timeouts anomalyRate
+}
+
+// newLatencyAnomalies returns the detector calling handler, nil if none.
+func newLatencyAnomalies(threshold float64, handler LatencyAnomalyFunc) *latencyAnomalies {
+	if handler == nil {
+		return nil
+	}
+	if threshold == 0 {
+		threshold = defaultAnomalyThreshold
+	}
+	return &latencyAnomalies{
+		handler:   handler,
+		threshold: threshold,
+		// a tenth of the latency, or of the peers, not to take the lookups
+		// of a steady network for anomalies
+		latency:  anomalyRate{relStdDev: 0.1},
+		timeouts: anomalyRate{minStdDev: 0.1},
+	}
+}
+
+// track tracks a lookup that took elapsed and contacted peers, timeouts of
+// which timed out, and calls the handler with the anomalies it starts or ends.
+func (d *latencyAnomalies) track(elapsed time.Duration, timeouts, contacted int) {
+	var anomalies []LatencyAnomaly
+	d.mu.Lock()
+	if a, ok := d.latency.track(float64(elapsed)/float64(time.Millisecond), d.threshold); ok {
+		a.Kind = LookupLatencyAnomaly
+		anomalies = append(anomalies, a)
+	}
+	if contacted > 0 {
+		if a, ok := d.timeouts.track(float64(timeouts)/float64(contacted), d.threshold); ok {
+			a.Kind = LookupTimeoutAnomaly
+			anomalies = append(anomalies, a)
+		}
+	}
+	d.mu.Unlock()
+
+	for _, a := range anomalies {
+		d.handler(a)
+	}
+}
+
+// anomalyRate is a rate of the lookups, tracked against its baseline.
+type anomalyRate struct {
+	// the floor of the standard deviation of the rate of a lookup, absolute
+	// and relative to the baseline
+	minStdDev, relStdDev float64
+
+	samples        int
+	mean, variance float64
+	recent         float64
+	anomalous      bool
+}
+
+// track adds the rate v of a lookup, and returns the anomaly it starts or
+// ends, if any. An anomaly ends once the recent rate is back within half the
+// threshold of its baseline.
+func (r *anomalyRate) track(v, threshold float64) (LatencyAnomaly, bool) {
+	r.samples++
+	if r.samples == 1 {
+		r.mean, r.recent = v, v
+		return LatencyAnomaly{}, false
+	}
+	r.recent += anomalyRecentWeight * (v - r.recent)
+
+	// against the baseline before the lookup
+	stdDev := math.Max(math.Sqrt(r.variance), math.Max(r.minStdDev, r.relStdDev*r.mean))
+	deviation := (r.recent - r.mean) / (stdDev * anomalyRecentScale)
+	a := LatencyAnomaly{Value: r.recent, Baseline: r.mean, Deviation: deviation}
+
+	diff := v - r.mean
+	r.mean += anomalyBaselineWeight * diff
+	r.variance = (1 - anomalyBaselineWeight) * (r.variance + anomalyBaselineWeight*diff*diff)
+
+	switch {
+	case r.samples <= anomalyWarmup:
+		return LatencyAnomaly{}, false
+	case !r.anomalous && deviation > threshold:
+		r.anomalous = true
+		return a, true
+	case r.anomalous && deviation < threshold/2:
+		r.anomalous = false
+		a.Ended = true
+		return a, true
+	}
+	return LatencyAnomaly{}, false
+}
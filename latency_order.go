@@ -0,0 +1,50 @@
+package dht
+
+import (
+	"sort"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// orderByLatency reorders peers, sorted by distance to the key, by blending
+// their rank by distance with their rank by latency, the latter weighed by
+// weight: 0 keeps the order by distance, 1 orders by latency alone. Peers whose
+// latency is unknown rank last by latency. Ties keep the order by distance.
+func orderByLatency(peers []peer.ID, latency func(peer.ID) time.Duration, weight float64) []peer.ID {
+	n := len(peers)
+	if n < 2 || weight <= 0 {
+		return peers
+	}
+
+	latencies := make([]time.Duration, n)
+	byLatency := make([]int, n)
+	for i, p := range peers {
+		latencies[i] = latency(p)
+		byLatency[i] = i
+	}
+	sort.SliceStable(byLatency, func(a, b int) bool {
+		la, lb := latencies[byLatency[a]], latencies[byLatency[b]]
+		if la == 0 || lb == 0 {
+			return la != 0 && lb == 0
+		}
+		return la < lb
+	})
+	scores := make([]float64, n)
+	for rank, i := range byLatency {
+		scores[i] = (1-weight)*float64(i) + weight*float64(rank)
+	}
+
+	order := make([]int, n)
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return scores[order[a]] < scores[order[b]]
+	})
+	ordered := make([]peer.ID, n)
+	for i, j := range order {
+		ordered[i] = peers[j]
+	}
+	return ordered
+}
@@ -0,0 +1,166 @@
+package dht
+
+import (
+	"context"
+	"reflect"
+	"sync/atomic"
+
+	"github.com/jbenet/goprocess"
+	"github.com/libp2p/go-libp2p-core/event"
+	"github.com/libp2p/go-libp2p-core/protocol"
+)
+
+// EvtBootstrapped is emitted on the event bus of the host when a refresh of
+// the routing table started while it was empty completes. The DHT is ready to
+// be used then, e.g. to publish records.
+type EvtBootstrapped struct {
+	// Protocol tells the DHTs of the host apart, e.g. the WAN and LAN DHTs,
+	// as for all the events of the DHT.
+	Protocol         protocol.ID
+	RoutingTableSize int
+}
+
+// EvtRoutingTableHealthChanged is emitted on the event bus of the host when
+// the routing table becomes healthy, holding enough peers for the DHT to stop
+// looking for more, or unhealthy again. It starts unhealthy.
+type EvtRoutingTableHealthChanged struct {
+	Protocol         protocol.ID
+	Healthy          bool
+	RoutingTableSize int
+}
+
+// EvtModeChanged is emitted on the event bus of the host when the DHT switches
+// to Mode, ModeClient or ModeServer.
+type EvtModeChanged struct {
+	Protocol protocol.ID
+	Mode     ModeOpt
+}
+
+// EvtLookupFailed is emitted on the event bus of the host when a lookup finds
+// no peer, unless it was cancelled.
+type EvtLookupFailed struct {
+	Protocol protocol.ID
+	// Operation is the DHT operation the lookup is for, e.g. "FindPeer".
+	Operation string
+	// Key is the hex encoded prefix of the Kademlia ID of the key.
+	Key string
+	// Err is the error failing the lookup, nil if it merely found no peer.
+	Err error
+}
+
+// lifecycleEventsBufferSize is the number of events queued for emission,
+// beyond which further events are dropped.
+const lifecycleEventsBufferSize = 64
+
+// lifecycleEvents emits the lifecycle events of the DHT, in order, from a
+// single goroutine so that slow subscribers don't stall the DHT.
+type lifecycleEvents struct {
+	events   chan interface{}
+	emitters map[reflect.Type]event.Emitter
+	// signaled when the routing table changes
+	rtChanged chan struct{}
+	// dropped counts the events dropped because the queue was full.
+	// Accessed atomically.
+	dropped int64
+}
+
+func newLifecycleEvents(bus event.Bus) (*lifecycleEvents, error) {
+	l := &lifecycleEvents{
+		events:    make(chan interface{}, lifecycleEventsBufferSize),
+		emitters:  make(map[reflect.Type]event.Emitter),
+		rtChanged: make(chan struct{}, 1),
+	}
+	for _, evt := range []interface{}{
+		new(EvtBootstrapped),
+		new(EvtRoutingTableHealthChanged),
+		new(EvtModeChanged),
+		new(EvtLookupFailed),
+	} {
+		em, err := bus.Emitter(evt)
+		if err != nil {
+			l.close()
+			return nil, err
+		}
+		l.emitters[reflect.TypeOf(evt).Elem()] = em
+	}
+	return l, nil
+}
+
+func (l *lifecycleEvents) close() {
+	for _, em := range l.emitters {
+		em.Close()
+	}
+}
+
+// publishLifecycleEvent queues ev for emission. It never blocks, as it may be
+// called with locks held: if the queue is full, ev is dropped and counted.
+func (dht *IpfsDHT) publishLifecycleEvent(ev interface{}) {
+	if dht.lifecycle == nil {
+		return
+	}
+	select {
+	case dht.lifecycle.events <- ev:
+	default:
+		n := atomic.AddInt64(&dht.lifecycle.dropped, 1)
+		logger.Warnw("dropped lifecycle event, subscribers are too slow", "event", reflect.TypeOf(ev), "dropped", n)
+	}
+}
+
+// signalRoutingTableChanged is called from the callbacks of the routing table,
+// under its lock, so it only wakes lifecycleLoop up.
+func (dht *IpfsDHT) signalRoutingTableChanged() {
+	if dht.lifecycle == nil {
+		return
+	}
+	select {
+	case dht.lifecycle.rtChanged <- struct{}{}:
+	default:
+	}
+}
+
+// lookupFailed publishes an EvtLookupFailed if the lookup of target for op,
+// which returned res and err, failed.
+func (dht *IpfsDHT) lookupFailed(ctx context.Context, op, target string, res *lookupWithFollowupResult, err error) {
+	if ctx.Err() != nil || (err == nil && len(res.peers) > 0) {
+		return
+	}
+	dht.publishLifecycleEvent(EvtLookupFailed{
+		Protocol:  dht.protocols[0],
+		Operation: op,
+		Key:       lookupKeyPrefix(target),
+		Err:       err,
+	})
+}
+
+func (dht *IpfsDHT) lifecycleLoop(proc goprocess.Process) {
+	l := dht.lifecycle
+	defer l.close()
+
+	emit := func(ev interface{}) {
+		if err := l.emitters[reflect.TypeOf(ev)].Emit(ev); err != nil {
+			logger.Debugw("failed to emit lifecycle event", "event", ev, "error", err)
+		}
+	}
+	healthy := false
+	cpls := 0
+	for {
+		select {
+		case ev := <-l.events:
+			emit(ev)
+		case <-l.rtChanged:
+			cpls = dht.recordKeyspaceCoverage(cpls)
+			size := dht.routingTable.Size()
+			dht.checkReady(size)
+			if h := size > minRTRefreshThreshold; h != healthy {
+				healthy = h
+				emit(EvtRoutingTableHealthChanged{
+					Protocol:         dht.protocols[0],
+					Healthy:          healthy,
+					RoutingTableSize: size,
+				})
+			}
+		case <-proc.Closing():
+			return
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package dht
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
+)
+
+// livenessSender reports the peers answering our requests as alive, so that
+// the routing table refresh doesn't check on the peers we exchanged messages
+// with recently.
+type livenessSender struct {
+	pb.MessageSender
+	alive func(p peer.ID)
+}
+
+func (ls *livenessSender) SendRequest(ctx context.Context, p peer.ID, pmes *pb.Message) (*pb.Message, error) {
+	resp, err := ls.MessageSender.SendRequest(ctx, p, pmes)
+	var throttled *pb.ThrottledError
+	if err == nil || errors.As(err, &throttled) {
+		// busy peers are alive too
+		ls.alive(p)
+	}
+	return resp, err
+}
+
+// OnDisconnect forwards disconnections to the wrapped sender.
+func (ls *livenessSender) OnDisconnect(ctx context.Context, p peer.ID) {
+	if d, ok := ls.MessageSender.(disconnector); ok {
+		d.OnDisconnect(ctx, p)
+	}
+}
+
+// peerAlive records that p answered a request, if it is in the routing table.
+func (dht *IpfsDHT) peerAlive(p peer.ID) {
+	dht.routingTable.UpdateLastSuccessfulOutboundQueryAt(p, time.Now())
+}
@@ -17,11 +17,22 @@ import (
 // If the context is canceled, this function will return the context error along
 // with the closest K peers it has found so far.
 func (dht *IpfsDHT) GetClosestPeers(ctx context.Context, key string) ([]peer.ID, error) {
+	ctx = dht.operationContext(ctx, opGetClosestPeers)
+	return dht.getClosestPeers(ctx, key, dht.bucketSize)
+}
+
+// getReplicaPeers returns the peers that records for the given key should be
+// stored on, i.e. the closest replication factor peers.
+func (dht *IpfsDHT) getReplicaPeers(ctx context.Context, key string) ([]peer.ID, error) {
+	return dht.getClosestPeers(ctx, key, dht.replicationFactor)
+}
+
+func (dht *IpfsDHT) getClosestPeers(ctx context.Context, key string, count int) ([]peer.ID, error) {
 	if key == "" {
 		return nil, fmt.Errorf("can't lookup empty key")
 	}
 	//TODO: I can break the interface! return []peer.ID
-	lookupRes, err := dht.runLookupWithFollowup(ctx, key,
+	lookupRes, err := dht.runLookupWithFollowupN(ctx, opGetClosestPeers, key, count,
 		func(ctx context.Context, p peer.ID) ([]*peer.AddrInfo, error) {
 			// For DHT query command
 			routing.PublishQueryEvent(ctx, &routing.QueryEvent{
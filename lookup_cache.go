@@ -0,0 +1,82 @@
+package dht
+
+import (
+	"context"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	record "github.com/libp2p/go-libp2p-record"
+	"github.com/multiformats/go-multihash"
+
+	"github.com/libp2p/go-libp2p-kad-dht/internal"
+	dhtcfg "github.com/libp2p/go-libp2p-kad-dht/internal/config"
+	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
+	"github.com/libp2p/go-libp2p-kad-dht/qpeerset"
+)
+
+// CachePolicyFunc decides whether a value, or the providers of a key, found by a
+// lookup should be cached. It is passed a nil value for providers.
+type CachePolicyFunc = dhtcfg.CachePolicyFunc
+
+// cacheValue caches val at the closest peer queried by the lookup that didn't
+// return it.
+func (dht *IpfsDHT) cacheValue(key string, val []byte, peersWithVal map[peer.ID]struct{}, lookupRes <-chan *lookupWithFollowupResult) {
+	if dht.lookupCachePolicy != nil && !dht.lookupCachePolicy(key, val) {
+		return
+	}
+
+	var l *lookupWithFollowupResult
+	select {
+	case l = <-lookupRes:
+	case <-dht.ctx.Done():
+		return
+	}
+	p, ok := cacheTarget(l, peersWithVal)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(dht.ctx, 30*time.Second)
+	defer cancel()
+	logger.Debugw("caching value", "key", internal.LoggableRecordKeyString(key), "peer", p)
+	if err := dht.protoMessenger.CacheValue(ctx, p, record.MakePutRecord(key, val), dht.lookupCacheTTL); err != nil {
+		logger.Debugw("failed to cache value", "key", internal.LoggableRecordKeyString(key), "peer", p, "error", err)
+	}
+}
+
+// cacheProviders caches the signed provider records found by a lookup at the
+// closest peer queried that returned no provider.
+func (dht *IpfsDHT) cacheProviders(key multihash.Multihash, recs []*pb.ProviderRecord, peersWithProvs map[peer.ID]struct{}, l *lookupWithFollowupResult) {
+	if dht.lookupCachePolicy != nil && !dht.lookupCachePolicy(string(key), nil) {
+		return
+	}
+	p, ok := cacheTarget(l, peersWithProvs)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(dht.ctx, 30*time.Second)
+	defer cancel()
+	logger.Debugw("caching providers", "key", internal.LoggableProviderRecordBytes(key), "peer", p)
+	if err := dht.protoMessenger.CacheProviders(ctx, p, key, recs, dht.lookupCacheTTL); err != nil {
+		logger.Debugw("failed to cache providers", "key", internal.LoggableProviderRecordBytes(key), "peer", p, "error", err)
+	}
+}
+
+// cacheTarget returns the closest peer queried by the lookup that isn't in have.
+func cacheTarget(l *lookupWithFollowupResult, have map[peer.ID]struct{}) (peer.ID, bool) {
+	if l == nil {
+		return "", false
+	}
+	// the peers are sorted by distance to the key
+	for i, p := range l.peers {
+		if l.state[i] != qpeerset.PeerQueried {
+			continue
+		}
+		if _, ok := have[p]; ok {
+			continue
+		}
+		return p, true
+	}
+	return "", false
+}
@@ -0,0 +1,111 @@
+package dht
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	"github.com/libp2p/go-libp2p-kad-dht/qpeerset"
+	kb "github.com/libp2p/go-libp2p-kbucket"
+)
+
+// experimentRun is the outcome of one side of a lookup experiment.
+type experimentRun struct {
+	summary *LookupSummary
+	weight  float64
+	// the peers contacted
+	contacted []peer.ID
+}
+
+func (q *query) experimentRun(summary *LookupSummary) experimentRun {
+	return experimentRun{
+		summary:   summary,
+		weight:    q.latencyWeight,
+		contacted: q.queryPeers.GetClosestInStates(qpeerset.PeerQueried, qpeerset.PeerUnreachable),
+	}
+}
+
+// startLookupExperiment starts the shadow lookup of target from seeds, if the
+// lookup is sampled for an experiment, see LookupExperiment. The outcome of
+// the primary lookup must be sent on the returned channel, or nil if not
+// sampled, for both to be logged once done.
+func (dht *IpfsDHT) startLookupExperiment(target string, seeds []peer.ID) chan<- experimentRun {
+	if dht.experimentFraction <= 0 || rand.Float64() >= dht.experimentFraction {
+		return nil
+	}
+
+	primary := make(chan experimentRun, 1)
+	go func() {
+		// the shadow lookup only asks for closer peers, whatever the primary
+		// lookup does with the peers it queries
+		sq := &query{
+			id:         uuid.New(),
+			key:        target,
+			ctx:        dht.ctx,
+			dht:        dht,
+			queryPeers: qpeerset.NewQueryPeerset(target),
+			seedPeers:  seeds,
+			peerTimes:  make(map[peer.ID]time.Duration),
+			queryFn: func(ctx context.Context, p peer.ID) ([]*peer.AddrInfo, error) {
+				return dht.protoMessenger.GetClosestPeers(ctx, p, peer.ID(target))
+			},
+			stopFn:     func() bool { return false },
+			numResults: dht.bucketSize,
+
+			latencyWeight: dht.experimentWeight,
+			shadow:        true,
+		}
+		start := time.Now()
+		sq.run()
+		elapsed := time.Since(start)
+		shadow := sq.experimentRun(sq.summary(elapsed, sq.constructLookupResult(kb.ConvertKey(target))))
+
+		select {
+		case p := <-primary:
+			logLookupExperiment(p, shadow)
+		case <-dht.ctx.Done():
+		}
+	}()
+	return primary
+}
+
+// logLookupExperiment logs the outcome of both sides of a lookup experiment,
+// and how much the peers they contacted diverge: 0 if the same, 1 if disjoint.
+func logLookupExperiment(primary, shadow experimentRun) {
+	lookupLogger.Infow("lookup experiment",
+		"id", primary.summary.ID.String(),
+		"key", primary.summary.Key,
+		"divergence", divergence(primary.contacted, shadow.contacted),
+		"primary_weight", primary.weight,
+		"primary_duration_ms", primary.summary.Duration.Milliseconds(),
+		"primary_hops", primary.summary.Hops,
+		"primary_contacted", primary.summary.Contacted,
+		"primary_reason", primary.summary.Reason.String(),
+		"shadow_weight", shadow.weight,
+		"shadow_duration_ms", shadow.summary.Duration.Milliseconds(),
+		"shadow_hops", shadow.summary.Hops,
+		"shadow_contacted", shadow.summary.Contacted,
+		"shadow_reason", shadow.summary.Reason.String(),
+	)
+}
+
+// divergence returns the Jaccard distance between the sets of peers a and b.
+func divergence(a, b []peer.ID) float64 {
+	if len(a) == 0 && len(b) == 0 {
+		return 0
+	}
+	in := make(map[peer.ID]struct{}, len(a))
+	for _, p := range a {
+		in[p] = struct{}{}
+	}
+	common := 0
+	for _, p := range b {
+		if _, ok := in[p]; ok {
+			common++
+		}
+	}
+	return 1 - float64(common)/float64(len(a)+len(b)-common)
+}
@@ -0,0 +1,125 @@
+package dht
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/google/uuid"
+	logging "github.com/ipfs/go-log"
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	"github.com/libp2p/go-libp2p-kad-dht/qpeerset"
+	kb "github.com/libp2p/go-libp2p-kbucket"
+)
+
+// lookupLogger logs the lookup records, see LookupLogs.
+var lookupLogger = logging.Logger("dht/lookups")
+
+// keyPrefixSize is the number of bytes of the Kademlia ID of the keys logged,
+// enough to locate the keys in the keyspace without revealing them.
+const keyPrefixSize = 4
+
+// LookupSummary describes a completed lookup, see LookupLogs and DebugServer.
+type LookupSummary struct {
+	// ID is the identifier of the lookup, as in its LookupEvents.
+	ID uuid.UUID
+	// Key is the hex encoded prefix of the Kademlia ID of the key.
+	Key string
+	// Duration is how long the lookup took, excluding its follow up queries.
+	Duration time.Duration
+	// Hops is the length of the longest referral path from our routing table
+	// to a peer that answered.
+	Hops int
+	// Contacted is the number of peers queried, successfully or not.
+	Contacted int
+	// Timeouts is the number of peers that timed out.
+	Timeouts int
+	// Unreachable is the number of peers that failed to answer.
+	Unreachable int
+	// Results is the number of closest peers found.
+	Results int
+	// Unhelpful is the number of responses that didn't refer the lookup to
+	// any new peer closer to the key than the peer responding, and Repeated
+	// the number of those with the same peers as the unhelpful response of
+	// another peer. Many repeated responses are the symptom of a referral
+	// loop, or of lazy or adversarial servers.
+	Unhelpful int
+	Repeated  int
+	// Reason is why the lookup terminated.
+	Reason LookupTerminationReason
+}
+
+// summary returns the summary of the completed lookup q, which took elapsed
+// and found res.
+func (q *query) summary(elapsed time.Duration, res *lookupWithFollowupResult) *LookupSummary {
+	return &LookupSummary{
+		ID:          q.id,
+		Key:         lookupKeyPrefix(q.key),
+		Duration:    elapsed,
+		Hops:        q.hops(),
+		Contacted:   len(q.queryPeers.GetClosestInStates(qpeerset.PeerQueried, qpeerset.PeerUnreachable)),
+		Timeouts:    q.timeouts,
+		Unreachable: len(q.queryPeers.GetClosestInStates(qpeerset.PeerUnreachable)),
+		Results:     len(res.peers),
+		Unhelpful:   q.referrals.unhelpful,
+		Repeated:    q.referrals.repeated,
+		Reason:      q.reason,
+	}
+}
+
+// lookupKeyPrefix returns the hex encoded prefix of the Kademlia ID of key.
+func lookupKeyPrefix(key string) string {
+	return hex.EncodeToString(kb.ConvertKey(key)[:keyPrefixSize])
+}
+
+// logLookup logs the record of a completed lookup.
+func logLookup(s *LookupSummary) {
+	lookupLogger.Infow("lookup",
+		"id", s.ID.String(),
+		"key", s.Key,
+		"duration_ms", s.Duration.Milliseconds(),
+		"hops", s.Hops,
+		"contacted", s.Contacted,
+		"timeouts", s.Timeouts,
+		"unreachable", s.Unreachable,
+		"results", s.Results,
+		"unhelpful", s.Unhelpful,
+		"repeated", s.Repeated,
+		"reason", s.Reason.String(),
+	)
+}
+
+// hops returns the length of the longest referral path from our routing table
+// to a peer that answered the query.
+func (q *query) hops() int {
+	depths := make(map[peer.ID]int)
+	var depth func(p peer.ID) int
+	depth = func(p peer.ID) int {
+		if p == q.dht.self {
+			return 0
+		}
+		if d, ok := depths[p]; ok {
+			return d
+		}
+		d := depth(q.queryPeers.GetReferrer(p)) + 1
+		depths[p] = d
+		return d
+	}
+
+	max := 0
+	for _, p := range q.queryPeers.GetClosestInStates(qpeerset.PeerQueried) {
+		if d := depth(p); d > max {
+			max = d
+		}
+	}
+	return max
+}
+
+// isTimeout returns whether err reports a timeout.
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout())
+}
@@ -0,0 +1,102 @@
+package dht
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/libp2p/go-libp2p-core/peer"
+	kb "github.com/libp2p/go-libp2p-kbucket"
+
+	"github.com/libp2p/go-libp2p-kad-dht/qpeerset"
+)
+
+// LookupProgress describes the progress of a lookup, see
+// RegisterForLookupProgress.
+type LookupProgress struct {
+	// ID identifies the lookup, as in its LookupEvents.
+	ID uuid.UUID
+	// Key is the hex encoded prefix of the Kademlia ID of the key.
+	Key string
+	// Closest is the closest peer to the key that answered so far, if any, and
+	// ClosestCpl the length of the common prefix of their Kademlia IDs: the
+	// longer, the closer the lookup got to the key.
+	Closest    peer.ID
+	ClosestCpl int
+	// Heard, Waiting, Queried and Failed are the numbers of peers the lookup
+	// heard of and didn't query yet, is waiting on, queried and failed to.
+	Heard, Waiting, Queried, Failed int
+	// Elapsed is the time elapsed since the start of the lookup.
+	Elapsed time.Duration
+}
+
+type lookupProgressKey struct{}
+
+// lookupProgressChannel holds the last progress of the lookups not received
+// yet, so that slow receivers don't slow the lookups down.
+type lookupProgressChannel struct {
+	mu  sync.Mutex
+	ctx context.Context
+	ch  chan LookupProgress
+}
+
+// RegisterForLookupProgress registers a lookup progress channel with the
+// given context. The returned context can be passed to DHT operations, e.g.
+// FindPeer and FindProviders, to receive the progress of their lookups on the
+// returned channel after every response, e.g. to render it live. The updates
+// the receiver didn't keep up with are replaced by the last one.
+//
+// The channel is closed once the passed context is canceled, which it MUST be
+// when the caller is no longer interested in the progress.
+func RegisterForLookupProgress(ctx context.Context) (context.Context, <-chan LookupProgress) {
+	pch := &lookupProgressChannel{ctx: ctx, ch: make(chan LookupProgress, 1)}
+	go pch.waitThenClose()
+	return context.WithValue(ctx, lookupProgressKey{}, pch), pch.ch
+}
+
+func (c *lookupProgressChannel) waitThenClose() {
+	<-c.ctx.Done()
+	c.mu.Lock()
+	close(c.ch)
+	c.ch = nil
+	c.mu.Unlock()
+}
+
+func (c *lookupProgressChannel) send(p LookupProgress) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ch == nil {
+		return
+	}
+	// replace the update not received yet, if any
+	select {
+	case <-c.ch:
+	default:
+	}
+	c.ch <- p
+}
+
+// publishProgress publishes the progress of the lookup q to the lookup
+// progress channel of its context, if any.
+func (q *query) publishProgress(start time.Time) {
+	pch, ok := q.ctx.Value(lookupProgressKey{}).(*lookupProgressChannel)
+	if !ok {
+		return
+	}
+
+	p := LookupProgress{
+		ID:      q.id,
+		Key:     lookupKeyPrefix(q.key),
+		Heard:   q.queryPeers.NumHeard(),
+		Waiting: q.queryPeers.NumWaiting(),
+		Queried: len(q.queryPeers.GetClosestInStates(qpeerset.PeerQueried)),
+		Failed:  len(q.queryPeers.GetClosestInStates(qpeerset.PeerUnreachable)),
+		Elapsed: time.Since(start),
+	}
+	if closest := q.queryPeers.GetClosestNInStates(1, qpeerset.PeerQueried); len(closest) > 0 {
+		p.Closest = closest[0]
+		p.ClosestCpl = kb.CommonPrefixLen(kb.ConvertKey(q.key), kb.ConvertPeerID(closest[0]))
+	}
+	pch.send(p)
+}
@@ -0,0 +1,303 @@
+package dht
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-kad-dht/qpeerset"
+
+	"github.com/google/uuid"
+)
+
+// LookupRecord records all the inputs of a lookup: its seed peers, every
+// response, in the order the lookup processed them, and what it decided after
+// each of them. ReplayLookup replays it against the scheduler of the lookups.
+type LookupRecord struct {
+	Key        []byte
+	Seeds      []peer.ID
+	Alpha      int
+	Beta       int
+	NumResults int
+	// LatencyWeight is the weight of the latency of the peers when picking
+	// the peers to query next, see LookupLatencyWeight.
+	LatencyWeight float64
+	Steps         []LookupRecordStep
+}
+
+// LookupRecordStep records a response processed by a lookup, or the
+// cancellation of the lookup, and the decision the lookup took then.
+type LookupRecordStep struct {
+	// At is the time elapsed since the start of the lookup.
+	At time.Duration
+	// Update is the response processed, nil if the lookup was cancelled. The
+	// first step processes the seed peers.
+	Update *LookupRecordUpdate `json:",omitempty"`
+	// Skipped are the heard peers skipped for being backed off from, blocked
+	// or undialable, with the state they were set to.
+	Skipped map[peer.ID]qpeerset.PeerState `json:",omitempty"`
+	// Latencies are the latencies the peers to query next were ordered by, if
+	// weighted by their latency.
+	Latencies map[peer.ID]time.Duration `json:",omitempty"`
+	// Next are the peers queried next, unless the lookup terminated for
+	// Reason.
+	Next       []peer.ID `json:",omitempty"`
+	Terminated bool      `json:",omitempty"`
+	Reason     LookupTerminationReason
+}
+
+// LookupRecordUpdate is a response processed by a lookup.
+type LookupRecordUpdate struct {
+	// Cause is the peer that responded, empty for the seed peers.
+	Cause       peer.ID   `json:",omitempty"`
+	Heard       []peer.ID `json:",omitempty"`
+	Queried     []peer.ID `json:",omitempty"`
+	Unreachable []peer.ID `json:",omitempty"`
+	Throttled   []peer.ID `json:",omitempty"`
+	TimedOut    bool      `json:",omitempty"`
+	Duration    time.Duration
+}
+
+type lookupRecorderKey struct{}
+
+// lookupRecorder writes the records of the lookups to w, one JSON object per
+// line.
+type lookupRecorder struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// RecordLookups returns a context that records the lookups run with it to w,
+// as one JSON encoded LookupRecord per line, e.g. to reproduce a lookup with
+// ReplayLookup.
+func RecordLookups(ctx context.Context, w io.Writer) context.Context {
+	return context.WithValue(ctx, lookupRecorderKey{}, &lookupRecorder{w: w})
+}
+
+func lookupRecorderFromContext(ctx context.Context) *lookupRecorder {
+	r, _ := ctx.Value(lookupRecorderKey{}).(*lookupRecorder)
+	return r
+}
+
+func (r *lookupRecorder) write(rec *LookupRecord) {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		logger.Debugw("failed to encode lookup record", "error", err)
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, err := r.w.Write(append(b, '\n')); err != nil {
+		logger.Debugw("failed to write lookup record", "error", err)
+	}
+}
+
+// lookupRecording records the lookup of a query as it runs.
+type lookupRecording struct {
+	start time.Time
+	rec   *LookupRecord
+	// the step being recorded
+	step LookupRecordStep
+}
+
+func newLookupRecording(q *query) *lookupRecording {
+	return &lookupRecording{
+		start: time.Now(),
+		rec: &LookupRecord{
+			Key:           []byte(q.key),
+			Seeds:         q.seedPeers,
+			Alpha:         q.dht.alpha,
+			Beta:          q.dht.beta,
+			NumResults:    q.numResults,
+			LatencyWeight: q.latencyWeight,
+		},
+	}
+}
+
+// update starts recording the step processing up, nil if the lookup was
+// cancelled.
+func (r *lookupRecording) update(q *query, up *queryUpdate) {
+	r.step = LookupRecordStep{At: time.Since(r.start)}
+	if up == nil {
+		return
+	}
+	// the lookup ignores ourselves, which replaying it as another peer
+	// mustn't see
+	withoutSelf := func(peers []peer.ID) []peer.ID {
+		var res []peer.ID
+		for _, p := range peers {
+			if p != q.dht.self {
+				res = append(res, p)
+			}
+		}
+		return res
+	}
+	r.step.Update = &LookupRecordUpdate{
+		Heard:       withoutSelf(up.heard),
+		Queried:     withoutSelf(up.queried),
+		Unreachable: withoutSelf(up.unreachable),
+		Throttled:   up.throttled,
+		TimedOut:    up.timedOut,
+		Duration:    up.queryDuration,
+	}
+	if up.cause != q.dht.self {
+		r.step.Update.Cause = up.cause
+	}
+}
+
+// latency returns the latency of p to the scheduler, recording it.
+func (r *lookupRecording) latency(q *query) func(peer.ID) time.Duration {
+	return func(p peer.ID) time.Duration {
+		l := q.dht.peerstore.LatencyEWMA(p)
+		if r.step.Latencies == nil {
+			r.step.Latencies = make(map[peer.ID]time.Duration)
+		}
+		r.step.Latencies[p] = l
+		return l
+	}
+}
+
+// decide records the decision of the scheduler, given the peers heard before
+// it, ending the step.
+func (r *lookupRecording) decide(q *query, heard []peer.ID, next []peer.ID) {
+	for _, p := range heard {
+		if st := q.queryPeers.GetState(p); st != qpeerset.PeerHeard && st != qpeerset.PeerWaiting {
+			if r.step.Skipped == nil {
+				r.step.Skipped = make(map[peer.ID]qpeerset.PeerState)
+			}
+			r.step.Skipped[p] = st
+		}
+	}
+	if q.terminated {
+		r.step.Terminated = true
+		r.step.Reason = q.reason
+	} else {
+		r.step.Next = next
+	}
+	r.rec.Steps = append(r.rec.Steps, r.step)
+}
+
+// ReadLookupRecords reads the lookup records written by RecordLookups.
+func ReadLookupRecords(r io.Reader) ([]*LookupRecord, error) {
+	var recs []*LookupRecord
+	s := bufio.NewScanner(r)
+	s.Buffer(nil, 64<<20)
+	for s.Scan() {
+		rec := new(LookupRecord)
+		if err := json.Unmarshal(s.Bytes(), rec); err != nil {
+			return nil, err
+		}
+		recs = append(recs, rec)
+	}
+	return recs, s.Err()
+}
+
+// ReplayLookup replays the lookup recorded by rec against the scheduler of the
+// lookups of the DHT, feeding it the recorded responses in the recorded order
+// without sending any request. It returns an error describing the first step
+// at which the scheduler decides otherwise than recorded, e.g. to reproduce a
+// regression of the termination of the lookups or of the order they query the
+// peers in.
+//
+// The DHT must be configured with the Resiliency of the recorded lookup.
+func (dht *IpfsDHT) ReplayLookup(ctx context.Context, rec *LookupRecord) error {
+	if rec.Beta != dht.beta {
+		return fmt.Errorf("lookup recorded with a resiliency of %d, replayed with %d", rec.Beta, dht.beta)
+	}
+
+	var step *LookupRecordStep
+	stopped := false
+	q := &query{
+		id:         uuid.New(),
+		key:        string(rec.Key),
+		ctx:        ctx,
+		dht:        dht,
+		queryPeers: qpeerset.NewQueryPeerset(string(rec.Key)),
+		seedPeers:  rec.Seeds,
+		peerTimes:  make(map[peer.ID]time.Duration),
+		stopFn:     func() bool { return stopped },
+		numResults: rec.NumResults,
+
+		latencyWeight: rec.LatencyWeight,
+		latency:       func(p peer.ID) time.Duration { return step.Latencies[p] },
+		// nothing to publish
+		shadow: true,
+	}
+
+	for i := range rec.Steps {
+		step = &rec.Steps[i]
+		if step.Update == nil {
+			// cancelled
+			if !step.Terminated || step.Reason != LookupCancelled {
+				return fmt.Errorf("step %d: cancelled without terminating", i)
+			}
+			return nil
+		}
+
+		up := &queryUpdate{
+			cause:         step.Update.Cause,
+			heard:         step.Update.Heard,
+			queried:       step.Update.Queried,
+			unreachable:   step.Update.Unreachable,
+			throttled:     step.Update.Throttled,
+			timedOut:      step.Update.TimedOut,
+			queryDuration: step.Update.Duration,
+		}
+		if up.cause == "" {
+			up.cause = dht.self
+		}
+		if err := q.replayUpdate(up); err != nil {
+			return fmt.Errorf("step %d: %w", i, err)
+		}
+		for p, st := range step.Skipped {
+			if q.queryPeers.GetState(p) != qpeerset.PeerHeard {
+				return fmt.Errorf("step %d: skipped peer %s isn't heard", i, p)
+			}
+			q.queryPeers.SetState(p, st)
+		}
+
+		stopped = step.Terminated && step.Reason == LookupStopped
+		ready, reason, next := q.isReadyToTerminate(ctx, rec.Alpha-q.queryPeers.NumWaiting())
+		switch {
+		case ready != step.Terminated:
+			return fmt.Errorf("step %d: terminated is %t, recorded %t", i, ready, step.Terminated)
+		case ready && reason != step.Reason:
+			return fmt.Errorf("step %d: terminated for %s, recorded %s", i, reason, step.Reason)
+		case ready:
+			if i != len(rec.Steps)-1 {
+				return fmt.Errorf("step %d: terminated before the last recorded step", i)
+			}
+			return nil
+		}
+		if len(next) != len(step.Next) {
+			return fmt.Errorf("step %d: querying %v next, recorded %v", i, next, step.Next)
+		}
+		for j := range next {
+			if next[j] != step.Next[j] {
+				return fmt.Errorf("step %d: querying %v next, recorded %v", i, next, step.Next)
+			}
+		}
+		for _, p := range next {
+			q.queryPeers.SetState(p, qpeerset.PeerWaiting)
+		}
+	}
+	return fmt.Errorf("not terminated after the %d recorded steps", len(rec.Steps))
+}
+
+// replayUpdate applies a recorded update, which may be inconsistent with the
+// state of the replayed lookup if the scheduler changed.
+func (q *query) replayUpdate(up *queryUpdate) (err error) {
+	defer func() {
+		// updateState panics on transitions the protocol doesn't allow
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	q.updateState(q.ctx, up)
+	return nil
+}
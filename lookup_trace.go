@@ -0,0 +1,72 @@
+package dht
+
+import (
+	"context"
+	"math/rand"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer records a span for every lookup and, under it, a span for every
+// request sent to a peer during the lookup, with the peer that referred us to
+// it so the convergence of the lookup can be retraced.
+//
+// The spans go to the global TracerProvider: applications export them, e.g. in
+// OTLP or to Jaeger, by registering the TracerProvider of the OpenTelemetry SDK
+// configured with the exporter of their choice, see otel.SetTracerProvider.
+var tracer = otel.Tracer("github.com/libp2p/go-libp2p-kad-dht")
+
+// sampleLookup returns whether to trace and log a lookup, see LookupSampling.
+func (dht *IpfsDHT) sampleLookup() bool {
+	return dht.lookupSampling >= 1 || rand.Float64() < dht.lookupSampling
+}
+
+// startLookupSpan starts the root span of the lookup of target, if sampled.
+// The lookups not sampled get a non-recording span, which their requests
+// aren't traced under.
+func startLookupSpan(ctx context.Context, target string, sampled bool) (context.Context, trace.Span) {
+	if !sampled {
+		span := trace.SpanFromContext(context.Background())
+		return trace.ContextWithSpan(ctx, span), span
+	}
+	return tracer.Start(ctx, "lookup", trace.WithAttributes(
+		attribute.String("key", lookupKeyPrefix(target)),
+	))
+}
+
+// endLookupSpan records the outcome of the lookup summarized by s on the
+// lookup span of ctx.
+func endLookupSpan(ctx context.Context, s *LookupSummary) {
+	span := trace.SpanFromContext(ctx)
+	span.SetAttributes(
+		attribute.String("id", s.ID.String()),
+		attribute.Int("hops", s.Hops),
+		attribute.Int("contacted", s.Contacted),
+		attribute.Int("timeouts", s.Timeouts),
+		attribute.Int("unreachable", s.Unreachable),
+		attribute.Int("results", s.Results),
+		attribute.Int("unhelpful", s.Unhelpful),
+		attribute.Int("repeated", s.Repeated),
+		attribute.String("reason", s.Reason.String()),
+	)
+}
+
+// startPeerSpan starts the span of a request sent to p, referred to us by
+// referrer, under the lookup span of ctx.
+func startPeerSpan(ctx context.Context, name string, p, referrer peer.ID) (context.Context, trace.Span) {
+	attrs := []attribute.KeyValue{attribute.String("peer", p.Pretty())}
+	if referrer != "" {
+		attrs = append(attrs, attribute.String("referrer", referrer.Pretty()))
+	}
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// failSpan records on span the error failing its request.
+func failSpan(span trace.Span, err error) {
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
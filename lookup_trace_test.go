@@ -0,0 +1,221 @@
+package dht
+
+import (
+	"context"
+	"encoding/hex"
+	"sync"
+	"testing"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+
+	kb "github.com/libp2p/go-libp2p-kbucket"
+)
+
+// testTracerProvider records the spans started while recording.
+type testTracerProvider struct {
+	mu        sync.Mutex
+	recording bool
+	spans     []*testSpan
+}
+
+func (tp *testTracerProvider) Tracer(string, ...trace.TracerOption) trace.Tracer {
+	return testTracer{tp}
+}
+
+func (tp *testTracerProvider) record(on bool) {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	if on {
+		tp.spans = nil
+	}
+	tp.recording = on
+}
+
+func (tp *testTracerProvider) recorded() []*testSpan {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	return append([]*testSpan(nil), tp.spans...)
+}
+
+var (
+	// the global TracerProvider only delegates to the first one installed
+	testTracing        = &testTracerProvider{}
+	installTestTracing sync.Once
+)
+
+type testTracer struct {
+	tp *testTracerProvider
+}
+
+func (t testTracer) Start(ctx context.Context, name string, opts ...trace.SpanOption) (context.Context, trace.Span) {
+	t.tp.mu.Lock()
+	defer t.tp.mu.Unlock()
+	if !t.tp.recording {
+		return trace.NewNoopTracerProvider().Tracer("").Start(ctx, name, opts...)
+	}
+
+	s := &testSpan{
+		tracer: t,
+		name:   name,
+		attrs:  make(map[attribute.Key]attribute.Value),
+	}
+	if parent, ok := trace.SpanFromContext(ctx).(*testSpan); ok {
+		s.parent = parent
+	}
+	for _, kv := range trace.NewSpanConfig(opts...).Attributes {
+		s.attrs[kv.Key] = kv.Value
+	}
+	t.tp.spans = append(t.tp.spans, s)
+	return trace.ContextWithSpan(ctx, s), s
+}
+
+type testSpan struct {
+	tracer testTracer
+	name   string
+	parent *testSpan
+
+	mu     sync.Mutex
+	attrs  map[attribute.Key]attribute.Value
+	status codes.Code
+	ended  bool
+}
+
+func (s *testSpan) Tracer() trace.Tracer                    { return s.tracer }
+func (s *testSpan) AddEvent(string, ...trace.EventOption)   {}
+func (s *testSpan) IsRecording() bool                       { return true }
+func (s *testSpan) RecordError(error, ...trace.EventOption) {}
+func (s *testSpan) SpanContext() trace.SpanContext          { return trace.SpanContext{} }
+func (s *testSpan) SetName(string)                          {}
+
+func (s *testSpan) End(...trace.SpanOption) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ended = true
+}
+
+func (s *testSpan) SetStatus(code codes.Code, _ string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status = code
+}
+
+func (s *testSpan) SetAttributes(kvs ...attribute.KeyValue) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, kv := range kvs {
+		s.attrs[kv.Key] = kv.Value
+	}
+}
+
+func (s *testSpan) attr(key string) attribute.Value {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.attrs[attribute.Key(key)]
+}
+
+func TestLookupTrace(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	installTestTracing.Do(func() { otel.SetTracerProvider(testTracing) })
+	tp := testTracing
+
+	client := setupDHT(ctx, t, false)
+	near := setupDHT(ctx, t, false)
+	far := setupDHT(ctx, t, false)
+	for _, d := range []*IpfsDHT{client, near, far} {
+		defer d.Close()
+		defer d.host.Close()
+	}
+	connect(t, ctx, client, near)
+	connect(t, ctx, near, far)
+
+	tp.record(true)
+	peers, err := client.GetClosestPeers(ctx, "foo")
+	tp.record(false)
+	require.NoError(t, err)
+	require.Len(t, peers, 2)
+
+	key := hex.EncodeToString(kb.ConvertKey("foo")[:keyPrefixSize])
+	var lookup *testSpan
+	queried := make(map[peer.ID]*testSpan)
+	for _, s := range tp.recorded() {
+		switch s.name {
+		case "lookup":
+			if s.attr("key").AsString() == key {
+				lookup = s
+			}
+		case "query peer":
+			queried[peer.ID(s.attr("peer").AsString())] = s
+		}
+	}
+	require.NotNil(t, lookup)
+	require.True(t, lookup.ended)
+	require.EqualValues(t, 2, lookup.attr("hops").AsInt64())
+	require.EqualValues(t, 2, lookup.attr("contacted").AsInt64())
+	require.EqualValues(t, 2, lookup.attr("results").AsInt64())
+	require.Equal(t, LookupStarvation.String(), lookup.attr("reason").AsString())
+
+	// the requests to the peers are traced under the lookup, with the peer
+	// that referred us to them
+	for _, tc := range []struct {
+		peer, referrer peer.ID
+	}{
+		{near.self, client.self},
+		{far.self, near.self},
+	} {
+		s, ok := queried[peer.ID(tc.peer.Pretty())]
+		require.True(t, ok)
+		require.Same(t, lookup, s.parent)
+		require.True(t, s.ended)
+		require.Equal(t, codes.Unset, s.status)
+		require.Equal(t, tc.referrer.Pretty(), s.attr("referrer").AsString())
+		require.EqualValues(t, 1, s.attr("heard").AsInt64())
+	}
+}
+
+func TestLookupSampling(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	installTestTracing.Do(func() { otel.SetTracerProvider(testTracing) })
+	tp := testTracing
+
+	core, logs := observer.New(zap.InfoLevel)
+	sugared := lookupLogger.SugaredLogger
+	lookupLogger.SugaredLogger = *zap.New(core).Sugar()
+	defer func() { lookupLogger.SugaredLogger = sugared }()
+
+	client := setupDHT(ctx, t, false, LookupLogs(), LookupSampling(0))
+	near := setupDHT(ctx, t, false)
+	far := setupDHT(ctx, t, false)
+	for _, d := range []*IpfsDHT{client, near, far} {
+		defer d.Close()
+		defer d.host.Close()
+	}
+	connect(t, ctx, client, near)
+	connect(t, ctx, near, far)
+
+	// the lookup runs under a span of the application
+	tp.record(true)
+	appCtx, appSpan := otel.Tracer("app").Start(ctx, "app")
+	peers, err := client.GetClosestPeers(appCtx, "foo")
+	appSpan.End()
+	tp.record(false)
+	require.NoError(t, err)
+	require.Len(t, peers, 2)
+
+	// neither traced nor logged, nor recorded on the span of the application
+	spans := tp.recorded()
+	require.Len(t, spans, 1)
+	require.Equal(t, "app", spans[0].name)
+	require.Empty(t, spans[0].attrs)
+	require.Zero(t, logs.FilterMessage("lookup").Len())
+}
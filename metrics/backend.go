@@ -0,0 +1,260 @@
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opencensus.io/stats/view"
+)
+
+// Label is a label of a metric, one of the tags of the view.
+type Label struct {
+	Key, Value string
+}
+
+// Backend receives the metrics of the DHT, for the embedders that don't use
+// OpenCensus or OpenTelemetry, see Collect.
+type Backend interface {
+	// Counter reports the cumulative value of the counter name.
+	Counter(name string, labels []Label, value float64)
+	// Gauge reports the last value of the gauge name.
+	Gauge(name string, labels []Label, value float64)
+	// Histogram reports the distribution name: the number of values in each
+	// bucket, up to the matching bound and above the last one, and their sum.
+	Histogram(name string, labels []Label, bounds []float64, counts []int64, sum float64)
+}
+
+// Collect reports the data of the views, DefaultViews if none, to b. The
+// views must be registered with view.Register to collect data.
+//
+// Each view is reported under its name, with its slashes replaced by dots,
+// and its tags as labels: the Count and Sum views as counters, the LastValue
+// views as gauges and the Distribution views as histograms.
+func Collect(b Backend, views ...*view.View) {
+	if len(views) == 0 {
+		views = DefaultViews
+	}
+	for _, v := range views {
+		viewName := v.Name
+		if viewName == "" {
+			viewName = v.Measure.Name()
+		}
+		rows, err := view.RetrieveData(viewName)
+		if err != nil {
+			// not registered
+			continue
+		}
+		name := strings.ReplaceAll(viewName, "/", ".")
+		for _, row := range rows {
+			labels := make([]Label, 0, len(row.Tags))
+			for _, t := range row.Tags {
+				labels = append(labels, Label{Key: t.Key.Name(), Value: t.Value})
+			}
+			switch d := row.Data.(type) {
+			case *view.CountData:
+				b.Counter(name, labels, float64(d.Value))
+			case *view.SumData:
+				b.Counter(name, labels, d.Value)
+			case *view.LastValueData:
+				b.Gauge(name, labels, d.Value)
+			case *view.DistributionData:
+				b.Histogram(name, labels, v.Aggregation.Buckets, d.CountPerBucket, d.Sum())
+			}
+		}
+	}
+}
+
+// NoopBackend discards the metrics.
+type NoopBackend struct{}
+
+func (NoopBackend) Counter(string, []Label, float64)                       {}
+func (NoopBackend) Gauge(string, []Label, float64)                         {}
+func (NoopBackend) Histogram(string, []Label, []float64, []int64, float64) {}
+
+// NewPrometheusHandler returns an HTTP handler serving the data of the views,
+// DefaultViews if none, in the Prometheus text exposition format, to be
+// scraped by Prometheus. The dots of the names are replaced by underscores.
+func NewPrometheusHandler(views ...*view.View) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b := &prometheusBackend{}
+		Collect(b, views...)
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		_, _ = w.Write(b.buf.Bytes())
+	})
+}
+
+// prometheusBackend writes the metrics in the Prometheus text exposition
+// format. Collect reports the rows of a view together, as the format requires.
+type prometheusBackend struct {
+	buf  bytes.Buffer
+	last string
+}
+
+func (b *prometheusBackend) Counter(name string, labels []Label, value float64) {
+	name = prometheusName(name)
+	b.declare(name, "counter")
+	b.sample(name, labels, value)
+}
+
+func (b *prometheusBackend) Gauge(name string, labels []Label, value float64) {
+	name = prometheusName(name)
+	b.declare(name, "gauge")
+	b.sample(name, labels, value)
+}
+
+func (b *prometheusBackend) Histogram(name string, labels []Label, bounds []float64, counts []int64, sum float64) {
+	name = prometheusName(name)
+	b.declare(name, "histogram")
+	var cumulative int64
+	for i, c := range counts {
+		cumulative += c
+		le := "+Inf"
+		if i < len(bounds) {
+			le = strconv.FormatFloat(bounds[i], 'g', -1, 64)
+		}
+		b.sample(name+"_bucket", append(labels[:len(labels):len(labels)], Label{Key: "le", Value: le}), float64(cumulative))
+	}
+	b.sample(name+"_sum", labels, sum)
+	b.sample(name+"_count", labels, float64(cumulative))
+}
+
+func (b *prometheusBackend) declare(name, typ string) {
+	if name == b.last {
+		return
+	}
+	b.last = name
+	fmt.Fprintf(&b.buf, "# TYPE %s %s\n", name, typ)
+}
+
+func (b *prometheusBackend) sample(name string, labels []Label, value float64) {
+	b.buf.WriteString(name)
+	if len(labels) > 0 {
+		b.buf.WriteByte('{')
+		for i, l := range labels {
+			if i > 0 {
+				b.buf.WriteByte(',')
+			}
+			fmt.Fprintf(&b.buf, "%s=\"%s\"", prometheusName(l.Key), prometheusLabelEscaper.Replace(l.Value))
+		}
+		b.buf.WriteByte('}')
+	}
+	b.buf.WriteByte(' ')
+	b.buf.WriteString(formatValue(value))
+	b.buf.WriteByte('\n')
+}
+
+// prometheusLabelEscaper escapes label values as the Prometheus text format
+// expects, which leaves any other character as is, unlike Go quoting.
+var prometheusLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// prometheusName returns name with the characters Prometheus doesn't allow
+// replaced by underscores.
+func prometheusName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == ':' {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// StatsdBackend writes the metrics to a statsd server, one line per metric,
+// with the labels as DogStatsD tags. Statsd counters being incremented, the
+// counters are written as their increments since the last collection, and the
+// histograms as the increments of their "<name>.count" and "<name>.sum"
+// counters.
+type StatsdBackend struct {
+	w io.Writer
+
+	mu   sync.Mutex
+	last map[string]float64
+}
+
+// NewStatsdBackend returns a StatsdBackend writing to w, e.g. a UDP connection
+// to the statsd server.
+func NewStatsdBackend(w io.Writer) *StatsdBackend {
+	return &StatsdBackend{w: w, last: make(map[string]float64)}
+}
+
+func (b *StatsdBackend) Counter(name string, labels []Label, value float64) {
+	b.increment(name, labels, value)
+}
+
+func (b *StatsdBackend) Gauge(name string, labels []Label, value float64) {
+	b.write(name, labels, value, "g")
+}
+
+func (b *StatsdBackend) Histogram(name string, labels []Label, _ []float64, counts []int64, sum float64) {
+	var count int64
+	for _, c := range counts {
+		count += c
+	}
+	b.increment(name+".count", labels, float64(count))
+	b.increment(name+".sum", labels, sum)
+}
+
+// increment writes the increment of the counter name since its last value.
+func (b *StatsdBackend) increment(name string, labels []Label, value float64) {
+	key := name + "|" + statsdTags(labels)
+	b.mu.Lock()
+	delta := value - b.last[key]
+	b.last[key] = value
+	b.mu.Unlock()
+	if delta > 0 {
+		b.write(name, labels, delta, "c")
+	}
+}
+
+func (b *StatsdBackend) write(name string, labels []Label, value float64, typ string) {
+	line := name + ":" + formatValue(value) + "|" + typ
+	if tags := statsdTags(labels); tags != "" {
+		line += "|#" + tags
+	}
+	// lost, as any statsd datagram may be
+	_, _ = io.WriteString(b.w, line+"\n")
+}
+
+// statsdTags returns the labels as DogStatsD tags, sorted so that they
+// identify the series.
+func statsdTags(labels []Label) string {
+	tags := make([]string, 0, len(labels))
+	for _, l := range labels {
+		tags = append(tags, l.Key+":"+l.Value)
+	}
+	sort.Strings(tags)
+	return strings.Join(tags, ",")
+}
+
+// Push reports the data of the views, DefaultViews if none, to b every
+// interval until ctx is done, e.g. to a StatsdBackend.
+func Push(ctx context.Context, b Backend, interval time.Duration, views ...*view.View) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			Collect(b, views...)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+)
+
+func TestBackends(t *testing.T) {
+	ctx, err := tag.New(context.Background(), tag.Upsert(KeyMessageType, "PING"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	views := []*view.View{ReceivedMessagesView, ReceivedBytesView, RoutingTableSizeView}
+	if err := view.Register(views...); err != nil {
+		t.Fatal(err)
+	}
+	defer view.Unregister(views...)
+
+	stats.Record(ctx, ReceivedMessages.M(1), ReceivedBytes.M(1500), RoutingTableSize.M(7))
+	stats.Record(ctx, ReceivedMessages.M(1), ReceivedBytes.M(3000))
+
+	Collect(NoopBackend{}, views...)
+
+	rec := httptest.NewRecorder()
+	NewPrometheusHandler(views...).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	exposed := rec.Body.String()
+	for _, line := range []string{
+		`# TYPE libp2p_io_dht_kad_received_messages counter`,
+		`libp2p_io_dht_kad_received_messages{message_type="PING"} 2`,
+		`# TYPE libp2p_io_dht_kad_received_bytes histogram`,
+		`libp2p_io_dht_kad_received_bytes_bucket{message_type="PING",le="2048"} 1`,
+		`libp2p_io_dht_kad_received_bytes_bucket{message_type="PING",le="+Inf"} 2`,
+		`libp2p_io_dht_kad_received_bytes_sum{message_type="PING"} 4500`,
+		`libp2p_io_dht_kad_received_bytes_count{message_type="PING"} 2`,
+		`# TYPE libp2p_io_dht_kad_routing_table_size gauge`,
+		`libp2p_io_dht_kad_routing_table_size 7`,
+	} {
+		if !strings.Contains(exposed, line+"\n") {
+			t.Errorf("expected %q in:\n%s", line, exposed)
+		}
+	}
+
+	// statsd is sent the increments of the counters
+	var buf bytes.Buffer
+	statsd := NewStatsdBackend(&buf)
+	Collect(statsd, views...)
+	stats.Record(ctx, ReceivedMessages.M(1))
+	Collect(statsd, views...)
+	sent := buf.String()
+	for _, line := range []string{
+		"libp2p.io.dht.kad.received_messages:2|c|#message_type:PING",
+		"libp2p.io.dht.kad.received_bytes.count:2|c|#message_type:PING",
+		"libp2p.io.dht.kad.received_bytes.sum:4500|c|#message_type:PING",
+		"libp2p.io.dht.kad.routing_table_size:7|g",
+		"libp2p.io.dht.kad.received_messages:1|c|#message_type:PING",
+	} {
+		if !strings.Contains(sent, line+"\n") {
+			t.Errorf("expected %q in:\n%s", line, sent)
+		}
+	}
+	if n := strings.Count(sent, "received_bytes.count"); n != 1 {
+		t.Errorf("expected the unchanged counters not to be sent again, got:\n%s", sent)
+	}
+}
+
+func TestPrometheusLabelEscaping(t *testing.T) {
+	var b prometheusBackend
+	b.sample("m", []Label{{Key: "v", Value: "a\\b\"c\nd\té"}}, 1)
+	if want := "m{v=\"a\\\\b\\\"c\\nd\té\"} 1\n"; b.buf.String() != want {
+		t.Errorf("expected %q, got %q", want, b.buf.String())
+	}
+}
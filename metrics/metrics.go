@@ -1,6 +1,11 @@
 package metrics
 
 import (
+	"hash/fnv"
+	"strconv"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+
 	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
 	"go.opencensus.io/stats"
 	"go.opencensus.io/stats/view"
@@ -19,6 +24,33 @@ var (
 	// KeyInstanceID identifies a dht instance by the pointer address.
 	// Useful for differentiating between different dhts that have the same peer id.
 	KeyInstanceID, _ = tag.NewKey("instance_id")
+	// KeyRateLimit identifies the rate limit that was hit, e.g. "peer", "key"
+	// or "subnet".
+	KeyRateLimit, _ = tag.NewKey("rate_limit")
+	// KeyProvideStage identifies the bounded stage of the provide pipeline,
+	// "lookup" or "rpc".
+	KeyProvideStage, _ = tag.NewKey("provide_stage")
+	// KeyRequestClass identifies the priority class of inbound requests,
+	// "routing", "lookup" or "store".
+	KeyRequestClass, _ = tag.NewKey("request_class")
+	// KeyRejectReason identifies why an inbound request failed strict
+	// validation, e.g. "peer_id" or "multiaddr".
+	KeyRejectReason, _ = tag.NewKey("reject_reason")
+	// KeyPeerBucket identifies the bucket remote peers are hashed to, see
+	// PeerBucket.
+	KeyPeerBucket, _ = tag.NewKey("peer_bucket")
+	// KeyDHT identifies a DHT by name, e.g. "wan" or "lan", or by protocol.
+	// Useful for differentiating between the DHTs run by a process.
+	KeyDHT, _ = tag.NewKey("dht")
+	// KeyOperation identifies the DHT operation a measurement is for, e.g.
+	// "Provide" or "FindPeer".
+	KeyOperation, _ = tag.NewKey("operation")
+	// KeyCpl identifies the length of the common prefix of the Kademlia IDs
+	// of a remote peer and ours, i.e. its bucket in the routing table.
+	KeyCpl, _ = tag.NewKey("cpl")
+	// KeyOutcome identifies the outcome of a DHT operation, "success",
+	// "failure" or "canceled".
+	KeyOutcome, _ = tag.NewKey("outcome")
 )
 
 // UpsertMessageType is a convenience upserts the message type
@@ -27,72 +59,341 @@ func UpsertMessageType(m *pb.Message) tag.Mutator {
 	return tag.Upsert(KeyMessageType, m.Type.String())
 }
 
+// PeerBucket returns the bucket, out of buckets, p is hashed to, which bounds
+// the number of values of KeyPeerBucket to buckets however many peers we talk
+// to. Operators can tell the peers of a slow bucket by hashing theirs.
+func PeerBucket(p peer.ID, buckets int) string {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(p))
+	return strconv.Itoa(int(h.Sum32() % uint32(buckets)))
+}
+
 // Measures
 var (
-	ReceivedMessages       = stats.Int64("libp2p.io/dht/kad/received_messages", "Total number of messages received per RPC", stats.UnitDimensionless)
-	ReceivedMessageErrors  = stats.Int64("libp2p.io/dht/kad/received_message_errors", "Total number of errors for messages received per RPC", stats.UnitDimensionless)
-	ReceivedBytes          = stats.Int64("libp2p.io/dht/kad/received_bytes", "Total received bytes per RPC", stats.UnitBytes)
-	InboundRequestLatency  = stats.Float64("libp2p.io/dht/kad/inbound_request_latency", "Latency per RPC", stats.UnitMilliseconds)
-	OutboundRequestLatency = stats.Float64("libp2p.io/dht/kad/outbound_request_latency", "Latency per RPC", stats.UnitMilliseconds)
-	SentMessages           = stats.Int64("libp2p.io/dht/kad/sent_messages", "Total number of messages sent per RPC", stats.UnitDimensionless)
-	SentMessageErrors      = stats.Int64("libp2p.io/dht/kad/sent_message_errors", "Total number of errors for messages sent per RPC", stats.UnitDimensionless)
-	SentRequests           = stats.Int64("libp2p.io/dht/kad/sent_requests", "Total number of requests sent per RPC", stats.UnitDimensionless)
-	SentRequestErrors      = stats.Int64("libp2p.io/dht/kad/sent_request_errors", "Total number of errors for requests sent per RPC", stats.UnitDimensionless)
-	SentBytes              = stats.Int64("libp2p.io/dht/kad/sent_bytes", "Total sent bytes per RPC", stats.UnitBytes)
+	ReceivedMessages                = stats.Int64("libp2p.io/dht/kad/received_messages", "Total number of messages received per RPC", stats.UnitDimensionless)
+	ReceivedMessageErrors           = stats.Int64("libp2p.io/dht/kad/received_message_errors", "Total number of errors for messages received per RPC", stats.UnitDimensionless)
+	ReceivedBytes                   = stats.Int64("libp2p.io/dht/kad/received_bytes", "Total received bytes per RPC", stats.UnitBytes)
+	InboundRequestLatency           = stats.Float64("libp2p.io/dht/kad/inbound_request_latency", "Latency per RPC", stats.UnitMilliseconds)
+	OutboundRequestLatency          = stats.Float64("libp2p.io/dht/kad/outbound_request_latency", "Latency per RPC", stats.UnitMilliseconds)
+	OutboundRequestFirstByteLatency = stats.Float64("libp2p.io/dht/kad/outbound_request_first_byte_latency", "Latency of the first byte of the response per RPC", stats.UnitMilliseconds)
+	SentMessages                    = stats.Int64("libp2p.io/dht/kad/sent_messages", "Total number of messages sent per RPC", stats.UnitDimensionless)
+	SentMessageErrors               = stats.Int64("libp2p.io/dht/kad/sent_message_errors", "Total number of errors for messages sent per RPC", stats.UnitDimensionless)
+	SentRequests                    = stats.Int64("libp2p.io/dht/kad/sent_requests", "Total number of requests sent per RPC", stats.UnitDimensionless)
+	SentRequestErrors               = stats.Int64("libp2p.io/dht/kad/sent_request_errors", "Total number of errors for requests sent per RPC", stats.UnitDimensionless)
+	SentBytes                       = stats.Int64("libp2p.io/dht/kad/sent_bytes", "Total sent bytes per RPC", stats.UnitBytes)
+	ReceivedResponseBytes           = stats.Int64("libp2p.io/dht/kad/received_response_bytes", "Total bytes of the responses received per RPC", stats.UnitBytes)
+	SentResponseBytes               = stats.Int64("libp2p.io/dht/kad/sent_response_bytes", "Total bytes of the responses sent per RPC", stats.UnitBytes)
+	InboundHandlerLatency           = stats.Float64("libp2p.io/dht/kad/inbound_handler_latency", "Time spent handling requests per RPC, excluding queueing and writing the response", stats.UnitMilliseconds)
+
+	RateLimitedProviderRecords = stats.Int64("libp2p.io/dht/kad/rate_limited_provider_records", "Total number of provider records dropped by rate limits", stats.UnitDimensionless)
+
+	ProviderRecordsStored  = stats.Int64("libp2p.io/dht/kad/provider_records_stored", "Number of provider records stored, as of the last provider record GC", stats.UnitDimensionless)
+	ProviderKeysStored     = stats.Int64("libp2p.io/dht/kad/provider_keys_stored", "Number of keys with provider records stored, as of the last provider record GC", stats.UnitDimensionless)
+	ProvidersPerKey        = stats.Int64("libp2p.io/dht/kad/providers_per_key", "Number of provider records stored per key, recorded for every key at each provider record GC", stats.UnitDimensionless)
+	ProviderRecordsAdded   = stats.Int64("libp2p.io/dht/kad/provider_records_added", "Total number of new provider records stored", stats.UnitDimensionless)
+	ProviderRecordsExpired = stats.Int64("libp2p.io/dht/kad/provider_records_expired", "Total number of provider records dropped because they expired", stats.UnitDimensionless)
+
+	ProvideQueueDepth = stats.Int64("libp2p.io/dht/kad/provide_queue_depth", "Number of provide operations waiting for a free slot", stats.UnitDimensionless)
+	ProvideQueueWait  = stats.Float64("libp2p.io/dht/kad/provide_queue_wait", "Time provide operations waited for a free slot", stats.UnitMilliseconds)
+
+	InboundQueueDepth   = stats.Int64("libp2p.io/dht/kad/inbound_queue_depth", "Number of inbound requests waiting to be handled", stats.UnitDimensionless)
+	InboundQueueWait    = stats.Float64("libp2p.io/dht/kad/inbound_queue_wait", "Time inbound requests waited to be handled", stats.UnitMilliseconds)
+	InboundQueueDropped = stats.Int64("libp2p.io/dht/kad/inbound_queue_dropped", "Total number of inbound requests refused for a full queue", stats.UnitDimensionless)
+
+	ThrottledRequests = stats.Int64("libp2p.io/dht/kad/throttled_requests", "Total number of inbound requests refused by the per peer and per subnet request rate limits", stats.UnitDimensionless)
+
+	BlockedRequests = stats.Int64("libp2p.io/dht/kad/blocked_requests", "Total number of inbound requests refused because the connection gater rejects their sender", stats.UnitDimensionless)
+	BlockedDials    = stats.Int64("libp2p.io/dht/kad/blocked_dials", "Total number of lookup candidates skipped because the connection gater doesn't allow dialing them", stats.UnitDimensionless)
+
+	RejectedRequests = stats.Int64("libp2p.io/dht/kad/rejected_requests", "Total number of inbound requests rejected by strict validation", stats.UnitDimensionless)
+
+	CloserPeersCacheHits   = stats.Int64("libp2p.io/dht/kad/closer_peers_cache_hits", "Total number of requests answered with cached closer peers", stats.UnitDimensionless)
+	CloserPeersCacheMisses = stats.Int64("libp2p.io/dht/kad/closer_peers_cache_misses", "Total number of requests whose closer peers weren't cached", stats.UnitDimensionless)
+
+	DuplicateRequests = stats.Int64("libp2p.io/dht/kad/duplicate_requests", "Total number of retransmitted mutating requests answered without handling them again", stats.UnitDimensionless)
+
+	OutboundStreamsOpened  = stats.Int64("libp2p.io/dht/kad/outbound_streams_opened", "Total number of streams opened to send requests and messages", stats.UnitDimensionless)
+	OutboundStreamsReused  = stats.Int64("libp2p.io/dht/kad/outbound_streams_reused", "Total number of requests and messages sent over an already open stream", stats.UnitDimensionless)
+	OutboundStreamsEvicted = stats.Int64("libp2p.io/dht/kad/outbound_streams_evicted", "Total number of open streams closed for being idle or to make room in the stream pool", stats.UnitDimensionless)
+
+	Operations       = stats.Int64("libp2p.io/dht/kad/operations", "Total number of Provide, FindPeer, FindProviders, GetValue and PutValue operations", stats.UnitDimensionless)
+	OperationLatency = stats.Float64("libp2p.io/dht/kad/operation_latency", "Duration of the Provide, FindPeer, FindProviders, GetValue and PutValue operations", stats.UnitMilliseconds)
+
+	LookupLatency            = stats.Float64("libp2p.io/dht/kad/lookup_latency", "Duration of the lookups, excluding their follow up queries", stats.UnitMilliseconds)
+	LookupPeersQueried       = stats.Int64("libp2p.io/dht/kad/lookup_peers_queried", "Number of peers queried per lookup, including the unreachable ones", stats.UnitDimensionless)
+	RoutingTableSize         = stats.Int64("libp2p.io/dht/kad/routing_table_size", "Number of peers in the routing table", stats.UnitDimensionless)
+	RoutingTableCplPeers     = stats.Int64("libp2p.io/dht/kad/routing_table_cpl_peers", "Number of peers in the routing table per common prefix length", stats.UnitDimensionless)
+	NetworkSize              = stats.Int64("libp2p.io/dht/kad/network_size", "Estimated number of peers in the network", stats.UnitDimensionless)
+	LookupHops               = stats.Int64("libp2p.io/dht/kad/lookup_hops", "Length of the longest referral path followed per lookup", stats.UnitDimensionless)
+	LookupPeerQueries        = stats.Int64("libp2p.io/dht/kad/lookup_peer_queries", "Total number of peers queried by the lookups", stats.UnitDimensionless)
+	LookupUnhelpfulResponses = stats.Int64("libp2p.io/dht/kad/lookup_unhelpful_responses", "Total number of responses not referring the lookups to any new closer peer", stats.UnitDimensionless)
+	LookupRepeatedResponses  = stats.Int64("libp2p.io/dht/kad/lookup_repeated_responses", "Total number of unhelpful responses repeating the peers of another one", stats.UnitDimensionless)
+	LookupPeerTimeouts       = stats.Int64("libp2p.io/dht/kad/lookup_peer_timeouts", "Total number of peers queried by the lookups that timed out", stats.UnitDimensionless)
+
+	LiveQueryPeersets       = stats.Int64("libp2p.io/dht/kad/live_query_peersets", "Number of peersets held by the running lookups", stats.UnitDimensionless)
+	LiveQueryPeersetEntries = stats.Int64("libp2p.io/dht/kad/live_query_peerset_entries", "Number of peers tracked by the peersets of the running lookups", stats.UnitDimensionless)
+	LookupPeersetEntries    = stats.Int64("libp2p.io/dht/kad/lookup_peerset_entries", "Number of peers tracked per lookup, each allocated in its peerset", stats.UnitDimensionless)
+
+	PeerRequestLatency = stats.Float64("libp2p.io/dht/kad/peer_request_latency", "Latency of the requests sent per bucket of remote peers", stats.UnitMilliseconds)
 )
 
 // Views
 var (
 	ReceivedMessagesView = &view.View{
 		Measure:     ReceivedMessages,
-		TagKeys:     []tag.Key{KeyMessageType, KeyPeerID, KeyInstanceID},
+		TagKeys:     []tag.Key{KeyMessageType, KeyPeerID, KeyInstanceID, KeyDHT, KeyOperation},
 		Aggregation: view.Count(),
 	}
 	ReceivedMessageErrorsView = &view.View{
 		Measure:     ReceivedMessageErrors,
-		TagKeys:     []tag.Key{KeyMessageType, KeyPeerID, KeyInstanceID},
+		TagKeys:     []tag.Key{KeyMessageType, KeyPeerID, KeyInstanceID, KeyDHT, KeyOperation},
 		Aggregation: view.Count(),
 	}
 	ReceivedBytesView = &view.View{
 		Measure:     ReceivedBytes,
-		TagKeys:     []tag.Key{KeyMessageType, KeyPeerID, KeyInstanceID},
+		TagKeys:     []tag.Key{KeyMessageType, KeyPeerID, KeyInstanceID, KeyDHT, KeyOperation},
 		Aggregation: defaultBytesDistribution,
 	}
 	InboundRequestLatencyView = &view.View{
 		Measure:     InboundRequestLatency,
-		TagKeys:     []tag.Key{KeyMessageType, KeyPeerID, KeyInstanceID},
+		TagKeys:     []tag.Key{KeyMessageType, KeyPeerID, KeyInstanceID, KeyDHT, KeyOperation},
 		Aggregation: defaultMillisecondsDistribution,
 	}
 	OutboundRequestLatencyView = &view.View{
 		Measure:     OutboundRequestLatency,
-		TagKeys:     []tag.Key{KeyMessageType, KeyPeerID, KeyInstanceID},
+		TagKeys:     []tag.Key{KeyMessageType, KeyPeerID, KeyInstanceID, KeyDHT, KeyOperation},
+		Aggregation: defaultMillisecondsDistribution,
+	}
+	OutboundRequestFirstByteLatencyView = &view.View{
+		Measure:     OutboundRequestFirstByteLatency,
+		TagKeys:     []tag.Key{KeyMessageType, KeyPeerID, KeyInstanceID, KeyDHT, KeyOperation},
 		Aggregation: defaultMillisecondsDistribution,
 	}
 	SentMessagesView = &view.View{
 		Measure:     SentMessages,
-		TagKeys:     []tag.Key{KeyMessageType, KeyPeerID, KeyInstanceID},
+		TagKeys:     []tag.Key{KeyMessageType, KeyPeerID, KeyInstanceID, KeyDHT, KeyOperation},
 		Aggregation: view.Count(),
 	}
 	SentMessageErrorsView = &view.View{
 		Measure:     SentMessageErrors,
-		TagKeys:     []tag.Key{KeyMessageType, KeyPeerID, KeyInstanceID},
+		TagKeys:     []tag.Key{KeyMessageType, KeyPeerID, KeyInstanceID, KeyDHT, KeyOperation},
 		Aggregation: view.Count(),
 	}
 	SentRequestsView = &view.View{
 		Measure:     SentRequests,
-		TagKeys:     []tag.Key{KeyMessageType, KeyPeerID, KeyInstanceID},
+		TagKeys:     []tag.Key{KeyMessageType, KeyPeerID, KeyInstanceID, KeyDHT, KeyOperation},
 		Aggregation: view.Count(),
 	}
 	SentRequestErrorsView = &view.View{
 		Measure:     SentRequestErrors,
-		TagKeys:     []tag.Key{KeyMessageType, KeyPeerID, KeyInstanceID},
+		TagKeys:     []tag.Key{KeyMessageType, KeyPeerID, KeyInstanceID, KeyDHT, KeyOperation},
 		Aggregation: view.Count(),
 	}
 	SentBytesView = &view.View{
 		Measure:     SentBytes,
-		TagKeys:     []tag.Key{KeyMessageType, KeyPeerID, KeyInstanceID},
+		TagKeys:     []tag.Key{KeyMessageType, KeyPeerID, KeyInstanceID, KeyDHT, KeyOperation},
+		Aggregation: defaultBytesDistribution,
+	}
+	ReceivedResponseBytesView = &view.View{
+		Measure:     ReceivedResponseBytes,
+		TagKeys:     []tag.Key{KeyMessageType, KeyPeerID, KeyInstanceID, KeyDHT, KeyOperation},
 		Aggregation: defaultBytesDistribution,
 	}
+	SentResponseBytesView = &view.View{
+		Measure:     SentResponseBytes,
+		TagKeys:     []tag.Key{KeyMessageType, KeyPeerID, KeyInstanceID, KeyDHT, KeyOperation},
+		Aggregation: defaultBytesDistribution,
+	}
+	InboundHandlerLatencyView = &view.View{
+		Measure:     InboundHandlerLatency,
+		TagKeys:     []tag.Key{KeyMessageType, KeyPeerID, KeyInstanceID, KeyDHT, KeyOperation},
+		Aggregation: defaultMillisecondsDistribution,
+	}
+	RateLimitedProviderRecordsView = &view.View{
+		Measure:     RateLimitedProviderRecords,
+		TagKeys:     []tag.Key{KeyRateLimit, KeyPeerID, KeyInstanceID, KeyDHT, KeyOperation},
+		Aggregation: view.Count(),
+	}
+	ProviderRecordsStoredView = &view.View{
+		Measure:     ProviderRecordsStored,
+		TagKeys:     []tag.Key{KeyPeerID, KeyInstanceID, KeyDHT, KeyOperation},
+		Aggregation: view.LastValue(),
+	}
+	ProviderKeysStoredView = &view.View{
+		Measure:     ProviderKeysStored,
+		TagKeys:     []tag.Key{KeyPeerID, KeyInstanceID, KeyDHT, KeyOperation},
+		Aggregation: view.LastValue(),
+	}
+	ProvidersPerKeyView = &view.View{
+		Measure:     ProvidersPerKey,
+		TagKeys:     []tag.Key{KeyPeerID, KeyInstanceID, KeyDHT, KeyOperation},
+		Aggregation: view.Distribution(1, 2, 3, 5, 10, 20, 50, 100, 200, 500),
+	}
+	ProviderRecordsAddedView = &view.View{
+		Measure:     ProviderRecordsAdded,
+		TagKeys:     []tag.Key{KeyPeerID, KeyInstanceID, KeyDHT, KeyOperation},
+		Aggregation: view.Count(),
+	}
+	ProviderRecordsExpiredView = &view.View{
+		Measure:     ProviderRecordsExpired,
+		TagKeys:     []tag.Key{KeyPeerID, KeyInstanceID, KeyDHT, KeyOperation},
+		Aggregation: view.Count(),
+	}
+	ProvideQueueDepthView = &view.View{
+		Measure:     ProvideQueueDepth,
+		TagKeys:     []tag.Key{KeyProvideStage, KeyPeerID, KeyInstanceID, KeyDHT, KeyOperation},
+		Aggregation: view.LastValue(),
+	}
+	ProvideQueueWaitView = &view.View{
+		Measure:     ProvideQueueWait,
+		TagKeys:     []tag.Key{KeyProvideStage, KeyPeerID, KeyInstanceID, KeyDHT, KeyOperation},
+		Aggregation: defaultMillisecondsDistribution,
+	}
+	InboundQueueDepthView = &view.View{
+		Measure:     InboundQueueDepth,
+		TagKeys:     []tag.Key{KeyRequestClass, KeyPeerID, KeyInstanceID, KeyDHT, KeyOperation},
+		Aggregation: view.LastValue(),
+	}
+	InboundQueueWaitView = &view.View{
+		Measure:     InboundQueueWait,
+		TagKeys:     []tag.Key{KeyRequestClass, KeyPeerID, KeyInstanceID, KeyDHT, KeyOperation},
+		Aggregation: defaultMillisecondsDistribution,
+	}
+	InboundQueueDroppedView = &view.View{
+		Measure:     InboundQueueDropped,
+		TagKeys:     []tag.Key{KeyRequestClass, KeyPeerID, KeyInstanceID, KeyDHT, KeyOperation},
+		Aggregation: view.Count(),
+	}
+	ThrottledRequestsView = &view.View{
+		Measure:     ThrottledRequests,
+		TagKeys:     []tag.Key{KeyMessageType, KeyRateLimit, KeyPeerID, KeyInstanceID, KeyDHT, KeyOperation},
+		Aggregation: view.Count(),
+	}
+	BlockedRequestsView = &view.View{
+		Measure:     BlockedRequests,
+		TagKeys:     []tag.Key{KeyMessageType, KeyPeerID, KeyInstanceID, KeyDHT, KeyOperation},
+		Aggregation: view.Count(),
+	}
+	BlockedDialsView = &view.View{
+		Measure:     BlockedDials,
+		TagKeys:     []tag.Key{KeyPeerID, KeyInstanceID, KeyDHT, KeyOperation},
+		Aggregation: view.Count(),
+	}
+	RejectedRequestsView = &view.View{
+		Measure:     RejectedRequests,
+		TagKeys:     []tag.Key{KeyMessageType, KeyRejectReason, KeyPeerID, KeyInstanceID, KeyDHT, KeyOperation},
+		Aggregation: view.Count(),
+	}
+	CloserPeersCacheHitsView = &view.View{
+		Measure:     CloserPeersCacheHits,
+		TagKeys:     []tag.Key{KeyMessageType, KeyPeerID, KeyInstanceID, KeyDHT, KeyOperation},
+		Aggregation: view.Count(),
+	}
+	CloserPeersCacheMissesView = &view.View{
+		Measure:     CloserPeersCacheMisses,
+		TagKeys:     []tag.Key{KeyMessageType, KeyPeerID, KeyInstanceID, KeyDHT, KeyOperation},
+		Aggregation: view.Count(),
+	}
+	DuplicateRequestsView = &view.View{
+		Measure:     DuplicateRequests,
+		TagKeys:     []tag.Key{KeyMessageType, KeyPeerID, KeyInstanceID, KeyDHT, KeyOperation},
+		Aggregation: view.Count(),
+	}
+	OperationsView = &view.View{
+		Measure:     Operations,
+		TagKeys:     []tag.Key{KeyOutcome, KeyPeerID, KeyInstanceID, KeyDHT, KeyOperation},
+		Aggregation: view.Count(),
+	}
+	OperationLatencyView = &view.View{
+		Measure:     OperationLatency,
+		TagKeys:     []tag.Key{KeyOutcome, KeyPeerID, KeyInstanceID, KeyDHT, KeyOperation},
+		Aggregation: defaultMillisecondsDistribution,
+	}
+	LookupLatencyView = &view.View{
+		Measure:     LookupLatency,
+		TagKeys:     []tag.Key{KeyPeerID, KeyInstanceID, KeyDHT, KeyOperation},
+		Aggregation: defaultMillisecondsDistribution,
+	}
+	LookupPeersQueriedView = &view.View{
+		Measure:     LookupPeersQueried,
+		TagKeys:     []tag.Key{KeyPeerID, KeyInstanceID, KeyDHT, KeyOperation},
+		Aggregation: view.Distribution(1, 2, 3, 5, 10, 20, 30, 50, 100, 200, 500),
+	}
+	LookupHopsView = &view.View{
+		Measure:     LookupHops,
+		TagKeys:     []tag.Key{KeyPeerID, KeyInstanceID, KeyDHT, KeyOperation},
+		Aggregation: view.Distribution(1, 2, 3, 4, 5, 6, 7, 8, 10, 12, 15, 20),
+	}
+	LookupPeerQueriesView = &view.View{
+		Measure:     LookupPeerQueries,
+		TagKeys:     []tag.Key{KeyCpl, KeyPeerID, KeyInstanceID, KeyDHT, KeyOperation},
+		Aggregation: view.Count(),
+	}
+	LookupPeerTimeoutsView = &view.View{
+		Measure:     LookupPeerTimeouts,
+		TagKeys:     []tag.Key{KeyCpl, KeyPeerID, KeyInstanceID, KeyDHT, KeyOperation},
+		Aggregation: view.Count(),
+	}
+	LookupUnhelpfulResponsesView = &view.View{
+		Measure:     LookupUnhelpfulResponses,
+		TagKeys:     []tag.Key{KeyPeerID, KeyInstanceID, KeyDHT, KeyOperation},
+		Aggregation: view.Count(),
+	}
+	LookupRepeatedResponsesView = &view.View{
+		Measure:     LookupRepeatedResponses,
+		TagKeys:     []tag.Key{KeyPeerID, KeyInstanceID, KeyDHT, KeyOperation},
+		Aggregation: view.Count(),
+	}
+	LiveQueryPeersetsView = &view.View{
+		Measure:     LiveQueryPeersets,
+		TagKeys:     []tag.Key{KeyPeerID, KeyInstanceID, KeyDHT, KeyOperation},
+		Aggregation: view.LastValue(),
+	}
+	LiveQueryPeersetEntriesView = &view.View{
+		Measure:     LiveQueryPeersetEntries,
+		TagKeys:     []tag.Key{KeyPeerID, KeyInstanceID, KeyDHT, KeyOperation},
+		Aggregation: view.LastValue(),
+	}
+	LookupPeersetEntriesView = &view.View{
+		Measure:     LookupPeersetEntries,
+		TagKeys:     []tag.Key{KeyPeerID, KeyInstanceID, KeyDHT, KeyOperation},
+		Aggregation: view.Distribution(10, 20, 50, 100, 200, 500, 1000, 2000, 5000),
+	}
+	RoutingTableSizeView = &view.View{
+		Measure:     RoutingTableSize,
+		TagKeys:     []tag.Key{KeyPeerID, KeyInstanceID, KeyDHT, KeyOperation},
+		Aggregation: view.LastValue(),
+	}
+	RoutingTableCplPeersView = &view.View{
+		Measure:     RoutingTableCplPeers,
+		TagKeys:     []tag.Key{KeyCpl, KeyPeerID, KeyInstanceID, KeyDHT, KeyOperation},
+		Aggregation: view.LastValue(),
+	}
+	NetworkSizeView = &view.View{
+		Measure:     NetworkSize,
+		TagKeys:     []tag.Key{KeyPeerID, KeyInstanceID, KeyDHT, KeyOperation},
+		Aggregation: view.LastValue(),
+	}
+	PeerRequestLatencyView = &view.View{
+		Measure:     PeerRequestLatency,
+		TagKeys:     []tag.Key{KeyPeerBucket, KeyPeerID, KeyInstanceID, KeyDHT, KeyOperation},
+		Aggregation: defaultMillisecondsDistribution,
+	}
+	OutboundStreamsOpenedView = &view.View{
+		Measure:     OutboundStreamsOpened,
+		TagKeys:     []tag.Key{KeyMessageType, KeyPeerID, KeyInstanceID, KeyDHT, KeyOperation},
+		Aggregation: view.Count(),
+	}
+	OutboundStreamsReusedView = &view.View{
+		Measure:     OutboundStreamsReused,
+		TagKeys:     []tag.Key{KeyMessageType, KeyPeerID, KeyInstanceID, KeyDHT, KeyOperation},
+		Aggregation: view.Count(),
+	}
+	OutboundStreamsEvictedView = &view.View{
+		Measure:     OutboundStreamsEvicted,
+		TagKeys:     []tag.Key{KeyPeerID, KeyInstanceID, KeyDHT, KeyOperation},
+		Aggregation: view.Count(),
+	}
 )
 
 // DefaultViews with all views in it.
@@ -102,9 +403,50 @@ var DefaultViews = []*view.View{
 	ReceivedBytesView,
 	InboundRequestLatencyView,
 	OutboundRequestLatencyView,
+	OutboundRequestFirstByteLatencyView,
 	SentMessagesView,
 	SentMessageErrorsView,
 	SentRequestsView,
 	SentRequestErrorsView,
 	SentBytesView,
+	ReceivedResponseBytesView,
+	SentResponseBytesView,
+	InboundHandlerLatencyView,
+	RateLimitedProviderRecordsView,
+	ProviderRecordsStoredView,
+	ProviderKeysStoredView,
+	ProvidersPerKeyView,
+	ProviderRecordsAddedView,
+	ProviderRecordsExpiredView,
+	ProvideQueueDepthView,
+	ProvideQueueWaitView,
+	InboundQueueDepthView,
+	InboundQueueWaitView,
+	InboundQueueDroppedView,
+	ThrottledRequestsView,
+	BlockedRequestsView,
+	BlockedDialsView,
+	RejectedRequestsView,
+	CloserPeersCacheHitsView,
+	CloserPeersCacheMissesView,
+	DuplicateRequestsView,
+	OutboundStreamsOpenedView,
+	OutboundStreamsReusedView,
+	OutboundStreamsEvictedView,
+	OperationsView,
+	OperationLatencyView,
+	LookupLatencyView,
+	LookupPeersQueriedView,
+	LookupHopsView,
+	LookupPeerQueriesView,
+	LookupPeerTimeoutsView,
+	LookupUnhelpfulResponsesView,
+	LookupRepeatedResponsesView,
+	LiveQueryPeersetsView,
+	LiveQueryPeersetEntriesView,
+	LookupPeersetEntriesView,
+	RoutingTableSizeView,
+	RoutingTableCplPeersView,
+	NetworkSizeView,
+	PeerRequestLatencyView,
 }
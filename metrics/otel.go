@@ -0,0 +1,148 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"go.opencensus.io/stats/view"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/unit"
+)
+
+// ExportViews exports the data of the views, DefaultViews if none, to meter.
+// The views must be registered with view.Register to collect data.
+//
+// Each view is observed under its name, with its slashes replaced by dots, and
+// its tags as attributes, which keeps the names and labels of the dashboards
+// built on the OpenCensus views stable:
+//   - Count views as an Int64SumObserver,
+//   - Sum views as a Float64SumObserver,
+//   - LastValue views as a Float64ValueObserver,
+//   - Distribution views as the "<name>.count" Int64SumObserver, the
+//     "<name>.sum" Float64SumObserver and the "<name>.bucket" Int64SumObserver
+//     of the cumulative bucket counts, by their "le" upper bound.
+//
+// The data is read from the views on collection, so the measurements are still
+// recorded once, with OpenCensus.
+func ExportViews(meter metric.Meter, views ...*view.View) error {
+	if len(views) == 0 {
+		views = DefaultViews
+	}
+
+	var observers []func(metric.BatchObserverResult)
+	batch := meter.NewBatchObserver(func(_ context.Context, result metric.BatchObserverResult) {
+		for _, observe := range observers {
+			observe(result)
+		}
+	})
+	for _, v := range views {
+		observe, err := newViewObserver(batch, v)
+		if err != nil {
+			return err
+		}
+		observers = append(observers, observe)
+	}
+	return nil
+}
+
+func newViewObserver(batch metric.BatchObserver, v *view.View) (func(metric.BatchObserverResult), error) {
+	viewName := v.Name
+	if viewName == "" {
+		viewName = v.Measure.Name()
+	}
+	name := strings.ReplaceAll(viewName, "/", ".")
+	opts := []metric.InstrumentOption{
+		metric.WithDescription(v.Description),
+		metric.WithUnit(unit.Unit(v.Measure.Unit())),
+	}
+
+	switch v.Aggregation.Type {
+	case view.AggTypeCount:
+		count, err := batch.NewInt64SumObserver(name, metric.WithDescription(v.Description))
+		if err != nil {
+			return nil, err
+		}
+		return rowObserver(viewName, func(result metric.BatchObserverResult, attrs []attribute.KeyValue, data view.AggregationData) {
+			if d, ok := data.(*view.CountData); ok {
+				result.Observe(attrs, count.Observation(d.Value))
+			}
+		}), nil
+	case view.AggTypeSum:
+		sum, err := batch.NewFloat64SumObserver(name, opts...)
+		if err != nil {
+			return nil, err
+		}
+		return rowObserver(viewName, func(result metric.BatchObserverResult, attrs []attribute.KeyValue, data view.AggregationData) {
+			if d, ok := data.(*view.SumData); ok {
+				result.Observe(attrs, sum.Observation(d.Value))
+			}
+		}), nil
+	case view.AggTypeLastValue:
+		last, err := batch.NewFloat64ValueObserver(name, opts...)
+		if err != nil {
+			return nil, err
+		}
+		return rowObserver(viewName, func(result metric.BatchObserverResult, attrs []attribute.KeyValue, data view.AggregationData) {
+			if d, ok := data.(*view.LastValueData); ok {
+				result.Observe(attrs, last.Observation(d.Value))
+			}
+		}), nil
+	case view.AggTypeDistribution:
+		count, err := batch.NewInt64SumObserver(name+".count", metric.WithDescription(v.Description))
+		if err != nil {
+			return nil, err
+		}
+		sum, err := batch.NewFloat64SumObserver(name+".sum", opts...)
+		if err != nil {
+			return nil, err
+		}
+		buckets, err := batch.NewInt64SumObserver(name+".bucket", metric.WithDescription(v.Description))
+		if err != nil {
+			return nil, err
+		}
+		bounds := make([]string, 0, len(v.Aggregation.Buckets)+1)
+		for _, b := range v.Aggregation.Buckets {
+			bounds = append(bounds, strconv.FormatFloat(b, 'g', -1, 64))
+		}
+		bounds = append(bounds, "+Inf")
+		return rowObserver(viewName, func(result metric.BatchObserverResult, attrs []attribute.KeyValue, data view.AggregationData) {
+			d, ok := data.(*view.DistributionData)
+			if !ok {
+				return
+			}
+			result.Observe(attrs, count.Observation(d.Count), sum.Observation(d.Sum()))
+			var cumulative int64
+			for i, c := range d.CountPerBucket {
+				if i >= len(bounds) {
+					break
+				}
+				cumulative += c
+				le := append(attrs[:len(attrs):len(attrs)], attribute.String("le", bounds[i]))
+				result.Observe(le, buckets.Observation(cumulative))
+			}
+		}), nil
+	}
+	return nil, fmt.Errorf("view %s: unsupported aggregation %s", viewName, v.Aggregation.Type)
+}
+
+// rowObserver returns a function observing the rows of the named view with
+// observe, their tags as attributes.
+func rowObserver(name string, observe func(metric.BatchObserverResult, []attribute.KeyValue, view.AggregationData)) func(metric.BatchObserverResult) {
+	return func(result metric.BatchObserverResult) {
+		rows, err := view.RetrieveData(name)
+		if err != nil {
+			// not registered
+			return
+		}
+		for _, row := range rows {
+			attrs := make([]attribute.KeyValue, 0, len(row.Tags))
+			for _, t := range row.Tags {
+				attrs = append(attrs, attribute.String(t.Key.Name(), t.Value))
+			}
+			observe(result, attrs, row.Data)
+		}
+	}
+}
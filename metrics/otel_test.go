@@ -0,0 +1,92 @@
+package metrics
+
+import (
+	"context"
+	"testing"
+
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+type testInstrument struct {
+	desc metric.Descriptor
+}
+
+func (i *testInstrument) Implementation() interface{}   { return i }
+func (i *testInstrument) Descriptor() metric.Descriptor { return i.desc }
+
+// testMeter collects the observations of its batch observer.
+type testMeter struct {
+	// the instruments of a batch observer share its runner
+	runner metric.AsyncBatchRunner
+}
+
+func (m *testMeter) RecordBatch(context.Context, []attribute.KeyValue, ...metric.Measurement) {}
+
+func (m *testMeter) NewSyncInstrument(metric.Descriptor) (metric.SyncImpl, error) {
+	return metric.NoopSync{}, nil
+}
+
+func (m *testMeter) NewAsyncInstrument(desc metric.Descriptor, runner metric.AsyncRunner) (metric.AsyncImpl, error) {
+	if r, ok := runner.(metric.AsyncBatchRunner); ok {
+		m.runner = r
+	}
+	return &testInstrument{desc: desc}, nil
+}
+
+// collect returns the observed values by instrument name and attributes.
+func (m *testMeter) collect() map[string]float64 {
+	values := make(map[string]float64)
+	m.runner.Run(context.Background(), func(attrs []attribute.KeyValue, obs ...metric.Observation) {
+		set := attribute.NewSet(attrs...)
+		for _, o := range obs {
+			desc := o.AsyncImpl().Descriptor()
+			key := desc.Name() + "{" + string(set.Encoded(attribute.DefaultEncoder())) + "}"
+			n := o.Number()
+			values[key] = n.CoerceToFloat64(desc.NumberKind())
+		}
+	})
+	return values
+}
+
+func TestExportViews(t *testing.T) {
+	ctx, err := tag.New(context.Background(), tag.Upsert(KeyMessageType, "PING"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	views := []*view.View{ReceivedMessagesView, ReceivedBytesView, RoutingTableSizeView}
+	if err := view.Register(views...); err != nil {
+		t.Fatal(err)
+	}
+	defer view.Unregister(views...)
+
+	stats.Record(ctx, ReceivedMessages.M(1), ReceivedBytes.M(1500), RoutingTableSize.M(7))
+	stats.Record(ctx, ReceivedMessages.M(1), ReceivedBytes.M(3000))
+
+	m := &testMeter{}
+	if err := ExportViews(metric.WrapMeterImpl(m, "test"), views...); err != nil {
+		t.Fatal(err)
+	}
+	if m.runner == nil {
+		t.Fatal("no observers registered")
+	}
+	values := m.collect()
+
+	for key, expected := range map[string]float64{
+		"libp2p.io.dht.kad.received_messages{message_type=PING}":             2,
+		"libp2p.io.dht.kad.received_bytes.count{message_type=PING}":          2,
+		"libp2p.io.dht.kad.received_bytes.sum{message_type=PING}":            4500,
+		"libp2p.io.dht.kad.received_bytes.bucket{le=2048,message_type=PING}": 1,
+		"libp2p.io.dht.kad.received_bytes.bucket{le=4096,message_type=PING}": 2,
+		"libp2p.io.dht.kad.received_bytes.bucket{le=+Inf,message_type=PING}": 2,
+		"libp2p.io.dht.kad.routing_table_size{}":                             7,
+	} {
+		if v, ok := values[key]; !ok || v != expected {
+			t.Errorf("expected %s to be %v, got %v (observed: %v)", key, expected, v, ok)
+		}
+	}
+}
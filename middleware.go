@@ -0,0 +1,43 @@
+package dht
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	dhtcfg "github.com/libp2p/go-libp2p-kad-dht/internal/config"
+	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
+)
+
+// RequestHandler handles an inbound request from a peer, and returns the
+// response to send back, if any. Returning an error resets the stream the
+// request came in on.
+type RequestHandler = dhtcfg.RequestHandler
+
+// RequestMiddleware wraps the handling of inbound requests, see
+// HandlerMiddleware.
+type RequestMiddleware = dhtcfg.RequestMiddleware
+
+// requestHandler returns the handler of the requests of type t, wrapped in the
+// middlewares, or nil if neither we nor a middleware may handle them.
+func (dht *IpfsDHT) requestHandler(t pb.Message_MessageType) dhtHandler {
+	h := dht.handlerForMsgType(t)
+	if len(dht.middlewares) == 0 {
+		return h
+	}
+
+	next := RequestHandler(h)
+	if h == nil {
+		// left to the middlewares, e.g. experimental handlers
+		next = unhandledRequest
+	}
+	for i := len(dht.middlewares) - 1; i >= 0; i-- {
+		next = dht.middlewares[i](next)
+	}
+	return dhtHandler(next)
+}
+
+func unhandledRequest(_ context.Context, _ peer.ID, req *pb.Message) (*pb.Message, error) {
+	return nil, fmt.Errorf("no handler for %s requests", req.GetType())
+}
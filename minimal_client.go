@@ -0,0 +1,34 @@
+package dht
+
+import (
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	dhtcfg "github.com/libp2p/go-libp2p-kad-dht/internal/config"
+)
+
+// applyMinimalClientProfile adapts cfg to a short-lived client, see
+// MinimalClientProfile.
+func applyMinimalClientProfile(cfg *dhtcfg.Config) {
+	cfg.Mode = ModeClient
+	cfg.RoutingTable.AutoRefresh = false
+
+	maxPeers := cfg.MinimalClient.MaxPeers
+	if maxPeers == 0 {
+		maxPeers = cfg.BucketSize
+	}
+	// the routing table never holds more peers than that, wait for no more
+	// to be ready
+	if cfg.FastBootstrap.MinPeers > maxPeers {
+		cfg.FastBootstrap.MinPeers = maxPeers
+	}
+	filter := cfg.RoutingTable.PeerFilter
+	cfg.RoutingTable.PeerFilter = func(dht interface{}, p peer.ID) bool {
+		rt := dht.(*IpfsDHT).routingTable
+		// the peers of a full routing table stay, rejecting them would remove
+		// them
+		if rt.Find(p) == "" && rt.Size() >= maxPeers {
+			return false
+		}
+		return filter == nil || filter(dht, p)
+	}
+}
@@ -0,0 +1,130 @@
+package dht
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"sync"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	kb "github.com/libp2p/go-libp2p-kbucket"
+	"go.opencensus.io/stats"
+
+	"github.com/libp2p/go-libp2p-kad-dht/metrics"
+)
+
+const (
+	// netSizeSamples is the number of the last lookups the network size is
+	// estimated from.
+	netSizeSamples = 128
+	// netSizeMinSamples is the number of lookups needed to estimate the
+	// network size.
+	netSizeMinSamples = 10
+)
+
+// ErrNotEnoughData is returned by NetworkSize until enough lookups completed to
+// estimate the size of the network.
+var ErrNotEnoughData = errors.New("not enough data to estimate the network size")
+
+// netSizeSample is the contribution of a lookup to the estimate, see track.
+type netSizeSample struct {
+	num, den float64
+}
+
+// netSizeEstimator estimates the size of the network from the density of the
+// peers around the targets of the completed lookups.
+//
+// The Kademlia IDs of the N peers of the network being uniformly distributed,
+// the normalized distance of the i-th closest peer to a target is expected to
+// be i/(N+1). N+1 is estimated by the least squares fit of the distances of
+// the closest peers found by the last lookups, Σi²/Σi·dᵢ.
+type netSizeEstimator struct {
+	mu sync.Mutex
+	// ring of the last samples, next being the oldest once full
+	samples []netSizeSample
+	next    int
+}
+
+func newNetSizeEstimator() *netSizeEstimator {
+	return &netSizeEstimator{}
+}
+
+// track adds the sample of a completed lookup of target, which found peers.
+func (e *netSizeEstimator) track(target string, peers []peer.ID) {
+	if len(peers) == 0 {
+		return
+	}
+	key := kb.ConvertKey(target)
+	var s netSizeSample
+	for i, p := range kb.SortClosestPeers(peers, key) {
+		rank := float64(i + 1)
+		s.num += rank * rank
+		s.den += rank * normalizedDistance(key, kb.ConvertPeerID(p))
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.samples) < netSizeSamples {
+		e.samples = append(e.samples, s)
+		return
+	}
+	e.samples[e.next] = s
+	e.next = (e.next + 1) % netSizeSamples
+}
+
+func (e *netSizeEstimator) estimate() (int, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.samples) < netSizeMinSamples {
+		return 0, ErrNotEnoughData
+	}
+	var num, den float64
+	for _, s := range e.samples {
+		num += s.num
+		den += s.den
+	}
+	if den == 0 {
+		return 0, ErrNotEnoughData
+	}
+	return int(math.Round(num / den)), nil
+}
+
+// normalizedDistance returns the XOR distance between a and b as a fraction
+// of the keyspace, in [0, 1).
+func normalizedDistance(a, b kb.ID) float64 {
+	var d [8]byte
+	for i := range d {
+		d[i] = a[i] ^ b[i]
+	}
+	return float64(binary.BigEndian.Uint64(d[:])) / math.Exp2(64)
+}
+
+// trackNetworkSize adds the sample of a completed lookup of target, which
+// found peers, to the estimate of the network size.
+func (dht *IpfsDHT) trackNetworkSize(target string, peers []peer.ID) {
+	dht.netSize.track(target, peers)
+	if n, err := dht.netSize.estimate(); err == nil {
+		stats.Record(dht.ctx, metrics.NetworkSize.M(int64(n)))
+	}
+}
+
+// NetworkSize returns an estimate of the number of peers in the network,
+// including us, from the density of the peers found around the targets of the
+// last completed lookups. It returns ErrNotEnoughData until enough lookups
+// completed, which the refreshes of the routing table are.
+func (dht *IpfsDHT) NetworkSize() (int, error) {
+	return dht.netSize.estimate()
+}
+
+// refreshMaxCpl returns the number of common prefix lengths with us worth
+// refreshing in the routing table in a network of n peers. About n/2^cpl peers
+// share a prefix of cpl bits with us, so the lookup of ourselves, finding the
+// closest bucketSize peers, finds all the peers of the buckets from
+// log2(n/bucketSize) on.
+func refreshMaxCpl(n, bucketSize int) uint {
+	cpl := math.Ceil(math.Log2(float64(n) / float64(bucketSize)))
+	if cpl < 1 {
+		return 1
+	}
+	return uint(cpl)
+}
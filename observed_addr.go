@@ -0,0 +1,35 @@
+package dht
+
+import (
+	"context"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+
+	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
+)
+
+type remoteAddrKey struct{}
+
+// withRemoteAddr records the remote address of the connection a request was
+// received over.
+func withRemoteAddr(ctx context.Context, a ma.Multiaddr) context.Context {
+	return context.WithValue(ctx, remoteAddrKey{}, a)
+}
+
+// setObservedAddr tells the requesters announcing CapObservedAddrs the address
+// we observe them at, see ObservedAddrFeedback. Requests received over
+// datagrams or HTTP aren't told any.
+func (dht *IpfsDHT) setObservedAddr(ctx context.Context, p peer.ID, resp *pb.Message) {
+	if !dht.observedAddrFeedback {
+		return
+	}
+	a, ok := ctx.Value(remoteAddrKey{}).(ma.Multiaddr)
+	if !ok {
+		return
+	}
+	if caps, _ := pb.PeerCapabilities(dht.peerstore, p); !caps.Has(pb.CapObservedAddrs) {
+		return
+	}
+	resp.ObservedAddr = a.Bytes()
+}
@@ -0,0 +1,258 @@
+package dht
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+	"github.com/jbenet/goprocess"
+	"github.com/multiformats/go-base32"
+	"github.com/multiformats/go-multihash"
+
+	"github.com/libp2p/go-libp2p-kad-dht/internal"
+)
+
+// ErrOfflineQueueFull is returned by Provide, ProvideMany and PutValue when the
+// routing table is empty and the offline queue has no room left.
+var ErrOfflineQueueFull = errors.New("offline queue is full")
+
+var (
+	offlineProvidesKey = ds.NewKey("/offline-queue/provide")
+	offlinePutsKey     = ds.NewKey("/offline-queue/put")
+)
+
+// offlineQueueRetryInterval is how often queued operations are retried when no
+// peer joins the routing table in between.
+var offlineQueueRetryInterval = time.Minute
+
+// offlineQueueMaxBackoff caps how long an operation no peer accepted waits
+// before it is retried.
+var offlineQueueMaxBackoff = time.Hour
+
+// offlineQueue persists the provides and puts issued while the routing table is
+// empty, until they can be sent out.
+type offlineQueue struct {
+	size int
+
+	mu    sync.Mutex
+	count int
+	// backoffs holds when the operations that failed to go out, by queue and
+	// key, may be retried.
+	backoffs map[ds.Key]offlineBackoff
+
+	// signaled when a peer is added to the routing table
+	peerAdded chan struct{}
+}
+
+type offlineBackoff struct {
+	attempts int
+	next     time.Time
+}
+
+// queueOffline reports whether operations should be queued rather than sent out.
+func (dht *IpfsDHT) queueOffline() bool {
+	return dht.offlineQueue != nil && dht.routingTable.Size() == 0
+}
+
+// enqueueOffline persists an operation on key under the given queue.
+func (dht *IpfsDHT) enqueueOffline(ctx context.Context, queue ds.Key, key []byte) error {
+	q := dht.offlineQueue
+	dsk := queue.Child(convertToDsKey(key))
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if has, err := dht.datastore.Has(ctx, dsk); err != nil {
+		return err
+	} else if has {
+		return nil
+	}
+	if q.count >= q.size {
+		return ErrOfflineQueueFull
+	}
+	if err := dht.datastore.Put(ctx, dsk, nil); err != nil {
+		return err
+	}
+	q.count++
+	return nil
+}
+
+// loadOfflineQueue counts the operations persisted by a previous run.
+func (dht *IpfsDHT) loadOfflineQueue() error {
+	count := 0
+	for _, queue := range []ds.Key{offlineProvidesKey, offlinePutsKey} {
+		keys, err := dht.offlineQueueKeys(queue)
+		if err != nil {
+			return err
+		}
+		count += len(keys)
+	}
+
+	dht.offlineQueue.mu.Lock()
+	dht.offlineQueue.count = count
+	dht.offlineQueue.mu.Unlock()
+	return nil
+}
+
+// signalOfflineQueue wakes up the offline queue when a peer is added to the
+// routing table.
+func (dht *IpfsDHT) signalOfflineQueue() {
+	if dht.offlineQueue == nil {
+		return
+	}
+	select {
+	case dht.offlineQueue.peerAdded <- struct{}{}:
+	default:
+	}
+}
+
+// offlineQueueLoop sends out the queued operations once the routing table is
+// no longer empty.
+func (dht *IpfsDHT) offlineQueueLoop(proc goprocess.Process) {
+	q := dht.offlineQueue
+
+	ticker := time.NewTicker(offlineQueueRetryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-q.peerAdded:
+		case <-ticker.C:
+		case <-proc.Closing():
+			return
+		}
+		if dht.routingTable.Size() > 0 {
+			dht.flushOfflineQueue(dht.ctx)
+		}
+	}
+}
+
+func (dht *IpfsDHT) flushOfflineQueue(ctx context.Context) {
+	provides, err := dht.offlineQueueKeys(offlineProvidesKey)
+	if err != nil {
+		logger.Warnw("failed to load queued provides", "error", err)
+	}
+	for _, k := range provides {
+		if ctx.Err() != nil {
+			return
+		}
+		if dht.backingOff(offlineProvidesKey, k) {
+			continue
+		}
+		keyMH := multihash.Multihash(k)
+		peers, err := dht.getReplicaPeers(ctx, string(keyMH))
+		if err != nil {
+			logger.Debugw("failed to send queued provide", "key", internal.LoggableProviderRecordBytes(keyMH), "error", err)
+			dht.backOff(offlineProvidesKey, k)
+			continue
+		}
+		if res := dht.putProviderToPeers(ctx, keyMH, peers); len(res.Succeeded) == 0 {
+			logger.Debugw("no peer accepted queued provide", "key", internal.LoggableProviderRecordBytes(keyMH))
+			dht.backOff(offlineProvidesKey, k)
+			continue
+		}
+		dht.dequeueOffline(offlineProvidesKey, k)
+	}
+
+	puts, err := dht.offlineQueueKeys(offlinePutsKey)
+	if err != nil {
+		logger.Warnw("failed to load queued puts", "error", err)
+	}
+	for _, k := range puts {
+		if ctx.Err() != nil {
+			return
+		}
+		if dht.backingOff(offlinePutsKey, k) {
+			continue
+		}
+		key := string(k)
+		rec, err := dht.getLocal(ctx, key)
+		if err != nil {
+			continue
+		}
+		if rec != nil {
+			if _, err := dht.putValueToPeers(ctx, key, rec); err != nil {
+				logger.Debugw("failed to send queued put", "key", internal.LoggableRecordKeyString(key), "error", err)
+				dht.backOff(offlinePutsKey, k)
+				continue
+			}
+		}
+		dht.dequeueOffline(offlinePutsKey, k)
+	}
+}
+
+func (dht *IpfsDHT) dequeueOffline(queue ds.Key, key []byte) {
+	q := dht.offlineQueue
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	dsk := queue.Child(convertToDsKey(key))
+	if err := dht.datastore.Delete(dht.ctx, dsk); err != nil {
+		logger.Warnw("failed to remove operation from the offline queue", "error", err)
+		return
+	}
+	delete(q.backoffs, dsk)
+	q.count--
+}
+
+// backOff keeps a queued operation no peer accepted in the queue, and holds off
+// retrying it for twice as long as the last time, up to offlineQueueMaxBackoff.
+func (dht *IpfsDHT) backOff(queue ds.Key, key []byte) {
+	q := dht.offlineQueue
+	dsk := queue.Child(convertToDsKey(key))
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.backoffs == nil {
+		q.backoffs = make(map[ds.Key]offlineBackoff)
+	}
+	b := q.backoffs[dsk]
+	delay := offlineQueueMaxBackoff
+	if b.attempts < 32 {
+		if d := offlineQueueRetryInterval << b.attempts; d > 0 && d < delay {
+			delay = d
+		}
+	}
+	b.attempts++
+	b.next = time.Now().Add(delay)
+	q.backoffs[dsk] = b
+}
+
+// backingOff reports whether a queued operation must wait before being retried.
+func (dht *IpfsDHT) backingOff(queue ds.Key, key []byte) bool {
+	q := dht.offlineQueue
+	dsk := queue.Child(convertToDsKey(key))
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	b, ok := q.backoffs[dsk]
+	return ok && time.Now().Before(b.next)
+}
+
+// offlineQueueKeys returns the keys of the operations in the given queue.
+func (dht *IpfsDHT) offlineQueueKeys(queue ds.Key) ([][]byte, error) {
+	res, err := dht.datastore.Query(dht.ctx, dsq.Query{Prefix: queue.String(), KeysOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([][]byte, 0, len(entries))
+	for _, e := range entries {
+		k, err := base32.RawStdEncoding.DecodeString(ds.RawKey(e.Key).Name())
+		if err != nil {
+			logger.Warnw("dropping undecodable offline queue entry", "key", e.Key, "error", err)
+			continue
+		}
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
@@ -0,0 +1,85 @@
+package dht_pb
+
+import (
+	"context"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// WithAddressFilter drops the addresses of the closer peers and providers in
+// the responses we get that keep rejects, once their signatures are checked.
+func WithAddressFilter(keep func(ma.Multiaddr) bool) ProtocolMessengerOption {
+	return func(pm *ProtocolMessenger) error {
+		pm.keepAddr = keep
+		return nil
+	}
+}
+
+// FilterMessageAddrs drops the addresses of the closer peers and providers in
+// m that keep rejects.
+func FilterMessageAddrs(m *Message, keep func(ma.Multiaddr) bool) {
+	FilterPeerAddrs(m.CloserPeers, keep)
+	FilterPeerAddrs(m.ProviderPeers, keep)
+	for i := range m.CloserPeersByKey {
+		FilterPeerAddrs(m.CloserPeersByKey[i].CloserPeers, keep)
+	}
+}
+
+// FilterPeerAddrs drops the addresses of peers that keep rejects, and the ones
+// that can't be decoded.
+func FilterPeerAddrs(peers []Message_Peer, keep func(ma.Multiaddr) bool) {
+	for i := range peers {
+		addrs := make([][]byte, 0, len(peers[i].Addrs))
+		for _, b := range peers[i].Addrs {
+			a, err := ma.NewMultiaddrBytes(b)
+			if err == nil && keep(a) {
+				addrs = append(addrs, b)
+			}
+		}
+		peers[i].Addrs = addrs
+	}
+}
+
+// PreferMessageAddrs moves the addresses of the closer peers and providers in m
+// that preferred approves before the others, keeping their order otherwise.
+func PreferMessageAddrs(m *Message, preferred func(ma.Multiaddr) bool) {
+	prefer := func(peers []Message_Peer) {
+		for i := range peers {
+			first := make([][]byte, 0, len(peers[i].Addrs))
+			var rest [][]byte
+			for _, b := range peers[i].Addrs {
+				if a, err := ma.NewMultiaddrBytes(b); err == nil && preferred(a) {
+					first = append(first, b)
+				} else {
+					rest = append(rest, b)
+				}
+			}
+			peers[i].Addrs = append(first, rest...)
+		}
+	}
+	prefer(m.CloserPeers)
+	prefer(m.ProviderPeers)
+	for i := range m.CloserPeersByKey {
+		prefer(m.CloserPeersByKey[i].CloserPeers)
+	}
+}
+
+// filteringSender filters the peer addresses in the responses it receives.
+type filteringSender struct {
+	MessageSender
+	keep func(ma.Multiaddr) bool
+}
+
+func (fs *filteringSender) SendRequest(ctx context.Context, p peer.ID, pmes *Message) (*Message, error) {
+	ctx = wrapFrameHandler(ctx, func(frame *Message) error {
+		FilterMessageAddrs(frame, fs.keep)
+		return nil
+	})
+	resp, err := fs.MessageSender.SendRequest(ctx, p, pmes)
+	if err != nil {
+		return nil, err
+	}
+	FilterMessageAddrs(resp, fs.keep)
+	return resp, nil
+}
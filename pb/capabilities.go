@@ -0,0 +1,120 @@
+package dht_pb
+
+import (
+	"context"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/peerstore"
+)
+
+// Capabilities is a bitmask of the optional protocol features a peer supports.
+// Peers exchange them on first contact, so that the features can be used
+// without trying them out request by request.
+type Capabilities uint64
+
+const (
+	// CapSignedProviderRecords is set by peers storing and serving signed
+	// provider records.
+	CapSignedProviderRecords Capabilities = 1 << iota
+	// CapMessageCompression is set by peers speaking the compressed variants
+	// of the DHT protocols.
+	CapMessageCompression
+	// CapRecordCompression is set by peers accepting compressed record values.
+	CapRecordCompression
+	// CapBatchedQueries is set by peers answering FIND_NODE requests for
+	// several keys.
+	CapBatchedQueries
+	// CapDoubleHashedProviders is set by peers storing their provider records
+	// under double-hashed keys.
+	CapDoubleHashedProviders
+	// CapSignedResponses is set by peers signing their FIND_NODE and
+	// GET_PROVIDERS responses.
+	CapSignedResponses
+	// CapPaginatedProviders is set by peers returning, and accepting, large
+	// provider lists in pages.
+	CapPaginatedProviders
+	// CapStreamedProviders is set by peers sending, and reading, large
+	// GET_PROVIDERS responses in several frames over the request's stream.
+	CapStreamedProviders
+	// CapObservedAddrs is set by peers wanting to be told the address they
+	// are observed at in responses.
+	CapObservedAddrs
+)
+
+// Has returns whether all the features of f are set.
+func (c Capabilities) Has(f Capabilities) bool {
+	return c&f == f
+}
+
+// capabilitiesKey is the peerstore metadata key under which the capabilities of
+// a peer are stored.
+const capabilitiesKey = "dht-capabilities"
+
+// RememberCapabilities stores the capabilities of p in the peerstore.
+func RememberCapabilities(ps peerstore.Peerstore, p peer.ID, caps Capabilities) {
+	if err := ps.Put(p, capabilitiesKey, caps); err != nil {
+		log.Debugw("failed to remember peer capabilities", "peer", p, "error", err)
+	}
+}
+
+// PeerCapabilities returns the capabilities of p, and false if they are not
+// known yet.
+func PeerCapabilities(ps peerstore.Peerstore, p peer.ID) (Capabilities, bool) {
+	v, err := ps.Get(p, capabilitiesKey)
+	if err != nil {
+		return 0, false
+	}
+	caps, ok := v.(Capabilities)
+	return caps, ok
+}
+
+// WithCapabilities announces caps to the peers whose capabilities aren't known
+// yet, and remembers theirs in ps, as answered. Peers answering without
+// capabilities are remembered as supporting none.
+func WithCapabilities(caps Capabilities, ps peerstore.Peerstore) ProtocolMessengerOption {
+	return func(pm *ProtocolMessenger) error {
+		pm.caps = &capabilitySender{caps: caps, ps: ps}
+		return nil
+	}
+}
+
+// capabilitySender exchanges capabilities over the requests it sends.
+type capabilitySender struct {
+	MessageSender
+	caps Capabilities
+	ps   peerstore.Peerstore
+}
+
+func (cs *capabilitySender) SendRequest(ctx context.Context, p peer.ID, pmes *Message) (*Message, error) {
+	if _, ok := PeerCapabilities(cs.ps, p); ok {
+		return cs.MessageSender.SendRequest(ctx, p, pmes)
+	}
+
+	// the message may be sent to other peers concurrently
+	req := *pmes
+	req.Capabilities = uint64(cs.caps)
+	resp, err := cs.MessageSender.SendRequest(ctx, p, &req)
+	if err != nil {
+		return nil, err
+	}
+	RememberCapabilities(cs.ps, p, Capabilities(resp.GetCapabilities()))
+	return resp, nil
+}
+
+func (cs *capabilitySender) SendMessage(ctx context.Context, p peer.ID, pmes *Message) error {
+	if _, ok := PeerCapabilities(cs.ps, p); ok {
+		return cs.MessageSender.SendMessage(ctx, p, pmes)
+	}
+
+	req := *pmes
+	req.Capabilities = uint64(cs.caps)
+	return cs.MessageSender.SendMessage(ctx, p, &req)
+}
+
+// peerCapabilities returns the capabilities of p, if known.
+func (pm *ProtocolMessenger) peerCapabilities(p peer.ID) (Capabilities, bool) {
+	if pm.caps == nil {
+		return 0, false
+	}
+	return PeerCapabilities(pm.caps.ps, p)
+}
@@ -0,0 +1,96 @@
+package dht_pb
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	kb "github.com/libp2p/go-libp2p-kbucket"
+)
+
+// MaxCloserPeers caps the number of closer peers requesters may ask for, see
+// WithCloserPeersCount.
+const MaxCloserPeers = 100
+
+// WithCloserPeersCount asks for n closer peers in the FIND_NODE, GET_VALUE and
+// GET_PROVIDERS requests we send, rather than the responder's bucket size, and
+// keeps the n closest of the closer peers responders configured with a larger
+// bucket size return anyway.
+func WithCloserPeersCount(n int) ProtocolMessengerOption {
+	return func(pm *ProtocolMessenger) error {
+		if n < 1 || n > MaxCloserPeers {
+			return fmt.Errorf("closer peers count must be between 1 and %d, got %d", MaxCloserPeers, n)
+		}
+		pm.closerPeersCount = n
+		return nil
+	}
+}
+
+// asksForCloserPeers returns whether the requests of type t are answered with
+// closer peers.
+func asksForCloserPeers(t Message_MessageType) bool {
+	switch t {
+	case Message_FIND_NODE, Message_GET_VALUE, Message_GET_PROVIDERS:
+		return true
+	}
+	return false
+}
+
+// closerPeersCountSender sets the number of closer peers of the requests it
+// sends, and trims the responses to it.
+type closerPeersCountSender struct {
+	MessageSender
+	n int
+}
+
+func (cs *closerPeersCountSender) SendRequest(ctx context.Context, p peer.ID, pmes *Message) (*Message, error) {
+	if !asksForCloserPeers(pmes.GetType()) {
+		return cs.MessageSender.SendRequest(ctx, p, pmes)
+	}
+
+	// the message may be sent to other peers concurrently
+	req := *pmes
+	req.CloserPeersCount = uint32(cs.n)
+	ctx = wrapFrameHandler(ctx, func(frame *Message) error {
+		cs.trim(pmes.GetKey(), frame)
+		return nil
+	})
+	resp, err := cs.MessageSender.SendRequest(ctx, p, &req)
+	if err != nil {
+		return nil, err
+	}
+	cs.trim(pmes.GetKey(), resp)
+	return resp, nil
+}
+
+// trim keeps the n closer peers of resp closest to their key.
+func (cs *closerPeersCountSender) trim(key []byte, resp *Message) {
+	resp.CloserPeers = ClosestPeers(resp.CloserPeers, key, cs.n)
+	for i := range resp.CloserPeersByKey {
+		kp := &resp.CloserPeersByKey[i]
+		kp.CloserPeers = ClosestPeers(kp.CloserPeers, kp.Key, cs.n)
+	}
+}
+
+// ClosestPeers returns the n peers of peers closest to key, in the order they
+// came in, or all of them if there are no more than n.
+func ClosestPeers(peers []Message_Peer, key []byte, n int) []Message_Peer {
+	if len(peers) <= n {
+		return peers
+	}
+	ids := make([]peer.ID, len(peers))
+	for i := range peers {
+		ids[i] = peer.ID(peers[i].Id)
+	}
+	keep := make(map[peer.ID]struct{}, n)
+	for _, id := range kb.SortClosestPeers(ids, kb.ConvertKey(string(key)))[:n] {
+		keep[id] = struct{}{}
+	}
+	closest := make([]Message_Peer, 0, n)
+	for _, pbp := range peers {
+		if _, ok := keep[peer.ID(pbp.Id)]; ok && len(closest) < n {
+			closest = append(closest, pbp)
+		}
+	}
+	return closest
+}
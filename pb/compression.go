@@ -0,0 +1,188 @@
+package dht_pb
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/peerstore"
+	recpb "github.com/libp2p/go-libp2p-record/pb"
+)
+
+// acceptedCompressionsKey is the peerstore metadata key under which the record
+// compressions accepted by a peer are stored.
+const acceptedCompressionsKey = "dht-record-compressions"
+
+// SupportedCompressions lists the record compressions this implementation
+// supports, in order of preference.
+var SupportedCompressions = []Message_Compression{Message_ZSTD, Message_SNAPPY}
+
+// RememberAcceptedCompressions stores the record compressions that the sender
+// of m accepts, as advertised in m, in the peerstore.
+func RememberAcceptedCompressions(ps peerstore.Peerstore, p peer.ID, m *Message) {
+	if len(m.GetAcceptedCompressions()) == 0 {
+		return
+	}
+	if err := ps.Put(p, acceptedCompressionsKey, m.GetAcceptedCompressions()); err != nil {
+		log.Debugw("failed to remember accepted record compressions", "peer", p, "error", err)
+	}
+}
+
+// AcceptedCompressions returns the record compressions p is known to accept.
+func AcceptedCompressions(ps peerstore.Peerstore, p peer.ID) []Message_Compression {
+	v, err := ps.Get(p, acceptedCompressionsKey)
+	if err != nil {
+		return nil
+	}
+	accepted, _ := v.([]Message_Compression)
+	return accepted
+}
+
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+	zstdErr     error
+)
+
+func zstdCodec() (*zstd.Encoder, *zstd.Decoder, error) {
+	zstdOnce.Do(func() {
+		zstdEncoder, zstdErr = zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+		if zstdErr != nil {
+			return
+		}
+		zstdDecoder, zstdErr = zstd.NewReader(nil,
+			zstd.WithDecoderConcurrency(1),
+			zstd.WithDecoderMaxMemory(network.MessageSizeMax),
+		)
+	})
+	return zstdEncoder, zstdDecoder, zstdErr
+}
+
+// CompressRecord compresses the value of the message's record with the first of
+// SupportedCompressions that is also in accepted, if the value is at least
+// threshold bytes long. The record is copied rather than modified in place.
+func CompressRecord(m *Message, accepted []Message_Compression, threshold int) error {
+	rec := m.GetRecord()
+	if rec == nil || m.RecordCompression != Message_NONE || len(rec.GetValue()) < threshold {
+		return nil
+	}
+
+	alg := Message_NONE
+loop:
+	for _, c := range SupportedCompressions {
+		for _, a := range accepted {
+			if a == c {
+				alg = c
+				break loop
+			}
+		}
+	}
+
+	var value []byte
+	switch alg {
+	case Message_NONE:
+		return nil
+	case Message_ZSTD:
+		enc, _, err := zstdCodec()
+		if err != nil {
+			return err
+		}
+		value = enc.EncodeAll(rec.GetValue(), nil)
+	case Message_SNAPPY:
+		value = snappy.Encode(nil, rec.GetValue())
+	}
+
+	// not worth it
+	if len(value) >= len(rec.GetValue()) {
+		return nil
+	}
+
+	m.Record = &recpb.Record{
+		Key:          rec.GetKey(),
+		Value:        value,
+		TimeReceived: rec.GetTimeReceived(),
+	}
+	m.RecordCompression = alg
+	return nil
+}
+
+// DecompressRecord restores the value of a record compressed with
+// CompressRecord, failing if the decompressed value would be larger than
+// maxSize bytes.
+func DecompressRecord(m *Message, maxSize int) error {
+	rec := m.GetRecord()
+	if m.RecordCompression == Message_NONE || rec == nil {
+		m.RecordCompression = Message_NONE
+		return nil
+	}
+
+	var value []byte
+	switch m.RecordCompression {
+	case Message_ZSTD:
+		_, dec, err := zstdCodec()
+		if err != nil {
+			return err
+		}
+		value, err = dec.DecodeAll(rec.GetValue(), nil)
+		if err != nil {
+			return err
+		}
+	case Message_SNAPPY:
+		n, err := snappy.DecodedLen(rec.GetValue())
+		if err != nil {
+			return err
+		}
+		if n > maxSize {
+			return fmt.Errorf("decompressed record value is %d bytes, the maximum is %d", n, maxSize)
+		}
+		value, err = snappy.Decode(nil, rec.GetValue())
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unsupported record compression %s", m.RecordCompression)
+	}
+
+	if len(value) > maxSize {
+		return fmt.Errorf("decompressed record value is %d bytes, the maximum is %d", len(value), maxSize)
+	}
+
+	m.Record = &recpb.Record{
+		Key:          rec.GetKey(),
+		Value:        value,
+		TimeReceived: rec.GetTimeReceived(),
+	}
+	m.RecordCompression = Message_NONE
+	return nil
+}
+
+// CompressMessage compresses a marshaled message with zstd, for streams
+// speaking a compressed protocol variant.
+func CompressMessage(b []byte) ([]byte, error) {
+	enc, _, err := zstdCodec()
+	if err != nil {
+		return nil, err
+	}
+	return enc.EncodeAll(b, nil), nil
+}
+
+// DecompressMessage restores a message compressed with CompressMessage, failing
+// if the decompressed message would be larger than maxSize bytes.
+func DecompressMessage(b []byte, maxSize int) ([]byte, error) {
+	_, dec, err := zstdCodec()
+	if err != nil {
+		return nil, err
+	}
+	out, err := dec.DecodeAll(b, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(out) > maxSize {
+		return nil, fmt.Errorf("decompressed message is %d bytes, the maximum is %d", len(out), maxSize)
+	}
+	return out, nil
+}
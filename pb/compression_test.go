@@ -0,0 +1,71 @@
+package dht_pb
+
+import (
+	"bytes"
+	"testing"
+
+	recpb "github.com/libp2p/go-libp2p-record/pb"
+)
+
+func TestRecordCompressionRoundTrip(t *testing.T) {
+	value := bytes.Repeat([]byte("compressible "), 100)
+
+	for _, alg := range SupportedCompressions {
+		rec := &recpb.Record{Key: []byte("/v/key"), Value: value}
+		m := &Message{Type: Message_PUT_VALUE, Record: rec}
+
+		if err := CompressRecord(m, []Message_Compression{alg}, 64); err != nil {
+			t.Fatal(err)
+		}
+		if m.RecordCompression != alg {
+			t.Fatalf("expected %s compression, got %s", alg, m.RecordCompression)
+		}
+		if len(m.Record.Value) >= len(value) {
+			t.Fatalf("%s did not compress the value", alg)
+		}
+		if !bytes.Equal(rec.Value, value) {
+			t.Fatal("the original record was modified")
+		}
+
+		// survives the wire
+		data, err := m.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		m = new(Message)
+		if err := m.Unmarshal(data); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := DecompressRecord(m, len(value)-1); err == nil {
+			t.Fatalf("%s: expected decompressing beyond the maximum size to fail", alg)
+		}
+		if err := DecompressRecord(m, len(value)); err != nil {
+			t.Fatal(err)
+		}
+		if m.RecordCompression != Message_NONE || !bytes.Equal(m.Record.Value, value) {
+			t.Fatalf("%s: value did not survive the round trip", alg)
+		}
+	}
+}
+
+func TestRecordCompressionSkipped(t *testing.T) {
+	value := bytes.Repeat([]byte("a"), 100)
+
+	// below threshold
+	m := &Message{Record: &recpb.Record{Value: value}}
+	if err := CompressRecord(m, SupportedCompressions, 101); err != nil {
+		t.Fatal(err)
+	}
+	if m.RecordCompression != Message_NONE {
+		t.Fatal("compressed a value below the threshold")
+	}
+
+	// nothing accepted in common
+	if err := CompressRecord(m, nil, 0); err != nil {
+		t.Fatal(err)
+	}
+	if m.RecordCompression != Message_NONE {
+		t.Fatal("compressed a value for a peer not accepting compression")
+	}
+}
@@ -0,0 +1,47 @@
+package dht_pb
+
+import (
+	"context"
+	"math"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// WithDeadlineHints tells peers how long we are willing to wait for the
+// responses to the requests sent with a context deadline, see DeadlineHint, so
+// that they skip the work that wouldn't complete in time.
+func WithDeadlineHints() ProtocolMessengerOption {
+	return func(pm *ProtocolMessenger) error {
+		pm.deadlineHints = true
+		return nil
+	}
+}
+
+// DeadlineHint returns the deadline hint of a request sent with the given time
+// left before its deadline.
+func DeadlineHint(left time.Duration) uint32 {
+	ms := left / time.Millisecond
+	switch {
+	case ms < 1:
+		return 1
+	case ms > math.MaxUint32:
+		return math.MaxUint32
+	}
+	return uint32(ms)
+}
+
+// deadlineSender sets the deadline hints of the requests it sends.
+type deadlineSender struct {
+	MessageSender
+}
+
+func (ds *deadlineSender) SendRequest(ctx context.Context, p peer.ID, pmes *Message) (*Message, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		// the message may be sent to other peers concurrently
+		req := *pmes
+		req.DeadlineMs = DeadlineHint(time.Until(deadline))
+		pmes = &req
+	}
+	return ds.MessageSender.SendRequest(ctx, p, pmes)
+}
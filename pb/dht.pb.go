@@ -33,6 +33,8 @@ const (
 	Message_GET_PROVIDERS Message_MessageType = 3
 	Message_FIND_NODE     Message_MessageType = 4
 	Message_PING          Message_MessageType = 5
+	// retracts a provider record previously announced with ADD_PROVIDER
+	Message_REMOVE_PROVIDER Message_MessageType = 6
 )
 
 var Message_MessageType_name = map[int32]string{
@@ -42,15 +44,17 @@ var Message_MessageType_name = map[int32]string{
 	3: "GET_PROVIDERS",
 	4: "FIND_NODE",
 	5: "PING",
+	6: "REMOVE_PROVIDER",
 }
 
 var Message_MessageType_value = map[string]int32{
-	"PUT_VALUE":     0,
-	"GET_VALUE":     1,
-	"ADD_PROVIDER":  2,
-	"GET_PROVIDERS": 3,
-	"FIND_NODE":     4,
-	"PING":          5,
+	"PUT_VALUE":       0,
+	"GET_VALUE":       1,
+	"ADD_PROVIDER":    2,
+	"GET_PROVIDERS":   3,
+	"FIND_NODE":       4,
+	"PING":            5,
+	"REMOVE_PROVIDER": 6,
 }
 
 func (x Message_MessageType) String() string {
@@ -97,6 +101,35 @@ func (Message_ConnectionType) EnumDescriptor() ([]byte, []int) {
 	return fileDescriptor_616a434b24c97ff4, []int{0, 1}
 }
 
+type Message_Compression int32
+
+const (
+	// record value is sent as is (default)
+	Message_NONE   Message_Compression = 0
+	Message_ZSTD   Message_Compression = 1
+	Message_SNAPPY Message_Compression = 2
+)
+
+var Message_Compression_name = map[int32]string{
+	0: "NONE",
+	1: "ZSTD",
+	2: "SNAPPY",
+}
+
+var Message_Compression_value = map[string]int32{
+	"NONE":   0,
+	"ZSTD":   1,
+	"SNAPPY": 2,
+}
+
+func (x Message_Compression) String() string {
+	return proto.EnumName(Message_Compression_name, int32(x))
+}
+
+func (Message_Compression) EnumDescriptor() ([]byte, []int) {
+	return fileDescriptor_616a434b24c97ff4, []int{0, 2}
+}
+
 type Message struct {
 	// defines what type of message it is.
 	Type Message_MessageType `protobuf:"varint,1,opt,name=type,proto3,enum=dht.pb.Message_MessageType" json:"type,omitempty"`
@@ -114,10 +147,67 @@ type Message struct {
 	CloserPeers []Message_Peer `protobuf:"bytes,8,rep,name=closerPeers,proto3" json:"closerPeers"`
 	// Used to return Providers
 	// GET_VALUE, ADD_PROVIDER, GET_PROVIDERS
-	ProviderPeers        []Message_Peer `protobuf:"bytes,9,rep,name=providerPeers,proto3" json:"providerPeers"`
-	XXX_NoUnkeyedLiteral struct{}       `json:"-"`
-	XXX_unrecognized     []byte         `json:"-"`
-	XXX_sizecache        int32          `json:"-"`
+	ProviderPeers []Message_Peer `protobuf:"bytes,9,rep,name=providerPeers,proto3" json:"providerPeers"`
+	// Compression applied to the value of the record
+	// PUT_VALUE, GET_VALUE
+	RecordCompression Message_Compression `protobuf:"varint,11,opt,name=recordCompression,proto3,enum=dht.pb.Message_Compression" json:"recordCompression,omitempty"`
+	// Compressions the sender accepts for the record values of the messages
+	// sent to it
+	// PUT_VALUE, GET_VALUE
+	AcceptedCompressions []Message_Compression `protobuf:"varint,12,rep,packed,name=acceptedCompressions,proto3,enum=dht.pb.Message_Compression" json:"acceptedCompressions,omitempty"`
+	// Set when caching a record found by a lookup, the number of seconds the
+	// receiver should keep it for
+	// PUT_VALUE, ADD_PROVIDER
+	CacheTtl int64 `protobuf:"varint,13,opt,name=cacheTtl,proto3" json:"cacheTtl,omitempty"`
+	// Set by requesters pipelining requests over a single stream, and echoed
+	// in the response. Responses to such requests may come out of order.
+	RequestId uint64 `protobuf:"varint,14,opt,name=requestId,proto3" json:"requestId,omitempty"`
+	// Additional keys to return closer peers for, answered in
+	// closerPeersByKey by the peers supporting batched requests. Other peers
+	// only answer for key.
+	// FIND_NODE
+	Keys [][]byte `protobuf:"bytes,15,rep,name=keys,proto3" json:"keys,omitempty"`
+	// Closer peers to each of the additional keys of a batched request
+	// FIND_NODE
+	CloserPeersByKey []Message_KeyPeers `protobuf:"bytes,16,rep,name=closerPeersByKey,proto3" json:"closerPeersByKey"`
+	// Set in responses to requests refused because the requester exceeded
+	// its request rate limit, the number of milliseconds it should wait
+	// before sending more requests
+	RetryAfterMs uint32 `protobuf:"varint,17,opt,name=retryAfterMs,proto3" json:"retryAfterMs,omitempty"`
+	// Bitmask of the optional features the sender supports, see
+	// Capabilities. Set on the first requests to a peer, and in the responses
+	// to requests carrying it.
+	Capabilities uint64 `protobuf:"varint,18,opt,name=capabilities,proto3" json:"capabilities,omitempty"`
+	// Signature of the responder over the routing information of a
+	// FIND_NODE or GET_PROVIDERS response, see SignResponse
+	ResponseSignature []byte `protobuf:"bytes,19,opt,name=responseSignature,proto3" json:"responseSignature,omitempty"`
+	// Set in responses when more providers remain than the page returned,
+	// to requesters announcing CapPaginatedProviders, and in the next
+	// request to resume after that page
+	// GET_PROVIDERS
+	ProvidersPageToken []byte `protobuf:"bytes,20,opt,name=providersPageToken,proto3" json:"providersPageToken,omitempty"`
+	// Set in all but the last frame of a response streamed in several
+	// frames, to requesters announcing CapStreamedProviders
+	// GET_PROVIDERS
+	MoreFrames bool `protobuf:"varint,21,opt,name=moreFrames,proto3" json:"moreFrames,omitempty"`
+	// Set by requesters on a deadline, the number of milliseconds they are
+	// willing to wait for the response, so that responders can skip the
+	// work that wouldn't complete in time and answer with what they have
+	DeadlineMs uint32 `protobuf:"varint,22,opt,name=deadlineMs,proto3" json:"deadlineMs,omitempty"`
+	// Set by requesters wanting a number of closer peers other than the
+	// responder's bucket size, capped by the responder at MaxCloserPeers
+	// FIND_NODE, GET_VALUE, GET_PROVIDERS
+	CloserPeersCount uint32 `protobuf:"varint,23,opt,name=closerPeersCount,proto3" json:"closerPeersCount,omitempty"`
+	// Set by requesters retrying mutating requests, the same in all the
+	// attempts, so that responders apply their effects once
+	// PUT_VALUE, ADD_PROVIDER
+	IdempotencyToken []byte `protobuf:"bytes,24,opt,name=idempotencyToken,proto3" json:"idempotencyToken,omitempty"`
+	// Set by responders, to requesters announcing CapObservedAddrs, the
+	// address they observe the requester at
+	ObservedAddr         []byte   `protobuf:"bytes,25,opt,name=observedAddr,proto3" json:"observedAddr,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
 }
 
 func (m *Message) Reset()         { *m = Message{} }
@@ -195,16 +285,134 @@ func (m *Message) GetProviderPeers() []Message_Peer {
 	return nil
 }
 
+func (m *Message) GetRecordCompression() Message_Compression {
+	if m != nil {
+		return m.RecordCompression
+	}
+	return Message_NONE
+}
+
+func (m *Message) GetAcceptedCompressions() []Message_Compression {
+	if m != nil {
+		return m.AcceptedCompressions
+	}
+	return nil
+}
+
+func (m *Message) GetCacheTtl() int64 {
+	if m != nil {
+		return m.CacheTtl
+	}
+	return 0
+}
+
+func (m *Message) GetRequestId() uint64 {
+	if m != nil {
+		return m.RequestId
+	}
+	return 0
+}
+
+func (m *Message) GetKeys() [][]byte {
+	if m != nil {
+		return m.Keys
+	}
+	return nil
+}
+
+func (m *Message) GetCloserPeersByKey() []Message_KeyPeers {
+	if m != nil {
+		return m.CloserPeersByKey
+	}
+	return nil
+}
+
+func (m *Message) GetRetryAfterMs() uint32 {
+	if m != nil {
+		return m.RetryAfterMs
+	}
+	return 0
+}
+
+func (m *Message) GetCapabilities() uint64 {
+	if m != nil {
+		return m.Capabilities
+	}
+	return 0
+}
+
+func (m *Message) GetResponseSignature() []byte {
+	if m != nil {
+		return m.ResponseSignature
+	}
+	return nil
+}
+
+func (m *Message) GetProvidersPageToken() []byte {
+	if m != nil {
+		return m.ProvidersPageToken
+	}
+	return nil
+}
+
+func (m *Message) GetMoreFrames() bool {
+	if m != nil {
+		return m.MoreFrames
+	}
+	return false
+}
+
+func (m *Message) GetDeadlineMs() uint32 {
+	if m != nil {
+		return m.DeadlineMs
+	}
+	return 0
+}
+
+func (m *Message) GetCloserPeersCount() uint32 {
+	if m != nil {
+		return m.CloserPeersCount
+	}
+	return 0
+}
+
+func (m *Message) GetIdempotencyToken() []byte {
+	if m != nil {
+		return m.IdempotencyToken
+	}
+	return nil
+}
+
+func (m *Message) GetObservedAddr() []byte {
+	if m != nil {
+		return m.ObservedAddr
+	}
+	return nil
+}
+
 type Message_Peer struct {
 	// ID of a given peer.
 	Id byteString `protobuf:"bytes,1,opt,name=id,proto3,customtype=byteString" json:"id"`
 	// multiaddrs for a given peer
 	Addrs [][]byte `protobuf:"bytes,2,rep,name=addrs,proto3" json:"addrs,omitempty"`
 	// used to signal the sender's connection capabilities to the peer
-	Connection           Message_ConnectionType `protobuf:"varint,3,opt,name=connection,proto3,enum=dht.pb.Message_ConnectionType" json:"connection,omitempty"`
-	XXX_NoUnkeyedLiteral struct{}               `json:"-"`
-	XXX_unrecognized     []byte                 `json:"-"`
-	XXX_sizecache        int32                  `json:"-"`
+	Connection Message_ConnectionType `protobuf:"varint,3,opt,name=connection,proto3,enum=dht.pb.Message_ConnectionType" json:"connection,omitempty"`
+	// time in seconds since the responder last received the provider
+	// record, GET_PROVIDERS responses only
+	RecordAge uint64 `protobuf:"varint,4,opt,name=recordAge,proto3" json:"recordAge,omitempty"`
+	// announcement time in unix nanoseconds signed by the provider and
+	// the signature over it, ADD_PROVIDER and GET_PROVIDERS only
+	SignedAt  int64  `protobuf:"varint,5,opt,name=signedAt,proto3" json:"signedAt,omitempty"`
+	Signature []byte `protobuf:"bytes,6,opt,name=signature,proto3" json:"signature,omitempty"`
+	// retrieval protocols the provider speaks, e.g. bitswap or http,
+	// ADD_PROVIDER and GET_PROVIDERS only
+	TransferProtocols []string `protobuf:"bytes,7,rep,name=transferProtocols,proto3" json:"transferProtocols,omitempty"`
+	// validity in seconds the provider requests for its record, capped
+	// by the responder, ADD_PROVIDER only; zero for the default validity
+	ProviderTtl          uint32   `protobuf:"varint,8,opt,name=providerTtl,proto3" json:"providerTtl,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
 }
 
 func (m *Message_Peer) Reset()         { *m = Message_Peer{} }
@@ -254,47 +462,238 @@ func (m *Message_Peer) GetConnection() Message_ConnectionType {
 	return Message_NOT_CONNECTED
 }
 
+func (m *Message_Peer) GetRecordAge() uint64 {
+	if m != nil {
+		return m.RecordAge
+	}
+	return 0
+}
+
+func (m *Message_Peer) GetSignedAt() int64 {
+	if m != nil {
+		return m.SignedAt
+	}
+	return 0
+}
+
+func (m *Message_Peer) GetSignature() []byte {
+	if m != nil {
+		return m.Signature
+	}
+	return nil
+}
+
+func (m *Message_Peer) GetTransferProtocols() []string {
+	if m != nil {
+		return m.TransferProtocols
+	}
+	return nil
+}
+
+func (m *Message_Peer) GetProviderTtl() uint32 {
+	if m != nil {
+		return m.ProviderTtl
+	}
+	return 0
+}
+
+type Message_KeyPeers struct {
+	// one of the keys of a batched request
+	Key []byte `protobuf:"bytes,1,opt,name=key,proto3" json:"key,omitempty"`
+	// peers closer to the key
+	CloserPeers          []Message_Peer `protobuf:"bytes,2,rep,name=closerPeers,proto3" json:"closerPeers"`
+	XXX_NoUnkeyedLiteral struct{}       `json:"-"`
+	XXX_unrecognized     []byte         `json:"-"`
+	XXX_sizecache        int32          `json:"-"`
+}
+
+func (m *Message_KeyPeers) Reset()         { *m = Message_KeyPeers{} }
+func (m *Message_KeyPeers) String() string { return proto.CompactTextString(m) }
+func (*Message_KeyPeers) ProtoMessage()    {}
+func (*Message_KeyPeers) Descriptor() ([]byte, []int) {
+	return fileDescriptor_616a434b24c97ff4, []int{0, 1}
+}
+func (m *Message_KeyPeers) XXX_Unmarshal(b []byte) error {
+	return m.Unmarshal(b)
+}
+func (m *Message_KeyPeers) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	if deterministic {
+		return xxx_messageInfo_Message_KeyPeers.Marshal(b, m, deterministic)
+	} else {
+		b = b[:cap(b)]
+		n, err := m.MarshalToSizedBuffer(b)
+		if err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	}
+}
+func (m *Message_KeyPeers) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_Message_KeyPeers.Merge(m, src)
+}
+func (m *Message_KeyPeers) XXX_Size() int {
+	return m.Size()
+}
+func (m *Message_KeyPeers) XXX_DiscardUnknown() {
+	xxx_messageInfo_Message_KeyPeers.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_Message_KeyPeers proto.InternalMessageInfo
+
+func (m *Message_KeyPeers) GetKey() []byte {
+	if m != nil {
+		return m.Key
+	}
+	return nil
+}
+
+func (m *Message_KeyPeers) GetCloserPeers() []Message_Peer {
+	if m != nil {
+		return m.CloserPeers
+	}
+	return nil
+}
+
+// VersionedValue wraps a value record with a sequence number and an expiry so
+// that divergent copies of the same key can be ordered by version.
+type VersionedValue struct {
+	// the wrapped value
+	Value []byte `protobuf:"bytes,1,opt,name=value,proto3" json:"value,omitempty"`
+	// monotonically increasing version of the value
+	Seq uint64 `protobuf:"varint,2,opt,name=seq,proto3" json:"seq,omitempty"`
+	// unix time in nanoseconds after which the value is no longer valid,
+	// zero means the value does not expire
+	Validity             int64    `protobuf:"varint,3,opt,name=validity,proto3" json:"validity,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *VersionedValue) Reset()         { *m = VersionedValue{} }
+func (m *VersionedValue) String() string { return proto.CompactTextString(m) }
+func (*VersionedValue) ProtoMessage()    {}
+func (*VersionedValue) Descriptor() ([]byte, []int) {
+	return fileDescriptor_616a434b24c97ff4, []int{1}
+}
+func (m *VersionedValue) XXX_Unmarshal(b []byte) error {
+	return m.Unmarshal(b)
+}
+func (m *VersionedValue) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	if deterministic {
+		return xxx_messageInfo_VersionedValue.Marshal(b, m, deterministic)
+	} else {
+		b = b[:cap(b)]
+		n, err := m.MarshalToSizedBuffer(b)
+		if err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	}
+}
+func (m *VersionedValue) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_VersionedValue.Merge(m, src)
+}
+func (m *VersionedValue) XXX_Size() int {
+	return m.Size()
+}
+func (m *VersionedValue) XXX_DiscardUnknown() {
+	xxx_messageInfo_VersionedValue.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_VersionedValue proto.InternalMessageInfo
+
+func (m *VersionedValue) GetValue() []byte {
+	if m != nil {
+		return m.Value
+	}
+	return nil
+}
+
+func (m *VersionedValue) GetSeq() uint64 {
+	if m != nil {
+		return m.Seq
+	}
+	return 0
+}
+
+func (m *VersionedValue) GetValidity() int64 {
+	if m != nil {
+		return m.Validity
+	}
+	return 0
+}
+
 func init() {
 	proto.RegisterEnum("dht.pb.Message_MessageType", Message_MessageType_name, Message_MessageType_value)
 	proto.RegisterEnum("dht.pb.Message_ConnectionType", Message_ConnectionType_name, Message_ConnectionType_value)
+	proto.RegisterEnum("dht.pb.Message_Compression", Message_Compression_name, Message_Compression_value)
 	proto.RegisterType((*Message)(nil), "dht.pb.Message")
 	proto.RegisterType((*Message_Peer)(nil), "dht.pb.Message.Peer")
+	proto.RegisterType((*Message_KeyPeers)(nil), "dht.pb.Message.KeyPeers")
+	proto.RegisterType((*VersionedValue)(nil), "dht.pb.VersionedValue")
 }
 
 func init() { proto.RegisterFile("dht.proto", fileDescriptor_616a434b24c97ff4) }
 
 var fileDescriptor_616a434b24c97ff4 = []byte{
-	// 469 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x84, 0x92, 0xb1, 0x6f, 0x9b, 0x40,
-	0x18, 0xc5, 0x73, 0x80, 0xdd, 0xf8, 0x03, 0x3b, 0xe4, 0x94, 0x01, 0xb9, 0x92, 0x83, 0x3c, 0xd1,
-	0xc1, 0x20, 0xd1, 0xb5, 0xaa, 0x6a, 0x03, 0x8d, 0x2c, 0xa5, 0xd8, 0xba, 0x38, 0xe9, 0x68, 0x19,
-	0xb8, 0x12, 0x54, 0xd7, 0x87, 0x00, 0xa7, 0xf2, 0xd6, 0x3f, 0x2f, 0x63, 0xe7, 0x0e, 0x51, 0xe5,
-	0xa9, 0x7f, 0x46, 0xc5, 0x11, 0x5a, 0xec, 0x25, 0x13, 0xef, 0x7d, 0xf7, 0x7e, 0xe2, 0xdd, 0xa7,
-	0x83, 0x4e, 0x74, 0x5f, 0x98, 0x69, 0xc6, 0x0a, 0x86, 0xdb, 0x5c, 0x06, 0x7d, 0x3b, 0x4e, 0x8a,
-	0xfb, 0x6d, 0x60, 0x86, 0xec, 0x9b, 0xb5, 0x4e, 0x82, 0xd4, 0x4e, 0xad, 0x98, 0x8d, 0x2a, 0x35,
-	0xca, 0x68, 0xc8, 0xb2, 0xc8, 0x4a, 0x03, 0xab, 0x52, 0x15, 0xdb, 0x1f, 0x35, 0x98, 0x98, 0xc5,
-	0xcc, 0xe2, 0xe3, 0x60, 0xfb, 0x85, 0x3b, 0x6e, 0xb8, 0xaa, 0xe2, 0xc3, 0x3f, 0x12, 0xbc, 0xfa,
-	0x44, 0xf3, 0x7c, 0x15, 0x53, 0x6c, 0x81, 0x54, 0xec, 0x52, 0xaa, 0x21, 0x1d, 0x19, 0x3d, 0xfb,
-	0xb5, 0x59, 0xb5, 0x30, 0x9f, 0x8f, 0xeb, 0xef, 0x62, 0x97, 0x52, 0xc2, 0x83, 0xd8, 0x80, 0xb3,
-	0x70, 0xbd, 0xcd, 0x0b, 0x9a, 0x5d, 0xd3, 0x07, 0xba, 0x26, 0xab, 0xef, 0x1a, 0xe8, 0xc8, 0x68,
-	0x91, 0xe3, 0x31, 0x56, 0x41, 0xfc, 0x4a, 0x77, 0x9a, 0xa0, 0x23, 0x43, 0x21, 0xa5, 0xc4, 0x6f,
-	0xa0, 0x5d, 0xf5, 0xd6, 0x44, 0x1d, 0x19, 0xb2, 0x7d, 0x6e, 0xd6, 0xd7, 0x08, 0x4c, 0xc2, 0x15,
-	0x79, 0x0e, 0xe0, 0x77, 0x20, 0x87, 0x6b, 0x96, 0xd3, 0x6c, 0x4e, 0x69, 0x96, 0x6b, 0xa7, 0xba,
-	0x68, 0xc8, 0xf6, 0xc5, 0x71, 0xbd, 0xf2, 0x70, 0x22, 0x3d, 0x3e, 0x5d, 0x9e, 0x90, 0x66, 0x1c,
-	0x7f, 0x80, 0x6e, 0x9a, 0xb1, 0x87, 0x24, 0xaa, 0xf9, 0xce, 0x8b, 0xfc, 0x21, 0xd0, 0xff, 0x81,
-	0x40, 0x2a, 0x15, 0x1e, 0x82, 0x90, 0x44, 0x7c, 0x3d, 0xca, 0x04, 0x97, 0xc9, 0x5f, 0x4f, 0x97,
-	0x10, 0xec, 0x0a, 0x7a, 0x53, 0x64, 0xc9, 0x26, 0x26, 0x42, 0x12, 0xe1, 0x0b, 0x68, 0xad, 0xa2,
-	0x28, 0xcb, 0x35, 0x41, 0x17, 0x0d, 0x85, 0x54, 0x06, 0xbf, 0x07, 0x08, 0xd9, 0x66, 0x43, 0xc3,
-	0x22, 0x61, 0x1b, 0x7e, 0xe3, 0x9e, 0x3d, 0x38, 0x6e, 0xe0, 0xfc, 0x4b, 0xf0, 0x1d, 0x37, 0x88,
-	0x61, 0x02, 0x72, 0x63, 0xfd, 0xb8, 0x0b, 0x9d, 0xf9, 0xed, 0x62, 0x79, 0x37, 0xbe, 0xbe, 0xf5,
-	0xd4, 0x93, 0xd2, 0x5e, 0x79, 0xb5, 0x45, 0x58, 0x05, 0x65, 0xec, 0xba, 0xcb, 0x39, 0x99, 0xdd,
-	0x4d, 0x5d, 0x8f, 0xa8, 0x02, 0x3e, 0x87, 0x6e, 0x19, 0xa8, 0x27, 0x37, 0xaa, 0x58, 0x32, 0x1f,
-	0xa7, 0xbe, 0xbb, 0xf4, 0x67, 0xae, 0xa7, 0x4a, 0xf8, 0x14, 0xa4, 0xf9, 0xd4, 0xbf, 0x52, 0x5b,
-	0xc3, 0xcf, 0xd0, 0x3b, 0x2c, 0x52, 0xd2, 0xfe, 0x6c, 0xb1, 0x74, 0x66, 0xbe, 0xef, 0x39, 0x0b,
-	0xcf, 0xad, 0xfe, 0xf8, 0xdf, 0x22, 0x7c, 0x06, 0xb2, 0x33, 0xf6, 0xeb, 0x84, 0x2a, 0x60, 0x0c,
-	0x3d, 0x67, 0xec, 0x37, 0x28, 0x55, 0x9c, 0x28, 0x8f, 0xfb, 0x01, 0xfa, 0xb9, 0x1f, 0xa0, 0xdf,
-	0xfb, 0x01, 0x0a, 0xda, 0xfc, 0xfd, 0xbd, 0xfd, 0x1b, 0x00, 0x00, 0xff, 0xff, 0x8d, 0x1a, 0xa1,
-	0xbe, 0xf7, 0x02, 0x00, 0x00,
+	// 909 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x94, 0x55, 0x4d, 0x6f, 0xdb, 0x46,
+	0x10, 0x0d, 0x45, 0x5a, 0x91, 0x47, 0xb2, 0x4d, 0x6f, 0xdc, 0x76, 0xeb, 0x16, 0x0e, 0xa1, 0x13,
+	0x5b, 0xd4, 0x12, 0xe0, 0x5e, 0x8b, 0xa2, 0xb2, 0xa4, 0x04, 0x6e, 0x62, 0x4a, 0x58, 0x2b, 0x2e,
+	0x9a, 0x8b, 0xc1, 0x8f, 0x89, 0x4c, 0x98, 0x26, 0x99, 0xdd, 0x95, 0x0b, 0x5e, 0xfa, 0x7b, 0xfa,
+	0x53, 0x7c, 0xec, 0xb9, 0x87, 0xa0, 0xf0, 0x2f, 0x29, 0x76, 0x69, 0x5a, 0x94, 0x65, 0x20, 0xe8,
+	0x49, 0x33, 0x6f, 0xdf, 0x5b, 0xcc, 0xce, 0x3c, 0x8e, 0x60, 0x33, 0xba, 0x94, 0xbd, 0x9c, 0x67,
+	0x32, 0x23, 0x4d, 0x1d, 0x06, 0xfb, 0x47, 0xf3, 0x58, 0x5e, 0x2e, 0x82, 0x5e, 0x98, 0x5d, 0xf7,
+	0x93, 0x38, 0xc8, 0x8f, 0xf2, 0xfe, 0x3c, 0x3b, 0x2c, 0xa3, 0x43, 0x8e, 0x61, 0xc6, 0xa3, 0x7e,
+	0x1e, 0xf4, 0xcb, 0xa8, 0xd4, 0xee, 0x1f, 0xd6, 0x34, 0xf3, 0x6c, 0x9e, 0xf5, 0x35, 0x1c, 0x2c,
+	0x3e, 0xe8, 0x4c, 0x27, 0x3a, 0x2a, 0xe9, 0xdd, 0xdb, 0x0e, 0x3c, 0x3f, 0x45, 0x21, 0xfc, 0x39,
+	0x92, 0x3e, 0x58, 0xb2, 0xc8, 0x91, 0x1a, 0x8e, 0xe1, 0x6e, 0x1f, 0x7d, 0xd3, 0x2b, 0xab, 0xe8,
+	0xdd, 0x1f, 0x57, 0xbf, 0xb3, 0x22, 0x47, 0xa6, 0x89, 0xc4, 0x85, 0x9d, 0x30, 0x59, 0x08, 0x89,
+	0xfc, 0x2d, 0xde, 0x60, 0xc2, 0xfc, 0x3f, 0x28, 0x38, 0x86, 0xbb, 0xc1, 0x1e, 0xc3, 0xc4, 0x06,
+	0xf3, 0x0a, 0x0b, 0xda, 0x70, 0x0c, 0xb7, 0xc3, 0x54, 0x48, 0xbe, 0x83, 0x66, 0x59, 0x37, 0x35,
+	0x1d, 0xc3, 0x6d, 0x1f, 0xed, 0xf6, 0xaa, 0x67, 0x04, 0x3d, 0xa6, 0x23, 0x76, 0x4f, 0x20, 0x3f,
+	0x41, 0x3b, 0x4c, 0x32, 0x81, 0x7c, 0x8a, 0xc8, 0x05, 0x6d, 0x39, 0xa6, 0xdb, 0x3e, 0xda, 0x7b,
+	0x5c, 0x9e, 0x3a, 0x3c, 0xb6, 0x6e, 0x3f, 0xbd, 0x7c, 0xc6, 0xea, 0x74, 0xf2, 0x0b, 0x6c, 0xe5,
+	0x3c, 0xbb, 0x89, 0xa3, 0x4a, 0xbf, 0xf9, 0x59, 0xfd, 0xaa, 0x80, 0x9c, 0xc0, 0x6e, 0x59, 0xc9,
+	0x30, 0xbb, 0xce, 0x39, 0x0a, 0x11, 0x67, 0x29, 0x6d, 0x3f, 0xdd, 0xa4, 0x1a, 0x85, 0xad, 0xab,
+	0xc8, 0x04, 0xf6, 0xfc, 0x30, 0xc4, 0x5c, 0x62, 0x1d, 0x16, 0xb4, 0xe3, 0x98, 0x9f, 0xbb, 0xed,
+	0x49, 0x21, 0xd9, 0x87, 0x56, 0xe8, 0x87, 0x97, 0x38, 0x93, 0x09, 0xdd, 0x72, 0x0c, 0xd7, 0x64,
+	0x0f, 0x39, 0xf9, 0x16, 0x36, 0x39, 0x7e, 0x5c, 0xa0, 0x90, 0x27, 0x11, 0xdd, 0x76, 0x0c, 0xd7,
+	0x62, 0x4b, 0x80, 0x10, 0xb0, 0xae, 0xb0, 0x10, 0x74, 0xc7, 0x31, 0xdd, 0x0e, 0xd3, 0x31, 0xf9,
+	0x15, 0xec, 0x5a, 0xeb, 0x8e, 0x8b, 0x37, 0x58, 0x50, 0x5b, 0xb7, 0x8b, 0x3e, 0x2e, 0xed, 0x0d,
+	0x16, 0x25, 0xa9, 0x6c, 0xd9, 0x9a, 0x8e, 0x74, 0xa1, 0xc3, 0x51, 0xf2, 0x62, 0xf0, 0x41, 0x22,
+	0x3f, 0x15, 0x74, 0xd7, 0x31, 0xdc, 0x2d, 0xb6, 0x82, 0x29, 0x4e, 0xe8, 0xe7, 0x7e, 0x10, 0x27,
+	0xb1, 0x8c, 0x51, 0x50, 0xa2, 0x8b, 0x5c, 0xc1, 0xc8, 0x0f, 0xaa, 0xfb, 0x22, 0xcf, 0x52, 0x81,
+	0x67, 0xf1, 0x3c, 0xf5, 0xe5, 0x82, 0x23, 0x7d, 0xa1, 0x8d, 0xb4, 0x7e, 0x40, 0x7a, 0x40, 0xaa,
+	0xe1, 0x89, 0xa9, 0x72, 0x6b, 0x76, 0x85, 0x29, 0xdd, 0xd3, 0xf4, 0x27, 0x4e, 0xc8, 0x01, 0xc0,
+	0x75, 0xc6, 0xf1, 0x15, 0xf7, 0xaf, 0x51, 0xd0, 0x2f, 0x1c, 0xc3, 0x6d, 0xb1, 0x1a, 0xa2, 0xce,
+	0x23, 0xf4, 0xa3, 0x24, 0x4e, 0xf1, 0x54, 0xd0, 0x2f, 0xf5, 0x1b, 0x6a, 0x08, 0xf9, 0x7e, 0xa5,
+	0x63, 0xc3, 0x6c, 0x91, 0x4a, 0xfa, 0x95, 0x66, 0xad, 0xe1, 0x8a, 0x1b, 0x47, 0x78, 0x9d, 0x67,
+	0x12, 0xd3, 0xb0, 0x28, 0x2b, 0xa3, 0xba, 0xb2, 0x35, 0x5c, 0x75, 0x26, 0x0b, 0x04, 0xf2, 0x1b,
+	0x8c, 0x06, 0x51, 0xc4, 0xe9, 0xd7, 0x9a, 0xb7, 0x82, 0xed, 0xff, 0xd5, 0x00, 0x4b, 0x5d, 0x4f,
+	0xba, 0xd0, 0x88, 0x23, 0xfd, 0xd9, 0x76, 0x8e, 0x89, 0x1a, 0xc7, 0x3f, 0x9f, 0x5e, 0x42, 0x50,
+	0x48, 0x3c, 0x93, 0x3c, 0x4e, 0xe7, 0xac, 0x11, 0x47, 0x64, 0x0f, 0x36, 0xfc, 0x28, 0xe2, 0x82,
+	0x36, 0xf4, 0xbc, 0xcb, 0x84, 0xfc, 0x0c, 0x10, 0x66, 0x69, 0x8a, 0xa1, 0x54, 0x9e, 0x36, 0xb5,
+	0xa7, 0x0f, 0xd6, 0x5d, 0x58, 0x31, 0xf4, 0xb7, 0x5f, 0x53, 0x94, 0x16, 0x53, 0x26, 0x1f, 0xcc,
+	0x91, 0x5a, 0x95, 0xc5, 0xee, 0x01, 0x65, 0x4e, 0x11, 0xcf, 0x53, 0x8c, 0x06, 0x92, 0x6e, 0x94,
+	0xe6, 0xac, 0x72, 0xa5, 0x14, 0x0f, 0xe3, 0x6c, 0xea, 0xd7, 0x2d, 0x01, 0x35, 0x74, 0xc9, 0xfd,
+	0x54, 0x7c, 0x40, 0x3e, 0x55, 0x7b, 0x2a, 0xcc, 0x12, 0x41, 0x9f, 0x3b, 0xa6, 0xbb, 0xc9, 0xd6,
+	0x0f, 0x88, 0x03, 0xed, 0x6a, 0xb4, 0xea, 0x3b, 0x68, 0xe9, 0xfe, 0xd7, 0xa1, 0xfd, 0xf7, 0xd0,
+	0xaa, 0x0c, 0x5b, 0xed, 0x22, 0x63, 0xb9, 0x8b, 0x1e, 0x2d, 0x98, 0xc6, 0xff, 0x5a, 0x30, 0xdd,
+	0x3f, 0xa1, 0x5d, 0x5b, 0x8d, 0x64, 0x0b, 0x36, 0xa7, 0xef, 0x66, 0x17, 0xe7, 0x83, 0xb7, 0xef,
+	0xc6, 0xf6, 0x33, 0x95, 0xbe, 0x1e, 0x57, 0xa9, 0x41, 0x6c, 0xe8, 0x0c, 0x46, 0xa3, 0x8b, 0x29,
+	0x9b, 0x9c, 0x9f, 0x8c, 0xc6, 0xcc, 0x6e, 0x90, 0x5d, 0xd8, 0x52, 0x84, 0x0a, 0x39, 0xb3, 0x4d,
+	0xa5, 0x79, 0x75, 0xe2, 0x8d, 0x2e, 0xbc, 0xc9, 0x68, 0x6c, 0x5b, 0xa4, 0x05, 0xd6, 0xf4, 0xc4,
+	0x7b, 0x6d, 0x6f, 0x90, 0x17, 0xb0, 0xc3, 0xc6, 0xa7, 0x93, 0xf3, 0xf1, 0xf2, 0x82, 0x66, 0xf7,
+	0x37, 0xd8, 0x5e, 0x9d, 0x90, 0xba, 0xd2, 0x9b, 0xcc, 0x2e, 0x86, 0x13, 0xcf, 0x1b, 0x0f, 0x67,
+	0xe3, 0x51, 0x59, 0xc6, 0x32, 0x35, 0xc8, 0x0e, 0xb4, 0x87, 0x03, 0xaf, 0x62, 0xd8, 0x0d, 0x42,
+	0x60, 0x7b, 0x38, 0xf0, 0x6a, 0x2a, 0xdb, 0xec, 0x1e, 0x42, 0xbb, 0xbe, 0xbb, 0x5a, 0x60, 0x79,
+	0x13, 0x4f, 0xbd, 0xa9, 0x05, 0xd6, 0xfb, 0xb3, 0x99, 0xba, 0x07, 0xa0, 0x79, 0xe6, 0x0d, 0xa6,
+	0xd3, 0xdf, 0xed, 0x46, 0x77, 0x06, 0xdb, 0xe7, 0xc8, 0x15, 0x15, 0xa3, 0x73, 0x3f, 0x59, 0xa0,
+	0xf2, 0xdc, 0x8d, 0x0a, 0xee, 0x7b, 0x5d, 0x26, 0xaa, 0xff, 0x02, 0x3f, 0xea, 0xff, 0x02, 0x8b,
+	0xa9, 0x50, 0xf9, 0xe4, 0xc6, 0x4f, 0xe2, 0x28, 0x96, 0x85, 0xf6, 0xa0, 0xc9, 0x1e, 0xf2, 0xe3,
+	0xce, 0xed, 0xdd, 0x81, 0xf1, 0xf7, 0xdd, 0x81, 0xf1, 0xef, 0xdd, 0x81, 0x11, 0x34, 0xf5, 0xbf,
+	0xd6, 0x8f, 0xff, 0x0d, 0x00, 0x56, 0xb3, 0x3f, 0xd6, 0x2d, 0x07, 0x00, 0x00,
 }
 
 func (m *Message) Marshal() (dAtA []byte, err error) {
@@ -321,6 +720,140 @@ func (m *Message) MarshalToSizedBuffer(dAtA []byte) (int, error) {
 		i -= len(m.XXX_unrecognized)
 		copy(dAtA[i:], m.XXX_unrecognized)
 	}
+	if len(m.ObservedAddr) > 0 {
+		i -= len(m.ObservedAddr)
+		copy(dAtA[i:], m.ObservedAddr)
+		i = encodeVarintDht(dAtA, i, uint64(len(m.ObservedAddr)))
+		i--
+		dAtA[i] = 0x1
+		i--
+		dAtA[i] = 0xca
+	}
+	if len(m.IdempotencyToken) > 0 {
+		i -= len(m.IdempotencyToken)
+		copy(dAtA[i:], m.IdempotencyToken)
+		i = encodeVarintDht(dAtA, i, uint64(len(m.IdempotencyToken)))
+		i--
+		dAtA[i] = 0x1
+		i--
+		dAtA[i] = 0xc2
+	}
+	if m.CloserPeersCount != 0 {
+		i = encodeVarintDht(dAtA, i, uint64(m.CloserPeersCount))
+		i--
+		dAtA[i] = 0x1
+		i--
+		dAtA[i] = 0xb8
+	}
+	if m.DeadlineMs != 0 {
+		i = encodeVarintDht(dAtA, i, uint64(m.DeadlineMs))
+		i--
+		dAtA[i] = 0x1
+		i--
+		dAtA[i] = 0xb0
+	}
+	if m.MoreFrames {
+		i--
+		if m.MoreFrames {
+			dAtA[i] = 1
+		} else {
+			dAtA[i] = 0
+		}
+		i--
+		dAtA[i] = 0x1
+		i--
+		dAtA[i] = 0xa8
+	}
+	if len(m.ProvidersPageToken) > 0 {
+		i -= len(m.ProvidersPageToken)
+		copy(dAtA[i:], m.ProvidersPageToken)
+		i = encodeVarintDht(dAtA, i, uint64(len(m.ProvidersPageToken)))
+		i--
+		dAtA[i] = 0x1
+		i--
+		dAtA[i] = 0xa2
+	}
+	if len(m.ResponseSignature) > 0 {
+		i -= len(m.ResponseSignature)
+		copy(dAtA[i:], m.ResponseSignature)
+		i = encodeVarintDht(dAtA, i, uint64(len(m.ResponseSignature)))
+		i--
+		dAtA[i] = 0x1
+		i--
+		dAtA[i] = 0x9a
+	}
+	if m.Capabilities != 0 {
+		i = encodeVarintDht(dAtA, i, uint64(m.Capabilities))
+		i--
+		dAtA[i] = 0x1
+		i--
+		dAtA[i] = 0x90
+	}
+	if m.RetryAfterMs != 0 {
+		i = encodeVarintDht(dAtA, i, uint64(m.RetryAfterMs))
+		i--
+		dAtA[i] = 0x1
+		i--
+		dAtA[i] = 0x88
+	}
+	if len(m.CloserPeersByKey) > 0 {
+		for iNdEx := len(m.CloserPeersByKey) - 1; iNdEx >= 0; iNdEx-- {
+			{
+				size, err := m.CloserPeersByKey[iNdEx].MarshalToSizedBuffer(dAtA[:i])
+				if err != nil {
+					return 0, err
+				}
+				i -= size
+				i = encodeVarintDht(dAtA, i, uint64(size))
+			}
+			i--
+			dAtA[i] = 0x1
+			i--
+			dAtA[i] = 0x82
+		}
+	}
+	if len(m.Keys) > 0 {
+		for iNdEx := len(m.Keys) - 1; iNdEx >= 0; iNdEx-- {
+			i -= len(m.Keys[iNdEx])
+			copy(dAtA[i:], m.Keys[iNdEx])
+			i = encodeVarintDht(dAtA, i, uint64(len(m.Keys[iNdEx])))
+			i--
+			dAtA[i] = 0x7a
+		}
+	}
+	if m.RequestId != 0 {
+		i = encodeVarintDht(dAtA, i, uint64(m.RequestId))
+		i--
+		dAtA[i] = 0x70
+	}
+	if m.CacheTtl != 0 {
+		i = encodeVarintDht(dAtA, i, uint64(m.CacheTtl))
+		i--
+		dAtA[i] = 0x68
+	}
+	if len(m.AcceptedCompressions) > 0 {
+		dAtA2 := make([]byte, len(m.AcceptedCompressions)*10)
+		var j1 int
+		for _, num := range m.AcceptedCompressions {
+			for num >= 1<<7 {
+				dAtA2[j1] = uint8(uint64(num)&0x7f | 0x80)
+				num >>= 7
+				j1++
+			}
+			dAtA2[j1] = uint8(num)
+			j1++
+		}
+		i -= j1
+		copy(dAtA[i:], dAtA2[:j1])
+		i = encodeVarintDht(dAtA, i, uint64(j1))
+		i--
+		dAtA[i] = 0x62
+	}
+	if m.RecordCompression != 0 {
+		i = encodeVarintDht(dAtA, i, uint64(m.RecordCompression))
+		i--
+		dAtA[i] = 0x58
+	}
 	if m.ClusterLevelRaw != 0 {
 		i = encodeVarintDht(dAtA, i, uint64(m.ClusterLevelRaw))
 		i--
@@ -405,6 +938,37 @@ func (m *Message_Peer) MarshalToSizedBuffer(dAtA []byte) (int, error) {
 		i -= len(m.XXX_unrecognized)
 		copy(dAtA[i:], m.XXX_unrecognized)
 	}
+	if m.ProviderTtl != 0 {
+		i = encodeVarintDht(dAtA, i, uint64(m.ProviderTtl))
+		i--
+		dAtA[i] = 0x40
+	}
+	if len(m.TransferProtocols) > 0 {
+		for iNdEx := len(m.TransferProtocols) - 1; iNdEx >= 0; iNdEx-- {
+			i -= len(m.TransferProtocols[iNdEx])
+			copy(dAtA[i:], m.TransferProtocols[iNdEx])
+			i = encodeVarintDht(dAtA, i, uint64(len(m.TransferProtocols[iNdEx])))
+			i--
+			dAtA[i] = 0x3a
+		}
+	}
+	if len(m.Signature) > 0 {
+		i -= len(m.Signature)
+		copy(dAtA[i:], m.Signature)
+		i = encodeVarintDht(dAtA, i, uint64(len(m.Signature)))
+		i--
+		dAtA[i] = 0x32
+	}
+	if m.SignedAt != 0 {
+		i = encodeVarintDht(dAtA, i, uint64(m.SignedAt))
+		i--
+		dAtA[i] = 0x28
+	}
+	if m.RecordAge != 0 {
+		i = encodeVarintDht(dAtA, i, uint64(m.RecordAge))
+		i--
+		dAtA[i] = 0x20
+	}
 	if m.Connection != 0 {
 		i = encodeVarintDht(dAtA, i, uint64(m.Connection))
 		i--
@@ -432,11 +996,103 @@ func (m *Message_Peer) MarshalToSizedBuffer(dAtA []byte) (int, error) {
 	return len(dAtA) - i, nil
 }
 
-func encodeVarintDht(dAtA []byte, offset int, v uint64) int {
-	offset -= sovDht(v)
-	base := offset
-	for v >= 1<<7 {
-		dAtA[offset] = uint8(v&0x7f | 0x80)
+func (m *Message_KeyPeers) Marshal() (dAtA []byte, err error) {
+	size := m.Size()
+	dAtA = make([]byte, size)
+	n, err := m.MarshalToSizedBuffer(dAtA[:size])
+	if err != nil {
+		return nil, err
+	}
+	return dAtA[:n], nil
+}
+
+func (m *Message_KeyPeers) MarshalTo(dAtA []byte) (int, error) {
+	size := m.Size()
+	return m.MarshalToSizedBuffer(dAtA[:size])
+}
+
+func (m *Message_KeyPeers) MarshalToSizedBuffer(dAtA []byte) (int, error) {
+	i := len(dAtA)
+	_ = i
+	var l int
+	_ = l
+	if m.XXX_unrecognized != nil {
+		i -= len(m.XXX_unrecognized)
+		copy(dAtA[i:], m.XXX_unrecognized)
+	}
+	if len(m.CloserPeers) > 0 {
+		for iNdEx := len(m.CloserPeers) - 1; iNdEx >= 0; iNdEx-- {
+			{
+				size, err := m.CloserPeers[iNdEx].MarshalToSizedBuffer(dAtA[:i])
+				if err != nil {
+					return 0, err
+				}
+				i -= size
+				i = encodeVarintDht(dAtA, i, uint64(size))
+			}
+			i--
+			dAtA[i] = 0x12
+		}
+	}
+	if len(m.Key) > 0 {
+		i -= len(m.Key)
+		copy(dAtA[i:], m.Key)
+		i = encodeVarintDht(dAtA, i, uint64(len(m.Key)))
+		i--
+		dAtA[i] = 0xa
+	}
+	return len(dAtA) - i, nil
+}
+
+func (m *VersionedValue) Marshal() (dAtA []byte, err error) {
+	size := m.Size()
+	dAtA = make([]byte, size)
+	n, err := m.MarshalToSizedBuffer(dAtA[:size])
+	if err != nil {
+		return nil, err
+	}
+	return dAtA[:n], nil
+}
+
+func (m *VersionedValue) MarshalTo(dAtA []byte) (int, error) {
+	size := m.Size()
+	return m.MarshalToSizedBuffer(dAtA[:size])
+}
+
+func (m *VersionedValue) MarshalToSizedBuffer(dAtA []byte) (int, error) {
+	i := len(dAtA)
+	_ = i
+	var l int
+	_ = l
+	if m.XXX_unrecognized != nil {
+		i -= len(m.XXX_unrecognized)
+		copy(dAtA[i:], m.XXX_unrecognized)
+	}
+	if m.Validity != 0 {
+		i = encodeVarintDht(dAtA, i, uint64(m.Validity))
+		i--
+		dAtA[i] = 0x18
+	}
+	if m.Seq != 0 {
+		i = encodeVarintDht(dAtA, i, uint64(m.Seq))
+		i--
+		dAtA[i] = 0x10
+	}
+	if len(m.Value) > 0 {
+		i -= len(m.Value)
+		copy(dAtA[i:], m.Value)
+		i = encodeVarintDht(dAtA, i, uint64(len(m.Value)))
+		i--
+		dAtA[i] = 0xa
+	}
+	return len(dAtA) - i, nil
+}
+
+func encodeVarintDht(dAtA []byte, offset int, v uint64) int {
+	offset -= sovDht(v)
+	base := offset
+	for v >= 1<<7 {
+		dAtA[offset] = uint8(v&0x7f | 0x80)
 		v >>= 7
 		offset++
 	}
@@ -475,6 +1131,65 @@ func (m *Message) Size() (n int) {
 	if m.ClusterLevelRaw != 0 {
 		n += 1 + sovDht(uint64(m.ClusterLevelRaw))
 	}
+	if m.RecordCompression != 0 {
+		n += 1 + sovDht(uint64(m.RecordCompression))
+	}
+	if len(m.AcceptedCompressions) > 0 {
+		l = 0
+		for _, e := range m.AcceptedCompressions {
+			l += sovDht(uint64(e))
+		}
+		n += 1 + sovDht(uint64(l)) + l
+	}
+	if m.CacheTtl != 0 {
+		n += 1 + sovDht(uint64(m.CacheTtl))
+	}
+	if m.RequestId != 0 {
+		n += 1 + sovDht(uint64(m.RequestId))
+	}
+	if len(m.Keys) > 0 {
+		for _, b := range m.Keys {
+			l = len(b)
+			n += 1 + l + sovDht(uint64(l))
+		}
+	}
+	if len(m.CloserPeersByKey) > 0 {
+		for _, e := range m.CloserPeersByKey {
+			l = e.Size()
+			n += 2 + l + sovDht(uint64(l))
+		}
+	}
+	if m.RetryAfterMs != 0 {
+		n += 2 + sovDht(uint64(m.RetryAfterMs))
+	}
+	if m.Capabilities != 0 {
+		n += 2 + sovDht(uint64(m.Capabilities))
+	}
+	l = len(m.ResponseSignature)
+	if l > 0 {
+		n += 2 + l + sovDht(uint64(l))
+	}
+	l = len(m.ProvidersPageToken)
+	if l > 0 {
+		n += 2 + l + sovDht(uint64(l))
+	}
+	if m.MoreFrames {
+		n += 3
+	}
+	if m.DeadlineMs != 0 {
+		n += 2 + sovDht(uint64(m.DeadlineMs))
+	}
+	if m.CloserPeersCount != 0 {
+		n += 2 + sovDht(uint64(m.CloserPeersCount))
+	}
+	l = len(m.IdempotencyToken)
+	if l > 0 {
+		n += 2 + l + sovDht(uint64(l))
+	}
+	l = len(m.ObservedAddr)
+	if l > 0 {
+		n += 2 + l + sovDht(uint64(l))
+	}
 	if m.XXX_unrecognized != nil {
 		n += len(m.XXX_unrecognized)
 	}
@@ -498,6 +1213,69 @@ func (m *Message_Peer) Size() (n int) {
 	if m.Connection != 0 {
 		n += 1 + sovDht(uint64(m.Connection))
 	}
+	if m.RecordAge != 0 {
+		n += 1 + sovDht(uint64(m.RecordAge))
+	}
+	if m.SignedAt != 0 {
+		n += 1 + sovDht(uint64(m.SignedAt))
+	}
+	l = len(m.Signature)
+	if l > 0 {
+		n += 1 + l + sovDht(uint64(l))
+	}
+	if len(m.TransferProtocols) > 0 {
+		for _, s := range m.TransferProtocols {
+			l = len(s)
+			n += 1 + l + sovDht(uint64(l))
+		}
+	}
+	if m.ProviderTtl != 0 {
+		n += 1 + sovDht(uint64(m.ProviderTtl))
+	}
+	if m.XXX_unrecognized != nil {
+		n += len(m.XXX_unrecognized)
+	}
+	return n
+}
+
+func (m *Message_KeyPeers) Size() (n int) {
+	if m == nil {
+		return 0
+	}
+	var l int
+	_ = l
+	l = len(m.Key)
+	if l > 0 {
+		n += 1 + l + sovDht(uint64(l))
+	}
+	if len(m.CloserPeers) > 0 {
+		for _, e := range m.CloserPeers {
+			l = e.Size()
+			n += 1 + l + sovDht(uint64(l))
+		}
+	}
+	if m.XXX_unrecognized != nil {
+		n += len(m.XXX_unrecognized)
+	}
+	return n
+}
+
+func (m *VersionedValue) Size() (n int) {
+	if m == nil {
+		return 0
+	}
+	var l int
+	_ = l
+	l = len(m.Value)
+	if l > 0 {
+		n += 1 + l + sovDht(uint64(l))
+	}
+	if m.Seq != 0 {
+		n += 1 + sovDht(uint64(m.Seq))
+	}
+	if m.Validity != 0 {
+		n += 1 + sovDht(uint64(m.Validity))
+	}
 	if m.XXX_unrecognized != nil {
 		n += len(m.XXX_unrecognized)
 	}
@@ -715,60 +1493,135 @@ func (m *Message) Unmarshal(dAtA []byte) error {
 					break
 				}
 			}
-		default:
-			iNdEx = preIndex
-			skippy, err := skipDht(dAtA[iNdEx:])
-			if err != nil {
-				return err
+		case 11:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field RecordCompression", wireType)
 			}
-			if (skippy < 0) || (iNdEx+skippy) < 0 {
-				return ErrInvalidLengthDht
+			m.RecordCompression = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowDht
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.RecordCompression |= Message_Compression(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
 			}
-			if (iNdEx + skippy) > l {
-				return io.ErrUnexpectedEOF
+		case 12:
+			if wireType == 0 {
+				var v Message_Compression
+				for shift := uint(0); ; shift += 7 {
+					if shift >= 64 {
+						return ErrIntOverflowDht
+					}
+					if iNdEx >= l {
+						return io.ErrUnexpectedEOF
+					}
+					b := dAtA[iNdEx]
+					iNdEx++
+					v |= Message_Compression(b&0x7F) << shift
+					if b < 0x80 {
+						break
+					}
+				}
+				m.AcceptedCompressions = append(m.AcceptedCompressions, v)
+			} else if wireType == 2 {
+				var packedLen int
+				for shift := uint(0); ; shift += 7 {
+					if shift >= 64 {
+						return ErrIntOverflowDht
+					}
+					if iNdEx >= l {
+						return io.ErrUnexpectedEOF
+					}
+					b := dAtA[iNdEx]
+					iNdEx++
+					packedLen |= int(b&0x7F) << shift
+					if b < 0x80 {
+						break
+					}
+				}
+				if packedLen < 0 {
+					return ErrInvalidLengthDht
+				}
+				postIndex := iNdEx + packedLen
+				if postIndex < 0 {
+					return ErrInvalidLengthDht
+				}
+				if postIndex > l {
+					return io.ErrUnexpectedEOF
+				}
+				var elementCount int
+				if elementCount != 0 && len(m.AcceptedCompressions) == 0 {
+					m.AcceptedCompressions = make([]Message_Compression, 0, elementCount)
+				}
+				for iNdEx < postIndex {
+					var v Message_Compression
+					for shift := uint(0); ; shift += 7 {
+						if shift >= 64 {
+							return ErrIntOverflowDht
+						}
+						if iNdEx >= l {
+							return io.ErrUnexpectedEOF
+						}
+						b := dAtA[iNdEx]
+						iNdEx++
+						v |= Message_Compression(b&0x7F) << shift
+						if b < 0x80 {
+							break
+						}
+					}
+					m.AcceptedCompressions = append(m.AcceptedCompressions, v)
+				}
+			} else {
+				return fmt.Errorf("proto: wrong wireType = %d for field AcceptedCompressions", wireType)
 			}
-			m.XXX_unrecognized = append(m.XXX_unrecognized, dAtA[iNdEx:iNdEx+skippy]...)
-			iNdEx += skippy
-		}
-	}
-
-	if iNdEx > l {
-		return io.ErrUnexpectedEOF
-	}
-	return nil
-}
-func (m *Message_Peer) Unmarshal(dAtA []byte) error {
-	l := len(dAtA)
-	iNdEx := 0
-	for iNdEx < l {
-		preIndex := iNdEx
-		var wire uint64
-		for shift := uint(0); ; shift += 7 {
-			if shift >= 64 {
-				return ErrIntOverflowDht
+		case 13:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field CacheTtl", wireType)
 			}
-			if iNdEx >= l {
-				return io.ErrUnexpectedEOF
+			m.CacheTtl = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowDht
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.CacheTtl |= int64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
 			}
-			b := dAtA[iNdEx]
-			iNdEx++
-			wire |= uint64(b&0x7F) << shift
-			if b < 0x80 {
-				break
+		case 14:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field RequestId", wireType)
 			}
-		}
-		fieldNum := int32(wire >> 3)
-		wireType := int(wire & 0x7)
-		if wireType == 4 {
-			return fmt.Errorf("proto: Peer: wiretype end group for non-group")
-		}
-		if fieldNum <= 0 {
-			return fmt.Errorf("proto: Peer: illegal tag %d (wire type %d)", fieldNum, wire)
-		}
-		switch fieldNum {
-		case 1:
+			m.RequestId = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowDht
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.RequestId |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 15:
 			if wireType != 2 {
-				return fmt.Errorf("proto: wrong wireType = %d for field Id", wireType)
+				return fmt.Errorf("proto: wrong wireType = %d for field Keys", wireType)
 			}
 			var byteLen int
 			for shift := uint(0); ; shift += 7 {
@@ -795,15 +1648,14 @@ func (m *Message_Peer) Unmarshal(dAtA []byte) error {
 			if postIndex > l {
 				return io.ErrUnexpectedEOF
 			}
-			if err := m.Id.Unmarshal(dAtA[iNdEx:postIndex]); err != nil {
-				return err
-			}
+			m.Keys = append(m.Keys, make([]byte, postIndex-iNdEx))
+			copy(m.Keys[len(m.Keys)-1], dAtA[iNdEx:postIndex])
 			iNdEx = postIndex
-		case 2:
+		case 16:
 			if wireType != 2 {
-				return fmt.Errorf("proto: wrong wireType = %d for field Addrs", wireType)
+				return fmt.Errorf("proto: wrong wireType = %d for field CloserPeersByKey", wireType)
 			}
-			var byteLen int
+			var msglen int
 			for shift := uint(0); ; shift += 7 {
 				if shift >= 64 {
 					return ErrIntOverflowDht
@@ -813,12 +1665,451 @@ func (m *Message_Peer) Unmarshal(dAtA []byte) error {
 				}
 				b := dAtA[iNdEx]
 				iNdEx++
-				byteLen |= int(b&0x7F) << shift
+				msglen |= int(b&0x7F) << shift
 				if b < 0x80 {
 					break
 				}
 			}
-			if byteLen < 0 {
+			if msglen < 0 {
+				return ErrInvalidLengthDht
+			}
+			postIndex := iNdEx + msglen
+			if postIndex < 0 {
+				return ErrInvalidLengthDht
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.CloserPeersByKey = append(m.CloserPeersByKey, Message_KeyPeers{})
+			if err := m.CloserPeersByKey[len(m.CloserPeersByKey)-1].Unmarshal(dAtA[iNdEx:postIndex]); err != nil {
+				return err
+			}
+			iNdEx = postIndex
+		case 17:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field RetryAfterMs", wireType)
+			}
+			m.RetryAfterMs = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowDht
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.RetryAfterMs |= uint32(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 18:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Capabilities", wireType)
+			}
+			m.Capabilities = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowDht
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.Capabilities |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 19:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field ResponseSignature", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowDht
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				byteLen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if byteLen < 0 {
+				return ErrInvalidLengthDht
+			}
+			postIndex := iNdEx + byteLen
+			if postIndex < 0 {
+				return ErrInvalidLengthDht
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.ResponseSignature = append(m.ResponseSignature[:0], dAtA[iNdEx:postIndex]...)
+			if m.ResponseSignature == nil {
+				m.ResponseSignature = []byte{}
+			}
+			iNdEx = postIndex
+		case 20:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field ProvidersPageToken", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowDht
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				byteLen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if byteLen < 0 {
+				return ErrInvalidLengthDht
+			}
+			postIndex := iNdEx + byteLen
+			if postIndex < 0 {
+				return ErrInvalidLengthDht
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.ProvidersPageToken = append(m.ProvidersPageToken[:0], dAtA[iNdEx:postIndex]...)
+			if m.ProvidersPageToken == nil {
+				m.ProvidersPageToken = []byte{}
+			}
+			iNdEx = postIndex
+		case 21:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field MoreFrames", wireType)
+			}
+			var v int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowDht
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				v |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			m.MoreFrames = bool(v != 0)
+		case 22:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field DeadlineMs", wireType)
+			}
+			m.DeadlineMs = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowDht
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.DeadlineMs |= uint32(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 23:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field CloserPeersCount", wireType)
+			}
+			m.CloserPeersCount = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowDht
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.CloserPeersCount |= uint32(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 24:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field IdempotencyToken", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowDht
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				byteLen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if byteLen < 0 {
+				return ErrInvalidLengthDht
+			}
+			postIndex := iNdEx + byteLen
+			if postIndex < 0 {
+				return ErrInvalidLengthDht
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.IdempotencyToken = append(m.IdempotencyToken[:0], dAtA[iNdEx:postIndex]...)
+			if m.IdempotencyToken == nil {
+				m.IdempotencyToken = []byte{}
+			}
+			iNdEx = postIndex
+		case 25:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field ObservedAddr", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowDht
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				byteLen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if byteLen < 0 {
+				return ErrInvalidLengthDht
+			}
+			postIndex := iNdEx + byteLen
+			if postIndex < 0 {
+				return ErrInvalidLengthDht
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.ObservedAddr = append(m.ObservedAddr[:0], dAtA[iNdEx:postIndex]...)
+			if m.ObservedAddr == nil {
+				m.ObservedAddr = []byte{}
+			}
+			iNdEx = postIndex
+		default:
+			iNdEx = preIndex
+			skippy, err := skipDht(dAtA[iNdEx:])
+			if err != nil {
+				return err
+			}
+			if (skippy < 0) || (iNdEx+skippy) < 0 {
+				return ErrInvalidLengthDht
+			}
+			if (iNdEx + skippy) > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.XXX_unrecognized = append(m.XXX_unrecognized, dAtA[iNdEx:iNdEx+skippy]...)
+			iNdEx += skippy
+		}
+	}
+
+	if iNdEx > l {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+func (m *Message_Peer) Unmarshal(dAtA []byte) error {
+	l := len(dAtA)
+	iNdEx := 0
+	for iNdEx < l {
+		preIndex := iNdEx
+		var wire uint64
+		for shift := uint(0); ; shift += 7 {
+			if shift >= 64 {
+				return ErrIntOverflowDht
+			}
+			if iNdEx >= l {
+				return io.ErrUnexpectedEOF
+			}
+			b := dAtA[iNdEx]
+			iNdEx++
+			wire |= uint64(b&0x7F) << shift
+			if b < 0x80 {
+				break
+			}
+		}
+		fieldNum := int32(wire >> 3)
+		wireType := int(wire & 0x7)
+		if wireType == 4 {
+			return fmt.Errorf("proto: Peer: wiretype end group for non-group")
+		}
+		if fieldNum <= 0 {
+			return fmt.Errorf("proto: Peer: illegal tag %d (wire type %d)", fieldNum, wire)
+		}
+		switch fieldNum {
+		case 1:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Id", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowDht
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				byteLen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if byteLen < 0 {
+				return ErrInvalidLengthDht
+			}
+			postIndex := iNdEx + byteLen
+			if postIndex < 0 {
+				return ErrInvalidLengthDht
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			if err := m.Id.Unmarshal(dAtA[iNdEx:postIndex]); err != nil {
+				return err
+			}
+			iNdEx = postIndex
+		case 2:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Addrs", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowDht
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				byteLen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if byteLen < 0 {
+				return ErrInvalidLengthDht
+			}
+			postIndex := iNdEx + byteLen
+			if postIndex < 0 {
+				return ErrInvalidLengthDht
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Addrs = append(m.Addrs, make([]byte, postIndex-iNdEx))
+			copy(m.Addrs[len(m.Addrs)-1], dAtA[iNdEx:postIndex])
+			iNdEx = postIndex
+		case 3:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Connection", wireType)
+			}
+			m.Connection = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowDht
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.Connection |= Message_ConnectionType(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 4:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field RecordAge", wireType)
+			}
+			m.RecordAge = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowDht
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.RecordAge |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 5:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field SignedAt", wireType)
+			}
+			m.SignedAt = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowDht
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.SignedAt |= int64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 6:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Signature", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowDht
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				byteLen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if byteLen < 0 {
 				return ErrInvalidLengthDht
 			}
 			postIndex := iNdEx + byteLen
@@ -828,14 +2119,290 @@ func (m *Message_Peer) Unmarshal(dAtA []byte) error {
 			if postIndex > l {
 				return io.ErrUnexpectedEOF
 			}
-			m.Addrs = append(m.Addrs, make([]byte, postIndex-iNdEx))
-			copy(m.Addrs[len(m.Addrs)-1], dAtA[iNdEx:postIndex])
+			m.Signature = append(m.Signature[:0], dAtA[iNdEx:postIndex]...)
+			if m.Signature == nil {
+				m.Signature = []byte{}
+			}
+			iNdEx = postIndex
+		case 7:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field TransferProtocols", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowDht
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				stringLen |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthDht
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex < 0 {
+				return ErrInvalidLengthDht
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.TransferProtocols = append(m.TransferProtocols, string(dAtA[iNdEx:postIndex]))
+			iNdEx = postIndex
+		case 8:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field ProviderTtl", wireType)
+			}
+			m.ProviderTtl = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowDht
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.ProviderTtl |= uint32(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		default:
+			iNdEx = preIndex
+			skippy, err := skipDht(dAtA[iNdEx:])
+			if err != nil {
+				return err
+			}
+			if (skippy < 0) || (iNdEx+skippy) < 0 {
+				return ErrInvalidLengthDht
+			}
+			if (iNdEx + skippy) > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.XXX_unrecognized = append(m.XXX_unrecognized, dAtA[iNdEx:iNdEx+skippy]...)
+			iNdEx += skippy
+		}
+	}
+
+	if iNdEx > l {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+func (m *Message_KeyPeers) Unmarshal(dAtA []byte) error {
+	l := len(dAtA)
+	iNdEx := 0
+	for iNdEx < l {
+		preIndex := iNdEx
+		var wire uint64
+		for shift := uint(0); ; shift += 7 {
+			if shift >= 64 {
+				return ErrIntOverflowDht
+			}
+			if iNdEx >= l {
+				return io.ErrUnexpectedEOF
+			}
+			b := dAtA[iNdEx]
+			iNdEx++
+			wire |= uint64(b&0x7F) << shift
+			if b < 0x80 {
+				break
+			}
+		}
+		fieldNum := int32(wire >> 3)
+		wireType := int(wire & 0x7)
+		if wireType == 4 {
+			return fmt.Errorf("proto: KeyPeers: wiretype end group for non-group")
+		}
+		if fieldNum <= 0 {
+			return fmt.Errorf("proto: KeyPeers: illegal tag %d (wire type %d)", fieldNum, wire)
+		}
+		switch fieldNum {
+		case 1:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Key", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowDht
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				byteLen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if byteLen < 0 {
+				return ErrInvalidLengthDht
+			}
+			postIndex := iNdEx + byteLen
+			if postIndex < 0 {
+				return ErrInvalidLengthDht
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Key = append(m.Key[:0], dAtA[iNdEx:postIndex]...)
+			if m.Key == nil {
+				m.Key = []byte{}
+			}
+			iNdEx = postIndex
+		case 2:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field CloserPeers", wireType)
+			}
+			var msglen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowDht
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				msglen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if msglen < 0 {
+				return ErrInvalidLengthDht
+			}
+			postIndex := iNdEx + msglen
+			if postIndex < 0 {
+				return ErrInvalidLengthDht
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.CloserPeers = append(m.CloserPeers, Message_Peer{})
+			if err := m.CloserPeers[len(m.CloserPeers)-1].Unmarshal(dAtA[iNdEx:postIndex]); err != nil {
+				return err
+			}
+			iNdEx = postIndex
+		default:
+			iNdEx = preIndex
+			skippy, err := skipDht(dAtA[iNdEx:])
+			if err != nil {
+				return err
+			}
+			if (skippy < 0) || (iNdEx+skippy) < 0 {
+				return ErrInvalidLengthDht
+			}
+			if (iNdEx + skippy) > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.XXX_unrecognized = append(m.XXX_unrecognized, dAtA[iNdEx:iNdEx+skippy]...)
+			iNdEx += skippy
+		}
+	}
+
+	if iNdEx > l {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+func (m *VersionedValue) Unmarshal(dAtA []byte) error {
+	l := len(dAtA)
+	iNdEx := 0
+	for iNdEx < l {
+		preIndex := iNdEx
+		var wire uint64
+		for shift := uint(0); ; shift += 7 {
+			if shift >= 64 {
+				return ErrIntOverflowDht
+			}
+			if iNdEx >= l {
+				return io.ErrUnexpectedEOF
+			}
+			b := dAtA[iNdEx]
+			iNdEx++
+			wire |= uint64(b&0x7F) << shift
+			if b < 0x80 {
+				break
+			}
+		}
+		fieldNum := int32(wire >> 3)
+		wireType := int(wire & 0x7)
+		if wireType == 4 {
+			return fmt.Errorf("proto: VersionedValue: wiretype end group for non-group")
+		}
+		if fieldNum <= 0 {
+			return fmt.Errorf("proto: VersionedValue: illegal tag %d (wire type %d)", fieldNum, wire)
+		}
+		switch fieldNum {
+		case 1:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Value", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowDht
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				byteLen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if byteLen < 0 {
+				return ErrInvalidLengthDht
+			}
+			postIndex := iNdEx + byteLen
+			if postIndex < 0 {
+				return ErrInvalidLengthDht
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Value = append(m.Value[:0], dAtA[iNdEx:postIndex]...)
+			if m.Value == nil {
+				m.Value = []byte{}
+			}
 			iNdEx = postIndex
+		case 2:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Seq", wireType)
+			}
+			m.Seq = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowDht
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.Seq |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
 		case 3:
 			if wireType != 0 {
-				return fmt.Errorf("proto: wrong wireType = %d for field Connection", wireType)
+				return fmt.Errorf("proto: wrong wireType = %d for field Validity", wireType)
 			}
-			m.Connection = 0
+			m.Validity = 0
 			for shift := uint(0); ; shift += 7 {
 				if shift >= 64 {
 					return ErrIntOverflowDht
@@ -845,7 +2412,7 @@ func (m *Message_Peer) Unmarshal(dAtA []byte) error {
 				}
 				b := dAtA[iNdEx]
 				iNdEx++
-				m.Connection |= Message_ConnectionType(b&0x7F) << shift
+				m.Validity |= int64(b&0x7F) << shift
 				if b < 0x80 {
 					break
 				}
@@ -0,0 +1,189 @@
+package dht_pb
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/gogo/protobuf/proto"
+)
+
+const (
+	// MinExtensionField is the lowest field number of extensions, the lower
+	// ones are reserved for the protocol.
+	MinExtensionField = 1000
+	// maxFieldNumber is the highest field number protobuf allows.
+	maxFieldNumber = 1<<29 - 1
+
+	// MaxProviderExtensionsSize bounds the size of the unknown fields of the
+	// provider records that are stored, and served, along with the records.
+	MaxProviderExtensionsSize = 1024
+)
+
+const wireBytes = 2
+
+var extensions = struct {
+	sync.Mutex
+	names map[int32]string
+}{names: make(map[int32]string)}
+
+// RegisterExtension reserves an extension field for the named experiment, so
+// that two experiments don't use the same field. Fields can only be set once
+// registered.
+//
+// Extensions are experimental fields carried next to the fields of Message and
+// Message_Peer, as length delimited fields numbered from MinExtensionField.
+// Peers unaware of an extension keep it among the unknown fields of the
+// messages they parse, which are serialized again along with the others, so
+// that extensions survive peers relaying messages or storing provider records
+// without understanding them.
+func RegisterExtension(field int32, name string) error {
+	if field < MinExtensionField || field > maxFieldNumber {
+		return fmt.Errorf("extension field %d out of the [%d, %d] range", field, MinExtensionField, maxFieldNumber)
+	}
+	extensions.Lock()
+	defer extensions.Unlock()
+	if other, ok := extensions.names[field]; ok {
+		return fmt.Errorf("extension field %d already registered by %s", field, other)
+	}
+	extensions.names[field] = name
+	return nil
+}
+
+// GetExtension returns the value of an extension field of m, if set.
+func (m *Message) GetExtension(field int32) ([]byte, bool) {
+	return ReadExtension(m.XXX_unrecognized, field)
+}
+
+// SetExtension sets an extension field of m, which must be registered.
+func (m *Message) SetExtension(field int32, value []byte) error {
+	unknown, err := WriteExtension(m.XXX_unrecognized, field, value)
+	if err != nil {
+		return err
+	}
+	m.XXX_unrecognized = unknown
+	return nil
+}
+
+// GetExtension returns the value of an extension field of m, if set.
+func (m *Message_Peer) GetExtension(field int32) ([]byte, bool) {
+	return ReadExtension(m.XXX_unrecognized, field)
+}
+
+// SetExtension sets an extension field of m, which must be registered.
+func (m *Message_Peer) SetExtension(field int32, value []byte) error {
+	unknown, err := WriteExtension(m.XXX_unrecognized, field, value)
+	if err != nil {
+		return err
+	}
+	m.XXX_unrecognized = unknown
+	return nil
+}
+
+// ReadExtension returns the value of an extension field among the serialized
+// unknown fields of a message, if set. The last value wins if set several
+// times.
+func ReadExtension(unknown []byte, field int32) ([]byte, bool) {
+	var (
+		value []byte
+		found bool
+	)
+	_ = walkFields(unknown, func(num int32, wire int, data []byte) {
+		if num == field && wire == wireBytes {
+			value, found = data, true
+		}
+	})
+	return value, found
+}
+
+// WriteExtension returns the serialized unknown fields of a message with the
+// extension field set to value, and its previous values dropped. The field
+// must be registered.
+func WriteExtension(unknown []byte, field int32, value []byte) ([]byte, error) {
+	extensions.Lock()
+	_, ok := extensions.names[field]
+	extensions.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("extension field %d not registered", field)
+	}
+
+	out := make([]byte, 0, len(unknown)+len(value)+2*binary.MaxVarintLen64)
+	err := walkFieldsRaw(unknown, func(num int32, raw []byte) {
+		if num != field {
+			out = append(out, raw...)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	out = append(out, proto.EncodeVarint(uint64(field)<<3|wireBytes)...)
+	out = append(out, proto.EncodeVarint(uint64(len(value)))...)
+	return append(out, value...), nil
+}
+
+var errMalformedFields = errors.New("malformed unknown fields")
+
+// walkFields calls f with the number, wire type and payload of the serialized
+// fields. Varint and fixed size payloads are handed as serialized.
+func walkFields(b []byte, f func(num int32, wire int, data []byte)) error {
+	for len(b) > 0 {
+		num, wire, data, n, err := nextField(b)
+		if err != nil {
+			return err
+		}
+		f(num, wire, data)
+		b = b[n:]
+	}
+	return nil
+}
+
+// walkFieldsRaw calls f with the number of the serialized fields and their
+// serialization, tag included.
+func walkFieldsRaw(b []byte, f func(num int32, raw []byte)) error {
+	for len(b) > 0 {
+		num, _, _, n, err := nextField(b)
+		if err != nil {
+			return err
+		}
+		f(num, b[:n])
+		b = b[n:]
+	}
+	return nil
+}
+
+// nextField parses the first serialized field of b, returning its number,
+// wire type, payload and serialized size.
+func nextField(b []byte) (int32, int, []byte, int, error) {
+	tag, n := proto.DecodeVarint(b)
+	if n == 0 || tag>>3 == 0 || tag>>3 > maxFieldNumber {
+		return 0, 0, nil, 0, errMalformedFields
+	}
+	num, wire := int32(tag>>3), int(tag&7)
+	switch wire {
+	case 0:
+		_, m := proto.DecodeVarint(b[n:])
+		if m == 0 {
+			return 0, 0, nil, 0, errMalformedFields
+		}
+		return num, wire, b[n : n+m], n + m, nil
+	case 1, 5:
+		size := 8
+		if wire == 5 {
+			size = 4
+		}
+		if len(b)-n < size {
+			return 0, 0, nil, 0, errMalformedFields
+		}
+		return num, wire, b[n : n+size], n + size, nil
+	case wireBytes:
+		l, m := proto.DecodeVarint(b[n:])
+		if m == 0 || l > uint64(len(b)-n-m) {
+			return 0, 0, nil, 0, errMalformedFields
+		}
+		start := n + m
+		return num, wire, b[start : start+int(l)], start + int(l), nil
+	}
+	// groups are deprecated, and not used by the protocol
+	return 0, 0, nil, 0, errMalformedFields
+}
@@ -0,0 +1,57 @@
+package dht_pb
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestExtensions(t *testing.T) {
+	const field = MinExtensionField + 1
+	if err := RegisterExtension(field, "test"); err != nil {
+		t.Fatal(err)
+	}
+	if err := RegisterExtension(field, "other test"); err == nil {
+		t.Fatal("expected registering a field twice to fail")
+	}
+	if err := RegisterExtension(MinExtensionField-1, "test"); err == nil {
+		t.Fatal("expected registering a protocol field to fail")
+	}
+
+	m := NewMessage(Message_FIND_NODE, []byte("key"), 0)
+	if err := m.SetExtension(field+1, []byte("value")); err == nil {
+		t.Fatal("expected setting an unregistered field to fail")
+	}
+	if err := m.SetExtension(field, []byte("old value")); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.SetExtension(field, []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+
+	// survives the wire, and peers unaware of it
+	data, err := m.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	relayed := new(Message)
+	if err := relayed.Unmarshal(data); err != nil {
+		t.Fatal(err)
+	}
+	relayed.ClusterLevelRaw = 1
+	if data, err = relayed.Marshal(); err != nil {
+		t.Fatal(err)
+	}
+	m = new(Message)
+	if err := m.Unmarshal(data); err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := m.GetExtension(field); !ok || !bytes.Equal(v, []byte("value")) {
+		t.Fatalf("expected the extension to be relayed, got %q", v)
+	}
+	if string(m.GetKey()) != "key" || m.ClusterLevelRaw != 1 {
+		t.Fatal("the known fields didn't survive the round trip")
+	}
+	if _, ok := m.GetExtension(field + 1); ok {
+		t.Fatal("expected an unset extension")
+	}
+}
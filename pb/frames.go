@@ -0,0 +1,40 @@
+package dht_pb
+
+import "context"
+
+type frameHandlerKey struct{}
+
+// FrameHandler is handed the frames of a response streamed in several frames,
+// see CapStreamedProviders, all but the last one, which is returned as the
+// response. An error fails the request.
+type FrameHandler func(frame *Message) error
+
+// WithFrameHandler returns a context under which the frames of streamed
+// responses are handed to h as they arrive. Without a frame handler, the
+// frames are merged into the response, and the signatures of signed responses
+// no longer verify.
+func WithFrameHandler(ctx context.Context, h FrameHandler) context.Context {
+	return context.WithValue(ctx, frameHandlerKey{}, h)
+}
+
+// GetFrameHandler returns the frame handler of ctx, if any.
+func GetFrameHandler(ctx context.Context) FrameHandler {
+	h, _ := ctx.Value(frameHandlerKey{}).(FrameHandler)
+	return h
+}
+
+// wrapFrameHandler applies f to the frames before the frame handler of ctx, if
+// any, so that the MessageSenders transforming the responses they receive do
+// the same to the frames.
+func wrapFrameHandler(ctx context.Context, f func(frame *Message) error) context.Context {
+	h := GetFrameHandler(ctx)
+	if h == nil {
+		return ctx
+	}
+	return WithFrameHandler(ctx, func(frame *Message) error {
+		if err := f(frame); err != nil {
+			return err
+		}
+		return h(frame)
+	})
+}
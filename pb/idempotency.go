@@ -0,0 +1,112 @@
+package dht_pb
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// idempotencyTokenSize is the size of the idempotency tokens we generate.
+const idempotencyTokenSize = 16
+
+// WithMutationRetries retries the PUT_VALUE and ADD_PROVIDER requests failing
+// for other reasons than the context being done or the peer throttling us up
+// to retries times, waiting backoff before the first retry and twice as long
+// before each following one. All the attempts carry the same idempotency
+// token, so that peers having handled an attempt whose response we missed
+// don't apply it again.
+func WithMutationRetries(retries int, backoff time.Duration) ProtocolMessengerOption {
+	return func(pm *ProtocolMessenger) error {
+		if retries < 0 || backoff < 0 {
+			return fmt.Errorf("mutation retries and backoff must not be negative, got %d and %s", retries, backoff)
+		}
+		pm.mutationRetries = retries
+		pm.mutationBackoff = backoff
+		return nil
+	}
+}
+
+// IsMutatingRequest reports whether requests of type t may carry an
+// idempotency token.
+func IsMutatingRequest(t Message_MessageType) bool {
+	return t == Message_PUT_VALUE || t == Message_ADD_PROVIDER
+}
+
+// retryingSender retries the mutating requests it sends, see
+// WithMutationRetries.
+type retryingSender struct {
+	MessageSender
+	retries int
+	backoff time.Duration
+}
+
+func (rs *retryingSender) SendRequest(ctx context.Context, p peer.ID, pmes *Message) (*Message, error) {
+	if !IsMutatingRequest(pmes.GetType()) {
+		return rs.MessageSender.SendRequest(ctx, p, pmes)
+	}
+	pmes, err := withIdempotencyToken(pmes)
+	if err != nil {
+		return nil, err
+	}
+	var resp *Message
+	err = rs.retry(ctx, func() error {
+		var err error
+		resp, err = rs.MessageSender.SendRequest(ctx, p, pmes)
+		return err
+	})
+	return resp, err
+}
+
+func (rs *retryingSender) SendMessage(ctx context.Context, p peer.ID, pmes *Message) error {
+	if !IsMutatingRequest(pmes.GetType()) {
+		return rs.MessageSender.SendMessage(ctx, p, pmes)
+	}
+	pmes, err := withIdempotencyToken(pmes)
+	if err != nil {
+		return err
+	}
+	return rs.retry(ctx, func() error {
+		return rs.MessageSender.SendMessage(ctx, p, pmes)
+	})
+}
+
+func (rs *retryingSender) retry(ctx context.Context, send func() error) error {
+	backoff := rs.backoff
+	for attempt := 0; ; attempt++ {
+		err := send()
+		var throttled *ThrottledError
+		if err == nil || attempt == rs.retries || ctx.Err() != nil || errors.As(err, &throttled) {
+			return err
+		}
+		logger.Debugw("retrying mutating request", "attempt", attempt+1, "error", err)
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		}
+		backoff *= 2
+	}
+}
+
+// withIdempotencyToken returns a copy of pmes carrying a new idempotency token,
+// unless it already carries one.
+func withIdempotencyToken(pmes *Message) (*Message, error) {
+	if len(pmes.GetIdempotencyToken()) > 0 {
+		return pmes, nil
+	}
+	token := make([]byte, idempotencyTokenSize)
+	if _, err := rand.Read(token); err != nil {
+		return nil, fmt.Errorf("generating idempotency token: %w", err)
+	}
+	// the message may be sent to other peers concurrently
+	req := *pmes
+	req.IdempotencyToken = token
+	return &req, nil
+}
@@ -0,0 +1,1611 @@
+// Code generated by protoc-gen-gogo. DO NOT EDIT.
+// source: introspection.proto
+
+package dht_pb
+
+import (
+	fmt "fmt"
+	proto "github.com/gogo/protobuf/proto"
+	io "io"
+	math "math"
+	math_bits "math/bits"
+)
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ = proto.Marshal
+var _ = fmt.Errorf
+var _ = math.Inf
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the proto package it is being compiled against.
+// A compilation error at this line likely means your copy of the
+// proto package needs to be updated.
+const _ = proto.GoGoProtoPackageIsVersion3 // please upgrade the proto package
+
+// Introspection is a snapshot of the state of a DHT node, for external
+// dashboards. Times are unix times in nanoseconds, zero if unset, and
+// durations are in nanoseconds.
+type Introspection struct {
+	Self []byte `protobuf:"bytes,1,opt,name=self,proto3" json:"self,omitempty"`
+	Time int64  `protobuf:"varint,2,opt,name=time,proto3" json:"time,omitempty"`
+	// the peers of the routing table
+	RoutingTable []*Introspection_Peer `protobuf:"bytes,3,rep,name=routingTable,proto3" json:"routingTable,omitempty"`
+	// the ongoing lookups
+	Lookups []*Introspection_Lookup `protobuf:"bytes,4,rep,name=lookups,proto3" json:"lookups,omitempty"`
+	// the last completed operations, the most recent last
+	RecentOperations     []*Introspection_Operation `protobuf:"bytes,5,rep,name=recentOperations,proto3" json:"recentOperations,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}                   `json:"-"`
+	XXX_unrecognized     []byte                     `json:"-"`
+	XXX_sizecache        int32                      `json:"-"`
+}
+
+func (m *Introspection) Reset()         { *m = Introspection{} }
+func (m *Introspection) String() string { return proto.CompactTextString(m) }
+func (*Introspection) ProtoMessage()    {}
+func (*Introspection) Descriptor() ([]byte, []int) {
+	return fileDescriptor_53a8bedf9a75e10a, []int{0}
+}
+func (m *Introspection) XXX_Unmarshal(b []byte) error {
+	return m.Unmarshal(b)
+}
+func (m *Introspection) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	if deterministic {
+		return xxx_messageInfo_Introspection.Marshal(b, m, deterministic)
+	} else {
+		b = b[:cap(b)]
+		n, err := m.MarshalToSizedBuffer(b)
+		if err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	}
+}
+func (m *Introspection) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_Introspection.Merge(m, src)
+}
+func (m *Introspection) XXX_Size() int {
+	return m.Size()
+}
+func (m *Introspection) XXX_DiscardUnknown() {
+	xxx_messageInfo_Introspection.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_Introspection proto.InternalMessageInfo
+
+func (m *Introspection) GetSelf() []byte {
+	if m != nil {
+		return m.Self
+	}
+	return nil
+}
+
+func (m *Introspection) GetTime() int64 {
+	if m != nil {
+		return m.Time
+	}
+	return 0
+}
+
+func (m *Introspection) GetRoutingTable() []*Introspection_Peer {
+	if m != nil {
+		return m.RoutingTable
+	}
+	return nil
+}
+
+func (m *Introspection) GetLookups() []*Introspection_Lookup {
+	if m != nil {
+		return m.Lookups
+	}
+	return nil
+}
+
+func (m *Introspection) GetRecentOperations() []*Introspection_Operation {
+	if m != nil {
+		return m.RecentOperations
+	}
+	return nil
+}
+
+type Introspection_Peer struct {
+	Id []byte `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	// length of the common prefix of the Kademlia IDs of the peer and ours
+	Cpl                           uint32   `protobuf:"varint,2,opt,name=cpl,proto3" json:"cpl,omitempty"`
+	AddedAt                       int64    `protobuf:"varint,3,opt,name=addedAt,proto3" json:"addedAt,omitempty"`
+	LastUsefulAt                  int64    `protobuf:"varint,4,opt,name=lastUsefulAt,proto3" json:"lastUsefulAt,omitempty"`
+	LastSuccessfulOutboundQueryAt int64    `protobuf:"varint,5,opt,name=lastSuccessfulOutboundQueryAt,proto3" json:"lastSuccessfulOutboundQueryAt,omitempty"`
+	XXX_NoUnkeyedLiteral          struct{} `json:"-"`
+	XXX_unrecognized              []byte   `json:"-"`
+	XXX_sizecache                 int32    `json:"-"`
+}
+
+func (m *Introspection_Peer) Reset()         { *m = Introspection_Peer{} }
+func (m *Introspection_Peer) String() string { return proto.CompactTextString(m) }
+func (*Introspection_Peer) ProtoMessage()    {}
+func (*Introspection_Peer) Descriptor() ([]byte, []int) {
+	return fileDescriptor_53a8bedf9a75e10a, []int{0, 0}
+}
+func (m *Introspection_Peer) XXX_Unmarshal(b []byte) error {
+	return m.Unmarshal(b)
+}
+func (m *Introspection_Peer) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	if deterministic {
+		return xxx_messageInfo_Introspection_Peer.Marshal(b, m, deterministic)
+	} else {
+		b = b[:cap(b)]
+		n, err := m.MarshalToSizedBuffer(b)
+		if err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	}
+}
+func (m *Introspection_Peer) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_Introspection_Peer.Merge(m, src)
+}
+func (m *Introspection_Peer) XXX_Size() int {
+	return m.Size()
+}
+func (m *Introspection_Peer) XXX_DiscardUnknown() {
+	xxx_messageInfo_Introspection_Peer.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_Introspection_Peer proto.InternalMessageInfo
+
+func (m *Introspection_Peer) GetId() []byte {
+	if m != nil {
+		return m.Id
+	}
+	return nil
+}
+
+func (m *Introspection_Peer) GetCpl() uint32 {
+	if m != nil {
+		return m.Cpl
+	}
+	return 0
+}
+
+func (m *Introspection_Peer) GetAddedAt() int64 {
+	if m != nil {
+		return m.AddedAt
+	}
+	return 0
+}
+
+func (m *Introspection_Peer) GetLastUsefulAt() int64 {
+	if m != nil {
+		return m.LastUsefulAt
+	}
+	return 0
+}
+
+func (m *Introspection_Peer) GetLastSuccessfulOutboundQueryAt() int64 {
+	if m != nil {
+		return m.LastSuccessfulOutboundQueryAt
+	}
+	return 0
+}
+
+type Introspection_Lookup struct {
+	// the identifier of the lookup, as in its lookup events
+	Id []byte `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	// the DHT operation the lookup is for, e.g. FindProviders
+	Operation string `protobuf:"bytes,2,opt,name=operation,proto3" json:"operation,omitempty"`
+	// hex encoded prefix of the Kademlia ID of the key
+	Key       string `protobuf:"bytes,3,opt,name=key,proto3" json:"key,omitempty"`
+	StartedAt int64  `protobuf:"varint,4,opt,name=startedAt,proto3" json:"startedAt,omitempty"`
+	// number of peers of the lookup in each state
+	Heard                uint32   `protobuf:"varint,5,opt,name=heard,proto3" json:"heard,omitempty"`
+	Waiting              uint32   `protobuf:"varint,6,opt,name=waiting,proto3" json:"waiting,omitempty"`
+	Queried              uint32   `protobuf:"varint,7,opt,name=queried,proto3" json:"queried,omitempty"`
+	Unreachable          uint32   `protobuf:"varint,8,opt,name=unreachable,proto3" json:"unreachable,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *Introspection_Lookup) Reset()         { *m = Introspection_Lookup{} }
+func (m *Introspection_Lookup) String() string { return proto.CompactTextString(m) }
+func (*Introspection_Lookup) ProtoMessage()    {}
+func (*Introspection_Lookup) Descriptor() ([]byte, []int) {
+	return fileDescriptor_53a8bedf9a75e10a, []int{0, 1}
+}
+func (m *Introspection_Lookup) XXX_Unmarshal(b []byte) error {
+	return m.Unmarshal(b)
+}
+func (m *Introspection_Lookup) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	if deterministic {
+		return xxx_messageInfo_Introspection_Lookup.Marshal(b, m, deterministic)
+	} else {
+		b = b[:cap(b)]
+		n, err := m.MarshalToSizedBuffer(b)
+		if err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	}
+}
+func (m *Introspection_Lookup) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_Introspection_Lookup.Merge(m, src)
+}
+func (m *Introspection_Lookup) XXX_Size() int {
+	return m.Size()
+}
+func (m *Introspection_Lookup) XXX_DiscardUnknown() {
+	xxx_messageInfo_Introspection_Lookup.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_Introspection_Lookup proto.InternalMessageInfo
+
+func (m *Introspection_Lookup) GetId() []byte {
+	if m != nil {
+		return m.Id
+	}
+	return nil
+}
+
+func (m *Introspection_Lookup) GetOperation() string {
+	if m != nil {
+		return m.Operation
+	}
+	return ""
+}
+
+func (m *Introspection_Lookup) GetKey() string {
+	if m != nil {
+		return m.Key
+	}
+	return ""
+}
+
+func (m *Introspection_Lookup) GetStartedAt() int64 {
+	if m != nil {
+		return m.StartedAt
+	}
+	return 0
+}
+
+func (m *Introspection_Lookup) GetHeard() uint32 {
+	if m != nil {
+		return m.Heard
+	}
+	return 0
+}
+
+func (m *Introspection_Lookup) GetWaiting() uint32 {
+	if m != nil {
+		return m.Waiting
+	}
+	return 0
+}
+
+func (m *Introspection_Lookup) GetQueried() uint32 {
+	if m != nil {
+		return m.Queried
+	}
+	return 0
+}
+
+func (m *Introspection_Lookup) GetUnreachable() uint32 {
+	if m != nil {
+		return m.Unreachable
+	}
+	return 0
+}
+
+type Introspection_Operation struct {
+	// the DHT operation, e.g. FindProviders
+	Operation            string   `protobuf:"bytes,1,opt,name=operation,proto3" json:"operation,omitempty"`
+	StartedAt            int64    `protobuf:"varint,2,opt,name=startedAt,proto3" json:"startedAt,omitempty"`
+	Duration             int64    `protobuf:"varint,3,opt,name=duration,proto3" json:"duration,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *Introspection_Operation) Reset()         { *m = Introspection_Operation{} }
+func (m *Introspection_Operation) String() string { return proto.CompactTextString(m) }
+func (*Introspection_Operation) ProtoMessage()    {}
+func (*Introspection_Operation) Descriptor() ([]byte, []int) {
+	return fileDescriptor_53a8bedf9a75e10a, []int{0, 2}
+}
+func (m *Introspection_Operation) XXX_Unmarshal(b []byte) error {
+	return m.Unmarshal(b)
+}
+func (m *Introspection_Operation) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	if deterministic {
+		return xxx_messageInfo_Introspection_Operation.Marshal(b, m, deterministic)
+	} else {
+		b = b[:cap(b)]
+		n, err := m.MarshalToSizedBuffer(b)
+		if err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	}
+}
+func (m *Introspection_Operation) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_Introspection_Operation.Merge(m, src)
+}
+func (m *Introspection_Operation) XXX_Size() int {
+	return m.Size()
+}
+func (m *Introspection_Operation) XXX_DiscardUnknown() {
+	xxx_messageInfo_Introspection_Operation.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_Introspection_Operation proto.InternalMessageInfo
+
+func (m *Introspection_Operation) GetOperation() string {
+	if m != nil {
+		return m.Operation
+	}
+	return ""
+}
+
+func (m *Introspection_Operation) GetStartedAt() int64 {
+	if m != nil {
+		return m.StartedAt
+	}
+	return 0
+}
+
+func (m *Introspection_Operation) GetDuration() int64 {
+	if m != nil {
+		return m.Duration
+	}
+	return 0
+}
+
+func init() {
+	proto.RegisterType((*Introspection)(nil), "dht.pb.Introspection")
+	proto.RegisterType((*Introspection_Peer)(nil), "dht.pb.Introspection.Peer")
+	proto.RegisterType((*Introspection_Lookup)(nil), "dht.pb.Introspection.Lookup")
+	proto.RegisterType((*Introspection_Operation)(nil), "dht.pb.Introspection.Operation")
+}
+
+func init() { proto.RegisterFile("introspection.proto", fileDescriptor_53a8bedf9a75e10a) }
+
+var fileDescriptor_53a8bedf9a75e10a = []byte{
+	// 417 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x7c, 0x53, 0x4b, 0x6e, 0x13, 0x41,
+	0x10, 0x55, 0x7b, 0xfc, 0x89, 0x2b, 0x36, 0x8a, 0x1a, 0x16, 0xad, 0x51, 0x30, 0x56, 0x56, 0x5e,
+	0xcd, 0x02, 0x24, 0x96, 0x48, 0x46, 0x6c, 0x10, 0x48, 0x81, 0x06, 0x0e, 0xd0, 0x9e, 0x2e, 0xe3,
+	0x56, 0x86, 0xe9, 0xa1, 0x3f, 0x42, 0xb9, 0x13, 0x07, 0x61, 0x89, 0x38, 0x01, 0xb2, 0xc4, 0x3d,
+	0x50, 0xd7, 0xd8, 0x4e, 0x26, 0xb1, 0xb2, 0xab, 0xf7, 0xea, 0x55, 0xe9, 0xbd, 0xae, 0x19, 0x78,
+	0x6c, 0xea, 0xe0, 0xac, 0x6f, 0xb0, 0x0c, 0xc6, 0xd6, 0x45, 0xe3, 0x6c, 0xb0, 0x7c, 0xa8, 0x37,
+	0xa1, 0x68, 0x56, 0x17, 0xff, 0x06, 0x30, 0x7d, 0x7b, 0xbb, 0xcf, 0x39, 0xf4, 0x3d, 0x56, 0x6b,
+	0xc1, 0xe6, 0x6c, 0x31, 0x91, 0x54, 0x27, 0x2e, 0x98, 0x6f, 0x28, 0x7a, 0x73, 0xb6, 0xc8, 0x24,
+	0xd5, 0xfc, 0x15, 0x4c, 0x9c, 0x8d, 0xc1, 0xd4, 0x5f, 0x3f, 0xab, 0x55, 0x85, 0x22, 0x9b, 0x67,
+	0x8b, 0xd3, 0xe7, 0x79, 0xd1, 0x2e, 0x2e, 0x3a, 0x4b, 0x8b, 0x0f, 0x88, 0x4e, 0x76, 0xf4, 0xfc,
+	0x25, 0x8c, 0x2a, 0x6b, 0xaf, 0x62, 0xe3, 0x45, 0x9f, 0x46, 0xcf, 0x8f, 0x8f, 0xbe, 0x27, 0x91,
+	0xdc, 0x8b, 0xf9, 0x3b, 0x38, 0x73, 0x58, 0x62, 0x1d, 0x2e, 0x1b, 0x74, 0x2a, 0x49, 0xbc, 0x18,
+	0xd0, 0x82, 0x67, 0xc7, 0x17, 0x1c, 0x74, 0xf2, 0xde, 0x60, 0xfe, 0x93, 0x41, 0x3f, 0x79, 0xe3,
+	0x8f, 0xa0, 0x67, 0xf4, 0x2e, 0x73, 0xcf, 0x68, 0x7e, 0x06, 0x59, 0xd9, 0x54, 0x14, 0x78, 0x2a,
+	0x53, 0xc9, 0x05, 0x8c, 0x94, 0xd6, 0xa8, 0x97, 0x41, 0x64, 0xf4, 0x0c, 0x7b, 0xc8, 0x2f, 0x60,
+	0x52, 0x29, 0x1f, 0xbe, 0x78, 0x5c, 0xc7, 0x6a, 0x19, 0x44, 0x9f, 0xda, 0x1d, 0x8e, 0xbf, 0x81,
+	0xa7, 0x09, 0x7f, 0x8a, 0x65, 0x89, 0xde, 0xaf, 0x63, 0x75, 0x19, 0xc3, 0xca, 0xc6, 0x5a, 0x7f,
+	0x8c, 0xe8, 0xae, 0x97, 0x41, 0x0c, 0x68, 0xe8, 0x61, 0x51, 0xfe, 0x87, 0xc1, 0xb0, 0x7d, 0x8f,
+	0x7b, 0x86, 0xcf, 0x61, 0x6c, 0xf7, 0xb9, 0xc8, 0xf6, 0x58, 0xde, 0x10, 0x29, 0xce, 0x15, 0x5e,
+	0x93, 0xf1, 0xb1, 0x4c, 0x65, 0xd2, 0xfb, 0xa0, 0x5c, 0x40, 0x7d, 0x70, 0x7c, 0x43, 0xf0, 0x27,
+	0x30, 0xd8, 0xa0, 0x72, 0x9a, 0x6c, 0x4d, 0x65, 0x0b, 0xd2, 0x13, 0xfc, 0x50, 0x26, 0x9d, 0x50,
+	0x0c, 0x89, 0xdf, 0xc3, 0xd4, 0xf9, 0x1e, 0xd1, 0x19, 0xd4, 0x62, 0xd4, 0x76, 0x76, 0x90, 0xcf,
+	0xe1, 0x34, 0xd6, 0x0e, 0x55, 0xb9, 0xa1, 0xaf, 0xe4, 0x84, 0xba, 0xb7, 0xa9, 0xbc, 0x84, 0xf1,
+	0xe1, 0x22, 0xdd, 0x18, 0xec, 0x6e, 0x8c, 0x8e, 0xe9, 0xde, 0x5d, 0xd3, 0x39, 0x9c, 0xe8, 0xb8,
+	0x1b, 0x6d, 0x4f, 0x74, 0xc0, 0xaf, 0x27, 0xbf, 0xb6, 0x33, 0xf6, 0x7b, 0x3b, 0x63, 0x7f, 0xb7,
+	0x33, 0xb6, 0x1a, 0xd2, 0x4f, 0xf0, 0xe2, 0xff, 0x00, 0xf3, 0xf6, 0x45, 0xbc, 0x1b, 0x03, 0x00,
+	0x00,
+}
+
+func (m *Introspection) Marshal() (dAtA []byte, err error) {
+	size := m.Size()
+	dAtA = make([]byte, size)
+	n, err := m.MarshalToSizedBuffer(dAtA[:size])
+	if err != nil {
+		return nil, err
+	}
+	return dAtA[:n], nil
+}
+
+func (m *Introspection) MarshalTo(dAtA []byte) (int, error) {
+	size := m.Size()
+	return m.MarshalToSizedBuffer(dAtA[:size])
+}
+
+func (m *Introspection) MarshalToSizedBuffer(dAtA []byte) (int, error) {
+	i := len(dAtA)
+	_ = i
+	var l int
+	_ = l
+	if m.XXX_unrecognized != nil {
+		i -= len(m.XXX_unrecognized)
+		copy(dAtA[i:], m.XXX_unrecognized)
+	}
+	if len(m.RecentOperations) > 0 {
+		for iNdEx := len(m.RecentOperations) - 1; iNdEx >= 0; iNdEx-- {
+			{
+				size, err := m.RecentOperations[iNdEx].MarshalToSizedBuffer(dAtA[:i])
+				if err != nil {
+					return 0, err
+				}
+				i -= size
+				i = encodeVarintIntrospection(dAtA, i, uint64(size))
+			}
+			i--
+			dAtA[i] = 0x2a
+		}
+	}
+	if len(m.Lookups) > 0 {
+		for iNdEx := len(m.Lookups) - 1; iNdEx >= 0; iNdEx-- {
+			{
+				size, err := m.Lookups[iNdEx].MarshalToSizedBuffer(dAtA[:i])
+				if err != nil {
+					return 0, err
+				}
+				i -= size
+				i = encodeVarintIntrospection(dAtA, i, uint64(size))
+			}
+			i--
+			dAtA[i] = 0x22
+		}
+	}
+	if len(m.RoutingTable) > 0 {
+		for iNdEx := len(m.RoutingTable) - 1; iNdEx >= 0; iNdEx-- {
+			{
+				size, err := m.RoutingTable[iNdEx].MarshalToSizedBuffer(dAtA[:i])
+				if err != nil {
+					return 0, err
+				}
+				i -= size
+				i = encodeVarintIntrospection(dAtA, i, uint64(size))
+			}
+			i--
+			dAtA[i] = 0x1a
+		}
+	}
+	if m.Time != 0 {
+		i = encodeVarintIntrospection(dAtA, i, uint64(m.Time))
+		i--
+		dAtA[i] = 0x10
+	}
+	if len(m.Self) > 0 {
+		i -= len(m.Self)
+		copy(dAtA[i:], m.Self)
+		i = encodeVarintIntrospection(dAtA, i, uint64(len(m.Self)))
+		i--
+		dAtA[i] = 0xa
+	}
+	return len(dAtA) - i, nil
+}
+
+func (m *Introspection_Peer) Marshal() (dAtA []byte, err error) {
+	size := m.Size()
+	dAtA = make([]byte, size)
+	n, err := m.MarshalToSizedBuffer(dAtA[:size])
+	if err != nil {
+		return nil, err
+	}
+	return dAtA[:n], nil
+}
+
+func (m *Introspection_Peer) MarshalTo(dAtA []byte) (int, error) {
+	size := m.Size()
+	return m.MarshalToSizedBuffer(dAtA[:size])
+}
+
+func (m *Introspection_Peer) MarshalToSizedBuffer(dAtA []byte) (int, error) {
+	i := len(dAtA)
+	_ = i
+	var l int
+	_ = l
+	if m.XXX_unrecognized != nil {
+		i -= len(m.XXX_unrecognized)
+		copy(dAtA[i:], m.XXX_unrecognized)
+	}
+	if m.LastSuccessfulOutboundQueryAt != 0 {
+		i = encodeVarintIntrospection(dAtA, i, uint64(m.LastSuccessfulOutboundQueryAt))
+		i--
+		dAtA[i] = 0x28
+	}
+	if m.LastUsefulAt != 0 {
+		i = encodeVarintIntrospection(dAtA, i, uint64(m.LastUsefulAt))
+		i--
+		dAtA[i] = 0x20
+	}
+	if m.AddedAt != 0 {
+		i = encodeVarintIntrospection(dAtA, i, uint64(m.AddedAt))
+		i--
+		dAtA[i] = 0x18
+	}
+	if m.Cpl != 0 {
+		i = encodeVarintIntrospection(dAtA, i, uint64(m.Cpl))
+		i--
+		dAtA[i] = 0x10
+	}
+	if len(m.Id) > 0 {
+		i -= len(m.Id)
+		copy(dAtA[i:], m.Id)
+		i = encodeVarintIntrospection(dAtA, i, uint64(len(m.Id)))
+		i--
+		dAtA[i] = 0xa
+	}
+	return len(dAtA) - i, nil
+}
+
+func (m *Introspection_Lookup) Marshal() (dAtA []byte, err error) {
+	size := m.Size()
+	dAtA = make([]byte, size)
+	n, err := m.MarshalToSizedBuffer(dAtA[:size])
+	if err != nil {
+		return nil, err
+	}
+	return dAtA[:n], nil
+}
+
+func (m *Introspection_Lookup) MarshalTo(dAtA []byte) (int, error) {
+	size := m.Size()
+	return m.MarshalToSizedBuffer(dAtA[:size])
+}
+
+func (m *Introspection_Lookup) MarshalToSizedBuffer(dAtA []byte) (int, error) {
+	i := len(dAtA)
+	_ = i
+	var l int
+	_ = l
+	if m.XXX_unrecognized != nil {
+		i -= len(m.XXX_unrecognized)
+		copy(dAtA[i:], m.XXX_unrecognized)
+	}
+	if m.Unreachable != 0 {
+		i = encodeVarintIntrospection(dAtA, i, uint64(m.Unreachable))
+		i--
+		dAtA[i] = 0x40
+	}
+	if m.Queried != 0 {
+		i = encodeVarintIntrospection(dAtA, i, uint64(m.Queried))
+		i--
+		dAtA[i] = 0x38
+	}
+	if m.Waiting != 0 {
+		i = encodeVarintIntrospection(dAtA, i, uint64(m.Waiting))
+		i--
+		dAtA[i] = 0x30
+	}
+	if m.Heard != 0 {
+		i = encodeVarintIntrospection(dAtA, i, uint64(m.Heard))
+		i--
+		dAtA[i] = 0x28
+	}
+	if m.StartedAt != 0 {
+		i = encodeVarintIntrospection(dAtA, i, uint64(m.StartedAt))
+		i--
+		dAtA[i] = 0x20
+	}
+	if len(m.Key) > 0 {
+		i -= len(m.Key)
+		copy(dAtA[i:], m.Key)
+		i = encodeVarintIntrospection(dAtA, i, uint64(len(m.Key)))
+		i--
+		dAtA[i] = 0x1a
+	}
+	if len(m.Operation) > 0 {
+		i -= len(m.Operation)
+		copy(dAtA[i:], m.Operation)
+		i = encodeVarintIntrospection(dAtA, i, uint64(len(m.Operation)))
+		i--
+		dAtA[i] = 0x12
+	}
+	if len(m.Id) > 0 {
+		i -= len(m.Id)
+		copy(dAtA[i:], m.Id)
+		i = encodeVarintIntrospection(dAtA, i, uint64(len(m.Id)))
+		i--
+		dAtA[i] = 0xa
+	}
+	return len(dAtA) - i, nil
+}
+
+func (m *Introspection_Operation) Marshal() (dAtA []byte, err error) {
+	size := m.Size()
+	dAtA = make([]byte, size)
+	n, err := m.MarshalToSizedBuffer(dAtA[:size])
+	if err != nil {
+		return nil, err
+	}
+	return dAtA[:n], nil
+}
+
+func (m *Introspection_Operation) MarshalTo(dAtA []byte) (int, error) {
+	size := m.Size()
+	return m.MarshalToSizedBuffer(dAtA[:size])
+}
+
+func (m *Introspection_Operation) MarshalToSizedBuffer(dAtA []byte) (int, error) {
+	i := len(dAtA)
+	_ = i
+	var l int
+	_ = l
+	if m.XXX_unrecognized != nil {
+		i -= len(m.XXX_unrecognized)
+		copy(dAtA[i:], m.XXX_unrecognized)
+	}
+	if m.Duration != 0 {
+		i = encodeVarintIntrospection(dAtA, i, uint64(m.Duration))
+		i--
+		dAtA[i] = 0x18
+	}
+	if m.StartedAt != 0 {
+		i = encodeVarintIntrospection(dAtA, i, uint64(m.StartedAt))
+		i--
+		dAtA[i] = 0x10
+	}
+	if len(m.Operation) > 0 {
+		i -= len(m.Operation)
+		copy(dAtA[i:], m.Operation)
+		i = encodeVarintIntrospection(dAtA, i, uint64(len(m.Operation)))
+		i--
+		dAtA[i] = 0xa
+	}
+	return len(dAtA) - i, nil
+}
+
+func encodeVarintIntrospection(dAtA []byte, offset int, v uint64) int {
+	offset -= sovIntrospection(v)
+	base := offset
+	for v >= 1<<7 {
+		dAtA[offset] = uint8(v&0x7f | 0x80)
+		v >>= 7
+		offset++
+	}
+	dAtA[offset] = uint8(v)
+	return base
+}
+func (m *Introspection) Size() (n int) {
+	if m == nil {
+		return 0
+	}
+	var l int
+	_ = l
+	l = len(m.Self)
+	if l > 0 {
+		n += 1 + l + sovIntrospection(uint64(l))
+	}
+	if m.Time != 0 {
+		n += 1 + sovIntrospection(uint64(m.Time))
+	}
+	if len(m.RoutingTable) > 0 {
+		for _, e := range m.RoutingTable {
+			l = e.Size()
+			n += 1 + l + sovIntrospection(uint64(l))
+		}
+	}
+	if len(m.Lookups) > 0 {
+		for _, e := range m.Lookups {
+			l = e.Size()
+			n += 1 + l + sovIntrospection(uint64(l))
+		}
+	}
+	if len(m.RecentOperations) > 0 {
+		for _, e := range m.RecentOperations {
+			l = e.Size()
+			n += 1 + l + sovIntrospection(uint64(l))
+		}
+	}
+	if m.XXX_unrecognized != nil {
+		n += len(m.XXX_unrecognized)
+	}
+	return n
+}
+
+func (m *Introspection_Peer) Size() (n int) {
+	if m == nil {
+		return 0
+	}
+	var l int
+	_ = l
+	l = len(m.Id)
+	if l > 0 {
+		n += 1 + l + sovIntrospection(uint64(l))
+	}
+	if m.Cpl != 0 {
+		n += 1 + sovIntrospection(uint64(m.Cpl))
+	}
+	if m.AddedAt != 0 {
+		n += 1 + sovIntrospection(uint64(m.AddedAt))
+	}
+	if m.LastUsefulAt != 0 {
+		n += 1 + sovIntrospection(uint64(m.LastUsefulAt))
+	}
+	if m.LastSuccessfulOutboundQueryAt != 0 {
+		n += 1 + sovIntrospection(uint64(m.LastSuccessfulOutboundQueryAt))
+	}
+	if m.XXX_unrecognized != nil {
+		n += len(m.XXX_unrecognized)
+	}
+	return n
+}
+
+func (m *Introspection_Lookup) Size() (n int) {
+	if m == nil {
+		return 0
+	}
+	var l int
+	_ = l
+	l = len(m.Id)
+	if l > 0 {
+		n += 1 + l + sovIntrospection(uint64(l))
+	}
+	l = len(m.Operation)
+	if l > 0 {
+		n += 1 + l + sovIntrospection(uint64(l))
+	}
+	l = len(m.Key)
+	if l > 0 {
+		n += 1 + l + sovIntrospection(uint64(l))
+	}
+	if m.StartedAt != 0 {
+		n += 1 + sovIntrospection(uint64(m.StartedAt))
+	}
+	if m.Heard != 0 {
+		n += 1 + sovIntrospection(uint64(m.Heard))
+	}
+	if m.Waiting != 0 {
+		n += 1 + sovIntrospection(uint64(m.Waiting))
+	}
+	if m.Queried != 0 {
+		n += 1 + sovIntrospection(uint64(m.Queried))
+	}
+	if m.Unreachable != 0 {
+		n += 1 + sovIntrospection(uint64(m.Unreachable))
+	}
+	if m.XXX_unrecognized != nil {
+		n += len(m.XXX_unrecognized)
+	}
+	return n
+}
+
+func (m *Introspection_Operation) Size() (n int) {
+	if m == nil {
+		return 0
+	}
+	var l int
+	_ = l
+	l = len(m.Operation)
+	if l > 0 {
+		n += 1 + l + sovIntrospection(uint64(l))
+	}
+	if m.StartedAt != 0 {
+		n += 1 + sovIntrospection(uint64(m.StartedAt))
+	}
+	if m.Duration != 0 {
+		n += 1 + sovIntrospection(uint64(m.Duration))
+	}
+	if m.XXX_unrecognized != nil {
+		n += len(m.XXX_unrecognized)
+	}
+	return n
+}
+
+func sovIntrospection(x uint64) (n int) {
+	return (math_bits.Len64(x|1) + 6) / 7
+}
+func sozIntrospection(x uint64) (n int) {
+	return sovIntrospection(uint64((x << 1) ^ uint64((int64(x) >> 63))))
+}
+func (m *Introspection) Unmarshal(dAtA []byte) error {
+	l := len(dAtA)
+	iNdEx := 0
+	for iNdEx < l {
+		preIndex := iNdEx
+		var wire uint64
+		for shift := uint(0); ; shift += 7 {
+			if shift >= 64 {
+				return ErrIntOverflowIntrospection
+			}
+			if iNdEx >= l {
+				return io.ErrUnexpectedEOF
+			}
+			b := dAtA[iNdEx]
+			iNdEx++
+			wire |= uint64(b&0x7F) << shift
+			if b < 0x80 {
+				break
+			}
+		}
+		fieldNum := int32(wire >> 3)
+		wireType := int(wire & 0x7)
+		if wireType == 4 {
+			return fmt.Errorf("proto: Introspection: wiretype end group for non-group")
+		}
+		if fieldNum <= 0 {
+			return fmt.Errorf("proto: Introspection: illegal tag %d (wire type %d)", fieldNum, wire)
+		}
+		switch fieldNum {
+		case 1:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Self", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowIntrospection
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				byteLen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if byteLen < 0 {
+				return ErrInvalidLengthIntrospection
+			}
+			postIndex := iNdEx + byteLen
+			if postIndex < 0 {
+				return ErrInvalidLengthIntrospection
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Self = append(m.Self[:0], dAtA[iNdEx:postIndex]...)
+			if m.Self == nil {
+				m.Self = []byte{}
+			}
+			iNdEx = postIndex
+		case 2:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Time", wireType)
+			}
+			m.Time = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowIntrospection
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.Time |= int64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 3:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field RoutingTable", wireType)
+			}
+			var msglen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowIntrospection
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				msglen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if msglen < 0 {
+				return ErrInvalidLengthIntrospection
+			}
+			postIndex := iNdEx + msglen
+			if postIndex < 0 {
+				return ErrInvalidLengthIntrospection
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.RoutingTable = append(m.RoutingTable, &Introspection_Peer{})
+			if err := m.RoutingTable[len(m.RoutingTable)-1].Unmarshal(dAtA[iNdEx:postIndex]); err != nil {
+				return err
+			}
+			iNdEx = postIndex
+		case 4:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Lookups", wireType)
+			}
+			var msglen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowIntrospection
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				msglen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if msglen < 0 {
+				return ErrInvalidLengthIntrospection
+			}
+			postIndex := iNdEx + msglen
+			if postIndex < 0 {
+				return ErrInvalidLengthIntrospection
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Lookups = append(m.Lookups, &Introspection_Lookup{})
+			if err := m.Lookups[len(m.Lookups)-1].Unmarshal(dAtA[iNdEx:postIndex]); err != nil {
+				return err
+			}
+			iNdEx = postIndex
+		case 5:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field RecentOperations", wireType)
+			}
+			var msglen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowIntrospection
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				msglen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if msglen < 0 {
+				return ErrInvalidLengthIntrospection
+			}
+			postIndex := iNdEx + msglen
+			if postIndex < 0 {
+				return ErrInvalidLengthIntrospection
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.RecentOperations = append(m.RecentOperations, &Introspection_Operation{})
+			if err := m.RecentOperations[len(m.RecentOperations)-1].Unmarshal(dAtA[iNdEx:postIndex]); err != nil {
+				return err
+			}
+			iNdEx = postIndex
+		default:
+			iNdEx = preIndex
+			skippy, err := skipIntrospection(dAtA[iNdEx:])
+			if err != nil {
+				return err
+			}
+			if (skippy < 0) || (iNdEx+skippy) < 0 {
+				return ErrInvalidLengthIntrospection
+			}
+			if (iNdEx + skippy) > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.XXX_unrecognized = append(m.XXX_unrecognized, dAtA[iNdEx:iNdEx+skippy]...)
+			iNdEx += skippy
+		}
+	}
+
+	if iNdEx > l {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+func (m *Introspection_Peer) Unmarshal(dAtA []byte) error {
+	l := len(dAtA)
+	iNdEx := 0
+	for iNdEx < l {
+		preIndex := iNdEx
+		var wire uint64
+		for shift := uint(0); ; shift += 7 {
+			if shift >= 64 {
+				return ErrIntOverflowIntrospection
+			}
+			if iNdEx >= l {
+				return io.ErrUnexpectedEOF
+			}
+			b := dAtA[iNdEx]
+			iNdEx++
+			wire |= uint64(b&0x7F) << shift
+			if b < 0x80 {
+				break
+			}
+		}
+		fieldNum := int32(wire >> 3)
+		wireType := int(wire & 0x7)
+		if wireType == 4 {
+			return fmt.Errorf("proto: Peer: wiretype end group for non-group")
+		}
+		if fieldNum <= 0 {
+			return fmt.Errorf("proto: Peer: illegal tag %d (wire type %d)", fieldNum, wire)
+		}
+		switch fieldNum {
+		case 1:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Id", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowIntrospection
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				byteLen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if byteLen < 0 {
+				return ErrInvalidLengthIntrospection
+			}
+			postIndex := iNdEx + byteLen
+			if postIndex < 0 {
+				return ErrInvalidLengthIntrospection
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Id = append(m.Id[:0], dAtA[iNdEx:postIndex]...)
+			if m.Id == nil {
+				m.Id = []byte{}
+			}
+			iNdEx = postIndex
+		case 2:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Cpl", wireType)
+			}
+			m.Cpl = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowIntrospection
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.Cpl |= uint32(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 3:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field AddedAt", wireType)
+			}
+			m.AddedAt = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowIntrospection
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.AddedAt |= int64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 4:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field LastUsefulAt", wireType)
+			}
+			m.LastUsefulAt = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowIntrospection
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.LastUsefulAt |= int64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 5:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field LastSuccessfulOutboundQueryAt", wireType)
+			}
+			m.LastSuccessfulOutboundQueryAt = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowIntrospection
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.LastSuccessfulOutboundQueryAt |= int64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		default:
+			iNdEx = preIndex
+			skippy, err := skipIntrospection(dAtA[iNdEx:])
+			if err != nil {
+				return err
+			}
+			if (skippy < 0) || (iNdEx+skippy) < 0 {
+				return ErrInvalidLengthIntrospection
+			}
+			if (iNdEx + skippy) > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.XXX_unrecognized = append(m.XXX_unrecognized, dAtA[iNdEx:iNdEx+skippy]...)
+			iNdEx += skippy
+		}
+	}
+
+	if iNdEx > l {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+func (m *Introspection_Lookup) Unmarshal(dAtA []byte) error {
+	l := len(dAtA)
+	iNdEx := 0
+	for iNdEx < l {
+		preIndex := iNdEx
+		var wire uint64
+		for shift := uint(0); ; shift += 7 {
+			if shift >= 64 {
+				return ErrIntOverflowIntrospection
+			}
+			if iNdEx >= l {
+				return io.ErrUnexpectedEOF
+			}
+			b := dAtA[iNdEx]
+			iNdEx++
+			wire |= uint64(b&0x7F) << shift
+			if b < 0x80 {
+				break
+			}
+		}
+		fieldNum := int32(wire >> 3)
+		wireType := int(wire & 0x7)
+		if wireType == 4 {
+			return fmt.Errorf("proto: Lookup: wiretype end group for non-group")
+		}
+		if fieldNum <= 0 {
+			return fmt.Errorf("proto: Lookup: illegal tag %d (wire type %d)", fieldNum, wire)
+		}
+		switch fieldNum {
+		case 1:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Id", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowIntrospection
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				byteLen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if byteLen < 0 {
+				return ErrInvalidLengthIntrospection
+			}
+			postIndex := iNdEx + byteLen
+			if postIndex < 0 {
+				return ErrInvalidLengthIntrospection
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Id = append(m.Id[:0], dAtA[iNdEx:postIndex]...)
+			if m.Id == nil {
+				m.Id = []byte{}
+			}
+			iNdEx = postIndex
+		case 2:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Operation", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowIntrospection
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				stringLen |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthIntrospection
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex < 0 {
+				return ErrInvalidLengthIntrospection
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Operation = string(dAtA[iNdEx:postIndex])
+			iNdEx = postIndex
+		case 3:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Key", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowIntrospection
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				stringLen |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthIntrospection
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex < 0 {
+				return ErrInvalidLengthIntrospection
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Key = string(dAtA[iNdEx:postIndex])
+			iNdEx = postIndex
+		case 4:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field StartedAt", wireType)
+			}
+			m.StartedAt = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowIntrospection
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.StartedAt |= int64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 5:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Heard", wireType)
+			}
+			m.Heard = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowIntrospection
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.Heard |= uint32(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 6:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Waiting", wireType)
+			}
+			m.Waiting = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowIntrospection
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.Waiting |= uint32(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 7:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Queried", wireType)
+			}
+			m.Queried = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowIntrospection
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.Queried |= uint32(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 8:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Unreachable", wireType)
+			}
+			m.Unreachable = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowIntrospection
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.Unreachable |= uint32(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		default:
+			iNdEx = preIndex
+			skippy, err := skipIntrospection(dAtA[iNdEx:])
+			if err != nil {
+				return err
+			}
+			if (skippy < 0) || (iNdEx+skippy) < 0 {
+				return ErrInvalidLengthIntrospection
+			}
+			if (iNdEx + skippy) > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.XXX_unrecognized = append(m.XXX_unrecognized, dAtA[iNdEx:iNdEx+skippy]...)
+			iNdEx += skippy
+		}
+	}
+
+	if iNdEx > l {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+func (m *Introspection_Operation) Unmarshal(dAtA []byte) error {
+	l := len(dAtA)
+	iNdEx := 0
+	for iNdEx < l {
+		preIndex := iNdEx
+		var wire uint64
+		for shift := uint(0); ; shift += 7 {
+			if shift >= 64 {
+				return ErrIntOverflowIntrospection
+			}
+			if iNdEx >= l {
+				return io.ErrUnexpectedEOF
+			}
+			b := dAtA[iNdEx]
+			iNdEx++
+			wire |= uint64(b&0x7F) << shift
+			if b < 0x80 {
+				break
+			}
+		}
+		fieldNum := int32(wire >> 3)
+		wireType := int(wire & 0x7)
+		if wireType == 4 {
+			return fmt.Errorf("proto: Operation: wiretype end group for non-group")
+		}
+		if fieldNum <= 0 {
+			return fmt.Errorf("proto: Operation: illegal tag %d (wire type %d)", fieldNum, wire)
+		}
+		switch fieldNum {
+		case 1:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Operation", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowIntrospection
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				stringLen |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthIntrospection
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex < 0 {
+				return ErrInvalidLengthIntrospection
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Operation = string(dAtA[iNdEx:postIndex])
+			iNdEx = postIndex
+		case 2:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field StartedAt", wireType)
+			}
+			m.StartedAt = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowIntrospection
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.StartedAt |= int64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 3:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Duration", wireType)
+			}
+			m.Duration = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowIntrospection
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.Duration |= int64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		default:
+			iNdEx = preIndex
+			skippy, err := skipIntrospection(dAtA[iNdEx:])
+			if err != nil {
+				return err
+			}
+			if (skippy < 0) || (iNdEx+skippy) < 0 {
+				return ErrInvalidLengthIntrospection
+			}
+			if (iNdEx + skippy) > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.XXX_unrecognized = append(m.XXX_unrecognized, dAtA[iNdEx:iNdEx+skippy]...)
+			iNdEx += skippy
+		}
+	}
+
+	if iNdEx > l {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+func skipIntrospection(dAtA []byte) (n int, err error) {
+	l := len(dAtA)
+	iNdEx := 0
+	depth := 0
+	for iNdEx < l {
+		var wire uint64
+		for shift := uint(0); ; shift += 7 {
+			if shift >= 64 {
+				return 0, ErrIntOverflowIntrospection
+			}
+			if iNdEx >= l {
+				return 0, io.ErrUnexpectedEOF
+			}
+			b := dAtA[iNdEx]
+			iNdEx++
+			wire |= (uint64(b) & 0x7F) << shift
+			if b < 0x80 {
+				break
+			}
+		}
+		wireType := int(wire & 0x7)
+		switch wireType {
+		case 0:
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return 0, ErrIntOverflowIntrospection
+				}
+				if iNdEx >= l {
+					return 0, io.ErrUnexpectedEOF
+				}
+				iNdEx++
+				if dAtA[iNdEx-1] < 0x80 {
+					break
+				}
+			}
+		case 1:
+			iNdEx += 8
+		case 2:
+			var length int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return 0, ErrIntOverflowIntrospection
+				}
+				if iNdEx >= l {
+					return 0, io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				length |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if length < 0 {
+				return 0, ErrInvalidLengthIntrospection
+			}
+			iNdEx += length
+		case 3:
+			depth++
+		case 4:
+			if depth == 0 {
+				return 0, ErrUnexpectedEndOfGroupIntrospection
+			}
+			depth--
+		case 5:
+			iNdEx += 4
+		default:
+			return 0, fmt.Errorf("proto: illegal wireType %d", wireType)
+		}
+		if iNdEx < 0 {
+			return 0, ErrInvalidLengthIntrospection
+		}
+		if depth == 0 {
+			return iNdEx, nil
+		}
+	}
+	return 0, io.ErrUnexpectedEOF
+}
+
+var (
+	ErrInvalidLengthIntrospection        = fmt.Errorf("proto: negative length found during unmarshaling")
+	ErrIntOverflowIntrospection          = fmt.Errorf("proto: integer overflow")
+	ErrUnexpectedEndOfGroupIntrospection = fmt.Errorf("proto: unexpected end of group")
+)
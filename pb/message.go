@@ -1,6 +1,9 @@
 package dht_pb
 
 import (
+	"fmt"
+	"time"
+
 	"github.com/libp2p/go-libp2p-core/network"
 	"github.com/libp2p/go-libp2p-core/peer"
 
@@ -15,6 +18,18 @@ type PeerRoutingInfo struct {
 	network.Connectedness
 }
 
+// ThrottledError is returned for the requests a peer refused because we
+// exceeded its request rate limit.
+type ThrottledError struct {
+	// RetryAfter is how long the peer asked us to wait before sending more
+	// requests.
+	RetryAfter time.Duration
+}
+
+func (e *ThrottledError) Error() string {
+	return fmt.Sprintf("request throttled by peer, retry after %s", e.RetryAfter)
+}
+
 // NewMessage constructs a new dht message with given type, key, and level
 func NewMessage(typ Message_MessageType, key []byte, level int) *Message {
 	m := &Message{
@@ -0,0 +1,43 @@
+package dht_pb
+
+import (
+	"context"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// ObservedAddrHandler is handed the addresses peers observe us at.
+type ObservedAddrHandler func(observer peer.ID, observed ma.Multiaddr)
+
+// WithObservedAddrHandler hands h the addresses the peers we send requests to
+// tell us they observe us at. Peers only do so for requesters announcing
+// CapObservedAddrs, see WithCapabilities.
+func WithObservedAddrHandler(h ObservedAddrHandler) ProtocolMessengerOption {
+	return func(pm *ProtocolMessenger) error {
+		pm.observedAddrs = h
+		return nil
+	}
+}
+
+// observedAddrSender hands the observed addresses of the responses it gets to
+// its handler.
+type observedAddrSender struct {
+	MessageSender
+	handle ObservedAddrHandler
+}
+
+func (oas *observedAddrSender) SendRequest(ctx context.Context, p peer.ID, pmes *Message) (*Message, error) {
+	resp, err := oas.MessageSender.SendRequest(ctx, p, pmes)
+	if err != nil {
+		return nil, err
+	}
+	if b := resp.GetObservedAddr(); len(b) > 0 {
+		if a, err := ma.NewMultiaddrBytes(b); err == nil {
+			oas.handle(p, a)
+		} else {
+			logger.Debugw("invalid observed address", "from", p, "error", err)
+		}
+	}
+	return resp, nil
+}
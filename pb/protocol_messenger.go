@@ -5,11 +5,16 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"time"
 
 	logging "github.com/ipfs/go-log"
+	"github.com/libp2p/go-libp2p-core/crypto"
 	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
 	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/peerstore"
 	recpb "github.com/libp2p/go-libp2p-record/pb"
+	ma "github.com/multiformats/go-multiaddr"
 	"github.com/multiformats/go-multihash"
 
 	"github.com/libp2p/go-libp2p-kad-dht/internal"
@@ -25,10 +30,52 @@ var logger = logging.Logger("dht")
 // varint-delineated protobufs
 type ProtocolMessenger struct {
 	m MessageSender
+
+	// record compression, only enabled if ps is set
+	ps                peerstore.Peerstore
+	compressThreshold int
+
+	// signs the provider records we put, if set
+	providerKey crypto.PrivKey
+	// advertised in the provider records we put
+	transferProtocols []string
+	// requested validity of the provider records we put, 0 for the default
+	providerTTL time.Duration
+
+	// exchanges capabilities with peers, if set
+	caps *capabilitySender
+	// checks the response signatures with the keys in it, if set
+	verifyResponses peerstore.Peerstore
+	// filters the peer addresses in responses, if set
+	keepAddr func(ma.Multiaddr) bool
+	// sets the deadline hints of our requests
+	deadlineHints bool
+	// number of closer peers we ask for, 0 for the responder's bucket size
+	closerPeersCount int
+	// retries of the mutating requests, and the backoff before the first one
+	mutationRetries int
+	mutationBackoff time.Duration
+	// handles the addresses peers observe us at, if set
+	observedAddrs ObservedAddrHandler
 }
 
 type ProtocolMessengerOption func(*ProtocolMessenger) error
 
+// WithRecordCompression advertises support for compressed record values in the
+// PUT_VALUE and GET_VALUE requests we send, and compresses the record values of
+// at least threshold bytes put to peers known to accept compression. What peers
+// accept is learned from their messages and remembered in ps.
+func WithRecordCompression(threshold int, ps peerstore.Peerstore) ProtocolMessengerOption {
+	return func(pm *ProtocolMessenger) error {
+		if threshold < 0 {
+			return fmt.Errorf("record compression threshold must not be negative, got %d", threshold)
+		}
+		pm.ps = ps
+		pm.compressThreshold = threshold
+		return nil
+	}
+}
+
 // NewProtocolMessenger creates a new ProtocolMessenger that is used for sending DHT messages to peers and processing
 // their responses.
 func NewProtocolMessenger(msgSender MessageSender, opts ...ProtocolMessengerOption) (*ProtocolMessenger, error) {
@@ -41,6 +88,29 @@ func NewProtocolMessenger(msgSender MessageSender, opts ...ProtocolMessengerOpti
 			return nil, err
 		}
 	}
+	if pm.deadlineHints {
+		pm.m = &deadlineSender{MessageSender: pm.m}
+	}
+	// each attempt gets its own deadline hint
+	if pm.mutationRetries > 0 {
+		pm.m = &retryingSender{MessageSender: pm.m, retries: pm.mutationRetries, backoff: pm.mutationBackoff}
+	}
+	if pm.closerPeersCount > 0 {
+		pm.m = &closerPeersCountSender{MessageSender: pm.m, n: pm.closerPeersCount}
+	}
+	if pm.observedAddrs != nil {
+		pm.m = &observedAddrSender{MessageSender: pm.m, handle: pm.observedAddrs}
+	}
+	if pm.caps != nil {
+		pm.caps.MessageSender = pm.m
+		pm.m = pm.caps
+	}
+	if pm.verifyResponses != nil {
+		pm.m = &verifyingSender{MessageSender: pm.m, ps: pm.verifyResponses}
+	}
+	if pm.keepAddr != nil {
+		pm.m = &filteringSender{MessageSender: pm.m, keep: pm.keepAddr}
+	}
 
 	return pm, nil
 }
@@ -55,15 +125,39 @@ type MessageSender interface {
 
 // PutValue asks a peer to store the given key/value pair.
 func (pm *ProtocolMessenger) PutValue(ctx context.Context, p peer.ID, rec *recpb.Record) error {
+	return pm.putValue(ctx, p, rec, 0)
+}
+
+// CacheValue asks a peer to cache a value record found by a lookup for the given
+// ttl. Peers already storing a value for the key keep theirs, peers that don't
+// support caching store the record for as long as any other.
+func (pm *ProtocolMessenger) CacheValue(ctx context.Context, p peer.ID, rec *recpb.Record, ttl time.Duration) error {
+	return pm.putValue(ctx, p, rec, ttl)
+}
+
+func (pm *ProtocolMessenger) putValue(ctx context.Context, p peer.ID, rec *recpb.Record, cacheTTL time.Duration) error {
 	pmes := NewMessage(Message_PUT_VALUE, rec.Key, 0)
 	pmes.Record = rec
+	pmes.CacheTtl = int64(cacheTTL / time.Second)
+	if pm.ps != nil {
+		pmes.AcceptedCompressions = SupportedCompressions
+		if err := CompressRecord(pmes, AcceptedCompressions(pm.ps, p), pm.compressThreshold); err != nil {
+			return err
+		}
+	}
+
 	rpmes, err := pm.m.SendRequest(ctx, p, pmes)
 	if err != nil {
 		logger.Debugw("failed to put value to peer", "to", p, "key", internal.LoggableRecordKeyBytes(rec.Key), "error", err)
 		return err
 	}
+	// the response echoes our request, so it tells us nothing about which
+	// compressions the peer accepts
+	if err := DecompressRecord(rpmes, network.MessageSizeMax); err != nil {
+		return err
+	}
 
-	if !bytes.Equal(rpmes.GetRecord().Value, pmes.GetRecord().Value) {
+	if !bytes.Equal(rpmes.GetRecord().Value, rec.Value) {
 		const errStr = "value not put correctly"
 		logger.Infow(errStr, "put-message", pmes, "get-message", rpmes)
 		return errors.New(errStr)
@@ -76,10 +170,17 @@ func (pm *ProtocolMessenger) PutValue(ctx context.Context, p peer.ID, rec *recpb
 // as described in GetClosestPeers.
 func (pm *ProtocolMessenger) GetValue(ctx context.Context, p peer.ID, key string) (*recpb.Record, []*peer.AddrInfo, error) {
 	pmes := NewMessage(Message_GET_VALUE, []byte(key), 0)
+	if pm.ps != nil {
+		pmes.AcceptedCompressions = SupportedCompressions
+	}
 	respMsg, err := pm.m.SendRequest(ctx, p, pmes)
 	if err != nil {
 		return nil, nil, err
 	}
+	pm.learnCompressions(p, respMsg)
+	if err := DecompressRecord(respMsg, network.MessageSizeMax); err != nil {
+		return nil, nil, err
+	}
 
 	// Perhaps we were given closer peers
 	peers := PBPeersToPeerInfos(respMsg.GetCloserPeers())
@@ -113,6 +214,62 @@ func (pm *ProtocolMessenger) GetClosestPeers(ctx context.Context, p peer.ID, id
 	return peers, nil
 }
 
+// MaxBatchedKeys is the maximum number of additional keys in a batched
+// FIND_NODE request.
+const MaxBatchedKeys = 20
+
+// GetClosestPeersBatch asks a peer for the peers closest to each of the keys,
+// batching up to 1+MaxBatchedKeys keys per FIND_NODE request. The keys the peer
+// didn't answer for, e.g. because it doesn't support batched requests, are
+// asked for one at a time, as are all the keys if the peer is known not to
+// support them, see CapBatchedQueries.
+func (pm *ProtocolMessenger) GetClosestPeersBatch(ctx context.Context, p peer.ID, keys [][]byte) (map[string][]*peer.AddrInfo, error) {
+	out := make(map[string][]*peer.AddrInfo, len(keys))
+	if caps, ok := pm.peerCapabilities(p); ok && !caps.Has(CapBatchedQueries) {
+		for _, key := range keys {
+			peers, err := pm.GetClosestPeers(ctx, p, peer.ID(key))
+			if err != nil {
+				return nil, err
+			}
+			out[string(key)] = peers
+		}
+		return out, nil
+	}
+	for len(keys) > 0 {
+		n := len(keys)
+		if n > 1+MaxBatchedKeys {
+			n = 1 + MaxBatchedKeys
+		}
+		batch := keys[:n]
+		keys = keys[n:]
+
+		pmes := NewMessage(Message_FIND_NODE, batch[0], 0)
+		pmes.Keys = batch[1:]
+		respMsg, err := pm.m.SendRequest(ctx, p, pmes)
+		if err != nil {
+			return nil, err
+		}
+		answered := make(map[string][]*peer.AddrInfo, len(respMsg.GetCloserPeersByKey()))
+		for _, kp := range respMsg.GetCloserPeersByKey() {
+			answered[string(kp.GetKey())] = PBPeersToPeerInfos(kp.GetCloserPeers())
+		}
+		out[string(batch[0])] = PBPeersToPeerInfos(respMsg.GetCloserPeers())
+
+		for _, key := range batch[1:] {
+			if peers, ok := answered[string(key)]; ok {
+				out[string(key)] = peers
+				continue
+			}
+			peers, err := pm.GetClosestPeers(ctx, p, peer.ID(key))
+			if err != nil {
+				return nil, err
+			}
+			out[string(key)] = peers
+		}
+	}
+	return out, nil
+}
+
 // PutProvider asks a peer to store that we are a provider for the given key.
 func (pm *ProtocolMessenger) PutProvider(ctx context.Context, p peer.ID, key multihash.Multihash, host host.Host) error {
 	pi := peer.AddrInfo{
@@ -128,20 +285,68 @@ func (pm *ProtocolMessenger) PutProvider(ctx context.Context, p peer.ID, key mul
 
 	pmes := NewMessage(Message_ADD_PROVIDER, key, 0)
 	pmes.ProviderPeers = RawPeerInfosToPBPeers([]peer.AddrInfo{pi})
+	pmes.ProviderPeers[0].TransferProtocols = pm.transferProtocols
+	pmes.ProviderPeers[0].ProviderTtl = uint32(pm.providerTTL / time.Second)
+	if pm.providerKey != nil {
+		now := time.Now()
+		sig, err := SignProviderTimestamp(pm.providerKey, key, now)
+		if err != nil {
+			return fmt.Errorf("signing provider record: %w", err)
+		}
+		pmes.ProviderPeers[0].SignedAt = now.UnixNano()
+		pmes.ProviderPeers[0].Signature = sig
+	}
+
+	return pm.m.SendMessage(ctx, p, pmes)
+}
+
+// CacheProviders asks a peer to cache the provider records found by a lookup
+// for the given ttl. Only records signed by their provider are sent, the peer
+// has no way to check the others weren't made up.
+func (pm *ProtocolMessenger) CacheProviders(ctx context.Context, p peer.ID, key multihash.Multihash, recs []*ProviderRecord, ttl time.Duration) error {
+	pmes := NewMessage(Message_ADD_PROVIDER, key, 0)
+	pmes.CacheTtl = int64(ttl / time.Second)
+	for _, rec := range recs {
+		if len(rec.Signature) == 0 || len(rec.Addrs) == 0 {
+			continue
+		}
+		pbp := peerInfoToPBPeer(rec.AddrInfo)
+		pbp.TransferProtocols = rec.TransferProtocols
+		pbp.SignedAt = rec.SignedAt.UnixNano()
+		pbp.Signature = rec.Signature
+		pmes.ProviderPeers = append(pmes.ProviderPeers, pbp)
+	}
+	if len(pmes.ProviderPeers) == 0 {
+		return nil
+	}
+
+	return pm.m.SendMessage(ctx, p, pmes)
+}
+
+// RemoveProvider asks a peer to retract the provider record announcing the host
+// as a provider of the given key. Peers that don't support retractions close the
+// stream instead; their copy of the record expires normally.
+func (pm *ProtocolMessenger) RemoveProvider(ctx context.Context, p peer.ID, key multihash.Multihash, host host.Host) error {
+	pmes := NewMessage(Message_REMOVE_PROVIDER, key, 0)
+	pmes.ProviderPeers = RawPeerInfosToPBPeers([]peer.AddrInfo{{ID: host.ID()}})
 
 	return pm.m.SendMessage(ctx, p, pmes)
 }
 
 // GetProviders asks a peer for the providers it knows of for a given key. Also returns the K closest peers to the key
-// as described in GetClosestPeers.
+// as described in GetClosestPeers. Paginated and streamed provider lists are fetched in full.
 func (pm *ProtocolMessenger) GetProviders(ctx context.Context, p peer.ID, key multihash.Multihash) ([]*peer.AddrInfo, []*peer.AddrInfo, error) {
-	pmes := NewMessage(Message_GET_PROVIDERS, key, 0)
-	respMsg, err := pm.m.SendRequest(ctx, p, pmes)
+	var provs, closerPeers []*peer.AddrInfo
+	err := pm.StreamProviderRecords(ctx, p, key, func(recs []*ProviderRecord, closer []*peer.AddrInfo) error {
+		for _, rec := range recs {
+			provs = append(provs, &rec.AddrInfo)
+		}
+		closerPeers = append(closerPeers, closer...)
+		return nil
+	})
 	if err != nil {
 		return nil, nil, err
 	}
-	provs := PBPeersToPeerInfos(respMsg.GetProviderPeers())
-	closerPeers := PBPeersToPeerInfos(respMsg.GetCloserPeers())
 	return provs, closerPeers, nil
 }
 
@@ -157,3 +362,9 @@ func (pm *ProtocolMessenger) Ping(ctx context.Context, p peer.ID) error {
 	}
 	return nil
 }
+
+func (pm *ProtocolMessenger) learnCompressions(p peer.ID, m *Message) {
+	if pm.ps != nil {
+		RememberAcceptedCompressions(pm.ps, p, m)
+	}
+}
@@ -0,0 +1,189 @@
+package dht_pb
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/multiformats/go-multihash"
+)
+
+// providerTimestampPrefix domain separates the provider timestamp signatures
+// from anything else signed with the provider's key.
+const providerTimestampPrefix = "libp2p-kad-dht-provider-timestamp:"
+
+// MaxProviderRecordPages bounds the pages of providers requested from a peer
+// for a key, so that a peer can't keep us paging forever.
+const MaxProviderRecordPages = 64
+
+// ProviderRecord is a provider returned in a GET_PROVIDERS response along with
+// the metadata of its record.
+type ProviderRecord struct {
+	peer.AddrInfo
+
+	// Age is how long ago the responder last received the record, zero if the
+	// responder doesn't report it.
+	Age time.Duration
+
+	// SignedAt is the announcement time signed by the provider, zero if the
+	// record isn't signed. The signature is checked with
+	// VerifyProviderTimestamp.
+	SignedAt  time.Time
+	Signature []byte
+
+	// TransferProtocols are the retrieval protocols the provider advertised.
+	TransferProtocols []string
+
+	// Extensions are the fields of the record unknown to us, see
+	// ReadExtension.
+	Extensions []byte
+}
+
+// WithSignedProviderRecords signs the announcement time of the provider records
+// we put with sk, so peers fetching them can detect replayed stale records.
+func WithSignedProviderRecords(sk crypto.PrivKey) ProtocolMessengerOption {
+	return func(pm *ProtocolMessenger) error {
+		pm.providerKey = sk
+		return nil
+	}
+}
+
+// WithTransferProtocols advertises the given retrieval protocols in the
+// provider records we put.
+func WithTransferProtocols(protos []string) ProtocolMessengerOption {
+	return func(pm *ProtocolMessenger) error {
+		pm.transferProtocols = protos
+		return nil
+	}
+}
+
+// WithProviderRecordTTL asks the peers we put provider records to to keep them
+// for ttl, instead of their default validity.
+func WithProviderRecordTTL(ttl time.Duration) ProtocolMessengerOption {
+	return func(pm *ProtocolMessenger) error {
+		pm.providerTTL = ttl
+		return nil
+	}
+}
+
+// SignProviderTimestamp signs the time t at which the provider announces itself
+// for key.
+func SignProviderTimestamp(sk crypto.PrivKey, key []byte, t time.Time) ([]byte, error) {
+	return sk.Sign(providerTimestampPayload(key, t))
+}
+
+// VerifyProviderTimestamp checks a signature made by SignProviderTimestamp.
+func VerifyProviderTimestamp(pk crypto.PubKey, key []byte, t time.Time, sig []byte) (bool, error) {
+	return pk.Verify(providerTimestampPayload(key, t), sig)
+}
+
+func providerTimestampPayload(key []byte, t time.Time) []byte {
+	buf := make([]byte, 0, len(providerTimestampPrefix)+len(key)+binary.MaxVarintLen64)
+	buf = append(buf, providerTimestampPrefix...)
+	buf = append(buf, key...)
+	scratch := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutVarint(scratch, t.UnixNano())
+	return append(buf, scratch[:n]...)
+}
+
+// GetProviderRecords asks a peer for the providers it knows of for a given key
+// like GetProviders, and also returns the age, signed timestamp and transfer
+// protocols of their records. The signatures are not verified.
+func (pm *ProtocolMessenger) GetProviderRecords(ctx context.Context, p peer.ID, key multihash.Multihash) ([]*ProviderRecord, []*peer.AddrInfo, error) {
+	var (
+		provs       []*ProviderRecord
+		closerPeers []*peer.AddrInfo
+	)
+	err := pm.StreamProviderRecords(ctx, p, key, func(page []*ProviderRecord, closer []*peer.AddrInfo) error {
+		provs = append(provs, page...)
+		closerPeers = append(closerPeers, closer...)
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return provs, closerPeers, nil
+}
+
+// GetProviderRecordsPage asks a peer for a page of the providers it knows of
+// for a given key, like GetProviderRecords. The first page is requested with a
+// nil token, and comes with the closer peers. The returned token, if not nil,
+// requests the next page.
+func (pm *ProtocolMessenger) GetProviderRecordsPage(ctx context.Context, p peer.ID, key multihash.Multihash, token []byte) ([]*ProviderRecord, []*peer.AddrInfo, []byte, error) {
+	var (
+		provs       []*ProviderRecord
+		closerPeers []*peer.AddrInfo
+	)
+	next, err := pm.getProviderRecordsPage(ctx, p, key, token, func(page []*ProviderRecord, closer []*peer.AddrInfo) error {
+		provs = append(provs, page...)
+		closerPeers = append(closerPeers, closer...)
+		return nil
+	})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return provs, closerPeers, next, nil
+}
+
+// StreamProviderRecords asks a peer for the providers it knows of for a given
+// key like GetProviderRecords, and hands them to handle as they arrive: frame by
+// frame from the peers streaming their responses, see CapStreamedProviders, and
+// page by page from the others. The closer peers come with the first call. An
+// error returned by handle aborts the request, and is returned, as does a peer
+// repeating a page token or returning too many pages.
+func (pm *ProtocolMessenger) StreamProviderRecords(ctx context.Context, p peer.ID, key multihash.Multihash, handle func(provs []*ProviderRecord, closerPeers []*peer.AddrInfo) error) error {
+	var token []byte
+	for pages := 0; ; pages++ {
+		if pages == MaxProviderRecordPages {
+			return fmt.Errorf("peer %s returned more than %d pages of providers", p, MaxProviderRecordPages)
+		}
+		next, err := pm.getProviderRecordsPage(ctx, p, key, token, handle)
+		if err != nil || len(next) == 0 {
+			return err
+		}
+		if bytes.Equal(next, token) {
+			return fmt.Errorf("peer %s returned the same page token twice", p)
+		}
+		token = next
+	}
+}
+
+// getProviderRecordsPage requests a page of providers, handing its frames to
+// handle, and returns the token of the next page.
+func (pm *ProtocolMessenger) getProviderRecordsPage(ctx context.Context, p peer.ID, key multihash.Multihash, token []byte, handle func([]*ProviderRecord, []*peer.AddrInfo) error) ([]byte, error) {
+	pmes := NewMessage(Message_GET_PROVIDERS, key, 0)
+	pmes.ProvidersPageToken = token
+	ctx = WithFrameHandler(ctx, func(frame *Message) error {
+		return handle(pbProviderRecords(frame.GetProviderPeers()), PBPeersToPeerInfos(frame.GetCloserPeers()))
+	})
+	respMsg, err := pm.m.SendRequest(ctx, p, pmes)
+	if err != nil {
+		return nil, err
+	}
+	if err := handle(pbProviderRecords(respMsg.GetProviderPeers()), PBPeersToPeerInfos(respMsg.GetCloserPeers())); err != nil {
+		return nil, err
+	}
+	return respMsg.GetProvidersPageToken(), nil
+}
+
+func pbProviderRecords(pbps []Message_Peer) []*ProviderRecord {
+	provs := make([]*ProviderRecord, 0, len(pbps))
+	for _, pbp := range pbps {
+		rec := &ProviderRecord{
+			AddrInfo:          PBPeerToPeerInfo(pbp),
+			Age:               time.Duration(pbp.GetRecordAge()) * time.Second,
+			TransferProtocols: pbp.GetTransferProtocols(),
+			Extensions:        pbp.XXX_unrecognized,
+		}
+		if pbp.SignedAt != 0 && len(pbp.Signature) > 0 {
+			rec.SignedAt = time.Unix(0, pbp.SignedAt)
+			rec.Signature = pbp.Signature
+		}
+		provs = append(provs, rec)
+	}
+	return provs
+}
@@ -0,0 +1,131 @@
+package dht_pb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/peerstore"
+)
+
+// responseSignaturePrefix domain separates the response signatures from
+// anything else signed with the responder's key.
+const responseSignaturePrefix = "libp2p-kad-dht-response:"
+
+// ErrInvalidResponseSignature is returned for responses whose signature doesn't
+// verify, or that aren't signed while their sender announced signing them.
+var ErrInvalidResponseSignature = errors.New("invalid response signature")
+
+// IsSignedResponseType returns whether the responses to requests of type t are
+// signed by peers signing their responses: the ones carrying routing
+// information.
+func IsSignedResponseType(t Message_MessageType) bool {
+	switch t {
+	case Message_FIND_NODE, Message_GET_PROVIDERS:
+		return true
+	}
+	return false
+}
+
+// SignResponse signs the routing information of a response with sk, so that
+// its sender can be held accountable for it.
+func SignResponse(sk crypto.PrivKey, m *Message) error {
+	payload, err := responseSigningPayload(m)
+	if err != nil {
+		return err
+	}
+	m.ResponseSignature, err = sk.Sign(payload)
+	return err
+}
+
+// VerifyResponse checks the signature of a response signed by SignResponse.
+// The response can be kept as proof of the routing information pk's owner
+// served.
+func VerifyResponse(pk crypto.PubKey, m *Message) error {
+	payload, err := responseSigningPayload(m)
+	if err != nil {
+		return err
+	}
+	ok, err := pk.Verify(payload, m.GetResponseSignature())
+	if err != nil || !ok {
+		return ErrInvalidResponseSignature
+	}
+	return nil
+}
+
+// responseSigningPayload returns what the signature of a response covers: the
+// type, the key, and the closer and provider peers.
+func responseSigningPayload(m *Message) ([]byte, error) {
+	signed := Message{
+		Type:             m.Type,
+		Key:              m.Key,
+		CloserPeers:      m.CloserPeers,
+		ProviderPeers:    m.ProviderPeers,
+		CloserPeersByKey: m.CloserPeersByKey,
+	}
+	b, err := signed.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(responseSignaturePrefix), b...), nil
+}
+
+// WithResponseVerification checks the signatures of the FIND_NODE and
+// GET_PROVIDERS responses, failing the requests whose response has an invalid
+// signature, or none while its sender announced signing them, see
+// CapSignedResponses. Public keys are looked up in ps.
+func WithResponseVerification(ps peerstore.Peerstore) ProtocolMessengerOption {
+	return func(pm *ProtocolMessenger) error {
+		pm.verifyResponses = ps
+		return nil
+	}
+}
+
+// verifyingSender checks the signatures of the responses it receives.
+type verifyingSender struct {
+	MessageSender
+	ps peerstore.Peerstore
+}
+
+func (vs *verifyingSender) SendRequest(ctx context.Context, p peer.ID, pmes *Message) (*Message, error) {
+	if !IsSignedResponseType(pmes.GetType()) {
+		return vs.MessageSender.SendRequest(ctx, p, pmes)
+	}
+
+	ctx = wrapFrameHandler(ctx, func(frame *Message) error {
+		return vs.verify(p, pmes.GetType(), frame)
+	})
+	resp, err := vs.MessageSender.SendRequest(ctx, p, pmes)
+	if err != nil {
+		return nil, err
+	}
+	if err := vs.verify(p, pmes.GetType(), resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// verify checks the signature of resp, a response of p to a request of type t.
+func (vs *verifyingSender) verify(p peer.ID, t Message_MessageType, resp *Message) error {
+	if len(resp.GetResponseSignature()) == 0 {
+		if caps, ok := PeerCapabilities(vs.ps, p); ok && caps.Has(CapSignedResponses) {
+			return fmt.Errorf("%w: unsigned response from %s", ErrInvalidResponseSignature, p)
+		}
+		return nil
+	}
+
+	pk := vs.ps.PubKey(p)
+	if pk == nil {
+		var err error
+		if pk, err = p.ExtractPublicKey(); err != nil {
+			return fmt.Errorf("no public key to verify the response of %s: %w", p, err)
+		}
+	}
+	if err := VerifyResponse(pk, resp); err != nil {
+		log.Warnw("response with an invalid signature", "from", p, "type", t)
+		return fmt.Errorf("%w from %s", err, p)
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+package dht_pb
+
+import (
+	"fmt"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// Limits enforced by ValidateRequest.
+const (
+	// MaxRequestKeySize is the size of the largest request key.
+	MaxRequestKeySize = 1024
+	// MaxProviderKeySize is the size of the largest provider record key.
+	MaxProviderKeySize = 80
+	// MaxRequestPeers is the number of providers an ADD_PROVIDER or
+	// REMOVE_PROVIDER request may carry.
+	MaxRequestPeers = 20
+	// MaxPeerAddrs is the number of addresses a peer may be sent with.
+	MaxPeerAddrs = 64
+	// MaxAddrSize is the size of the largest multiaddr.
+	MaxAddrSize = 1024
+	// MaxTransferProtocols is the number of transfer protocols a provider may
+	// announce, each at most MaxTransferProtocolSize long.
+	MaxTransferProtocols    = 16
+	MaxTransferProtocolSize = 256
+	// MaxIdempotencyTokenSize is the size of the largest idempotency token.
+	MaxIdempotencyTokenSize = 32
+)
+
+// The reasons requests are rejected for by ValidateRequest.
+const (
+	RejectUnknownType     = "unknown_type"
+	RejectKey             = "key"
+	RejectTooManyKeys     = "too_many_keys"
+	RejectRecord          = "record"
+	RejectTooManyPeers    = "too_many_peers"
+	RejectPeerID          = "peer_id"
+	RejectTooManyAddrs    = "too_many_addrs"
+	RejectMultiaddr       = "multiaddr"
+	RejectFieldLength     = "field_length"
+	RejectUnexpectedField = "unexpected_field"
+)
+
+// ValidationError is returned by ValidateRequest for the requests it rejects.
+type ValidationError struct {
+	// Reason is one of the Reject constants, e.g. RejectPeerID.
+	Reason string
+	Err    error
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("invalid request (%s): %s", e.Reason, e.Err)
+}
+
+func invalid(reason string, format string, args ...interface{}) error {
+	return &ValidationError{Reason: reason, Err: fmt.Errorf(format, args...)}
+}
+
+// ValidateRequest checks that m is a well formed request before it is handled:
+// its fields are within the limits above, the peer IDs and multiaddrs it
+// carries decode, and it carries none of the fields only found in responses.
+// It returns a *ValidationError otherwise.
+func ValidateRequest(m *Message) error {
+	typ := m.GetType()
+	if _, ok := Message_MessageType_name[int32(typ)]; !ok {
+		return invalid(RejectUnknownType, "unknown message type %d", typ)
+	}
+
+	key := m.GetKey()
+	switch typ {
+	case Message_PING:
+	case Message_ADD_PROVIDER, Message_GET_PROVIDERS, Message_REMOVE_PROVIDER:
+		if len(key) == 0 || len(key) > MaxProviderKeySize {
+			return invalid(RejectKey, "provider key of %d bytes", len(key))
+		}
+	default:
+		if len(key) == 0 || len(key) > MaxRequestKeySize {
+			return invalid(RejectKey, "key of %d bytes", len(key))
+		}
+	}
+
+	if len(m.GetKeys()) > 0 && typ != Message_FIND_NODE {
+		return invalid(RejectUnexpectedField, "batched keys in a %s request", typ)
+	}
+	if len(m.GetKeys()) > MaxBatchedKeys {
+		return invalid(RejectTooManyKeys, "%d batched keys", len(m.GetKeys()))
+	}
+	for _, k := range m.GetKeys() {
+		if len(k) == 0 || len(k) > MaxRequestKeySize {
+			return invalid(RejectKey, "batched key of %d bytes", len(k))
+		}
+	}
+
+	rec := m.GetRecord()
+	switch {
+	case typ == Message_PUT_VALUE && rec == nil:
+		return invalid(RejectRecord, "PUT_VALUE without a record")
+	case typ == Message_PUT_VALUE && string(rec.GetKey()) != string(key):
+		return invalid(RejectRecord, "record key doesn't match the request key")
+	case typ != Message_PUT_VALUE && rec != nil:
+		return invalid(RejectUnexpectedField, "record in a %s request", typ)
+	}
+
+	if len(m.GetCloserPeers()) > 0 || len(m.GetCloserPeersByKey()) > 0 ||
+		m.GetRetryAfterMs() != 0 || len(m.GetResponseSignature()) > 0 || len(m.GetObservedAddr()) > 0 {
+		return invalid(RejectUnexpectedField, "response fields in a %s request", typ)
+	}
+	if len(m.GetProvidersPageToken()) > 0 && typ != Message_GET_PROVIDERS {
+		return invalid(RejectUnexpectedField, "page token in a %s request", typ)
+	}
+	if len(m.GetProvidersPageToken()) > MaxRequestKeySize {
+		return invalid(RejectFieldLength, "page token of %d bytes", len(m.GetProvidersPageToken()))
+	}
+
+	if len(m.GetIdempotencyToken()) > 0 && typ != Message_PUT_VALUE && typ != Message_ADD_PROVIDER {
+		return invalid(RejectUnexpectedField, "idempotency token in a %s request", typ)
+	}
+	if len(m.GetIdempotencyToken()) > MaxIdempotencyTokenSize {
+		return invalid(RejectFieldLength, "idempotency token of %d bytes", len(m.GetIdempotencyToken()))
+	}
+
+	providers := m.GetProviderPeers()
+	if len(providers) > 0 && typ != Message_ADD_PROVIDER && typ != Message_REMOVE_PROVIDER {
+		return invalid(RejectUnexpectedField, "providers in a %s request", typ)
+	}
+	if len(providers) > MaxRequestPeers {
+		return invalid(RejectTooManyPeers, "%d providers", len(providers))
+	}
+	for i := range providers {
+		if err := validatePeer(&providers[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validatePeer(p *Message_Peer) error {
+	if _, err := peer.IDFromBytes([]byte(p.Id)); err != nil {
+		return invalid(RejectPeerID, "%s", err)
+	}
+	if len(p.Addrs) > MaxPeerAddrs {
+		return invalid(RejectTooManyAddrs, "%d addresses", len(p.Addrs))
+	}
+	for _, b := range p.Addrs {
+		if len(b) > MaxAddrSize {
+			return invalid(RejectFieldLength, "address of %d bytes", len(b))
+		}
+		if _, err := ma.NewMultiaddrBytes(b); err != nil {
+			return invalid(RejectMultiaddr, "%s", err)
+		}
+	}
+	if len(p.TransferProtocols) > MaxTransferProtocols {
+		return invalid(RejectFieldLength, "%d transfer protocols", len(p.TransferProtocols))
+	}
+	for _, proto := range p.TransferProtocols {
+		if len(proto) == 0 || len(proto) > MaxTransferProtocolSize {
+			return invalid(RejectFieldLength, "transfer protocol of %d bytes", len(proto))
+		}
+	}
+	if len(p.Signature) > MaxAddrSize {
+		return invalid(RejectFieldLength, "signature of %d bytes", len(p.Signature))
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package dht
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru/simplelru"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+const (
+	// peerStatsSize is the number of remote peers whose stats are kept.
+	peerStatsSize = 4096
+	// peerStatsAlpha is the weight of the last request in the success rate,
+	// as for the latency EWMA of the peerstore.
+	peerStatsAlpha = 0.1
+)
+
+// PeerStats describes the requests we sent to a remote peer, see
+// IpfsDHT.PeerStats.
+type PeerStats struct {
+	// RTT is the moving average of the round trip time of the requests
+	// answered by the peer, zero if unknown.
+	RTT time.Duration
+	// TimeToFirstByte is the moving average of the time it took for the
+	// first byte of the responses of the peer to arrive, zero if unknown. It
+	// is high for slow peers, while the rest of the RTT, the time taken to
+	// transfer the responses, is high on slow networks.
+	TimeToFirstByte time.Duration
+	// SuccessRate is the moving average of the fraction of the requests
+	// answered by the peer, in [0, 1].
+	SuccessRate float64
+	// Requests is the number of requests sent to the peer.
+	Requests int
+	// Unhelpful is the number of responses of the peer that didn't refer our
+	// lookups to any new peer closer to the key, see LookupSummary.Unhelpful.
+	Unhelpful int
+	// LastError is the error failing the last request that failed, if any,
+	// at LastErrorAt.
+	LastError   error
+	LastErrorAt time.Time
+}
+
+// peerStats keeps the stats of the remote peers we last sent requests to.
+type peerStats struct {
+	mu    sync.Mutex
+	peers *lru.LRU
+}
+
+func newPeerStats() *peerStats {
+	// can only fail on a non-positive size
+	peers, _ := lru.NewLRU(peerStatsSize, nil)
+	return &peerStats{peers: peers}
+}
+
+// record records the outcome of a request sent to p, nil if answered after
+// firstByte. The requests we gave up on aren't accounted for, and the RTT is
+// already in the peerstore.
+func (ps *peerStats) record(p peer.ID, firstByte, _ time.Duration, err error) {
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	var s *PeerStats
+	if v, ok := ps.peers.Get(p); ok {
+		s = v.(*PeerStats)
+	} else {
+		// the first request sets the rate
+		s = &PeerStats{SuccessRate: 1}
+		if err != nil {
+			s.SuccessRate = 0
+		}
+		ps.peers.Add(p, s)
+	}
+
+	s.Requests++
+	success := 1.0
+	if err != nil {
+		success = 0
+		s.LastError = err
+		s.LastErrorAt = time.Now()
+	} else if s.TimeToFirstByte == 0 {
+		s.TimeToFirstByte = firstByte
+	} else {
+		s.TimeToFirstByte = time.Duration((1-peerStatsAlpha)*float64(s.TimeToFirstByte) + peerStatsAlpha*float64(firstByte))
+	}
+	s.SuccessRate = (1-peerStatsAlpha)*s.SuccessRate + peerStatsAlpha*success
+}
+
+// recordUnhelpful records an unhelpful response of p to a lookup.
+func (ps *peerStats) recordUnhelpful(p peer.ID) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	// the request it answered was recorded
+	if v, ok := ps.peers.Get(p); ok {
+		v.(*PeerStats).Unhelpful++
+	}
+}
+
+func (ps *peerStats) get(p peer.ID) PeerStats {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if v, ok := ps.peers.Peek(p); ok {
+		return *v.(*PeerStats)
+	}
+	return PeerStats{}
+}
+
+// PeerStats returns the stats of the requests we sent to p, the zero
+// PeerStats but for the RTT if we didn't send any lately.
+func (dht *IpfsDHT) PeerStats(p peer.ID) PeerStats {
+	s := dht.peerStats.get(p)
+	s.RTT = dht.peerstore.LatencyEWMA(p)
+	return s
+}
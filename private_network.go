@@ -0,0 +1,44 @@
+package dht
+
+import (
+	"strings"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
+
+	dhtcfg "github.com/libp2p/go-libp2p-kad-dht/internal/config"
+)
+
+// PrivateNetworkPrefix replaces the /ipfs prefix of the DHT protocols in a
+// private network, see PrivateNetworkProtocols.
+const PrivateNetworkPrefix protocol.ID = "/pnet"
+
+// applyPrivateNetworkProfile adapts cfg to a private network, see
+// PrivateNetworkProfile. With PrivateNetworkProtocols, the protocols starting
+// with the /ipfs prefix move under PrivateNetworkPrefix.
+func applyPrivateNetworkProfile(cfg *dhtcfg.Config) {
+	prefix := string(cfg.ProtocolPrefix)
+	if cfg.PrivateNetworkProtocols && cfg.V1ProtocolOverride == "" && (prefix == string(DefaultPrefix) || strings.HasPrefix(prefix, string(DefaultPrefix)+"/")) {
+		cfg.ProtocolPrefix = PrivateNetworkPrefix + protocol.ID(strings.TrimPrefix(prefix, string(DefaultPrefix)))
+	}
+
+	if bootstrapPeers := cfg.BootstrapPeers; bootstrapPeers != nil {
+		public := make(map[peer.ID]struct{})
+		for _, ai := range GetDefaultBootstrapPeerAddrInfos() {
+			public[ai.ID] = struct{}{}
+		}
+		cfg.BootstrapPeers = func() []peer.AddrInfo {
+			var private []peer.AddrInfo
+			for _, ai := range bootstrapPeers() {
+				if _, ok := public[ai.ID]; !ok {
+					private = append(private, ai)
+				}
+			}
+			return private
+		}
+	}
+}
+
+func (dht *IpfsDHT) inPrivateNetwork() bool {
+	return dht.privateNetwork
+}
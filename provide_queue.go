@@ -0,0 +1,112 @@
+package dht
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/multiformats/go-multihash"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/tag"
+
+	"github.com/libp2p/go-libp2p-kad-dht/metrics"
+)
+
+// provideStage bounds the number of concurrent operations of one stage of the
+// provide pipeline. A nil stage is unbounded.
+type provideStage struct {
+	name   string
+	slots  chan struct{}
+	queued int64 // atomic
+}
+
+func newProvideStage(name string, limit int) *provideStage {
+	if limit == 0 {
+		return nil
+	}
+	return &provideStage{name: name, slots: make(chan struct{}, limit)}
+}
+
+// acquire waits for a free slot, and returns the function releasing it.
+func (s *provideStage) acquire(ctx context.Context) (func(), error) {
+	if s == nil {
+		return func() {}, nil
+	}
+
+	select {
+	case s.slots <- struct{}{}:
+		return s.release, nil
+	default:
+	}
+
+	ctx, _ = tag.New(ctx, tag.Upsert(metrics.KeyProvideStage, s.name))
+	start := time.Now()
+	stats.Record(ctx, metrics.ProvideQueueDepth.M(atomic.AddInt64(&s.queued, 1)))
+	defer func() {
+		stats.Record(ctx,
+			metrics.ProvideQueueDepth.M(atomic.AddInt64(&s.queued, -1)),
+			metrics.ProvideQueueWait.M(float64(time.Since(start))/float64(time.Millisecond)),
+		)
+	}()
+
+	select {
+	case s.slots <- struct{}{}:
+		return s.release, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (s *provideStage) release() {
+	<-s.slots
+}
+
+func (s *provideStage) stats() ProvideStageStats {
+	if s == nil {
+		return ProvideStageStats{}
+	}
+	return ProvideStageStats{
+		Queued:   int(atomic.LoadInt64(&s.queued)),
+		InFlight: len(s.slots),
+		Limit:    cap(s.slots),
+	}
+}
+
+// getProvidePeers finds the replica peers of a provider record key once a
+// lookup slot is free.
+func (dht *IpfsDHT) getProvidePeers(ctx context.Context, keyMH multihash.Multihash) ([]peer.ID, error) {
+	release, err := dht.provideLookups.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return dht.getReplicaPeers(ctx, string(keyMH))
+}
+
+// ProvideStageStats describes the load of one stage of the provide pipeline.
+type ProvideStageStats struct {
+	// Queued is the number of operations waiting for a free slot.
+	Queued int
+	// InFlight is the number of operations running.
+	InFlight int
+	// Limit is the maximum number of operations running at once, 0 if
+	// unbounded.
+	Limit int
+}
+
+// ProvideQueueStats describes the load of the provide pipeline, see
+// ProvideConcurrency.
+type ProvideQueueStats struct {
+	Lookups ProvideStageStats
+	RPCs    ProvideStageStats
+}
+
+// ProvideQueueStats returns the current load of the provide pipeline. Stages
+// without a concurrency limit report no load.
+func (dht *IpfsDHT) ProvideQueueStats() ProvideQueueStats {
+	return ProvideQueueStats{
+		Lookups: dht.provideLookups.stats(),
+		RPCs:    dht.provideRPCs.stats(),
+	}
+}
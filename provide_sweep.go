@@ -0,0 +1,311 @@
+package dht
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/big"
+	"sort"
+	"sync"
+
+	u "github.com/ipfs/go-ipfs-util"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/routing"
+	kb "github.com/libp2p/go-libp2p-kbucket"
+	"github.com/multiformats/go-multihash"
+
+	"github.com/libp2p/go-libp2p-kad-dht/internal"
+	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
+)
+
+// sweepCandidatesFactor is how many times the replication factor of peers are
+// looked up for each region of the keyspace swept by ProvideMany. A wider
+// candidate set can be reused for more of the following keys.
+const sweepCandidatesFactor = 2
+
+// sweepRegion is a set of peers known to contain every peer within radius of
+// target. A nil radius means the set contains every peer in the network.
+type sweepRegion struct {
+	target kb.ID
+	peers  []peer.ID
+	radius *big.Int
+}
+
+// closestPeers returns the count closest peers to key if they are guaranteed to
+// be in the region.
+func (r *sweepRegion) closestPeers(key kb.ID, count int) ([]peer.ID, bool) {
+	closest := kb.SortClosestPeers(r.peers, key)
+	if len(closest) > count {
+		closest = closest[:count]
+	}
+	if r.radius == nil || len(closest) == 0 {
+		return closest, true
+	}
+
+	// every peer p at most as far from key as the farthest of the closest
+	// peers is also within farthest + d(target, key) of target, since
+	// d(target, p) = d(key, p) XOR d(target, key) <= d(key, p) + d(target, key).
+	farthest := xorDistance(key, kb.ConvertPeerID(closest[len(closest)-1]))
+	bound := farthest.Add(farthest, xorDistance(key, r.target))
+	return closest, bound.Cmp(r.radius) <= 0
+}
+
+func xorDistance(a, b kb.ID) *big.Int {
+	return new(big.Int).SetBytes(u.XOR(a, b))
+}
+
+// widenRegion asks the peers of region closest to its target for the closest
+// peers of keys, in batched FIND_NODE requests, and adds the peers they know of
+// to the region. The region still contains every peer within its radius, but
+// knowing more of the peers around keys lets it cover more of them, saving
+// their lookups. Peers that don't support batched requests are asked for one
+// key at a time.
+func (dht *IpfsDHT) widenRegion(ctx context.Context, region *sweepRegion, keys [][]byte) {
+	asked := kb.SortClosestPeers(region.peers, region.target)
+	if len(asked) > dht.alpha {
+		asked = asked[:dht.alpha]
+	}
+
+	var mu sync.Mutex
+	known := make(map[peer.ID]struct{}, len(region.peers))
+	for _, p := range region.peers {
+		known[p] = struct{}{}
+	}
+	wg := sync.WaitGroup{}
+	for _, p := range asked {
+		wg.Add(1)
+		go func(p peer.ID) {
+			defer wg.Done()
+			closer, err := dht.protoMessenger.GetClosestPeersBatch(ctx, p, keys)
+			if err != nil {
+				logger.Debugw("failed to widen sweep region", "peer", p, "error", err)
+				return
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			for _, infos := range closer {
+				for _, ai := range infos {
+					if _, ok := known[ai.ID]; ok || ai.ID == dht.self || !dht.queryPeerFilter(dht, *ai) {
+						continue
+					}
+					known[ai.ID] = struct{}{}
+					dht.addCandidateAddrs(ai.ID, ai.Addrs)
+					region.peers = append(region.peers, ai.ID)
+				}
+			}
+		}(p)
+	}
+	wg.Wait()
+}
+
+// ProvideMany announces this node as a provider of all the given keys.
+//
+// Rather than running one lookup per key, the keys are swept in keyspace order.
+// The lookup run for a key finds a wider set of candidate peers than needed,
+// which the closest of them widen with the peers they know around the next
+// keys in batched requests, and the following keys reuse it for as long as
+// their closest peers are guaranteed to be among the candidates. Consecutive
+// keys thus share most of their closest peers, and each of these peers is sent
+// all its provider records over the same stream. This makes reproviding large
+// numbers of keys much cheaper than calling Provide for each of them.
+//
+// While the DHT has no peers, the keys are queued as described for OfflineQueue
+// instead. An error is returned if the closest peers of some keys could not be
+// found.
+func (dht *IpfsDHT) ProvideMany(ctx context.Context, keys []multihash.Multihash) error {
+	_, err := dht.ProvideManyWithResult(ctx, keys)
+	return err
+}
+
+// ProvideManyWithResult works like ProvideMany but also reports which peers
+// were sent all their provider records. Peers that could not be sent them
+// because no provide RPC slot freed up in time are reported as failed with
+// ErrNoProvideSlot.
+func (dht *IpfsDHT) ProvideManyWithResult(ctx context.Context, keys []multihash.Multihash) (*PutResult, error) {
+	if !dht.enableProviders {
+		return nil, routing.ErrNotSupported
+	}
+	ctx, done, err := dht.drainer.enter(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	logger.Debugw("providing many", "count", len(keys))
+
+	sweepKeys := make([]string, 0, len(keys))
+	for _, k := range keys {
+		dht.setUnprovided(false, k)
+		k = dht.providerKey(k)
+		// add self locally
+		dht.providerStore.AddProvider(ctx, k, peer.AddrInfo{ID: dht.self})
+		sweepKeys = append(sweepKeys, string(k))
+	}
+
+	if dht.queueOffline() {
+		logger.Debugw("no peers, queueing provides", "count", len(keys))
+		for _, k := range sweepKeys {
+			if err := dht.enqueueOffline(ctx, offlineProvidesKey, []byte(k)); err != nil {
+				return nil, err
+			}
+		}
+		return nil, nil
+	}
+
+	swept, sweepErr := dht.sweepClosestPeers(ctx, sweepKeys, dht.provideLookups)
+	if swept == nil {
+		return nil, sweepErr
+	}
+	peerKeys := make(map[peer.ID][]multihash.Multihash, len(swept))
+	for p, ks := range swept {
+		for _, k := range ks {
+			peerKeys[p] = append(peerKeys[p], multihash.Multihash(k))
+		}
+	}
+
+	var resLk sync.Mutex
+	res := &PutResult{Failed: make(map[peer.ID]error)}
+	wg := sync.WaitGroup{}
+	sem := make(chan struct{}, putManyParallelism)
+	for p, pks := range peerKeys {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(p peer.ID, pks []multihash.Multihash) {
+			defer func() { <-sem }()
+			defer wg.Done()
+
+			err := dht.putProvidersToPeer(ctx, p, pks)
+			resLk.Lock()
+			defer resLk.Unlock()
+			if err != nil {
+				res.Failed[p] = err
+			} else {
+				res.Succeeded = append(res.Succeeded, p)
+			}
+		}(p, pks)
+	}
+	wg.Wait()
+
+	if sweepErr != nil {
+		return res, sweepErr
+	}
+	return res, ctx.Err()
+}
+
+// sweepClosestPeers finds the closest peers of every key, sweeping the keys in
+// keyspace order as described for ProvideMany, and returns the keys each peer
+// is responsible for. The lookups wait for a slot of stage, if not nil. The
+// keys found are returned along with an error if the closest peers of some
+// keys could not be found, and none if the context ends first.
+func (dht *IpfsDHT) sweepClosestPeers(ctx context.Context, keys []string, stage *provideStage) (map[peer.ID][]string, error) {
+	type sweepKey struct {
+		key string
+		id  kb.ID
+	}
+	sorted := make([]sweepKey, 0, len(keys))
+	for _, k := range keys {
+		sorted = append(sorted, sweepKey{key: k, id: kb.ConvertKey(k)})
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return bytes.Compare(sorted[i].id, sorted[j].id) < 0
+	})
+
+	var (
+		region      *sweepRegion
+		lookups     int
+		failedKeys  int
+		firstLookup error
+		peerKeys    = make(map[peer.ID][]string)
+	)
+	for i, k := range sorted {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		var peers []peer.ID
+		ok := false
+		if region != nil {
+			peers, ok = region.closestPeers(k.id, dht.replicationFactor)
+		}
+		if !ok {
+			n := sweepCandidatesFactor * dht.replicationFactor
+			var candidates []peer.ID
+			release, err := stage.acquire(ctx)
+			if err == nil {
+				candidates, err = dht.getClosestPeers(ctx, k.key, n)
+				release()
+			}
+			lookups++
+			if err != nil {
+				failedKeys++
+				if firstLookup == nil {
+					firstLookup = err
+				}
+				region = nil
+				peers = candidates
+				if len(peers) > dht.replicationFactor {
+					peers = kb.SortClosestPeers(peers, k.id)[:dht.replicationFactor]
+				}
+			} else {
+				region = &sweepRegion{target: k.id, peers: candidates}
+				if len(candidates) >= n {
+					// the lookup only guarantees the candidates are the
+					// closest peers up to the farthest of them
+					region.radius = xorDistance(k.id, kb.ConvertPeerID(kb.SortClosestPeers(candidates, k.id)[len(candidates)-1]))
+				}
+				peers, _ = region.closestPeers(k.id, dht.replicationFactor)
+
+				if region.radius != nil {
+					// the next keys the region doesn't cover yet
+					var next [][]byte
+					for _, nk := range sorted[i+1:] {
+						if len(next) > pb.MaxBatchedKeys {
+							break
+						}
+						if _, ok := region.closestPeers(nk.id, dht.replicationFactor); !ok {
+							next = append(next, []byte(nk.key))
+						}
+					}
+					if len(next) > 0 {
+						dht.widenRegion(ctx, region, next)
+					}
+				}
+			}
+		}
+
+		for _, p := range peers {
+			peerKeys[p] = append(peerKeys[p], k.key)
+		}
+	}
+
+	logger.Debugw("swept keyspace", "keys", len(sorted), "lookups", lookups, "peers", len(peerKeys))
+
+	if failedKeys > 0 {
+		return peerKeys, fmt.Errorf("failed to find the closest peers of %d out of %d keys: %w", failedKeys, len(sorted), firstLookup)
+	}
+	return peerKeys, nil
+}
+
+// putProvidersToPeer sends all the provider records in keys to p over the same
+// stream. The last error is returned if some of them could not be sent.
+func (dht *IpfsDHT) putProvidersToPeer(ctx context.Context, p peer.ID, keys []multihash.Multihash) error {
+	release, err := dht.provideRPCs.acquire(ctx)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrNoProvideSlot, err)
+	}
+	defer release()
+
+	var lastErr error
+	for _, k := range keys {
+		logger.Debugf("putProvider(%s, %s)", internal.LoggableProviderRecordBytes(k), p)
+		if err := dht.protoMessenger.PutProvider(ctx, p, k, dht.host); err != nil {
+			logger.Debug(err)
+			lastErr = err
+			if ctx.Err() != nil {
+				return err
+			}
+		}
+	}
+	return lastErr
+}
@@ -0,0 +1,28 @@
+package dht
+
+import (
+	"github.com/multiformats/go-multihash"
+)
+
+// doubleHashPrefix domain separates double-hashed provider keys.
+const doubleHashPrefix = "CR_DOUBLEHASH"
+
+// DoubleHashProviderKey returns the key provider records for mh are stored
+// under when double hashing is enabled, i.e. the SHA2-256 multihash of mh
+// prefixed with "CR_DOUBLEHASH". It can't be reversed to learn mh.
+func DoubleHashProviderKey(mh multihash.Multihash) multihash.Multihash {
+	buf := make([]byte, 0, len(doubleHashPrefix)+len(mh))
+	buf = append(buf, doubleHashPrefix...)
+	buf = append(buf, mh...)
+	// can only fail for unknown hash functions
+	dh, _ := multihash.Sum(buf, multihash.SHA2_256, -1)
+	return dh
+}
+
+// providerKey returns the key provider records for mh are stored under.
+func (dht *IpfsDHT) providerKey(mh multihash.Multihash) multihash.Multihash {
+	if dht.doubleHashProviders {
+		return DoubleHashProviderKey(mh)
+	}
+	return mh
+}
@@ -0,0 +1,124 @@
+package dht
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru/simplelru"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/tag"
+
+	"github.com/libp2p/go-libp2p-kad-dht/metrics"
+)
+
+// providerRateLimitEntries is the number of peers and of keys whose provider
+// rate is tracked. The least recently seen are forgotten first.
+const providerRateLimitEntries = 4096
+
+// tokenBucket allows up to burst events at once, refilled at rate per second.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// refill adds the tokens accrued since the last event.
+func (b *tokenBucket) refill(now time.Time, rate float64, burst int) {
+	b.tokens = math.Min(float64(burst), b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+}
+
+// providerRateLimiter limits the rate at which inbound provider records are
+// accepted per source peer and per key.
+type providerRateLimiter struct {
+	peerRate  float64
+	peerBurst int
+	keyRate   float64
+	keyBurst  int
+
+	mu    sync.Mutex
+	peers *lru.LRU
+	keys  *lru.LRU
+}
+
+// newProviderRateLimiter returns a rate limiter with the given limits, a zero
+// rate disabling the corresponding limit. It returns nil if both are disabled.
+func newProviderRateLimiter(peerRate float64, peerBurst int, keyRate float64, keyBurst int) *providerRateLimiter {
+	if peerRate == 0 && keyRate == 0 {
+		return nil
+	}
+
+	// can only fail on a non-positive size
+	peers, _ := lru.NewLRU(providerRateLimitEntries, nil)
+	keys, _ := lru.NewLRU(providerRateLimitEntries, nil)
+	return &providerRateLimiter{
+		peerRate:  peerRate,
+		peerBurst: peerBurst,
+		keyRate:   keyRate,
+		keyBurst:  keyBurst,
+		peers:     peers,
+		keys:      keys,
+	}
+}
+
+// allow reports whether a provider record for key announced by p is within
+// the limits, recording which limit was hit otherwise.
+func (rl *providerRateLimiter) allow(ctx context.Context, p peer.ID, key []byte) bool {
+	if rl == nil {
+		return true
+	}
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	// both limits are checked before taking a token from either, so that
+	// records refused for their key don't count against their sender
+	now := time.Now()
+	var peerBucket, keyBucket *tokenBucket
+	if rl.peerRate > 0 {
+		peerBucket = rl.bucket(rl.peers, string(p), now, rl.peerBurst)
+		if peerBucket.refill(now, rl.peerRate, rl.peerBurst); peerBucket.tokens < 1 {
+			recordProviderRateLimited(ctx, "peer")
+			return false
+		}
+	}
+	if rl.keyRate > 0 {
+		keyBucket = rl.bucket(rl.keys, string(key), now, rl.keyBurst)
+		if keyBucket.refill(now, rl.keyRate, rl.keyBurst); keyBucket.tokens < 1 {
+			recordProviderRateLimited(ctx, "key")
+			return false
+		}
+	}
+	for _, b := range []*tokenBucket{peerBucket, keyBucket} {
+		if b != nil {
+			b.tokens--
+		}
+	}
+	return true
+}
+
+func (rl *providerRateLimiter) bucket(buckets *lru.LRU, k string, now time.Time, burst int) *tokenBucket {
+	if b, ok := buckets.Get(k); ok {
+		return b.(*tokenBucket)
+	}
+	b := &tokenBucket{tokens: float64(burst), last: now}
+	buckets.Add(k, b)
+	return b
+}
+
+func recordProviderRateLimited(ctx context.Context, limit string) {
+	_ = stats.RecordWithTags(ctx,
+		[]tag.Mutator{tag.Upsert(metrics.KeyRateLimit, limit)},
+		metrics.RateLimitedProviderRecords.M(1),
+	)
+}
+
+// wait returns how long until the bucket allows an event.
+func (b *tokenBucket) wait(rate float64) time.Duration {
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / rate * float64(time.Second))
+}
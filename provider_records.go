@@ -0,0 +1,207 @@
+package dht
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
+	"github.com/libp2p/go-libp2p-kad-dht/providers"
+)
+
+// maxProviderClockSkew is how far in the future a signed provider timestamp may
+// be, to account for clock differences between peers.
+const maxProviderClockSkew = time.Minute
+
+var errStaleProviderRecord = errors.New("signed provider record is stale")
+
+// Well known retrieval protocols advertised in provider records, see
+// ProviderTransferProtocols.
+const (
+	TransferBitswap   = "bitswap"
+	TransferGraphsync = "graphsync"
+	TransferHTTP      = "http"
+)
+
+const (
+	maxTransferProtocols   = 8
+	maxTransferProtocolLen = 64
+)
+
+// ProviderInfo is a provider found by FindProviderInfosAsync along with the
+// retrieval protocols it advertised.
+type ProviderInfo struct {
+	peer.AddrInfo
+
+	// TransferProtocols are the retrieval protocols the provider advertised,
+	// empty if it advertised none.
+	TransferProtocols []string
+
+	// Delegated is the delegated routing endpoint the provider was found
+	// through, empty if found through the DHT, see DelegatedRoutingFallback.
+	Delegated string
+}
+
+func checkTransferProtocols(protos []string) error {
+	if len(protos) > maxTransferProtocols {
+		return fmt.Errorf("at most %d transfer protocols can be advertised, got %d", maxTransferProtocols, len(protos))
+	}
+	for _, proto := range protos {
+		if len(proto) == 0 || len(proto) > maxTransferProtocolLen {
+			return fmt.Errorf("invalid transfer protocol name %q", proto)
+		}
+	}
+	return nil
+}
+
+// checkProviderTimestamp verifies the announcement time signed by provider p
+// for key, and that it is neither older than the provider record validity nor
+// in the future.
+func (dht *IpfsDHT) checkProviderTimestamp(p peer.ID, key []byte, signedAt time.Time, sig []byte) error {
+	pk := dht.peerstore.PubKey(p)
+	if pk == nil {
+		return fmt.Errorf("no public key for provider %s", p)
+	}
+	ok, err := pb.VerifyProviderTimestamp(pk, key, signedAt, sig)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("invalid provider record signature")
+	}
+
+	now := time.Now()
+	if now.Sub(signedAt) > providers.ProvideValidity || signedAt.Sub(now) > maxProviderClockSkew {
+		return errStaleProviderRecord
+	}
+	return nil
+}
+
+// providerRecordsToPBPeers converts the provider records into the providers of
+// a GET_PROVIDERS response, freshest records first.
+func (dht *IpfsDHT) providerRecordsToPBPeers(recs []providers.ProviderRecord) []pb.Message_Peer {
+	sort.SliceStable(recs, func(i, j int) bool {
+		return recs[i].Received.After(recs[j].Received)
+	})
+
+	infos := make([]peer.AddrInfo, len(recs))
+	for i, rec := range recs {
+		infos[i] = rec.AddrInfo
+	}
+	pbps := pb.PeerInfosToPBPeers(dht.host.Network(), infos)
+
+	now := time.Now()
+	for i, rec := range recs {
+		if !rec.Received.IsZero() && now.After(rec.Received) {
+			pbps[i].RecordAge = uint64(now.Sub(rec.Received) / time.Second)
+		}
+		if len(rec.Signature) > 0 {
+			pbps[i].SignedAt = rec.SignedAt.UnixNano()
+			pbps[i].Signature = rec.Signature
+		}
+		pbps[i].TransferProtocols = rec.TransferProtocols
+		pbps[i].XXX_unrecognized = rec.Extensions
+	}
+	return pbps
+}
+
+// providersPageBytes bounds the size of the providers returned per page of a
+// GET_PROVIDERS response.
+var providersPageBytes = 256 << 10
+
+// providersPage returns the page of providers following the one token was
+// returned with, freshest records first, and the token of the next page, if
+// any. Providers are paged in the order of their peer IDs, so that the pages
+// stay consistent as records come and go between requests.
+func providersPage(pbps []pb.Message_Peer, token []byte) ([]pb.Message_Peer, []byte) {
+	sort.Slice(pbps, func(i, j int) bool {
+		return string(pbps[i].Id) < string(pbps[j].Id)
+	})
+	start := sort.Search(len(pbps), func(i int) bool {
+		return string(pbps[i].Id) > string(token)
+	})
+	page, next := pbps[start:], []byte(nil)
+
+	size := 0
+	for i := range page {
+		size += page[i].Size()
+		if i > 0 && size > providersPageBytes {
+			page, next = page[:i], []byte(page[i-1].Id)
+			break
+		}
+	}
+	sort.SliceStable(page, func(i, j int) bool {
+		return page[i].RecordAge < page[j].RecordAge
+	})
+	return page, next
+}
+
+// filterProviderRecords drops the provider records whose signed timestamp
+// doesn't check out, and orders the remaining ones freshest first.
+func (dht *IpfsDHT) filterProviderRecords(key []byte, recs []*pb.ProviderRecord) []*pb.ProviderRecord {
+	out := recs[:0]
+	for _, rec := range recs {
+		if len(rec.Signature) > 0 {
+			if err := dht.checkProviderTimestamp(rec.ID, key, rec.SignedAt, rec.Signature); err != nil {
+				logger.Debugw("dropping provider record", "provider", rec.ID, "error", err)
+				continue
+			}
+		}
+		out = append(out, rec)
+	}
+
+	sort.SliceStable(out, func(i, j int) bool {
+		return out[i].Age < out[j].Age
+	})
+	return out
+}
+
+// hasProviderRecord returns whether rs stores a record of p for key.
+func (dht *IpfsDHT) hasProviderRecord(ctx context.Context, rs providers.ProviderRecordStore, key []byte, p peer.ID) bool {
+	recs, err := rs.GetProviderRecords(ctx, key)
+	if err != nil {
+		return false
+	}
+	for _, rec := range recs {
+		if rec.ID == p {
+			return true
+		}
+	}
+	return false
+}
+
+// localProviderInfos returns the providers for key in our provider store. Our
+// own record advertises the transfer protocols we were configured with.
+func (dht *IpfsDHT) localProviderInfos(ctx context.Context, key []byte) ([]ProviderInfo, error) {
+	var infos []ProviderInfo
+	if rs, ok := dht.providerStore.(providers.ProviderRecordStore); ok {
+		recs, err := rs.GetProviderRecords(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		infos = make([]ProviderInfo, len(recs))
+		for i, rec := range recs {
+			infos[i] = ProviderInfo{AddrInfo: rec.AddrInfo, TransferProtocols: rec.TransferProtocols}
+		}
+	} else {
+		provs, err := dht.providerStore.GetProviders(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		infos = make([]ProviderInfo, len(provs))
+		for i, prov := range provs {
+			infos[i] = ProviderInfo{AddrInfo: prov}
+		}
+	}
+
+	for i := range infos {
+		if infos[i].ID == dht.self {
+			infos[i].TransferProtocols = dht.transferProtocols
+		}
+	}
+	return infos, nil
+}
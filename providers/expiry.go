@@ -0,0 +1,250 @@
+package providers
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+	"go.opencensus.io/stats"
+
+	"github.com/libp2p/go-libp2p-kad-dht/metrics"
+)
+
+// Provider records are indexed by the epoch they were last refreshed in, under
+// /providers-expiry/<epoch>/<key>/<provider>. Once a whole epoch is expired,
+// GC sweeps its bucket instead of reading every record stored. Refreshing a
+// record indexes it under the current epoch, leaving a stale entry behind in
+// the old bucket, which the sweep drops after checking the record itself.
+const expiryIndexPrefix = "/providers-expiry/"
+
+// expirySweptKey stores the last epoch swept. Until it is set, GC scans all the
+// records, which indexes the ones written before the index existed.
+var expirySweptKey = ds.NewKey("/providers-expiry-state/swept")
+
+// expiryEpochLength is the duration of an expiry epoch. Records may outlive
+// their validity by up to one epoch on disk, but are never served past it.
+var expiryEpochLength = time.Hour
+
+// occupancyScanRounds is how many GC rounds apart the stored records are
+// counted for the occupancy metrics, as sweeps no longer see them all.
+var occupancyScanRounds = 6
+
+type gcPhase int
+
+const (
+	// gcScan reads every record, for stores not indexed yet.
+	gcScan gcPhase = iota
+	// gcSweep drops the records of the expired epochs.
+	gcSweep
+	// gcCount counts the records stored, for the occupancy metrics.
+	gcCount
+	gcDone
+)
+
+// gcRound is the state of a GC round, only accessed within the run method.
+type gcRound struct {
+	now   time.Time
+	phase gcPhase
+	query dsq.Results
+
+	// records updated since a full scan started
+	skip map[string]struct{}
+	// next and last epochs to sweep
+	epoch, lastEpoch int64
+	// live records per key
+	keys map[string]int64
+}
+
+func expiryEpoch(t time.Time) int64 {
+	return t.UnixNano() / int64(expiryEpochLength)
+}
+
+func mkExpiryPrefix(epoch int64) string {
+	return expiryIndexPrefix + strconv.FormatInt(epoch, 10) + "/"
+}
+
+// mkExpiryKeyFor returns the index key of the record stored under dsk and last
+// refreshed at t.
+func mkExpiryKeyFor(dsk string, t time.Time) string {
+	return mkExpiryPrefix(expiryEpoch(t)) + strings.TrimPrefix(dsk, ProvidersKeyPrefix)
+}
+
+// indexExpiry indexes the record stored under dsk by its expiry epoch.
+func indexExpiry(ctx context.Context, dstore ds.Datastore, dsk string, t time.Time) error {
+	return dstore.Put(ctx, ds.NewKey(mkExpiryKeyFor(dsk, t)), []byte{})
+}
+
+// newGCRound plans a GC round: a full scan if the records aren't indexed yet,
+// else a sweep of the epochs expired since the last round, followed by a count
+// of the records every occupancyScanRounds rounds.
+func (pm *ProviderManager) newGCRound(ctx context.Context, now time.Time) *gcRound {
+	gc := &gcRound{now: now}
+	pm.gcRounds++
+
+	swept, err := pm.dstore.Get(ctx, expirySweptKey)
+	if err == nil {
+		gc.epoch, err = readEpoch(swept)
+		gc.epoch++
+	}
+	if err != nil {
+		if err != ds.ErrNotFound {
+			log.Error("reading last swept provider expiry epoch: ", err)
+		}
+		gc.phase = gcScan
+		gc.skip = make(map[string]struct{})
+		gc.keys = make(map[string]int64)
+		return gc
+	}
+
+	gc.lastEpoch = expiryEpoch(now.Add(-ProvideValidity)) - 1
+	gc.phase = gcSweep
+	if gc.epoch > gc.lastEpoch {
+		pm.endSweep(gc)
+	}
+	return gc
+}
+
+// endSweep moves the round past its sweep.
+func (pm *ProviderManager) endSweep(gc *gcRound) {
+	if (pm.gcRounds-1)%occupancyScanRounds == 0 {
+		gc.phase = gcCount
+		gc.keys = make(map[string]int64)
+		return
+	}
+	gc.phase = gcDone
+}
+
+// nextGCQuery ends the current query of the round, if any, and starts the next
+// one. It returns nil once the round is over.
+func (pm *ProviderManager) nextGCQuery(ctx context.Context, gc *gcRound) <-chan dsq.Result {
+	if gc.query != nil {
+		if err := gc.query.Close(); err != nil {
+			log.Error("failed to close provider GC query: ", err)
+		}
+		gc.query = nil
+
+		switch gc.phase {
+		case gcScan:
+			// every live record is indexed now, sweep from there on.
+			pm.setSweptEpoch(ctx, expiryEpoch(gc.now.Add(-ProvideValidity))-1)
+			recordOccupancy(ctx, gc.keys)
+			gc.phase = gcDone
+		case gcSweep:
+			pm.setSweptEpoch(ctx, gc.epoch)
+			gc.epoch++
+			if gc.epoch > gc.lastEpoch {
+				pm.endSweep(gc)
+			}
+		case gcCount:
+			recordOccupancy(ctx, gc.keys)
+			gc.phase = gcDone
+		}
+	}
+
+	var q dsq.Query
+	switch gc.phase {
+	case gcScan:
+		q = dsq.Query{Prefix: ProvidersKeyPrefix}
+	case gcSweep:
+		q = dsq.Query{Prefix: mkExpiryPrefix(gc.epoch), KeysOnly: true}
+	case gcCount:
+		q = dsq.Query{Prefix: ProvidersKeyPrefix, KeysOnly: true}
+	default:
+		return nil
+	}
+
+	res, err := pm.dstore.Query(ctx, q)
+	if err != nil {
+		log.Error("provider record GC query failed: ", err)
+		return nil
+	}
+	gc.query = res
+	return res.Next()
+}
+
+// gcResult handles an entry returned by the current query of the round.
+func (pm *ProviderManager) gcResult(ctx context.Context, gc *gcRound, res dsq.Result) {
+	switch gc.phase {
+	case gcScan:
+		if _, ok := gc.skip[res.Key]; ok {
+			// We've updated this record since starting the
+			// GC round, skip it.
+			gc.keys[providerKeyOf(res.Key)]++
+			return
+		}
+		t, err := readTimeValue(res.Value)
+		if err != nil || gc.now.Sub(t) > ProvideValidity {
+			if err != nil {
+				log.Error("parsing providers record from disk: ", err)
+			}
+			pm.expireRecord(ctx, res.Key)
+			return
+		}
+		if err := indexExpiry(ctx, pm.dstore, res.Key, t); err != nil {
+			log.Error("failed to index provider record expiry: ", err)
+		}
+		gc.keys[providerKeyOf(res.Key)]++
+	case gcSweep:
+		pm.sweepEntry(ctx, gc, res.Key)
+	case gcCount:
+		gc.keys[providerKeyOf(res.Key)]++
+	}
+}
+
+// sweepEntry drops the record indexed by an entry of an expired epoch, unless
+// it was refreshed since, and the entry itself.
+func (pm *ProviderManager) sweepEntry(ctx context.Context, gc *gcRound, idx string) {
+	dsk := ProvidersKeyPrefix + strings.TrimPrefix(idx, mkExpiryPrefix(gc.epoch))
+	data, err := pm.dstore.Get(ctx, ds.RawKey(dsk))
+	switch err {
+	case nil:
+		t, err := readTimeValue(data)
+		if err != nil || gc.now.Sub(t) > ProvideValidity {
+			pm.expireRecord(ctx, dsk)
+		}
+		// else refreshed, and indexed under a later epoch
+	case ds.ErrNotFound:
+		// removed, or expired when loaded
+	default:
+		log.Error("reading provider record from disk: ", err)
+		return
+	}
+
+	err = pm.dstore.Delete(ctx, ds.RawKey(idx))
+	if err != nil && err != ds.ErrNotFound {
+		log.Error("failed to remove provider expiry index entry: ", err)
+	}
+}
+
+func (pm *ProviderManager) expireRecord(ctx context.Context, dsk string) {
+	err := pm.dstore.Delete(ctx, ds.RawKey(dsk))
+	if err != nil && err != ds.ErrNotFound {
+		log.Error("failed to remove provider record from disk: ", err)
+	}
+	stats.Record(ctx, metrics.ProviderRecordsExpired.M(1))
+}
+
+func (pm *ProviderManager) setSweptEpoch(ctx context.Context, epoch int64) {
+	if err := writeSweptEpoch(ctx, pm.dstore, epoch); err != nil {
+		log.Error("failed to store last swept provider expiry epoch: ", err)
+	}
+}
+
+func writeSweptEpoch(ctx context.Context, dstore ds.Datastore, epoch int64) error {
+	buf := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutVarint(buf, epoch)
+	return dstore.Put(ctx, expirySweptKey, buf[:n])
+}
+
+func readEpoch(data []byte) (int64, error) {
+	epoch, n := binary.Varint(data)
+	if n <= 0 {
+		return 0, fmt.Errorf("failed to parse epoch")
+	}
+	return epoch, nil
+}
@@ -0,0 +1,301 @@
+package providers
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+	base32 "github.com/multiformats/go-base32"
+)
+
+// exportMagic starts the provider record dumps written by Export, and versions
+// their format.
+const exportMagic = "kad-provider-records/1\n"
+
+// maxExportFieldSize bounds the size of the fields read from a dump.
+const maxExportFieldSize = 1 << 20
+
+// ProviderExporter is implemented by provider stores that can dump their
+// provider records and load them back, e.g. on another node.
+type ProviderExporter interface {
+	Export(ctx context.Context, w io.Writer) (int, error)
+	Import(ctx context.Context, r io.Reader) (int, error)
+}
+
+var _ ProviderExporter = (*ProviderManager)(nil)
+var _ ProviderExporter = (*ShardedProviderManager)(nil)
+
+type exportReq struct {
+	ctx  context.Context
+	resp chan exportResp
+}
+
+type exportResp struct {
+	res dsq.Results
+	err error
+}
+
+type importProv struct {
+	ctx   context.Context
+	key   []byte
+	val   peer.ID
+	entry []byte
+	resp  chan bool
+}
+
+// Export writes all the provider records stored to w, along with their
+// addresses, timestamps and metadata, and returns how many were written. The
+// dump can be loaded on another node with Import.
+//
+// The dump starts with a version line, followed by every record as its key,
+// provider and encoded entry, each one uvarint length prefixed.
+func (pm *ProviderManager) Export(ctx context.Context, w io.Writer) (int, error) {
+	bw := bufio.NewWriter(w)
+	if _, err := bw.WriteString(exportMagic); err != nil {
+		return 0, err
+	}
+	n, err := pm.exportRecords(ctx, bw)
+	if err != nil {
+		return n, err
+	}
+	return n, bw.Flush()
+}
+
+func (pm *ProviderManager) exportRecords(ctx context.Context, bw *bufio.Writer) (int, error) {
+	er := &exportReq{ctx: ctx, resp: make(chan exportResp, 1)}
+	select {
+	case pm.exports <- er:
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+	var resp exportResp
+	select {
+	case resp = <-er.resp:
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+	if resp.err != nil {
+		return 0, resp.err
+	}
+	defer resp.res.Close()
+
+	now := time.Now()
+	n := 0
+	for e := range resp.res.Next() {
+		if e.Error != nil {
+			return n, e.Error
+		}
+		k, p, err := parseProvKey(e.Key)
+		if err != nil {
+			log.Error("skipping provider record with invalid key: ", err)
+			continue
+		}
+		t, err := readTimeValue(e.Value)
+		if err != nil || now.Sub(t) > ProvideValidity {
+			continue
+		}
+		for _, field := range [][]byte{k, []byte(p), e.Value} {
+			if err := writeExportField(bw, field); err != nil {
+				return n, err
+			}
+		}
+		n++
+	}
+	return n, nil
+}
+
+// Import loads the provider records of a dump written by Export and returns how
+// many were imported. Records that expired in the meantime, or that are older
+// than the record already stored for the same provider and key, are skipped.
+func (pm *ProviderManager) Import(ctx context.Context, r io.Reader) (int, error) {
+	return importRecords(ctx, r, func(k []byte, p peer.ID, entry []byte) (bool, error) {
+		return pm.importRecord(ctx, k, p, entry)
+	})
+}
+
+func (pm *ProviderManager) importRecord(ctx context.Context, k []byte, p peer.ID, entry []byte) (bool, error) {
+	ip := &importProv{
+		ctx:   ctx,
+		key:   k,
+		val:   p,
+		entry: entry,
+		resp:  make(chan bool, 1),
+	}
+	select {
+	case pm.imports <- ip:
+	case <-ctx.Done():
+		return false, ctx.Err()
+	}
+	select {
+	case imported := <-ip.resp:
+		return imported, nil
+	case <-ctx.Done():
+		return false, ctx.Err()
+	}
+}
+
+// importProv stores an imported record unless it expired or we have a newer one.
+func (pm *ProviderManager) importProv(ctx context.Context, k []byte, p peer.ID, entry []byte) (bool, error) {
+	t, addrs, signed, protos, ext, err := decodeProviderEntry(entry)
+	if err != nil {
+		return false, err
+	}
+	if time.Since(t) > ProvideValidity {
+		return false, nil
+	}
+
+	known, _, _, _, _, err := readProviderEntry(ctx, pm.dstore, k, p)
+	if err != nil && err != ds.ErrNotFound {
+		return false, err
+	}
+	if err == nil && !known.Before(t) {
+		return false, nil
+	}
+
+	if err := writeProviderEntry(ctx, pm.dstore, k, p, t, addrs, signed, protos, ext); err != nil {
+		return false, err
+	}
+	if err := indexExpiry(ctx, pm.dstore, mkProvKeyFor(k, p), t); err != nil {
+		return false, err
+	}
+	if cached, ok := pm.cache.Get(string(k)); ok {
+		pset := cached.(*providerSet)
+		pset.setVal(p, t)
+		pset.addrs[p] = addrs
+		pset.setSigned(p, signed)
+		pset.setProtocols(p, protos)
+		pset.setExtensions(p, ext)
+	}
+	return true, nil
+}
+
+// Export writes the provider records of all the shards to w, see
+// ProviderManager.Export.
+func (spm *ShardedProviderManager) Export(ctx context.Context, w io.Writer) (int, error) {
+	bw := bufio.NewWriter(w)
+	if _, err := bw.WriteString(exportMagic); err != nil {
+		return 0, err
+	}
+	total := 0
+	for _, shard := range spm.shards {
+		n, err := shard.exportRecords(ctx, bw)
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, bw.Flush()
+}
+
+// Import loads the provider records of a dump into the shards responsible for
+// them, see ProviderManager.Import. Dumps can be moved between sharded and
+// unsharded stores.
+func (spm *ShardedProviderManager) Import(ctx context.Context, r io.Reader) (int, error) {
+	return importRecords(ctx, r, func(k []byte, p peer.ID, entry []byte) (bool, error) {
+		return spm.shard(k).importRecord(ctx, k, p, entry)
+	})
+}
+
+// importRecords reads a dump and hands each record to add.
+func importRecords(ctx context.Context, r io.Reader, add func(k []byte, p peer.ID, entry []byte) (bool, error)) (int, error) {
+	br := bufio.NewReader(r)
+	magic := make([]byte, len(exportMagic))
+	if _, err := io.ReadFull(br, magic); err != nil || string(magic) != exportMagic {
+		return 0, fmt.Errorf("not a provider record dump")
+	}
+
+	n := 0
+	for {
+		if ctx.Err() != nil {
+			return n, ctx.Err()
+		}
+
+		k, err := readExportField(br)
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+		p, err := readExportField(br)
+		if err != nil {
+			return n, unexpectedEOF(err)
+		}
+		entry, err := readExportField(br)
+		if err != nil {
+			return n, unexpectedEOF(err)
+		}
+
+		imported, err := add(k, peer.ID(p), entry)
+		if err != nil {
+			if ctx.Err() != nil {
+				return n, ctx.Err()
+			}
+			log.Error("skipping invalid provider record: ", err)
+			continue
+		}
+		if imported {
+			n++
+		}
+	}
+}
+
+func writeExportField(w *bufio.Writer, b []byte) error {
+	var scratch [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(scratch[:], uint64(len(b)))
+	if _, err := w.Write(scratch[:n]); err != nil {
+		return err
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+func readExportField(r *bufio.Reader) ([]byte, error) {
+	l, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if l > maxExportFieldSize {
+		return nil, fmt.Errorf("provider record dump field too large: %d bytes", l)
+	}
+	b := make([]byte, l)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	return b, nil
+}
+
+func unexpectedEOF(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// parseProvKey splits the datastore key of a provider record into the key and
+// the provider, see mkProvKeyFor.
+func parseProvKey(dsk string) ([]byte, peer.ID, error) {
+	rest := strings.TrimPrefix(dsk, ProvidersKeyPrefix)
+	i := strings.LastIndex(rest, "/")
+	if i < 0 || len(rest) == len(dsk) {
+		return nil, "", fmt.Errorf("malformed provider record key %s", dsk)
+	}
+	k, err := base32.RawStdEncoding.DecodeString(rest[:i])
+	if err != nil {
+		return nil, "", err
+	}
+	p, err := base32.RawStdEncoding.DecodeString(rest[i+1:])
+	if err != nil {
+		return nil, "", err
+	}
+	return k, peer.ID(p), nil
+}
@@ -4,19 +4,50 @@ import (
 	"time"
 
 	"github.com/libp2p/go-libp2p-core/peer"
+	ma "github.com/multiformats/go-multiaddr"
 )
 
+// maxProviderAddrs is the maximum number of addresses remembered for a
+// provider of a key. The stalest addresses are dropped first.
+var maxProviderAddrs = 16
+
 // A providerSet has the list of providers and the time that they were added
 // It is used as an intermediary data struct between what is stored in the datastore
 // and the list of providers that get passed to the consumer of a .GetProviders call
 type providerSet struct {
 	providers []peer.ID
 	set       map[peer.ID]time.Time
+	addrs     map[peer.ID][]providerAddr
+	signed    map[peer.ID]signedTimestamp
+	protocols map[peer.ID][]string
+	ext       map[peer.ID][]byte
+}
+
+// providerAddr is an address announced by a provider along with the last time
+// it was announced.
+type providerAddr struct {
+	addr ma.Multiaddr
+	seen time.Time
+}
+
+// signedTimestamp is the announcement time of a provider record signed by the
+// provider.
+type signedTimestamp struct {
+	at  time.Time
+	sig []byte
+}
+
+func (st signedTimestamp) isSet() bool {
+	return len(st.sig) > 0
 }
 
 func newProviderSet() *providerSet {
 	return &providerSet{
-		set: make(map[peer.ID]time.Time),
+		set:       make(map[peer.ID]time.Time),
+		addrs:     make(map[peer.ID][]providerAddr),
+		signed:    make(map[peer.ID]signedTimestamp),
+		protocols: make(map[peer.ID][]string),
+		ext:       make(map[peer.ID][]byte),
 	}
 }
 
@@ -32,3 +63,103 @@ func (ps *providerSet) setVal(p peer.ID, t time.Time) {
 
 	ps.set[p] = t
 }
+
+func (ps *providerSet) setSigned(p peer.ID, st signedTimestamp) {
+	if st.isSet() {
+		ps.signed[p] = st
+	} else {
+		delete(ps.signed, p)
+	}
+}
+
+func (ps *providerSet) setProtocols(p peer.ID, protos []string) {
+	if len(protos) > 0 {
+		ps.protocols[p] = protos
+	} else {
+		delete(ps.protocols, p)
+	}
+}
+
+func (ps *providerSet) setExtensions(p peer.ID, ext []byte) {
+	if len(ext) > 0 {
+		ps.ext[p] = ext
+	} else {
+		delete(ps.ext, p)
+	}
+}
+
+func (ps *providerSet) remove(p peer.ID) {
+	if _, found := ps.set[p]; !found {
+		return
+	}
+	delete(ps.set, p)
+	delete(ps.addrs, p)
+	delete(ps.signed, p)
+	delete(ps.ext, p)
+	for i, prov := range ps.providers {
+		if prov == p {
+			ps.providers = append(ps.providers[:i], ps.providers[i+1:]...)
+			break
+		}
+	}
+}
+
+// records returns the providers along with their addresses, freshest first,
+// and the metadata of their records. Addresses that haven't been announced for
+// longer than ProvideValidity are left out.
+func (ps *providerSet) records(now time.Time) []ProviderRecord {
+	out := make([]ProviderRecord, 0, len(ps.providers))
+	for _, p := range ps.providers {
+		rec := ProviderRecord{
+			AddrInfo: peer.AddrInfo{ID: p},
+			Received: ps.set[p],
+		}
+		for _, pa := range ps.addrs[p] {
+			if now.Sub(pa.seen) > ProvideValidity {
+				break
+			}
+			rec.Addrs = append(rec.Addrs, pa.addr)
+		}
+		if st, ok := ps.signed[p]; ok {
+			rec.SignedAt = st.at
+			rec.Signature = st.sig
+		}
+		rec.TransferProtocols = ps.protocols[p]
+		rec.Extensions = ps.ext[p]
+		out = append(out, rec)
+	}
+	return out
+}
+
+// mergeProviderAddrs merges the addresses announced at time t into the
+// previously known ones. Re-announced addresses are refreshed rather than
+// duplicated and the result is ordered freshest first.
+func mergeProviderAddrs(known []providerAddr, announced []ma.Multiaddr, t time.Time) []providerAddr {
+	merged := make([]providerAddr, 0, len(announced)+len(known))
+	for _, a := range announced {
+		if !containsProviderAddr(merged, a) {
+			merged = append(merged, providerAddr{addr: a, seen: t})
+		}
+	}
+	for _, pa := range known {
+		if len(merged) >= maxProviderAddrs {
+			break
+		}
+		if !containsProviderAddr(merged, pa.addr) {
+			merged = append(merged, pa)
+		}
+	}
+	if len(merged) > maxProviderAddrs {
+		merged = merged[:maxProviderAddrs]
+	}
+	return merged
+}
+
+func containsProviderAddr(addrs []providerAddr, a ma.Multiaddr) bool {
+	for _, pa := range addrs {
+		if pa.addr.Equal(a) {
+			return true
+		}
+	}
+	return false
+}
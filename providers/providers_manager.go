@@ -9,7 +9,6 @@ import (
 
 	"github.com/libp2p/go-libp2p-core/peer"
 	peerstore "github.com/libp2p/go-libp2p-core/peerstore"
-	peerstoreImpl "github.com/libp2p/go-libp2p-peerstore"
 
 	lru "github.com/hashicorp/golang-lru/simplelru"
 	ds "github.com/ipfs/go-datastore"
@@ -19,6 +18,10 @@ import (
 	goprocess "github.com/jbenet/goprocess"
 	goprocessctx "github.com/jbenet/goprocess/context"
 	base32 "github.com/multiformats/go-base32"
+	ma "github.com/multiformats/go-multiaddr"
+	"go.opencensus.io/stats"
+
+	"github.com/libp2p/go-libp2p-kad-dht/metrics"
 )
 
 // ProvidersKeyPrefix is the prefix/namespace for ALL provider record
@@ -38,6 +41,46 @@ type ProviderStore interface {
 	GetProviders(ctx context.Context, key []byte) ([]peer.AddrInfo, error)
 }
 
+// ProviderRemover is implemented by provider stores that support retracting
+// provider records before they expire.
+type ProviderRemover interface {
+	RemoveProvider(ctx context.Context, key []byte, p peer.ID) error
+}
+
+// ProviderRecord is a provider of a key along with the metadata of its record.
+type ProviderRecord struct {
+	peer.AddrInfo
+
+	// Received is the last time the record was announced to us. It is set by
+	// the store and ignored when adding records.
+	Received time.Time
+
+	// SignedAt is the announcement time signed by the provider, zero if the
+	// record isn't signed. Signatures are checked before records are added.
+	SignedAt  time.Time
+	Signature []byte
+
+	// TransferProtocols are the retrieval protocols the provider advertised.
+	TransferProtocols []string
+
+	// Extensions are the fields of the record unknown to us, as serialized by
+	// the provider, kept so that they are served along with the record.
+	Extensions []byte
+
+	// TTL is how long the provider asked the record to last, capped at
+	// ProvideValidity, zero for ProvideValidity. It is only used when adding
+	// records, which are then stored as received early enough to expire after
+	// TTL, and Received reflects it.
+	TTL time.Duration
+}
+
+// ProviderRecordStore is implemented by provider stores that keep the metadata
+// of provider records along with the providers.
+type ProviderRecordStore interface {
+	AddProviderRecord(ctx context.Context, key []byte, rec ProviderRecord) error
+	GetProviderRecords(ctx context.Context, key []byte) ([]ProviderRecord, error)
+}
+
 // ProviderManager adds and pulls providers out of the datastore,
 // caching them in between
 type ProviderManager struct {
@@ -49,13 +92,19 @@ type ProviderManager struct {
 	dstore *autobatch.Datastore
 
 	newprovs chan *addProv
+	rmprovs  chan *rmProv
 	getprovs chan *getProv
+	exports  chan *exportReq
+	imports  chan *importProv
 	proc     goprocess.Process
 
 	cleanupInterval time.Duration
+	gcRounds        int
 }
 
 var _ ProviderStore = (*ProviderManager)(nil)
+var _ ProviderRemover = (*ProviderManager)(nil)
+var _ ProviderRecordStore = (*ProviderManager)(nil)
 
 // Option is a function that sets a provider manager option.
 type Option func(*ProviderManager) error
@@ -88,6 +137,17 @@ func Cache(c lru.LRUCache) Option {
 }
 
 type addProv struct {
+	ctx    context.Context
+	key    []byte
+	val    peer.ID
+	addrs  []ma.Multiaddr
+	signed signedTimestamp
+	protos []string
+	ext    []byte
+	ttl    time.Duration
+}
+
+type rmProv struct {
 	ctx context.Context
 	key []byte
 	val peer.ID
@@ -96,7 +156,7 @@ type addProv struct {
 type getProv struct {
 	ctx  context.Context
 	key  []byte
-	resp chan []peer.ID
+	resp chan []ProviderRecord
 }
 
 // NewProviderManager constructor
@@ -105,6 +165,9 @@ func NewProviderManager(ctx context.Context, local peer.ID, ps peerstore.Peersto
 	pm.self = local
 	pm.getprovs = make(chan *getProv)
 	pm.newprovs = make(chan *addProv)
+	pm.rmprovs = make(chan *rmProv)
+	pm.exports = make(chan *exportReq)
+	pm.imports = make(chan *importProv)
 	pm.pstore = ps
 	pm.dstore = autobatch.NewAutoBatching(dstore, batchBufferSize)
 	cache, err := lru.NewLRU(lruCacheSize, nil)
@@ -128,18 +191,16 @@ func (pm *ProviderManager) Process() goprocess.Process {
 
 func (pm *ProviderManager) run(ctx context.Context, proc goprocess.Process) {
 	var (
-		gcQuery    dsq.Results
+		gc         *gcRound
 		gcQueryRes <-chan dsq.Result
-		gcSkip     map[string]struct{}
-		gcTime     time.Time
 		gcTimer    = time.NewTimer(pm.cleanupInterval)
 	)
 
 	defer func() {
 		gcTimer.Stop()
-		if gcQuery != nil {
+		if gc != nil && gc.query != nil {
 			// don't really care if this fails.
-			_ = gcQuery.Close()
+			_ = gc.query.Close()
 		}
 		if err := pm.dstore.Flush(ctx); err != nil {
 			log.Error("failed to flush datastore: ", err)
@@ -149,18 +210,32 @@ func (pm *ProviderManager) run(ctx context.Context, proc goprocess.Process) {
 	for {
 		select {
 		case np := <-pm.newprovs:
-			err := pm.addProv(np.ctx, np.key, np.val)
+			err := pm.addProv(np.ctx, np.key, np.val, np.addrs, np.signed, np.protos, np.ext, np.ttl)
 			if err != nil {
 				log.Error("error adding new providers: ", err)
 				continue
 			}
-			if gcSkip != nil {
-				// we have an gc, tell it to skip this provider
+			if gc != nil && gc.skip != nil {
+				// we have a full scan, tell it to skip this provider
 				// as we've updated it since the GC started.
-				gcSkip[mkProvKeyFor(np.key, np.val)] = struct{}{}
+				gc.skip[mkProvKeyFor(np.key, np.val)] = struct{}{}
+			}
+		case rp := <-pm.rmprovs:
+			if err := pm.removeProv(rp.ctx, rp.key, rp.val); err != nil {
+				log.Error("error removing provider: ", err)
+			}
+		case er := <-pm.exports:
+			// queried from the loop, as it flushes the pending writes
+			res, err := pm.dstore.Query(er.ctx, dsq.Query{Prefix: ProvidersKeyPrefix})
+			er.resp <- exportResp{res: res, err: err}
+		case ip := <-pm.imports:
+			imported, err := pm.importProv(ip.ctx, ip.key, ip.val, ip.entry)
+			if err != nil {
+				log.Error("error importing provider record: ", err)
 			}
+			ip.resp <- imported
 		case gp := <-pm.getprovs:
-			provs, err := pm.getProvidersForKey(gp.ctx, gp.key)
+			provs, err := pm.getProviderRecordsForKey(gp.ctx, gp.key)
 			if err != nil && err != ds.ErrNotFound {
 				log.Error("error reading providers: ", err)
 			}
@@ -169,43 +244,21 @@ func (pm *ProviderManager) run(ctx context.Context, proc goprocess.Process) {
 			gp.resp <- provs[0:len(provs):len(provs)]
 		case res, ok := <-gcQueryRes:
 			if !ok {
-				if err := gcQuery.Close(); err != nil {
-					log.Error("failed to close provider GC query: ", err)
+				gcQueryRes = pm.nextGCQuery(ctx, gc)
+				if gcQueryRes == nil {
+					// cleanup GC round
+					gcTimer.Reset(pm.cleanupInterval)
+					gc = nil
 				}
-				gcTimer.Reset(pm.cleanupInterval)
-
-				// cleanup GC round
-				gcQueryRes = nil
-				gcSkip = nil
-				gcQuery = nil
 				continue
 			}
 			if res.Error != nil {
 				log.Error("got error from GC query: ", res.Error)
 				continue
 			}
-			if _, ok := gcSkip[res.Key]; ok {
-				// We've updated this record since starting the
-				// GC round, skip it.
-				continue
-			}
-
-			// check expiration time
-			t, err := readTimeValue(res.Value)
-			switch {
-			case err != nil:
-				// couldn't parse the time
-				log.Error("parsing providers record from disk: ", err)
-				fallthrough
-			case gcTime.Sub(t) > ProvideValidity:
-				// or expired
-				err = pm.dstore.Delete(ctx, ds.RawKey(res.Key))
-				if err != nil && err != ds.ErrNotFound {
-					log.Error("failed to remove provider record from disk: ", err)
-				}
-			}
+			pm.gcResult(ctx, gc, res)
 
-		case gcTime = <-gcTimer.C:
+		case now := <-gcTimer.C:
 			// You know the wonderful thing about caches? You can
 			// drop them.
 			//
@@ -213,31 +266,43 @@ func (pm *ProviderManager) run(ctx context.Context, proc goprocess.Process) {
 			pm.cache.Purge()
 
 			// Now, kick off a GC of the datastore.
-			q, err := pm.dstore.Query(ctx, dsq.Query{
-				Prefix: ProvidersKeyPrefix,
-			})
-			if err != nil {
-				log.Error("provider record GC query failed: ", err)
-				continue
+			gc = pm.newGCRound(ctx, now)
+			gcQueryRes = pm.nextGCQuery(ctx, gc)
+			if gcQueryRes == nil {
+				gcTimer.Reset(pm.cleanupInterval)
+				gc = nil
 			}
-			gcQuery = q
-			gcQueryRes = q.Next()
-			gcSkip = make(map[string]struct{})
 		case <-proc.Closing():
 			return
 		}
 	}
 }
 
-// AddProvider adds a provider
+// AddProvider adds a provider. Repeated announcements by the same provider
+// refresh its record and merge the announced addresses into it.
 func (pm *ProviderManager) AddProvider(ctx context.Context, k []byte, provInfo peer.AddrInfo) error {
-	if provInfo.ID != pm.self { // don't add own addrs.
-		pm.pstore.AddAddrs(provInfo.ID, provInfo.Addrs, peerstore.ProviderAddrTTL)
-	}
+	return pm.AddProviderRecord(ctx, k, ProviderRecord{AddrInfo: provInfo})
+}
+
+// AddProviderRecord adds a provider like AddProvider, keeping the signed
+// timestamp, transfer protocols and extensions of the record. A signed announcement older
+// than the one already stored for the provider is a replay and doesn't refresh
+// the record.
+func (pm *ProviderManager) AddProviderRecord(ctx context.Context, k []byte, rec ProviderRecord) error {
 	prov := &addProv{
-		ctx: ctx,
-		key: k,
-		val: provInfo.ID,
+		ctx:    ctx,
+		key:    k,
+		val:    rec.ID,
+		protos: rec.TransferProtocols,
+		ext:    rec.Extensions,
+		ttl:    rec.TTL,
+	}
+	if len(rec.Signature) > 0 {
+		prov.signed = signedTimestamp{at: rec.SignedAt, sig: rec.Signature}
+	}
+	if rec.ID != pm.self { // don't add own addrs.
+		pm.pstore.AddAddrs(rec.ID, rec.Addrs, peerstore.ProviderAddrTTL)
+		prov.addrs = rec.Addrs
 	}
 	select {
 	case pm.newprovs <- prov:
@@ -248,23 +313,273 @@ func (pm *ProviderManager) AddProvider(ctx context.Context, k []byte, provInfo p
 }
 
 // addProv updates the cache if needed
-func (pm *ProviderManager) addProv(ctx context.Context, k []byte, p peer.ID) error {
+func (pm *ProviderManager) addProv(ctx context.Context, k []byte, p peer.ID, announced []ma.Multiaddr, signed signedTimestamp, protos []string, ext []byte, ttl time.Duration) error {
 	now := time.Now()
+	// records expire ProvideValidity after they are received, shorter lived
+	// ones are backdated accordingly
+	received := now
+	if ttl > 0 && ttl < ProvideValidity {
+		received = now.Add(ttl - ProvideValidity)
+	}
+
+	var (
+		known       []providerAddr
+		knownSigned signedTimestamp
+		knownProtos []string
+		knownExt    []byte
+		isNew       bool
+	)
+	cached, ok := pm.cache.Get(string(k))
+	if ok {
+		pset := cached.(*providerSet)
+		known = pset.addrs[p]
+		knownSigned = pset.signed[p]
+		knownProtos = pset.protocols[p]
+		knownExt = pset.ext[p]
+		_, found := pset.set[p]
+		isNew = !found
+	} else {
+		// not cached, merge with the record on disk and write through
+		_, addrs, sig, protos, ext, err := readProviderEntry(ctx, pm.dstore, k, p)
+		if err != nil && err != ds.ErrNotFound {
+			log.Error("reading provider record from disk: ", err)
+		}
+		known = addrs
+		knownSigned = sig
+		knownProtos = protos
+		knownExt = ext
+		isNew = err == ds.ErrNotFound
+	}
+
+	if signed.isSet() && knownSigned.isSet() && !signed.at.After(knownSigned.at) {
+		log.Debugf("ignoring replayed provider record from %s", p)
+		return nil
+	}
+	if !signed.isSet() {
+		// an unsigned announcement refreshes the record without replacing
+		// the signature and metadata it doesn't carry
+		signed = knownSigned
+		if len(protos) == 0 {
+			protos = knownProtos
+		}
+		if len(ext) == 0 {
+			ext = knownExt
+		}
+	}
+
+	addrs := mergeProviderAddrs(known, announced, now)
+	if ok {
+		pset := cached.(*providerSet)
+		pset.setVal(p, received)
+		pset.addrs[p] = addrs
+		pset.setSigned(p, signed)
+		pset.setProtocols(p, protos)
+		pset.setExtensions(p, ext)
+	}
+
+	if err := writeProviderEntry(ctx, pm.dstore, k, p, received, addrs, signed, protos, ext); err != nil {
+		return err
+	}
+	if err := indexExpiry(ctx, pm.dstore, mkProvKeyFor(k, p), received); err != nil {
+		return err
+	}
+	if isNew {
+		stats.Record(ctx, metrics.ProviderRecordsAdded.M(1))
+	}
+	return nil
+}
+
+// RemoveProvider retracts the provider record of p for the key.
+func (pm *ProviderManager) RemoveProvider(ctx context.Context, k []byte, p peer.ID) error {
+	prov := &rmProv{
+		ctx: ctx,
+		key: k,
+		val: p,
+	}
+	select {
+	case pm.rmprovs <- prov:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// removeProv removes the provider from the cache and the datastore
+func (pm *ProviderManager) removeProv(ctx context.Context, k []byte, p peer.ID) error {
 	if provs, ok := pm.cache.Get(string(k)); ok {
-		provs.(*providerSet).setVal(p, now)
-	} // else not cached, just write through
+		provs.(*providerSet).remove(p)
+	}
 
-	return writeProviderEntry(ctx, pm.dstore, k, p, now)
+	err := pm.dstore.Delete(ctx, ds.NewKey(mkProvKeyFor(k, p)))
+	if err == ds.ErrNotFound {
+		return nil
+	}
+	return err
 }
 
 // writeProviderEntry writes the provider into the datastore
-func writeProviderEntry(ctx context.Context, dstore ds.Datastore, k []byte, p peer.ID, t time.Time) error {
+func writeProviderEntry(ctx context.Context, dstore ds.Datastore, k []byte, p peer.ID, t time.Time, addrs []providerAddr, signed signedTimestamp, protos []string, ext []byte) error {
 	dsk := mkProvKeyFor(k, p)
+	return dstore.Put(ctx, ds.NewKey(dsk), encodeProviderEntry(t, addrs, signed, protos, ext))
+}
+
+// readProviderEntry reads the provider's record for the key from the datastore.
+func readProviderEntry(ctx context.Context, dstore ds.Datastore, k []byte, p peer.ID) (time.Time, []providerAddr, signedTimestamp, []string, []byte, error) {
+	data, err := dstore.Get(ctx, ds.NewKey(mkProvKeyFor(k, p)))
+	if err != nil {
+		return time.Time{}, nil, signedTimestamp{}, nil, nil, err
+	}
+	return decodeProviderEntry(data)
+}
+
+// Tags of the optional fields following the addresses of a provider entry.
+// They can't be mistaken for an address time, which is always positive.
+const (
+	entrySignedTimestampTag = 0
+	entryProtocolsTag       = -1
+	entryExtensionsTag      = -2
+)
+
+// encodeProviderEntry serializes a provider record as the varint encoded time
+// it was last announced, followed by the addresses of the provider, each one as
+// the varint encoded time it was last announced and the length prefixed
+// address. Then come the optional fields, each one introduced by its varint
+// encoded tag: the varint encoded signed time and the length prefixed
+// signature of signed records, the count and length prefixed names of the
+// transfer protocols, and the length prefixed extensions. Records written
+// before addresses were stored consist of the time only.
+func encodeProviderEntry(t time.Time, addrs []providerAddr, signed signedTimestamp, protos []string, ext []byte) []byte {
+	scratch := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutVarint(scratch, t.UnixNano())
+	buf := append([]byte(nil), scratch[:n]...)
+
+	for _, pa := range addrs {
+		n = binary.PutVarint(scratch, pa.seen.UnixNano())
+		buf = append(buf, scratch[:n]...)
+		b := pa.addr.Bytes()
+		n = binary.PutUvarint(scratch, uint64(len(b)))
+		buf = append(buf, scratch[:n]...)
+		buf = append(buf, b...)
+	}
+
+	if signed.isSet() {
+		n = binary.PutVarint(scratch, entrySignedTimestampTag)
+		buf = append(buf, scratch[:n]...)
+		n = binary.PutVarint(scratch, signed.at.UnixNano())
+		buf = append(buf, scratch[:n]...)
+		n = binary.PutUvarint(scratch, uint64(len(signed.sig)))
+		buf = append(buf, scratch[:n]...)
+		buf = append(buf, signed.sig...)
+	}
+	if len(protos) > 0 {
+		n = binary.PutVarint(scratch, entryProtocolsTag)
+		buf = append(buf, scratch[:n]...)
+		n = binary.PutUvarint(scratch, uint64(len(protos)))
+		buf = append(buf, scratch[:n]...)
+		for _, proto := range protos {
+			n = binary.PutUvarint(scratch, uint64(len(proto)))
+			buf = append(buf, scratch[:n]...)
+			buf = append(buf, proto...)
+		}
+	}
+	if len(ext) > 0 {
+		n = binary.PutVarint(scratch, entryExtensionsTag)
+		buf = append(buf, scratch[:n]...)
+		n = binary.PutUvarint(scratch, uint64(len(ext)))
+		buf = append(buf, scratch[:n]...)
+		buf = append(buf, ext...)
+	}
+	return buf
+}
+
+// decodeProviderEntry parses a record written by encodeProviderEntry.
+func decodeProviderEntry(data []byte) (time.Time, []providerAddr, signedTimestamp, []string, []byte, error) {
+	fail := func(err error) (time.Time, []providerAddr, signedTimestamp, []string, []byte, error) {
+		return time.Time{}, nil, signedTimestamp{}, nil, nil, err
+	}
+
+	nsec, n := binary.Varint(data)
+	if n <= 0 {
+		return fail(fmt.Errorf("failed to parse time"))
+	}
+	data = data[n:]
+
+	var (
+		addrs  []providerAddr
+		signed signedTimestamp
+		protos []string
+		ext    []byte
+	)
+	for len(data) > 0 {
+		seen, n := binary.Varint(data)
+		if n <= 0 {
+			return fail(fmt.Errorf("failed to parse provider address time"))
+		}
+		data = data[n:]
 
-	buf := make([]byte, 16)
-	n := binary.PutVarint(buf, t.UnixNano())
+		switch {
+		case seen == entrySignedTimestampTag:
+			at, n := binary.Varint(data)
+			if n <= 0 {
+				return fail(fmt.Errorf("failed to parse signed provider time"))
+			}
+			data = data[n:]
+			sig, rest, err := readLengthPrefixed(data)
+			if err != nil {
+				return fail(fmt.Errorf("failed to parse provider signature: %w", err))
+			}
+			data = rest
+			signed = signedTimestamp{at: time.Unix(0, at), sig: append([]byte(nil), sig...)}
+		case seen == entryProtocolsTag:
+			count, n := binary.Uvarint(data)
+			if n <= 0 || count > uint64(len(data)-n) {
+				return fail(fmt.Errorf("failed to parse transfer protocol count"))
+			}
+			data = data[n:]
+			protos = make([]string, 0, count)
+			for i := uint64(0); i < count; i++ {
+				proto, rest, err := readLengthPrefixed(data)
+				if err != nil {
+					return fail(fmt.Errorf("failed to parse transfer protocol: %w", err))
+				}
+				data = rest
+				protos = append(protos, string(proto))
+			}
+		case seen == entryExtensionsTag:
+			b, rest, err := readLengthPrefixed(data)
+			if err != nil {
+				return fail(fmt.Errorf("failed to parse provider extensions: %w", err))
+			}
+			data = rest
+			ext = append([]byte(nil), b...)
+		case seen < 0:
+			return fail(fmt.Errorf("unknown provider entry field %d", seen))
+		default:
+			b, rest, err := readLengthPrefixed(data)
+			if err != nil {
+				return fail(fmt.Errorf("failed to parse provider address: %w", err))
+			}
+			data = rest
+			a, err := ma.NewMultiaddrBytes(b)
+			if err != nil {
+				return fail(err)
+			}
+			addrs = append(addrs, providerAddr{addr: a, seen: time.Unix(0, seen)})
+		}
+	}
+
+	return time.Unix(0, nsec), addrs, signed, protos, ext, nil
+}
 
-	return dstore.Put(ctx, ds.NewKey(dsk), buf[:n])
+// readLengthPrefixed reads a uvarint length prefixed byte string off data and
+// returns it along with the rest of data.
+func readLengthPrefixed(data []byte) ([]byte, []byte, error) {
+	l, n := binary.Uvarint(data)
+	if n <= 0 || l > uint64(len(data)-n) {
+		return nil, nil, fmt.Errorf("invalid length")
+	}
+	data = data[n:]
+	return data[:l], data[l:], nil
 }
 
 func mkProvKeyFor(k []byte, p peer.ID) string {
@@ -275,13 +590,28 @@ func mkProvKey(k []byte) string {
 	return ProvidersKeyPrefix + base32.RawStdEncoding.EncodeToString(k)
 }
 
-// GetProviders returns the set of providers for the given key.
-// This method _does not_ copy the set. Do not modify it.
+// GetProviders returns the set of providers for the given key, along with the
+// freshest addresses they announced, or the addresses in the peerstore for
+// providers that didn't announce any.
 func (pm *ProviderManager) GetProviders(ctx context.Context, k []byte) ([]peer.AddrInfo, error) {
+	recs, err := pm.GetProviderRecords(ctx, k)
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]peer.AddrInfo, len(recs))
+	for i, rec := range recs {
+		infos[i] = rec.AddrInfo
+	}
+	return infos, nil
+}
+
+// GetProviderRecords returns the providers for the given key like
+// GetProviders, along with the metadata of their records.
+func (pm *ProviderManager) GetProviderRecords(ctx context.Context, k []byte) ([]ProviderRecord, error) {
 	gp := &getProv{
 		ctx:  ctx,
 		key:  k,
-		resp: make(chan []peer.ID, 1), // buffered to prevent sender from blocking
+		resp: make(chan []ProviderRecord, 1), // buffered to prevent sender from blocking
 	}
 	select {
 	case <-ctx.Done():
@@ -291,17 +621,22 @@ func (pm *ProviderManager) GetProviders(ctx context.Context, k []byte) ([]peer.A
 	select {
 	case <-ctx.Done():
 		return nil, ctx.Err()
-	case peers := <-gp.resp:
-		return peerstoreImpl.PeerInfos(pm.pstore, peers), nil
+	case recs := <-gp.resp:
+		for i := range recs {
+			if len(recs[i].Addrs) == 0 {
+				recs[i].Addrs = pm.pstore.Addrs(recs[i].ID)
+			}
+		}
+		return recs, nil
 	}
 }
 
-func (pm *ProviderManager) getProvidersForKey(ctx context.Context, k []byte) ([]peer.ID, error) {
+func (pm *ProviderManager) getProviderRecordsForKey(ctx context.Context, k []byte) ([]ProviderRecord, error) {
 	pset, err := pm.getProviderSetForKey(ctx, k)
 	if err != nil {
 		return nil, err
 	}
-	return pset.providers, nil
+	return pset.records(time.Now()), nil
 }
 
 // returns the ProviderSet if it already exists on cache, otherwise loads it from datasatore
@@ -344,10 +679,10 @@ func loadProviderSet(ctx context.Context, dstore ds.Datastore, k []byte) (*provi
 		}
 
 		// check expiration time
-		t, err := readTimeValue(e.Value)
+		t, addrs, signed, protos, ext, err := decodeProviderEntry(e.Value)
 		switch {
 		case err != nil:
-			// couldn't parse the time
+			// couldn't parse the record
 			log.Error("parsing providers record from disk: ", err)
 			fallthrough
 		case now.Sub(t) > ProvideValidity:
@@ -356,6 +691,7 @@ func loadProviderSet(ctx context.Context, dstore ds.Datastore, k []byte) (*provi
 			if err != nil && err != ds.ErrNotFound {
 				log.Error("failed to remove provider record from disk: ", err)
 			}
+			stats.Record(ctx, metrics.ProviderRecordsExpired.M(1))
 			continue
 		}
 
@@ -374,11 +710,34 @@ func loadProviderSet(ctx context.Context, dstore ds.Datastore, k []byte) (*provi
 		pid := peer.ID(decstr)
 
 		out.setVal(pid, t)
+		out.addrs[pid] = addrs
+		out.setSigned(pid, signed)
+		out.setProtocols(pid, protos)
+		out.setExtensions(pid, ext)
 	}
 
 	return out, nil
 }
 
+// providerKeyOf returns the key part of the datastore key of a provider record.
+func providerKeyOf(dsk string) string {
+	return dsk[:strings.LastIndex(dsk, "/")]
+}
+
+// recordOccupancy records the number of records and keys stored, and the
+// number of records per key, counted by a GC round.
+func recordOccupancy(ctx context.Context, keys map[string]int64) {
+	var records int64
+	for _, n := range keys {
+		records += n
+		stats.Record(ctx, metrics.ProvidersPerKey.M(n))
+	}
+	stats.Record(ctx,
+		metrics.ProviderRecordsStored.M(records),
+		metrics.ProviderKeysStored.M(int64(len(keys))),
+	)
+}
+
 func readTimeValue(data []byte) (time.Time, error) {
 	nsec, n := binary.Varint(data)
 	if n <= 0 {
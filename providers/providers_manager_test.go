@@ -1,25 +1,34 @@
 package providers
 
 import (
+	"bytes"
 	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/libp2p/go-libp2p-core/peer"
 	"github.com/libp2p/go-libp2p-peerstore/pstoremem"
 
+	ma "github.com/multiformats/go-multiaddr"
 	mh "github.com/multiformats/go-multihash"
 
 	ds "github.com/ipfs/go-datastore"
+	namespace "github.com/ipfs/go-datastore/namespace"
 	dsq "github.com/ipfs/go-datastore/query"
 	dssync "github.com/ipfs/go-datastore/sync"
 	u "github.com/ipfs/go-ipfs-util"
 	//
 	// used by TestLargeProvidersSet: do not remove
 	// lds "github.com/ipfs/go-ds-leveldb"
+
+	"go.opencensus.io/stats/view"
+
+	"github.com/libp2p/go-libp2p-kad-dht/metrics"
 )
 
 func TestProviderManager(t *testing.T) {
@@ -102,12 +111,12 @@ func TestProvidersSerialization(t *testing.T) {
 	pt1 := time.Now()
 	pt2 := pt1.Add(time.Hour)
 
-	err := writeProviderEntry(context.Background(), dstore, k, p1, pt1)
+	err := writeProviderEntry(context.Background(), dstore, k, p1, pt1, nil, signedTimestamp{}, nil, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	err = writeProviderEntry(context.Background(), dstore, k, p2, pt2)
+	err = writeProviderEntry(context.Background(), dstore, k, p2, pt2, nil, signedTimestamp{}, nil, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -337,3 +346,451 @@ func TestWriteUpdatesCache(t *testing.T) {
 		t.Fatalf("expected h1 to be provided by 2 peers, is by %d", len(c1Provs))
 	}
 }
+
+func TestProviderAddrsMerged(t *testing.T) {
+	old := lruCacheSize
+	lruCacheSize = 1
+	defer func() { lruCacheSize = old }()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	pm, err := NewProviderManager(ctx, peer.ID("self"), pstoremem.NewPeerstore(), dssync.MutexWrap(ds.NewMapDatastore()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pm.proc.Close()
+
+	addrs := make([]ma.Multiaddr, 4)
+	for i := range addrs {
+		addrs[i] = ma.StringCast(fmt.Sprintf("/ip4/1.2.3.4/tcp/%d", 4000+i))
+	}
+
+	prov := peer.ID("provider")
+	h1 := u.Hash([]byte("1"))
+	h2 := u.Hash([]byte("2"))
+
+	check := func(expected ...ma.Multiaddr) {
+		t.Helper()
+		provs, err := pm.GetProviders(ctx, h1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(provs) != 1 {
+			t.Fatalf("expected a single merged provider record, got %d", len(provs))
+		}
+		if len(provs[0].Addrs) != len(expected) {
+			t.Fatalf("expected addresses %v, got %v", expected, provs[0].Addrs)
+		}
+		for i, a := range expected {
+			if !a.Equal(provs[0].Addrs[i]) {
+				t.Fatalf("expected addresses %v, got %v", expected, provs[0].Addrs)
+			}
+		}
+	}
+
+	pm.AddProvider(ctx, h1, peer.AddrInfo{ID: prov, Addrs: addrs[:2]})
+	check(addrs[0], addrs[1])
+
+	// merged in the cache
+	pm.AddProvider(ctx, h1, peer.AddrInfo{ID: prov, Addrs: addrs[1:3]})
+	check(addrs[1], addrs[2], addrs[0])
+
+	// merged on disk
+	pm.AddProvider(ctx, h2, peer.AddrInfo{ID: prov})
+	pm.AddProvider(ctx, h1, peer.AddrInfo{ID: prov, Addrs: addrs[3:]})
+	pm.AddProvider(ctx, h2, peer.AddrInfo{ID: prov})
+	check(addrs[3], addrs[1], addrs[2], addrs[0])
+}
+
+func TestUnsignedUpdateKeepsRecord(t *testing.T) {
+	old := lruCacheSize
+	lruCacheSize = 1
+	defer func() { lruCacheSize = old }()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	pm, err := NewProviderManager(ctx, peer.ID("self"), pstoremem.NewPeerstore(), dssync.MutexWrap(ds.NewMapDatastore()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pm.proc.Close()
+
+	prov := peer.ID("provider")
+	h1 := u.Hash([]byte("1"))
+	h2 := u.Hash([]byte("2"))
+	signedAt := time.Now().Truncate(time.Second)
+
+	check := func() {
+		t.Helper()
+		recs, err := pm.GetProviderRecords(ctx, h1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(recs) != 1 {
+			t.Fatalf("expected a single provider record, got %d", len(recs))
+		}
+		if !recs[0].SignedAt.Equal(signedAt) || string(recs[0].Signature) != "sig" {
+			t.Fatalf("expected the signature to be kept, got %v %q", recs[0].SignedAt, recs[0].Signature)
+		}
+		if len(recs[0].TransferProtocols) != 1 || recs[0].TransferProtocols[0] != "bitswap" {
+			t.Fatalf("expected the transfer protocols to be kept, got %v", recs[0].TransferProtocols)
+		}
+	}
+
+	if err := pm.AddProviderRecord(ctx, h1, ProviderRecord{
+		AddrInfo:          peer.AddrInfo{ID: prov},
+		SignedAt:          signedAt,
+		Signature:         []byte("sig"),
+		TransferProtocols: []string{"bitswap"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	check()
+
+	// refreshed in the cache
+	pm.AddProvider(ctx, h1, peer.AddrInfo{ID: prov})
+	check()
+
+	// refreshed on disk
+	pm.AddProvider(ctx, h2, peer.AddrInfo{ID: prov})
+	pm.AddProvider(ctx, h1, peer.AddrInfo{ID: prov})
+	pm.AddProvider(ctx, h2, peer.AddrInfo{ID: prov})
+	check()
+}
+
+func TestProviderEntrySerialization(t *testing.T) {
+	now := time.Now()
+	addrs := []providerAddr{
+		{addr: ma.StringCast("/ip4/1.2.3.4/tcp/4001"), seen: now},
+		{addr: ma.StringCast("/ip6/::1/udp/4001/quic"), seen: now.Add(-time.Minute)},
+	}
+
+	signed := signedTimestamp{at: now.Add(-time.Second), sig: []byte("signature")}
+	protos := []string{"bitswap", "http"}
+	ext := []byte{0xc2, 0x3e, 0x01, 0x2a}
+
+	tm, decoded, decodedSig, decodedProtos, decodedExt, err := decodeProviderEntry(encodeProviderEntry(now, addrs, signed, protos, ext))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !tm.Equal(now) || len(decoded) != len(addrs) {
+		t.Fatalf("provider entry wasn't serialized correctly")
+	}
+	if !decodedSig.at.Equal(signed.at) || !bytes.Equal(decodedSig.sig, signed.sig) {
+		t.Fatalf("signed timestamp wasn't serialized correctly")
+	}
+	if len(decodedProtos) != len(protos) || decodedProtos[0] != protos[0] || decodedProtos[1] != protos[1] {
+		t.Fatalf("transfer protocols weren't serialized correctly")
+	}
+	if !bytes.Equal(decodedExt, ext) {
+		t.Fatalf("extensions weren't serialized correctly")
+	}
+	for i := range addrs {
+		if !addrs[i].addr.Equal(decoded[i].addr) || !addrs[i].seen.Equal(decoded[i].seen) {
+			t.Fatalf("provider address %d wasn't serialized correctly", i)
+		}
+	}
+
+	// the time is readable on its own
+	tm, err = readTimeValue(encodeProviderEntry(now, addrs, signed, protos, ext))
+	if err != nil || !tm.Equal(now) {
+		t.Fatalf("time wasnt serialized correctly")
+	}
+
+	// the optional fields can be left out
+	_, decoded, decodedSig, decodedProtos, decodedExt, err = decodeProviderEntry(encodeProviderEntry(now, addrs, signedTimestamp{}, nil, nil))
+	if err != nil || len(decoded) != len(addrs) || decodedSig.isSet() || len(decodedProtos) != 0 || len(decodedExt) != 0 {
+		t.Fatalf("unsigned provider entry wasn't serialized correctly")
+	}
+}
+
+func TestShardedProviderManager(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dstore := dssync.MutexWrap(ds.NewMapDatastore())
+	shards := make([]ds.Batching, 4)
+	for i := range shards {
+		shards[i] = namespace.Wrap(dstore, ds.NewKey(fmt.Sprintf("/shard-%d", i)))
+	}
+
+	spm, err := NewShardedProviderManager(ctx, peer.ID("self"), pstoremem.NewPeerstore(), shards)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	friend := peer.ID("friend")
+	var mhs []mh.Multihash
+	for i := 0; i < 100; i++ {
+		h := u.Hash([]byte(fmt.Sprint(i)))
+		mhs = append(mhs, h)
+		spm.AddProvider(ctx, h, peer.AddrInfo{ID: friend})
+	}
+
+	for _, c := range mhs {
+		resp, err := spm.GetProviders(ctx, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(resp) != 1 || resp[0].ID != friend {
+			t.Fatal("expected provider to be returned")
+		}
+	}
+
+	spm.Process().Close()
+	for i, shard := range shards {
+		res, err := shard.Query(ctx, dsq.Query{Prefix: ProvidersKeyPrefix, KeysOnly: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries, err := res.Rest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) == 0 {
+			t.Fatalf("expected shard %d to store some of the records", i)
+		}
+	}
+}
+
+func TestProviderStoreMetrics(t *testing.T) {
+	views := []*view.View{metrics.ProviderRecordsStoredView, metrics.ProviderKeysStoredView, metrics.ProviderRecordsAddedView}
+	if err := view.Register(views...); err != nil {
+		t.Fatal(err)
+	}
+	defer view.Unregister(views...)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	pm, err := NewProviderManager(ctx, peer.ID("testing"), pstoremem.NewPeerstore(), dssync.MutexWrap(ds.NewMapDatastore()), CleanupInterval(50*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pm.proc.Close()
+
+	k1, k2 := u.Hash([]byte("one")), u.Hash([]byte("two"))
+	pm.AddProvider(ctx, k1, peer.AddrInfo{ID: "a"})
+	pm.AddProvider(ctx, k1, peer.AddrInfo{ID: "b"})
+	pm.AddProvider(ctx, k2, peer.AddrInfo{ID: "a"})
+	// a refresh isn't a new record
+	pm.AddProvider(ctx, k2, peer.AddrInfo{ID: "a"})
+
+	lastValue := func(v *view.View) float64 {
+		rows, err := view.RetrieveData(v.Name)
+		if err != nil || len(rows) == 0 {
+			return -1
+		}
+		switch data := rows[0].Data.(type) {
+		case *view.LastValueData:
+			return data.Value
+		case *view.CountData:
+			return float64(data.Value)
+		}
+		return -1
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for lastValue(metrics.ProviderRecordsStoredView) != 3 || lastValue(metrics.ProviderKeysStoredView) != 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected 3 records under 2 keys, got %v under %v",
+				lastValue(metrics.ProviderRecordsStoredView), lastValue(metrics.ProviderKeysStoredView))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if added := lastValue(metrics.ProviderRecordsAddedView); added != 3 {
+		t.Fatalf("expected 3 added records, got %v", added)
+	}
+}
+
+func TestProviderExportImport(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	newPM := func() *ProviderManager {
+		pm, err := NewProviderManager(ctx, peer.ID("testing"), pstoremem.NewPeerstore(), dssync.MutexWrap(ds.NewMapDatastore()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return pm
+	}
+	src := newPM()
+	defer src.proc.Close()
+
+	addr := ma.StringCast("/ip4/1.2.3.4/tcp/4001")
+	k1, k2 := u.Hash([]byte("one")), u.Hash([]byte("two"))
+	src.AddProviderRecord(ctx, k1, ProviderRecord{AddrInfo: peer.AddrInfo{ID: "a", Addrs: []ma.Multiaddr{addr}}, TransferProtocols: []string{"bitswap"}})
+	src.AddProvider(ctx, k1, peer.AddrInfo{ID: "b"})
+	src.AddProvider(ctx, k2, peer.AddrInfo{ID: "a"})
+
+	var buf bytes.Buffer
+	n, err := src.Export(ctx, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Fatalf("expected 3 exported records, got %d", n)
+	}
+	dump := buf.Bytes()
+
+	dstores := []ds.Batching{
+		namespace.Wrap(dssync.MutexWrap(ds.NewMapDatastore()), ds.NewKey("a")),
+		namespace.Wrap(dssync.MutexWrap(ds.NewMapDatastore()), ds.NewKey("b")),
+	}
+	sharded, err := NewShardedProviderManager(ctx, peer.ID("testing"), pstoremem.NewPeerstore(), dstores)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sharded.Process().Close()
+
+	dst := newPM()
+	defer dst.proc.Close()
+	for _, store := range []ProviderExporter{dst, sharded} {
+		n, err = store.Import(ctx, bytes.NewReader(dump))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 3 {
+			t.Fatalf("expected 3 imported records, got %d", n)
+		}
+		// importing again doesn't replace the records with equally old ones
+		if n, err = store.Import(ctx, bytes.NewReader(dump)); err != nil || n != 0 {
+			t.Fatalf("expected no records to be imported twice, got %d (%v)", n, err)
+		}
+
+		recs, err := store.(ProviderRecordStore).GetProviderRecords(ctx, k1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(recs) != 2 {
+			t.Fatalf("expected 2 providers, got %d", len(recs))
+		}
+		for _, rec := range recs {
+			if rec.ID == "a" && (len(rec.Addrs) != 1 || !rec.Addrs[0].Equal(addr) || len(rec.TransferProtocols) != 1) {
+				t.Fatalf("provider record metadata wasn't preserved: %v", rec)
+			}
+		}
+		if provs, err := store.(ProviderStore).GetProviders(ctx, k2); err != nil || len(provs) != 1 {
+			t.Fatalf("expected 1 provider, got %d (%v)", len(provs), err)
+		}
+	}
+
+	// a truncated dump is rejected
+	if _, err := dst.Import(ctx, bytes.NewReader(dump[:len(dump)-1])); err != io.ErrUnexpectedEOF {
+		t.Fatalf("expected an unexpected EOF, got %v", err)
+	}
+	if _, err := dst.Import(ctx, strings.NewReader("garbage")); err == nil {
+		t.Fatal("expected an error importing garbage")
+	}
+}
+
+func TestProviderExpirySweep(t *testing.T) {
+	epochLength := expiryEpochLength
+	expiryEpochLength = time.Minute
+	defer func() { expiryEpochLength = epochLength }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	now := time.Now()
+	old := now.Add(-2 * ProvideValidity)
+	k1, k2, k3 := u.Hash([]byte("one")), u.Hash([]byte("two")), u.Hash([]byte("three"))
+	has := func(dstore ds.Datastore, key string) bool {
+		ok, err := dstore.Has(ctx, ds.NewKey(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ok
+	}
+	runGC := func(dstore ds.Batching) {
+		pm, err := NewProviderManager(ctx, peer.ID("testing"), pstoremem.NewPeerstore(), dstore, CleanupInterval(10*time.Millisecond))
+		if err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(200 * time.Millisecond)
+		// flushes the pending writes
+		pm.proc.Close()
+	}
+
+	// records written before the index existed are indexed by a full scan
+	dstore := dssync.MutexWrap(ds.NewMapDatastore())
+	writeProviderEntry(ctx, dstore, k1, "a", old, nil, signedTimestamp{}, nil, nil)
+	writeProviderEntry(ctx, dstore, k2, "a", now, nil, signedTimestamp{}, nil, nil)
+	runGC(dstore)
+	if has(dstore, mkProvKeyFor(k1, "a")) {
+		t.Fatal("expected the expired record to be collected")
+	}
+	if !has(dstore, mkProvKeyFor(k2, "a")) || !has(dstore, mkExpiryKeyFor(mkProvKeyFor(k2, "a"), now)) {
+		t.Fatal("expected the live record to be indexed")
+	}
+	if !has(dstore, expirySweptKey.String()) {
+		t.Fatal("expected the index to be marked as complete")
+	}
+
+	// indexed records are dropped by sweeping the expired epochs
+	dstore = dssync.MutexWrap(ds.NewMapDatastore())
+	writeSweptEpoch(ctx, dstore, expiryEpoch(old)-1)
+	for _, k := range [][]byte{k1, k2} {
+		writeProviderEntry(ctx, dstore, k, "a", old, nil, signedTimestamp{}, nil, nil)
+		indexExpiry(ctx, dstore, mkProvKeyFor(k, "a"), old)
+	}
+	// refreshed since
+	writeProviderEntry(ctx, dstore, k2, "a", now, nil, signedTimestamp{}, nil, nil)
+	indexExpiry(ctx, dstore, mkProvKeyFor(k2, "a"), now)
+	// removed since
+	indexExpiry(ctx, dstore, mkProvKeyFor(k3, "a"), old)
+
+	runGC(dstore)
+	if has(dstore, mkProvKeyFor(k1, "a")) {
+		t.Fatal("expected the expired record to be swept")
+	}
+	if !has(dstore, mkProvKeyFor(k2, "a")) || !has(dstore, mkExpiryKeyFor(mkProvKeyFor(k2, "a"), now)) {
+		t.Fatal("expected the refreshed record to be kept")
+	}
+	res, err := dstore.Query(ctx, dsq.Query{Prefix: mkExpiryPrefix(expiryEpoch(old)), KeysOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rest, _ := res.Rest(); len(rest) != 0 {
+		t.Fatalf("expected the expired epoch to be emptied, got %d entries", len(rest))
+	}
+}
+
+func TestProviderRecordTTL(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	pm, err := NewProviderManager(ctx, peer.ID("testing"), pstoremem.NewPeerstore(), dssync.MutexWrap(ds.NewMapDatastore()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pm.proc.Close()
+
+	k := u.Hash([]byte("ttl"))
+	start := time.Now()
+	if err := pm.AddProviderRecord(ctx, k, ProviderRecord{AddrInfo: peer.AddrInfo{ID: "short"}, TTL: time.Hour}); err != nil {
+		t.Fatal(err)
+	}
+	// capped at the default validity
+	if err := pm.AddProviderRecord(ctx, k, ProviderRecord{AddrInfo: peer.AddrInfo{ID: "long"}, TTL: 2 * ProvideValidity}); err != nil {
+		t.Fatal(err)
+	}
+
+	recs, err := pm.GetProviderRecords(ctx, k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) != 2 {
+		t.Fatalf("expected 2 records, got %d", len(recs))
+	}
+	for _, rec := range recs {
+		expires := rec.Received.Add(ProvideValidity)
+		want := ProvideValidity
+		if rec.ID == "short" {
+			want = time.Hour
+		}
+		if expires.Before(start.Add(want)) || expires.After(time.Now().Add(want)) {
+			t.Fatalf("expected the record of %s to expire in %s, expires at %s", rec.ID, want, expires)
+		}
+	}
+}
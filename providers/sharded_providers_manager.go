@@ -0,0 +1,98 @@
+package providers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	peerstore "github.com/libp2p/go-libp2p-core/peerstore"
+
+	ds "github.com/ipfs/go-datastore"
+	goprocess "github.com/jbenet/goprocess"
+	goprocessctx "github.com/jbenet/goprocess/context"
+)
+
+// ShardedProviderManager spreads provider records across several
+// ProviderManagers, each one with its own datastore, cache and GC. Keys are
+// assigned to shards by their position in the DHT keyspace, so every shard
+// holds a contiguous range of it.
+//
+// A single ProviderManager serializes all operations through one goroutine,
+// sharding removes that bottleneck for nodes storing very large numbers of
+// provider records.
+type ShardedProviderManager struct {
+	shards []*ProviderManager
+	proc   goprocess.Process
+}
+
+var _ ProviderStore = (*ShardedProviderManager)(nil)
+var _ ProviderRemover = (*ShardedProviderManager)(nil)
+var _ ProviderRecordStore = (*ShardedProviderManager)(nil)
+
+// NewShardedProviderManager constructs a provider store with one shard per
+// datastore. The datastores must not overlap; a single datastore can be split
+// with namespace.Wrap. The set of datastores must stay the same across
+// restarts, or previously stored records will end up in the wrong shard.
+func NewShardedProviderManager(ctx context.Context, local peer.ID, ps peerstore.Peerstore, dstores []ds.Batching, opts ...Option) (*ShardedProviderManager, error) {
+	if len(dstores) == 0 {
+		return nil, fmt.Errorf("a sharded provider manager needs at least one datastore")
+	}
+
+	spm := &ShardedProviderManager{
+		shards: make([]*ProviderManager, 0, len(dstores)),
+		proc:   goprocessctx.WithContext(ctx),
+	}
+	for _, dstore := range dstores {
+		pm, err := NewProviderManager(ctx, local, ps, dstore, opts...)
+		if err != nil {
+			spm.proc.Close()
+			return nil, err
+		}
+		spm.proc.AddChild(pm.Process())
+		spm.shards = append(spm.shards, pm)
+	}
+	return spm, nil
+}
+
+// Process returns the ShardedProviderManager process. Closing it closes all
+// the shards.
+func (spm *ShardedProviderManager) Process() goprocess.Process {
+	return spm.proc
+}
+
+// AddProvider adds a provider to the shard responsible for the key.
+func (spm *ShardedProviderManager) AddProvider(ctx context.Context, k []byte, provInfo peer.AddrInfo) error {
+	return spm.shard(k).AddProvider(ctx, k, provInfo)
+}
+
+// GetProviders returns the set of providers for the given key from the shard
+// responsible for it.
+func (spm *ShardedProviderManager) GetProviders(ctx context.Context, k []byte) ([]peer.AddrInfo, error) {
+	return spm.shard(k).GetProviders(ctx, k)
+}
+
+// AddProviderRecord adds a provider record to the shard responsible for the key.
+func (spm *ShardedProviderManager) AddProviderRecord(ctx context.Context, k []byte, rec ProviderRecord) error {
+	return spm.shard(k).AddProviderRecord(ctx, k, rec)
+}
+
+// GetProviderRecords returns the provider records for the given key from the
+// shard responsible for it.
+func (spm *ShardedProviderManager) GetProviderRecords(ctx context.Context, k []byte) ([]ProviderRecord, error) {
+	return spm.shard(k).GetProviderRecords(ctx, k)
+}
+
+// RemoveProvider retracts the provider record of p for the key from the shard
+// responsible for it.
+func (spm *ShardedProviderManager) RemoveProvider(ctx context.Context, k []byte, p peer.ID) error {
+	return spm.shard(k).RemoveProvider(ctx, k, p)
+}
+
+func (spm *ShardedProviderManager) shard(k []byte) *ProviderManager {
+	// split the keyspace in len(shards) contiguous ranges
+	h := sha256.Sum256(k)
+	pos := uint64(binary.BigEndian.Uint32(h[:4]))
+	return spm.shards[pos*uint64(len(spm.shards))>>32]
+}
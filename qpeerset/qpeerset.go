@@ -20,6 +20,11 @@ const (
 	PeerQueried
 	// PeerUnreachable is applied to peers who have been queried and a response was not retrieved successfully.
 	PeerUnreachable
+	// PeerThrottled is applied to peers who refused to be queried because we exceeded their request rate
+	// limit, or that are still backed off from after doing so.
+	PeerThrottled
+	// PeerBlocked is applied to peers which our connection gater doesn't allow us to dial.
+	PeerBlocked
 )
 
 // QueryPeerset maintains the state of a Kademlia asynchronous lookup.
@@ -157,3 +162,8 @@ func (qp *QueryPeerset) NumHeard() int {
 func (qp *QueryPeerset) NumWaiting() int {
 	return len(qp.GetClosestInStates(PeerWaiting))
 }
+
+// Len returns the number of peers in the set, whatever their state.
+func (qp *QueryPeerset) Len() int {
+	return len(qp.all)
+}
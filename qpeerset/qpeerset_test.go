@@ -53,6 +53,7 @@ func TestQPeerSet(t *testing.T) {
 	require.Equal(t, PeerHeard, qp.GetState(peer2))
 	require.False(t, qp.TryAdd(peer2, oracle))
 	require.Equal(t, 0, qp.NumWaiting())
+	require.Equal(t, 1, qp.Len())
 
 	// add peer4
 	require.True(t, qp.TryAdd(peer4, oracle))
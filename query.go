@@ -5,17 +5,25 @@ import (
 	"errors"
 	"fmt"
 	"math"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/libp2p/go-libp2p-core/network"
 	"github.com/libp2p/go-libp2p-core/peer"
-	pstore "github.com/libp2p/go-libp2p-core/peerstore"
 	"github.com/libp2p/go-libp2p-core/routing"
 
 	"github.com/google/uuid"
+	"github.com/libp2p/go-libp2p-kad-dht/metrics"
+	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
 	"github.com/libp2p/go-libp2p-kad-dht/qpeerset"
 	kb "github.com/libp2p/go-libp2p-kbucket"
+	swarm "github.com/libp2p/go-libp2p-swarm"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/tag"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // ErrNoPeersQueried is returned when we failed to connect to any peers.
@@ -58,10 +66,44 @@ type query struct {
 
 	// stopFn is used to determine if we should stop the WHOLE disjoint query.
 	stopFn stopFn
+
+	// numResults is the number of closest peers returned by the query.
+	numResults int
+
+	// timeouts is the number of peers that timed out.
+	timeouts int
+
+	// reason is why the query terminated.
+	reason LookupTerminationReason
+
+	// latencyWeight weighs the latency of the peers against their distance
+	// to the key when picking the peers to query next.
+	latencyWeight float64
+
+	// latency returns the latency of the peers weighted by latencyWeight,
+	// the latency EWMA of the peerstore if nil.
+	latency func(peer.ID) time.Duration
+
+	// shadow is set for the shadow queries of lookup experiments, whose
+	// events aren't published.
+	shadow bool
+
+	// sampled is set for the queries traced, see LookupSampling.
+	sampled bool
+
+	// progress reports the progress of the query to Introspect, nil for
+	// shadow queries.
+	progress *pb.Introspection_Lookup
+
+	// recording records the lookup, if run with RecordLookups.
+	recording *lookupRecording
+
+	// referrals tracks the responses not getting the lookup closer.
+	referrals referrals
 }
 
 type lookupWithFollowupResult struct {
-	peers []peer.ID            // the top K not unreachable peers at the end of the query
+	peers []peer.ID            // the top K (or numResults) not unreachable peers at the end of the query
 	state []qpeerset.PeerState // the peer states at the end of the query
 
 	// indicates that neither the lookup nor the followup has been prematurely terminated by an external condition such
@@ -69,19 +111,35 @@ type lookupWithFollowupResult struct {
 	completed bool
 }
 
-// runLookupWithFollowup executes the lookup on the target using the given query function and stopping when either the
+// runLookupWithFollowup executes the lookup, for the DHT operation op, on the target using the given query function and stopping when either the
 // context is cancelled or the stop function returns true. Note: if the stop function is not sticky, i.e. it does not
 // return true every time after the first time it returns true, it is not guaranteed to cause a stop to occur just
 // because it momentarily returns true.
 //
 // After the lookup is complete the query function is run (unless stopped) against all of the top K peers from the
 // lookup that have not already been successfully queried.
-func (dht *IpfsDHT) runLookupWithFollowup(ctx context.Context, target string, queryFn queryFn, stopFn stopFn) (*lookupWithFollowupResult, error) {
+func (dht *IpfsDHT) runLookupWithFollowup(ctx context.Context, op string, target string, queryFn queryFn, stopFn stopFn) (*lookupWithFollowupResult, error) {
+	return dht.runLookupWithFollowupN(ctx, op, target, dht.bucketSize, queryFn, stopFn)
+}
+
+// runLookupWithFollowupN works like runLookupWithFollowup but returns, and follows up on, the top numResults peers
+// rather than the top K. The lookup itself, and therefore its termination, is unaffected.
+func (dht *IpfsDHT) runLookupWithFollowupN(ctx context.Context, op string, target string, numResults int, queryFn queryFn, stopFn stopFn) (*lookupWithFollowupResult, error) {
+	ctx = dht.operationContext(ctx, op)
+	sampled := dht.sampleLookup()
+	ctx, span := startLookupSpan(ctx, target, sampled)
+	defer span.End()
+	defer dht.introspection.recordOperation(op, time.Now())
+
 	// run the query
-	lookupRes, err := dht.runQuery(ctx, target, queryFn, stopFn)
+	lookupRes, err := dht.runQuery(ctx, op, target, numResults, sampled, queryFn, stopFn)
+	dht.lookupFailed(ctx, op, target, lookupRes, err)
 	if err != nil {
 		return nil, err
 	}
+	if lookupRes.completed {
+		dht.trackNetworkSize(target, lookupRes.peers)
+	}
 
 	// query all of the top K peers we've either Heard about or have outstanding queries we're Waiting on.
 	// This ensures that all of the top K results have been queried which adds to resiliency against churn for query
@@ -110,7 +168,14 @@ func (dht *IpfsDHT) runLookupWithFollowup(ctx context.Context, target string, qu
 	for _, p := range queryPeers {
 		qp := p
 		go func() {
-			_, _ = queryFn(followUpCtx, qp)
+			ctx, span := followUpCtx, trace.SpanFromContext(followUpCtx)
+			if sampled {
+				ctx, span = startPeerSpan(followUpCtx, "follow up", qp, "")
+			}
+			if _, err := queryFn(ctx, qp); err != nil {
+				failSpan(span, err)
+			}
+			span.End()
 			doneCh <- struct{}{}
 		}()
 	}
@@ -145,10 +210,20 @@ processFollowUp:
 	return lookupRes, nil
 }
 
-func (dht *IpfsDHT) runQuery(ctx context.Context, target string, queryFn queryFn, stopFn stopFn) (*lookupWithFollowupResult, error) {
+func (dht *IpfsDHT) runQuery(ctx context.Context, op string, target string, numResults int, sampled bool, queryFn queryFn, stopFn stopFn) (*lookupWithFollowupResult, error) {
+	ctx, done, err := dht.drainer.enter(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
 	// pick the K closest peers to the key in our Routing table.
 	targetKadID := kb.ConvertKey(target)
 	seedPeers := dht.routingTable.NearestPeers(targetKadID, dht.bucketSize)
+	if len(seedPeers) == 0 {
+		// peers reached over HTTP don't make it to the routing table
+		seedPeers = dht.httpSeeds
+	}
 	if len(seedPeers) == 0 {
 		routing.PublishQueryEvent(ctx, &routing.QueryEvent{
 			Type:  routing.QueryError,
@@ -168,16 +243,58 @@ func (dht *IpfsDHT) runQuery(ctx context.Context, target string, queryFn queryFn
 		terminated: false,
 		queryFn:    queryFn,
 		stopFn:     stopFn,
+		numResults: numResults,
+
+		latencyWeight: dht.latencyWeight,
+		sampled:       sampled,
+	}
+	q.progress = dht.introspection.startLookup(q, op)
+	recorder := lookupRecorderFromContext(ctx)
+	if recorder != nil {
+		q.recording = newLookupRecording(q)
+		q.latency = q.recording.latency(q)
 	}
+	defer dht.introspection.endLookup(q.progress)
+	experiment := dht.startLookupExperiment(target, seedPeers)
 
 	// run the query
+	start := time.Now()
 	q.run()
+	elapsed := time.Since(start)
+	stats.Record(ctx,
+		metrics.LookupLatency.M(float64(elapsed)/float64(time.Millisecond)),
+		metrics.LookupPeersQueried.M(int64(len(q.queryPeers.GetClosestInStates(qpeerset.PeerQueried, qpeerset.PeerUnreachable)))),
+		metrics.LookupHops.M(int64(q.hops())),
+		metrics.LookupPeersetEntries.M(int64(q.queryPeers.Len())),
+	)
 
 	if ctx.Err() == nil {
 		q.recordValuablePeers()
+		if dht.anomalies != nil && !q.shadow {
+			dht.anomalies.track(elapsed, q.timeouts, len(q.queryPeers.GetClosestInStates(qpeerset.PeerQueried, qpeerset.PeerUnreachable)))
+		}
+	}
+
+	if recorder != nil {
+		recorder.write(q.recording.rec)
 	}
 
 	res := q.constructLookupResult(targetKadID)
+	logged := dht.lookupLogs && sampled
+	traced := trace.SpanFromContext(ctx).IsRecording()
+	if logged || dht.debugEvents.subscribed() || experiment != nil || traced {
+		summary := q.summary(elapsed, res)
+		if traced {
+			endLookupSpan(ctx, summary)
+		}
+		if logged {
+			logLookup(summary)
+		}
+		dht.debugEvents.publish(&DebugEvent{Summary: summary})
+		if experiment != nil {
+			experiment <- q.experimentRun(summary)
+		}
+	}
 	return res, nil
 }
 
@@ -222,7 +339,7 @@ func (q *query) constructLookupResult(target kb.ID) *lookupWithFollowupResult {
 	// extract the top K not unreachable peers
 	var peers []peer.ID
 	peerState := make(map[peer.ID]qpeerset.PeerState)
-	qp := q.queryPeers.GetClosestNInStates(q.dht.bucketSize, qpeerset.PeerHeard, qpeerset.PeerWaiting, qpeerset.PeerQueried)
+	qp := q.queryPeers.GetClosestNInStates(q.numResults, qpeerset.PeerHeard, qpeerset.PeerWaiting, qpeerset.PeerQueried)
 	for _, p := range qp {
 		state := q.queryPeers.GetState(p)
 		peerState[p] = state
@@ -231,8 +348,8 @@ func (q *query) constructLookupResult(target kb.ID) *lookupWithFollowupResult {
 
 	// get the top K overall peers
 	sortedPeers := kb.SortClosestPeers(peers, target)
-	if len(sortedPeers) > q.dht.bucketSize {
-		sortedPeers = sortedPeers[:q.dht.bucketSize]
+	if len(sortedPeers) > q.numResults {
+		sortedPeers = sortedPeers[:q.numResults]
 	}
 
 	// return the top K not unreachable peers as well as their states at the end of the query
@@ -254,6 +371,10 @@ type queryUpdate struct {
 	queried     []peer.ID
 	heard       []peer.ID
 	unreachable []peer.ID
+	throttled   []peer.ID
+
+	// timedOut is set if the unreachable peer timed out.
+	timedOut bool
 
 	queryDuration time.Duration
 }
@@ -262,20 +383,36 @@ func (q *query) run() {
 	pathCtx, cancelPath := context.WithCancel(q.ctx)
 	defer cancelPath()
 
+	start := time.Now()
 	alpha := q.dht.alpha
 
 	ch := make(chan *queryUpdate, alpha)
 	ch <- &queryUpdate{cause: q.dht.self, heard: q.seedPeers}
 
+	// the peerset is live until all outstanding queries have completed
+	q.dht.trackPeersets(1, 0)
+	entries := 0
+	defer func() { q.dht.trackPeersets(-1, -entries) }()
+
 	// return only once all outstanding queries have completed.
 	defer q.waitGroup.Wait()
 	for {
 		var cause peer.ID
 		select {
 		case update := <-ch:
+			if q.recording != nil {
+				q.recording.update(q, update)
+			}
 			q.updateState(pathCtx, update)
 			cause = update.cause
+			if n := q.queryPeers.Len(); n != entries {
+				q.dht.trackPeersets(0, n-entries)
+				entries = n
+			}
 		case <-pathCtx.Done():
+			if q.recording != nil {
+				q.recording.update(q, nil)
+			}
 			q.terminate(pathCtx, cancelPath, LookupCancelled)
 		}
 
@@ -285,12 +422,20 @@ func (q *query) run() {
 
 		// termination is triggered on end-of-lookup conditions or starvation of unused peers
 		// it also returns the peers we should query next for a maximum of `maxNumQueriesToSpawn` peers.
+		var heard []peer.ID
+		if q.recording != nil {
+			heard = q.queryPeers.GetClosestInStates(qpeerset.PeerHeard)
+		}
 		ready, reason, qPeers := q.isReadyToTerminate(pathCtx, maxNumQueriesToSpawn)
 		if ready {
 			q.terminate(pathCtx, cancelPath, reason)
 		}
+		if q.recording != nil {
+			q.recording.decide(q, heard, qPeers)
+		}
 
 		if q.terminated {
+			q.publishProgress(start)
 			return
 		}
 
@@ -298,12 +443,16 @@ func (q *query) run() {
 		for _, p := range qPeers {
 			q.spawnQuery(pathCtx, cause, p, ch)
 		}
+		if q.progress != nil {
+			q.dht.introspection.updateLookup(q.progress, q)
+		}
+		q.publishProgress(start)
 	}
 }
 
 // spawnQuery starts one query, if an available heard peer is found
 func (q *query) spawnQuery(ctx context.Context, cause peer.ID, queryPeer peer.ID, ch chan<- *queryUpdate) {
-	PublishLookupEvent(ctx,
+	q.publishLookupEvent(ctx,
 		NewLookupEvent(
 			q.dht.self,
 			q.id,
@@ -320,38 +469,82 @@ func (q *query) spawnQuery(ctx context.Context, cause peer.ID, queryPeer peer.ID
 			nil,
 		),
 	)
+	if q.sampled {
+		ctx, _ = startPeerSpan(ctx, "query peer", queryPeer, q.queryPeers.GetReferrer(queryPeer))
+	}
 	q.queryPeers.SetState(queryPeer, qpeerset.PeerWaiting)
 	q.waitGroup.Add(1)
 	go q.queryPeer(ctx, ch, queryPeer)
 }
 
+// publishLookupEvent publishes ev to the lookup event channel of ctx, if any,
+// and to the subscribers of the debug server.
+func (q *query) publishLookupEvent(ctx context.Context, ev *LookupEvent) {
+	if q.shadow {
+		return
+	}
+	PublishLookupEvent(ctx, ev)
+	q.dht.debugEvents.publish(&DebugEvent{Lookup: ev})
+}
+
 func (q *query) isReadyToTerminate(ctx context.Context, nPeersToQuery int) (bool, LookupTerminationReason, []peer.ID) {
 	// give the application logic a chance to terminate
 	if q.stopFn() {
 		return true, LookupStopped, nil
 	}
-	if q.isStarvationTermination() {
-		return true, LookupStarvation, nil
-	}
-	if q.isLookupTermination() {
-		return true, LookupCompleted, nil
+	q.skipBackedOffPeers()
+	q.skipBlockedPeers()
+	if terminate, reason := q.terminationReason(); terminate {
+		return true, reason, nil
 	}
 
 	// The peers we query next should be ones that we have only Heard about.
 	var peersToQuery []peer.ID
 	peers := q.queryPeers.GetClosestInStates(qpeerset.PeerHeard)
+	if q.latencyWeight > 0 {
+		latency := q.latency
+		if latency == nil {
+			latency = q.dht.peerstore.LatencyEWMA
+		}
+		peers = orderByLatency(peers, latency, q.latencyWeight)
+	}
 	count := 0
+	skipped := false
 	for _, p := range peers {
+		// only the peers picked are checked, the check being too costly
+		// to run for every heard peer on each update
+		if q.dht.inDialBackoff(p) {
+			q.queryPeers.SetState(p, qpeerset.PeerUnreachable)
+			skipped = true
+			continue
+		}
 		peersToQuery = append(peersToQuery, p)
 		count++
 		if count == nPeersToQuery {
 			break
 		}
 	}
+	if skipped {
+		// the peers skipped may have been all that kept the lookup going
+		if terminate, reason := q.terminationReason(); terminate {
+			return true, reason, nil
+		}
+	}
 
 	return false, -1, peersToQuery
 }
 
+// terminationReason reports whether the lookup starved or completed.
+func (q *query) terminationReason() (bool, LookupTerminationReason) {
+	if q.isStarvationTermination() {
+		return true, LookupStarvation
+	}
+	if q.isLookupTermination() {
+		return true, LookupCompleted
+	}
+	return false, -1
+}
+
 // From the set of all nodes that are not unreachable,
 // if the closest beta nodes are all queried, the lookup can terminate.
 func (q *query) isLookupTermination() bool {
@@ -373,7 +566,7 @@ func (q *query) terminate(ctx context.Context, cancel context.CancelFunc, reason
 		return
 	}
 
-	PublishLookupEvent(ctx,
+	q.publishLookupEvent(ctx,
 		NewLookupEvent(
 			q.dht.self,
 			q.id,
@@ -385,6 +578,7 @@ func (q *query) terminate(ctx context.Context, cancel context.CancelFunc, reason
 	)
 	cancel() // abort outstanding queries
 	q.terminated = true
+	q.reason = reason
 }
 
 // queryPeer queries a single peer and reports its findings on the channel.
@@ -393,24 +587,37 @@ func (q *query) queryPeer(ctx context.Context, ch chan<- *queryUpdate, p peer.ID
 	defer q.waitGroup.Done()
 	dialCtx, queryCtx := ctx, ctx
 
+	span := trace.SpanFromContext(ctx)
+	defer span.End()
+
 	// dial the peer
 	if err := q.dht.dialPeer(dialCtx, p); err != nil {
+		failSpan(span, err)
 		// remove the peer if there was a dial failure..but not because of a context cancellation
 		if dialCtx.Err() == nil {
 			q.dht.peerStoppedDHT(q.dht.ctx, p)
 		}
-		ch <- &queryUpdate{cause: p, unreachable: []peer.ID{p}}
+		ch <- &queryUpdate{cause: p, unreachable: []peer.ID{p}, timedOut: dialCtx.Err() == nil && isTimeout(err)}
 		return
 	}
 
 	startQuery := time.Now()
 	// send query RPC to the remote peer
 	newPeers, err := q.queryFn(queryCtx, p)
+	var throttled *pb.ThrottledError
+	if errors.As(err, &throttled) {
+		// the peer is fine, just busy
+		q.dht.peerBackoff.add(p, throttled.RetryAfter)
+		span.SetAttributes(attribute.Bool("throttled", true))
+		ch <- &queryUpdate{cause: p, throttled: []peer.ID{p}}
+		return
+	}
 	if err != nil {
+		failSpan(span, err)
 		if queryCtx.Err() == nil {
 			q.dht.peerStoppedDHT(q.dht.ctx, p)
 		}
-		ch <- &queryUpdate{cause: p, unreachable: []peer.ID{p}}
+		ch <- &queryUpdate{cause: p, unreachable: []peer.ID{p}, timedOut: queryCtx.Err() == nil && isTimeout(err)}
 		return
 	}
 
@@ -437,19 +644,51 @@ func (q *query) queryPeer(ctx context.Context, ch chan<- *queryUpdate, p peer.ID
 		// TODO: this behavior is really specific to how FindPeer works and not GetClosestPeers or any other function
 		isTarget := string(next.ID) == q.key
 		if isTarget || q.dht.queryPeerFilter(q.dht, *next) {
-			q.dht.maybeAddAddrs(next.ID, next.Addrs, pstore.TempAddrTTL)
+			q.dht.addCandidateAddrs(next.ID, next.Addrs)
 			saw = append(saw, next.ID)
 		}
 	}
 
+	span.SetAttributes(attribute.Int("closer_peers", len(newPeers)), attribute.Int("heard", len(saw)))
 	ch <- &queryUpdate{cause: p, heard: saw, queried: []peer.ID{p}, queryDuration: queryDuration}
 }
 
+// peersetStats counts the peersets of the running lookups and the peers they
+// track, each allocated, see metrics.LiveQueryPeersets.
+type peersetStats struct {
+	peersets int64 // atomic
+	entries  int64 // atomic
+}
+
+// trackPeersets adds peersets and entries to the live ones, recording the
+// totals.
+func (dht *IpfsDHT) trackPeersets(peersets, entries int) {
+	var ms []stats.Measurement
+	if peersets != 0 {
+		ms = append(ms, metrics.LiveQueryPeersets.M(atomic.AddInt64(&dht.peersets.peersets, int64(peersets))))
+	}
+	if entries != 0 {
+		ms = append(ms, metrics.LiveQueryPeersetEntries.M(atomic.AddInt64(&dht.peersets.entries, int64(entries))))
+	}
+	stats.Record(dht.ctx, ms...)
+}
+
+// recordPeerQuery records the query of p, by the length of the common prefix
+// of its Kademlia ID and ours, so that the timeout rate of each bucket shows.
+func (q *query) recordPeerQuery(p peer.ID, timedOut bool) {
+	cpl := kb.CommonPrefixLen(q.dht.selfKey, kb.ConvertPeerID(p))
+	ms := []stats.Measurement{metrics.LookupPeerQueries.M(1)}
+	if timedOut {
+		ms = append(ms, metrics.LookupPeerTimeouts.M(1))
+	}
+	_ = stats.RecordWithTags(q.ctx, []tag.Mutator{tag.Upsert(metrics.KeyCpl, strconv.Itoa(cpl))}, ms...)
+}
+
 func (q *query) updateState(ctx context.Context, up *queryUpdate) {
 	if q.terminated {
 		panic("update should not be invoked after the logical lookup termination")
 	}
-	PublishLookupEvent(ctx,
+	q.publishLookupEvent(ctx,
 		NewLookupEvent(
 			q.dht.self,
 			q.id,
@@ -458,19 +697,25 @@ func (q *query) updateState(ctx context.Context, up *queryUpdate) {
 			NewLookupUpdateEvent(
 				up.cause,
 				up.cause,
-				up.heard,       // heard
-				nil,            // waiting
-				up.queried,     // queried
-				up.unreachable, // unreachable
+				up.heard,                                // heard
+				nil,                                     // waiting
+				up.queried,                              // queried
+				append(up.unreachable, up.throttled...), // unreachable
 			),
 			nil,
 		),
 	)
+	helpful := false
 	for _, p := range up.heard {
 		if p == q.dht.self { // don't add self.
 			continue
 		}
-		q.queryPeers.TryAdd(p, up.cause)
+		if q.queryPeers.TryAdd(p, up.cause) && kb.Closer(p, up.cause, q.key) {
+			helpful = true
+		}
+	}
+	if up.cause != q.dht.self && len(up.queried) > 0 {
+		q.checkReferral(up.cause, up.heard, helpful)
 	}
 	for _, p := range up.queried {
 		if p == q.dht.self { // don't add self.
@@ -494,6 +739,59 @@ func (q *query) updateState(ctx context.Context, up *queryUpdate) {
 			panic(fmt.Errorf("kademlia protocol error: tried to transition to the unreachable state from state %v", st))
 		}
 	}
+	if up.timedOut {
+		q.timeouts++
+	}
+	if up.cause != q.dht.self {
+		q.recordPeerQuery(up.cause, up.timedOut)
+	}
+	for _, p := range up.throttled {
+		if st := q.queryPeers.GetState(p); st == qpeerset.PeerWaiting {
+			q.queryPeers.SetState(p, qpeerset.PeerThrottled)
+		} else {
+			panic(fmt.Errorf("kademlia protocol error: tried to transition to the throttled state from state %v", st))
+		}
+	}
+}
+
+// skipBackedOffPeers marks the heard peers we are backing off from as
+// throttled, so that they aren't queried.
+func (q *query) skipBackedOffPeers() {
+	if q.dht.peerBackoff.empty() {
+		return
+	}
+	for _, p := range q.queryPeers.GetClosestInStates(qpeerset.PeerHeard) {
+		if q.dht.peerBackoff.backingOff(p) {
+			q.queryPeers.SetState(p, qpeerset.PeerThrottled)
+		}
+	}
+}
+
+// dialBackoffer is implemented by the networks tracking the addresses they
+// recently failed to dial, e.g. the swarm.
+type dialBackoffer interface {
+	Backoff() *swarm.DialBackoff
+}
+
+// inDialBackoff reports whether dialing p would fail for all its known
+// addresses being backed off from. Lookups mark the peers picked to be queried
+// next that are as unreachable, rather than dialing them again.
+func (dht *IpfsDHT) inDialBackoff(p peer.ID) bool {
+	n, ok := dht.host.Network().(dialBackoffer)
+	if !ok || dht.host.Network().Connectedness(p) == network.Connected {
+		return false
+	}
+	addrs := dht.peerstore.Addrs(p)
+	if len(addrs) == 0 {
+		return false
+	}
+	backoff := n.Backoff()
+	for _, a := range addrs {
+		if !backoff.Backoff(p, a) {
+			return false
+		}
+	}
+	return true
 }
 
 func (dht *IpfsDHT) dialPeer(ctx context.Context, p peer.ID) error {
@@ -508,9 +806,14 @@ func (dht *IpfsDHT) dialPeer(ctx context.Context, p peer.ID) error {
 		ID:   p,
 	})
 
-	pi := peer.AddrInfo{ID: p}
-	if err := dht.host.Connect(ctx, pi); err != nil {
+	if err := dht.connect(ctx, p); err != nil {
 		logger.Debugf("error connecting: %s", err)
+		if dht.httpSender != nil {
+			if _, ok := dht.httpSender.Endpoint(p); ok {
+				logger.Debugw("falling back to http", "peer", p)
+				return nil
+			}
+		}
 		routing.PublishQueryEvent(ctx, &routing.QueryEvent{
 			Type:  routing.QueryError,
 			Extra: err.Error(),
@@ -1,13 +1,20 @@
 package dht
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"testing"
 	"time"
 
+	"github.com/google/uuid"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/test"
+	kb "github.com/libp2p/go-libp2p-kbucket"
 	tu "github.com/libp2p/go-libp2p-testing/etc"
 
+	"github.com/libp2p/go-libp2p-kad-dht/qpeerset"
+
 	"github.com/stretchr/testify/require"
 )
 
@@ -116,3 +123,103 @@ func checkRoutingTable(a, b *IpfsDHT) bool {
 	// under high load, this may not happen as immediately as we would like.
 	return a.routingTable.Find(b.self) != "" && b.routingTable.Find(a.self) != ""
 }
+
+func TestOrderByLatency(t *testing.T) {
+	peers := []peer.ID{"a", "b", "c", "d"}
+	latencies := map[peer.ID]time.Duration{
+		"a": 300 * time.Millisecond,
+		"b": 200 * time.Millisecond,
+		"c": 10 * time.Millisecond,
+		// "d" is unknown
+	}
+	latency := func(p peer.ID) time.Duration { return latencies[p] }
+
+	require.Equal(t, peers, orderByLatency(peers, latency, 0))
+	require.Equal(t, []peer.ID{"c", "b", "a", "d"}, orderByLatency(peers, latency, 1))
+	// a: 0+1, b: 0.5+0.5, c: 1+0, d: 1.5+1.5, ties keep the order by distance
+	require.Equal(t, []peer.ID{"a", "b", "c", "d"}, orderByLatency(peers, latency, 0.5))
+	// a: 0+1.5, b: 0.25+0.75, c: 0.5+0
+	require.Equal(t, []peer.ID{"c", "b", "a", "d"}, orderByLatency(peers, latency, 0.75))
+}
+
+func TestLookupRecordReplay(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dhts := setupDHTS(t, ctx, 10)
+	defer func() {
+		for _, d := range dhts {
+			d.Close()
+			d.host.Close()
+		}
+	}()
+	for i := 1; i < len(dhts); i++ {
+		connect(t, ctx, dhts[i-1], dhts[i])
+	}
+
+	var buf bytes.Buffer
+	_, err := dhts[0].GetClosestPeers(RecordLookups(ctx, &buf), "foo")
+	require.NoError(t, err)
+	recs, err := ReadLookupRecords(&buf)
+	require.NoError(t, err)
+	require.Len(t, recs, 1)
+	rec := recs[0]
+	require.Equal(t, []byte("foo"), rec.Key)
+	require.NotEmpty(t, rec.Seeds)
+	require.Greater(t, len(rec.Steps), 1)
+	last := rec.Steps[len(rec.Steps)-1]
+	require.True(t, last.Terminated)
+
+	// replayed by another peer, the scheduler decides the same at every step
+	replayer := setupDHT(ctx, t, false)
+	defer replayer.Close()
+	defer replayer.host.Close()
+	require.NoError(t, replayer.ReplayLookup(ctx, rec))
+
+	// and the replay reports a lookup terminating otherwise
+	reason := LookupCompleted
+	if last.Reason == LookupCompleted {
+		reason = LookupStarvation
+	}
+	rec.Steps[len(rec.Steps)-1].Reason = reason
+	require.Error(t, replayer.ReplayLookup(ctx, rec))
+}
+
+func TestReferralLoops(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d := setupDHT(ctx, t, false)
+	defer d.Close()
+	defer d.host.Close()
+
+	key := "foo"
+	peers := kb.SortClosestPeers([]peer.ID{
+		test.RandPeerIDFatal(t),
+		test.RandPeerIDFatal(t),
+		test.RandPeerIDFatal(t),
+	}, kb.ConvertKey(key))
+	a, b, far := peers[0], peers[1], peers[2]
+	d.peerStats.record(a, 0, 0, nil)
+
+	q := &query{
+		id:         uuid.New(),
+		key:        key,
+		ctx:        ctx,
+		dht:        d,
+		queryPeers: qpeerset.NewQueryPeerset(key),
+		peerTimes:  make(map[peer.ID]time.Duration),
+	}
+	q.updateState(ctx, &queryUpdate{cause: d.self, heard: []peer.ID{a, b}})
+	q.queryPeers.SetState(a, qpeerset.PeerWaiting)
+	q.queryPeers.SetState(b, qpeerset.PeerWaiting)
+
+	// both refer the lookup to the same farther peer
+	q.updateState(ctx, &queryUpdate{cause: a, heard: []peer.ID{far}, queried: []peer.ID{a}})
+	q.updateState(ctx, &queryUpdate{cause: b, heard: []peer.ID{far}, queried: []peer.ID{b}})
+
+	s := q.summary(time.Second, &lookupWithFollowupResult{})
+	require.Equal(t, 2, s.Unhelpful)
+	require.Equal(t, 1, s.Repeated)
+	require.Equal(t, 1, d.PeerStats(a).Unhelpful)
+}
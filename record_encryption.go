@@ -0,0 +1,105 @@
+package dht
+
+import (
+	"context"
+	"fmt"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+
+	dhtcfg "github.com/libp2p/go-libp2p-kad-dht/internal/config"
+)
+
+// RecordCipher encrypts the records persisted to the datastore, see
+// RecordEncryption.
+type RecordCipher = dhtcfg.RecordCipher
+
+// EncryptedDatastore returns a datastore storing the values put to it in d,
+// sealed by c, and opening them as they are read back. Only the values are
+// encrypted, the keys are stored as is.
+func EncryptedDatastore(d ds.Batching, c RecordCipher) ds.Batching {
+	return &encryptedDatastore{Batching: d, cipher: c}
+}
+
+type encryptedDatastore struct {
+	ds.Batching
+	cipher RecordCipher
+}
+
+func (e *encryptedDatastore) Put(ctx context.Context, key ds.Key, value []byte) error {
+	sealed, err := e.cipher.Seal(key, value)
+	if err != nil {
+		return fmt.Errorf("encrypting record: %w", err)
+	}
+	return e.Batching.Put(ctx, key, sealed)
+}
+
+func (e *encryptedDatastore) Get(ctx context.Context, key ds.Key) ([]byte, error) {
+	sealed, err := e.Batching.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	value, err := e.cipher.Open(key, sealed)
+	if err != nil {
+		return nil, fmt.Errorf("decrypting record: %w", err)
+	}
+	return value, nil
+}
+
+func (e *encryptedDatastore) GetSize(ctx context.Context, key ds.Key) (int, error) {
+	value, err := e.Get(ctx, key)
+	if err != nil {
+		return -1, err
+	}
+	return len(value), nil
+}
+
+// Query opens the values of the results before applying the filters and
+// orders of q, which may look at them.
+func (e *encryptedDatastore) Query(ctx context.Context, q dsq.Query) (dsq.Results, error) {
+	if q.KeysOnly && len(q.Filters) == 0 && len(q.Orders) == 0 {
+		return e.Batching.Query(ctx, q)
+	}
+	res, err := e.Batching.Query(ctx, dsq.Query{Prefix: q.Prefix, KeysOnly: q.KeysOnly})
+	if err != nil {
+		return nil, err
+	}
+	opened := dsq.ResultsFromIterator(q, dsq.Iterator{
+		Next: func() (dsq.Result, bool) {
+			r, ok := res.NextSync()
+			if !ok || r.Error != nil || q.KeysOnly {
+				return r, ok
+			}
+			value, err := e.cipher.Open(ds.RawKey(r.Key), r.Value)
+			if err != nil {
+				return dsq.Result{Error: fmt.Errorf("decrypting record %s: %w", r.Key, err)}, true
+			}
+			r.Value = value
+			r.Size = len(value)
+			return r, true
+		},
+		Close: res.Close,
+	})
+	return dsq.NaiveQueryApply(dsq.Query{Filters: q.Filters, Orders: q.Orders, Offset: q.Offset, Limit: q.Limit}, opened), nil
+}
+
+func (e *encryptedDatastore) Batch(ctx context.Context) (ds.Batch, error) {
+	b, err := e.Batching.Batch(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptedBatch{Batch: b, cipher: e.cipher}, nil
+}
+
+type encryptedBatch struct {
+	ds.Batch
+	cipher RecordCipher
+}
+
+func (e *encryptedBatch) Put(ctx context.Context, key ds.Key, value []byte) error {
+	sealed, err := e.cipher.Seal(key, value)
+	if err != nil {
+		return fmt.Errorf("encrypting record: %w", err)
+	}
+	return e.Batch.Put(ctx, key, sealed)
+}
@@ -0,0 +1,57 @@
+package dht
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"go.opencensus.io/stats"
+
+	"github.com/libp2p/go-libp2p-kad-dht/metrics"
+)
+
+// referrals tracks the responses of a lookup that don't get it closer to the
+// key, see LookupSummary.Unhelpful.
+type referrals struct {
+	// the sets of peers of the unhelpful responses, by their responder
+	unhelpfulSets map[string]peer.ID
+	unhelpful     int
+	repeated      int
+}
+
+// checkReferral checks the response of cause, referring the lookup to heard,
+// helpful if it referred it to a new peer closer to the key than cause.
+func (q *query) checkReferral(cause peer.ID, heard []peer.ID, helpful bool) {
+	if helpful {
+		return
+	}
+	q.referrals.unhelpful++
+	ms := []stats.Measurement{metrics.LookupUnhelpfulResponses.M(1)}
+	if !q.shadow {
+		q.dht.peerStats.recordUnhelpful(cause)
+	}
+
+	// the same peers sent by another peer, e.g. servers referring each other
+	// in a loop or all answering with a fixed set of peers
+	set := referralSet(heard)
+	if responder, ok := q.referrals.unhelpfulSets[set]; ok && responder != cause && len(heard) > 0 {
+		q.referrals.repeated++
+		ms = append(ms, metrics.LookupRepeatedResponses.M(1))
+	} else {
+		if q.referrals.unhelpfulSets == nil {
+			q.referrals.unhelpfulSets = make(map[string]peer.ID)
+		}
+		q.referrals.unhelpfulSets[set] = cause
+	}
+	stats.Record(q.ctx, ms...)
+}
+
+// referralSet identifies the set of peers, whatever their order.
+func referralSet(peers []peer.ID) string {
+	ids := make([]string, len(peers))
+	for i, p := range peers {
+		ids[i] = string(p)
+	}
+	sort.Strings(ids)
+	return strings.Join(ids, "\x00")
+}
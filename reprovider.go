@@ -0,0 +1,250 @@
+package dht
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jbenet/goprocess"
+	"github.com/multiformats/go-multihash"
+
+	dhtcfg "github.com/libp2p/go-libp2p-kad-dht/internal/config"
+)
+
+// KeyChanFunc streams the keys to reprovide. The channel is closed once all the
+// keys were sent.
+type KeyChanFunc = dhtcfg.KeyChanFunc
+
+// ReproviderTier is a set of keys reprovided on its own schedule, see
+// ReproviderTiers.
+type ReproviderTier = dhtcfg.ReproviderTier
+
+// reproviderInitialDelay is how long after startup the first round of every
+// tier starts.
+var reproviderInitialDelay = time.Minute
+
+// reprovideBatchSize is the number of keys handed to ProvideMany at once.
+const reprovideBatchSize = 4096
+
+// ReproviderTierStats are the statistics of a reprovider tier.
+type ReproviderTierStats struct {
+	Name string
+	// Rounds is the number of times the tier was reprovided.
+	Rounds int
+	// LastStart and LastDuration describe the last round.
+	LastStart    time.Time
+	LastDuration time.Duration
+	// LastKeys is the number of keys reprovided by the last round, not
+	// counting those already reprovided by a higher priority tier.
+	LastKeys int
+	// LastError is the error the last round failed with, if any.
+	LastError error
+	// NextRound is when the tier is due next.
+	NextRound time.Time
+}
+
+type reprovider struct {
+	tiers []ReproviderTier
+
+	// serializes rounds
+	runLk sync.Mutex
+
+	mu    sync.Mutex
+	stats []ReproviderTierStats
+	// unprovided holds the keys retracted with Unprovide, which are
+	// skipped until they are provided again.
+	unprovided map[string]struct{}
+}
+
+func newReprovider(tiers []ReproviderTier) *reprovider {
+	r := &reprovider{
+		tiers:      tiers,
+		stats:      make([]ReproviderTierStats, len(tiers)),
+		unprovided: make(map[string]struct{}),
+	}
+	first := time.Now().Add(reproviderInitialDelay)
+	for i, tier := range tiers {
+		r.stats[i] = ReproviderTierStats{Name: tier.Name, NextRound: first}
+	}
+	return r
+}
+
+// nextRound returns when the next tier is due.
+func (r *reprovider) nextRound() time.Time {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	next := r.stats[0].NextRound
+	for _, st := range r.stats[1:] {
+		if st.NextRound.Before(next) {
+			next = st.NextRound
+		}
+	}
+	return next
+}
+
+// setUnprovided marks the keys as retracted, or as provided again, so
+// that the reprovider skips them or resumes reproviding them.
+func (dht *IpfsDHT) setUnprovided(unprovided bool, keys ...multihash.Multihash) {
+	r := dht.reprovider
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, k := range keys {
+		if unprovided {
+			r.unprovided[string(k)] = struct{}{}
+		} else {
+			delete(r.unprovided, string(k))
+		}
+	}
+}
+
+// isUnprovided returns whether the key was retracted with Unprovide.
+func (dht *IpfsDHT) isUnprovided(key multihash.Multihash) bool {
+	r := dht.reprovider
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, ok := r.unprovided[string(key)]
+	return ok
+}
+
+// ReproviderStats returns the statistics of the reprovider tiers, in priority
+// order, or nil if no tiers are configured.
+func (dht *IpfsDHT) ReproviderStats() []ReproviderTierStats {
+	if dht.reprovider == nil {
+		return nil
+	}
+	r := dht.reprovider
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]ReproviderTierStats(nil), r.stats...)
+}
+
+// Reprovide reprovides all the reprovider tiers right away, in priority order,
+// and reschedules them.
+func (dht *IpfsDHT) Reprovide(ctx context.Context) error {
+	if dht.reprovider == nil {
+		return fmt.Errorf("no reprovider tiers configured")
+	}
+	return dht.reprovideTiers(ctx, func(int) bool { return true })
+}
+
+// reprovideLoop reprovides the tiers as they become due.
+func (dht *IpfsDHT) reprovideLoop(proc goprocess.Process) {
+	r := dht.reprovider
+
+	timer := time.NewTimer(time.Until(r.nextRound()))
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+		case <-proc.Closing():
+			return
+		}
+
+		now := time.Now()
+		_ = dht.reprovideTiers(dht.ctx, func(i int) bool {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			return !r.stats[i].NextRound.After(now)
+		})
+		timer.Reset(time.Until(r.nextRound()))
+	}
+}
+
+// reprovideTiers reprovides the due tiers in priority order. Keys are only
+// reprovided by the first tier they appear in.
+func (dht *IpfsDHT) reprovideTiers(ctx context.Context, due func(i int) bool) error {
+	r := dht.reprovider
+	r.runLk.Lock()
+	defer r.runLk.Unlock()
+
+	seen := make(map[string]struct{})
+	var firstErr error
+	for i, tier := range r.tiers {
+		if !due(i) {
+			continue
+		}
+
+		start := time.Now()
+		n, err := dht.reprovideTier(ctx, tier, seen)
+		if err != nil {
+			logger.Warnw("failed to reprovide tier", "tier", tier.Name, "error", err)
+			if firstErr == nil {
+				firstErr = fmt.Errorf("reproviding tier %s: %w", tier.Name, err)
+			}
+		}
+
+		r.mu.Lock()
+		st := &r.stats[i]
+		st.Rounds++
+		st.LastStart = start
+		st.LastDuration = time.Since(start)
+		st.LastKeys = n
+		st.LastError = err
+		st.NextRound = start.Add(tier.Interval)
+		r.mu.Unlock()
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+	return firstErr
+}
+
+// reprovideTier reprovides the keys of tier that are not in seen, and adds them
+// to it. Keys retracted with Unprovide are skipped. It returns the number of
+// keys reprovided.
+func (dht *IpfsDHT) reprovideTier(ctx context.Context, tier ReproviderTier, seen map[string]struct{}) (int, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	keys, err := tier.Keys(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	var (
+		batch    []multihash.Multihash
+		count    int
+		firstErr error
+	)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := dht.ProvideMany(ctx, batch); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		count += len(batch)
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case c, ok := <-keys:
+			if !ok {
+				flush()
+				return count, firstErr
+			}
+			mh := c.Hash()
+			if _, ok := seen[string(mh)]; ok {
+				continue
+			}
+			seen[string(mh)] = struct{}{}
+			if dht.isUnprovided(mh) {
+				continue
+			}
+			batch = append(batch, mh)
+			if len(batch) >= reprovideBatchSize {
+				flush()
+			}
+		case <-ctx.Done():
+			return count, ctx.Err()
+		}
+	}
+}
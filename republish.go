@@ -0,0 +1,85 @@
+package dht
+
+import (
+	"time"
+
+	u "github.com/ipfs/go-ipfs-util"
+	"github.com/jbenet/goprocess"
+
+	"github.com/libp2p/go-libp2p-kad-dht/internal"
+)
+
+// trackPublished records that key was just published by this node.
+func (dht *IpfsDHT) trackPublished(key string) {
+	if dht.published == nil {
+		return
+	}
+
+	dht.publishedLk.Lock()
+	dht.published[key] = time.Now()
+	dht.publishedLk.Unlock()
+}
+
+// republishLoop periodically re-puts the values published by this node.
+func (dht *IpfsDHT) republishLoop(proc goprocess.Process) {
+	// check a few times per interval so that no value is republished much
+	// later than its due time.
+	ticker := time.NewTicker(dht.republishInterval / 4)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			dht.republishDue()
+		case <-proc.Closing():
+			return
+		}
+	}
+}
+
+// republishDue re-puts every tracked value that was last put at least one
+// republish interval ago.
+func (dht *IpfsDHT) republishDue() {
+	now := time.Now()
+
+	var due []string
+	dht.publishedLk.Lock()
+	for k, last := range dht.published {
+		if now.Sub(last) >= dht.republishInterval {
+			due = append(due, k)
+		}
+	}
+	dht.publishedLk.Unlock()
+
+	for _, key := range due {
+		if dht.ctx.Err() != nil {
+			return
+		}
+
+		rec, err := dht.getLocal(dht.ctx, key)
+		if err != nil {
+			continue
+		}
+		if rec == nil {
+			logger.Debugw("published value is gone, no longer republishing", "key", internal.LoggableRecordKeyString(key))
+			dht.publishedLk.Lock()
+			delete(dht.published, key)
+			dht.publishedLk.Unlock()
+			continue
+		}
+
+		// refresh our own copy too, it is subject to the max record age when
+		// served to other peers.
+		rec.TimeReceived = u.FormatRFC3339(time.Now())
+		if err := dht.putLocal(dht.ctx, key, rec); err != nil {
+			continue
+		}
+
+		logger.Debugw("republishing value", "key", internal.LoggableRecordKeyString(key))
+		if _, err := dht.putValueToPeers(dht.ctx, key, rec); err != nil {
+			logger.Debugw("failed to republish value", "key", internal.LoggableRecordKeyString(key), "error", err)
+			continue
+		}
+		dht.trackPublished(key)
+	}
+}
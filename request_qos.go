@@ -0,0 +1,149 @@
+package dht
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"go.opencensus.io/stats"
+	"go.opencensus.io/tag"
+
+	"github.com/libp2p/go-libp2p-kad-dht/metrics"
+	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
+)
+
+// requestClass is the priority class of an inbound request, the lower the
+// sooner it is handled under load.
+type requestClass int
+
+const (
+	// classRouting requests keep the routing working: FIND_NODE and PING.
+	classRouting requestClass = iota
+	// classLookup requests read records: GET_PROVIDERS and GET_VALUE.
+	classLookup
+	// classStore requests write records: ADD_PROVIDER, PUT_VALUE, and
+	// anything else.
+	classStore
+
+	numRequestClasses
+)
+
+var requestClassNames = [numRequestClasses]string{"routing", "lookup", "store"}
+
+func (c requestClass) String() string {
+	return requestClassNames[c]
+}
+
+func classOf(t pb.Message_MessageType) requestClass {
+	switch t {
+	case pb.Message_FIND_NODE, pb.Message_PING:
+		return classRouting
+	case pb.Message_GET_PROVIDERS, pb.Message_GET_VALUE:
+		return classLookup
+	}
+	return classStore
+}
+
+// queueFullRetryAfter is how long peers whose request was refused for a full
+// queue are asked to wait.
+const queueFullRetryAfter = time.Second
+
+// requestQueue bounds the number of inbound requests handled at once. Requests
+// beyond the limit wait for a free slot, which goes to the waiting request of
+// the highest priority class, in arrival order within a class. A nil queue is
+// unbounded.
+type requestQueue struct {
+	// ctx carries the tags of the metrics recorded when releasing a slot.
+	ctx       context.Context
+	limit     int
+	maxQueued int
+
+	mu      sync.Mutex
+	running int
+	waiting [numRequestClasses][]chan struct{}
+}
+
+func newRequestQueue(ctx context.Context, limit, maxQueued int) *requestQueue {
+	if limit == 0 {
+		return nil
+	}
+	return &requestQueue{ctx: ctx, limit: limit, maxQueued: maxQueued}
+}
+
+// acquire waits for a slot to handle a request of type t, and returns the
+// function releasing it. It returns false without waiting if too many requests
+// of its class are waiting already.
+func (q *requestQueue) acquire(ctx context.Context, t pb.Message_MessageType) (func(), bool, error) {
+	if q == nil {
+		return func() {}, true, nil
+	}
+
+	c := classOf(t)
+	ctx, _ = tag.New(ctx, tag.Upsert(metrics.KeyRequestClass, c.String()))
+
+	q.mu.Lock()
+	if q.running < q.limit {
+		q.running++
+		q.mu.Unlock()
+		return q.release, true, nil
+	}
+	if q.maxQueued > 0 && len(q.waiting[c]) >= q.maxQueued {
+		q.mu.Unlock()
+		stats.Record(ctx, metrics.InboundQueueDropped.M(1))
+		return nil, false, nil
+	}
+	granted := make(chan struct{})
+	q.waiting[c] = append(q.waiting[c], granted)
+	depth := len(q.waiting[c])
+	q.mu.Unlock()
+
+	start := time.Now()
+	stats.Record(ctx, metrics.InboundQueueDepth.M(int64(depth)))
+	defer func() {
+		stats.Record(ctx, metrics.InboundQueueWait.M(float64(time.Since(start))/float64(time.Millisecond)))
+	}()
+
+	select {
+	case <-granted:
+		return q.release, true, nil
+	case <-ctx.Done():
+	}
+
+	q.mu.Lock()
+	for i, ch := range q.waiting[c] {
+		if ch == granted {
+			q.waiting[c] = append(q.waiting[c][:i], q.waiting[c][i+1:]...)
+			depth = len(q.waiting[c])
+			q.mu.Unlock()
+			stats.Record(ctx, metrics.InboundQueueDepth.M(int64(depth)))
+			return nil, true, ctx.Err()
+		}
+	}
+	q.mu.Unlock()
+	// granted meanwhile, pass the slot on
+	q.release()
+	return nil, true, ctx.Err()
+}
+
+// release hands the slot over to the next waiting request, if any.
+func (q *requestQueue) release() {
+	q.mu.Lock()
+	for c := range q.waiting {
+		if len(q.waiting[c]) == 0 {
+			continue
+		}
+		next := q.waiting[c][0]
+		q.waiting[c][0] = nil
+		q.waiting[c] = q.waiting[c][1:]
+		depth := len(q.waiting[c])
+		q.mu.Unlock()
+
+		close(next)
+		_ = stats.RecordWithTags(q.ctx,
+			[]tag.Mutator{tag.Upsert(metrics.KeyRequestClass, requestClass(c).String())},
+			metrics.InboundQueueDepth.M(int64(depth)))
+		return
+	}
+	q.running--
+	q.mu.Unlock()
+}
@@ -0,0 +1,192 @@
+package dht
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru/simplelru"
+	asnutil "github.com/libp2p/go-libp2p-asn-util"
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
+)
+
+// requestRateLimitEntries is the number of peers, and of subnets, whose request
+// rate is tracked. The least recently seen are forgotten first.
+const requestRateLimitEntries = 4096
+
+// Requests are limited per subnet by /24 for IPv4 addresses, and by
+// autonomous system for IPv6 addresses, or by /48 when it isn't known.
+const (
+	subnetIPv4Bits = 24
+	subnetIPv6Bits = 48
+)
+
+// requestRateLimiter limits the rate at which inbound requests are handled per
+// peer and per subnet, since Sybil peers can trivially rotate their peer IDs.
+type requestRateLimiter struct {
+	rate        float64
+	burst       int
+	subnetRate  float64
+	subnetBurst int
+	allowlist   []*net.IPNet
+
+	mu      sync.Mutex
+	peers   *lru.LRU
+	subnets *lru.LRU
+}
+
+// newRequestRateLimiter returns a rate limiter with the given limits, or nil if
+// both rates are zero.
+func newRequestRateLimiter(rate float64, burst int, subnetRate float64, subnetBurst int, allowlist []*net.IPNet) *requestRateLimiter {
+	if rate == 0 && subnetRate == 0 {
+		return nil
+	}
+
+	// can only fail on a non-positive size
+	peers, _ := lru.NewLRU(requestRateLimitEntries, nil)
+	subnets, _ := lru.NewLRU(requestRateLimitEntries, nil)
+	return &requestRateLimiter{
+		rate:        rate,
+		burst:       burst,
+		subnetRate:  subnetRate,
+		subnetBurst: subnetBurst,
+		allowlist:   allowlist,
+		peers:       peers,
+		subnets:     subnets,
+	}
+}
+
+// allow returns zero if a request from p, coming from ip if known, is within
+// the limits, and else how long p should wait before sending more requests and
+// the limit that was hit, "peer" or "subnet".
+func (rl *requestRateLimiter) allow(p peer.ID, ip net.IP) (time.Duration, string) {
+	if rl == nil {
+		return 0, ""
+	}
+	for _, n := range rl.allowlist {
+		if ip != nil && n.Contains(ip) {
+			return 0, ""
+		}
+	}
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	// both limits are checked before taking a token from either, so that
+	// requests refused by one don't count against the other
+	now := time.Now()
+	var peerBucket, subnetBucket *tokenBucket
+	if rl.rate > 0 {
+		peerBucket = rl.bucket(rl.peers, string(p), now, rl.burst)
+		if peerBucket.refill(now, rl.rate, rl.burst); peerBucket.tokens < 1 {
+			return peerBucket.wait(rl.rate), "peer"
+		}
+	}
+	if rl.subnetRate > 0 && ip != nil {
+		subnetBucket = rl.bucket(rl.subnets, subnetOf(ip), now, rl.subnetBurst)
+		if subnetBucket.refill(now, rl.subnetRate, rl.subnetBurst); subnetBucket.tokens < 1 {
+			return subnetBucket.wait(rl.subnetRate), "subnet"
+		}
+	}
+	for _, b := range []*tokenBucket{peerBucket, subnetBucket} {
+		if b != nil {
+			b.tokens--
+		}
+	}
+	return 0, ""
+}
+
+func (rl *requestRateLimiter) bucket(buckets *lru.LRU, k string, now time.Time, burst int) *tokenBucket {
+	if b, ok := buckets.Get(k); ok {
+		return b.(*tokenBucket)
+	}
+	b := &tokenBucket{tokens: float64(burst), last: now}
+	buckets.Add(k, b)
+	return b
+}
+
+// subnetOf returns the subnet requests from ip are limited by.
+func subnetOf(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return fmt.Sprintf("%s/%d", ip4.Mask(net.CIDRMask(subnetIPv4Bits, 32)), subnetIPv4Bits)
+	}
+	if asn, err := asnutil.Store.AsnForIPv6(ip); err == nil && asn != "" {
+		return "AS" + asn
+	}
+	return fmt.Sprintf("%s/%d", ip.Mask(net.CIDRMask(subnetIPv6Bits, 128)), subnetIPv6Bits)
+}
+
+// throttleResponse returns the response refusing a request over the rate limit,
+// or nil for the requests that get no response.
+func throttleResponse(req *pb.Message, retryAfter time.Duration) *pb.Message {
+	switch req.GetType() {
+	case pb.Message_ADD_PROVIDER, pb.Message_REMOVE_PROVIDER:
+		return nil
+	}
+
+	ms := retryAfter.Milliseconds()
+	if ms < 1 {
+		ms = 1
+	}
+	resp := pb.NewMessage(req.GetType(), nil, req.GetClusterLevel())
+	resp.RetryAfterMs = uint32(ms)
+	return resp
+}
+
+// peerBackoff tracks the peers that throttled our requests, until they accept
+// requests again. Only the requestRateLimitEntries peers that throttled us last
+// are remembered.
+type peerBackoff struct {
+	mu    sync.Mutex
+	until *lru.LRU
+}
+
+func (b *peerBackoff) add(p peer.ID, d time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.until == nil {
+		// can only fail on a non-positive size
+		b.until, _ = lru.NewLRU(requestRateLimitEntries, nil)
+	}
+	b.until.Add(p, time.Now().Add(d))
+}
+
+// backingOff returns whether requests to p should be held off.
+func (b *peerBackoff) backingOff(p peer.ID) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.until == nil {
+		return false
+	}
+	until, ok := b.until.Peek(p)
+	if !ok {
+		return false
+	}
+	if time.Now().After(until.(time.Time)) {
+		b.until.Remove(p)
+		return false
+	}
+	return true
+}
+
+// empty returns whether no peer is being backed off from, cheaply. The oldest
+// expired entries are dropped on the way.
+func (b *peerBackoff) empty() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.until == nil {
+		return true
+	}
+	now := time.Now()
+	for {
+		p, until, ok := b.until.GetOldest()
+		if !ok || now.Before(until.(time.Time)) {
+			break
+		}
+		b.until.Remove(p)
+	}
+	return b.until.Len() == 0
+}
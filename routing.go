@@ -3,7 +3,10 @@ package dht
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -16,30 +19,75 @@ import (
 	u "github.com/ipfs/go-ipfs-util"
 	"github.com/libp2p/go-libp2p-kad-dht/internal"
 	internalConfig "github.com/libp2p/go-libp2p-kad-dht/internal/config"
+	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
+	"github.com/libp2p/go-libp2p-kad-dht/providers"
 	"github.com/libp2p/go-libp2p-kad-dht/qpeerset"
 	kb "github.com/libp2p/go-libp2p-kbucket"
 	record "github.com/libp2p/go-libp2p-record"
+	recpb "github.com/libp2p/go-libp2p-record/pb"
 	"github.com/multiformats/go-multihash"
 )
 
 // This file implements the Routing interface for the IpfsDHT struct.
 
+// ErrRecordTooLarge is returned when a record value exceeds the configured
+// maximum record size.
+var ErrRecordTooLarge = errors.New("record too large")
+
+// checkRecordSize fails with ErrRecordTooLarge if value exceeds the maximum
+// record size.
+func (dht *IpfsDHT) checkRecordSize(key string, value []byte) error {
+	if dht.maxRecordSize > 0 && len(value) > dht.maxRecordSize {
+		return fmt.Errorf("%w: value for key %s is %d bytes, the maximum is %d", ErrRecordTooLarge,
+			internal.LoggableRecordKeyString(key), len(value), dht.maxRecordSize)
+	}
+	return nil
+}
+
 // Basic Put/Get
 
 // PutValue adds value corresponding to given Key.
 // This is the top level "Store" operation of the DHT
+// Failures to store the value on individual peers are not reported, use
+// PutValueWithResult for that.
 func (dht *IpfsDHT) PutValue(ctx context.Context, key string, value []byte, opts ...routing.Option) (err error) {
-	if !dht.enableValues {
-		return routing.ErrNotSupported
+	_, err = dht.PutValueWithResult(ctx, key, value, opts...)
+	var perr *PutError
+	if errors.As(err, &perr) {
+		return nil
 	}
+	return err
+}
 
-	logger.Debugw("putting value", "key", internal.LoggableRecordKeyString(key))
+// putValueLocal validates value and stores it locally, returning the record to
+// send to the network.
+func (dht *IpfsDHT) putValueLocal(ctx context.Context, key string, value []byte) (*recpb.Record, error) {
+	if err := dht.checkRecordSize(key, value); err != nil {
+		return nil, err
+	}
 
 	// don't even allow local users to put bad values.
-	if err := dht.Validator.Validate(key, value); err != nil {
-		return err
+	if err := dht.Validator().Validate(key, value); err != nil {
+		return nil, err
+	}
+
+	if err := dht.checkNotOlder(ctx, key, value); err != nil {
+		return nil, err
+	}
+
+	rec := record.MakePutRecord(key, value)
+	rec.TimeReceived = u.FormatRFC3339(time.Now())
+	if err := dht.putLocal(ctx, key, rec); err != nil {
+		return nil, err
 	}
 
+	dht.trackPublished(key)
+	return rec, nil
+}
+
+// checkNotOlder returns an error if value would replace a newer value stored
+// locally for key.
+func (dht *IpfsDHT) checkNotOlder(ctx context.Context, key string, value []byte) error {
 	old, err := dht.getLocal(ctx, key)
 	if err != nil {
 		// Means something is wrong with the datastore.
@@ -49,7 +97,7 @@ func (dht *IpfsDHT) PutValue(ctx context.Context, key string, value []byte, opts
 	// Check if we have an old value that's not the same as the new one.
 	if old != nil && !bytes.Equal(old.GetValue(), value) {
 		// Check to see if the new one is better.
-		i, err := dht.Validator.Select(key, [][]byte{value, old.GetValue()})
+		i, err := dht.selectValue(key, [][]byte{value, old.GetValue()})
 		if err != nil {
 			return err
 		}
@@ -57,19 +105,93 @@ func (dht *IpfsDHT) PutValue(ctx context.Context, key string, value []byte, opts
 			return fmt.Errorf("can't replace a newer value with an older value")
 		}
 	}
+	return nil
+}
 
-	rec := record.MakePutRecord(key, value)
-	rec.TimeReceived = u.FormatRFC3339(time.Now())
-	err = dht.putLocal(ctx, key, rec)
+// PutResult reports which of the closest peers to a key stored a put value.
+type PutResult struct {
+	// Succeeded lists the peers that acknowledged the value.
+	Succeeded []peer.ID
+	// Failed maps the peers that did not acknowledge the value to the reason.
+	Failed map[peer.ID]error
+}
+
+// PutError is returned when none of the closest peers to a key stored a put
+// value. It matches, with errors.Is, any of the errors the peers failed with.
+type PutError struct {
+	// Failed maps the peers that did not acknowledge the value to the reason.
+	Failed map[peer.ID]error
+}
+
+func (e *PutError) Error() string {
+	ids := make([]peer.ID, 0, len(e.Failed))
+	for p := range e.Failed {
+		ids = append(ids, p)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	msgs := make([]string, len(ids))
+	for i, p := range ids {
+		msgs[i] = fmt.Sprintf("%s: %s", p, e.Failed[p])
+	}
+	return fmt.Sprintf("failed to put value to any of %d peers: %s", len(ids), strings.Join(msgs, "; "))
+}
+
+// Is reports whether any of the peers failed with target.
+func (e *PutError) Is(target error) bool {
+	for _, err := range e.Failed {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// PutValueWithResult works like PutValue but reports, per closest peer, whether
+// the value was stored. This lets callers decide whether to retry when only
+// some of the peers acknowledged the value before the context expired. An
+// error is returned if the value could not be sent to any peer at all, e.g.
+// because it is invalid or its closest peers could not be found, and a
+// *PutError, along with the result, if none of the peers stored it.
+func (dht *IpfsDHT) PutValueWithResult(ctx context.Context, key string, value []byte, opts ...routing.Option) (_ *PutResult, err error) {
+	ctx = dht.operationContext(ctx, opPutValue)
+	defer func(start time.Time) { dht.recordOperation(ctx, opPutValue, start, err) }(time.Now())
+
+	if !dht.enableValues {
+		return nil, routing.ErrNotSupported
+	}
+
+	key = dht.routingKey(key)
+	logger.Debugw("putting value", "key", internal.LoggableRecordKeyString(key))
+
+	rec, err := dht.putValueLocal(ctx, key, value)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	if dht.queueOffline() {
+		logger.Debugw("no peers, queueing put", "key", internal.LoggableRecordKeyString(key))
+		return nil, dht.enqueueOffline(ctx, offlinePutsKey, []byte(key))
 	}
 
-	peers, err := dht.GetClosestPeers(ctx, key)
+	return dht.putValueToPeers(ctx, key, rec)
+}
+
+// putValueToPeers sends rec to the replica peers of key.
+func (dht *IpfsDHT) putValueToPeers(ctx context.Context, key string, rec *recpb.Record) (*PutResult, error) {
+	ctx, done, err := dht.drainer.enter(ctx)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	defer done()
+
+	peers, err := dht.getReplicaPeers(ctx, key)
+	if err != nil {
+		return nil, err
 	}
 
+	var resLk sync.Mutex
+	res := &PutResult{Failed: make(map[peer.ID]error)}
+
 	wg := sync.WaitGroup{}
 	for _, p := range peers {
 		wg.Add(1)
@@ -86,21 +208,136 @@ func (dht *IpfsDHT) PutValue(ctx context.Context, key string, value []byte, opts
 			if err != nil {
 				logger.Debugf("failed putting value to peer: %s", err)
 			}
+
+			resLk.Lock()
+			defer resLk.Unlock()
+			if err != nil {
+				res.Failed[p] = err
+			} else {
+				res.Succeeded = append(res.Succeeded, p)
+			}
 		}(p)
 	}
 	wg.Wait()
 
-	return nil
+	if len(res.Succeeded) == 0 && len(res.Failed) > 0 {
+		return res, &PutError{Failed: res.Failed}
+	}
+	return res, nil
+}
+
+// putManyParallelism is the number of peers that PutMany and ProvideMany send
+// records to concurrently.
+const putManyParallelism = 16
+
+// PutMany adds many values at once. All values are validated and stored locally
+// before any of them is sent out. The closest peers of the keys are then found
+// by sweeping them in keyspace order, as ProvideMany does, and each peer is sent
+// all the records it is responsible for in a single batch, reusing the same
+// stream.
+//
+// Like PutValue, failures to store a record on a remote peer are not reported.
+// An error is returned if the closest peers of some keys could not be found.
+func (dht *IpfsDHT) PutMany(ctx context.Context, values map[string][]byte) error {
+	ctx = dht.operationContext(ctx, opPutValue)
+
+	if !dht.enableValues {
+		return routing.ErrNotSupported
+	}
+
+	logger.Debugw("putting many values", "count", len(values))
+
+	if len(dht.keyMappers) > 0 {
+		mapped := make(map[string][]byte, len(values))
+		for k, v := range values {
+			mapped[dht.routingKey(k)] = v
+		}
+		if len(mapped) != len(values) {
+			return fmt.Errorf("several keys map to the same routing key")
+		}
+		values = mapped
+	}
+
+	// validate everything upfront so that bad input doesn't leave us with a
+	// partially applied batch
+	for k, v := range values {
+		if err := dht.checkRecordSize(k, v); err != nil {
+			return err
+		}
+		if err := dht.Validator().Validate(k, v); err != nil {
+			return fmt.Errorf("invalid value for key %s: %w", internal.LoggableRecordKeyString(k), err)
+		}
+		if err := dht.checkNotOlder(ctx, k, v); err != nil {
+			return fmt.Errorf("failed to put value for key %s: %w", internal.LoggableRecordKeyString(k), err)
+		}
+	}
+
+	recs := make(map[string]*recpb.Record, len(values))
+	for k, v := range values {
+		rec, err := dht.putValueLocal(ctx, k, v)
+		if err != nil {
+			return fmt.Errorf("failed to put value for key %s: %w", internal.LoggableRecordKeyString(k), err)
+		}
+		recs[k] = rec
+	}
+
+	keys := make([]string, 0, len(recs))
+	for k := range recs {
+		keys = append(keys, k)
+	}
+	swept, sweepErr := dht.sweepClosestPeers(ctx, keys, nil)
+	if swept == nil {
+		return sweepErr
+	}
+	peerRecs := make(map[peer.ID][]*recpb.Record, len(swept))
+	for p, ks := range swept {
+		for _, k := range ks {
+			peerRecs[p] = append(peerRecs[p], recs[k])
+		}
+	}
+
+	wg := sync.WaitGroup{}
+	sem := make(chan struct{}, putManyParallelism)
+	for p, prs := range peerRecs {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(p peer.ID, prs []*recpb.Record) {
+			defer func() { <-sem }()
+			defer wg.Done()
+			routing.PublishQueryEvent(ctx, &routing.QueryEvent{
+				Type: routing.Value,
+				ID:   p,
+			})
+
+			for _, rec := range prs {
+				if err := dht.protoMessenger.PutValue(ctx, p, rec); err != nil {
+					logger.Debugf("failed putting value to peer: %s", err)
+					if ctx.Err() != nil {
+						return
+					}
+				}
+			}
+		}(p, prs)
+	}
+	wg.Wait()
+
+	return sweepErr
 }
 
 // recvdVal stores a value and the peer from which we got the value.
 type recvdVal struct {
 	Val  []byte
 	From peer.ID
+	// RTT of the request that returned the value, zero for the local value.
+	RTT time.Duration
 }
 
 // GetValue searches for the value corresponding to given Key.
+// The number of responses to wait for can be set per call with the Quorum option.
 func (dht *IpfsDHT) GetValue(ctx context.Context, key string, opts ...routing.Option) (_ []byte, err error) {
+	ctx = dht.operationContext(ctx, opGetValue)
+	defer func(start time.Time) { dht.recordOperation(ctx, opGetValue, start, err) }(time.Now())
+
 	if !dht.enableValues {
 		return nil, routing.ErrNotSupported
 	}
@@ -110,6 +347,9 @@ func (dht *IpfsDHT) GetValue(ctx context.Context, key string, opts ...routing.Op
 	if err := cfg.Apply(opts...); err != nil {
 		return nil, err
 	}
+	if report, ok := cfg.Other[internalConfig.CrossValidateOptionKey{}].(*ValueReport); ok {
+		return dht.crossValidateValue(ctx, key, report)
+	}
 	opts = append(opts, Quorum(internalConfig.GetQuorum(&cfg)))
 
 	responses, err := dht.SearchValue(ctx, key, opts...)
@@ -133,55 +373,199 @@ func (dht *IpfsDHT) GetValue(ctx context.Context, key string, opts ...routing.Op
 	return best, nil
 }
 
+// ValueProvenance is a value record along with where it came from.
+type ValueProvenance struct {
+	Val []byte
+	// From is the peer that served the value, the local peer for the value
+	// found in our own datastore.
+	From peer.ID
+	// RTT is the round trip time of the request that returned the value. It is
+	// zero for the local value.
+	RTT time.Duration
+	// Distance is the XOR distance between From and the key in the Kademlia
+	// keyspace.
+	Distance []byte
+}
+
+// GetValues searches for the values corresponding to given Key and returns up to
+// nvals valid values, each with its provenance, in the order they were
+// received. Unlike GetValue no value is selected, so callers can audit where the
+// values came from and apply their own trust heuristics. If nvals is 0 all the
+// values found by the lookup are returned.
+func (dht *IpfsDHT) GetValues(ctx context.Context, key string, nvals int) ([]ValueProvenance, error) {
+	ctx = dht.operationContext(ctx, opGetValue)
+
+	if !dht.enableValues {
+		return nil, routing.ErrNotSupported
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	key = dht.routingKey(key)
+	keyID := kb.ConvertKey(key)
+	vals := make([]ValueProvenance, 0, nvals)
+	valCh, _ := dht.getValues(ctx, key, make(chan struct{}))
+	for v := range valCh {
+		vals = append(vals, ValueProvenance{
+			Val:      v.Val,
+			From:     v.From,
+			RTT:      v.RTT,
+			Distance: u.XOR(keyID, kb.ConvertPeerID(v.From)),
+		})
+		if nvals > 0 && len(vals) >= nvals {
+			break
+		}
+	}
+
+	if len(vals) == 0 {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		return nil, routing.ErrNotFound
+	}
+	return vals, nil
+}
+
 // SearchValue searches for the value corresponding to given Key and streams the results.
 func (dht *IpfsDHT) SearchValue(ctx context.Context, key string, opts ...routing.Option) (<-chan []byte, error) {
+	ctx = dht.operationContext(ctx, opGetValue)
+
 	if !dht.enableValues {
 		return nil, routing.ErrNotSupported
 	}
 
-	var cfg routing.Options
-	if err := cfg.Apply(opts...); err != nil {
+	responsesNeeded, err := searchValueResponsesNeeded(opts)
+	if err != nil {
 		return nil, err
 	}
+	key = dht.routingKey(key)
 
-	responsesNeeded := 0
-	if !cfg.Offline {
-		responsesNeeded = internalConfig.GetQuorum(&cfg)
+	out := make(chan []byte)
+	go func() {
+		defer close(out)
+		dht.searchValue(ctx, key, responsesNeeded, out)
+	}()
+
+	return out, nil
+}
+
+// ValueUpdate is a result emitted by SearchValueProgressive.
+type ValueUpdate struct {
+	// Value is the best value found so far. It is nil on a settled update if
+	// no value was found.
+	Value []byte
+	// Settled is true on the final update, once the search is over and Value
+	// can no longer be superseded.
+	Settled bool
+}
+
+// SearchValueProgressive works like SearchValue but wraps results in a
+// ValueUpdate. The best value found so far is emitted as soon as it arrives and
+// is followed by every strictly better value found as the lookup continues. Once
+// the search completes a final update with Settled set is emitted, carrying the
+// best value. No settled update is emitted if the context is cancelled first.
+func (dht *IpfsDHT) SearchValueProgressive(ctx context.Context, key string, opts ...routing.Option) (<-chan ValueUpdate, error) {
+	ctx = dht.operationContext(ctx, opGetValue)
+
+	if !dht.enableValues {
+		return nil, routing.ErrNotSupported
 	}
 
-	stopCh := make(chan struct{})
-	valCh, lookupRes := dht.getValues(ctx, key, stopCh)
+	responsesNeeded, err := searchValueResponsesNeeded(opts)
+	if err != nil {
+		return nil, err
+	}
+	key = dht.routingKey(key)
 
-	out := make(chan []byte)
+	out := make(chan ValueUpdate)
 	go func() {
 		defer close(out)
-		best, peersWithBest, aborted := dht.searchValueQuorum(ctx, key, valCh, stopCh, out, responsesNeeded)
-		if best == nil || aborted {
-			return
-		}
 
-		updatePeers := make([]peer.ID, 0, dht.bucketSize)
-		select {
-		case l := <-lookupRes:
-			if l == nil {
-				return
-			}
+		var (
+			best    []byte
+			settled bool
+		)
+		vals := make(chan []byte)
+		go func() {
+			defer close(vals)
+			best, settled = dht.searchValue(ctx, key, responsesNeeded, vals)
+		}()
 
-			for _, p := range l.peers {
-				if _, ok := peersWithBest[p]; !ok {
-					updatePeers = append(updatePeers, p)
-				}
+		for v := range vals {
+			select {
+			case out <- ValueUpdate{Value: v}:
+			case <-ctx.Done():
 			}
-		case <-ctx.Done():
-			return
 		}
 
-		dht.updatePeerValues(dht.Context(), key, best, updatePeers)
+		if !settled {
+			return
+		}
+		select {
+		case out <- ValueUpdate{Value: best, Settled: true}:
+		case <-ctx.Done():
+		}
 	}()
 
 	return out, nil
 }
 
+func searchValueResponsesNeeded(opts []routing.Option) (int, error) {
+	var cfg routing.Options
+	if err := cfg.Apply(opts...); err != nil {
+		return 0, err
+	}
+
+	if cfg.Offline {
+		return 0, nil
+	}
+	return internalConfig.GetQuorum(&cfg), nil
+}
+
+// searchValue runs a value lookup for key, sending every strictly better value
+// on out. It returns the best value found and whether the search ran to
+// completion (as opposed to being cut short by the context).
+func (dht *IpfsDHT) searchValue(ctx context.Context, key string, responsesNeeded int, out chan<- []byte) ([]byte, bool) {
+	stopCh := make(chan struct{})
+	valCh, lookupRes := dht.getValues(ctx, key, stopCh)
+
+	best, peersWithBest, aborted := dht.searchValueQuorum(ctx, key, valCh, stopCh, out, responsesNeeded)
+	if ctx.Err() != nil {
+		return best, false
+	}
+	if best == nil {
+		return best, true
+	}
+	if aborted {
+		// the lookup stopped before reaching the closest peers, cache the
+		// value along the way instead of fixing them up
+		if dht.lookupCacheTTL > 0 {
+			go dht.cacheValue(key, best, peersWithBest, lookupRes)
+		}
+		return best, true
+	}
+
+	updatePeers := make([]peer.ID, 0, dht.bucketSize)
+	select {
+	case l := <-lookupRes:
+		if l == nil {
+			return best, true
+		}
+
+		for _, p := range l.peers {
+			if _, ok := peersWithBest[p]; !ok {
+				updatePeers = append(updatePeers, p)
+			}
+		}
+	case <-ctx.Done():
+		return best, false
+	}
+
+	dht.updatePeerValues(dht.Context(), key, best, updatePeers)
+	return best, true
+}
+
 func (dht *IpfsDHT) searchValueQuorum(ctx context.Context, key string, valCh <-chan recvdVal, stopCh chan struct{},
 	out chan<- []byte, nvals int) ([]byte, map[peer.ID]struct{}, bool) {
 	numResponses := 0
@@ -225,7 +609,7 @@ loop:
 					aborted = newVal(ctx, v, false)
 					continue
 				}
-				sel, err := dht.Validator.Select(key, [][]byte{best, v.Val})
+				sel, err := dht.selectValue(key, [][]byte{best, v.Val})
 				if err != nil {
 					logger.Warnw("failed to select best value", "key", internal.LoggableRecordKeyString(key), "error", err)
 					continue
@@ -288,7 +672,7 @@ func (dht *IpfsDHT) getValues(ctx context.Context, key string, stopQuery chan st
 	go func() {
 		defer close(valCh)
 		defer close(lookupResCh)
-		lookupRes, err := dht.runLookupWithFollowup(ctx, key,
+		lookupRes, err := dht.runLookupWithFollowup(ctx, opGetValue, key,
 			func(ctx context.Context, p peer.ID) ([]*peer.AddrInfo, error) {
 				// For DHT query command
 				routing.PublishQueryEvent(ctx, &routing.QueryEvent{
@@ -296,10 +680,12 @@ func (dht *IpfsDHT) getValues(ctx context.Context, key string, stopQuery chan st
 					ID:   p,
 				})
 
+				start := time.Now()
 				rec, peers, err := dht.protoMessenger.GetValue(ctx, p, key)
 				if err != nil {
 					return nil, err
 				}
+				rtt := time.Since(start)
 
 				// For DHT query command
 				routing.PublishQueryEvent(ctx, &routing.QueryEvent{
@@ -317,7 +703,11 @@ func (dht *IpfsDHT) getValues(ctx context.Context, key string, stopQuery chan st
 					logger.Debug("received a nil record value")
 					return peers, nil
 				}
-				if err := dht.Validator.Validate(key, val); err != nil {
+				if err := dht.checkRecordSize(key, val); err != nil {
+					logger.Debugw("received oversized record (discarded)", "from", p, "error", err)
+					return peers, nil
+				}
+				if err := dht.Validator().Validate(key, val); err != nil {
 					// make sure record is valid
 					logger.Debugw("received invalid record (discarded)", "error", err)
 					return peers, nil
@@ -328,6 +718,7 @@ func (dht *IpfsDHT) getValues(ctx context.Context, key string, stopQuery chan st
 				case valCh <- recvdVal{
 					Val:  val,
 					From: p,
+					RTT:  rtt,
 				}:
 				case <-ctx.Done():
 					return nil, ctx.Err()
@@ -369,21 +760,58 @@ func (dht *IpfsDHT) refreshRTIfNoShortcut(key kb.ID, lookupRes *lookupWithFollow
 // Some DHTs store values directly, while an indirect store stores pointers to
 // locations of the value, similarly to Coral and Mainline DHT.
 
+// ErrPeerTooSlow is reported for the peers that did not take a provider record
+// within their share of the time left to ProvideWithResult.
+var ErrPeerTooSlow = errors.New("peer too slow")
+
+// ErrNoProvideSlot is reported for the peers that were not sent a provider
+// record because no provide RPC slot freed up before the context expired.
+var ErrNoProvideSlot = errors.New("no provide rpc slot available")
+
 // Provide makes this node announce that it can provide a value for the given key
 func (dht *IpfsDHT) Provide(ctx context.Context, key cid.Cid, brdcst bool) (err error) {
+	_, err = dht.ProvideWithResult(ctx, key, brdcst)
+	return err
+}
+
+// ProvideWithResult works like Provide but also reports which of the closest
+// peers were sent the provider record. The result is nil if brdcst is false or
+// no peers were found.
+//
+// If ctx has a deadline, the time left once the closest peers are found is
+// split between them, so that a few slow peers cannot use up the whole budget.
+// The records are sent to at most Concurrency peers at once and each send is
+// given its share of the remaining time. Sends that take longer are cancelled
+// and the peers are reported as failed with ErrPeerTooSlow.
+func (dht *IpfsDHT) ProvideWithResult(ctx context.Context, key cid.Cid, brdcst bool) (_ *PutResult, err error) {
+	ctx = dht.operationContext(ctx, opProvide)
+	defer func(start time.Time) { dht.recordOperation(ctx, opProvide, start, err) }(time.Now())
+
 	if !dht.enableProviders {
-		return routing.ErrNotSupported
+		return nil, routing.ErrNotSupported
 	} else if !key.Defined() {
-		return fmt.Errorf("invalid cid: undefined")
+		return nil, fmt.Errorf("invalid cid: undefined")
 	}
-	keyMH := key.Hash()
+	keyMH := dht.providerKey(key.Hash())
 	logger.Debugw("providing", "cid", key, "mh", internal.LoggableProviderRecordBytes(keyMH))
 
 	// add self locally
 	dht.providerStore.AddProvider(ctx, keyMH, peer.AddrInfo{ID: dht.self})
+	dht.setUnprovided(false, key.Hash())
 	if !brdcst {
-		return nil
+		return nil, nil
+	}
+
+	if dht.queueOffline() {
+		logger.Debugw("no peers, queueing provide", "mh", internal.LoggableProviderRecordBytes(keyMH))
+		return nil, dht.enqueueOffline(ctx, offlineProvidesKey, keyMH)
+	}
+
+	ctx, done, err := dht.drainer.enter(ctx)
+	if err != nil {
+		return nil, err
 	}
+	defer done()
 
 	closerCtx := ctx
 	if deadline, ok := ctx.Deadline(); ok {
@@ -392,7 +820,7 @@ func (dht *IpfsDHT) Provide(ctx context.Context, key cid.Cid, brdcst bool) (err
 
 		if timeout < 0 {
 			// timed out
-			return context.DeadlineExceeded
+			return nil, context.DeadlineExceeded
 		} else if timeout < 10*time.Second {
 			// Reserve 10% for the final put.
 			deadline = deadline.Add(-timeout / 10)
@@ -407,42 +835,155 @@ func (dht *IpfsDHT) Provide(ctx context.Context, key cid.Cid, brdcst bool) (err
 	}
 
 	var exceededDeadline bool
-	peers, err := dht.GetClosestPeers(closerCtx, string(keyMH))
+	peers, err := dht.getProvidePeers(closerCtx, keyMH)
 	switch err {
 	case context.DeadlineExceeded:
 		// If the _inner_ deadline has been exceeded but the _outer_
 		// context is still fine, provide the value to the closest peers
 		// we managed to find, even if they're not the _actual_ closest peers.
 		if ctx.Err() != nil {
-			return ctx.Err()
+			return nil, ctx.Err()
 		}
 		exceededDeadline = true
 	case nil:
 	default:
-		return err
+		return nil, err
+	}
+
+	var res *PutResult
+	if len(peers) > 0 {
+		res = dht.putProviderToPeers(ctx, keyMH, peers)
+	}
+	if exceededDeadline {
+		return res, context.DeadlineExceeded
 	}
+	return res, ctx.Err()
+}
 
+// putProviderToPeers sends our provider record for keyMH to peers, splitting
+// the time left before the deadline of ctx between them, if any.
+func (dht *IpfsDHT) putProviderToPeers(ctx context.Context, keyMH multihash.Multihash, peers []peer.ID) *PutResult {
+	var resLk sync.Mutex
+	res := &PutResult{Failed: make(map[peer.ID]error)}
+	outstanding := len(peers)
+
+	// with a deadline, the records are sent to alpha peers at once, each
+	// given its share of the time left. Otherwise they are all sent at once.
+	deadline, hasDeadline := ctx.Deadline()
+	var sem chan struct{}
+	if hasDeadline {
+		sem = make(chan struct{}, dht.alpha)
+	}
 	wg := sync.WaitGroup{}
 	for _, p := range peers {
+		if sem != nil {
+			sem <- struct{}{}
+		}
+
 		wg.Add(1)
 		go func(p peer.ID) {
+			defer func() {
+				if sem != nil {
+					<-sem
+				}
+			}()
 			defer wg.Done()
-			logger.Debugf("putProvider(%s, %s)", internal.LoggableProviderRecordBytes(keyMH), p)
-			err := dht.protoMessenger.PutProvider(ctx, p, keyMH, dht.host)
+
+			// waiting for a slot is not the peer's fault, so it doesn't
+			// count against its share of the time left.
+			release, err := dht.provideRPCs.acquire(ctx)
+			if err != nil {
+				err = fmt.Errorf("%w: %s", ErrNoProvideSlot, err)
+			} else {
+				putCtx, cancel := ctx, context.CancelFunc(func() {})
+				if hasDeadline {
+					// if every send took its full share, the last ones would
+					// still complete in time.
+					share := time.Until(deadline)
+					resLk.Lock()
+					if outstanding > dht.alpha {
+						share = share * time.Duration(dht.alpha) / time.Duration(outstanding)
+					}
+					resLk.Unlock()
+					putCtx, cancel = context.WithTimeout(ctx, share)
+				}
+
+				logger.Debugf("putProvider(%s, %s)", internal.LoggableProviderRecordBytes(keyMH), p)
+				err = dht.protoMessenger.PutProvider(putCtx, p, keyMH, dht.host)
+				release()
+				if err != nil && putCtx.Err() == context.DeadlineExceeded && ctx.Err() == nil {
+					err = ErrPeerTooSlow
+				}
+				cancel()
+			}
 			if err != nil {
 				logger.Debug(err)
 			}
+
+			resLk.Lock()
+			defer resLk.Unlock()
+			outstanding--
+			if err != nil {
+				res.Failed[p] = err
+			} else {
+				res.Succeeded = append(res.Succeeded, p)
+			}
 		}(p)
 	}
 	wg.Wait()
-	if exceededDeadline {
-		return context.DeadlineExceeded
+
+	return res
+}
+
+// Unprovide retracts this node's provider record for key. The local record is
+// removed right away and, if brdcst is true, the closest peers are asked to
+// remove theirs too. Peers that don't support retractions keep the record
+// until it expires. The reprovider skips the key until it is provided again.
+func (dht *IpfsDHT) Unprovide(ctx context.Context, key cid.Cid, brdcst bool) error {
+	if !dht.enableProviders {
+		return routing.ErrNotSupported
+	} else if !key.Defined() {
+		return fmt.Errorf("invalid cid: undefined")
+	}
+	keyMH := dht.providerKey(key.Hash())
+	logger.Debugw("unproviding", "cid", key, "mh", internal.LoggableProviderRecordBytes(keyMH))
+
+	remover, ok := dht.providerStore.(providers.ProviderRemover)
+	if !ok {
+		return fmt.Errorf("provider store does not support removing providers")
+	}
+	if err := remover.RemoveProvider(ctx, keyMH, dht.self); err != nil {
+		return err
+	}
+	dht.setUnprovided(true, key.Hash())
+	if !brdcst {
+		return nil
+	}
+
+	peers, err := dht.getReplicaPeers(ctx, string(keyMH))
+	if err != nil && len(peers) == 0 {
+		return err
 	}
+
+	wg := sync.WaitGroup{}
+	for _, p := range peers {
+		wg.Add(1)
+		go func(p peer.ID) {
+			defer wg.Done()
+			logger.Debugf("removeProvider(%s, %s)", internal.LoggableProviderRecordBytes(keyMH), p)
+			if err := dht.protoMessenger.RemoveProvider(ctx, p, keyMH, dht.host); err != nil {
+				logger.Debug(err)
+			}
+		}(p)
+	}
+	wg.Wait()
 	return ctx.Err()
 }
 
 // FindProviders searches until the context expires.
 func (dht *IpfsDHT) FindProviders(ctx context.Context, c cid.Cid) ([]peer.AddrInfo, error) {
+	ctx = dht.operationContext(ctx, opFindProviders)
+
 	if !dht.enableProviders {
 		return nil, routing.ErrNotSupported
 	} else if !c.Defined() {
@@ -462,8 +1003,34 @@ func (dht *IpfsDHT) FindProviders(ctx context.Context, c cid.Cid) ([]peer.AddrIn
 // completes. Note: not reading from the returned channel may block the query
 // from progressing.
 func (dht *IpfsDHT) FindProvidersAsync(ctx context.Context, key cid.Cid, count int) <-chan peer.AddrInfo {
+	infos := dht.FindProviderInfosAsync(ctx, key, count)
+
+	chSize := count
+	if count == 0 {
+		chSize = 1
+	}
+	peerOut := make(chan peer.AddrInfo, chSize)
+	go func() {
+		defer close(peerOut)
+		for info := range infos {
+			select {
+			case peerOut <- info.AddrInfo:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return peerOut
+}
+
+// FindProviderInfosAsync is the same as FindProvidersAsync, but also returns
+// the retrieval protocols the providers advertised in their records, so
+// callers can pick a provider they can fetch from.
+func (dht *IpfsDHT) FindProviderInfosAsync(ctx context.Context, key cid.Cid, count int) <-chan ProviderInfo {
+	ctx = dht.operationContext(ctx, opFindProviders)
+
 	if !dht.enableProviders || !key.Defined() {
-		peerOut := make(chan peer.AddrInfo)
+		peerOut := make(chan ProviderInfo)
 		close(peerOut)
 		return peerOut
 	}
@@ -472,16 +1039,25 @@ func (dht *IpfsDHT) FindProvidersAsync(ctx context.Context, key cid.Cid, count i
 	if count == 0 {
 		chSize = 1
 	}
-	peerOut := make(chan peer.AddrInfo, chSize)
+	peerOut := make(chan ProviderInfo, chSize)
 
-	keyMH := key.Hash()
+	keyMH := dht.providerKey(key.Hash())
 
 	logger.Debugw("finding providers", "cid", key, "mh", internal.LoggableProviderRecordBytes(keyMH))
+	if dht.delegatedRouting == nil {
+		go dht.findProvidersAsyncRoutine(ctx, keyMH, count, peerOut)
+		return peerOut
+	}
+	ctx, cancel := context.WithCancel(ctx)
 	go dht.findProvidersAsyncRoutine(ctx, keyMH, count, peerOut)
-	return peerOut
+	return dht.delegatedRouting.withDelegatedProviders(ctx, cancel, key, count, peerOut)
 }
 
-func (dht *IpfsDHT) findProvidersAsyncRoutine(ctx context.Context, key multihash.Multihash, count int, peerOut chan peer.AddrInfo) {
+// errEnoughProviders stops fetching the providers of a peer once a lookup has
+// found all it needs.
+var errEnoughProviders = errors.New("found enough providers")
+
+func (dht *IpfsDHT) findProvidersAsyncRoutine(ctx context.Context, key multihash.Multihash, count int, peerOut chan ProviderInfo) {
 	defer close(peerOut)
 
 	findAll := count == 0
@@ -491,8 +1067,15 @@ func (dht *IpfsDHT) findProvidersAsyncRoutine(ctx context.Context, key multihash
 	} else {
 		ps = peer.NewLimitedSet(count)
 	}
+	defer func(start time.Time) {
+		var err error
+		if ps.Size() == 0 {
+			err = routing.ErrNotFound
+		}
+		dht.recordOperation(ctx, opFindProviders, start, err)
+	}(time.Now())
 
-	provs, err := dht.providerStore.GetProviders(ctx, key)
+	provs, err := dht.localProviderInfos(ctx, key)
 	if err != nil {
 		return
 	}
@@ -513,7 +1096,14 @@ func (dht *IpfsDHT) findProvidersAsyncRoutine(ctx context.Context, key multihash
 		}
 	}
 
-	lookupRes, err := dht.runLookupWithFollowup(ctx, string(key),
+	// the peers that returned providers, and the signed records found, for
+	// caching them along the lookup path
+	var (
+		cacheLk        sync.Mutex
+		peersWithProvs = make(map[peer.ID]struct{})
+		signedProvs    []*pb.ProviderRecord
+	)
+	lookupRes, err := dht.runLookupWithFollowup(ctx, opFindProviders, string(key),
 		func(ctx context.Context, p peer.ID) ([]*peer.AddrInfo, error) {
 			// For DHT query command
 			routing.PublishQueryEvent(ctx, &routing.QueryEvent{
@@ -521,30 +1111,57 @@ func (dht *IpfsDHT) findProvidersAsyncRoutine(ctx context.Context, key multihash
 				ID:   p,
 			})
 
-			provs, closest, err := dht.protoMessenger.GetProviders(ctx, p, key)
-			if err != nil {
-				return nil, err
-			}
+			var (
+				closest  []*peer.AddrInfo
+				answered bool
+			)
+			err := dht.protoMessenger.StreamProviderRecords(ctx, p, key, func(recs []*pb.ProviderRecord, closer []*peer.AddrInfo) error {
+				if !answered {
+					closest, answered = closer, true
+				}
+				provs := dht.filterProviderRecords(key, recs)
+				if len(provs) > 0 {
+					cacheLk.Lock()
+					peersWithProvs[p] = struct{}{}
+					cacheLk.Unlock()
+				}
 
-			logger.Debugf("%d provider entries", len(provs))
-
-			// Add unique providers from request, up to 'count'
-			for _, prov := range provs {
-				dht.maybeAddAddrs(prov.ID, prov.Addrs, peerstore.TempAddrTTL)
-				logger.Debugf("got provider: %s", prov)
-				if ps.TryAdd(prov.ID) {
-					logger.Debugf("using provider: %s", prov)
-					select {
-					case peerOut <- *prov:
-					case <-ctx.Done():
-						logger.Debug("context timed out sending more providers")
-						return nil, ctx.Err()
+				logger.Debugf("%d provider entries", len(provs))
+
+				// Add unique providers from request, up to 'count'
+				for _, prov := range provs {
+					dht.maybeAddAddrs(prov.ID, prov.Addrs, peerstore.TempAddrTTL)
+					logger.Debugf("got provider: %s", prov)
+					if ps.TryAdd(prov.ID) {
+						logger.Debugf("using provider: %s", prov)
+						if len(prov.Signature) > 0 {
+							cacheLk.Lock()
+							signedProvs = append(signedProvs, prov)
+							cacheLk.Unlock()
+						}
+						select {
+						case peerOut <- ProviderInfo{AddrInfo: prov.AddrInfo, TransferProtocols: prov.TransferProtocols}:
+						case <-ctx.Done():
+							logger.Debug("context timed out sending more providers")
+							return ctx.Err()
+						}
+					}
+					if !findAll && ps.Size() >= count {
+						logger.Debugf("got enough providers (%d/%d)", ps.Size(), count)
+						return errEnoughProviders
 					}
 				}
-				if !findAll && ps.Size() >= count {
-					logger.Debugf("got enough providers (%d/%d)", ps.Size(), count)
-					return nil, nil
-				}
+				// keep fetching the providers of the peer while we still
+				// need some
+				return nil
+			})
+			switch {
+			case err == errEnoughProviders:
+				return nil, nil
+			case err != nil && (!answered || ctx.Err() != nil):
+				return nil, err
+			case err != nil:
+				logger.Debugw("failed to fetch the rest of the providers", "from", p, "error", err)
 			}
 
 			// Give closer peers back to the query to be queried
@@ -566,10 +1183,25 @@ func (dht *IpfsDHT) findProvidersAsyncRoutine(ctx context.Context, key multihash
 	if err == nil && ctx.Err() == nil {
 		dht.refreshRTIfNoShortcut(kb.ConvertKey(string(key)), lookupRes)
 	}
+	if err == nil && dht.lookupCacheTTL > 0 {
+		cacheLk.Lock()
+		recs := append([]*pb.ProviderRecord(nil), signedProvs...)
+		have := make(map[peer.ID]struct{}, len(peersWithProvs))
+		for p := range peersWithProvs {
+			have[p] = struct{}{}
+		}
+		cacheLk.Unlock()
+		if len(recs) > 0 {
+			go dht.cacheProviders(key, recs, have, lookupRes)
+		}
+	}
 }
 
 // FindPeer searches for a peer with given ID.
 func (dht *IpfsDHT) FindPeer(ctx context.Context, id peer.ID) (_ peer.AddrInfo, err error) {
+	ctx = dht.operationContext(ctx, opFindPeer)
+	defer func(start time.Time) { dht.recordOperation(ctx, opFindPeer, start, err) }(time.Now())
+
 	if err := id.Validate(); err != nil {
 		return peer.AddrInfo{}, err
 	}
@@ -581,7 +1213,7 @@ func (dht *IpfsDHT) FindPeer(ctx context.Context, id peer.ID) (_ peer.AddrInfo,
 		return pi, nil
 	}
 
-	lookupRes, err := dht.runLookupWithFollowup(ctx, string(id),
+	lookupRes, err := dht.runLookupWithFollowup(ctx, opFindPeer, string(id),
 		func(ctx context.Context, p peer.ID) ([]*peer.AddrInfo, error) {
 			// For DHT query command
 			routing.PublishQueryEvent(ctx, &routing.QueryEvent{
@@ -610,6 +1242,9 @@ func (dht *IpfsDHT) FindPeer(ctx context.Context, id peer.ID) (_ peer.AddrInfo,
 	)
 
 	if err != nil {
+		if dht.delegatedRouting != nil && ctx.Err() == nil {
+			return dht.findPeerDelegated(ctx, id, err)
+		}
 		return peer.AddrInfo{}, err
 	}
 
@@ -619,7 +1254,7 @@ func (dht *IpfsDHT) FindPeer(ctx context.Context, id peer.ID) (_ peer.AddrInfo,
 			// Note: we consider PeerUnreachable to be a valid state because the peer may not support the DHT protocol
 			// and therefore the peer would fail the query. The fact that a peer that is returned can be a non-DHT
 			// server peer and is not identified as such is a bug.
-			dialedPeerDuringQuery = (lookupRes.state[i] == qpeerset.PeerQueried || lookupRes.state[i] == qpeerset.PeerUnreachable || lookupRes.state[i] == qpeerset.PeerWaiting)
+			dialedPeerDuringQuery = (lookupRes.state[i] == qpeerset.PeerQueried || lookupRes.state[i] == qpeerset.PeerUnreachable || lookupRes.state[i] == qpeerset.PeerWaiting || lookupRes.state[i] == qpeerset.PeerThrottled)
 			break
 		}
 	}
@@ -631,5 +1266,21 @@ func (dht *IpfsDHT) FindPeer(ctx context.Context, id peer.ID) (_ peer.AddrInfo,
 		return dht.peerstore.PeerInfo(id), nil
 	}
 
+	if dht.delegatedRouting != nil {
+		return dht.findPeerDelegated(ctx, id, routing.ErrNotFound)
+	}
 	return peer.AddrInfo{}, routing.ErrNotFound
 }
+
+// findPeerDelegated finds id through the delegated routing endpoint once the
+// lookup failed with err, which is returned if the endpoint doesn't find it
+// either.
+func (dht *IpfsDHT) findPeerDelegated(ctx context.Context, id peer.ID, err error) (peer.AddrInfo, error) {
+	ai, derr := dht.delegatedRouting.findPeer(ctx, id)
+	if derr != nil {
+		logger.Debugw("failed to find peer through the delegated routing endpoint", "peer", id, "error", derr)
+		return peer.AddrInfo{}, err
+	}
+	dht.maybeAddAddrs(id, ai.Addrs, peerstore.TempAddrTTL)
+	return ai, nil
+}
@@ -1,6 +1,8 @@
 package dht
 
 import (
+	"fmt"
+
 	"github.com/libp2p/go-libp2p-core/routing"
 	internalConfig "github.com/libp2p/go-libp2p-kad-dht/internal/config"
 )
@@ -9,9 +11,15 @@ import (
 // values from before returning the best one. Zero means the DHT query
 // should complete instead of returning early.
 //
+// Quorum is set per call, so critical reads can demand more responses than
+// routine ones, e.g. `dht.GetValue(ctx, key, Quorum(16))`.
+//
 // Default: 0
 func Quorum(n int) routing.Option {
 	return func(opts *routing.Options) error {
+		if n < 0 {
+			return fmt.Errorf("quorum must not be negative, got %d", n)
+		}
 		if opts.Other == nil {
 			opts.Other = make(map[interface{}]interface{}, 1)
 		}
@@ -19,3 +27,22 @@ func Quorum(n int) routing.Option {
 		return nil
 	}
 }
+
+// CrossValidate is a DHT option that makes GetValue fetch the record from all
+// the K closest peers to the key instead of stopping at a quorum, and fill
+// report with every distinct valid value found and the peers that served it.
+// It is meant for debugging record poisoning and propagation delays: the
+// lookup always runs to completion and peers serving outdated values are not
+// corrected.
+func CrossValidate(report *ValueReport) routing.Option {
+	return func(opts *routing.Options) error {
+		if report == nil {
+			return fmt.Errorf("cross validation needs a report")
+		}
+		if opts.Other == nil {
+			opts.Other = make(map[interface{}]interface{}, 1)
+		}
+		opts.Other[internalConfig.CrossValidateOptionKey{}] = report
+		return nil
+	}
+}
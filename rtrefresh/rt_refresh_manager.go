@@ -41,6 +41,7 @@ type RtRefreshManager struct {
 	enableAutoRefresh   bool                                        // should run periodic refreshes ?
 	refreshKeyGenFnc    func(cpl uint) (string, error)              // generate the key for the query to refresh this cpl
 	refreshQueryFnc     func(ctx context.Context, key string) error // query to run for a refresh.
+	refreshMaxCplFnc    func() (uint, bool)                         // number of cpls worth refreshing, if known
 	refreshQueryTimeout time.Duration                               // timeout for one refresh query
 
 	// interval between two periodic refreshes.
@@ -57,6 +58,7 @@ type RtRefreshManager struct {
 func NewRtRefreshManager(h host.Host, rt *kbucket.RoutingTable, autoRefresh bool,
 	refreshKeyGenFnc func(cpl uint) (string, error),
 	refreshQueryFnc func(ctx context.Context, key string) error,
+	refreshMaxCplFnc func() (uint, bool),
 	refreshQueryTimeout time.Duration,
 	refreshInterval time.Duration,
 	successfulOutboundQueryGracePeriod time.Duration,
@@ -73,6 +75,7 @@ func NewRtRefreshManager(h host.Host, rt *kbucket.RoutingTable, autoRefresh bool
 		enableAutoRefresh: autoRefresh,
 		refreshKeyGenFnc:  refreshKeyGenFnc,
 		refreshQueryFnc:   refreshQueryFnc,
+		refreshMaxCplFnc:  refreshMaxCplFnc,
 
 		refreshQueryTimeout:                refreshQueryTimeout,
 		refreshInterval:                    refreshInterval,
@@ -209,6 +212,13 @@ func (r *RtRefreshManager) doRefresh(forceRefresh bool) error {
 	}
 
 	refreshCpls := r.rt.GetTrackedCplsForRefresh()
+	// The lookup for ourselves already finds the peers of the buckets beyond
+	// the ones worth refreshing, given the size of the network.
+	if r.refreshMaxCplFnc != nil {
+		if maxCpl, ok := r.refreshMaxCplFnc(); ok && uint(len(refreshCpls)) > maxCpl {
+			refreshCpls = refreshCpls[:maxCpl]
+		}
+	}
 
 	rfnc := func(cpl uint) (err error) {
 		if forceRefresh {
@@ -219,6 +229,7 @@ func (r *RtRefreshManager) doRefresh(forceRefresh bool) error {
 		return
 	}
 
+refreshLoop:
 	for c := range refreshCpls {
 		cpl := uint(c)
 		if err := rfnc(cpl); err != nil {
@@ -238,7 +249,7 @@ func (r *RtRefreshManager) doRefresh(forceRefresh bool) error {
 						merr = multierror.Append(merr, err)
 					}
 				}
-				return merr
+				break refreshLoop
 			}
 		}
 	}
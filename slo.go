@@ -0,0 +1,143 @@
+package dht
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"go.opencensus.io/stats"
+	"go.opencensus.io/tag"
+
+	"github.com/libp2p/go-libp2p-kad-dht/metrics"
+)
+
+// The outcomes of the DHT operations, labeling the metrics, see
+// metrics.KeyOutcome.
+const (
+	outcomeSuccess  = "success"
+	outcomeFailure  = "failure"
+	outcomeCanceled = "canceled"
+)
+
+// sloOperations are the operations OperationSLOs reports, in order.
+var sloOperations = []string{opProvide, opFindPeer, opFindProviders, opGetValue, opPutValue}
+
+// sloWindow is the number of the last operations OperationSLOs reports on, per
+// operation.
+const sloWindow = 1024
+
+// OperationSLO describes the success rate and the latency of the last
+// operations of a kind, see OperationSLOs.
+type OperationSLO struct {
+	// Operation is the kind of the operations, e.g. "Provide" or "FindPeer".
+	Operation string
+	// Completed is the number of the operations that weren't canceled, and
+	// Succeeded the number of those that succeeded.
+	Completed, Succeeded int
+	// SuccessRate is Succeeded out of Completed, 1 if none completed.
+	SuccessRate float64
+	// P50, P90 and P99 are the percentiles of the duration of the completed
+	// operations, successful or not.
+	P50, P90, P99 time.Duration
+}
+
+// operationOutcome is the outcome of an operation that wasn't canceled.
+type operationOutcome struct {
+	duration  time.Duration
+	succeeded bool
+}
+
+// operationSLOs tracks the outcomes of the last operations of each kind.
+type operationSLOs struct {
+	mu sync.Mutex
+	// rings of the last outcomes by operation, next being the oldest once full
+	outcomes map[string][]operationOutcome
+	next     map[string]int
+}
+
+func newOperationSLOs() *operationSLOs {
+	return &operationSLOs{
+		outcomes: make(map[string][]operationOutcome),
+		next:     make(map[string]int),
+	}
+}
+
+func (s *operationSLOs) track(op string, o operationOutcome) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	outcomes := s.outcomes[op]
+	if len(outcomes) < sloWindow {
+		s.outcomes[op] = append(outcomes, o)
+		return
+	}
+	outcomes[s.next[op]] = o
+	s.next[op] = (s.next[op] + 1) % sloWindow
+}
+
+func (s *operationSLOs) slo(op string) OperationSLO {
+	s.mu.Lock()
+	outcomes := s.outcomes[op]
+	durations := make([]time.Duration, len(outcomes))
+	slo := OperationSLO{Operation: op, Completed: len(outcomes), SuccessRate: 1}
+	for i, o := range outcomes {
+		durations[i] = o.duration
+		if o.succeeded {
+			slo.Succeeded++
+		}
+	}
+	s.mu.Unlock()
+
+	if len(durations) == 0 {
+		return slo
+	}
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+	percentile := func(p int) time.Duration {
+		// nearest rank
+		return durations[(p*len(durations)+99)/100-1]
+	}
+	slo.SuccessRate = float64(slo.Succeeded) / float64(slo.Completed)
+	slo.P50, slo.P90, slo.P99 = percentile(50), percentile(90), percentile(99)
+	return slo
+}
+
+// recordOperation records the outcome of the operation op, started at start
+// and failed with err if not nil, as the metrics.Operations and
+// metrics.OperationLatency metrics, to alert on its success rate and latency
+// percentiles, and for OperationSLOs. ctx is the context of the operation: the
+// operations it was canceled by the caller of aren't accounted for as failures.
+func (dht *IpfsDHT) recordOperation(ctx context.Context, op string, start time.Time, err error) {
+	elapsed := time.Since(start)
+	outcome := outcomeSuccess
+	switch {
+	case err == nil:
+	case errors.Is(ctx.Err(), context.Canceled):
+		outcome = outcomeCanceled
+	default:
+		outcome = outcomeFailure
+	}
+	_ = stats.RecordWithTags(ctx, []tag.Mutator{tag.Upsert(metrics.KeyOutcome, outcome)},
+		metrics.Operations.M(1),
+		metrics.OperationLatency.M(float64(elapsed)/float64(time.Millisecond)),
+	)
+	if outcome != outcomeCanceled {
+		dht.slos.track(op, operationOutcome{duration: elapsed, succeeded: err == nil})
+	}
+}
+
+// OperationSLOs reports the success rate and the latency percentiles of the
+// last operations of each kind, Provide, FindPeer, FindProviders, GetValue and
+// PutValue, in that order, for alerting. The operations canceled by their
+// callers aren't accounted for. The metrics.Operations and
+// metrics.OperationLatency metrics report them too, for all the operations.
+//
+// FindProviders operations succeed once they find a provider, and fail with
+// routing.ErrNotFound otherwise.
+func (dht *IpfsDHT) OperationSLOs() []OperationSLO {
+	slos := make([]OperationSLO, 0, len(sloOperations))
+	for _, op := range sloOperations {
+		slos = append(slos, dht.slos.slo(op))
+	}
+	return slos
+}
@@ -0,0 +1,51 @@
+package dht
+
+import (
+	"context"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	"github.com/libp2p/go-libp2p-kad-dht/internal/net"
+	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
+)
+
+// providersFrameBytes bounds the size of the providers sent per frame of a
+// streamed GET_PROVIDERS response.
+var providersFrameBytes = 64 << 10
+
+// streamsProviders reports whether our GET_PROVIDERS responses to p are
+// streamed: p reads streamed responses, and its request came in over a stream
+// rather than in a datagram or over HTTP.
+func (dht *IpfsDHT) streamsProviders(ctx context.Context, p peer.ID) bool {
+	if !dht.streamProviders {
+		return false
+	}
+	if _, ok := net.RemoteIP(ctx); ok {
+		return false
+	}
+	caps, ok := pb.PeerCapabilities(dht.peerstore, p)
+	return ok && caps.Has(pb.CapStreamedProviders)
+}
+
+// providerFrames splits resp into frames carrying up to providersFrameBytes of
+// providers each, so that the requester can start using the first providers
+// before the others are serialized. The first frame carries the rest of the
+// response, e.g. the closer peers.
+func providerFrames(resp *pb.Message) []*pb.Message {
+	provs := resp.ProviderPeers
+	frames := []*pb.Message{resp}
+	start, size := 0, 0
+	for i := range provs {
+		size += provs[i].Size()
+		if i > start && size > providersFrameBytes {
+			frames[len(frames)-1].ProviderPeers = provs[start:i]
+			frames = append(frames, &pb.Message{Type: resp.Type, Key: resp.Key, ClusterLevelRaw: resp.ClusterLevelRaw})
+			start, size = i, provs[i].Size()
+		}
+	}
+	frames[len(frames)-1].ProviderPeers = provs[start:]
+	for _, frame := range frames[:len(frames)-1] {
+		frame.MoreFrames = true
+	}
+	return frames
+}
@@ -36,12 +36,10 @@ func newSubscriberNotifiee(dht *IpfsDHT) (*subscriberNotifee, error) {
 		// register for event bus notifications for when our local address/addresses change so we can
 		// advertise those to the network
 		new(event.EvtLocalAddressesUpdated),
-	}
 
-	// register for event bus local routability changes in order to trigger switching between client and server modes
-	// only register for events if the DHT is operating in ModeAuto
-	if dht.auto == ModeAuto || dht.auto == ModeAutoServer {
-		evts = append(evts, new(event.EvtLocalReachabilityChanged))
+		// register for event bus local routability changes in order to trigger switching between client and server modes
+		// when operating in ModeAuto, which SetMode may switch to at any time
+		new(event.EvtLocalReachabilityChanged),
 	}
 
 	subs, err := dht.host.EventBus().Subscribe(evts, bufSize)
@@ -87,12 +85,7 @@ func (nn *subscriberNotifee) subscribe(proc goprocess.Process) {
 			case event.EvtPeerIdentificationCompleted:
 				handlePeerChangeEvent(dht, evt.Peer)
 			case event.EvtLocalReachabilityChanged:
-				if dht.auto == ModeAuto || dht.auto == ModeAutoServer {
-					handleLocalReachabilityChangedEvent(dht, evt)
-				} else {
-					// something has gone really wrong if we get an event we did not subscribe to
-					logger.Errorf("received LocalReachabilityChanged event that was not subscribed to")
-				}
+				handleLocalReachabilityChangedEvent(dht, evt)
 			default:
 				// something has gone really wrong if we get an event for another type
 				logger.Errorf("got wrong type from subscription: %T", e)
@@ -117,24 +110,21 @@ func handlePeerChangeEvent(dht *IpfsDHT, p peer.ID) {
 }
 
 func handleLocalReachabilityChangedEvent(dht *IpfsDHT, e event.EvtLocalReachabilityChanged) {
-	var target mode
-
-	switch e.Reachability {
-	case network.ReachabilityPrivate:
-		target = modeClient
-	case network.ReachabilityUnknown:
-		if dht.auto == ModeAutoServer {
-			target = modeServer
-		} else {
-			target = modeClient
-		}
-	case network.ReachabilityPublic:
-		target = modeServer
+	dht.modeLk.Lock()
+	dht.reachability = e.Reachability
+	if dht.auto != ModeAuto && dht.auto != ModeAutoServer {
+		dht.modeLk.Unlock()
+		return
 	}
+	target := reachabilityMode(dht.auto, e.Reachability)
 
 	logger.Infof("processed event %T; performing dht mode switch", e)
 
-	err := dht.setMode(target)
+	changed, err := dht.switchMode(target)
+	dht.modeLk.Unlock()
+	if changed {
+		dht.modeChanged(target)
+	}
 	// NOTE: the mode will be printed out as a decimal.
 	if err == nil {
 		logger.Infow("switched DHT mode successfully", "mode", target)
@@ -143,6 +133,20 @@ func handleLocalReachabilityChangedEvent(dht *IpfsDHT, e event.EvtLocalReachabil
 	}
 }
 
+// reachabilityMode returns the mode to operate in with the given reachability
+// in the automatic mode auto.
+func reachabilityMode(auto ModeOpt, r network.Reachability) mode {
+	switch r {
+	case network.ReachabilityPublic:
+		return modeServer
+	case network.ReachabilityUnknown:
+		if auto == ModeAutoServer {
+			return modeServer
+		}
+	}
+	return modeClient
+}
+
 // validRTPeer returns true if the peer supports the DHT protocol and false otherwise. Supporting the DHT protocol means
 // supporting the primary protocols, we do not want to add peers that are speaking obsolete secondary protocols to our
 // routing table
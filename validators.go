@@ -0,0 +1,59 @@
+package dht
+
+import (
+	"fmt"
+
+	record "github.com/libp2p/go-libp2p-record"
+)
+
+// Validator returns the validator of the value records currently in use. Use
+// AddValidator and RemoveValidator to change namespaced validators once the DHT
+// is running.
+func (dht *IpfsDHT) Validator() record.Validator {
+	dht.validatorLk.RLock()
+	defer dht.validatorLk.RUnlock()
+	return dht.recordValidator
+}
+
+// AddValidator registers v for records with keys under the `ns` namespace on a
+// running DHT, replacing any validator previously registered for it. Like the
+// NamespacedValidator option, this fails if the DHT is not using a
+// `record.NamespacedValidator`.
+//
+// The validators of DHTs running the default protocol prefix cannot be changed.
+func (dht *IpfsDHT) AddValidator(ns string, v record.Validator) error {
+	return dht.updateValidators(ns, func(nsval record.NamespacedValidator) {
+		nsval[ns] = v
+	})
+}
+
+// RemoveValidator unregisters the validator for the `ns` namespace. Records
+// under that namespace are rejected afterwards.
+func (dht *IpfsDHT) RemoveValidator(ns string) error {
+	return dht.updateValidators(ns, func(nsval record.NamespacedValidator) {
+		delete(nsval, ns)
+	})
+}
+
+func (dht *IpfsDHT) updateValidators(ns string, update func(record.NamespacedValidator)) error {
+	if dht.fixedValidators {
+		return fmt.Errorf("cannot change the validator for namespace %q: protocol prefix %s uses a fixed set of validators", ns, DefaultPrefix)
+	}
+
+	dht.validatorLk.Lock()
+	defer dht.validatorLk.Unlock()
+
+	nsval, ok := dht.recordValidator.(record.NamespacedValidator)
+	if !ok {
+		return fmt.Errorf("can only change namespaced validators of a NamespacedValidator")
+	}
+
+	// copy on write, lookups in flight keep using the validators they started with
+	next := make(record.NamespacedValidator, len(nsval)+1)
+	for k, v := range nsval {
+		next[k] = v
+	}
+	update(next)
+	dht.recordValidator = next
+	return nil
+}
@@ -0,0 +1,87 @@
+package dht
+
+import (
+	"context"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/routing"
+
+	"github.com/libp2p/go-libp2p-kad-dht/qpeerset"
+)
+
+// ValueReport describes the values served for a key by the peers closest to
+// it, see CrossValidate.
+type ValueReport struct {
+	// Values are the distinct valid values found, the selected one first.
+	Values []ServedValue
+	// Missing are the closest peers to the key that answered but had no valid
+	// value for it.
+	Missing []peer.ID
+}
+
+// ServedValue is a value along with the peers that served it.
+type ServedValue struct {
+	Val   []byte
+	Peers []peer.ID
+}
+
+// Divergent reports whether the peers served different values.
+func (r *ValueReport) Divergent() bool {
+	return len(r.Values) > 1
+}
+
+// crossValidateValue fetches the value for key from all the closest peers and
+// fills report with what each of them served. It returns the selected value.
+func (dht *IpfsDHT) crossValidateValue(ctx context.Context, key string, report *ValueReport) ([]byte, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	key = dht.routingKey(key)
+	valCh, lookupResCh := dht.getValues(ctx, key, make(chan struct{}))
+
+	var (
+		values []ServedValue
+		index  = make(map[string]int)
+		served = make(map[peer.ID]struct{})
+	)
+	for v := range valCh {
+		i, ok := index[string(v.Val)]
+		if !ok {
+			i = len(values)
+			index[string(v.Val)] = i
+			values = append(values, ServedValue{Val: v.Val})
+		}
+		values[i].Peers = append(values[i].Peers, v.From)
+		served[v.From] = struct{}{}
+	}
+
+	var missing []peer.ID
+	if lookupRes, ok := <-lookupResCh; ok {
+		for i, p := range lookupRes.peers {
+			if _, ok := served[p]; !ok && lookupRes.state[i] == qpeerset.PeerQueried {
+				missing = append(missing, p)
+			}
+		}
+	}
+
+	if len(values) > 1 {
+		vals := make([][]byte, len(values))
+		for i, v := range values {
+			vals[i] = v.Val
+		}
+		best, err := dht.selectValue(key, vals)
+		if err != nil {
+			return nil, err
+		}
+		values[0], values[best] = values[best], values[0]
+	}
+
+	*report = ValueReport{Values: values, Missing: missing}
+	if len(values) == 0 {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		return nil, routing.ErrNotFound
+	}
+	return values[0].Val, nil
+}
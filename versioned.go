@@ -0,0 +1,199 @@
+package dht
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/libp2p/go-libp2p-core/routing"
+
+	dhtcfg "github.com/libp2p/go-libp2p-kad-dht/internal/config"
+	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
+	record "github.com/libp2p/go-libp2p-record"
+)
+
+// ConflictResolverFunc picks the value to keep among divergent values found for
+// the same key. It returns the index of the chosen value.
+type ConflictResolverFunc = dhtcfg.ConflictResolverFunc
+
+// ErrVersionedValueExpired is returned when validating a versioned value whose
+// validity has passed.
+var ErrVersionedValueExpired = errors.New("versioned value has expired")
+
+// VersionedValue is a value record carrying a sequence number and a validity.
+type VersionedValue struct {
+	Value []byte
+	Seq   uint64
+	// Validity is the time after which the value is no longer valid. The zero
+	// time means the value never expires.
+	Validity time.Time
+}
+
+// MarshalVersionedValue encodes a versioned value so that it can be stored with
+// PutValue.
+func MarshalVersionedValue(v VersionedValue) ([]byte, error) {
+	pv := &pb.VersionedValue{
+		Value: v.Value,
+		Seq:   v.Seq,
+	}
+	if !v.Validity.IsZero() {
+		pv.Validity = v.Validity.UnixNano()
+	}
+	return proto.Marshal(pv)
+}
+
+// UnmarshalVersionedValue decodes a value previously encoded with
+// MarshalVersionedValue.
+func UnmarshalVersionedValue(data []byte) (VersionedValue, error) {
+	pv := new(pb.VersionedValue)
+	if err := proto.Unmarshal(data, pv); err != nil {
+		return VersionedValue{}, err
+	}
+	v := VersionedValue{
+		Value: pv.GetValue(),
+		Seq:   pv.GetSeq(),
+	}
+	if pv.GetValidity() != 0 {
+		v.Validity = time.Unix(0, pv.GetValidity())
+	}
+	return v, nil
+}
+
+func (v VersionedValue) expired(now time.Time) bool {
+	return !v.Validity.IsZero() && now.After(v.Validity)
+}
+
+// VersionedValidator validates values encoded with MarshalVersionedValue. It
+// rejects expired values and prefers the value with the highest sequence
+// number, then the one valid for the longest. Remaining ties are broken by the
+// wrapped Validator, if any, which is also used to validate the inner value.
+//
+// It is meant to be registered for a namespace, e.g.
+// `NamespacedValidator("v", VersionedValidator{Validator: myValidator})`.
+type VersionedValidator struct {
+	Validator record.Validator
+}
+
+var _ record.Validator = VersionedValidator{}
+
+// Validate implements record.Validator.
+func (vv VersionedValidator) Validate(key string, value []byte) error {
+	v, err := UnmarshalVersionedValue(value)
+	if err != nil {
+		return err
+	}
+	if v.expired(time.Now()) {
+		return ErrVersionedValueExpired
+	}
+	if vv.Validator != nil {
+		return vv.Validator.Validate(key, v.Value)
+	}
+	return nil
+}
+
+// Select implements record.Validator.
+func (vv VersionedValidator) Select(key string, values [][]byte) (int, error) {
+	if len(values) == 0 {
+		return 0, errors.New("can't select from no values")
+	}
+
+	decoded := make([]VersionedValue, len(values))
+	for i, val := range values {
+		v, err := UnmarshalVersionedValue(val)
+		if err != nil {
+			return 0, err
+		}
+		decoded[i] = v
+	}
+
+	best := []int{0}
+	for i := 1; i < len(decoded); i++ {
+		switch compareVersions(decoded[i], decoded[best[0]]) {
+		case 1:
+			best = []int{i}
+		case 0:
+			best = append(best, i)
+		}
+	}
+
+	if len(best) == 1 || vv.Validator == nil {
+		return best[0], nil
+	}
+
+	inner := make([][]byte, len(best))
+	for i, idx := range best {
+		inner[i] = decoded[idx].Value
+	}
+	sel, err := vv.Validator.Select(key, inner)
+	if err != nil {
+		return 0, err
+	}
+	return best[sel], nil
+}
+
+// compareVersions returns 1 if a is newer than b, -1 if it is older and 0 if
+// neither can be preferred by version alone.
+func compareVersions(a, b VersionedValue) int {
+	switch {
+	case a.Seq > b.Seq:
+		return 1
+	case a.Seq < b.Seq:
+		return -1
+	case a.Validity.Equal(b.Validity):
+		return 0
+	case a.Validity.IsZero():
+		return 1
+	case b.Validity.IsZero():
+		return -1
+	case a.Validity.After(b.Validity):
+		return 1
+	default:
+		return -1
+	}
+}
+
+// PutVersionedValue stores value under key tagged with the given sequence
+// number and validity. The key's namespace must be validated by a
+// VersionedValidator.
+func (dht *IpfsDHT) PutVersionedValue(ctx context.Context, key string, value []byte, seq uint64, validity time.Time, opts ...routing.Option) error {
+	data, err := MarshalVersionedValue(VersionedValue{Value: value, Seq: seq, Validity: validity})
+	if err != nil {
+		return err
+	}
+	return dht.PutValue(ctx, key, data, opts...)
+}
+
+// GetVersionedValue searches for the versioned value stored under key. When
+// divergent versions are found across peers the configured conflict resolver
+// (see ValueConflictResolver) decides which one is returned.
+func (dht *IpfsDHT) GetVersionedValue(ctx context.Context, key string, opts ...routing.Option) (VersionedValue, error) {
+	data, err := dht.GetValue(ctx, key, opts...)
+	if err != nil {
+		return VersionedValue{}, err
+	}
+	return UnmarshalVersionedValue(data)
+}
+
+// selectValue picks the best of vals using the conflict resolver if one has been
+// configured and the validator otherwise. An error is returned if the index
+// picked is out of range.
+func (dht *IpfsDHT) selectValue(key string, vals [][]byte) (int, error) {
+	var (
+		best int
+		err  error
+	)
+	if dht.conflictResolver != nil {
+		best, err = dht.conflictResolver(key, vals)
+	} else {
+		best, err = dht.Validator().Select(key, vals)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if best < 0 || best >= len(vals) {
+		return 0, fmt.Errorf("selected value %d out of %d", best, len(vals))
+	}
+	return best, nil
+}
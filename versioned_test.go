@@ -0,0 +1,142 @@
+package dht
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	u "github.com/ipfs/go-ipfs-util"
+	record "github.com/libp2p/go-libp2p-record"
+	"github.com/stretchr/testify/require"
+)
+
+func mustMarshalVersioned(t *testing.T, v VersionedValue) []byte {
+	t.Helper()
+	data, err := MarshalVersionedValue(v)
+	require.NoError(t, err)
+	return data
+}
+
+func TestVersionedValueRoundTrip(t *testing.T) {
+	validity := time.Unix(0, time.Now().Add(time.Hour).UnixNano())
+	in := VersionedValue{Value: []byte("hello"), Seq: 7, Validity: validity}
+
+	out, err := UnmarshalVersionedValue(mustMarshalVersioned(t, in))
+	require.NoError(t, err)
+	require.Equal(t, in.Value, out.Value)
+	require.Equal(t, in.Seq, out.Seq)
+	require.True(t, in.Validity.Equal(out.Validity))
+
+	out, err = UnmarshalVersionedValue(mustMarshalVersioned(t, VersionedValue{Value: []byte("forever")}))
+	require.NoError(t, err)
+	require.True(t, out.Validity.IsZero())
+}
+
+func TestVersionedValidator(t *testing.T) {
+	vv := VersionedValidator{}
+
+	expired := mustMarshalVersioned(t, VersionedValue{Value: []byte("a"), Seq: 5, Validity: time.Now().Add(-time.Minute)})
+	require.Equal(t, ErrVersionedValueExpired, vv.Validate("/v/k", expired))
+
+	soon := mustMarshalVersioned(t, VersionedValue{Value: []byte("b"), Seq: 2, Validity: time.Now().Add(time.Minute)})
+	later := mustMarshalVersioned(t, VersionedValue{Value: []byte("c"), Seq: 2, Validity: time.Now().Add(time.Hour)})
+	never := mustMarshalVersioned(t, VersionedValue{Value: []byte("d"), Seq: 2})
+	newer := mustMarshalVersioned(t, VersionedValue{Value: []byte("e"), Seq: 3, Validity: time.Now().Add(time.Minute)})
+	require.NoError(t, vv.Validate("/v/k", soon))
+
+	i, err := vv.Select("/v/k", [][]byte{soon, later})
+	require.NoError(t, err)
+	require.Equal(t, 1, i)
+
+	i, err = vv.Select("/v/k", [][]byte{later, never, soon})
+	require.NoError(t, err)
+	require.Equal(t, 1, i)
+
+	i, err = vv.Select("/v/k", [][]byte{never, newer, later})
+	require.NoError(t, err)
+	require.Equal(t, 1, i)
+
+	_, err = vv.Select("/v/k", [][]byte{soon, []byte("not a versioned value")})
+	require.Error(t, err)
+}
+
+func TestGetVersionedValueConflict(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var resolved int
+	lowestSeq := func(key string, vals [][]byte) (int, error) {
+		resolved++
+		best := 0
+		for i := range vals {
+			v, err := UnmarshalVersionedValue(vals[i])
+			if err != nil {
+				return 0, err
+			}
+			b, _ := UnmarshalVersionedValue(vals[best])
+			if v.Seq < b.Seq {
+				best = i
+			}
+		}
+		return best, nil
+	}
+
+	dhtA := setupDHT(ctx, t, false)
+	dhtB := setupDHT(ctx, t, false)
+	dhtC := setupDHT(ctx, t, false, ValueConflictResolver(lowestSeq))
+	dhts := []*IpfsDHT{dhtA, dhtB, dhtC}
+	for _, d := range dhts {
+		defer d.Close()
+		defer d.host.Close()
+		d.recordValidator.(record.NamespacedValidator)["v"] = VersionedValidator{}
+	}
+
+	connect(t, ctx, dhtA, dhtB)
+	connect(t, ctx, dhtB, dhtC)
+	connect(t, ctx, dhtA, dhtC)
+
+	// store divergent versions on A and B without replicating them
+	for i, d := range []*IpfsDHT{dhtA, dhtB} {
+		rec := record.MakePutRecord("/v/hello", mustMarshalVersioned(t, VersionedValue{
+			Value: []byte("value"),
+			Seq:   uint64(i + 1),
+		}))
+		rec.TimeReceived = u.FormatRFC3339(time.Now())
+		require.NoError(t, d.putLocal(ctx, "/v/hello", rec))
+	}
+
+	ctxT, cancelT := context.WithTimeout(ctx, 5*time.Second)
+	defer cancelT()
+
+	v, err := dhtA.GetVersionedValue(ctxT, "/v/hello")
+	require.NoError(t, err)
+	require.EqualValues(t, 2, v.Seq)
+
+	v, err = dhtC.GetVersionedValue(ctxT, "/v/hello")
+	require.NoError(t, err)
+	require.EqualValues(t, 1, v.Seq)
+	require.NotZero(t, resolved)
+
+	// cross-validated lookups pick the same value
+	var report ValueReport
+	data, err := dhtC.GetValue(ctxT, "/v/hello", CrossValidate(&report))
+	require.NoError(t, err)
+	v, err = UnmarshalVersionedValue(data)
+	require.NoError(t, err)
+	require.EqualValues(t, 1, v.Seq)
+	require.Equal(t, data, report.Values[0].Val)
+}
+
+func TestSelectValueOutOfRange(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d := setupDHT(ctx, t, false, ValueConflictResolver(func(key string, vals [][]byte) (int, error) {
+		return len(vals), nil
+	}))
+	defer d.Close()
+	defer d.host.Close()
+
+	_, err := d.selectValue("/v/hello", [][]byte{[]byte("a"), []byte("b")})
+	require.Error(t, err)
+}